@@ -0,0 +1,129 @@
+// Package bencode implements the encoding of the BitTorrent protocol, used by
+// torrent files, tracker responses, the extension protocol and the DHT.
+//
+// Marshal and Unmarshal map Go values to bencoded values the way
+// encoding/json does: integers to integers, strings and byte slices or arrays
+// to strings, slices and arrays to lists, maps with string keys and structs to
+// dictionaries. The key of a struct field is its name unless its tag gives
+// another one, as in `bencode:"piece length"`. The omitempty option leaves out
+// the zero values, and the "-" tag ignores the field. Dictionary keys are
+// written in sorted order as the specification requires.
+//
+// Decoding into an empty interface gives int64, string, []interface{} and
+// map[string]interface{} values. RawMessage keeps a value as it was encoded,
+// such as the info dictionary of a torrent whose hash identifies it.
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrSyntax is returned when decoding data that is not valid bencode
+	ErrSyntax = errors.New("bencode: syntax error")
+	// ErrType is returned when a bencoded value does not fit the Go value it
+	// is decoded into. The other values are still decoded.
+	ErrType = errors.New("bencode: type mismatch")
+	// ErrUnsupportedType is returned when encoding a value that has no
+	// bencoded equivalent, such as a float or a nil pointer
+	ErrUnsupportedType = errors.New("bencode: unsupported type")
+	// ErrInvalidTarget is returned when decoding into a value that is not a
+	// non-nil pointer
+	ErrInvalidTarget = errors.New("bencode: decoding into a non-pointer or nil value")
+)
+
+// Marshaler is implemented by the types encoding themselves. MarshalBencode
+// returns a single valid bencoded value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by the types decoding themselves.
+// UnmarshalBencode receives a single bencoded value, which it must copy to
+// keep it after returning.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// RawMessage is a raw encoded value. It delays the decoding of a value, or
+// keeps its exact encoding, e.g. to hash it.
+type RawMessage []byte
+
+// MarshalBencode returns m as the encoding of m
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, fmt.Errorf("%w: empty RawMessage", ErrUnsupportedType)
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets m to a copy of data
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// field is an encoded field of a struct
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// fieldCache holds the fields of the struct types by type, sorted by name
+var fieldCache sync.Map
+
+// structFields returns the encoded fields of a struct type, sorted by name
+func structFields(t reflect.Type) []field {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.IndexByte(tag, ','); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// fieldByName returns the field of a struct named key, or else the one whose
+// name matches key regardless of case
+func fieldByName(fields []field, key string) (field, bool) {
+	for _, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
@@ -0,0 +1,493 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// maxDepth is the deepest nesting of lists and dictionaries decoded
+	maxDepth = 1000
+	// maxDigits is the longest integer or string length decoded
+	maxDigits = 20
+)
+
+// Unmarshal decodes the single bencoded value of data into the value pointed
+// to by v, allocating the maps, slices and pointers as needed. The keys of a
+// dictionary are matched to the fields of a struct by name, or else regardless
+// of case, and the ones without a field are ignored. A value that does not fit
+// is skipped, and an ErrType error is returned once the others are decoded.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrInvalidTarget
+	}
+	d := decodeState{data: data}
+	err := d.value(rv, 0)
+	if err != nil {
+		return err
+	}
+	if d.off != len(data) {
+		return d.syntaxError("data after the value")
+	}
+	return d.typeErr
+}
+
+// Decoder reads encoded values from a stream
+type Decoder struct {
+	r byteReader
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// NewDecoder returns a decoder reading from r. The decoder does not read past
+// the values it decodes if r is an io.ByteReader, so that the data following
+// them, such as the piece of a ut_metadata message, can still be read from r.
+// Otherwise, it buffers r.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decode reads the next value and decodes it into v, see Unmarshal. It returns
+// io.EOF when there is no value left.
+func (dec *Decoder) Decode(v interface{}) error {
+	data, err := dec.read()
+	if err != nil {
+		return err
+	}
+	return Unmarshal(data, v)
+}
+
+// read reads the bytes of the next value
+func (dec *Decoder) read() ([]byte, error) {
+	var buf bytes.Buffer
+	depth := 0
+	for {
+		c, err := dec.r.ReadByte()
+		if err == io.EOF && buf.Len() > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(c)
+
+		switch {
+		case c == 'l' || c == 'd':
+			depth++
+			if depth > maxDepth {
+				return nil, fmt.Errorf("%w: exceeded max depth", ErrSyntax)
+			}
+			continue
+		case c == 'e' && depth > 0:
+			depth--
+		case c == 'i':
+			err = dec.readUntil(&buf, 'e')
+		case c >= '0' && c <= '9':
+			start := buf.Len() - 1
+			err = dec.readUntil(&buf, ':')
+			if err != nil {
+				return nil, err
+			}
+			digits := buf.Bytes()[start : buf.Len()-1]
+			var n int
+			n, err = strconv.Atoi(string(digits))
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid string length %q", ErrSyntax, digits)
+			}
+			_, err = io.CopyN(&buf, dec.r, int64(n))
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		default:
+			return nil, fmt.Errorf("%w: invalid character %q", ErrSyntax, c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if depth == 0 {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// readUntil copies the bytes of an integer or of a string length to buf, up
+// to and including delim
+func (dec *Decoder) readUntil(buf *bytes.Buffer, delim byte) error {
+	for i := 0; i <= maxDigits+1; i++ {
+		c, err := dec.r.ReadByte()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(c)
+		if c == delim {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: number too long", ErrSyntax)
+}
+
+// decodeState decodes a bencoded value, d.off being the offset of the next
+// byte to decode
+type decodeState struct {
+	data    []byte
+	off     int
+	typeErr error // first value that did not fit
+}
+
+func (d *decodeState) syntaxError(msg string) error {
+	return fmt.Errorf("%w at offset %d: %s", ErrSyntax, d.off, msg)
+}
+
+func (d *decodeState) typeError(what string, t reflect.Type) {
+	if d.typeErr == nil {
+		d.typeErr = fmt.Errorf("%w: cannot decode %s at offset %d into %s", ErrType, what, d.off, t)
+	}
+}
+
+// peek returns the next byte to decode
+func (d *decodeState) peek() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, d.syntaxError("unexpected end of data")
+	}
+	return d.data[d.off], nil
+}
+
+// value decodes the next value into v
+func (d *decodeState) value(v reflect.Value, depth int) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	u, v := indirect(v)
+	if u != nil {
+		start := d.off
+		d.off, err = d.skip(d.off, depth)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalBencode(d.data[start:d.off])
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		x, err := d.generic(depth)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+	}
+
+	switch {
+	case c == 'i':
+		return d.integer(v)
+	case c >= '0' && c <= '9':
+		return d.string(v)
+	case c == 'l':
+		return d.list(v, depth)
+	case c == 'd':
+		return d.dict(v, depth)
+	}
+	return d.syntaxError(fmt.Sprintf("invalid character %q", c))
+}
+
+// indirect allocates the nil pointers of v, and returns the Unmarshaler they
+// lead to if any, else the value they point to
+func indirect(v reflect.Value) (Unmarshaler, reflect.Value) {
+	for {
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			if e := v.Elem(); e.Kind() == reflect.Ptr && !e.IsNil() {
+				v = e
+				continue
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(unmarshalerType) {
+				return v.Addr().Interface().(Unmarshaler), v
+			}
+			return nil, v
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().Implements(unmarshalerType) {
+			return v.Interface().(Unmarshaler), v
+		}
+		v = v.Elem()
+	}
+}
+
+// skip returns the end offset of the value at off
+func (d *decodeState) skip(off, depth int) (int, error) {
+	if off >= len(d.data) {
+		return 0, fmt.Errorf("%w at offset %d: unexpected end of data", ErrSyntax, off)
+	}
+	switch c := d.data[off]; {
+	case c == 'i':
+		_, end, err := d.scanInt(off)
+		return end, err
+	case c >= '0' && c <= '9':
+		_, end, err := d.scanString(off)
+		return end, err
+	case c == 'l' || c == 'd':
+		if depth >= maxDepth {
+			return 0, fmt.Errorf("%w at offset %d: exceeded max depth", ErrSyntax, off)
+		}
+		off++
+		// the keys of dictionaries are followed by values, not by their end
+		for i := 0; off >= len(d.data) || d.data[off] != 'e' || (c == 'd' && i%2 == 1); i++ {
+			var err error
+			if c == 'd' && i%2 == 0 {
+				_, off, err = d.scanString(off)
+			} else {
+				off, err = d.skip(off, depth+1)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return off + 1, nil
+	default:
+		return 0, fmt.Errorf("%w at offset %d: invalid character %q", ErrSyntax, off, c)
+	}
+}
+
+// scanInt returns the digits and the end offset of the integer at off
+func (d *decodeState) scanInt(off int) (string, int, error) {
+	end := bytes.IndexByte(d.data[off:], 'e')
+	if end < 0 {
+		return "", 0, fmt.Errorf("%w at offset %d: unterminated integer", ErrSyntax, off)
+	}
+	s := string(d.data[off+1 : off+end])
+	digits := s
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 || len(digits) > maxDigits || !isDigits(digits) {
+		return "", 0, fmt.Errorf("%w at offset %d: invalid integer %q", ErrSyntax, off, s)
+	}
+	return s, off + end + 1, nil
+}
+
+// scanString returns the bytes and the end offset of the string at off
+func (d *decodeState) scanString(off int) ([]byte, int, error) {
+	colon := bytes.IndexByte(d.data[off:], ':')
+	if colon < 0 {
+		return nil, 0, fmt.Errorf("%w at offset %d: expected a string", ErrSyntax, off)
+	}
+	digits := string(d.data[off : off+colon])
+	if len(digits) == 0 || len(digits) > maxDigits || !isDigits(digits) {
+		return nil, 0, fmt.Errorf("%w at offset %d: invalid string length %q", ErrSyntax, off, digits)
+	}
+	n, err := strconv.Atoi(digits)
+	start := off + colon + 1
+	if err != nil || n > len(d.data)-start {
+		return nil, 0, fmt.Errorf("%w at offset %d: string length %s past the end of data", ErrSyntax, off, digits)
+	}
+	return d.data[start : start+n], start + n, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *decodeState) integer(v reflect.Value) error {
+	s, end, err := d.scanInt(d.off)
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			d.typeError("integer "+s, v.Type())
+			break
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			d.typeError("integer "+s, v.Type())
+			break
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		v.SetBool(s != "0" && s != "-0")
+	default:
+		d.typeError("integer", v.Type())
+	}
+	d.off = end
+	return nil
+}
+
+func (d *decodeState) string(v reflect.Value) error {
+	s, end, err := d.scanString(d.off)
+	if err != nil {
+		return err
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(append([]byte(nil), s...))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(s):
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		d.typeError("string", v.Type())
+	}
+	d.off = end
+	return nil
+}
+
+func (d *decodeState) list(v reflect.Value, depth int) error {
+	if depth >= maxDepth {
+		return d.syntaxError("exceeded max depth")
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		d.typeError("list", v.Type())
+		end, err := d.skip(d.off, depth)
+		d.off = end
+		return err
+	}
+	if v.Kind() == reflect.Slice {
+		if v.IsNil() {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		}
+		v.SetLen(0)
+	}
+
+	d.off++
+	i := 0
+	for ; ; i++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			break
+		}
+		switch {
+		case v.Kind() == reflect.Slice:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.value(elem, depth+1)
+			v.Set(reflect.Append(v, elem))
+		case i < v.Len():
+			err = d.value(v.Index(i), depth+1)
+		default:
+			d.off, err = d.skip(d.off, depth+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for ; v.Kind() == reflect.Array && i < v.Len(); i++ {
+		v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+	}
+	d.off++
+	return nil
+}
+
+func (d *decodeState) dict(v reflect.Value, depth int) error {
+	if depth >= maxDepth {
+		return d.syntaxError("exceeded max depth")
+	}
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case v.Kind() == reflect.Struct:
+	default:
+		d.typeError("dictionary", v.Type())
+		end, err := d.skip(d.off, depth)
+		d.off = end
+		return err
+	}
+
+	d.off++
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			break
+		}
+		key, end, err := d.scanString(d.off)
+		if err != nil {
+			return err
+		}
+		d.off = end
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.value(elem, depth+1)
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+		} else if f, ok := fieldByName(structFields(v.Type()), string(key)); ok {
+			err = d.value(v.Field(f.index), depth+1)
+		} else {
+			d.off, err = d.skip(d.off, depth+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	d.off++
+	return nil
+}
+
+// generic decodes the next value into an int64, a string, a []interface{} or
+// a map[string]interface{}
+func (d *decodeState) generic(depth int) (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		s, end, err := d.scanInt(d.off)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			d.typeError("integer "+s, reflect.TypeOf(n))
+		}
+		d.off = end
+		return n, nil
+	case c >= '0' && c <= '9':
+		s, end, err := d.scanString(d.off)
+		if err != nil {
+			return nil, err
+		}
+		d.off = end
+		return string(s), nil
+	case c == 'l':
+		list := []interface{}{}
+		err = d.list(reflect.ValueOf(&list).Elem(), depth)
+		return list, err
+	case c == 'd':
+		dict := map[string]interface{}{}
+		err = d.dict(reflect.ValueOf(&dict).Elem(), depth)
+		return dict, err
+	}
+	return nil, d.syntaxError(fmt.Sprintf("invalid character %q", c))
+}
@@ -0,0 +1,157 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshal(t *testing.T) {
+	var info testInfo
+	err := Unmarshal([]byte("d5:filesld6:lengthi1e4:pathl1:a1:beee4:name1:n12:piece lengthi2e6:pieces1:x7:privatei1e7:unknownli1ee8:untaggedi3ee"), &info)
+	assert.Nil(t, err)
+	assert.Equal(t, testInfo{
+		Pieces:      "x",
+		PieceLength: 2,
+		Name:        "n",
+		Files:       []testFile{{Length: 1, Path: []string{"a", "b"}}},
+		Private:     true,
+		Untagged:    3,
+	}, info)
+
+	var hash [3]byte
+	assert.Nil(t, Unmarshal([]byte("3:abc"), &hash))
+	assert.Equal(t, [3]byte{'a', 'b', 'c'}, hash)
+
+	var b []byte
+	assert.Nil(t, Unmarshal([]byte("2:\x00\x01"), &b))
+	assert.Equal(t, []byte{0, 1}, b)
+
+	var m map[string]*int
+	assert.Nil(t, Unmarshal([]byte("d1:ai1e1:bi-2ee"), &m))
+	require.Len(t, m, 2)
+	assert.Equal(t, 1, *m["a"])
+	assert.Equal(t, -2, *m["b"])
+
+	var list [2]string
+	assert.Nil(t, Unmarshal([]byte("l1:a1:b1:ce"), &list))
+	assert.Equal(t, [2]string{"a", "b"}, list)
+}
+
+func TestUnmarshalGeneric(t *testing.T) {
+	var v interface{}
+	err := Unmarshal([]byte("d1:ai1e1:bl1:xi-2ee1:cdee"), &v)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"a": int64(1),
+		"b": []interface{}{"x", int64(-2)},
+		"c": map[string]interface{}{},
+	}, v)
+
+	var args struct {
+		ID string `bencode:"id"`
+	}
+	msg := struct {
+		A interface{} `bencode:"a"`
+	}{A: &args}
+	assert.Nil(t, Unmarshal([]byte("d1:ad2:id3:abcee"), &msg))
+	assert.Equal(t, "abc", args.ID)
+}
+
+func TestUnmarshalRawMessage(t *testing.T) {
+	var torrent struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+	err := Unmarshal([]byte("d8:announce3:url4:infod4:name1:n3:zzzi1eee"), &torrent)
+	assert.Nil(t, err)
+	assert.Equal(t, "url", torrent.Announce)
+	assert.Equal(t, RawMessage("d4:name1:n3:zzzi1ee"), torrent.Info)
+
+	buf, err := Marshal(torrent)
+	assert.Nil(t, err)
+	assert.Equal(t, "d8:announce3:url4:infod4:name1:n3:zzzi1eee", string(buf))
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	var resp struct {
+		Interval int    `bencode:"interval"`
+		Peers    string `bencode:"peers"`
+		Small    int8   `bencode:"small"`
+	}
+	err := Unmarshal([]byte("d8:intervali900e5:peersld2:ip1:xee5:smalli300ee"), &resp)
+	assert.True(t, errors.Is(err, ErrType))
+	assert.Equal(t, 900, resp.Interval)
+	assert.Equal(t, "", resp.Peers)
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		err   error
+	}{
+		"empty":              {"", ErrSyntax},
+		"invalid character":  {"x", ErrSyntax},
+		"unterminated int":   {"i12", ErrSyntax},
+		"empty int":          {"ie", ErrSyntax},
+		"invalid int":        {"i1-2e", ErrSyntax},
+		"short string":       {"5:abc", ErrSyntax},
+		"invalid length":     {"-1:a", ErrSyntax},
+		"unterminated list":  {"li1e", ErrSyntax},
+		"integer key":        {"di1ei2ee", ErrSyntax},
+		"missing value":      {"d1:ae", ErrSyntax},
+		"trailing data":      {"i1ei2e", ErrSyntax},
+		"too deep":           {strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1), ErrSyntax},
+		"string into int":    {"1:a", ErrType},
+		"overflowing int":    {"i99999999999999999999e", ErrType},
+		"dict into list":     {"de", ErrType},
+		"list into int":      {"le", ErrType},
+		"skipped list error": {"l1:ai1", ErrSyntax},
+	}
+
+	for name, test := range tests {
+		var v int
+		err := Unmarshal([]byte(test.input), &v)
+		assert.True(t, errors.Is(err, test.err), name)
+	}
+
+	var v int
+	assert.Equal(t, ErrInvalidTarget, Unmarshal([]byte("i1e"), v))
+	assert.Equal(t, ErrInvalidTarget, Unmarshal([]byte("i1e"), (*int)(nil)))
+}
+
+func TestDecoder(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("d8:msg_typei1e5:piecei0eepiece data"))
+	var msg struct {
+		MsgType int `bencode:"msg_type"`
+		Piece   int `bencode:"piece"`
+	}
+	assert.Nil(t, NewDecoder(r).Decode(&msg))
+	assert.Equal(t, 1, msg.MsgType)
+	rest, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "piece data", string(rest))
+
+	dec := NewDecoder(bytes.NewBufferString("i1e3:abcl2:abei2"))
+	var n int
+	var s string
+	var l []string
+	assert.Nil(t, dec.Decode(&n))
+	assert.Nil(t, dec.Decode(&s))
+	assert.Nil(t, dec.Decode(&l))
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "abc", s)
+	assert.Equal(t, []string{"ab"}, l)
+	assert.Equal(t, io.ErrUnexpectedEOF, dec.Decode(&n))
+	assert.Equal(t, io.EOF, dec.Decode(&n))
+
+	err = NewDecoder(strings.NewReader("x")).Decode(&n)
+	assert.True(t, errors.Is(err, ErrSyntax))
+}
@@ -0,0 +1,97 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Pieces      string     `bencode:"pieces"`
+	PieceLength int        `bencode:"piece length"`
+	Name        string     `bencode:"name"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Private     bool       `bencode:"private,omitempty"`
+	Ignored     string     `bencode:"-"`
+	Untagged    int
+	unexported  int
+}
+
+func TestMarshal(t *testing.T) {
+	tests := map[string]struct {
+		input  interface{}
+		output string
+	}{
+		"integer":          {42, "i42e"},
+		"negative integer": {int8(-3), "i-3e"},
+		"unsigned integer": {uint64(1 << 63), "i9223372036854775808e"},
+		"true":             {true, "i1e"},
+		"false":            {false, "i0e"},
+		"string":           {"spam", "4:spam"},
+		"empty string":     {"", "0:"},
+		"bytes":            {[]byte{0, 1}, "2:\x00\x01"},
+		"byte array":       {[3]byte{'a', 'b', 'c'}, "3:abc"},
+		"list":             {[]interface{}{"spam", 42}, "l4:spami42ee"},
+		"nil list":         {[]string(nil), "le"},
+		"map":              {map[string]int{"b": 2, "a": 1}, "d1:ai1e1:bi2ee"},
+		"pointer":          {&testFile{Length: 1, Path: []string{"a"}}, "d6:lengthi1e4:pathl1:aee"},
+		"raw message":      {RawMessage("i1e"), "i1e"},
+		"struct": {
+			testInfo{Pieces: "x", PieceLength: 2, Name: "n", Ignored: "i", Untagged: 3, unexported: 4},
+			"d8:Untaggedi3e4:name1:n12:piece lengthi2e6:pieces1:xe",
+		},
+		"struct omitempty": {
+			testInfo{Files: []testFile{{1, []string{"a"}}}, Private: true},
+			"d8:Untaggedi0e5:filesld6:lengthi1e4:pathl1:aeee4:name0:12:piece lengthi0e6:pieces0:7:privatei1ee",
+		},
+		"nil fields": {
+			struct {
+				A *int        `bencode:"a"`
+				B interface{} `bencode:"b"`
+				C RawMessage  `bencode:"c,omitempty"`
+			}{},
+			"de",
+		},
+	}
+
+	for name, test := range tests {
+		output, err := Marshal(test.input)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, string(output), name)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := map[string]struct {
+		input interface{}
+		err   error
+	}{
+		"float":             {1.5, ErrUnsupportedType},
+		"nil":               {nil, ErrUnsupportedType},
+		"nil pointer":       {(*int)(nil), ErrUnsupportedType},
+		"integer keys":      {map[int]int{1: 1}, ErrUnsupportedType},
+		"empty raw message": {RawMessage(nil), ErrUnsupportedType},
+		"invalid raw":       {RawMessage("i1ei2e"), ErrSyntax},
+		"nested":            {[]interface{}{"a", func() {}}, ErrUnsupportedType},
+	}
+
+	for name, test := range tests {
+		_, err := Marshal(test.input)
+		assert.True(t, errors.Is(err, test.err), name)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	assert.Nil(t, enc.Encode(1))
+	assert.Nil(t, enc.Encode("a"))
+	assert.Equal(t, "i1e1:a", buf.String())
+}
@@ -1,8 +1,42 @@
 package bitfield
 
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrLength is returned when a bitfield does not have one bit per piece
+	ErrLength = errors.New("bitfield has the wrong length")
+	// ErrSpareBits is returned when a bit past the last piece is set
+	ErrSpareBits = errors.New("bitfield has spare bits set")
+)
+
 // Bitfield represents the pieces a peer has
 type Bitfield []byte
 
+// Length returns the length in bytes of the bitfield of numPieces pieces
+func Length(numPieces int) int {
+	return (numPieces + 7) / 8
+}
+
+// New returns a bitfield of numPieces pieces with none set
+func New(numPieces int) Bitfield {
+	return make(Bitfield, Length(numPieces))
+}
+
+// Validate checks that the bitfield has the length of numPieces pieces,
+// with the spare bits past the last piece cleared, as the peers must send it
+func (bf Bitfield) Validate(numPieces int) error {
+	if len(bf) != Length(numPieces) {
+		return fmt.Errorf("%w: %d bytes, expected %d", ErrLength, len(bf), Length(numPieces))
+	}
+	if spare := numPieces % 8; spare != 0 && bf[len(bf)-1]&(0xff>>uint(spare)) != 0 {
+		return ErrSpareBits
+	}
+	return nil
+}
+
 // HasPiece tells if a bitfield has a particular index set
 func (bf Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
@@ -24,3 +58,15 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << uint(7-offset)
 }
+
+// ClearPiece clears a bit in the bitfield
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+
+	// silently discard invalid bounded index
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << uint(7-offset)
+}
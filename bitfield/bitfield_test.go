@@ -1,6 +1,7 @@
 package bitfield
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -47,3 +48,43 @@ func TestSetPiece(t *testing.T) {
 		assert.Equal(t, test.outpt, bf)
 	}
 }
+
+func TestClearPiece(t *testing.T) {
+	bf := Bitfield{0b01010100, 0b01010100}
+	bf.ClearPiece(1)  // cleared
+	bf.ClearPiece(2)  // noop
+	bf.ClearPiece(19) // out of bounds
+	assert.Equal(t, Bitfield{0b00010100, 0b01010100}, bf)
+}
+
+func TestLength(t *testing.T) {
+	assert.Equal(t, 0, Length(0))
+	assert.Equal(t, 1, Length(1))
+	assert.Equal(t, 1, Length(8))
+	assert.Equal(t, 2, Length(9))
+	assert.Len(t, New(9), 2)
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		input  Bitfield
+		pieces int
+		err    error
+	}{
+		"valid":              {Bitfield{0b11111111, 0b11000000}, 10, nil},
+		"whole bytes":        {Bitfield{0b11111111, 0b11111111}, 16, nil},
+		"too short":          {Bitfield{0b11111111}, 10, ErrLength},
+		"too long":           {Bitfield{0b11111111, 0, 0}, 10, ErrLength},
+		"spare bit set":      {Bitfield{0b11111111, 0b11100000}, 10, ErrSpareBits},
+		"last spare bit set": {Bitfield{0, 0b00000001}, 10, ErrSpareBits},
+	}
+
+	for name, test := range tests {
+		err := test.input.Validate(test.pieces)
+		if test.err == nil {
+			assert.Nil(t, err, name)
+		} else {
+			assert.True(t, errors.Is(err, test.err), name)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package blocklist holds the ranges of IP addresses peers must not be
+// connected to nor accepted from, loaded from PeerGuardian (.p2p) or CIDR
+// lists.
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidRange is returned when parsing or adding an invalid range
+var ErrInvalidRange = errors.New("invalid IP range")
+
+// Range is an inclusive range of IP addresses of the same family
+type Range struct {
+	First net.IP
+	Last  net.IP
+}
+
+func (r Range) String() string {
+	if r.First.Equal(r.Last) {
+		return r.First.String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// ParseRange parses a range written as a CIDR block (192.0.2.0/24), as its
+// first and last addresses (192.0.2.0-192.0.2.255), or as a single address
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	var r Range
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return Range{}, fmt.Errorf("%w: %s", ErrInvalidRange, s)
+		}
+		r.First = ipNet.IP
+		r.Last = make(net.IP, len(ipNet.IP))
+		for i := range ipNet.IP {
+			r.Last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+		}
+	} else if i := strings.IndexByte(s, '-'); i >= 0 {
+		r.First, r.Last = parseIP(s[:i]), parseIP(s[i+1:])
+	} else {
+		r.First = parseIP(s)
+		r.Last = r.First
+	}
+	if _, _, err := r.keys(); err != nil {
+		return Range{}, fmt.Errorf("%w: %s", err, s)
+	}
+	return r, nil
+}
+
+// parseIP parses an address, accepting the leading zeros of the IPv4
+// addresses of PeerGuardian lists such as 001.002.003.004
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip
+}
+
+// key is an address as a comparable value, IPv4 addresses being mapped to
+// IPv6 ones
+type key [net.IPv6len]byte
+
+func keyOf(ip net.IP) (key, bool) {
+	var k key
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return k, false
+	}
+	copy(k[:], ip16)
+	return k, true
+}
+
+func (k key) less(o key) bool {
+	return bytes.Compare(k[:], o[:]) < 0
+}
+
+// next returns the address following k, and false if k is the last one
+func (k key) next() (key, bool) {
+	for i := len(k) - 1; i >= 0; i-- {
+		k[i]++
+		if k[i] != 0 {
+			return k, true
+		}
+	}
+	return k, false
+}
+
+// prev returns the address preceding k, and false if k is the first one
+func (k key) prev() (key, bool) {
+	for i := len(k) - 1; i >= 0; i-- {
+		k[i]--
+		if k[i] != 0xff {
+			return k, true
+		}
+	}
+	return k, false
+}
+
+func (k key) ip() net.IP {
+	ip := net.IP(append([]byte(nil), k[:]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// keys returns the bounds of a valid range
+func (r Range) keys() (key, key, error) {
+	first, ok1 := keyOf(r.First)
+	last, ok2 := keyOf(r.Last)
+	if !ok1 || !ok2 || (r.First.To4() == nil) != (r.Last.To4() == nil) || last.less(first) {
+		return key{}, key{}, ErrInvalidRange
+	}
+	return first, last, nil
+}
+
+// span is a range of addresses as keys
+type span struct {
+	first, last key
+}
+
+// Blocklist is a set of ranges of addresses, safe for concurrent use. Its
+// ranges can be changed while in use. A nil Blocklist blocks nothing.
+type Blocklist struct {
+	mu    sync.RWMutex
+	spans []span // sorted, neither overlapping nor adjacent
+}
+
+// New returns a blocklist of the ranges
+func New(ranges ...Range) (*Blocklist, error) {
+	b := &Blocklist{}
+	if err := b.Add(ranges...); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Add blocks the ranges
+func (b *Blocklist) Add(ranges ...Range) error {
+	added := make([]span, 0, len(ranges))
+	for _, r := range ranges {
+		first, last, err := r.keys()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, r)
+		}
+		added = append(added, span{first, last})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	spans := append(append([]span(nil), b.spans...), added...)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].first.less(spans[j].first) })
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next, ok := last.last.next()
+			if !ok || !next.less(s.first) {
+				// s overlaps or follows the last span
+				if last.last.less(s.last) {
+					last.last = s.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	b.spans = merged
+	return nil
+}
+
+// Remove unblocks the addresses of the ranges, which may split the ranges
+// blocked
+func (b *Blocklist) Remove(ranges ...Range) error {
+	removed := make([]span, 0, len(ranges))
+	for _, r := range ranges {
+		first, last, err := r.keys()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, r)
+		}
+		removed = append(removed, span{first, last})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rm := range removed {
+		var kept []span
+		for _, s := range b.spans {
+			if s.last.less(rm.first) || rm.last.less(s.first) {
+				kept = append(kept, s)
+				continue
+			}
+			if s.first.less(rm.first) {
+				last, _ := rm.first.prev()
+				kept = append(kept, span{s.first, last})
+			}
+			if rm.last.less(s.last) {
+				first, _ := rm.last.next()
+				kept = append(kept, span{first, s.last})
+			}
+		}
+		b.spans = kept
+	}
+	return nil
+}
+
+// Blocked tells whether ip is in a range of the blocklist
+func (b *Blocklist) Blocked(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	k, ok := keyOf(ip)
+	if !ok {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	// The first span ending at or after k is the only one that may hold it
+	i := sort.Search(len(b.spans), func(i int) bool { return !b.spans[i].last.less(k) })
+	return i < len(b.spans) && !k.less(b.spans[i].first)
+}
+
+// Ranges returns the ranges blocked, sorted and merged
+func (b *Blocklist) Ranges() []Range {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ranges := make([]Range, len(b.spans))
+	for i, s := range b.spans {
+		ranges[i] = Range{s.first.ip(), s.last.ip()}
+	}
+	return ranges
+}
+
+// Len returns the number of ranges blocked, once merged
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.spans)
+}
+
+// Load blocks the ranges of a list with a range per line, as accepted by
+// ParseRange or in the PeerGuardian format "description:first-last". Empty
+// lines and comments starting with # are skipped. It returns the number of
+// ranges read.
+func (b *Blocklist) Load(r io.Reader) (int, error) {
+	var ranges []Range
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rng, err := ParseRange(text)
+		if err != nil {
+			// The description of the PeerGuardian format ends at the last
+			// colon, as IPv4 addresses have none
+			i := strings.LastIndexByte(text, ':')
+			if i < 0 {
+				return 0, fmt.Errorf("line %d: %w", line, err)
+			}
+			if rng, err = ParseRange(text[i+1:]); err != nil {
+				return 0, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		ranges = append(ranges, rng)
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return len(ranges), b.Add(ranges...)
+}
@@ -0,0 +1,129 @@
+package blocklist
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output Range
+		err    error
+	}{
+		"cidr":          {"192.0.2.0/24", Range{net.IP{192, 0, 2, 0}, net.IP{192, 0, 2, 255}}, nil},
+		"cidr ipv6":     {"2001:db8::/126", Range{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::3")}, nil},
+		"range":         {"192.0.2.10 - 192.0.2.20", Range{net.IP{192, 0, 2, 10}, net.IP{192, 0, 2, 20}}, nil},
+		"leading zeros": {"001.002.003.004-001.002.003.010", Range{net.IP{1, 2, 3, 4}, net.IP{1, 2, 3, 10}}, nil},
+		"single":        {"192.0.2.1", Range{net.IP{192, 0, 2, 1}, net.IP{192, 0, 2, 1}}, nil},
+		"reversed":      {"192.0.2.20-192.0.2.10", Range{}, ErrInvalidRange},
+		"mixed":         {"192.0.2.1-2001:db8::1", Range{}, ErrInvalidRange},
+		"invalid":       {"example.com", Range{}, ErrInvalidRange},
+		"invalid cidr":  {"192.0.2.0/33", Range{}, ErrInvalidRange},
+	}
+
+	for name, test := range tests {
+		output, err := ParseRange(test.input)
+		assert.True(t, errors.Is(err, test.err), name)
+		assert.Equal(t, test.output, output, name)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	b, err := New(
+		Range{net.IP{192, 0, 2, 10}, net.IP{192, 0, 2, 20}},
+		Range{net.IP{198, 51, 100, 0}, net.IP{198, 51, 100, 255}},
+		Range{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ff")},
+	)
+	require.Nil(t, err)
+
+	tests := map[string]struct {
+		input  net.IP
+		output bool
+	}{
+		"first":       {net.IP{192, 0, 2, 10}, true},
+		"inside":      {net.IP{192, 0, 2, 15}, true},
+		"last":        {net.IP{192, 0, 2, 20}, true},
+		"before":      {net.IP{192, 0, 2, 9}, false},
+		"after":       {net.IP{192, 0, 2, 21}, false},
+		"between":     {net.IP{198, 51, 99, 1}, false},
+		"mapped ipv4": {net.ParseIP("::ffff:198.51.100.7"), true},
+		"ipv6":        {net.ParseIP("2001:db8::42"), true},
+		"other ipv6":  {net.ParseIP("2001:db8::1:0"), false},
+		"nil":         {nil, false},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, b.Blocked(test.input), name)
+	}
+
+	var none *Blocklist
+	assert.False(t, none.Blocked(net.IP{192, 0, 2, 15}))
+}
+
+func TestAddMerges(t *testing.T) {
+	b, err := New(
+		Range{net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 10}},
+		Range{net.IP{10, 0, 0, 5}, net.IP{10, 0, 0, 20}},  // overlapping
+		Range{net.IP{10, 0, 0, 21}, net.IP{10, 0, 0, 30}}, // adjacent
+		Range{net.IP{10, 0, 1, 0}, net.IP{10, 0, 1, 0}},
+	)
+	require.Nil(t, err)
+	assert.Equal(t, []Range{
+		{net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 30}},
+		{net.IP{10, 0, 1, 0}, net.IP{10, 0, 1, 0}},
+	}, b.Ranges())
+
+	err = b.Add(Range{net.IP{10, 0, 0, 0}, nil})
+	assert.True(t, errors.Is(err, ErrInvalidRange))
+	assert.Equal(t, 2, b.Len())
+}
+
+func TestRemove(t *testing.T) {
+	b, err := New(
+		Range{net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 255}},
+		Range{net.IP{10, 0, 2, 0}, net.IP{10, 0, 2, 255}},
+	)
+	require.Nil(t, err)
+
+	// Splits the first range and removes the second one
+	err = b.Remove(
+		Range{net.IP{10, 0, 0, 100}, net.IP{10, 0, 0, 199}},
+		Range{net.IP{10, 0, 2, 0}, net.IP{10, 0, 3, 0}},
+	)
+	require.Nil(t, err)
+	assert.Equal(t, []Range{
+		{net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 99}},
+		{net.IP{10, 0, 0, 200}, net.IP{10, 0, 0, 255}},
+	}, b.Ranges())
+	assert.False(t, b.Blocked(net.IP{10, 0, 0, 150}))
+	assert.True(t, b.Blocked(net.IP{10, 0, 0, 250}))
+}
+
+func TestLoad(t *testing.T) {
+	list := `# PeerGuardian and CIDR ranges
+Some Org:1.2.3.0-1.2.3.255
+Other-Org: with colons:004.005.006.000-004.005.006.010
+
+192.0.2.0/24
+2001:db8::/32
+`
+	b := &Blocklist{}
+	n, err := b.Load(strings.NewReader(list))
+	require.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.True(t, b.Blocked(net.IP{1, 2, 3, 4}))
+	assert.True(t, b.Blocked(net.IP{4, 5, 6, 10}))
+	assert.False(t, b.Blocked(net.IP{4, 5, 6, 11}))
+	assert.True(t, b.Blocked(net.IP{192, 0, 2, 1}))
+	assert.True(t, b.Blocked(net.ParseIP("2001:db8:1::1")))
+
+	_, err = b.Load(strings.NewReader("1.2.3.4\nnot a range\n"))
+	assert.True(t, errors.Is(err, ErrInvalidRange))
+	assert.Contains(t, err.Error(), "line 2")
+}
@@ -2,8 +2,13 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/leonhfr/torrent-client/bitfield"
@@ -12,21 +17,311 @@ import (
 	"github.com/leonhfr/torrent-client/peer"
 )
 
+const (
+	// DefaultDialTimeout is the time allowed to establish the TCP connection
+	DefaultDialTimeout = 3 * time.Second
+	// DefaultHandshakeTimeout is the time allowed to complete the handshake
+	DefaultHandshakeTimeout = 3 * time.Second
+	// DefaultBitfieldTimeout is the time allowed to receive the bitfield
+	DefaultBitfieldTimeout = 5 * time.Second
+)
+
+var (
+	// ErrInfoHashMismatch is returned when a peer handshakes for another
+	// torrent. It is handshake.ErrInfoHashMismatch.
+	ErrInfoHashMismatch = handshake.ErrInfoHashMismatch
+	// ErrPeerTimeout matches the errors of the connections with peers that
+	// did not answer before a deadline. Those peers may answer another time.
+	ErrPeerTimeout = errors.New("peer timed out")
+)
+
+// Stage identifies a step of the connection setup with a peer
+type Stage string
+
+const (
+	StageDial       Stage = "dial"       // StageDial is the TCP connection
+	StageEncryption Stage = "encryption" // StageEncryption is the encryption handshake
+	StageHandshake  Stage = "handshake"  // StageHandshake is the handshake exchange
+	StageBitfield   Stage = "bitfield"   // StageBitfield is the reception of the bitfield
+)
+
+// ConnectError is returned by New when the connection setup with a peer fails
+type ConnectError struct {
+	Stage Stage
+	Peer  peer.Peer
+	Err   error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("%s with %s failed: %v", e.Stage, e.Peer, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the connection setup timed out when target is ErrPeerTimeout
+func (e *ConnectError) Is(target error) bool {
+	return target == ErrPeerTimeout && isTimeout(e.Err)
+}
+
+// timeoutError is the error of an operation on a connection whose deadline
+// expired. It matches ErrPeerTimeout, and still unwraps to the net.Error.
+type timeoutError struct {
+	err error
+}
+
+func (e timeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e timeoutError) Is(target error) bool {
+	return target == ErrPeerTimeout
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// wrapTimeout wraps err in a timeoutError if a deadline expired
+func wrapTimeout(err error) error {
+	if isTimeout(err) {
+		return timeoutError{err}
+	}
+	return err
+}
+
+// Counters counts the bytes exchanged with peers. Payload is the data of the
+// blocks, which is what trackers expect as uploaded and downloaded. Overhead
+// is everything else: handshakes, message headers and control messages.
+// Fields are accessed atomically, use Snapshot to read them.
+type Counters struct {
+	PayloadDownloaded  int64
+	PayloadUploaded    int64
+	OverheadDownloaded int64
+	OverheadUploaded   int64
+
+	downloadRate meter // payload received
+	uploadRate   meter // payload sent
+}
+
+// Snapshot returns a copy of the counters
+func (cs *Counters) Snapshot() Counters {
+	if cs == nil {
+		return Counters{}
+	}
+	return Counters{
+		PayloadDownloaded:  atomic.LoadInt64(&cs.PayloadDownloaded),
+		PayloadUploaded:    atomic.LoadInt64(&cs.PayloadUploaded),
+		OverheadDownloaded: atomic.LoadInt64(&cs.OverheadDownloaded),
+		OverheadUploaded:   atomic.LoadInt64(&cs.OverheadUploaded),
+	}
+}
+
+// split returns the payload and overhead bytes of a message on the wire
+func split(msg *message.Message) (payload, overhead int64) {
+	if msg == nil {
+		return 0, 4 // keep-alive
+	}
+	total := int64(4 + 1 + len(msg.Payload))
+	if msg.ID == message.MsgPiece && len(msg.Payload) > 8 {
+		payload = int64(len(msg.Payload) - 8)
+	}
+	return payload, total - payload
+}
+
+func (cs *Counters) received(msg *message.Message) {
+	if cs == nil {
+		return
+	}
+	payload, overhead := split(msg)
+	cs.AddPayloadDownloaded(payload)
+	atomic.AddInt64(&cs.OverheadDownloaded, overhead)
+}
+
+// AddPayloadDownloaded counts block data received from elsewhere than a
+// peer, such as a web seed
+func (cs *Counters) AddPayloadDownloaded(n int64) {
+	if cs == nil {
+		return
+	}
+	atomic.AddInt64(&cs.PayloadDownloaded, n)
+	cs.downloadRate.add(n, time.Now())
+}
+
+func (cs *Counters) sent(msg *message.Message) {
+	if cs == nil {
+		return
+	}
+	payload, overhead := split(msg)
+	atomic.AddInt64(&cs.PayloadUploaded, payload)
+	atomic.AddInt64(&cs.OverheadUploaded, overhead)
+	cs.uploadRate.add(payload, time.Now())
+}
+
+// handshook counts a handshake sent and received
+func (cs *Counters) handshook(infoHash, peerID [20]byte) {
+	if cs == nil {
+		return
+	}
+	n := int64(len(handshake.New(infoHash, peerID).Serialize()))
+	atomic.AddInt64(&cs.OverheadUploaded, n)
+	atomic.AddInt64(&cs.OverheadDownloaded, n)
+}
+
+// Dialer establishes the TCP connections with peers, e.g. through a proxy
+// such as proxy.SOCKS5
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type options struct {
+	dialer           Dialer
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	bitfieldTimeout  time.Duration
+	counters         *Counters
+	extensions       bool
+	handlers         []extension
+	metadataSize     int
+	uploadOnly       bool
+	encryption       EncryptionPolicy
+	downloadLimiters []*Limiter
+	uploadLimiters   []*Limiter
+	maxLength        int
+	pieces           int
+}
+
+// Option configures the connection setup with a peer
+type Option func(*options)
+
+// WithDialTimeout sets the time allowed to establish the TCP connection
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithDialer dials the peers with d instead of directly. The dial timeout
+// still applies.
+func WithDialer(d Dialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+// WithHandshakeTimeout sets the time allowed to complete the handshake
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.handshakeTimeout = d
+	}
+}
+
+// WithBitfieldTimeout sets the time allowed to receive the bitfield
+func WithBitfieldTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.bitfieldTimeout = d
+	}
+}
+
+// WithCounters makes the client count its traffic into cs, which can be
+// shared by several clients. By default each client has its own counters.
+func WithCounters(cs *Counters) Option {
+	return func(o *options) {
+		o.counters = cs
+	}
+}
+
+// WithExtensions advertises the extension protocol (BEP 10) in the handshake.
+// If the peer also supports it, the extension handshake is sent once connected.
+func WithExtensions() Option {
+	return func(o *options) {
+		o.extensions = true
+	}
+}
+
+// WithMaxMessageLength sets the longest message accepted from the peer,
+// which is disconnected when it sends a longer one. Defaults to
+// message.DefaultMaxLength.
+func WithMaxMessageLength(n int) Option {
+	return func(o *options) {
+		o.maxLength = n
+	}
+}
+
+// WithPieces validates the bitfield of the peer against the number of pieces
+// of the torrent. Peers sending a bitfield of another length, or with spare
+// bits set, are disconnected.
+func WithPieces(numPieces int) Option {
+	return func(o *options) {
+		o.pieces = numPieces
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		dialTimeout:      DefaultDialTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		bitfieldTimeout:  DefaultBitfieldTimeout,
+		maxLength:        message.DefaultMaxLength,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.counters == nil {
+		o.counters = &Counters{}
+	}
+	return o
+}
+
 // Client is a TCP connection with a peer
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
 	peer     peer.Peer
+	remoteID [20]byte
 	infoHash [20]byte
 	peerID   [20]byte
+	counters *Counters
+	reader   *message.Reader // reads the messages of Conn, created on first read
+	// pending is the first message of the peer, read in place of its
+	// bitfield and returned by the next read
+	pending *message.Message
+	// announced is set when the peer sent its bitfield, or HaveAll or HaveNone
+	announced bool
+	// maxLength is the longest message accepted, see WithMaxMessageLength
+	maxLength int
+	lastSent  int64 // time the last message was sent, in nanoseconds, accessed atomically
+	// downloadRate and uploadRate measure the block data exchanged
+	downloadRate meter
+	uploadRate   meter
+	// extensions is set when both ends advertised the extension protocol
+	extensions bool
+	handlers   []extension
+
+	mu               sync.Mutex
+	remoteExtensions ExtensionHandshake
+}
+
+func newHandshake(infoHash, peerID [20]byte, o options) *handshake.Handshake {
+	h := handshake.New(infoHash, peerID)
+	if o.extensions {
+		h.EnableExtensions()
+	}
+	return h
 }
 
-func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Handshake, error) {
-	conn.SetDeadline(time.Now().Add(3 * time.Second))
+func completeHandshake(conn net.Conn, infoHash, peerID [20]byte, o options) (*handshake.Handshake, error) {
+	conn.SetDeadline(time.Now().Add(o.handshakeTimeout))
 	defer conn.SetDeadline(time.Time{}) // Disable deadline
 
-	req := handshake.New(infoHash, peerID)
+	req := newHandshake(infoHash, peerID, o)
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -38,97 +333,347 @@ func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) (*handshake.Han
 	}
 
 	if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
-		return nil, fmt.Errorf("expected info hash %x, got %x", res.InfoHash, infoHash)
+		return nil, fmt.Errorf("%w: expected %x, got %x", ErrInfoHashMismatch, infoHash, res.InfoHash)
 	}
 
 	return res, nil
 }
 
-func receiveBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
+// receiveBitfield reads the pieces the peer has, from the bitfield or the
+// HaveAll or HaveNone message it starts with, if announced. Peers having no
+// piece may send none of them, or send Have messages instead: the bitfield
+// is then empty, and the first message read, if any, is pending to be read
+// again. The bitfield has a bit for each piece, if their number is known.
+func receiveBitfield(conn net.Conn, o options) (bf bitfield.Bitfield, announced bool, pending *message.Message, err error) {
+	conn.SetDeadline(time.Now().Add(o.bitfieldTimeout))
 	defer conn.SetDeadline(time.Time{}) // Disable deadline
 
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
+	// Nothing sent until the deadline is a peer with no piece, while a
+	// message cut by the deadline cannot be read anymore
+	var first [1]byte
+	_, err = io.ReadFull(conn, first[:])
+	if isTimeout(err) {
+		return bitfield.New(o.pieces), false, nil, nil
 	}
-	if msg == nil {
-		return nil, fmt.Errorf("expected bitfield, got %s", msg)
+	if err != nil {
+		return nil, false, nil, err
 	}
-	if msg.ID != message.MsgBitfield {
-		return nil, fmt.Errorf("expected bitfield, got ID %d", msg.ID)
+	msg, err := message.ReadMax(io.MultiReader(bytes.NewReader(first[:]), conn), o.maxLength)
+	if err != nil {
+		return nil, false, nil, err
 	}
 
-	return msg.Payload, nil
+	switch {
+	case msg == nil: // keep-alive
+		o.counters.received(msg)
+		return bitfield.New(o.pieces), false, nil, nil
+	case msg.ID == message.MsgBitfield:
+		if o.pieces > 0 {
+			err = bitfield.Bitfield(msg.Payload).Validate(o.pieces)
+			if err != nil {
+				return nil, false, nil, err
+			}
+		}
+		o.counters.received(msg)
+		return msg.Payload, true, nil, nil
+	case msg.ID == message.MsgHaveAll:
+		bf = bitfield.New(o.pieces)
+		for index := 0; index < o.pieces; index++ {
+			bf.SetPiece(index)
+		}
+		o.counters.received(msg)
+		return bf, true, nil, nil
+	case msg.ID == message.MsgHaveNone:
+		o.counters.received(msg)
+		return bitfield.New(o.pieces), true, nil, nil
+	default:
+		return bitfield.New(o.pieces), false, msg, nil
+	}
 }
 
 // New connects with a peer, completes a handshake, and receives a handshake
-// returns an error if any of those fail.
-func New(peer peer.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// returns a *ConnectError identifying the stage if any of those fail.
+// The connection setup is interrupted when ctx is done. When encryption is
+// preferred, a peer failing the encryption handshake is connected to again
+// in plaintext.
+func New(ctx context.Context, peer peer.Peer, peerID, infoHash [20]byte, opts ...Option) (*Client, error) {
+	o := newOptions(opts)
+	c, err := dial(ctx, peer, peerID, infoHash, o)
+	var connectErr *ConnectError
+	if err != nil && o.encryption == EncryptionPreferred && errors.As(err, &connectErr) && connectErr.Stage == StageEncryption && ctx.Err() == nil {
+		o.encryption = EncryptionDisabled
+		return dial(ctx, peer, peerID, infoHash, o)
+	}
+	return c, err
+}
+
+func dial(ctx context.Context, peer peer.Peer, peerID, infoHash [20]byte, o options) (*Client, error) {
+	var dialer Dialer = &net.Dialer{}
+	if o.dialer != nil {
+		dialer = o.dialer
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, o.dialTimeout)
+	conn, err := dialer.DialContext(dialCtx, "tcp", peer.String())
+	cancel()
 	if err != nil {
-		return nil, err
+		return nil, &ConnectError{Stage: StageDial, Peer: peer, Err: err}
 	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	return handshakeConn(ctx, conn, peer, peerID, infoHash, o)
+}
+
+// NewFromConn completes the handshake and receives the bitfield over an
+// already established connection, such as a TLS connection or an in-memory
+// pipe, instead of dialing the peer
+func NewFromConn(ctx context.Context, conn net.Conn, peerID, infoHash [20]byte, opts ...Option) (*Client, error) {
+	return handshakeConn(ctx, conn, remotePeer(conn), peerID, infoHash, newOptions(opts))
+}
+
+// closeOnDone closes conn if ctx is done before the returned function is
+// called, which interrupts the connection setup under way
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
+
+// interrupted returns the error of a connection setup interrupted by ctx, at
+// the stage reported by err if any
+func interrupted(ctx context.Context, p peer.Peer, err error) error {
+	stage := StageHandshake
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		stage = connectErr.Stage
+	}
+	return &ConnectError{Stage: stage, Peer: p, Err: ctx.Err()}
+}
+
+// handshakeConn initiates the handshake on conn and receives the bitfield.
+// The connection is closed if it fails or if ctx is done meanwhile.
+func handshakeConn(ctx context.Context, conn net.Conn, peer peer.Peer, peerID, infoHash [20]byte, o options) (*Client, error) {
+	stop := closeOnDone(ctx, conn)
+	c, err := setupConn(conn, peer, peerID, infoHash, o)
+	stop()
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, interrupted(ctx, peer, err)
+	}
+	return c, err
+}
+
+func setupConn(conn net.Conn, peer peer.Peer, peerID, infoHash [20]byte, o options) (*Client, error) {
+	encrypted, err := encrypt(conn, infoHash, o)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, &ConnectError{Stage: StageEncryption, Peer: peer, Err: err}
 	}
+	conn = encrypted
 
-	bf, err := receiveBitfield(conn)
+	res, err := completeHandshake(conn, infoHash, peerID, o)
 	if err != nil {
 		conn.Close()
+		return nil, &ConnectError{Stage: StageHandshake, Peer: peer, Err: err}
+	}
+
+	o.counters.handshook(infoHash, peerID)
+
+	bf, announced, pending, err := receiveBitfield(conn, o)
+	if err != nil {
+		conn.Close()
+		return nil, &ConnectError{Stage: StageBitfield, Peer: peer, Err: err}
+	}
+
+	c := &Client{
+		Conn:      limit(conn, o),
+		Choked:    true,
+		Bitfield:  bf,
+		announced: announced,
+		pending:   pending,
+		peer:      peer,
+		remoteID:  res.PeerID,
+		infoHash:  infoHash,
+		peerID:    peerID,
+		counters:  o.counters,
+		lastSent:  time.Now().UnixNano(),
+
+		maxLength: o.maxLength,
+
+		extensions: o.extensions && res.SupportsExtensions(),
+		handlers:   o.handlers,
+	}
+	if c.extensions {
+		err = c.sendExtensionHandshake(o)
+		if err != nil {
+			conn.Close()
+			return nil, &ConnectError{Stage: StageHandshake, Peer: peer, Err: err}
+		}
+	}
+	return c, nil
+}
+
+// remotePeer returns the address of the peer at the other end of conn, if it
+// is a TCP connection
+func remotePeer(conn net.Conn) peer.Peer {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	return peer.Peer{}
+}
+
+// Accept completes the handshake initiated by a peer on an incoming connection
+// and sends our bitfield. It fails if the peer asks for another torrent. The
+// connection is closed if ctx is done before the handshake completes.
+func Accept(ctx context.Context, conn net.Conn, peerID, infoHash [20]byte, bf bitfield.Bitfield, opts ...Option) (*Client, error) {
+	in, err := ReadHandshake(ctx, conn, [][20]byte{infoHash}, opts...)
+	if err != nil {
 		return nil, err
 	}
+	return in.Accept(ctx, peerID, bf, opts...)
+}
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+// Peer returns the address of the peer
+func (c *Client) Peer() peer.Peer {
+	return c.peer
 }
 
-// Read reads and consumes a message from the connection
+// SentBitfield reports whether the peer announced its pieces when
+// connecting, with a bitfield or a HaveAll or HaveNone message. Peers that
+// did not may announce them with Have messages.
+func (c *Client) SentBitfield() bool {
+	return c.announced
+}
+
+// RemoteID returns the peer ID the peer sent in its handshake
+func (c *Client) RemoteID() [20]byte {
+	return c.remoteID
+}
+
+// SupportsExtensions reports whether both ends advertised the extension
+// protocol (BEP 10), so that extended messages can be exchanged
+func (c *Client) SupportsExtensions() bool {
+	return c.extensions
+}
+
+// Counters returns a snapshot of the traffic counted by the client
+func (c *Client) Counters() Counters {
+	return c.counters.Snapshot()
+}
+
+// Read reads and consumes a message from the connection. Extended messages
+// are dispatched to the registered extension handlers before being returned.
+// Callers done with a message can give its buffer back with message.Release.
 func (c *Client) Read() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
+	msg := c.pending
+	if msg != nil {
+		c.pending = nil
+	} else {
+		if c.reader == nil {
+			c.reader = message.NewReader(c.Conn)
+			c.reader.MaxLength = c.maxLength
+		}
+		var err error
+		msg, err = c.reader.Read()
+		if err != nil {
+			return nil, wrapTimeout(err)
+		}
+	}
+	c.counters.received(msg)
+	payload, _ := split(msg)
+	c.downloadRate.add(payload, time.Now())
+	if msg != nil && msg.ID == message.MsgExtended && c.extensions {
+		err := c.handleExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// ReadContext reads a message as Read, until ctx is done. The read is
+// interrupted by expiring the read deadline of the connection, and a message
+// partly read is resumed by the next read.
+func (c *Client) ReadContext(ctx context.Context) (*message.Message, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	msg, err := c.Read()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	return msg, err
 }
 
+func (c *Client) send(msg *message.Message) error {
+	_, err := c.Conn.Write(msg.Serialize())
+	if err == nil {
+		c.counters.sent(msg)
+		payload, _ := split(msg)
+		now := time.Now()
+		c.uploadRate.add(payload, now)
+		atomic.StoreInt64(&c.lastSent, now.UnixNano())
+	}
+	return wrapTimeout(err)
+}
+
 // SendRequest sends a Request message to the peer
 func (c *Client) SendRequest(index, begin, length int) error {
-	msg := message.NewRequest(index, begin, length)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(message.NewRequest(index, begin, length))
+}
+
+// SendCancel sends a Cancel message to the peer
+func (c *Client) SendCancel(index, begin, length int) error {
+	return c.send(message.NewCancel(index, begin, length))
+}
+
+// SendPiece sends a Piece message delivering a block to the peer
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	return c.send(message.NewPiece(index, begin, block))
 }
 
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgInterested})
 }
 
 // SendNotInterested sends a NotInterested message to the peer
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgNotInterested})
 }
 
-// SendUnchokesends an Unchoke message to the peer
+// SendChoke sends a Choke message to the peer
+func (c *Client) SendChoke() error {
+	return c.send(&message.Message{ID: message.MsgChoke})
+}
+
+// SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgUnchoke})
 }
 
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
-	msg := message.NewHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.send(message.NewHave(index))
+}
+
+// SendExtended sends an Extended message to the peer
+func (c *Client) SendExtended(extendedID uint8, payload []byte) error {
+	return c.send(message.NewExtended(extendedID, payload))
 }
@@ -1,12 +1,16 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/leonhfr/torrent-client/bitfield"
 	"github.com/leonhfr/torrent-client/handshake"
 	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/peer"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -21,8 +25,9 @@ func createClientAndServer(t *testing.T) (clientConn, serverConn net.Conn) {
 	done := make(chan struct{})
 	go func() {
 		defer ln.Close()
-		serverConn, err = ln.Accept()
-		require.Nil(t, err)
+		var acceptErr error
+		serverConn, acceptErr = ln.Accept()
+		assert.Nil(t, acceptErr)
 		done <- struct{}{}
 	}()
 	clientConn, err = net.Dial("tcp", ln.Addr().String())
@@ -33,39 +38,87 @@ func createClientAndServer(t *testing.T) (clientConn, serverConn net.Conn) {
 
 func TestRecvBitfield(t *testing.T) {
 	tests := map[string]struct {
-		msg    []byte
-		output bitfield.Bitfield
-		fails  bool
+		msg       []byte
+		output    bitfield.Bitfield
+		announced bool
+		pending   *message.Message
+		fails     bool
 	}{
 		"successful bitfield": {
-			msg:    []byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2, 3, 4, 5},
-			output: bitfield.Bitfield{1, 2, 3, 4, 5},
-			fails:  false,
+			msg:       []byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2, 3, 4, 0x50},
+			output:    bitfield.Bitfield{1, 2, 3, 4, 0x50},
+			announced: true,
+		},
+		"have all": {
+			msg:       []byte{0x00, 0x00, 0x00, 0x01, 14},
+			output:    bitfield.Bitfield{0xff, 0xff, 0xff, 0xff, 0xf0},
+			announced: true,
+		},
+		"have none": {
+			msg:       []byte{0x00, 0x00, 0x00, 0x01, 15},
+			output:    bitfield.Bitfield{0, 0, 0, 0, 0},
+			announced: true,
 		},
 		"message is not a bitfield": {
-			msg:    []byte{0x00, 0x00, 0x00, 0x06, 99, 1, 2, 3, 4, 5},
-			output: nil,
-			fails:  true,
+			msg:     []byte{0x00, 0x00, 0x00, 0x05, 4, 0, 0, 0, 3},
+			output:  bitfield.Bitfield{0, 0, 0, 0, 0},
+			pending: message.NewHave(3),
 		},
 		"message is keep-alive": {
 			msg:    []byte{0x00, 0x00, 0x00, 0x00},
-			output: nil,
-			fails:  true,
+			output: bitfield.Bitfield{0, 0, 0, 0, 0},
+		},
+		"no message": {
+			output: bitfield.Bitfield{0, 0, 0, 0, 0},
+		},
+		"message is cut": {
+			msg:   []byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2},
+			fails: true,
 		},
 	}
 
-	for _, test := range tests {
+	for name, test := range tests {
 		clientConn, serverConn := createClientAndServer(t)
 		serverConn.Write(test.msg)
 
-		bf, err := receiveBitfield(clientConn)
+		o := newOptions([]Option{WithPieces(36), WithBitfieldTimeout(50 * time.Millisecond)})
+		bf, announced, pending, err := receiveBitfield(clientConn, o)
 
 		if test.fails {
-			assert.NotNil(t, err)
+			assert.NotNil(t, err, name)
 		} else {
-			assert.Nil(t, err)
-			assert.Equal(t, bf, test.output)
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, bf, name)
+			assert.Equal(t, test.announced, announced, name)
+			assert.Equal(t, test.pending, pending, name)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestRecvBitfieldValidated(t *testing.T) {
+	tests := map[string]struct {
+		msg []byte
+		err error
+	}{
+		"valid":         {[]byte{0x00, 0x00, 0x00, 0x03, 5, 0xff, 0xc0}, nil},
+		"wrong length":  {[]byte{0x00, 0x00, 0x00, 0x02, 5, 0xff}, bitfield.ErrLength},
+		"spare bit set": {[]byte{0x00, 0x00, 0x00, 0x03, 5, 0xff, 0xe0}, bitfield.ErrSpareBits},
+	}
+
+	for name, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		serverConn.Write(test.msg)
+
+		_, _, _, err := receiveBitfield(clientConn, newOptions([]Option{WithPieces(10)}))
+		if test.err == nil {
+			assert.Nil(t, err, name)
+		} else {
+			assert.True(t, errors.Is(err, test.err), name)
 		}
+		clientConn.Close()
+		serverConn.Close()
 	}
 }
 
@@ -101,10 +154,10 @@ func TestCompleteHandshake(t *testing.T) {
 		clientConn, serverConn := createClientAndServer(t)
 		serverConn.Write(test.serverHandshake)
 
-		h, err := completeHandshake(clientConn, test.clientInfohash, test.clientPeerID)
+		h, err := completeHandshake(clientConn, test.clientInfohash, test.clientPeerID, newOptions(nil))
 
 		if test.fails {
-			assert.NotNil(t, err)
+			assert.True(t, errors.Is(err, ErrInfoHashMismatch))
 		} else {
 			assert.Nil(t, err)
 			assert.Equal(t, h, test.output)
@@ -151,6 +204,42 @@ func TestSendRequest(t *testing.T) {
 	assert.Equal(t, expected, buf)
 }
 
+func TestSendCancel(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendCancel(1, 2, 3)
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0d,
+		8,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x03,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestSendPiece(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendPiece(1, 2, []byte{0xaa, 0xbb})
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0b,
+		7,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0xaa, 0xbb,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
 func TestSendInterested(t *testing.T) {
 	clientConn, serverConn := createClientAndServer(t)
 	client := Client{Conn: clientConn}
@@ -181,6 +270,21 @@ func TestSendNotInterested(t *testing.T) {
 	assert.Equal(t, expected, buf)
 }
 
+func TestSendChoke(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn}
+	err := client.SendChoke()
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x01,
+		0,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
 func TestSendUnchoke(t *testing.T) {
 	clientConn, serverConn := createClientAndServer(t)
 	client := Client{Conn: clientConn}
@@ -211,3 +315,317 @@ func TestSendHave(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, buf)
 }
+
+func TestNewConnectStage(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	tests := map[string]struct {
+		serve func(conn net.Conn)
+		stage Stage
+	}{
+		"peer stalls the handshake": {
+			serve: func(conn net.Conn) {},
+			stage: StageHandshake,
+		},
+		"peer stalls the bitfield": {
+			serve: func(conn net.Conn) {
+				conn.Write(handshake.New(infoHash, peerID).Serialize())
+				conn.Write([]byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2})
+			},
+			stage: StageBitfield,
+		},
+	}
+
+	for _, test := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		go func(serve func(net.Conn)) {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			serve(conn)
+			time.Sleep(time.Second)
+		}(test.serve)
+
+		addr := ln.Addr().(*net.TCPAddr)
+		p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+		_, err = New(context.Background(), p, peerID, infoHash,
+			WithHandshakeTimeout(50*time.Millisecond),
+			WithBitfieldTimeout(50*time.Millisecond),
+		)
+		ln.Close()
+
+		var connectErr *ConnectError
+		require.True(t, errors.As(err, &connectErr))
+		assert.Equal(t, test.stage, connectErr.Stage)
+		assert.Contains(t, err.Error(), string(test.stage))
+		assert.True(t, errors.Is(err, ErrPeerTimeout))
+	}
+}
+
+func TestReadMaxMessageLength(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer serverConn.Close()
+	c := Client{Conn: clientConn, maxLength: newOptions([]Option{WithMaxMessageLength(8)}).maxLength}
+
+	go serverConn.Write(message.NewPiece(0, 0, make([]byte, 16)).Serialize())
+	_, err := c.Read()
+	assert.True(t, errors.Is(err, message.ErrTooLong))
+}
+
+func TestReadTimeout(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer serverConn.Close()
+	c := Client{Conn: clientConn}
+
+	c.Conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := c.Read()
+	assert.True(t, errors.Is(err, ErrPeerTimeout))
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr))
+
+	serverConn.Close()
+	c.Conn.SetReadDeadline(time.Time{})
+	_, err = c.Read()
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrPeerTimeout))
+}
+
+func TestNewWithoutBitfield(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(handshake.New(infoHash, peerID).Serialize())
+		conn.Write(message.NewHave(9).Serialize())
+		time.Sleep(time.Second)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := New(context.Background(), p, peerID, infoHash, WithPieces(12))
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.False(t, c.SentBitfield())
+	assert.Equal(t, bitfield.Bitfield{0, 0}, c.Bitfield)
+
+	msg, err := c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, message.NewHave(9), msg)
+}
+
+func TestNewDialStage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close() // nothing listens on the port anymore
+
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	_, err = New(context.Background(), p, [20]byte{}, [20]byte{}, WithDialTimeout(50*time.Millisecond))
+
+	var connectErr *ConnectError
+	require.True(t, errors.As(err, &connectErr))
+	assert.Equal(t, StageDial, connectErr.Stage)
+	assert.Equal(t, p, connectErr.Peer)
+}
+
+// pipeDialer connects to an in-memory peer, recording the address dialed
+type pipeDialer struct {
+	address string
+	conn    net.Conn
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.address = address
+	return d.conn, nil
+}
+
+func TestNewWithDialer(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	conn, peerConn := net.Pipe()
+	defer peerConn.Close()
+	go func() {
+		if _, err := handshake.Read(peerConn); err != nil {
+			return
+		}
+		peerConn.Write(handshake.New(infoHash, peerID).Serialize())
+		peerConn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0xff}}).Serialize())
+	}()
+
+	// The peer is unreachable but through the dialer
+	p := peer.Peer{IP: net.IP{203, 0, 113, 5}, Port: 6881}
+	d := &pipeDialer{conn: conn}
+	c, err := New(context.Background(), p, peerID, infoHash, WithDialer(d))
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.Equal(t, "203.0.113.5:6881", d.address)
+	assert.Equal(t, bitfield.Bitfield{0xff}, c.Bitfield)
+}
+
+func TestNewCanceled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Second) // never answers the handshake
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	addr := ln.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	start := time.Now()
+	_, err = New(ctx, p, [20]byte{}, [20]byte{}, WithHandshakeTimeout(time.Second))
+
+	var connectErr *ConnectError
+	require.True(t, errors.As(err, &connectErr))
+	assert.Equal(t, StageHandshake, connectErr.Stage)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestReadContext(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	c := &Client{Conn: clientConn, counters: &Counters{}}
+
+	_, err := serverConn.Write(message.NewHave(3).Serialize())
+	require.Nil(t, err)
+	msg, err := c.ReadContext(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgHave, msg.ID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = c.ReadContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestAccept(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	remoteID := [20]byte{45, 83, 89, 48, 48, 49, 48, 45, 192, 125, 147, 203, 136, 32, 59, 180, 253, 168, 193, 19}
+
+	tests := map[string]struct {
+		infoHash [20]byte
+		fails    bool
+	}{
+		"peer asks for our torrent": {
+			infoHash: infoHash,
+			fails:    false,
+		},
+		"peer asks for another torrent": {
+			infoHash: [20]byte{0xde, 0xe8, 0x6a, 0x7f},
+			fails:    true,
+		},
+	}
+
+	for _, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		clientConn.Write(handshake.New(test.infoHash, remoteID).Serialize())
+
+		c, err := Accept(context.Background(), serverConn, peerID, infoHash, bitfield.Bitfield{0xff})
+		if test.fails {
+			assert.NotNil(t, err)
+			continue
+		}
+		require.Nil(t, err)
+		assert.True(t, c.Choked)
+		assert.Equal(t, remoteID, c.RemoteID())
+
+		res, err := handshake.Read(clientConn)
+		require.Nil(t, err)
+		assert.Equal(t, handshake.New(infoHash, peerID), res)
+		bf, _, _, err := receiveBitfield(clientConn, newOptions(nil))
+		require.Nil(t, err)
+		assert.Equal(t, bitfield.Bitfield{0xff}, bf)
+	}
+}
+
+func TestNewFromConn(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	remoteID := [20]byte{45, 83, 89, 48, 48, 49, 48, 45, 192, 125, 147, 203, 136, 32, 59, 180, 253, 168, 193, 19}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := Accept(context.Background(), serverConn, remoteID, infoHash, bitfield.Bitfield{0xf0})
+		accepted <- err
+	}()
+
+	c, err := NewFromConn(context.Background(), clientConn, peerID, infoHash)
+	require.Nil(t, err)
+	require.Nil(t, <-accepted)
+	assert.True(t, c.Choked)
+	assert.Equal(t, remoteID, c.RemoteID())
+	assert.Equal(t, bitfield.Bitfield{0xf0}, c.Bitfield)
+
+	go serverConn.Write(message.NewHave(4).Serialize())
+	msg, err := c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, message.NewHave(4), msg)
+}
+
+func TestSendExtended(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	c := Client{Conn: clientConn}
+	go c.SendExtended(1, []byte("d1:ai1ee"))
+
+	msg, err := message.Read(serverConn)
+	require.Nil(t, err)
+	assert.Equal(t, message.NewExtended(1, []byte("d1:ai1ee")), msg)
+}
+
+func TestCounters(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	client := Client{Conn: clientConn, counters: &Counters{}}
+
+	block := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	msgs := []*message.Message{
+		message.NewHave(4),
+		{ID: message.MsgUnchoke},
+		nil, // keep-alive
+		message.NewPiece(0, 0, block),
+	}
+	for _, msg := range msgs {
+		_, err := serverConn.Write(msg.Serialize())
+		require.Nil(t, err)
+	}
+	for range msgs {
+		_, err := client.Read()
+		require.Nil(t, err)
+	}
+	require.Nil(t, client.SendRequest(0, 0, 10))
+	require.Nil(t, client.SendPiece(0, 0, block[:5]))
+
+	counters := client.Counters()
+	assert.Equal(t, int64(10), counters.PayloadDownloaded)
+	assert.Equal(t, int64(5), counters.PayloadUploaded)
+	assert.Equal(t, int64(9+5+4+13), counters.OverheadDownloaded)
+	assert.Equal(t, int64(17+13), counters.OverheadUploaded)
+}
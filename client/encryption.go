@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/leonhfr/torrent-client/mse"
+)
+
+// EncryptionPolicy tells whether connections use Message Stream Encryption
+type EncryptionPolicy int
+
+const (
+	// EncryptionDisabled only uses plaintext connections
+	EncryptionDisabled EncryptionPolicy = iota
+	// EncryptionPreferred encrypts the connections with the peers supporting
+	// it, and falls back to plaintext with the others
+	EncryptionPreferred
+	// EncryptionRequired only uses encrypted connections
+	EncryptionRequired
+)
+
+// ErrPlaintextRefused is returned when a peer handshakes in plaintext while
+// encryption is required
+var ErrPlaintextRefused = errors.New("plaintext connection refused")
+
+// WithEncryption sets the encryption policy of the connection
+func WithEncryption(policy EncryptionPolicy) Option {
+	return func(o *options) {
+		o.encryption = policy
+	}
+}
+
+// methods returns the crypto methods allowed by the policy
+func (p EncryptionPolicy) methods() mse.CryptoMethod {
+	if p == EncryptionRequired {
+		return mse.CryptoRC4
+	}
+	return mse.CryptoRC4 | mse.CryptoPlaintext
+}
+
+// encrypt runs the encryption handshake on an outgoing connection, if the
+// policy enables it, and returns the connection to handshake on
+func encrypt(conn net.Conn, infoHash [20]byte, o options) (net.Conn, error) {
+	if o.encryption == EncryptionDisabled {
+		return conn, nil
+	}
+	conn.SetDeadline(time.Now().Add(o.handshakeTimeout))
+	defer conn.SetDeadline(time.Time{}) // Disable deadline
+
+	encrypted, _, err := mse.Initiate(conn, infoHash, o.encryption.methods())
+	return encrypted, err
+}
+
+// decrypt runs the encryption handshake on an incoming connection for one of
+// the torrents of infoHashes if the peer started one, and returns the
+// connection to handshake on
+func decrypt(conn net.Conn, infoHashes [][20]byte, o options) (net.Conn, error) {
+	if o.encryption == EncryptionDisabled {
+		return conn, nil
+	}
+	conn, plaintext, err := mse.IsPlaintext(conn)
+	if err != nil {
+		return nil, err
+	}
+	if plaintext {
+		if o.encryption == EncryptionRequired {
+			return nil, ErrPlaintextRefused
+		}
+		return conn, nil
+	}
+	conn, _, err = mse.Receive(conn, infoHashes, o.encryption.methods())
+	return conn, err
+}
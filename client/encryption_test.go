@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/mse"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	remoteID := [20]byte{45, 83, 89, 48, 48, 49, 48, 45, 192, 125, 147, 203, 136, 32, 59, 180, 253, 168, 193, 19}
+
+	tests := map[string]struct {
+		outgoing  EncryptionPolicy
+		incoming  EncryptionPolicy
+		encrypted bool
+		stage     Stage // stage of the failure, if any
+	}{
+		"both required":               {EncryptionRequired, EncryptionRequired, true, ""},
+		"preferred by both":           {EncryptionPreferred, EncryptionPreferred, true, ""},
+		"preferred to plaintext peer": {EncryptionPreferred, EncryptionDisabled, false, ""},
+		"plaintext to preferring":     {EncryptionDisabled, EncryptionPreferred, false, ""},
+		"required to plaintext peer":  {EncryptionRequired, EncryptionDisabled, false, StageEncryption},
+		"plaintext to requiring":      {EncryptionDisabled, EncryptionRequired, false, StageHandshake},
+	}
+
+	for name, test := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		go func(policy EncryptionPolicy) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, err := Accept(context.Background(), conn, remoteID, infoHash, bitfield.Bitfield{0xff},
+						WithEncryption(policy), WithHandshakeTimeout(100*time.Millisecond))
+					if err == nil {
+						time.Sleep(100 * time.Millisecond)
+					}
+				}()
+			}
+		}(test.incoming)
+
+		addr := ln.Addr().(*net.TCPAddr)
+		p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+		c, err := New(context.Background(), p, peerID, infoHash,
+			WithEncryption(test.outgoing), WithHandshakeTimeout(200*time.Millisecond))
+		ln.Close()
+
+		if test.stage != "" {
+			var connectErr *ConnectError
+			require.True(t, errors.As(err, &connectErr), name)
+			assert.Equal(t, test.stage, connectErr.Stage, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, remoteID, c.RemoteID(), name)
+		assert.Equal(t, bitfield.Bitfield{0xff}, c.Bitfield, name)
+		conn, ok := c.Conn.(*mse.Conn)
+		assert.Equal(t, test.encrypted, ok && conn.Encrypted(), name)
+		c.Conn.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/message"
+)
+
+// ErrExtensionUnsupported is returned when sending a message for an extension
+// the peer did not advertise in its extension handshake
+var ErrExtensionUnsupported = errors.New("extension not supported by peer")
+
+// ExtensionHandshake is the dictionary exchanged by the extension handshake
+// (BEP 10). M maps the names of the supported extensions to the extended
+// message IDs they are received with.
+type ExtensionHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	// UploadOnly is 1 for the peers that only upload, such as partial seeds
+	// (BEP 21)
+	UploadOnly int `bencode:"upload_only,omitempty"`
+}
+
+// ExtensionHandler handles an extension with one peer, such as ut_metadata or
+// ut_pex. A handler is registered on a single client, it can keep the state
+// of the exchange with that peer.
+type ExtensionHandler interface {
+	// Handshake is called when the peer sends its extension handshake
+	Handshake(c *Client, hs ExtensionHandshake) error
+	// Message is called with the payload of every message the peer sends
+	// for the extension
+	Message(c *Client, payload []byte) error
+}
+
+type extension struct {
+	name    string
+	handler ExtensionHandler
+}
+
+// WithExtension registers the handler of an extension with the peer. It also
+// enables the extension protocol, as WithExtensions.
+func WithExtension(name string, h ExtensionHandler) Option {
+	return func(o *options) {
+		o.extensions = true
+		o.handlers = append(o.handlers, extension{name, h})
+	}
+}
+
+// WithMetadataSize advertises the size of the metadata of the torrent in the
+// extension handshake, for peers fetching it with ut_metadata
+func WithMetadataSize(size int) Option {
+	return func(o *options) {
+		o.metadataSize = size
+	}
+}
+
+// sendExtensionHandshake advertises the registered extensions, the extended
+// ID of each being its position in the registry starting at 1
+func (c *Client) sendExtensionHandshake(o options) error {
+	hs := ExtensionHandshake{M: map[string]int{}, MetadataSize: o.metadataSize}
+	if o.uploadOnly {
+		hs.UploadOnly = 1
+	}
+	for i, ext := range c.handlers {
+		hs.M[ext.name] = i + 1
+	}
+	buf, err := bencode.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	return c.SendExtended(0, buf)
+}
+
+// WithUploadOnly tells the peer in the extension handshake that we only
+// upload, as a partial seed having every piece of the files it wants but not
+// the others (BEP 21). It also enables the extension protocol, as
+// WithExtensions.
+func WithUploadOnly() Option {
+	return func(o *options) {
+		o.extensions = true
+		o.uploadOnly = true
+	}
+}
+
+// RemoteExtensions returns the last extension handshake sent by the peer
+func (c *Client) RemoteExtensions() ExtensionHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remoteExtensions
+}
+
+// ExtensionID returns the extended message ID the peer receives the messages
+// of the extension with, if it supports it
+func (c *Client) ExtensionID(name string) (uint8, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.remoteExtensions.M[name]
+	return uint8(id), ok && id > 0 && id <= 255
+}
+
+// SendExtension sends a message of the extension to the peer
+func (c *Client) SendExtension(name string, payload []byte) error {
+	id, ok := c.ExtensionID(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrExtensionUnsupported, name)
+	}
+	return c.SendExtended(id, payload)
+}
+
+// handleExtended dispatches an extended message to the registered handlers.
+// The extension handshake is stored and passed to every handler, the other
+// messages go to the handler of their extension.
+func (c *Client) handleExtended(msg *message.Message) error {
+	id, payload, err := msg.ParseExtended()
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		var hs ExtensionHandshake
+		err = bencode.Unmarshal(payload, &hs)
+		if err != nil {
+			return fmt.Errorf("malformed extension handshake: %w", err)
+		}
+		c.mu.Lock()
+		c.remoteExtensions = hs
+		c.mu.Unlock()
+		for _, ext := range c.handlers {
+			err = ext.handler.Handshake(c, hs)
+			if err != nil {
+				return fmt.Errorf("%s: %w", ext.name, err)
+			}
+		}
+		return nil
+	}
+	if int(id) > len(c.handlers) {
+		return nil // unknown extensions are ignored
+	}
+	ext := c.handlers[id-1]
+	err = ext.handler.Message(c, payload)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ext.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHandler records what an extension receives
+type recordingHandler struct {
+	handshakes []ExtensionHandshake
+	messages   [][]byte
+	err        error
+}
+
+func (h *recordingHandler) Handshake(c *Client, hs ExtensionHandshake) error {
+	h.handshakes = append(h.handshakes, hs)
+	return nil
+}
+
+func (h *recordingHandler) Message(c *Client, payload []byte) error {
+	h.messages = append(h.messages, payload)
+	return h.err
+}
+
+// connectPair connects a client initiating the handshake with one accepting it
+func connectPair(t *testing.T, local, remote []Option) (*Client, *Client) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	clientConn, serverConn := createClientAndServer(t)
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	accepted := make(chan *Client, 1)
+	go func() {
+		a, err := Accept(context.Background(), serverConn, peerID, infoHash, bitfield.Bitfield{0xf0}, remote...)
+		assert.Nil(t, err)
+		accepted <- a
+	}()
+
+	c, err := NewFromConn(context.Background(), clientConn, peerID, infoHash, local...)
+	require.Nil(t, err)
+	a := <-accepted
+	require.NotNil(t, a)
+	return c, a
+}
+
+func TestExtensions(t *testing.T) {
+	tests := map[string]struct {
+		local    []Option
+		remote   []Option
+		expected bool
+	}{
+		"both ends":   {local: []Option{WithExtensions()}, remote: []Option{WithExtensions()}, expected: true},
+		"local only":  {local: []Option{WithExtensions()}, expected: false},
+		"remote only": {remote: []Option{WithExtensions()}, expected: false},
+	}
+
+	for name, test := range tests {
+		c, a := connectPair(t, test.local, test.remote)
+		assert.Equal(t, test.expected, c.SupportsExtensions(), name)
+		assert.Equal(t, test.expected, a.SupportsExtensions(), name)
+	}
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	pex, metadata, served := &recordingHandler{}, &recordingHandler{}, &recordingHandler{}
+	c, a := connectPair(t,
+		[]Option{WithExtension("ut_pex", pex), WithExtension("ut_metadata", metadata)},
+		[]Option{WithExtension("ut_metadata", served), WithMetadataSize(42)},
+	)
+
+	// Each end reads the extension handshake of the other
+	msg, err := c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgExtended, msg.ID)
+	remote := ExtensionHandshake{M: map[string]int{"ut_metadata": 1}, MetadataSize: 42}
+	assert.Equal(t, remote, c.RemoteExtensions())
+	assert.Equal(t, []ExtensionHandshake{remote}, pex.handshakes)
+	assert.Equal(t, []ExtensionHandshake{remote}, metadata.handshakes)
+
+	_, err = a.Read()
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int{"ut_pex": 1, "ut_metadata": 2}, a.RemoteExtensions().M)
+
+	id, ok := a.ExtensionID("ut_metadata")
+	assert.True(t, ok)
+	assert.Equal(t, uint8(2), id)
+	_, ok = c.ExtensionID("ut_pex")
+	assert.False(t, ok)
+	assert.ErrorIs(t, c.SendExtension("ut_pex", nil), ErrExtensionUnsupported)
+
+	// Messages go to the handler of their extension
+	require.Nil(t, a.SendExtension("ut_metadata", []byte("hello")))
+	_, err = c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("hello")}, metadata.messages)
+	assert.Empty(t, pex.messages)
+
+	require.Nil(t, c.SendExtension("ut_metadata", []byte("world")))
+	_, err = a.Read()
+	require.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("world")}, served.messages)
+
+	// Handler errors fail the read
+	metadata.err = errors.New("boom")
+	require.Nil(t, a.SendExtension("ut_metadata", []byte("again")))
+	_, err = c.Read()
+	assert.ErrorIs(t, err, metadata.err)
+}
+
+func TestUploadOnly(t *testing.T) {
+	c, a := connectPair(t, []Option{WithExtensions()}, []Option{WithUploadOnly()})
+
+	_, err := c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, 1, c.RemoteExtensions().UploadOnly)
+
+	_, err = a.Read()
+	require.Nil(t, err)
+	assert.Equal(t, 0, a.RemoteExtensions().UploadOnly)
+}
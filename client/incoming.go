@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/handshake"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/mse"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// Incoming is a connection initiated by a peer whose handshake was read, to
+// be accepted by the torrent it asks for
+type Incoming struct {
+	conn net.Conn
+	peer peer.Peer
+	req  *handshake.Handshake
+}
+
+// ReadHandshake reads the handshake of a peer connecting for one of the
+// torrents of infoHashes, after the encryption handshake if the peer starts
+// one. The connection is closed if it fails or if ctx is done meanwhile.
+func ReadHandshake(ctx context.Context, conn net.Conn, infoHashes [][20]byte, opts ...Option) (*Incoming, error) {
+	stop := closeOnDone(ctx, conn)
+	in, err := readHandshake(conn, infoHashes, newOptions(opts))
+	stop()
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, interrupted(ctx, remotePeer(conn), err)
+	}
+	if err != nil {
+		conn.Close()
+	}
+	return in, err
+}
+
+func readHandshake(conn net.Conn, infoHashes [][20]byte, o options) (*Incoming, error) {
+	p := remotePeer(conn)
+
+	conn.SetDeadline(time.Now().Add(o.handshakeTimeout))
+	defer conn.SetDeadline(time.Time{}) // Disable deadline
+
+	conn, err := decrypt(conn, infoHashes, o)
+	if err != nil {
+		return nil, &ConnectError{Stage: StageEncryption, Peer: p, Err: err}
+	}
+	req, err := handshake.Read(conn)
+	if err != nil {
+		return nil, &ConnectError{Stage: StageHandshake, Peer: p, Err: err}
+	}
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(req.InfoHash[:], infoHash[:]) {
+			return &Incoming{conn: conn, peer: p, req: req}, nil
+		}
+	}
+	if len(infoHashes) == 1 {
+		err = fmt.Errorf("%w: expected %x, got %x", ErrInfoHashMismatch, infoHashes[0], req.InfoHash)
+	} else {
+		err = fmt.Errorf("%w: got %x", ErrInfoHashMismatch, req.InfoHash)
+	}
+	return nil, &ConnectError{Stage: StageHandshake, Peer: p, Err: err}
+}
+
+// InfoHash returns the info hash of the torrent the peer asks for
+func (in *Incoming) InfoHash() [20]byte {
+	return in.req.InfoHash
+}
+
+// Peer returns the address of the peer
+func (in *Incoming) Peer() peer.Peer {
+	return in.peer
+}
+
+// Close closes the connection, for peers asking for a torrent that is not
+// served anymore
+func (in *Incoming) Close() error {
+	return in.conn.Close()
+}
+
+// encrypted tells if the peer started an encrypted connection
+func (in *Incoming) encrypted() bool {
+	conn, ok := in.conn.(*mse.Conn)
+	return ok && conn.Encrypted()
+}
+
+// Accept answers the handshake of the peer and sends our bitfield. The
+// connection is closed if it fails or if ctx is done meanwhile.
+func (in *Incoming) Accept(ctx context.Context, peerID [20]byte, bf bitfield.Bitfield, opts ...Option) (*Client, error) {
+	stop := closeOnDone(ctx, in.conn)
+	c, err := in.accept(peerID, bf, newOptions(opts))
+	stop()
+	if ctx.Err() != nil {
+		in.conn.Close()
+		return nil, interrupted(ctx, in.peer, err)
+	}
+	if err != nil {
+		in.conn.Close()
+	}
+	return c, err
+}
+
+func (in *Incoming) accept(peerID [20]byte, bf bitfield.Bitfield, o options) (*Client, error) {
+	conn, p, infoHash := in.conn, in.peer, in.req.InfoHash
+	if o.encryption == EncryptionRequired && !in.encrypted() {
+		return nil, &ConnectError{Stage: StageEncryption, Peer: p, Err: ErrPlaintextRefused}
+	}
+
+	conn.SetDeadline(time.Now().Add(o.handshakeTimeout))
+	defer conn.SetDeadline(time.Time{}) // Disable deadline
+
+	_, err := conn.Write(newHandshake(infoHash, peerID, o).Serialize())
+	if err != nil {
+		return nil, &ConnectError{Stage: StageHandshake, Peer: p, Err: err}
+	}
+
+	o.counters.handshook(infoHash, peerID)
+
+	msg := message.Message{ID: message.MsgBitfield, Payload: bf}
+	_, err = conn.Write(msg.Serialize())
+	if err != nil {
+		return nil, &ConnectError{Stage: StageBitfield, Peer: p, Err: err}
+	}
+	o.counters.sent(&msg)
+
+	c := &Client{
+		Conn:     limit(conn, o),
+		Choked:   true,
+		peer:     p,
+		remoteID: in.req.PeerID,
+		infoHash: infoHash,
+		peerID:   peerID,
+		counters: o.counters,
+		lastSent: time.Now().UnixNano(),
+
+		maxLength: o.maxLength,
+
+		extensions: o.extensions && in.req.SupportsExtensions(),
+		handlers:   o.handlers,
+	}
+	if c.extensions {
+		err = c.sendExtensionHandshake(o)
+		if err != nil {
+			return nil, &ConnectError{Stage: StageHandshake, Peer: p, Err: err}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/handshake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadHandshake(t *testing.T) {
+	infoHashes := [][20]byte{{1, 2, 3}, {4, 5, 6}}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	remoteID := [20]byte{45, 83, 89, 48, 48, 49, 48, 45, 192, 125, 147, 203, 136, 32, 59, 180, 253, 168, 193, 19}
+
+	tests := map[string]struct {
+		infoHash  [20]byte
+		policy    EncryptionPolicy
+		encrypted bool
+		err       error
+	}{
+		"first torrent":         {infoHashes[0], EncryptionDisabled, false, nil},
+		"second torrent":        {infoHashes[1], EncryptionDisabled, false, nil},
+		"encrypted":             {infoHashes[1], EncryptionRequired, true, nil},
+		"unknown torrent":       {[20]byte{7, 8, 9}, EncryptionDisabled, false, ErrInfoHashMismatch},
+		"unknown and encrypted": {[20]byte{7, 8, 9}, EncryptionRequired, false, nil},
+	}
+
+	for name, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		dialed := make(chan *Client, 1)
+		go func(infoHash [20]byte, policy EncryptionPolicy) {
+			c, err := NewFromConn(context.Background(), clientConn, peerID, infoHash, WithEncryption(policy))
+			if err != nil {
+				clientConn.Close()
+			}
+			dialed <- c
+		}(test.infoHash, test.policy)
+
+		in, err := ReadHandshake(context.Background(), serverConn, infoHashes, WithEncryption(EncryptionPreferred))
+		if test.infoHash == [20]byte{7, 8, 9} {
+			assert.NotNil(t, err, name)
+			if test.err != nil {
+				assert.True(t, errors.Is(err, test.err), name)
+			}
+			<-dialed
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, test.infoHash, in.InfoHash(), name)
+		assert.Equal(t, test.encrypted, in.encrypted(), name)
+
+		c, err := in.Accept(context.Background(), remoteID, bitfield.Bitfield{0xff})
+		require.Nil(t, err, name)
+		assert.Equal(t, peerID, c.RemoteID(), name)
+		assert.Equal(t, bitfield.Bitfield{0xff}, (<-dialed).Bitfield, name)
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestIncomingRequiresEncryption(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	clientConn, serverConn := createClientAndServer(t)
+	defer clientConn.Close()
+	clientConn.Write(handshake.New(infoHash, [20]byte{}).Serialize())
+
+	// The listener allows plaintext, the torrent does not
+	in, err := ReadHandshake(context.Background(), serverConn, [][20]byte{infoHash})
+	require.Nil(t, err)
+	_, err = in.Accept(context.Background(), [20]byte{}, bitfield.Bitfield{0xff}, WithEncryption(EncryptionRequired))
+	assert.True(t, errors.Is(err, ErrPlaintextRefused))
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultKeepAliveInterval is the idle time after which a keep-alive is sent.
+// Peers usually drop connections idle for two minutes.
+const DefaultKeepAliveInterval = 90 * time.Second
+
+// SendKeepAlive sends a keep-alive message to the peer
+func (c *Client) SendKeepAlive() error {
+	return c.send(nil)
+}
+
+// idle returns the time elapsed since the last message was sent to the peer
+func (c *Client) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSent)))
+}
+
+// KeepAlive sends a keep-alive message whenever nothing else was sent to the
+// peer for interval, so that it does not drop the connection while idle, e.g.
+// while we are choked. It returns when ctx is done or the connection cannot be
+// written to.
+func (c *Client) KeepAlive(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if idle := c.idle(); idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+		err := c.SendKeepAlive()
+		if err != nil {
+			return
+		}
+		timer.Reset(interval)
+	}
+}
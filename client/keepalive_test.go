@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepAlive(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	c := &Client{Conn: clientConn, counters: &Counters{}, lastSent: time.Now().UnixNano()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.KeepAlive(ctx, 20*time.Millisecond)
+
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := message.Read(serverConn)
+	require.Nil(t, err)
+	assert.Nil(t, msg)
+	assert.Equal(t, int64(4), c.Counters().OverheadUploaded)
+}
+
+func TestKeepAliveNotSentWhileActive(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	c := &Client{Conn: clientConn, counters: &Counters{}, lastSent: time.Now().UnixNano()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.KeepAlive(ctx, 50*time.Millisecond)
+	go func() {
+		for i := 0; i < 20; i++ {
+			c.SendHave(i)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		serverConn.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := message.Read(serverConn)
+		require.Nil(t, err)
+		require.NotNil(t, msg)
+		assert.Equal(t, message.MsgHave, msg.ID)
+	}
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter limits a bandwidth in bytes per second with a token bucket. It can
+// be shared by several connections, e.g. those of a torrent or all of them,
+// and its limit changed while they transfer. A nil Limiter does not limit.
+type Limiter struct {
+	l *rate.Limiter
+}
+
+// NewLimiter returns a limiter of bytesPerSecond, 0 for no limit
+func NewLimiter(bytesPerSecond int) *Limiter {
+	l := &Limiter{rate.NewLimiter(rate.Inf, 0)}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the limit to bytesPerSecond, 0 for no limit. The bucket
+// holds a second of transfer.
+func (l *Limiter) SetLimit(bytesPerSecond int) {
+	if bytesPerSecond <= 0 {
+		l.l.SetLimit(rate.Inf)
+		return
+	}
+	l.l.SetBurst(bytesPerSecond)
+	l.l.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// Limit returns the limit in bytes per second, 0 for no limit
+func (l *Limiter) Limit() int {
+	if l == nil || l.l.Limit() == rate.Inf {
+		return 0
+	}
+	return int(l.l.Limit())
+}
+
+// Wait blocks until n bytes can be transferred or ctx is done. Transfers
+// larger than the bucket wait for it to refill several times.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		if l.l.Limit() == rate.Inf {
+			return nil
+		}
+		chunk := n
+		if burst := l.l.Burst(); chunk > burst {
+			chunk = burst
+		}
+		err := l.l.WaitN(ctx, chunk)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// The limit changed meanwhile
+			continue
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// WithDownloadLimiter limits the bytes read from the peer. The option can be
+// given several times, e.g. for the limit of the torrent and the global one.
+func WithDownloadLimiter(l *Limiter) Option {
+	return func(o *options) {
+		if l != nil {
+			o.downloadLimiters = append(o.downloadLimiters, l)
+		}
+	}
+}
+
+// WithUploadLimiter limits the bytes written to the peer. The option can be
+// given several times, e.g. for the limit of the torrent and the global one.
+func WithUploadLimiter(l *Limiter) Option {
+	return func(o *options) {
+		if l != nil {
+			o.uploadLimiters = append(o.uploadLimiters, l)
+		}
+	}
+}
+
+// limitedConn is a connection whose reads and writes wait for limiters
+type limitedConn struct {
+	net.Conn
+	download []*Limiter
+	upload   []*Limiter
+
+	ctx    context.Context // done once closed, to interrupt the waits
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// limit returns conn limited by the limiters of the options, if any
+func limit(conn net.Conn, o options) net.Conn {
+	if len(o.downloadLimiters) == 0 && len(o.uploadLimiters) == 0 {
+		return conn
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &limitedConn{
+		Conn:     conn,
+		download: o.downloadLimiters,
+		upload:   o.uploadLimiters,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Read reads from the connection, then waits until the bytes read fit in
+// the download limits
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for _, l := range c.download {
+		if waitErr := l.Wait(c.ctx, n); waitErr != nil {
+			return n, net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+// Write waits until the bytes fit in the upload limits, then writes them
+func (c *limitedConn) Write(p []byte) (int, error) {
+	for _, l := range c.upload {
+		if err := l.Wait(c.ctx, len(p)); err != nil {
+			return 0, net.ErrClosed
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.cancel)
+	return c.Conn.Close()
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(40000)
+	assert.Equal(t, 40000, l.Limit())
+
+	// The bucket holds a second of transfer, the rest waits for it to refill
+	clientConn, serverConn := createClientAndServer(t)
+	defer serverConn.Close()
+	conn := limit(clientConn, options{uploadLimiters: []*Limiter{l}})
+	defer conn.Close()
+	go io.Copy(io.Discard, serverConn)
+
+	start := time.Now()
+	_, err := conn.Write(make([]byte, 60000))
+	require.Nil(t, err)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+
+	// Without limit, the writes do not wait
+	l.SetLimit(0)
+	assert.Equal(t, 0, l.Limit())
+	start = time.Now()
+	_, err = conn.Write(make([]byte, 60000))
+	require.Nil(t, err)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestLimitRead(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer serverConn.Close()
+	conn := limit(clientConn, options{downloadLimiters: []*Limiter{NewLimiter(40000), nil}})
+	defer conn.Close()
+	go serverConn.Write(make([]byte, 60000))
+
+	start := time.Now()
+	_, err := io.ReadFull(conn, make([]byte, 60000))
+	require.Nil(t, err)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+}
+
+func TestLimitClose(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer serverConn.Close()
+	conn := limit(clientConn, options{uploadLimiters: []*Limiter{NewLimiter(1)}})
+
+	// Closing interrupts a write waiting for the limiter
+	written := make(chan error)
+	go func() {
+		_, err := conn.Write(make([]byte, 100))
+		written <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-written:
+		assert.Equal(t, net.ErrClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("write not interrupted")
+	}
+}
+
+func TestNoLimit(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	assert.Equal(t, clientConn, limit(clientConn, newOptions(nil)))
+	assert.Equal(t, 0, (*Limiter)(nil).Limit())
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// RateWindow is the period transfer rates are measured over
+const RateWindow = 10 * time.Second
+
+// meter measures a transfer rate over the last RateWindow, in buckets of one
+// second
+type meter struct {
+	mu      sync.Mutex
+	buckets [RateWindow / time.Second]int64
+	last    int64 // second of the most recent bucket
+}
+
+// advance empties the buckets of the seconds elapsed since the last one
+func (r *meter) advance(now time.Time) {
+	second := now.Unix()
+	if second-r.last >= int64(len(r.buckets)) {
+		r.buckets = [len(r.buckets)]int64{}
+		r.last = second
+		return
+	}
+	for r.last < second {
+		r.last++
+		r.buckets[r.last%int64(len(r.buckets))] = 0
+	}
+}
+
+// add counts n bytes transferred at now
+func (r *meter) add(n int64, now time.Time) {
+	if n == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(now)
+	r.buckets[r.last%int64(len(r.buckets))] += n
+}
+
+// perSecond returns the bytes transferred per second over the window ending
+// at now
+func (r *meter) perSecond(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(now)
+	total := int64(0)
+	for _, n := range r.buckets {
+		total += n
+	}
+	return float64(total) / RateWindow.Seconds()
+}
+
+// DownloadRate returns the block data received from the peer per second,
+// over the last RateWindow
+func (c *Client) DownloadRate() float64 {
+	return c.downloadRate.perSecond(time.Now())
+}
+
+// UploadRate returns the block data sent to the peer per second, over the
+// last RateWindow
+func (c *Client) UploadRate() float64 {
+	return c.uploadRate.perSecond(time.Now())
+}
+
+// DownloadRate returns the block data counted as received per second, over
+// the last RateWindow
+func (cs *Counters) DownloadRate() float64 {
+	if cs == nil {
+		return 0
+	}
+	return cs.downloadRate.perSecond(time.Now())
+}
+
+// UploadRate returns the block data counted as sent per second, over the
+// last RateWindow
+func (cs *Counters) UploadRate() float64 {
+	if cs == nil {
+		return 0
+	}
+	return cs.uploadRate.perSecond(time.Now())
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var r meter
+	r.add(1000, start)
+	r.add(1000, start.Add(500*time.Millisecond))
+	r.add(3000, start.Add(5*time.Second))
+	assert.Equal(t, 500.0, r.perSecond(start.Add(5*time.Second)))
+
+	// Bytes leave the rate as they get older than the window
+	assert.Equal(t, 300.0, r.perSecond(start.Add(RateWindow)))
+	assert.Equal(t, 0.0, r.perSecond(start.Add(5*time.Second+RateWindow)))
+	r.add(1000, start.Add(time.Hour))
+	assert.Equal(t, 100.0, r.perSecond(start.Add(time.Hour)))
+}
+
+func TestClientRates(t *testing.T) {
+	clientConn, serverConn := createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	c := &Client{Conn: clientConn, counters: &Counters{}}
+
+	go func() {
+		serverConn.Write(message.NewPiece(0, 0, make([]byte, 100)).Serialize())
+	}()
+	_, err := c.Read()
+	require.Nil(t, err)
+	require.Nil(t, c.SendPiece(0, 0, make([]byte, 50)))
+	// Only the block data counts
+	require.Nil(t, c.SendHave(0))
+
+	assert.Equal(t, 100/RateWindow.Seconds(), c.DownloadRate())
+	assert.Equal(t, 50/RateWindow.Seconds(), c.UploadRate())
+	assert.Equal(t, 100/RateWindow.Seconds(), c.counters.DownloadRate())
+	assert.Equal(t, 50/RateWindow.Seconds(), c.counters.UploadRate())
+
+	// Data from elsewhere counts in the totals and rates
+	c.counters.AddPayloadDownloaded(200)
+	assert.Equal(t, int64(300), c.counters.Snapshot().PayloadDownloaded)
+	assert.Equal(t, 300/RateWindow.Seconds(), c.counters.DownloadRate())
+
+	var none *Counters
+	assert.Equal(t, 0.0, none.DownloadRate())
+	assert.Equal(t, 0.0, none.UploadRate())
+}
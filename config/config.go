@@ -0,0 +1,178 @@
+// Package config reads configuration files setting the flags of a command,
+// so that long-running deployments do not need them on the command line.
+//
+// The files are in a subset of TOML: each line is blank, a # comment or a
+// key = value pair, where the key is the name of a flag and the value a
+// string, in double or single quotes, an integer, a float or a boolean.
+// Tables and arrays are not supported.
+//
+//	# daemon.toml
+//	dir = "/srv/torrents"
+//	port = 6881
+//	download-limit = 1_000_000
+//	dht = true
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Setting is a key = value pair of a configuration file
+type Setting struct {
+	Key   string
+	Value string // unquoted if it was a string
+	Line  int
+}
+
+// Parse reads the settings of a configuration file. Keys must be unique.
+func Parse(r io.Reader) ([]Setting, error) {
+	var settings []Setting
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		eq := strings.IndexByte(text, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key := strings.TrimSpace(text[:eq])
+		if !validKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", line, key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line, key)
+		}
+		seen[key] = true
+		value, err := parseValue(strings.TrimSpace(text[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, key, err)
+		}
+		settings = append(settings, Setting{Key: key, Value: value, Line: line})
+	}
+	return settings, scanner.Err()
+}
+
+// validKey tells whether a key is a bare TOML key, as the flag names are
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue returns a value as a flag would take it, dropping a trailing
+// comment
+func parseValue(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		end := closingQuote(s)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if err := checkComment(s[end+1:]); err != nil {
+			return "", err
+		}
+		return strconv.Unquote(s[:end+1])
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if err := checkComment(s[end+2:]); err != nil {
+			return "", err
+		}
+		return s[1 : end+1], nil
+	case s[0] == '[' || s[0] == '{':
+		return "", fmt.Errorf("arrays and tables are not supported")
+	}
+
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "true" || s == "false" {
+		return s, nil
+	}
+	number := strings.ReplaceAll(s, "_", "")
+	if _, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return number, nil
+	}
+	if _, err := strconv.ParseFloat(number, 64); err == nil {
+		return number, nil
+	}
+	return "", fmt.Errorf("invalid value %q", s)
+}
+
+// closingQuote returns the index of the quote ending a double-quoted string
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// checkComment checks that only a comment follows a value
+func checkComment(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && rest[0] != '#' {
+		return fmt.Errorf("unexpected %q after value", rest)
+	}
+	return nil
+}
+
+// Apply sets the flags of fs from the settings of a configuration file,
+// except the ones set on the command line, which take precedence. fs must
+// have been parsed. Keys that are not flags of fs are an error.
+func Apply(fs *flag.FlagSet, settings []Setting) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range settings {
+		if fs.Lookup(s.Key) == nil {
+			return fmt.Errorf("line %d: unknown setting %q", s.Line, s.Key)
+		}
+		if set[s.Key] {
+			continue
+		}
+		if err := fs.Set(s.Key, s.Value); err != nil {
+			return fmt.Errorf("line %d: %s: %w", s.Line, s.Key, err)
+		}
+	}
+	return nil
+}
+
+// Load reads the configuration file at path and applies it to fs, see Apply
+func Load(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	settings, err := Parse(f)
+	if err == nil {
+		err = Apply(fs, settings)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
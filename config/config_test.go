@@ -0,0 +1,92 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	input := `# daemon settings
+
+dir = "/srv/my \"torrents\"" # quoted
+proxy = 'socks5://host:1080#x'
+port = 6881
+download-limit = 1_000_000
+seed-ratio = 1.5
+dht = false
+`
+	settings, err := Parse(strings.NewReader(input))
+	require.Nil(t, err)
+	assert.Equal(t, []Setting{
+		{"dir", `/srv/my "torrents"`, 3},
+		{"proxy", "socks5://host:1080#x", 4},
+		{"port", "6881", 5},
+		{"download-limit", "1000000", 6},
+		{"seed-ratio", "1.5", 7},
+		{"dht", "false", 8},
+	}, settings)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		want  string
+	}{
+		"missing equal":    {"port 6881", "line 1: expected key = value"},
+		"invalid key":      {"\n\"port\" = 1", `line 2: invalid key "\"port\""`},
+		"duplicate key":    {"port = 1\nport = 2", `line 2: duplicate key "port"`},
+		"missing value":    {"port =", "line 1: port: missing value"},
+		"bare string":      {"dir = /srv", `line 1: dir: invalid value "/srv"`},
+		"unterminated":     {`dir = "/srv`, "line 1: dir: unterminated string"},
+		"trailing garbage": {`dir = "/srv" x`, `line 1: dir: unexpected "x" after value`},
+		"array":            {`tracker = ["a"]`, "line 1: tracker: arrays and tables are not supported"},
+		"table":            {"[daemon]", "line 1: expected key = value"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input))
+			require.NotNil(t, err)
+			assert.Equal(t, tt.want, err.Error())
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte("port = 6881\ndir = \"/srv\"\nidle = \"30m\"\ndht = false\n"), 0644))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Uint("port", 0, "")
+	dir := fs.String("dir", ".", "")
+	idle := fs.Duration("idle", 0, "")
+	dht := fs.Bool("dht", true, "")
+	require.Nil(t, fs.Parse([]string{"-dir", "/data"}))
+
+	require.Nil(t, Load(fs, path))
+	assert.Equal(t, uint(6881), *port)
+	assert.Equal(t, "/data", *dir)
+	assert.Equal(t, 30*time.Minute, *idle)
+	assert.False(t, *dht)
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Uint("port", 0, "")
+	require.Nil(t, ioutil.WriteFile(path, []byte("port = -1\n"), 0644))
+	err := Load(fs, path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), path+": line 1: port: ")
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("# comment\nunknown = 1\n"), 0644))
+	err = Load(fs, path)
+	require.NotNil(t, err)
+	assert.Equal(t, path+`: line 2: unknown setting "unknown"`, err.Error())
+
+	assert.NotNil(t, Load(fs, filepath.Join(t.TempDir(), "missing.toml")))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+// listFlag is a flag that can be given several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runCreate creates the .torrent file of a file or a directory:
+//
+//	torrent-client create [flags] <path>
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: torrent-client create [flags] <path>")
+		fs.PrintDefaults()
+	}
+	var announce, webSeeds listFlag
+	fs.Var(&announce, "announce", "tier of trackers, as comma-separated URLs; can be repeated")
+	fs.Var(&webSeeds, "webseed", "URL of a web seed; can be repeated")
+	output := fs.String("o", "", "path of the .torrent file (default: the name of the content with .torrent)")
+	comment := fs.String("comment", "", "comment of the torrent")
+	private := fs.Bool("private", false, "only get peers from the trackers")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes (default: chosen from the size of the content)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected the path of the content")
+	}
+	path := fs.Arg(0)
+
+	opts := []torrentfile.CreateOption{
+		torrentfile.WithPieceLength(*pieceLength),
+		torrentfile.WithComment(*comment),
+		torrentfile.WithCreatedBy("torrent-client"),
+		torrentfile.WithWebSeeds(webSeeds...),
+	}
+	var tiers [][]string
+	for _, tier := range announce {
+		tiers = append(tiers, strings.Split(tier, ","))
+	}
+	if len(tiers) == 1 && len(tiers[0]) == 1 {
+		opts = append(opts, torrentfile.WithAnnounce(tiers[0][0]))
+	} else if len(tiers) > 0 {
+		opts = append(opts, torrentfile.WithAnnounceList(tiers))
+	}
+	if *private {
+		opts = append(opts, torrentfile.WithPrivate())
+	}
+	tf, err := torrentfile.Create(path, opts...)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(path)) + ".torrent"
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	err = tf.Write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created %s, info hash %x\n", *output, tf.InfoHash)
+	return nil
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Client calls the API of a daemon
+type Client struct {
+	// URL is the address the Server is served at, e.g.
+	// http://localhost:9091/rpc
+	URL string
+	// HTTPClient sends the calls. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	id int64
+}
+
+// NewClient returns a client of the daemon served at url
+func NewClient(url string) *Client {
+	return &Client{URL: url}
+}
+
+// Call calls a method with params, which may be nil, and decodes its result
+// into result unless it is nil. The errors of the API are returned as *Error.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	id := atomic.AddInt64(&c.id, 1)
+	req := struct {
+		JSONRPC string      `json:"jsonrpc"`
+		Method  string      `json:"method"`
+		Params  interface{} `json:"params,omitempty"`
+		ID      int64       `json:"id"`
+	}{"2.0", method, params, id}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpRes, err := httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", httpRes.Status)
+	}
+
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if result == nil || len(res.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+// AddTorrent adds a torrent from the content of its .torrent file
+func (c *Client) AddTorrent(ctx context.Context, torrent []byte) (TorrentInfo, error) {
+	var info TorrentInfo
+	err := c.Call(ctx, MethodAdd, AddParams{Torrent: torrent}, &info)
+	return info, err
+}
+
+// AddMagnet adds a torrent from its magnet link
+func (c *Client) AddMagnet(ctx context.Context, uri string) (TorrentInfo, error) {
+	var info TorrentInfo
+	err := c.Call(ctx, MethodAdd, AddParams{Magnet: uri}, &info)
+	return info, err
+}
+
+// Remove removes a torrent by its hex info hash, keeping its data
+func (c *Client) Remove(ctx context.Context, infoHash string) error {
+	return c.Call(ctx, MethodRemove, TorrentParams{infoHash}, nil)
+}
+
+// Torrent returns the status of a torrent by its hex info hash
+func (c *Client) Torrent(ctx context.Context, infoHash string) (TorrentInfo, error) {
+	var info TorrentInfo
+	err := c.Call(ctx, MethodGet, TorrentParams{infoHash}, &info)
+	return info, err
+}
+
+// Torrents returns the status of the torrents, sorted by name
+func (c *Client) Torrents(ctx context.Context) ([]TorrentInfo, error) {
+	var infos []TorrentInfo
+	err := c.Call(ctx, MethodList, nil, &infos)
+	return infos, err
+}
+
+// Pause stops a running torrent by its hex info hash
+func (c *Client) Pause(ctx context.Context, infoHash string) (TorrentInfo, error) {
+	var info TorrentInfo
+	err := c.Call(ctx, MethodPause, TorrentParams{infoHash}, &info)
+	return info, err
+}
+
+// Resume runs a paused torrent by its hex info hash
+func (c *Client) Resume(ctx context.Context, infoHash string) (TorrentInfo, error) {
+	var info TorrentInfo
+	err := c.Call(ctx, MethodResume, TorrentParams{infoHash}, &info)
+	return info, err
+}
+
+// Verify hashes the data of a torrent by its hex info hash again, the
+// missing pieces being downloaded again
+func (c *Client) Verify(ctx context.Context, infoHash string) (TorrentInfo, error) {
+	var info TorrentInfo
+	err := c.Call(ctx, MethodVerify, TorrentParams{infoHash}, &info)
+	return info, err
+}
+
+// Move moves a torrent by its hex info hash to a position of the queue, from
+// 0 for the first
+func (c *Client) Move(ctx context.Context, infoHash string, position int) (TorrentInfo, error) {
+	var info TorrentInfo
+	err := c.Call(ctx, MethodMove, MoveParams{infoHash, position}, &info)
+	return info, err
+}
+
+// Session returns the state of the session
+func (c *Client) Session(ctx context.Context) (SessionInfo, error) {
+	var info SessionInfo
+	err := c.Call(ctx, MethodSessionGet, nil, &info)
+	return info, err
+}
+
+// SetLimits sets the bandwidth limits of the session, leaving the nil ones
+// unchanged
+func (c *Client) SetLimits(ctx context.Context, download, upload *int) (SessionInfo, error) {
+	var info SessionInfo
+	err := c.Call(ctx, MethodSessionSet, SessionParams{DownloadLimit: download, UploadLimit: upload}, &info)
+	return info, err
+}
+
+// SetSchedule replaces the alternate bandwidth limits by time of day of the
+// session, in the format of session.ParseSchedule, empty for none
+func (c *Client) SetSchedule(ctx context.Context, schedule string) (SessionInfo, error) {
+	var info SessionInfo
+	err := c.Call(ctx, MethodSessionSet, SessionParams{Schedule: &schedule}, &info)
+	return info, err
+}
+
+// SetQueueLimits sets the numbers of torrents downloading and seeding at the
+// same time, leaving the nil ones unchanged
+func (c *Client) SetQueueLimits(ctx context.Context, downloads, seeds *int) (SessionInfo, error) {
+	var info SessionInfo
+	err := c.Call(ctx, MethodSessionSet, SessionParams{MaxActiveDownloads: downloads, MaxActiveSeeds: seeds}, &info)
+	return info, err
+}
@@ -0,0 +1,487 @@
+// Package daemon controls a session over HTTP with JSON-RPC 2.0, so that the
+// client can run headless on a server and be driven by Client or any
+// JSON-RPC library.
+package daemon
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/leonhfr/torrent-client/session"
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+// Methods of the API, with the params and result they take
+const (
+	MethodAdd        = "torrent.add"    // MethodAdd takes AddParams and returns a TorrentInfo
+	MethodRemove     = "torrent.remove" // MethodRemove takes TorrentParams and returns nothing
+	MethodGet        = "torrent.get"    // MethodGet takes TorrentParams and returns a TorrentInfo
+	MethodList       = "torrent.list"   // MethodList takes nothing and returns TorrentInfos
+	MethodPause      = "torrent.pause"  // MethodPause takes TorrentParams and returns a TorrentInfo
+	MethodResume     = "torrent.resume" // MethodResume takes TorrentParams and returns a TorrentInfo
+	MethodMove       = "torrent.move"   // MethodMove takes MoveParams and returns a TorrentInfo
+	MethodVerify     = "torrent.verify" // MethodVerify takes TorrentParams and returns a TorrentInfo
+	MethodSessionGet = "session.get"    // MethodSessionGet takes nothing and returns a SessionInfo
+	MethodSessionSet = "session.set"    // MethodSessionSet takes SessionParams and returns a SessionInfo
+)
+
+// Codes of the errors returned by the API, the standard JSON-RPC ones then
+// the ones of the application
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeUnknownTorrent = 1 // CodeUnknownTorrent is a torrent not in the session
+	CodeDuplicate      = 2 // CodeDuplicate is a torrent already in the session
+	CodeInvalidState   = 3 // CodeInvalidState is a torrent already paused, already running or queued, or without metadata
+)
+
+// Error is an error returned by the API
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// AddParams adds a torrent from the content of a .torrent file, or else from
+// a magnet link
+type AddParams struct {
+	Torrent []byte `json:"torrent,omitempty"` // base64 in JSON
+	Magnet  string `json:"magnet,omitempty"`
+}
+
+// TorrentParams identifies a torrent by its hex encoded info hash
+type TorrentParams struct {
+	InfoHash string `json:"info_hash"`
+}
+
+// MoveParams moves a torrent to a position of the queue, from 0
+type MoveParams struct {
+	InfoHash string `json:"info_hash"`
+	Position int    `json:"position"`
+}
+
+// SessionParams sets the bandwidth limits of the session in bytes per
+// second, and the numbers of torrents downloading and seeding at the same
+// time, 0 for no limit. Schedule replaces the alternate bandwidth limits by
+// time of day, in the format of session.ParseSchedule, empty for none.
+// Missing settings are left unchanged.
+type SessionParams struct {
+	DownloadLimit      *int    `json:"download_limit,omitempty"`
+	UploadLimit        *int    `json:"upload_limit,omitempty"`
+	MaxActiveDownloads *int    `json:"max_active_downloads,omitempty"`
+	MaxActiveSeeds     *int    `json:"max_active_seeds,omitempty"`
+	Schedule           *string `json:"schedule,omitempty"`
+}
+
+// TorrentInfo is the status of a torrent of the session
+type TorrentInfo struct {
+	InfoHash        string  `json:"info_hash"`
+	Name            string  `json:"name"`
+	Length          int     `json:"length"`
+	Running         bool    `json:"running"`
+	Queued          bool    `json:"queued"`
+	QueuePosition   int     `json:"queue_position"`
+	CompletedPieces int     `json:"completed_pieces"`
+	TotalPieces     int     `json:"total_pieces"`
+	Completed       int64   `json:"completed"`
+	Downloaded      int64   `json:"downloaded"`
+	Uploaded        int64   `json:"uploaded"`
+	DownloadRate    float64 `json:"download_rate"`
+	UploadRate      float64 `json:"upload_rate"`
+	Peers           int     `json:"peers"`
+	Ratio           float64 `json:"ratio"`
+	// ETA is in seconds, -1 while nothing is downloaded
+	ETA   int64  `json:"eta"`
+	Error string `json:"error,omitempty"`
+}
+
+// SessionInfo is the state of the session
+type SessionInfo struct {
+	PeerID             string `json:"peer_id"`
+	Port               uint16 `json:"port"`
+	DownloadLimit      int    `json:"download_limit"`
+	UploadLimit        int    `json:"upload_limit"`
+	MaxActiveDownloads int    `json:"max_active_downloads"`
+	MaxActiveSeeds     int    `json:"max_active_seeds"`
+	// Schedule is in the format of session.ParseSchedule, and ActiveRule
+	// the rule of it replacing the bandwidth limits now, if any
+	Schedule   string `json:"schedule"`
+	ActiveRule string `json:"active_rule,omitempty"`
+	Torrents   int    `json:"torrents"`
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// Server serves the API of a session over HTTP, each request being a POST
+// of a JSON-RPC 2.0 call. Batches are not supported. The calls must be sent
+// as application/json and not from another origin, so that web pages cannot
+// control the daemon with cross-site form posts, and name the server by
+// localhost, an IP address or one of Hosts, so that they cannot either after
+// pointing a name of theirs to the server with DNS rebinding.
+type Server struct {
+	// Hosts are the names the server can be reached by besides localhost and
+	// its IP addresses
+	Hosts []string
+
+	ctx     context.Context
+	session *session.Session
+	methods map[string]func(ctx context.Context, params json.RawMessage) (interface{}, error)
+}
+
+// NewServer returns a server controlling the session. The torrents added or
+// resumed run until ctx is done.
+func NewServer(ctx context.Context, s *session.Session) *Server {
+	srv := &Server{ctx: ctx, session: s}
+	srv.methods = map[string]func(context.Context, json.RawMessage) (interface{}, error){
+		MethodAdd:        srv.add,
+		MethodRemove:     srv.remove,
+		MethodGet:        srv.get,
+		MethodList:       srv.list,
+		MethodPause:      srv.pause,
+		MethodResume:     srv.resume,
+		MethodMove:       srv.move,
+		MethodVerify:     srv.verify,
+		MethodSessionGet: srv.sessionGet,
+		MethodSessionSet: srv.sessionSet,
+	}
+	return srv
+}
+
+// ServeHTTP answers a JSON-RPC call
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "expected application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !allowedHost(r, srv.Hosts) {
+		http.Error(w, "unknown host", http.StatusForbidden)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	var req request
+	res := response{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		res.Error = &Error{CodeParseError, err.Error()}
+	} else {
+		if len(req.ID) > 0 {
+			res.ID = req.ID
+		}
+		res.Result, res.Error = srv.call(r.Context(), req)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// sameOrigin tells whether a request comes from a page of the server itself,
+// or from a client sending no Origin header such as the remote command
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// allowedHost tells whether a request names the server by localhost, an IP
+// address or one of hosts
+func allowedHost(r *http.Request, hosts []string) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // without port
+	}
+	host = strings.TrimSuffix(host, ".")
+	if net.ParseIP(strings.Trim(host, "[]")) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// call runs the method of a request, until ctx is done for the methods
+// waiting for the session
+func (srv *Server) call(ctx context.Context, req request) (interface{}, *Error) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, &Error{CodeInvalidRequest, "invalid JSON-RPC 2.0 request"}
+	}
+	method, ok := srv.methods[req.Method]
+	if !ok {
+		return nil, &Error{CodeMethodNotFound, fmt.Sprintf("unknown method %q", req.Method)}
+	}
+	result, err := method(ctx, req.Params)
+	if err != nil {
+		var rpcErr *Error
+		if errors.As(err, &rpcErr) {
+			return nil, rpcErr
+		}
+		return nil, &Error{CodeInvalidParams, err.Error()}
+	}
+	return result, nil
+}
+
+// decodeParams decodes the params of a request, which may be missing
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(params, v)
+}
+
+// infoHash decodes the info hash of TorrentParams
+func (p TorrentParams) infoHash() ([20]byte, error) {
+	var h [20]byte
+	buf, err := hex.DecodeString(p.InfoHash)
+	if err != nil || len(buf) != len(h) {
+		return h, fmt.Errorf("invalid info hash %q", p.InfoHash)
+	}
+	copy(h[:], buf)
+	return h, nil
+}
+
+// torrentParams decodes TorrentParams and returns the info hash of a torrent
+// of the session
+func (srv *Server) torrentParams(params json.RawMessage) ([20]byte, error) {
+	var p TorrentParams
+	if err := decodeParams(params, &p); err != nil {
+		return [20]byte{}, err
+	}
+	h, err := p.infoHash()
+	if err != nil {
+		return h, err
+	}
+	if _, ok := srv.session.Status(h); !ok {
+		return h, &Error{CodeUnknownTorrent, fmt.Sprintf("unknown torrent %s", p.InfoHash)}
+	}
+	return h, nil
+}
+
+func (srv *Server) add(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p AddParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	var tf torrentfile.TorrentFile
+	var err error
+	switch {
+	case len(p.Torrent) > 0:
+		tf, err = torrentfile.Parse(p.Torrent)
+	case p.Magnet != "":
+		tf, err = torrentfile.FromMagnet(p.Magnet)
+	default:
+		err = errors.New("missing torrent or magnet")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !srv.session.AddTorrent(srv.ctx, tf) {
+		return nil, &Error{CodeDuplicate, fmt.Sprintf("torrent %x already added", tf.InfoHash)}
+	}
+	return srv.info(tf.InfoHash), nil
+}
+
+func (srv *Server) remove(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.torrentParams(params)
+	if err != nil {
+		return nil, err
+	}
+	srv.session.RemoveTorrent(h)
+	return nil, nil
+}
+
+func (srv *Server) get(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.torrentParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return srv.info(h), nil
+}
+
+func (srv *Server) list(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	statuses := srv.session.Statuses()
+	infos := make([]TorrentInfo, len(statuses))
+	for i, status := range statuses {
+		infos[i] = torrentInfo(status)
+	}
+	return infos, nil
+}
+
+func (srv *Server) pause(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.torrentParams(params)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.session.StopTorrent(h) {
+		return nil, &Error{CodeInvalidState, fmt.Sprintf("torrent %x is neither running nor queued", h)}
+	}
+	return srv.info(h), nil
+}
+
+func (srv *Server) resume(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.torrentParams(params)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.session.StartTorrent(srv.ctx, h) {
+		return nil, &Error{CodeInvalidState, fmt.Sprintf("torrent %x is already running or queued", h)}
+	}
+	return srv.info(h), nil
+}
+
+func (srv *Server) verify(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	h, err := srv.torrentParams(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := srv.session.VerifyTorrent(ctx, h); err != nil {
+		if errors.Is(err, session.ErrMetadataPending) || errors.Is(err, session.ErrVerifying) {
+			return nil, &Error{CodeInvalidState, fmt.Sprintf("torrent %x: %s", h, err)}
+		}
+		return nil, err
+	}
+	return srv.info(h), nil
+}
+
+func (srv *Server) move(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p MoveParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	h, err := srv.torrentParams(params)
+	if err != nil {
+		return nil, err
+	}
+	srv.session.MoveTorrent(h, p.Position)
+	return srv.info(h), nil
+}
+
+func (srv *Server) sessionGet(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	peerID := srv.session.PeerID()
+	downloads, seeds := srv.session.QueueLimits()
+	var active string
+	if rule, ok := srv.session.ActiveRule(); ok {
+		active = rule.String()
+	}
+	return SessionInfo{
+		PeerID:             hex.EncodeToString(peerID[:]),
+		Port:               srv.session.ListenPort(),
+		DownloadLimit:      srv.session.DownloadLimit(),
+		UploadLimit:        srv.session.UploadLimit(),
+		MaxActiveDownloads: downloads,
+		MaxActiveSeeds:     seeds,
+		Schedule:           session.FormatSchedule(srv.session.Schedule()),
+		ActiveRule:         active,
+		Torrents:           len(srv.session.Torrents()),
+	}, nil
+}
+
+func (srv *Server) sessionSet(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var p SessionParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	for _, limit := range []*int{p.DownloadLimit, p.UploadLimit, p.MaxActiveDownloads, p.MaxActiveSeeds} {
+		if limit != nil && *limit < 0 {
+			return nil, errors.New("negative limit")
+		}
+	}
+	var rules []session.ScheduleRule
+	if p.Schedule != nil {
+		var err error
+		if rules, err = session.ParseSchedule(*p.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	if p.DownloadLimit != nil {
+		srv.session.SetDownloadLimit(*p.DownloadLimit)
+	}
+	if p.UploadLimit != nil {
+		srv.session.SetUploadLimit(*p.UploadLimit)
+	}
+	if p.MaxActiveDownloads != nil || p.MaxActiveSeeds != nil {
+		downloads, seeds := srv.session.QueueLimits()
+		if p.MaxActiveDownloads != nil {
+			downloads = *p.MaxActiveDownloads
+		}
+		if p.MaxActiveSeeds != nil {
+			seeds = *p.MaxActiveSeeds
+		}
+		srv.session.SetQueueLimits(downloads, seeds)
+	}
+	if p.Schedule != nil {
+		srv.session.SetSchedule(rules)
+	}
+	return srv.sessionGet(ctx, nil)
+}
+
+// info returns the status of a torrent of the session
+func (srv *Server) info(h [20]byte) TorrentInfo {
+	status, _ := srv.session.Status(h)
+	return torrentInfo(status)
+}
+
+func torrentInfo(status session.TorrentStatus) TorrentInfo {
+	stats := status.Stats
+	info := TorrentInfo{
+		InfoHash:        hex.EncodeToString(status.InfoHash[:]),
+		Name:            status.Name,
+		Length:          status.Length,
+		Running:         status.Running,
+		Queued:          status.Queued,
+		QueuePosition:   status.QueuePosition,
+		CompletedPieces: stats.CompletedPieces,
+		TotalPieces:     stats.TotalPieces,
+		Completed:       stats.Completed,
+		Downloaded:      stats.TotalDownloaded,
+		Uploaded:        stats.TotalUploaded,
+		DownloadRate:    stats.DownloadRate,
+		UploadRate:      stats.UploadRate,
+		Peers:           stats.Peers,
+		Ratio:           stats.Ratio,
+		ETA:             int64(math.Ceil(stats.ETA.Seconds())),
+	}
+	if stats.ETA < 0 {
+		info.ETA = -1
+	}
+	if status.Err != nil {
+		info.Error = status.Err.Error()
+	}
+	return info
+}
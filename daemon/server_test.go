@@ -0,0 +1,316 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/session"
+	"github.com/leonhfr/torrent-client/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDaemon returns a client of a daemon controlling a new session,
+// whose directory holds a file
+func newTestDaemon(t *testing.T, ctx context.Context) (*Client, *session.Session) {
+	s := session.New()
+	s.Dir = t.TempDir()
+	s.Logger = logging.Discard
+	require.Nil(t, s.Listen(ctx))
+	t.Cleanup(func() { s.Close() })
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.Dir, "file"), []byte("served by the daemon"), 0644))
+
+	server := httptest.NewServer(NewServer(ctx, s))
+	t.Cleanup(server.Close)
+	return NewClient(server.URL), s
+}
+
+// newTestTracker returns the URL of a tracker knowing a single peer that
+// never answers, so that the torrents announcing to it keep running for the
+// time of the handshake timeout instead of failing for lack of peers
+func newTestTracker(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	peers := string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)})
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "d8:intervali60e5:peers6:%se", peers)
+	}))
+	t.Cleanup(tracker.Close)
+	return tracker.URL
+}
+
+func TestServerTorrents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, s := newTestDaemon(t, ctx)
+
+	tf, err := torrentfile.Create(filepath.Join(s.Dir, "file"), torrentfile.WithAnnounce(newTestTracker(t)))
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	require.Nil(t, tf.Write(&buf))
+	infoHash := hex.EncodeToString(tf.InfoHash[:])
+
+	info, err := c.AddTorrent(ctx, buf.Bytes())
+	require.Nil(t, err)
+	assert.Equal(t, infoHash, info.InfoHash)
+	assert.Equal(t, "file", info.Name)
+	assert.Equal(t, tf.Length, info.Length)
+	assert.True(t, info.Running)
+
+	_, err = c.AddTorrent(ctx, buf.Bytes())
+	assert.Equal(t, &Error{CodeDuplicate, "torrent " + infoHash + " already added"}, err)
+
+	magnet, err := c.AddMagnet(ctx, "magnet:?xt=urn:btih:"+strings.Repeat("ab", 20)+"&dn=magnet")
+	require.Nil(t, err)
+	assert.Equal(t, "magnet", magnet.Name)
+	assert.Equal(t, 0, magnet.Length)
+
+	infos, err := c.Torrents(ctx)
+	require.Nil(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, "file", infos[0].Name)
+	assert.Equal(t, "magnet", infos[1].Name)
+	assert.Equal(t, 1, infos[1].QueuePosition)
+
+	info, err = c.Pause(ctx, infoHash)
+	require.Nil(t, err)
+	assert.False(t, info.Running)
+	_, err = c.Pause(ctx, infoHash)
+	assert.Equal(t, CodeInvalidState, err.(*Error).Code)
+
+	info, err = c.Resume(ctx, infoHash)
+	require.Nil(t, err)
+	assert.True(t, info.Running)
+	_, err = c.Resume(ctx, infoHash)
+	assert.Equal(t, CodeInvalidState, err.(*Error).Code)
+
+	// The statistics are refreshed while running
+	require.Eventually(t, func() bool {
+		info, err := c.Torrent(ctx, infoHash)
+		return err == nil && info.TotalPieces == len(tf.PieceHashes)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The run started without the data, which verifying finds once put back
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.Dir, "file"), []byte("served by the daemon"), 0644))
+	info, err = c.Verify(ctx, infoHash)
+	require.Nil(t, err)
+	assert.Equal(t, len(tf.PieceHashes), info.CompletedPieces)
+	_, err = c.Verify(ctx, magnet.InfoHash)
+	assert.Equal(t, CodeInvalidState, err.(*Error).Code)
+
+	// Verifying stops with the call
+	canceled, cancelCall := context.WithCancel(ctx)
+	cancelCall()
+	params, err := json.Marshal(TorrentParams{infoHash})
+	require.Nil(t, err)
+	_, rpcErr := NewServer(ctx, s).call(canceled, request{JSONRPC: "2.0", Method: MethodVerify, Params: params})
+	assert.Equal(t, &Error{CodeInvalidParams, context.Canceled.Error()}, rpcErr)
+
+	magnet, err = c.Move(ctx, magnet.InfoHash, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 0, magnet.QueuePosition)
+	info, err = c.Torrent(ctx, infoHash)
+	require.Nil(t, err)
+	assert.Equal(t, 1, info.QueuePosition)
+	_, err = c.Move(ctx, strings.Repeat("cd", 20), 0)
+	assert.Equal(t, CodeUnknownTorrent, err.(*Error).Code)
+
+	require.Nil(t, c.Remove(ctx, infoHash))
+	_, err = c.Torrent(ctx, infoHash)
+	assert.Equal(t, &Error{CodeUnknownTorrent, "unknown torrent " + infoHash}, err)
+	infos, err = c.Torrents(ctx)
+	require.Nil(t, err)
+	assert.Len(t, infos, 1)
+}
+
+func TestServerSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, s := newTestDaemon(t, ctx)
+
+	info, err := c.Session(ctx)
+	require.Nil(t, err)
+	peerID := s.PeerID()
+	assert.Equal(t, SessionInfo{PeerID: hex.EncodeToString(peerID[:]), Port: s.ListenPort()}, info)
+
+	download, upload := 1000, 500
+	info, err = c.SetLimits(ctx, &download, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 1000, info.DownloadLimit)
+	assert.Equal(t, 0, info.UploadLimit)
+	info, err = c.SetLimits(ctx, nil, &upload)
+	require.Nil(t, err)
+	assert.Equal(t, 1000, info.DownloadLimit)
+	assert.Equal(t, 500, info.UploadLimit)
+	assert.Equal(t, 1000, s.DownloadLimit())
+	assert.Equal(t, 500, s.UploadLimit())
+
+	downloads, seeds := 2, 3
+	info, err = c.SetQueueLimits(ctx, &downloads, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 2, info.MaxActiveDownloads)
+	assert.Equal(t, 0, info.MaxActiveSeeds)
+	info, err = c.SetQueueLimits(ctx, nil, &seeds)
+	require.Nil(t, err)
+	assert.Equal(t, 2, info.MaxActiveDownloads)
+	assert.Equal(t, 3, info.MaxActiveSeeds)
+
+	negative := -1
+	_, err = c.SetLimits(ctx, &negative, nil)
+	assert.Equal(t, &Error{CodeInvalidParams, "negative limit"}, err)
+	_, err = c.SetQueueLimits(ctx, nil, &negative)
+	assert.Equal(t, &Error{CodeInvalidParams, "negative limit"}, err)
+
+	info, err = c.SetSchedule(ctx, "daily 00:00-00:00 100 200; sat,sun 09:00-18:00 0 0")
+	require.Nil(t, err)
+	assert.Equal(t, "daily 00:00-00:00 100 200; sat,sun 09:00-18:00 0 0", info.Schedule)
+	assert.Equal(t, "daily 00:00-00:00 100 200", info.ActiveRule)
+	assert.Equal(t, 1000, info.DownloadLimit)
+	_, err = c.SetSchedule(ctx, "daily 9:00-18:00 0 0")
+	assert.Equal(t, &Error{CodeInvalidParams, `rule "daily 9:00-18:00 0 0": invalid time "9:00"`}, err)
+	info, err = c.SetSchedule(ctx, "")
+	require.Nil(t, err)
+	assert.Empty(t, info.Schedule)
+	assert.Empty(t, info.ActiveRule)
+}
+
+func TestServerErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _ := newTestDaemon(t, ctx)
+
+	tests := map[string]struct {
+		method string
+		params interface{}
+		code   int
+	}{
+		"unknown method":       {"torrent.unknown", nil, CodeMethodNotFound},
+		"missing torrent":      {MethodAdd, AddParams{}, CodeInvalidParams},
+		"invalid torrent":      {MethodAdd, AddParams{Torrent: []byte("invalid")}, CodeInvalidParams},
+		"invalid magnet":       {MethodAdd, AddParams{Magnet: "http://example.com"}, CodeInvalidParams},
+		"invalid params":       {MethodGet, []int{1}, CodeInvalidParams},
+		"invalid info hash":    {MethodGet, TorrentParams{"abc"}, CodeInvalidParams},
+		"unknown torrent":      {MethodPause, TorrentParams{strings.Repeat("00", 20)}, CodeUnknownTorrent},
+		"missing info hash":    {MethodRemove, nil, CodeInvalidParams},
+		"verify unknown":       {MethodVerify, TorrentParams{strings.Repeat("00", 20)}, CodeUnknownTorrent},
+		"invalid session args": {MethodSessionSet, "limits", CodeInvalidParams},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := c.Call(ctx, tt.method, tt.params, nil)
+			require.IsType(t, &Error{}, err)
+			assert.Equal(t, tt.code, err.(*Error).Code)
+		})
+	}
+}
+
+func TestServerRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _ := newTestDaemon(t, ctx)
+
+	tests := map[string]struct {
+		body string
+		want string
+	}{
+		"parse error":     {`{`, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected EOF"},"id":null}`},
+		"invalid version": {`{"method":"session.get","id":1}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid JSON-RPC 2.0 request"},"id":1}`},
+		"string id":       {`{"jsonrpc":"2.0","method":"torrent.list","id":"a"}`, `{"jsonrpc":"2.0","result":[],"id":"a"}`},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := http.Post(c.URL, "application/json", strings.NewReader(tt.body))
+			require.Nil(t, err)
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			require.Nil(t, err)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+			assert.JSONEq(t, tt.want, string(body))
+		})
+	}
+
+	res, err := http.Get(c.URL)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestServerCrossSite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, s := newTestDaemon(t, ctx)
+	srv := NewServer(ctx, s)
+	srv.Hosts = []string{"nas.lan"}
+	server := httptest.NewServer(srv)
+	defer server.Close()
+	body := `{"jsonrpc":"2.0","method":"torrent.list","id":1}`
+
+	tests := map[string]struct {
+		contentType string
+		host        string
+		origin      string
+		want        int
+	}{
+		"form post":    {"text/plain", "", "", http.StatusUnsupportedMediaType},
+		"no type":      {"", "", "", http.StatusUnsupportedMediaType},
+		"other origin": {"application/json", "", "http://evil.example", http.StatusForbidden},
+		"same origin":  {"application/json; charset=utf-8", "", server.URL, http.StatusOK},
+		"rebound name": {"application/json", "evil.example", "http://evil.example", http.StatusForbidden},
+		"localhost":    {"application/json", "localhost:9091", "http://localhost:9091", http.StatusOK},
+		"IPv6 address": {"application/json", "[::1]:9091", "", http.StatusOK},
+		"allowed name": {"application/json", "nas.lan:9091", "http://nas.lan:9091", http.StatusOK},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+			require.Nil(t, err)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			res, err := http.DefaultClient.Do(req)
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.Equal(t, tt.want, res.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,678 @@
+package daemon
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/session"
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+const (
+	// SessionIDHeader is the header of the Transmission RPC protecting
+	// against CSRF: requests without the current ID are answered with 409
+	// Conflict and the ID to use
+	SessionIDHeader = "X-Transmission-Session-Id"
+	// transmissionRPCVersion is the version of the Transmission RPC
+	// implemented, that of Transmission 3.00
+	transmissionRPCVersion = 16
+	// speedBytes is the number of bytes in the kB of the speeds of the
+	// Transmission RPC
+	speedBytes = 1000
+	// maxTorrentSize caps the .torrent files fetched by URL
+	maxTorrentSize = 10 << 20
+	// defaultQueueSize is the size of the queues of Transmission, reported
+	// while they are disabled until set
+	defaultQueueSize = 5
+)
+
+// Status and error codes of the torrents of the Transmission RPC
+const (
+	transmissionStopped      = 0
+	transmissionCheck        = 2
+	transmissionDownloadWait = 3
+	transmissionDownload     = 4
+	transmissionSeedWait     = 5
+	transmissionSeed         = 6
+
+	transmissionLocalError = 3
+)
+
+// TransmissionServer serves the API of a session over HTTP with the
+// Transmission RPC protocol, usually on /transmission/rpc, so that the tools
+// supporting Transmission can control it, e.g. Sonarr or transmission-remote.
+// It implements the session-get, session-set, session-stats, torrent-add,
+// torrent-get, torrent-start, torrent-start-now, torrent-stop,
+// torrent-verify, torrent-remove and queue-move-* methods. All the torrents
+// are stored in the directory of the session: the download-dir of
+// torrent-add is ignored. torrent-set is accepted but has no effect. Like
+// Server, it refuses the requests naming it by a host other than localhost,
+// an IP address or one of Hosts, before handing out the session ID.
+type TransmissionServer struct {
+	// Hosts are the names the server can be reached by besides localhost and
+	// its IP addresses
+	Hosts []string
+
+	ctx       context.Context
+	session   *session.Session
+	sessionID string
+	methods   map[string]func(args json.RawMessage) (interface{}, error)
+
+	mu     sync.Mutex
+	ids    map[[20]byte]int // ids of the torrents, assigned on first sight
+	hashes map[int][20]byte
+	added  map[[20]byte]time.Time
+	nextID int
+	// downloadLimit and uploadLimit are the speed limits in kB/s, and
+	// downloadQueue and seedQueue the sizes of the queues, kept while
+	// disabled
+	downloadLimit int
+	uploadLimit   int
+	downloadQueue int
+	seedQueue     int
+}
+
+// NewTransmissionServer returns a Transmission RPC server controlling the
+// session. The torrents added or started run until ctx is done.
+func NewTransmissionServer(ctx context.Context, s *session.Session) *TransmissionServer {
+	id := make([]byte, 24)
+	// crypto/rand only fails if the system has no source of randomness
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	srv := &TransmissionServer{
+		ctx:           ctx,
+		session:       s,
+		sessionID:     hex.EncodeToString(id),
+		ids:           make(map[[20]byte]int),
+		hashes:        make(map[int][20]byte),
+		added:         make(map[[20]byte]time.Time),
+		nextID:        1,
+		downloadLimit: s.DownloadLimit() / speedBytes,
+		uploadLimit:   s.UploadLimit() / speedBytes,
+		downloadQueue: defaultQueueSize,
+		seedQueue:     defaultQueueSize,
+	}
+	srv.methods = map[string]func(json.RawMessage) (interface{}, error){
+		"session-get":       srv.sessionGet,
+		"session-set":       srv.sessionSet,
+		"session-stats":     srv.sessionStats,
+		"torrent-add":       srv.torrentAdd,
+		"torrent-get":       srv.torrentGet,
+		"torrent-start":     srv.torrentStart,
+		"torrent-start-now": srv.torrentStart,
+		"torrent-stop":      srv.torrentStop,
+		"torrent-verify":    srv.torrentVerify,
+		"torrent-remove":    srv.torrentRemove,
+		"torrent-set":       srv.torrentSet,
+		"queue-move-top":    srv.queueMove(func(int) int { return 0 }, true),
+		"queue-move-up":     srv.queueMove(func(position int) int { return position - 1 }, false),
+		"queue-move-down":   srv.queueMove(func(position int) int { return position + 1 }, true),
+		"queue-move-bottom": srv.queueMove(func(int) int { return math.MaxInt32 }, false),
+	}
+	return srv
+}
+
+type transmissionRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string          `json:"result"`
+	Arguments interface{}     `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// ServeHTTP answers a Transmission RPC request
+func (srv *TransmissionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowedHost(r, srv.Hosts) {
+		http.Error(w, "unknown host", http.StatusForbidden)
+		return
+	}
+	w.Header().Set(SessionIDHeader, srv.sessionID)
+	if r.Header.Get(SessionIDHeader) != srv.sessionID {
+		http.Error(w, fmt.Sprintf("%s: %s", SessionIDHeader, srv.sessionID), http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req transmissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := transmissionResponse{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	method, ok := srv.methods[req.Method]
+	if !ok {
+		res.Result = "method name not recognized"
+	} else if args, err := method(req.Arguments); err != nil {
+		res.Result = err.Error()
+	} else if args != nil {
+		res.Arguments = args
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// id returns the id of a torrent, assigning the next one on first sight
+func (srv *TransmissionServer) id(h [20]byte) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	id, ok := srv.ids[h]
+	if !ok {
+		id = srv.nextID
+		srv.nextID++
+		srv.ids[h] = id
+		srv.hashes[id] = h
+		srv.added[h] = time.Now()
+	}
+	return id
+}
+
+// forget releases the id of a removed torrent
+func (srv *TransmissionServer) forget(h [20]byte) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.hashes, srv.ids[h])
+	delete(srv.ids, h)
+	delete(srv.added, h)
+}
+
+// selectTorrents returns the torrents selected by the ids argument: all of
+// them if missing, the running ones for "recently-active", else an id or a
+// list of ids and hex info hashes
+func (srv *TransmissionServer) selectTorrents(args json.RawMessage) ([]session.TorrentStatus, error) {
+	var a struct {
+		IDs json.RawMessage `json:"ids"`
+	}
+	if err := decodeParams(args, &a); err != nil {
+		return nil, err
+	}
+	statuses := srv.session.Statuses()
+	for _, status := range statuses {
+		srv.id(status.InfoHash)
+	}
+	if len(a.IDs) == 0 {
+		return statuses, nil
+	}
+
+	var selected []session.TorrentStatus
+	var recent string
+	if err := json.Unmarshal(a.IDs, &recent); err == nil {
+		if recent != "recently-active" {
+			return nil, fmt.Errorf("invalid ids %q", recent)
+		}
+		for _, status := range statuses {
+			if status.Running {
+				selected = append(selected, status)
+			}
+		}
+		return selected, nil
+	}
+
+	var ids []interface{}
+	if err := json.Unmarshal(a.IDs, &ids); err != nil {
+		var id float64
+		if err := json.Unmarshal(a.IDs, &id); err != nil {
+			return nil, errors.New("invalid ids")
+		}
+		ids = []interface{}{id}
+	}
+	want := make(map[[20]byte]bool)
+	for _, id := range ids {
+		switch id := id.(type) {
+		case float64:
+			srv.mu.Lock()
+			h, ok := srv.hashes[int(id)]
+			srv.mu.Unlock()
+			if ok {
+				want[h] = true
+			}
+		case string:
+			h, err := TorrentParams{strings.ToLower(id)}.infoHash()
+			if err != nil {
+				return nil, err
+			}
+			want[h] = true
+		default:
+			return nil, fmt.Errorf("invalid id %v", id)
+		}
+	}
+	for _, status := range statuses {
+		if want[status.InfoHash] {
+			selected = append(selected, status)
+		}
+	}
+	return selected, nil
+}
+
+func (srv *TransmissionServer) sessionGet(args json.RawMessage) (interface{}, error) {
+	srv.mu.Lock()
+	downloadLimit, uploadLimit := srv.downloadLimit, srv.uploadLimit
+	downloadQueue, seedQueue := srv.downloadQueue, srv.seedQueue
+	srv.mu.Unlock()
+	downloadEnabled, uploadEnabled := srv.session.DownloadLimit() > 0, srv.session.UploadLimit() > 0
+	if downloadEnabled {
+		downloadLimit = srv.session.DownloadLimit() / speedBytes
+	}
+	if uploadEnabled {
+		uploadLimit = srv.session.UploadLimit() / speedBytes
+	}
+	maxDownloads, maxSeeds := srv.session.QueueLimits()
+	if maxDownloads > 0 {
+		downloadQueue = maxDownloads
+	}
+	if maxSeeds > 0 {
+		seedQueue = maxSeeds
+	}
+	return map[string]interface{}{
+		"version":                  fmt.Sprintf("3.00 (%s %s)", peer.ClientName, peer.ClientVersion),
+		"rpc-version":              transmissionRPCVersion,
+		"rpc-version-minimum":      1,
+		"download-dir":             srv.session.Dir,
+		"peer-port":                srv.session.ListenPort(),
+		"speed-limit-down":         downloadLimit,
+		"speed-limit-down-enabled": downloadEnabled,
+		"speed-limit-up":           uploadLimit,
+		"speed-limit-up-enabled":   uploadEnabled,
+		"download-queue-size":      downloadQueue,
+		"download-queue-enabled":   maxDownloads > 0,
+		"seed-queue-size":          seedQueue,
+		"seed-queue-enabled":       maxSeeds > 0,
+		"units": map[string]interface{}{
+			"speed-bytes":  speedBytes,
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"size-bytes":   speedBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"memory-bytes": 1024,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+		},
+	}, nil
+}
+
+func (srv *TransmissionServer) sessionSet(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		DownloadLimit   *int  `json:"speed-limit-down"`
+		DownloadEnabled *bool `json:"speed-limit-down-enabled"`
+		UploadLimit     *int  `json:"speed-limit-up"`
+		UploadEnabled   *bool `json:"speed-limit-up-enabled"`
+		DownloadQueue   *int  `json:"download-queue-size"`
+		DownloadQueued  *bool `json:"download-queue-enabled"`
+		SeedQueue       *int  `json:"seed-queue-size"`
+		SeedQueued      *bool `json:"seed-queue-enabled"`
+	}
+	if err := decodeParams(args, &a); err != nil {
+		return nil, err
+	}
+	if a.DownloadLimit != nil && *a.DownloadLimit < 0 || a.UploadLimit != nil && *a.UploadLimit < 0 {
+		return nil, errors.New("negative speed limit")
+	}
+	if a.DownloadQueue != nil && *a.DownloadQueue < 0 || a.SeedQueue != nil && *a.SeedQueue < 0 {
+		return nil, errors.New("negative queue size")
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.downloadLimit = setLimit(srv.session.DownloadLimit(), srv.downloadLimit, a.DownloadLimit, a.DownloadEnabled, speedBytes, srv.session.SetDownloadLimit)
+	srv.uploadLimit = setLimit(srv.session.UploadLimit(), srv.uploadLimit, a.UploadLimit, a.UploadEnabled, speedBytes, srv.session.SetUploadLimit)
+	maxDownloads, _ := srv.session.QueueLimits()
+	srv.downloadQueue = setLimit(maxDownloads, srv.downloadQueue, a.DownloadQueue, a.DownloadQueued, 1, func(n int) {
+		_, seeds := srv.session.QueueLimits()
+		srv.session.SetQueueLimits(n, seeds)
+	})
+	_, maxSeeds := srv.session.QueueLimits()
+	srv.seedQueue = setLimit(maxSeeds, srv.seedQueue, a.SeedQueue, a.SeedQueued, 1, func(n int) {
+		downloads, _ := srv.session.QueueLimits()
+		srv.session.SetQueueLimits(downloads, n)
+	})
+	return nil, nil
+}
+
+// setLimit applies a limit in units of the session and whether it is
+// enabled, each left unchanged if nil, and returns the limit to keep. The
+// session takes the limit multiplied by unit, 0 when disabled.
+func setLimit(current, kept int, limit *int, enabled *bool, unit int, set func(int)) int {
+	on := current > 0
+	if on {
+		kept = current / unit
+	}
+	if limit != nil {
+		kept = *limit
+	}
+	if enabled != nil {
+		on = *enabled
+	}
+	switch {
+	case on && kept > 0:
+		set(kept * unit)
+	case on || enabled != nil:
+		set(0)
+	}
+	return kept
+}
+
+func (srv *TransmissionServer) sessionStats(args json.RawMessage) (interface{}, error) {
+	var active, paused int
+	var downloadRate, uploadRate float64
+	var downloaded, uploaded int64
+	statuses := srv.session.Statuses()
+	for _, status := range statuses {
+		if status.Running {
+			active++
+		} else {
+			paused++
+		}
+		downloadRate += status.Stats.DownloadRate
+		uploadRate += status.Stats.UploadRate
+		downloaded += status.Stats.TotalDownloaded
+		uploaded += status.Stats.TotalUploaded
+	}
+	stats := map[string]interface{}{
+		"downloadedBytes": downloaded,
+		"uploadedBytes":   uploaded,
+		"filesAdded":      len(statuses),
+		"sessionCount":    1,
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(statuses),
+		"downloadSpeed":      int64(downloadRate),
+		"uploadSpeed":        int64(uploadRate),
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}, nil
+}
+
+func (srv *TransmissionServer) torrentAdd(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Filename string `json:"filename"`
+		Metainfo []byte `json:"metainfo"` // base64 in JSON
+		Paused   bool   `json:"paused"`
+	}
+	if err := decodeParams(args, &a); err != nil {
+		return nil, err
+	}
+	tf, err := srv.openTorrent(a.Filename, a.Metainfo)
+	if err != nil {
+		return nil, err
+	}
+
+	var added bool
+	if a.Paused {
+		added = srv.session.Add(tf)
+	} else {
+		added = srv.session.AddTorrent(srv.ctx, tf)
+	}
+	if status, ok := srv.session.Status(tf.InfoHash); ok {
+		tf.Name = status.Name
+	}
+	torrent := map[string]interface{}{
+		"id":         srv.id(tf.InfoHash),
+		"name":       tf.Name,
+		"hashString": hex.EncodeToString(tf.InfoHash[:]),
+	}
+	if !added {
+		return map[string]interface{}{"torrent-duplicate": torrent}, nil
+	}
+	return map[string]interface{}{"torrent-added": torrent}, nil
+}
+
+// openTorrent returns the torrent of the metainfo, or else of the filename,
+// a magnet link, the URL of a .torrent file or a path on the host of the
+// daemon
+func (srv *TransmissionServer) openTorrent(filename string, metainfo []byte) (torrentfile.TorrentFile, error) {
+	switch {
+	case len(metainfo) > 0:
+		return torrentfile.Parse(metainfo)
+	case strings.HasPrefix(filename, "magnet:"):
+		return torrentfile.FromMagnet(filename)
+	case strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://"):
+		return srv.fetchTorrent(filename)
+	case filename != "":
+		return torrentfile.Open(filename)
+	}
+	return torrentfile.TorrentFile{}, errors.New("missing filename or metainfo")
+}
+
+// fetchTorrent downloads a .torrent file
+func (srv *TransmissionServer) fetchTorrent(url string) (torrentfile.TorrentFile, error) {
+	ctx, cancel := context.WithTimeout(srv.ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return torrentfile.TorrentFile{}, fmt.Errorf("fetching %s: unexpected status %s", url, res.Status)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(res.Body, maxTorrentSize))
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+	return torrentfile.Parse(buf)
+}
+
+func (srv *TransmissionServer) torrentGet(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Fields []string `json:"fields"`
+	}
+	if err := decodeParams(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	statuses, err := srv.selectTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[[20]byte]int)
+	for _, tf := range srv.session.Torrents() {
+		switch {
+		case len(tf.Files) > 0:
+			files[tf.InfoHash] = len(tf.Files)
+		case len(tf.PieceHashes) > 0:
+			files[tf.InfoHash] = 1
+		}
+	}
+
+	torrents := make([]map[string]interface{}, len(statuses))
+	for i, status := range statuses {
+		all := srv.torrentFields(status, files[status.InfoHash])
+		torrent := make(map[string]interface{}, len(a.Fields))
+		for _, field := range a.Fields {
+			if value, ok := all[field]; ok {
+				torrent[field] = value
+			}
+		}
+		torrents[i] = torrent
+	}
+	return map[string]interface{}{"torrents": torrents}, nil
+}
+
+// torrentFields returns the fields of torrent-get supported for a torrent
+func (srv *TransmissionServer) torrentFields(status session.TorrentStatus, fileCount int) map[string]interface{} {
+	id := srv.id(status.InfoHash)
+	srv.mu.Lock()
+	added := srv.added[status.InfoHash]
+	srv.mu.Unlock()
+
+	stats := status.Stats
+	complete := stats.TotalPieces > 0 && stats.CompletedPieces == stats.TotalPieces
+	percentDone := 0.0
+	if stats.TotalPieces > 0 {
+		percentDone = float64(stats.CompletedPieces) / float64(stats.TotalPieces)
+	}
+	left := int64(status.Length) - stats.Completed
+	if left < 0 || complete {
+		left = 0
+	}
+	state := transmissionStopped
+	switch {
+	case status.Verifying:
+		state = transmissionCheck
+	case status.Running && complete:
+		state = transmissionSeed
+	case status.Running:
+		state = transmissionDownload
+	case status.Queued && complete:
+		state = transmissionSeedWait
+	case status.Queued:
+		state = transmissionDownloadWait
+	}
+	eta := -1
+	switch {
+	case state == transmissionDownload && stats.ETA < 0:
+		eta = -2
+	case state == transmissionDownload:
+		eta = int(stats.ETA.Seconds())
+	}
+	metadata := 0.0
+	if status.Length > 0 || stats.TotalPieces > 0 {
+		metadata = 1
+	}
+	errCode, errString := 0, ""
+	if status.Err != nil {
+		errCode, errString = transmissionLocalError, status.Err.Error()
+	}
+
+	return map[string]interface{}{
+		"id":                      id,
+		"hashString":              hex.EncodeToString(status.InfoHash[:]),
+		"name":                    status.Name,
+		"downloadDir":             srv.session.Dir,
+		"addedDate":               added.Unix(),
+		"status":                  state,
+		"error":                   errCode,
+		"errorString":             errString,
+		"totalSize":               status.Length,
+		"sizeWhenDone":            status.Length,
+		"leftUntilDone":           left,
+		"haveValid":               stats.Completed,
+		"percentDone":             percentDone,
+		"metadataPercentComplete": metadata,
+		"isFinished":              complete && !status.Running && status.Err == nil,
+		"isStalled":               status.Running && !complete && stats.Peers == 0,
+		"eta":                     eta,
+		"rateDownload":            int64(stats.DownloadRate),
+		"rateUpload":              int64(stats.UploadRate),
+		"downloadedEver":          stats.TotalDownloaded,
+		"uploadedEver":            stats.TotalUploaded,
+		"uploadRatio":             stats.Ratio,
+		"peersConnected":          stats.Peers,
+		"fileCount":               fileCount,
+		"queuePosition":           status.QueuePosition,
+	}
+}
+
+func (srv *TransmissionServer) torrentStart(args json.RawMessage) (interface{}, error) {
+	statuses, err := srv.selectTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		srv.session.StartTorrent(srv.ctx, status.InfoHash)
+	}
+	return nil, nil
+}
+
+func (srv *TransmissionServer) torrentStop(args json.RawMessage) (interface{}, error) {
+	statuses, err := srv.selectTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		srv.session.StopTorrent(status.InfoHash)
+	}
+	return nil, nil
+}
+
+// torrentVerify hashes the data of the torrents again in the background, one
+// after the other, like Transmission does. Their status is "check" meanwhile.
+// The ones whose metadata is not known yet are skipped, and the errors are
+// logged by the session.
+func (srv *TransmissionServer) torrentVerify(args json.RawMessage) (interface{}, error) {
+	statuses, err := srv.selectTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for _, status := range statuses {
+			srv.session.VerifyTorrent(srv.ctx, status.InfoHash)
+		}
+	}()
+	return nil, nil
+}
+
+func (srv *TransmissionServer) torrentRemove(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		DeleteLocalData bool `json:"delete-local-data"`
+	}
+	if err := decodeParams(args, &a); err != nil {
+		return nil, err
+	}
+	statuses, err := srv.selectTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if a.DeleteLocalData {
+			if _, err := srv.session.DeleteTorrent(status.InfoHash); err != nil {
+				return nil, err
+			}
+		} else {
+			srv.session.RemoveTorrent(status.InfoHash)
+		}
+		srv.forget(status.InfoHash)
+	}
+	return nil, nil
+}
+
+// queueMove returns a method moving the selected torrents in the queue to the
+// position returned by to from their own. They are moved in the order of
+// their positions, or in reverse order if reverse is set, so that they keep
+// it.
+func (srv *TransmissionServer) queueMove(to func(position int) int, reverse bool) func(json.RawMessage) (interface{}, error) {
+	return func(args json.RawMessage) (interface{}, error) {
+		statuses, err := srv.selectTorrents(args)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].QueuePosition < statuses[j].QueuePosition != reverse
+		})
+		for _, status := range statuses {
+			srv.session.MoveTorrent(status.InfoHash, to(status.QueuePosition))
+		}
+		return nil, nil
+	}
+}
+
+func (srv *TransmissionServer) torrentSet(args json.RawMessage) (interface{}, error) {
+	_, err := srv.selectTorrents(args)
+	return nil, err
+}
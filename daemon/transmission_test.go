@@ -0,0 +1,283 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/session"
+	"github.com/leonhfr/torrent-client/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// transmissionClient calls a Transmission RPC server, getting its session ID
+// from the first 409 Conflict like the Transmission clients
+type transmissionClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func newTestTransmission(t *testing.T, ctx context.Context) (*transmissionClient, *session.Session) {
+	s := session.New()
+	s.Dir = t.TempDir()
+	s.Logger = logging.Discard
+	require.Nil(t, s.Listen(ctx))
+	t.Cleanup(func() { s.Close() })
+
+	server := httptest.NewServer(NewTransmissionServer(ctx, s))
+	t.Cleanup(server.Close)
+	return &transmissionClient{t: t, url: server.URL}, s
+}
+
+// call returns the result and arguments of a method
+func (c *transmissionClient) call(method string, args interface{}) (string, map[string]interface{}) {
+	body, err := json.Marshal(map[string]interface{}{"method": method, "arguments": args, "tag": 7})
+	require.Nil(c.t, err)
+	for {
+		req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+		require.Nil(c.t, err)
+		req.Header.Set(SessionIDHeader, c.sessionID)
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(c.t, err)
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusConflict {
+			require.Empty(c.t, c.sessionID)
+			c.sessionID = res.Header.Get(SessionIDHeader)
+			require.NotEmpty(c.t, c.sessionID)
+			continue
+		}
+		require.Equal(c.t, http.StatusOK, res.StatusCode)
+
+		var r struct {
+			Result    string                 `json:"result"`
+			Arguments map[string]interface{} `json:"arguments"`
+			Tag       int                    `json:"tag"`
+		}
+		require.Nil(c.t, json.NewDecoder(res.Body).Decode(&r))
+		assert.Equal(c.t, 7, r.Tag)
+		return r.Result, r.Arguments
+	}
+}
+
+// torrents returns the fields of the torrents selected by ids
+func (c *transmissionClient) torrents(ids interface{}, fields ...string) []interface{} {
+	args := map[string]interface{}{"fields": fields}
+	if ids != nil {
+		args["ids"] = ids
+	}
+	result, res := c.call("torrent-get", args)
+	require.Equal(c.t, "success", result)
+	return res["torrents"].([]interface{})
+}
+
+func TestTransmissionSessionID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _ := newTestTransmission(t, ctx)
+
+	res, err := http.Post(c.url, "application/json", strings.NewReader(`{"method":"session-get"}`))
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	assert.NotEmpty(t, res.Header.Get(SessionIDHeader))
+
+	result, _ := c.call("session-close", nil)
+	assert.Equal(t, "method name not recognized", result)
+
+	// A page pointing its name to the server does not get the session ID
+	req, err := http.NewRequest(http.MethodPost, c.url, strings.NewReader(`{"method":"session-get"}`))
+	require.Nil(t, err)
+	req.Host = "evil.example"
+	req.Header.Set("Origin", "http://evil.example")
+	res, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Empty(t, res.Header.Get(SessionIDHeader))
+}
+
+func TestTransmissionSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, s := newTestTransmission(t, ctx)
+
+	result, args := c.call("session-get", nil)
+	require.Equal(t, "success", result)
+	assert.Equal(t, "3.00 (torrent-client 0.1.0)", args["version"])
+	assert.Equal(t, float64(transmissionRPCVersion), args["rpc-version"])
+	assert.Equal(t, s.Dir, args["download-dir"])
+	assert.Equal(t, float64(s.ListenPort()), args["peer-port"])
+	assert.Equal(t, false, args["speed-limit-down-enabled"])
+
+	result, _ = c.call("session-set", map[string]interface{}{"speed-limit-down": 100, "speed-limit-up": 50})
+	require.Equal(t, "success", result)
+	assert.Equal(t, 0, s.DownloadLimit())
+	result, _ = c.call("session-set", map[string]interface{}{"speed-limit-down-enabled": true})
+	require.Equal(t, "success", result)
+	assert.Equal(t, 100000, s.DownloadLimit())
+	assert.Equal(t, 0, s.UploadLimit())
+
+	_, args = c.call("session-get", nil)
+	assert.Equal(t, float64(100), args["speed-limit-down"])
+	assert.Equal(t, true, args["speed-limit-down-enabled"])
+	assert.Equal(t, float64(50), args["speed-limit-up"])
+	assert.Equal(t, false, args["speed-limit-up-enabled"])
+
+	result, _ = c.call("session-set", map[string]interface{}{"speed-limit-down-enabled": false})
+	require.Equal(t, "success", result)
+	assert.Equal(t, 0, s.DownloadLimit())
+	_, args = c.call("session-get", nil)
+	assert.Equal(t, float64(100), args["speed-limit-down"])
+
+	result, _ = c.call("session-set", map[string]interface{}{"speed-limit-up": -1})
+	assert.Equal(t, "negative speed limit", result)
+
+	assert.Equal(t, float64(defaultQueueSize), args["download-queue-size"])
+	assert.Equal(t, false, args["download-queue-enabled"])
+	result, _ = c.call("session-set", map[string]interface{}{"download-queue-enabled": true, "seed-queue-size": 2})
+	require.Equal(t, "success", result)
+	downloads, seeds := s.QueueLimits()
+	assert.Equal(t, defaultQueueSize, downloads)
+	assert.Equal(t, 0, seeds)
+	result, _ = c.call("session-set", map[string]interface{}{"download-queue-enabled": false, "seed-queue-enabled": true})
+	require.Equal(t, "success", result)
+	downloads, seeds = s.QueueLimits()
+	assert.Equal(t, 0, downloads)
+	assert.Equal(t, 2, seeds)
+	_, args = c.call("session-get", nil)
+	assert.Equal(t, false, args["download-queue-enabled"])
+	assert.Equal(t, float64(2), args["seed-queue-size"])
+	assert.Equal(t, true, args["seed-queue-enabled"])
+	result, _ = c.call("session-set", map[string]interface{}{"seed-queue-size": -1})
+	assert.Equal(t, "negative queue size", result)
+
+	result, args = c.call("session-stats", nil)
+	require.Equal(t, "success", result)
+	assert.Equal(t, float64(0), args["torrentCount"])
+}
+
+func TestTransmissionTorrents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, s := newTestTransmission(t, ctx)
+
+	content := []byte("added with the Transmission RPC")
+	path := filepath.Join(s.Dir, "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	tf, err := torrentfile.Create(path, torrentfile.WithAnnounce(newTestTracker(t)))
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	require.Nil(t, tf.Write(&buf))
+	hash := hex.EncodeToString(tf.InfoHash[:])
+
+	result, args := c.call("torrent-add", map[string]interface{}{"metainfo": buf.Bytes(), "paused": true})
+	require.Equal(t, "success", result)
+	assert.Equal(t, map[string]interface{}{"id": float64(1), "name": "file", "hashString": hash}, args["torrent-added"])
+	result, args = c.call("torrent-add", map[string]interface{}{"metainfo": buf.Bytes()})
+	require.Equal(t, "success", result)
+	assert.Equal(t, map[string]interface{}{"id": float64(1), "name": "file", "hashString": hash}, args["torrent-duplicate"])
+
+	magnet := "magnet:?xt=urn:btih:" + strings.Repeat("ab", 20) + "&dn=magnet"
+	result, args = c.call("torrent-add", map[string]interface{}{"filename": magnet, "paused": true})
+	require.Equal(t, "success", result)
+	assert.Equal(t, float64(2), args["torrent-added"].(map[string]interface{})["id"])
+
+	result, _ = c.call("torrent-add", map[string]interface{}{})
+	assert.Equal(t, "missing filename or metainfo", result)
+
+	torrents := c.torrents(nil, "id", "name", "status", "totalSize", "fileCount", "downloadDir", "unknown")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"id": float64(1), "name": "file", "status": float64(transmissionStopped), "totalSize": float64(len(content)), "fileCount": float64(1), "downloadDir": s.Dir},
+		map[string]interface{}{"id": float64(2), "name": "magnet", "status": float64(transmissionStopped), "totalSize": float64(0), "fileCount": float64(0), "downloadDir": s.Dir},
+	}, torrents)
+
+	tests := map[string]struct {
+		ids  interface{}
+		want []interface{}
+	}{
+		"id":              {1, []interface{}{map[string]interface{}{"id": float64(1)}}},
+		"ids":             {[]interface{}{2, 3}, []interface{}{map[string]interface{}{"id": float64(2)}}},
+		"hash":            {[]interface{}{strings.ToUpper(hash)}, []interface{}{map[string]interface{}{"id": float64(1)}}},
+		"recently active": {"recently-active", []interface{}{}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.want, c.torrents(tt.ids, "id"))
+		})
+	}
+
+	queue := func() []interface{} {
+		return []interface{}{c.torrents(1, "queuePosition")[0], c.torrents(2, "queuePosition")[0]}
+	}
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"queuePosition": float64(0)},
+		map[string]interface{}{"queuePosition": float64(1)},
+	}, queue())
+	result, _ = c.call("queue-move-top", map[string]interface{}{"ids": 2})
+	require.Equal(t, "success", result)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"queuePosition": float64(1)},
+		map[string]interface{}{"queuePosition": float64(0)},
+	}, queue())
+	result, _ = c.call("queue-move-down", map[string]interface{}{"ids": []interface{}{1, 2}})
+	require.Equal(t, "success", result)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"queuePosition": float64(0)},
+		map[string]interface{}{"queuePosition": float64(1)},
+	}, queue())
+
+	s.SetQueueLimits(1, 0)
+	result, _ = c.call("torrent-start", map[string]interface{}{"ids": 1})
+	require.Equal(t, "success", result)
+	result, _ = c.call("torrent-start", map[string]interface{}{"ids": 2})
+	require.Equal(t, "success", result)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"status": float64(transmissionDownload)},
+		map[string]interface{}{"status": float64(transmissionDownloadWait)},
+	}, c.torrents(nil, "status"))
+	result, _ = c.call("torrent-stop", map[string]interface{}{"ids": 2})
+	require.Equal(t, "success", result)
+	s.SetQueueLimits(0, 0)
+
+	result, _ = c.call("torrent-start", map[string]interface{}{"ids": []interface{}{hash}})
+	require.Equal(t, "success", result)
+	status, _ := s.Status(tf.InfoHash)
+	assert.True(t, status.Running)
+	assert.Equal(t, []interface{}{map[string]interface{}{"id": float64(1)}}, c.torrents("recently-active", "id"))
+	result, _ = c.call("torrent-stop", map[string]interface{}{"ids": 1})
+	require.Equal(t, "success", result)
+	status, _ = s.Status(tf.InfoHash)
+	assert.False(t, status.Running)
+
+	// The data written again outside of the session is found by verifying in
+	// the background, the magnet link being skipped
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	result, _ = c.call("torrent-verify", map[string]interface{}{"ids": []interface{}{1, 2}})
+	require.Equal(t, "success", result)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]interface{}{
+			map[string]interface{}{"haveValid": float64(len(content)), "status": float64(transmissionStopped)},
+		}, c.torrents(1, "haveValid", "status"))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	result, _ = c.call("torrent-remove", map[string]interface{}{"ids": 2})
+	require.Equal(t, "success", result)
+	result, _ = c.call("torrent-remove", map[string]interface{}{"ids": 1, "delete-local-data": true})
+	require.Equal(t, "success", result)
+	assert.Empty(t, s.Torrents())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// KRPC error codes
+const (
+	ErrCodeGeneric  = 201
+	ErrCodeServer   = 202
+	ErrCodeProtocol = 203
+	ErrCodeMethod   = 204
+)
+
+// Error is an error message returned by a node
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+// krpcMessage is a KRPC message, a query with its arguments, a response with
+// its return values or an error
+type krpcMessage struct {
+	T string      `bencode:"t"`
+	Y string      `bencode:"y"`
+	Q string      `bencode:"q,omitempty"`
+	A interface{} `bencode:"a,omitempty"`
+	R interface{} `bencode:"r,omitempty"`
+	E interface{} `bencode:"e,omitempty"`
+}
+
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+}
+
+func encodeMessage(msg krpcMessage) ([]byte, error) {
+	return bencode.Marshal(msg)
+}
+
+// dict is a decoded bencode dictionary
+type dict map[string]interface{}
+
+func (d dict) str(key string) string {
+	s, _ := d[key].(string)
+	return s
+}
+
+func (d dict) int(key string) int {
+	i, _ := d[key].(int64)
+	return int(i)
+}
+
+func (d dict) dict(key string) dict {
+	m, _ := d[key].(map[string]interface{})
+	return m
+}
+
+func (d dict) id() (NodeID, error) {
+	var id NodeID
+	s := d.str("id")
+	if len(s) != len(id) {
+		return id, errors.New("missing node ID")
+	}
+	copy(id[:], s)
+	return id, nil
+}
+
+// nodes decodes the IPv4 and IPv6 nodes of a response
+func (d dict) nodes() ([]Node, error) {
+	nodes, err := UnmarshalNodes([]byte(d.str("nodes")), net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	nodes6, err := UnmarshalNodes([]byte(d.str("nodes6")), net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	return append(nodes, nodes6...), nil
+}
+
+// values decodes the peers of a get_peers response
+func (d dict) values() []peer.Peer {
+	list, _ := d["values"].([]interface{})
+	var peers []peer.Peer
+	for _, v := range list {
+		s, _ := v.(string)
+		if p, ok := unmarshalPeer([]byte(s)); ok {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func decodeMessage(buf []byte) (dict, error) {
+	var data interface{}
+	err := bencode.Unmarshal(buf, &data)
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("message is not a dictionary")
+	}
+	return msg, nil
+}
+
+// decodeError decodes the error list of an error message
+func decodeError(msg dict) *Error {
+	list, _ := msg["e"].([]interface{})
+	e := &Error{Code: ErrCodeGeneric}
+	if len(list) > 0 {
+		if code, ok := list[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+	if len(list) > 1 {
+		e.Message, _ = list[1].(string)
+	}
+	return e
+}
+
+// marshalPeer encodes a peer in the compact format, 6 bytes for IPv4
+// and 18 bytes for IPv6
+func marshalPeer(p peer.Peer) []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	buf := append([]byte(nil), ip...)
+	return append(buf, byte(p.Port>>8), byte(p.Port))
+}
+
+func unmarshalPeer(buf []byte) (peer.Peer, bool) {
+	if len(buf) != net.IPv4len+2 && len(buf) != net.IPv6len+2 {
+		return peer.Peer{}, false
+	}
+	ipLen := len(buf) - 2
+	return peer.Peer{
+		IP:   net.IP(append([]byte(nil), buf[:ipLen]...)),
+		Port: binary.BigEndian.Uint16(buf[ipLen:]),
+	}, true
+}
@@ -0,0 +1,259 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/leonhfr/torrent-client/bencode"
+)
+
+// K is the maximum number of nodes in a bucket
+const K = 8
+
+const (
+	compactNodeSize  = 26 // 20 for ID, 4 for IP, 2 for port
+	compactNode6Size = 38 // 20 for ID, 16 for IP, 2 for port
+)
+
+// NodeID identifies a node of the DHT
+type NodeID [20]byte
+
+// Node is a contact in the DHT
+type Node struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// RoutingTable stores known nodes in buckets by XOR distance to our own ID
+type RoutingTable struct {
+	self    NodeID
+	mu      sync.RWMutex
+	buckets [160][]Node
+}
+
+type bencodeTable struct {
+	ID     string `bencode:"id"`
+	Nodes  string `bencode:"nodes"`
+	Nodes6 string `bencode:"nodes6"`
+}
+
+// NewRoutingTable creates an empty routing table for our node ID
+func NewRoutingTable(self NodeID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+// Self returns our own node ID
+func (rt *RoutingTable) Self() NodeID {
+	return rt.self
+}
+
+func distance(a, b NodeID) NodeID {
+	var d NodeID
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// bucketIndex returns the number of leading bits shared by id and our ID
+func (rt *RoutingTable) bucketIndex(id NodeID) int {
+	d := distance(rt.self, id)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1 // id is our own ID
+}
+
+// Add inserts a node, or refreshes it if already known. It returns false
+// if the node is our own or its bucket is full.
+func (rt *RoutingTable) Add(n Node) bool {
+	index := rt.bucketIndex(n.ID)
+	if index < 0 {
+		return false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	bucket := rt.buckets[index]
+	for i, known := range bucket {
+		if known.ID == n.ID {
+			// Move the node to the tail, where the most recently seen nodes are
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			rt.buckets[index] = append(bucket, n)
+			return true
+		}
+	}
+	if len(bucket) >= K {
+		return false
+	}
+	rt.buckets[index] = append(bucket, n)
+	return true
+}
+
+// Remove deletes a node
+func (rt *RoutingTable) Remove(id NodeID) {
+	index := rt.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	bucket := rt.buckets[index]
+	for i, known := range bucket {
+		if known.ID == id {
+			rt.buckets[index] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// Len returns the number of nodes
+func (rt *RoutingTable) Len() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// Nodes returns all the nodes
+func (rt *RoutingTable) Nodes() []Node {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	var nodes []Node
+	for _, bucket := range rt.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	return nodes
+}
+
+// Closest returns up to count nodes, sorted by XOR distance to the target
+func (rt *RoutingTable) Closest(target NodeID, count int) []Node {
+	nodes := rt.Nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		di, dj := distance(nodes[i].ID, target), distance(nodes[j].ID, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// MarshalNodes encodes nodes in the compact node info format, IPv4 nodes in
+// nodes and IPv6 nodes in nodes6
+func MarshalNodes(list []Node) (nodes, nodes6 []byte) {
+	for _, n := range list {
+		if ip4 := n.Addr.IP.To4(); ip4 != nil {
+			nodes = append(nodes, n.ID[:]...)
+			nodes = append(nodes, ip4...)
+			nodes = append(nodes, byte(n.Addr.Port>>8), byte(n.Addr.Port))
+		} else if ip6 := n.Addr.IP.To16(); ip6 != nil {
+			nodes6 = append(nodes6, n.ID[:]...)
+			nodes6 = append(nodes6, ip6...)
+			nodes6 = append(nodes6, byte(n.Addr.Port>>8), byte(n.Addr.Port))
+		}
+	}
+	return nodes, nodes6
+}
+
+// UnmarshalNodes decodes nodes from the compact node info format, where
+// each IP address is ipLen bytes long
+func UnmarshalNodes(buf []byte, ipLen int) ([]Node, error) {
+	size := 20 + ipLen + 2
+	if len(buf)%size != 0 {
+		return nil, fmt.Errorf("received malformed nodes of length %d", len(buf))
+	}
+	nodes := make([]Node, len(buf)/size)
+	for i := range nodes {
+		offset := i * size
+		copy(nodes[i].ID[:], buf[offset:offset+20])
+		ip := make(net.IP, ipLen)
+		copy(ip, buf[offset+20:offset+20+ipLen])
+		port := binary.BigEndian.Uint16(buf[offset+20+ipLen : offset+size])
+		nodes[i].Addr = &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	return nodes, nil
+}
+
+// Save writes our ID and the nodes of the routing table
+func (rt *RoutingTable) Save(w io.Writer) error {
+	nodes, nodes6 := MarshalNodes(rt.Nodes())
+	return bencode.NewEncoder(w).Encode(bencodeTable{
+		ID:     string(rt.self[:]),
+		Nodes:  string(nodes),
+		Nodes6: string(nodes6),
+	})
+}
+
+// Load reads a routing table written by Save
+func Load(r io.Reader) (*RoutingTable, error) {
+	bt := bencodeTable{}
+	err := bencode.NewDecoder(r).Decode(&bt)
+	if err != nil {
+		return nil, err
+	}
+	if len(bt.ID) != 20 {
+		return nil, fmt.Errorf("expected node ID of length 20, got length %d", len(bt.ID))
+	}
+
+	var self NodeID
+	copy(self[:], bt.ID)
+	rt := NewRoutingTable(self)
+
+	nodes, err := UnmarshalNodes([]byte(bt.Nodes), net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	nodes6, err := UnmarshalNodes([]byte(bt.Nodes6), net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range append(nodes, nodes6...) {
+		rt.Add(n)
+	}
+	return rt, nil
+}
+
+// SaveFile writes the routing table to a file, replacing it atomically
+func (rt *RoutingTable) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = rt.Save(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile reads a routing table from a file written by SaveFile
+func LoadFile(path string) (*RoutingTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Load(file)
+}
@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nodeID(b ...byte) NodeID {
+	var id NodeID
+	copy(id[:], b)
+	return id
+}
+
+func TestRoutingTableAdd(t *testing.T) {
+	rt := NewRoutingTable(nodeID())
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}
+
+	assert.False(t, rt.Add(Node{ID: nodeID(), Addr: addr}), "own ID")
+	for i := 0; i < K; i++ {
+		assert.True(t, rt.Add(Node{ID: nodeID(0x80, byte(i)), Addr: addr}))
+	}
+	assert.False(t, rt.Add(Node{ID: nodeID(0x80, K), Addr: addr}), "full bucket")
+	assert.True(t, rt.Add(Node{ID: nodeID(0x80, 0), Addr: addr}), "refresh")
+	assert.True(t, rt.Add(Node{ID: nodeID(0x40), Addr: addr}), "other bucket")
+	assert.Equal(t, K+1, rt.Len())
+
+	rt.Remove(nodeID(0x40))
+	assert.Equal(t, K, rt.Len())
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	rt := NewRoutingTable(nodeID())
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}
+	for _, b := range []byte{0x01, 0x10, 0x80, 0x81} {
+		rt.Add(Node{ID: nodeID(b), Addr: addr})
+	}
+
+	closest := rt.Closest(nodeID(0x80), 2)
+	assert.Equal(t, []NodeID{nodeID(0x80), nodeID(0x81)}, []NodeID{closest[0].ID, closest[1].ID})
+}
+
+func TestSaveLoad(t *testing.T) {
+	rt := NewRoutingTable(nodeID(1, 2, 3))
+	nodes := []Node{
+		{ID: nodeID(0x80), Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 6881}},
+		{ID: nodeID(0x40), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+	}
+	for _, n := range nodes {
+		rt.Add(n)
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, rt.Save(&buf))
+	loaded, err := Load(&buf)
+	require.Nil(t, err)
+	assert.Equal(t, rt.Self(), loaded.Self())
+	assert.Equal(t, 2, loaded.Len())
+	for _, n := range loaded.Nodes() {
+		switch n.ID {
+		case nodes[0].ID:
+			assert.True(t, nodes[0].Addr.IP.Equal(n.Addr.IP))
+			assert.Equal(t, nodes[0].Addr.Port, n.Addr.Port)
+		case nodes[1].ID:
+			assert.True(t, nodes[1].Addr.IP.Equal(n.Addr.IP))
+			assert.Equal(t, nodes[1].Addr.Port, n.Addr.Port)
+		default:
+			t.Errorf("unexpected node %x", n.ID)
+		}
+	}
+}
+
+func TestSaveLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	rt := NewRoutingTable(nodeID(1))
+	rt.Add(Node{ID: nodeID(0x80), Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 6881}})
+
+	require.Nil(t, rt.SaveFile(path))
+	loaded, err := LoadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, rt.Self(), loaded.Self())
+	assert.Equal(t, 1, loaded.Len())
+}
+
+func TestUnmarshalNodesMalformed(t *testing.T) {
+	_, err := UnmarshalNodes(make([]byte, compactNodeSize+1), net.IPv4len)
+	assert.NotNil(t, err)
+}
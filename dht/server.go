@@ -0,0 +1,597 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+const (
+	// DefaultQueryTimeout is the time a node has to respond to a query
+	DefaultQueryTimeout = 5 * time.Second
+	// Alpha is the number of nodes queried at the same time by a lookup
+	Alpha = 3
+	// AnnounceInterval is the time between two announces of a torrent
+	AnnounceInterval = 15 * time.Minute
+	// MaxPeersPerTorrent is the number of announced peers kept by torrent
+	MaxPeersPerTorrent = 100
+	// MaxTorrents is the number of torrents whose announced peers are kept
+	MaxTorrents = 5000
+	// PeerExpiry is the time an announced peer is kept without announcing
+	// again
+	PeerExpiry = 30 * time.Minute
+	// TokenRotation is the time between two changes of the secret of the
+	// tokens. The tokens of the previous secret are accepted too, so that a
+	// token is valid for 5 to 10 minutes.
+	TokenRotation = 5 * time.Minute
+)
+
+// ErrClosed is returned by the queries of a closed server
+var ErrClosed = errors.New("dht server closed")
+
+// Server is a Mainline DHT node (BEP 5). It answers the queries of other
+// nodes and queries them to find the peers of torrents.
+type Server struct {
+	// QueryTimeout defaults to DefaultQueryTimeout
+	QueryTimeout time.Duration
+
+	table *RoutingTable
+	conn  net.PacketConn
+	clock func() time.Time // returns the current time, time.Now if nil
+
+	mu      sync.Mutex
+	nextTID uint16
+	pending map[string]chan dict         // responses awaited, by transaction ID
+	peers   map[[20]byte][]announcedPeer // peers announced to us, by info hash
+	secrets [2][20]byte                  // salt the tokens given to the nodes, the current one first
+	rotated time.Time                    // time the secrets last changed
+	closed  bool
+}
+
+// announcedPeer is a peer announced to us, and when
+type announcedPeer struct {
+	peer.Peer
+	at time.Time
+}
+
+// NewServer creates a node answering on conn with the ID of the table
+func NewServer(conn net.PacketConn, table *RoutingTable) (*Server, error) {
+	s := &Server{
+		table:   table,
+		conn:    conn,
+		pending: make(map[string]chan dict),
+		peers:   make(map[[20]byte][]announcedPeer),
+	}
+	for i := range s.secrets {
+		if _, err := rand.Read(s.secrets[i][:]); err != nil {
+			return nil, err
+		}
+	}
+	s.rotated = s.now()
+	return s, nil
+}
+
+// now returns the current time
+func (s *Server) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+// Table returns the routing table of the node
+func (s *Server) Table() *RoutingTable {
+	return s.table
+}
+
+// Serve reads the incoming messages until the server is closed
+func (s *Server) Serve() error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			continue // not a KRPC message
+		}
+
+		switch msg.str("y") {
+		case "q":
+			s.handleQuery(msg, udpAddr)
+		case "r", "e":
+			s.mu.Lock()
+			ch, ok := s.pending[msg.str("t")]
+			delete(s.pending, msg.str("t"))
+			s.mu.Unlock()
+			if ok {
+				ch <- msg
+			}
+		}
+	}
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+func (s *Server) send(msg krpcMessage, addr *net.UDPAddr) error {
+	buf, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteTo(buf, addr)
+	return err
+}
+
+// token returns the token a node at ip has to send back to announce a peer
+func (s *Server) token(ip net.IP) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotateSecrets()
+	return tokenOf(s.secrets[0], ip)
+}
+
+// validToken tells whether a node at ip sent back a token given lately
+func (s *Server) validToken(token string, ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotateSecrets()
+	for _, secret := range s.secrets {
+		if token == tokenOf(secret, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rotateSecrets replaces the secrets of the tokens every TokenRotation,
+// keeping the previous one. The lock must be held.
+func (s *Server) rotateSecrets() {
+	now := s.now()
+	for i := 0; i < len(s.secrets) && now.Sub(s.rotated) >= TokenRotation; i++ {
+		s.secrets[1] = s.secrets[0]
+		if _, err := rand.Read(s.secrets[0][:]); err != nil {
+			// the previous secret stays in use until the next query
+			s.secrets[0] = s.secrets[1]
+			return
+		}
+		s.rotated = s.rotated.Add(TokenRotation)
+	}
+	if now.Sub(s.rotated) >= TokenRotation {
+		// unused for long: both secrets were replaced
+		s.rotated = now
+	}
+}
+
+// tokenOf returns the token of a node at ip with a secret
+func tokenOf(secret [20]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip)
+	return string(h.Sum(nil)[:8])
+}
+
+func (s *Server) handleQuery(msg dict, addr *net.UDPAddr) {
+	args := msg.dict("a")
+	id, err := args.id()
+	if err != nil {
+		s.sendError(msg, addr, ErrCodeProtocol, "missing node ID")
+		return
+	}
+	s.table.Add(Node{ID: id, Addr: addr})
+
+	self := s.table.Self()
+	ret := krpcReturn{ID: string(self[:])}
+	switch msg.str("q") {
+	case "ping":
+	case "find_node":
+		var target NodeID
+		copy(target[:], args.str("target"))
+		nodes, nodes6 := MarshalNodes(s.table.Closest(target, K))
+		ret.Nodes, ret.Nodes6 = string(nodes), string(nodes6)
+	case "get_peers":
+		var infoHash [20]byte
+		copy(infoHash[:], args.str("info_hash"))
+		ret.Token = s.token(addr.IP)
+		for _, p := range s.announced(infoHash) {
+			ret.Values = append(ret.Values, string(marshalPeer(p)))
+		}
+		if len(ret.Values) == 0 {
+			nodes, nodes6 := MarshalNodes(s.table.Closest(NodeID(infoHash), K))
+			ret.Nodes, ret.Nodes6 = string(nodes), string(nodes6)
+		}
+	case "announce_peer":
+		if !s.validToken(args.str("token"), addr.IP) {
+			s.sendError(msg, addr, ErrCodeProtocol, "bad token")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], args.str("info_hash"))
+		p := peer.Peer{IP: addr.IP, Port: uint16(args.int("port"))}
+		if args.int("implied_port") != 0 {
+			p.Port = uint16(addr.Port)
+		}
+		s.storePeer(infoHash, p)
+	default:
+		s.sendError(msg, addr, ErrCodeMethod, "method unknown")
+		return
+	}
+	s.send(krpcMessage{T: msg.str("t"), Y: "r", R: ret}, addr)
+}
+
+func (s *Server) sendError(msg dict, addr *net.UDPAddr, code int, message string) {
+	s.send(krpcMessage{T: msg.str("t"), Y: "e", E: []interface{}{code, message}}, addr)
+}
+
+// storePeer records a peer announced for a torrent, dropping the oldest
+// ones past MaxPeersPerTorrent. Past MaxTorrents, the torrent announced to
+// the longest ago is forgotten.
+func (s *Server) storePeer(infoHash [20]byte, p peer.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	peers := s.unexpired(infoHash, now)
+	for i, known := range peers {
+		if known.String() == p.String() {
+			peers = append(peers[:i], peers[i+1:]...)
+			break
+		}
+	}
+	if _, ok := s.peers[infoHash]; !ok && len(s.peers) >= MaxTorrents {
+		s.evictTorrent(now)
+	}
+	peers = append(peers, announcedPeer{p, now})
+	if len(peers) > MaxPeersPerTorrent {
+		peers = peers[len(peers)-MaxPeersPerTorrent:]
+	}
+	s.peers[infoHash] = peers
+}
+
+// announced returns the peers announced for a torrent that did not expire
+func (s *Server) announced(infoHash [20]byte) []peer.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var peers []peer.Peer
+	for _, p := range s.unexpired(infoHash, s.now()) {
+		peers = append(peers, p.Peer)
+	}
+	return peers
+}
+
+// unexpired drops the expired peers of a torrent, forgetting the torrent if
+// none is left, and returns the others, oldest first. The lock must be held.
+func (s *Server) unexpired(infoHash [20]byte, now time.Time) []announcedPeer {
+	peers := s.peers[infoHash]
+	i := 0
+	for i < len(peers) && now.Sub(peers[i].at) >= PeerExpiry {
+		i++
+	}
+	peers = peers[i:]
+	if len(peers) == 0 {
+		delete(s.peers, infoHash)
+		return nil
+	}
+	s.peers[infoHash] = peers
+	return peers
+}
+
+// evictTorrent forgets the torrents whose peers all expired, or else the one
+// announced to the longest ago. The lock must be held.
+func (s *Server) evictTorrent(now time.Time) {
+	var oldest [20]byte
+	var oldestAt time.Time
+	for infoHash, peers := range s.peers {
+		last := peers[len(peers)-1].at
+		if now.Sub(last) >= PeerExpiry {
+			delete(s.peers, infoHash)
+			continue
+		}
+		if oldestAt.IsZero() || last.Before(oldestAt) {
+			oldest, oldestAt = infoHash, last
+		}
+	}
+	if len(s.peers) >= MaxTorrents {
+		delete(s.peers, oldest)
+	}
+}
+
+// query sends a query to a node and returns the values of its response. The
+// node is added to the routing table if it responds, and removed otherwise.
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr, method string, args krpcArgs) (dict, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	s.nextTID++
+	var t [2]byte
+	binary.BigEndian.PutUint16(t[:], s.nextTID)
+	tid := string(t[:])
+	ch := make(chan dict, 1)
+	s.pending[tid] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, tid)
+		s.mu.Unlock()
+	}()
+
+	self := s.table.Self()
+	args.ID = string(self[:])
+	err := s.send(krpcMessage{T: tid, Y: "q", Q: method, A: args}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := s.QueryTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-ch:
+		if msg.str("y") == "e" {
+			return nil, decodeError(msg)
+		}
+		ret := msg.dict("r")
+		id, err := ret.id()
+		if err != nil {
+			return nil, err
+		}
+		s.table.Add(Node{ID: id, Addr: addr})
+		return ret, nil
+	case <-timer.C:
+		for _, n := range s.table.Nodes() {
+			if n.Addr.IP.Equal(addr.IP) && n.Addr.Port == addr.Port {
+				s.table.Remove(n.ID)
+			}
+		}
+		return nil, fmt.Errorf("%s did not respond to %s", addr, method)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ping checks a node is alive and returns its ID
+func (s *Server) Ping(ctx context.Context, addr *net.UDPAddr) (NodeID, error) {
+	ret, err := s.query(ctx, addr, "ping", krpcArgs{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return ret.id()
+}
+
+// FindNode asks a node for the nodes closest to target it knows
+func (s *Server) FindNode(ctx context.Context, addr *net.UDPAddr, target NodeID) ([]Node, error) {
+	ret, err := s.query(ctx, addr, "find_node", krpcArgs{Target: string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	return ret.nodes()
+}
+
+// GetPeers asks a node for the peers of a torrent. The node returns the
+// peers if it knows any, or else the nodes closest to the info hash, and a
+// token to announce to it.
+func (s *Server) GetPeers(ctx context.Context, addr *net.UDPAddr, infoHash [20]byte) ([]peer.Peer, []Node, string, error) {
+	ret, err := s.query(ctx, addr, "get_peers", krpcArgs{InfoHash: string(infoHash[:])})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	nodes, err := ret.nodes()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return ret.values(), nodes, ret.str("token"), nil
+}
+
+// AnnouncePeer tells a node we are a peer of the torrent, listening on port.
+// The token is the one returned by GetPeers.
+func (s *Server) AnnouncePeer(ctx context.Context, addr *net.UDPAddr, infoHash [20]byte, port uint16, token string) error {
+	_, err := s.query(ctx, addr, "announce_peer", krpcArgs{
+		InfoHash: string(infoHash[:]),
+		Port:     int(port),
+		Token:    token,
+	})
+	return err
+}
+
+// Bootstrap pings the given nodes, then looks up our own ID to fill the
+// routing table
+func (s *Server) Bootstrap(ctx context.Context, addrs []*net.UDPAddr) error {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			s.Ping(ctx, addr)
+		}(addr)
+	}
+	wg.Wait()
+	if s.table.Len() == 0 {
+		return errors.New("no bootstrap node responded")
+	}
+	s.lookup(ctx, s.table.Self(), false)
+	return ctx.Err()
+}
+
+// contact is a node found by a lookup, with the token it gave
+type contact struct {
+	node      Node
+	queried   bool
+	responded bool
+	token     string
+}
+
+// lookup queries the nodes closest to target iteratively, Alpha at a time,
+// until the K closest have all been queried. It uses get_peers if peers is
+// set, and returns the peers found and the closest nodes that responded.
+func (s *Server) lookup(ctx context.Context, target NodeID, peers bool) ([]peer.Peer, []*contact) {
+	var mu sync.Mutex
+	var found []peer.Peer
+	seen := make(map[string]bool)
+	var contacts []*contact
+	add := func(nodes []Node) {
+		for _, n := range nodes {
+			if n.ID == s.table.Self() || seen[n.Addr.String()] {
+				continue
+			}
+			seen[n.Addr.String()] = true
+			contacts = append(contacts, &contact{node: n})
+		}
+		sort.Slice(contacts, func(i, j int) bool {
+			di, dj := distance(contacts[i].node.ID, target), distance(contacts[j].node.ID, target)
+			return bytes.Compare(di[:], dj[:]) < 0
+		})
+	}
+	add(s.table.Closest(target, K))
+
+	for ctx.Err() == nil {
+		// Query the closest nodes not queried yet among the K closest
+		var batch []*contact
+		closest := 0
+		for _, c := range contacts {
+			if closest == K || len(batch) == Alpha {
+				break
+			}
+			if c.queried && !c.responded {
+				continue
+			}
+			closest++
+			if !c.queried {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c *contact) {
+				defer wg.Done()
+				var nodes []Node
+				var values []peer.Peer
+				var token string
+				var err error
+				if peers {
+					values, nodes, token, err = s.GetPeers(ctx, c.node.Addr, [20]byte(target))
+				} else {
+					nodes, err = s.FindNode(ctx, c.node.Addr, target)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					return
+				}
+				c.responded, c.token = true, token
+				found = append(found, values...)
+				add(nodes)
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	var responded []*contact
+	for _, c := range contacts {
+		if c.responded && len(responded) < K {
+			responded = append(responded, c)
+		}
+	}
+	return dedupe(found), responded
+}
+
+func dedupe(peers []peer.Peer) []peer.Peer {
+	seen := make(map[string]bool)
+	var unique []peer.Peer
+	for _, p := range peers {
+		if !seen[p.String()] {
+			seen[p.String()] = true
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
+
+// FindPeers looks up the peers of a torrent
+func (s *Server) FindPeers(ctx context.Context, infoHash [20]byte) []peer.Peer {
+	peers, _ := s.lookup(ctx, NodeID(infoHash), true)
+	return peers
+}
+
+// Announce looks up the peers of a torrent, and announces we are a peer
+// listening on port to the closest nodes
+func (s *Server) Announce(ctx context.Context, infoHash [20]byte, port uint16) []peer.Peer {
+	peers, contacts := s.lookup(ctx, NodeID(infoHash), true)
+	var wg sync.WaitGroup
+	for _, c := range contacts {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *contact) {
+			defer wg.Done()
+			s.AnnouncePeer(ctx, c.node.Addr, infoHash, port, c.token)
+		}(c)
+	}
+	wg.Wait()
+	return peers
+}
+
+type peerSource struct {
+	s        *Server
+	infoHash [20]byte
+	port     uint16
+}
+
+// PeerSource returns the DHT as a source of peers for a torrent, which is
+// announced at AnnounceInterval
+func (s *Server) PeerSource(infoHash [20]byte, port uint16) p2p.PeerSource {
+	return peerSource{s, infoHash, port}
+}
+
+func (ps peerSource) Name() string {
+	return "dht"
+}
+
+func (ps peerSource) Tracker() bool {
+	return false
+}
+
+func (ps peerSource) Discover(ctx context.Context) ([]peer.Peer, time.Duration, error) {
+	if ps.s.table.Len() == 0 {
+		return nil, 0, errors.New("routing table is empty")
+	}
+	return ps.s.Announce(ctx, ps.infoHash, ps.port), AnnounceInterval, nil
+}
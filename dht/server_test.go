@@ -0,0 +1,184 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, id NodeID) *Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s, err := NewServer(conn, NewRoutingTable(id))
+	require.Nil(t, err)
+	s.QueryTimeout = 200 * time.Millisecond
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func (s *Server) addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestServerPing(t *testing.T) {
+	a := newTestServer(t, NodeID{1})
+	b := newTestServer(t, NodeID{2})
+
+	id, err := a.Ping(context.Background(), b.addr())
+	require.Nil(t, err)
+	assert.Equal(t, NodeID{2}, id)
+	// Both nodes learned about each other
+	assert.Equal(t, 1, a.Table().Len())
+	assert.Equal(t, 1, b.Table().Len())
+}
+
+func TestServerPingTimeout(t *testing.T) {
+	a := newTestServer(t, NodeID{1})
+	b := newTestServer(t, NodeID{2})
+	b.Close()
+
+	_, err := a.Ping(context.Background(), b.addr())
+	assert.NotNil(t, err)
+}
+
+func TestServerFindNode(t *testing.T) {
+	a := newTestServer(t, NodeID{1})
+	b := newTestServer(t, NodeID{2})
+	c := newTestServer(t, NodeID{3})
+	b.Table().Add(Node{ID: NodeID{3}, Addr: c.addr()})
+
+	nodes, err := a.FindNode(context.Background(), b.addr(), NodeID{3})
+	require.Nil(t, err)
+	// The closest node comes first, followed by the querying node
+	require.Len(t, nodes, 2)
+	assert.Equal(t, NodeID{3}, nodes[0].ID)
+	assert.Equal(t, c.addr().Port, nodes[0].Addr.Port)
+	assert.Equal(t, NodeID{1}, nodes[1].ID)
+}
+
+func TestServerAnnouncePeerBadToken(t *testing.T) {
+	a := newTestServer(t, NodeID{1})
+	b := newTestServer(t, NodeID{2})
+
+	err := a.AnnouncePeer(context.Background(), b.addr(), [20]byte{9}, 6881, "forged")
+	var dhtErr *Error
+	require.ErrorAs(t, err, &dhtErr)
+	assert.Equal(t, ErrCodeProtocol, dhtErr.Code)
+}
+
+func TestServerAnnounceAndFindPeers(t *testing.T) {
+	// A small network where each node only knows the next one
+	var servers []*Server
+	for i := 0; i < 6; i++ {
+		servers = append(servers, newTestServer(t, NodeID{byte(i * 40)}))
+	}
+	for i := 1; i < len(servers); i++ {
+		_, err := servers[i].Ping(context.Background(), servers[i-1].addr())
+		require.Nil(t, err)
+	}
+	for _, s := range servers {
+		require.Nil(t, s.Bootstrap(context.Background(), []*net.UDPAddr{servers[0].addr()}))
+	}
+
+	infoHash := [20]byte{100, 1, 2, 3}
+	peers := servers[1].Announce(context.Background(), infoHash, 6881)
+	assert.Empty(t, peers)
+
+	peers = servers[5].FindPeers(context.Background(), infoHash)
+	assert.Equal(t, []peer.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, peers)
+
+	source := servers[4].PeerSource(infoHash, 6882)
+	assert.Equal(t, "dht", source.Name())
+	assert.False(t, source.Tracker())
+	peers, interval, err := source.Discover(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, AnnounceInterval, interval)
+	assert.Contains(t, peers, peer.Peer{IP: net.IP{127, 0, 0, 1}, Port: 6881})
+}
+
+func TestServerTokenRotation(t *testing.T) {
+	s := newTestServer(t, NodeID{1})
+	now := time.Now()
+	s.mu.Lock()
+	s.clock = func() time.Time { return now }
+	s.rotated = now
+	s.mu.Unlock()
+	ip := net.IP{10, 0, 0, 1}
+
+	token := s.token(ip)
+	assert.True(t, s.validToken(token, ip))
+	assert.False(t, s.validToken(token, net.IP{10, 0, 0, 2}))
+
+	// The token of the previous secret is still accepted
+	now = now.Add(TokenRotation)
+	assert.NotEqual(t, token, s.token(ip))
+	assert.True(t, s.validToken(token, ip))
+
+	now = now.Add(TokenRotation)
+	assert.False(t, s.validToken(token, ip))
+
+	// Both secrets change after a long time without queries
+	token = s.token(ip)
+	now = now.Add(time.Hour)
+	assert.False(t, s.validToken(token, ip))
+	assert.True(t, s.validToken(s.token(ip), ip))
+}
+
+func TestServerPeerExpiry(t *testing.T) {
+	s := newTestServer(t, NodeID{1})
+	now := time.Now()
+	s.mu.Lock()
+	s.clock = func() time.Time { return now }
+	s.mu.Unlock()
+	a := peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	b := peer.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+
+	s.storePeer([20]byte{1}, a)
+	now = now.Add(PeerExpiry / 2)
+	s.storePeer([20]byte{1}, b)
+	assert.Equal(t, []peer.Peer{a, b}, s.announced([20]byte{1}))
+
+	now = now.Add(PeerExpiry / 2)
+	assert.Equal(t, []peer.Peer{b}, s.announced([20]byte{1}))
+
+	// Announcing again keeps a peer
+	s.storePeer([20]byte{1}, b)
+	now = now.Add(PeerExpiry - time.Second)
+	assert.Equal(t, []peer.Peer{b}, s.announced([20]byte{1}))
+	now = now.Add(time.Second)
+	assert.Empty(t, s.announced([20]byte{1}))
+	assert.Empty(t, s.peers)
+}
+
+func TestServerMaxTorrents(t *testing.T) {
+	s := newTestServer(t, NodeID{1})
+	now := time.Now()
+	s.mu.Lock()
+	s.clock = func() time.Time { return now }
+	s.mu.Unlock()
+	p := peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+
+	for i := 0; i < MaxTorrents; i++ {
+		now = now.Add(time.Millisecond)
+		s.storePeer([20]byte{byte(i), byte(i >> 8)}, p)
+	}
+	require.Len(t, s.peers, MaxTorrents)
+
+	// The torrent announced to the longest ago makes room for a new one
+	s.storePeer([20]byte{0xff, 0xff}, p)
+	assert.Len(t, s.peers, MaxTorrents)
+	assert.Empty(t, s.announced([20]byte{0, 0}))
+	assert.Equal(t, []peer.Peer{p}, s.announced([20]byte{0xff, 0xff}))
+	assert.Equal(t, []peer.Peer{p}, s.announced([20]byte{1, 0}))
+
+	// Expired torrents are forgotten first
+	now = now.Add(PeerExpiry)
+	s.storePeer([20]byte{0xfe, 0xff}, p)
+	assert.Len(t, s.peers, 1)
+}
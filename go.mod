@@ -3,8 +3,8 @@ module github.com/leonhfr/torrent-client
 go 1.17
 
 require (
-	github.com/jackpal/bencode-go v1.0.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/time v0.3.0
 )
 
 require (
@@ -1,13 +1,22 @@
 package handshake
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
 
+var (
+	// ErrMalformed is returned when reading a handshake with an empty protocol string
+	ErrMalformed = errors.New("malformed handshake")
+	// ErrInfoHashMismatch is returned when a peer handshakes for another torrent
+	ErrInfoHashMismatch = errors.New("info hash mismatch")
+)
+
 // Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -21,13 +30,23 @@ func New(infoHash, peerID [20]byte) *Handshake {
 	}
 }
 
+// EnableExtensions sets the reserved bit advertising the extension protocol (BEP 10)
+func (h *Handshake) EnableExtensions() {
+	h.Reserved[5] |= 0x10
+}
+
+// SupportsExtensions reports whether the extension protocol (BEP 10) is advertised
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
 // Serialize serializes the handshake to a buffer
 func (h *Handshake) Serialize() []byte {
 	buf := make([]byte, len(h.Pstr)+49)
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], []byte(h.Pstr))
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -43,7 +62,7 @@ func Read(r io.Reader) (*Handshake, error) {
 	lengthPstr := int(lengthBuf[0])
 
 	if lengthPstr == 0 {
-		return nil, fmt.Errorf("lengthPstr cannot be 0")
+		return nil, fmt.Errorf("%w: lengthPstr cannot be 0", ErrMalformed)
 	}
 
 	handshakeBuf := make([]byte, 48+lengthPstr)
@@ -52,13 +71,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[lengthPstr:lengthPstr+8])
 	copy(infoHash[:], handshakeBuf[lengthPstr+8:lengthPstr+8+20])
 	copy(peerID[:], handshakeBuf[lengthPstr+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:lengthPstr]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -2,6 +2,7 @@ package handshake
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -48,6 +49,19 @@ func TestSerialize(t *testing.T) {
 	}
 }
 
+func TestExtensions(t *testing.T) {
+	h := New([20]byte{}, [20]byte{})
+	assert.False(t, h.SupportsExtensions())
+
+	h.EnableExtensions()
+	assert.True(t, h.SupportsExtensions())
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0}, h.Reserved)
+
+	res, err := Read(bytes.NewReader(h.Serialize()))
+	assert.Nil(t, err)
+	assert.True(t, res.SupportsExtensions())
+}
+
 func TestRead(t *testing.T) {
 	tests := map[string]struct {
 		input  []byte
@@ -91,3 +105,8 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, test.output, m)
 	}
 }
+
+func TestReadMalformed(t *testing.T) {
+	_, err := Read(bytes.NewReader([]byte{0, 0, 0}))
+	assert.True(t, errors.Is(err, ErrMalformed))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+// runInfo prints the metadata of a .torrent file:
+//
+//	torrent-client info [flags] <path>
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: torrent-client info [flags] <path>")
+		fs.PrintDefaults()
+	}
+	files := fs.Bool("files", true, "list the files of a multi-file torrent")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected the path of a torrent file")
+	}
+
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("name:         %s\n", tf.Name)
+	fmt.Printf("info hash:    %x\n", tf.InfoHash)
+	fmt.Printf("size:         %d bytes\n", tf.Length)
+	fmt.Printf("pieces:       %d of %d bytes\n", len(tf.PieceHashes), tf.PieceLength)
+	fmt.Printf("private:      %t\n", tf.Private)
+	if tf.Comment != "" {
+		fmt.Printf("comment:      %s\n", tf.Comment)
+	}
+	if tf.CreatedBy != "" {
+		fmt.Printf("created by:   %s\n", tf.CreatedBy)
+	}
+	if !tf.CreationDate.IsZero() {
+		fmt.Printf("created on:   %s\n", tf.CreationDate.Format(time.RFC3339))
+	}
+	for i, tier := range tf.Trackers() {
+		fmt.Printf("tier %d:       %s\n", i, strings.Join(tier, " "))
+	}
+	for _, url := range tf.URLList {
+		fmt.Printf("web seed:     %s\n", url)
+	}
+	if *files && len(tf.Files) > 0 {
+		fmt.Printf("files:        %d\n", len(tf.Files))
+		for i, f := range tf.Files {
+			if f.Padding {
+				fmt.Printf("  %4d  %12d  %s (padding)\n", i, f.Length, path.Join(f.Path...))
+				continue
+			}
+			fmt.Printf("  %4d  %12d  %s\n", i, f.Length, path.Join(f.Path...))
+		}
+	}
+	return nil
+}
+
+// runMagnet prints the magnet link of a .torrent file:
+//
+//	torrent-client magnet <path>
+func runMagnet(args []string) error {
+	fs := flag.NewFlagSet("magnet", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: torrent-client magnet <path>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected the path of a torrent file")
+	}
+
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(tf.Magnet())
+	return nil
+}
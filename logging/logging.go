@@ -0,0 +1,113 @@
+// Package logging defines the logger the packages of the client write to, so
+// that programs using them can filter their entries by level, or redirect
+// them to their own logging library.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level is the severity of an entry
+type Level int
+
+const (
+	// Debug entries follow the exchanges with each peer
+	Debug Level = iota
+	// Info entries report the progress of the torrents
+	Info
+	// Warn entries report failures the client recovers from, such as a
+	// peer or a tracker not responding
+	Warn
+	// Error entries report failures stopping a torrent
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// Field is a piece of context of an entry, such as the peer it is about
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns the field of a key and a value
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Logger receives the entries. It must be safe for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// Std writes the entries at or above Min to a standard logger, as the
+// message followed by the fields in key=value form
+type Std struct {
+	// Logger defaults to the standard logger
+	Logger *log.Logger
+	Min    Level
+}
+
+// Log writes the entry if its level is at least Min
+func (s Std) Log(level Level, msg string, fields ...Field) {
+	if level < s.Min {
+		return
+	}
+	l := s.Logger
+	if l == nil {
+		l = log.Default()
+	}
+	if len(fields) == 0 {
+		l.Println(msg)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	l.Println(b.String())
+}
+
+// Default writes the entries at or above Info to the standard logger
+var Default Logger = Std{Min: Info}
+
+// Discard drops every entry
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Log(Level, string, ...Field) {}
+
+// With returns a logger adding fields to the entries written to l, e.g. to
+// tell which peer they are about
+func With(l Logger, fields ...Field) Logger {
+	if w, ok := l.(with); ok {
+		return with{w.l, append(append([]Field(nil), w.fields...), fields...)}
+	}
+	return with{l, fields}
+}
+
+type with struct {
+	l      Logger
+	fields []Field
+}
+
+func (w with) Log(level Level, msg string, fields ...Field) {
+	w.l.Log(level, msg, append(append([]Field(nil), w.fields...), fields...)...)
+}
@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStd(t *testing.T) {
+	var out bytes.Buffer
+	l := Std{Logger: log.New(&out, "", 0), Min: Info}
+	l.Log(Debug, "hidden")
+	l.Log(Info, "downloading")
+	l.Log(Warn, "could not connect", F("peer", "1.2.3.4:6881"), F("err", "refused"))
+	assert.Equal(t, "downloading\ncould not connect peer=1.2.3.4:6881 err=refused\n", out.String())
+}
+
+func TestWith(t *testing.T) {
+	var out bytes.Buffer
+	base := Std{Logger: log.New(&out, "", 0)}
+	peer := With(base, F("peer", "1.2.3.4:6881"))
+	piece := With(peer, F("piece", 3))
+	piece.Log(Debug, "received")
+	peer.Log(Debug, "choked", F("reason", "snubbed"))
+	assert.Equal(t, "received peer=1.2.3.4:6881 piece=3\nchoked peer=1.2.3.4:6881 reason=snubbed\n", out.String())
+
+	Discard.Log(Error, "dropped")
+	With(Discard, F("peer", "x")).Log(Error, "dropped")
+}
+
+func TestLevelString(t *testing.T) {
+	assert.Equal(t, "debug", Debug.String())
+	assert.Equal(t, "error", Error.String())
+	assert.Equal(t, "level(7)", Level(7).String())
+}
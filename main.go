@@ -1,23 +1,59 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
-
-	"github.com/leonhfr/torrent-client/torrentfile"
 )
 
-func main() {
-	inPath := os.Args[1]
-	outPath := os.Args[2]
+// command is a subcommand of torrent-client
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"download", "download a torrent from a .torrent file or a magnet link", runDownload},
+	{"seed", "verify the data of a torrent and seed it", runSeed},
+	{"create", "create the .torrent file of a file or a directory", runCreate},
+	{"info", "print the metadata of a .torrent file", runInfo},
+	{"verify", "check the data of a torrent against its piece hashes", runVerify},
+	{"magnet", "print the magnet link of a .torrent file", runMagnet},
+	{"scrape", "print the numbers of seeders and leechers of a torrent", runScrape},
+	{"daemon", "run torrents in the background, controlled over JSON-RPC", runDaemon},
+	{"remote", "add, list, pause, resume or remove the torrents of a daemon", runRemote},
+}
 
-	tf, err := torrentfile.Open(inPath)
-	if err != nil {
-		log.Fatal(err)
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: torrent-client <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
 	}
+	fmt.Fprintln(os.Stderr, "\nrun torrent-client <command> -h for the flags of a command")
+}
 
-	err = tf.DownloadToFile(outPath)
-	if err != nil {
-		log.Fatal(err)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name == name {
+			err := c.run(os.Args[2:])
+			if err != nil {
+				log.Fatalf("%s: %s", name, err)
+			}
+			return
+		}
+	}
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage()
+		return
 	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
 }
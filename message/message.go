@@ -2,22 +2,40 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// DefaultMaxLength is the longest message read by default. It fits the
+// blocks of 16 KiB and the bitfields of a million pieces.
+const DefaultMaxLength = 128 * 1024
+
+var (
+	// ErrUnexpectedID is returned when parsing a message of another type
+	ErrUnexpectedID = errors.New("unexpected message ID")
+	// ErrMalformed is returned when the payload of a message is invalid
+	ErrMalformed = errors.New("malformed message")
+	// ErrTooLong is returned when reading a message longer than allowed,
+	// which is a protocol violation
+	ErrTooLong = errors.New("message too long")
+)
+
 type messageID uint8
 
 const (
-	MsgChoke         messageID = 0 // MsgChoke chokes the receiver
-	MsgUnchoke       messageID = 1 // MsgUnchoke unchokes the receiver
-	MsgInterested    messageID = 2 // MsgInterested expresses interest in receiving data
-	MsgNotInterested messageID = 3 // MsgNotInterested expresses disinterest in receiving data
-	MsgHave          messageID = 4 // MsgHave alerts the receiver that the sender has downloaded a piece
-	MsgBitfield      messageID = 5 // MsgBitfield encodes which pieces the sender has downloaded
-	MsgRequest       messageID = 6 // MsgRequest requests a block of data from the receiver
-	MsgPiece         messageID = 7 // MsgPiece delivers a block of data to fulfill a request
-	MsgCancel        messageID = 8 // MsgCancel cancels a request
+	MsgChoke         messageID = 0  // MsgChoke chokes the receiver
+	MsgUnchoke       messageID = 1  // MsgUnchoke unchokes the receiver
+	MsgInterested    messageID = 2  // MsgInterested expresses interest in receiving data
+	MsgNotInterested messageID = 3  // MsgNotInterested expresses disinterest in receiving data
+	MsgHave          messageID = 4  // MsgHave alerts the receiver that the sender has downloaded a piece
+	MsgBitfield      messageID = 5  // MsgBitfield encodes which pieces the sender has downloaded
+	MsgRequest       messageID = 6  // MsgRequest requests a block of data from the receiver
+	MsgPiece         messageID = 7  // MsgPiece delivers a block of data to fulfill a request
+	MsgCancel        messageID = 8  // MsgCancel cancels a request
+	MsgHaveAll       messageID = 14 // MsgHaveAll replaces the bitfield of a peer having every piece (BEP 6)
+	MsgHaveNone      messageID = 15 // MsgHaveNone replaces the bitfield of a peer having no piece (BEP 6)
+	MsgExtended      messageID = 20 // MsgExtended carries a message of the extension protocol (BEP 10)
 )
 
 // Message stores the ID and payload of a message
@@ -35,6 +53,15 @@ func NewRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+// NewCancel creates a CANCEL Message
+func NewCancel(index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: MsgCancel, Payload: payload}
+}
+
 // NewHave creates a HAVE Message
 func NewHave(index int) *Message {
 	payload := make([]byte, 4)
@@ -42,25 +69,57 @@ func NewHave(index int) *Message {
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+// NewPiece creates a PIECE Message delivering a block
+func NewPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// NewExtended creates an EXTENDED Message. The extended ID 0 is the
+// extension handshake, the others are negotiated by the handshake.
+func NewExtended(extendedID uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extendedID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseRequest parses a REQUEST Message
+func (msg *Message) ParseRequest() (index, begin, length int, err error) {
+	if msg.ID != MsgRequest {
+		return 0, 0, 0, fmt.Errorf("%w: expected REQUEST (ID %d), got ID %d", ErrUnexpectedID, MsgRequest, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("%w: expected payload length 12, got length %d", ErrMalformed, len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 // ParsePiece parses a PIECE Message amd copies its payload in a buffer
 func (msg *Message) ParsePiece(expectedIndex int, buf []byte) (int, error) {
 	if msg.ID != MsgPiece {
-		return 0, fmt.Errorf("expected PIECE (ID %d), got ID %d", MsgPiece, msg.ID)
+		return 0, fmt.Errorf("%w: expected PIECE (ID %d), got ID %d", ErrUnexpectedID, MsgPiece, msg.ID)
 	}
 	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("payload too short, %d < 8", len(msg.Payload))
+		return 0, fmt.Errorf("%w: payload too short, %d < 8", ErrMalformed, len(msg.Payload))
 	}
 	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
 	if index != expectedIndex {
-		return 0, fmt.Errorf("expected index %d, got %d", expectedIndex, index)
+		return 0, fmt.Errorf("%w: expected index %d, got %d", ErrMalformed, expectedIndex, index)
 	}
 	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
 	if begin >= len(buf) {
-		return 0, fmt.Errorf("begin offset too high, %d >= %d", begin, len(buf))
+		return 0, fmt.Errorf("%w: begin offset too high, %d >= %d", ErrMalformed, begin, len(buf))
 	}
 	data := msg.Payload[8:]
 	if begin+len(data) > len(buf) {
-		return 0, fmt.Errorf("data too long [%d] for offset %d with length %d", len(data), begin, len(buf))
+		return 0, fmt.Errorf("%w: data too long [%d] for offset %d with length %d", ErrMalformed, len(data), begin, len(buf))
 	}
 	copy(buf[begin:], data)
 	return len(data), nil
@@ -69,15 +128,26 @@ func (msg *Message) ParsePiece(expectedIndex int, buf []byte) (int, error) {
 // ParseHave parses a HAVE Message
 func (msg *Message) ParseHave() (int, error) {
 	if msg.ID != MsgHave {
-		return 0, fmt.Errorf("expected HAVE (ID %d), got ID %d", MsgHave, msg.ID)
+		return 0, fmt.Errorf("%w: expected HAVE (ID %d), got ID %d", ErrUnexpectedID, MsgHave, msg.ID)
 	}
 	if len(msg.Payload) != 4 {
-		return 0, fmt.Errorf("expected payload length 4, got length %d", len(msg.Payload))
+		return 0, fmt.Errorf("%w: expected payload length 4, got length %d", ErrMalformed, len(msg.Payload))
 	}
 	index := int(binary.BigEndian.Uint32(msg.Payload))
 	return index, nil
 }
 
+// ParseExtended parses an EXTENDED Message into its extended ID and payload
+func (msg *Message) ParseExtended() (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("%w: expected EXTENDED (ID %d), got ID %d", ErrUnexpectedID, MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("%w: expected payload length at least 1, got length %d", ErrMalformed, len(msg.Payload))
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
 // Serialize serializes a message into a buffer of the form
 // <length prefix><message ID><payload>
 // Interprets `nil` as a keep-alive message
@@ -93,9 +163,15 @@ func (msg *Message) Serialize() []byte {
 	return buf
 }
 
-// Read parses a message from a stream.
+// Read parses a message from a stream, up to DefaultMaxLength long.
 // Returns `nil` on keep-alive message.
 func Read(r io.Reader) (*Message, error) {
+	return ReadMax(r, DefaultMaxLength)
+}
+
+// ReadMax parses a message from a stream as Read, failing with ErrTooLong
+// before reading a message longer than max bytes
+func ReadMax(r io.Reader, max int) (*Message, error) {
 	lengthBuf := make([]byte, 4)
 	_, err := io.ReadFull(r, lengthBuf)
 	if err != nil {
@@ -107,6 +183,10 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	err = checkLength(length, max)
+	if err != nil {
+		return nil, err
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
@@ -122,6 +202,14 @@ func Read(r io.Reader) (*Message, error) {
 	return &msg, nil
 }
 
+// checkLength fails if a message of the given length is longer than max
+func checkLength(length uint32, max int) error {
+	if uint64(length) > uint64(max) {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrTooLong, length, max)
+	}
+	return nil
+}
+
 func (msg *Message) name() string {
 	if msg == nil {
 		return "KeepAlive"
@@ -145,6 +233,12 @@ func (msg *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", msg.ID)
 	}
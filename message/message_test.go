@@ -2,6 +2,7 @@ package message
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,6 +21,19 @@ func TestNewRequest(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestNewCancel(t *testing.T) {
+	msg := NewCancel(4, 567, 4321)
+	expected := &Message{
+		ID: MsgCancel,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0x00, 0x00, 0x10, 0xe1, // Length
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
 func TestNewHave(t *testing.T) {
 	msg := NewHave(4)
 	expected := &Message{
@@ -29,6 +43,79 @@ func TestNewHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestNewPiece(t *testing.T) {
+	msg := NewPiece(4, 567, []byte{0xaa, 0xbb, 0xcc})
+	expected := &Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0xaa, 0xbb, 0xcc, // Block
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestNewExtended(t *testing.T) {
+	msg := NewExtended(3, []byte{0xaa, 0xbb})
+	expected := &Message{
+		ID:      MsgExtended,
+		Payload: []byte{0x03, 0xaa, 0xbb},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		index  int
+		begin  int
+		length int
+		fails  bool
+	}{
+		"parse valid request": {
+			input: &Message{
+				ID: MsgRequest,
+				Payload: []byte{
+					0x00, 0x00, 0x00, 0x04, // Index
+					0x00, 0x00, 0x02, 0x37, // Begin
+					0x00, 0x00, 0x10, 0xe1, // Length
+				},
+			},
+			index:  4,
+			begin:  567,
+			length: 4321,
+			fails:  false,
+		},
+		"wrong message type": {
+			input: &Message{
+				ID:      MsgPiece,
+				Payload: []byte{0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x02, 0x37, 0x00, 0x00, 0x10, 0xe1},
+			},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{
+				ID:      MsgRequest,
+				Payload: []byte{0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x02, 0x37},
+			},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		index, begin, length, err := test.input.ParseRequest()
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.index, index)
+		assert.Equal(t, test.begin, begin)
+		assert.Equal(t, test.length, length)
+	}
+}
+
 func TestParsePiece(t *testing.T) {
 	tests := map[string]struct {
 		inputIndex int
@@ -138,6 +225,15 @@ func TestParsePiece(t *testing.T) {
 	}
 }
 
+func TestParseErrors(t *testing.T) {
+	_, _, _, err := NewHave(4).ParseRequest()
+	assert.True(t, errors.Is(err, ErrUnexpectedID))
+	_, err = (&Message{ID: MsgHave, Payload: []byte{0x00}}).ParseHave()
+	assert.True(t, errors.Is(err, ErrMalformed))
+	_, err = NewPiece(1, 0, []byte{0x00}).ParsePiece(2, make([]byte, 4))
+	assert.True(t, errors.Is(err, ErrMalformed))
+}
+
 func TestParseHave(t *testing.T) {
 	tests := map[string]struct {
 		input  *Message
@@ -177,6 +273,45 @@ func TestParseHave(t *testing.T) {
 	}
 }
 
+func TestParseExtended(t *testing.T) {
+	tests := map[string]struct {
+		input   *Message
+		id      uint8
+		payload []byte
+		fails   bool
+	}{
+		"parse valid message": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{0x02, 0xaa, 0xbb}},
+			id:      2,
+			payload: []byte{0xaa, 0xbb},
+		},
+		"empty extended payload": {
+			input:   &Message{ID: MsgExtended, Payload: []byte{0x00}},
+			id:      0,
+			payload: []byte{},
+		},
+		"wrong message type": {
+			input: &Message{ID: MsgHave, Payload: []byte{0x00, 0x00, 0x00, 0x04}},
+			fails: true,
+		},
+		"payload too short": {
+			input: &Message{ID: MsgExtended, Payload: []byte{}},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		id, payload, err := test.input.ParseExtended()
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.id, id)
+		assert.Equal(t, test.payload, payload)
+	}
+}
+
 func TestSerialize(t *testing.T) {
 	tests := map[string]struct {
 		input  *Message
@@ -224,6 +359,11 @@ func TestRead(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"length too long": {
+			input:  []byte{0xff, 0xff, 0xff, 0xff, 4},
+			output: nil,
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
@@ -238,6 +378,18 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestReadMax(t *testing.T) {
+	buf := NewHave(1).Serialize()
+	_, err := ReadMax(bytes.NewReader(buf), 4)
+	assert.True(t, errors.Is(err, ErrTooLong))
+	msg, err := ReadMax(bytes.NewReader(buf), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, NewHave(1), msg)
+
+	_, err = Read(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert.True(t, errors.Is(err, ErrTooLong))
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		input  *Message
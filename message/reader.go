@@ -0,0 +1,107 @@
+package message
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+const (
+	// poolSize is the size of the pooled payload buffers, which fit the
+	// PIECE messages of 16 KiB blocks
+	poolSize = 8 + 16*1024
+	// minPooled is the smallest payload taken from the pool. Smaller ones,
+	// such as the ones of requests, are cheaper to allocate than to hold a
+	// pooled buffer.
+	minPooled = 1024
+)
+
+var payloads = sync.Pool{
+	New: func() interface{} {
+		return new([poolSize]byte)
+	},
+}
+
+// Reader reads messages from a stream as Read does, reusing a scratch buffer
+// for the length prefixes and taking the payloads of blocks from a pool. A
+// read interrupted by an error, such as an expired deadline, resumes where
+// it stopped on the next call. It is not safe for concurrent use.
+type Reader struct {
+	// MaxLength is the longest message read, see ReadMax. Defaults to
+	// DefaultMaxLength.
+	MaxLength int
+
+	r       io.Reader
+	header  [5]byte
+	read    int    // bytes of the current message read so far
+	payload []byte // payload of the current message, once its ID is read
+}
+
+// NewReader returns a reader of the messages of r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read reads and consumes a message. Its payload can be given back to the
+// pool with Release once it is not used anymore.
+func (rd *Reader) Read() (*Message, error) {
+	if rd.read < 4 {
+		n, err := io.ReadFull(rd.r, rd.header[rd.read:4])
+		rd.read += n
+		if err != nil {
+			return nil, err
+		}
+	}
+	length := binary.BigEndian.Uint32(rd.header[:4])
+
+	// keep-alive message
+	if length == 0 {
+		rd.read = 0
+		return nil, nil
+	}
+	max := rd.MaxLength
+	if max <= 0 {
+		max = DefaultMaxLength
+	}
+	err := checkLength(length, max)
+	if err != nil {
+		return nil, err
+	}
+
+	if rd.read < 5 {
+		n, err := io.ReadFull(rd.r, rd.header[4:5])
+		rd.read += n
+		if err != nil {
+			return nil, err
+		}
+		if size := int(length - 1); size >= minPooled && size <= poolSize {
+			rd.payload = payloads.Get().(*[poolSize]byte)[:size]
+		} else {
+			rd.payload = make([]byte, size)
+		}
+	}
+	n, err := io.ReadFull(rd.r, rd.payload[rd.read-5:])
+	rd.read += n
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{ID: messageID(rd.header[4]), Payload: rd.payload}
+	rd.read, rd.payload = 0, nil
+	return msg, nil
+}
+
+// Release gives the payload of a message read by a Reader back to the pool.
+// Neither the message nor its payload may be used afterwards.
+func Release(msg *Message) {
+	if msg != nil {
+		release(msg.Payload)
+		msg.Payload = nil
+	}
+}
+
+func release(payload []byte) {
+	if cap(payload) == poolSize {
+		payloads.Put((*[poolSize]byte)(payload[:poolSize]))
+	}
+}
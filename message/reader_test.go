@@ -0,0 +1,144 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	block := make([]byte, 16*1024)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	large := make([]byte, 2*poolSize)
+	messages := []*Message{
+		NewHave(4),
+		nil, // keep-alive
+		NewPiece(1, 0, block),
+		{ID: MsgBitfield, Payload: large},
+		NewPiece(2, 16, block[:minPooled]),
+	}
+	var stream bytes.Buffer
+	for _, msg := range messages {
+		stream.Write(msg.Serialize())
+	}
+
+	r := NewReader(&stream)
+	for _, expected := range messages {
+		msg, err := r.Read()
+		require.Nil(t, err)
+		assert.Equal(t, expected, msg)
+		Release(msg)
+	}
+	_, err := r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	buf := NewPiece(1, 0, make([]byte, 16*1024)).Serialize()
+	_, err := NewReader(bytes.NewReader(buf[:100])).Read()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+// stutterReader delivers its chunks one read at a time, failing the reads
+// of the empty ones as an expired deadline would
+type stutterReader [][]byte
+
+var errStutter = errors.New("read interrupted")
+
+func (s *stutterReader) Read(p []byte) (int, error) {
+	if len(*s) == 0 {
+		return 0, io.EOF
+	}
+	chunk := (*s)[0]
+	if len(chunk) == 0 {
+		*s = (*s)[1:]
+		return 0, errStutter
+	}
+	n := copy(p, chunk)
+	if n == len(chunk) {
+		*s = (*s)[1:]
+	} else {
+		(*s)[0] = chunk[n:]
+	}
+	return n, nil
+}
+
+func TestReaderResumes(t *testing.T) {
+	piece := NewPiece(1, 0, make([]byte, 16*1024))
+	piece.Payload[100] = 42
+	have := NewHave(3).Serialize()
+	buf := piece.Serialize()
+	// Interrupted in the length prefix, after the ID and in the payload
+	stream := stutterReader{buf[:2], nil, buf[2:5], nil, buf[5:200], nil, nil, buf[200:], have}
+
+	r := NewReader(&stream)
+	interruptions := 0
+	var msgs []*Message
+	for {
+		msg, err := r.Read()
+		if errors.Is(err, errStutter) {
+			interruptions++
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, 4, interruptions)
+	assert.Equal(t, []*Message{piece, NewHave(3)}, msgs)
+}
+
+func TestReaderMaxLength(t *testing.T) {
+	buf := NewPiece(1, 0, make([]byte, 16*1024)).Serialize()
+	r := NewReader(bytes.NewReader(buf))
+	r.MaxLength = 1024
+	_, err := r.Read()
+	assert.True(t, errors.Is(err, ErrTooLong))
+
+	_, err = NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})).Read()
+	assert.True(t, errors.Is(err, ErrTooLong))
+}
+
+func TestRelease(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(NewPiece(1, 0, make([]byte, 16*1024)).Serialize())
+	msg, err := NewReader(&stream).Read()
+	require.Nil(t, err)
+	assert.Equal(t, poolSize, cap(msg.Payload))
+	Release(msg)
+	assert.Nil(t, msg.Payload)
+
+	// Messages not read by a Reader are left alone
+	msg = NewHave(1)
+	Release(msg)
+	Release(nil)
+}
+
+func BenchmarkRead(b *testing.B) {
+	buf := NewPiece(1, 0, make([]byte, 16*1024)).Serialize()
+	r := bytes.NewReader(buf)
+	b.Run("Read", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.Reset(buf)
+			Read(r)
+		}
+	})
+	b.Run("Reader", func(b *testing.B) {
+		b.ReportAllocs()
+		rd := NewReader(r)
+		for i := 0; i < b.N; i++ {
+			r.Reset(buf)
+			msg, _ := rd.Read()
+			Release(msg)
+		}
+	})
+}
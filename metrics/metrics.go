@@ -0,0 +1,149 @@
+// Package metrics keeps the metrics of torrents in memory and exposes them
+// to Prometheus, in its text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets, in seconds,
+// suited to the latency of network requests
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// contentType is the type of the Prometheus text format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds counters, gauges and histograms by name, which are created
+// on first use. It implements p2p.Metrics, so that it can be shared by
+// torrents, and serves the metrics over HTTP to Prometheus, e.g. on
+// /metrics. It is safe for concurrent use.
+type Registry struct {
+	namespace string
+	buckets   []float64
+
+	mu         sync.Mutex
+	counters   map[string]int64
+	gauges     map[string]int64
+	histograms map[string]*histogram
+}
+
+// histogram counts samples in buckets of increasing upper bounds
+type histogram struct {
+	counts []int64 // samples by bucket, not cumulated, the last one for +Inf
+	sum    float64
+	count  int64
+}
+
+// NewRegistry returns an empty registry whose metrics are prefixed with
+// namespace and an underscore, if not empty. Histograms have the buckets
+// given, or DefaultBuckets.
+func NewRegistry(namespace string, buckets ...float64) *Registry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Registry{
+		namespace:  namespace,
+		buckets:    sorted,
+		counters:   make(map[string]int64),
+		gauges:     make(map[string]int64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// AddCounter increments a counter by delta
+func (r *Registry) AddCounter(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+// AddGauge moves a gauge up or down by delta
+func (r *Registry) AddGauge(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] += delta
+}
+
+// Observe adds a sample to a histogram
+func (r *Registry) Observe(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[name]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(r.buckets)+1)}
+		r.histograms[name] = h
+	}
+	i := sort.SearchFloat64s(r.buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// Write writes the metrics in the Prometheus text format, ordered by name.
+// Counters get the _total suffix.
+func (r *Registry) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	r.mu.Lock()
+	for _, name := range sortedKeys(r.counters) {
+		full := r.name(name) + "_total"
+		fmt.Fprintf(bw, "# TYPE %s counter\n%s %d\n", full, full, r.counters[name])
+	}
+	for _, name := range sortedKeys(r.gauges) {
+		full := r.name(name)
+		fmt.Fprintf(bw, "# TYPE %s gauge\n%s %d\n", full, full, r.gauges[name])
+	}
+	names := make([]string, 0, len(r.histograms))
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		full := r.name(name)
+		h := r.histograms[name]
+		fmt.Fprintf(bw, "# TYPE %s histogram\n", full)
+		cumulated := int64(0)
+		for i, bound := range r.buckets {
+			cumulated += h.counts[i]
+			fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", full, formatFloat(bound), cumulated)
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", full, h.count)
+		fmt.Fprintf(bw, "%s_sum %s\n%s_count %d\n", full, formatFloat(h.sum), full, h.count)
+	}
+	r.mu.Unlock()
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	r.Write(w)
+}
+
+// name returns the full name of a metric
+func (r *Registry) name(name string) string {
+	if r.namespace == "" {
+		return name
+	}
+	return r.namespace + "_" + name
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _ p2p.Metrics = (*Registry)(nil)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry("torrent", 1, 0.5)
+	r.AddCounter(p2p.MetricPiecesCompleted, 3)
+	r.AddCounter(p2p.MetricPiecesCompleted, 2)
+	r.AddCounter(p2p.MetricDownloadedBytes, 1024)
+	r.AddGauge(p2p.MetricConnectedPeers, 2)
+	r.AddGauge(p2p.MetricConnectedPeers, -1)
+	r.Observe(p2p.MetricRequestLatency, 0.25)
+	r.Observe(p2p.MetricRequestLatency, 0.5)
+	r.Observe(p2p.MetricRequestLatency, 2)
+
+	var buf bytes.Buffer
+	require.Nil(t, r.Write(&buf))
+	expected := `# TYPE torrent_downloaded_bytes_total counter
+torrent_downloaded_bytes_total 1024
+# TYPE torrent_pieces_completed_total counter
+torrent_pieces_completed_total 5
+# TYPE torrent_connected_peers gauge
+torrent_connected_peers 1
+# TYPE torrent_request_latency_seconds histogram
+torrent_request_latency_seconds_bucket{le="0.5"} 2
+torrent_request_latency_seconds_bucket{le="1"} 2
+torrent_request_latency_seconds_bucket{le="+Inf"} 3
+torrent_request_latency_seconds_sum 2.75
+torrent_request_latency_seconds_count 3
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := NewRegistry("")
+	r.AddGauge(p2p.MetricActiveTorrents, 1)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, contentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE active_torrents gauge\nactive_torrents 1\n", rec.Body.String())
+}
@@ -0,0 +1,377 @@
+// Package mse implements the Message Stream Encryption handshake, which
+// obfuscates BitTorrent connections with RC4 keys negotiated by a
+// Diffie-Hellman exchange
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// CryptoMethod is a bit field of the encryption methods of the connection
+// after the handshake
+type CryptoMethod uint32
+
+const (
+	CryptoPlaintext CryptoMethod = 0x01 // CryptoPlaintext sends the messages as is
+	CryptoRC4       CryptoMethod = 0x02 // CryptoRC4 encrypts the messages with RC4
+)
+
+const (
+	keySize    = 96   // keySize is the size of the public keys and secret
+	maxPadSize = 512  // maxPadSize is the largest random padding
+	discard    = 1024 // discard is the number of keystream bytes dropped
+)
+
+var (
+	// ErrNoCryptoMethod is returned when no crypto method is supported by both ends
+	ErrNoCryptoMethod = errors.New("no common crypto method")
+	// ErrUnknownInfoHash is returned when the peer asks for a torrent we don't serve
+	ErrUnknownInfoHash = errors.New("unknown info hash")
+	// ErrSyncNotFound is returned when the peer's stream does not match the handshake
+	ErrSyncNotFound = errors.New("synchronization pattern not found")
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8) // verification constant
+)
+
+// pstr starts the plaintext handshake
+var pstr = []byte("\x13BitTorrent protocol")
+
+// keyPair is one end of the Diffie-Hellman exchange
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(generator, private, prime)
+	return &keyPair{private: private, public: pad(public)}, nil
+}
+
+// secret returns the secret shared with the owner of the public key
+func (k *keyPair) secret(public []byte) []byte {
+	y := new(big.Int).SetBytes(public)
+	return pad(new(big.Int).Exp(y, k.private, prime))
+}
+
+// pad returns n as a big-endian integer of keySize bytes
+func pad(n *big.Int) []byte {
+	buf := make([]byte, keySize)
+	b := n.Bytes()
+	copy(buf[keySize-len(b):], b)
+	return buf
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher returns the RC4 stream for the given key name, with the first
+// bytes discarded
+func newCipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), secret, skey[:]))
+	buf := make([]byte, discard)
+	c.XORKeyStream(buf, buf)
+	return c
+}
+
+// randomPad returns between 0 and maxPadSize random bytes
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadSize+1))
+	_, err = rand.Read(buf)
+	return buf, err
+}
+
+// synchronize reads from r until the pattern is found, at most max bytes
+// after the current position
+func synchronize(r io.Reader, pattern []byte, max int) error {
+	buf := make([]byte, 0, max+len(pattern))
+	b := make([]byte, 1)
+	for len(buf) < cap(buf) {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b[0])
+		if bytes.HasSuffix(buf, pattern) {
+			return nil
+		}
+	}
+	return ErrSyncNotFound
+}
+
+// Initiate runs the handshake on an outgoing connection for the torrent of
+// info hash skey, offering the crypto methods of provide. It returns the
+// connection to use from then on, which encrypts the messages if the peer
+// selected RC4.
+func Initiate(conn net.Conn, skey [20]byte, provide CryptoMethod) (net.Conn, CryptoMethod, error) {
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, 0, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padA...))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	yb := make([]byte, keySize)
+	_, err = io.ReadFull(conn, yb)
+	if err != nil {
+		return nil, 0, err
+	}
+	secret := keys.secret(yb)
+	enc := newCipher("keyA", secret, skey)
+	dec := newCipher("keyB", secret, skey)
+
+	req := hash([]byte("req1"), secret)
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	req = append(req, req2...)
+	// The plaintext handshake follows the encryption handshake instead of
+	// being sent as initial payload, so IA is empty
+	negotiation := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(negotiation[8:], uint32(provide))
+	enc.XORKeyStream(negotiation, negotiation)
+	_, err = conn.Write(append(req, negotiation...))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The peer's answer starts with the encrypted verification constant,
+	// after its padding
+	pattern := make([]byte, len(vc))
+	dec.XORKeyStream(pattern, vc)
+	err = synchronize(conn, pattern, maxPadSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	answer := make([]byte, 4+2)
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(answer, answer)
+	selected := CryptoMethod(binary.BigEndian.Uint32(answer))
+	padD := make([]byte, binary.BigEndian.Uint16(answer[4:]))
+	if len(padD) > maxPadSize {
+		return nil, 0, fmt.Errorf("padding of %d bytes too long", len(padD))
+	}
+	_, err = io.ReadFull(conn, padD)
+	if err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	switch {
+	case selected == CryptoRC4 && provide&CryptoRC4 != 0:
+		return newConn(conn, nil, enc, dec), selected, nil
+	case selected == CryptoPlaintext && provide&CryptoPlaintext != 0:
+		return conn, selected, nil
+	}
+	return nil, 0, fmt.Errorf("%w: peer selected %#x", ErrNoCryptoMethod, selected)
+}
+
+// IsPlaintext reads the start of an incoming connection to tell whether the
+// peer sent a plaintext handshake. It returns the connection to read from
+// then on, which replays the bytes read.
+func IsPlaintext(conn net.Conn) (net.Conn, bool, error) {
+	buf := make([]byte, len(pstr))
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, false, err
+	}
+	return newConn(conn, buf, nil, nil), bytes.Equal(buf, pstr), nil
+}
+
+// Receive runs the handshake on an incoming connection for one of the
+// torrents of skeys, selecting one of the crypto methods of allowed. It
+// returns the connection to use from then on and the info hash asked for.
+func Receive(conn net.Conn, skeys [][20]byte, allowed CryptoMethod) (net.Conn, [20]byte, error) {
+	var skey [20]byte
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, skey, err
+	}
+	ya := make([]byte, keySize)
+	_, err = io.ReadFull(conn, ya)
+	if err != nil {
+		return nil, skey, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, skey, err
+	}
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padB...))
+	if err != nil {
+		return nil, skey, err
+	}
+	secret := keys.secret(ya)
+
+	// The initiator's request starts after its padding
+	err = synchronize(conn, hash([]byte("req1"), secret), maxPadSize)
+	if err != nil {
+		return nil, skey, err
+	}
+	req := make([]byte, 20)
+	_, err = io.ReadFull(conn, req)
+	if err != nil {
+		return nil, skey, err
+	}
+	req3 := hash([]byte("req3"), secret)
+	for i := range req {
+		req[i] ^= req3[i]
+	}
+	found := false
+	for _, k := range skeys {
+		if bytes.Equal(req, hash([]byte("req2"), k[:])) {
+			skey, found = k, true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, ErrUnknownInfoHash
+	}
+	enc := newCipher("keyB", secret, skey)
+	dec := newCipher("keyA", secret, skey)
+
+	negotiation := make([]byte, 8+4+2)
+	_, err = io.ReadFull(conn, negotiation)
+	if err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(negotiation, negotiation)
+	if !bytes.Equal(negotiation[:8], vc) {
+		return nil, skey, errors.New("invalid verification constant")
+	}
+	provide := CryptoMethod(binary.BigEndian.Uint32(negotiation[8:]))
+	padC := make([]byte, binary.BigEndian.Uint16(negotiation[12:]))
+	if len(padC) > maxPadSize {
+		return nil, skey, fmt.Errorf("padding of %d bytes too long", len(padC))
+	}
+	_, err = io.ReadFull(conn, padC)
+	if err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(padC, padC)
+	var lenIA [2]byte
+	_, err = io.ReadFull(conn, lenIA[:])
+	if err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(lenIA[:], lenIA[:])
+	ia := make([]byte, binary.BigEndian.Uint16(lenIA[:]))
+	_, err = io.ReadFull(conn, ia)
+	if err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected CryptoMethod
+	switch {
+	case provide&allowed&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&allowed&CryptoPlaintext != 0:
+		selected = CryptoPlaintext
+	default:
+		return nil, skey, fmt.Errorf("%w: peer provided %#x", ErrNoCryptoMethod, provide)
+	}
+	answer := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(answer[8:], uint32(selected))
+	enc.XORKeyStream(answer, answer)
+	_, err = conn.Write(answer)
+	if err != nil {
+		return nil, skey, err
+	}
+
+	if selected == CryptoPlaintext {
+		return newConn(conn, ia, nil, nil), skey, nil
+	}
+	return newConn(conn, ia, enc, dec), skey, nil
+}
+
+// Conn is a connection reading some buffered bytes first, and encrypting the
+// stream if it has RC4 ciphers
+type Conn struct {
+	net.Conn
+	buf []byte // read before the connection
+
+	readMu sync.Mutex
+	dec    *rc4.Cipher
+
+	writeMu sync.Mutex
+	enc     *rc4.Cipher
+}
+
+func newConn(conn net.Conn, buf []byte, enc, dec *rc4.Cipher) *Conn {
+	return &Conn{Conn: conn, buf: buf, enc: enc, dec: dec}
+}
+
+// Read reads the buffered bytes, then decrypts the bytes read from the
+// connection
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypts b and writes it to the connection. Writes are serialized,
+// so that the peer decrypts them in the order they were encrypted.
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Encrypted reports whether the stream is encrypted
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
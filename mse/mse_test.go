@@ -0,0 +1,143 @@
+package mse
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createConns(t *testing.T) (initiator, receiver net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+	initiator, err = net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	return initiator, <-accepted
+}
+
+type received struct {
+	conn net.Conn
+	skey [20]byte
+	err  error
+}
+
+func TestHandshake(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	tests := map[string]struct {
+		provide  CryptoMethod
+		allowed  CryptoMethod
+		selected CryptoMethod
+		err      error
+	}{
+		"rc4":              {CryptoRC4, CryptoRC4, CryptoRC4, nil},
+		"rc4 preferred":    {CryptoRC4 | CryptoPlaintext, CryptoRC4 | CryptoPlaintext, CryptoRC4, nil},
+		"plaintext":        {CryptoRC4 | CryptoPlaintext, CryptoPlaintext, CryptoPlaintext, nil},
+		"no common method": {CryptoRC4, CryptoPlaintext, 0, ErrNoCryptoMethod},
+	}
+
+	for name, test := range tests {
+		a, b := createConns(t)
+		done := make(chan received, 1)
+		go func(allowed CryptoMethod) {
+			conn, got, err := Receive(b, [][20]byte{{4, 5, 6}, skey}, allowed)
+			if err != nil {
+				b.Close()
+			}
+			done <- received{conn, got, err}
+		}(test.allowed)
+
+		conn, selected, err := Initiate(a, skey, test.provide)
+		if test.err != nil {
+			assert.NotNil(t, err, name)
+			assert.True(t, errors.Is((<-done).err, test.err), name)
+			a.Close()
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, test.selected, selected, name)
+		r := <-done
+		require.Nil(t, r.err, name)
+		assert.Equal(t, skey, r.skey, name)
+
+		// Both ends read what the other wrote
+		go conn.Write([]byte("from initiator"))
+		buf := make([]byte, 14)
+		_, err = io.ReadFull(r.conn, buf)
+		require.Nil(t, err, name)
+		assert.Equal(t, "from initiator", string(buf), name)
+		go r.conn.Write([]byte("from receiver"))
+		buf = make([]byte, 13)
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(t, err, name)
+		assert.Equal(t, "from receiver", string(buf), name)
+
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	a, b := createConns(t)
+	defer a.Close()
+	defer b.Close()
+	go Receive(b, [][20]byte{skey}, CryptoRC4)
+	conn, _, err := Initiate(a, skey, CryptoRC4)
+	require.Nil(t, err)
+	assert.True(t, conn.(*Conn).Encrypted())
+
+	// The bytes on the wire are not the ones written
+	go conn.Write([]byte("\x13BitTorrent protocol"))
+	buf := make([]byte, 20)
+	_, err = io.ReadFull(b, buf)
+	require.Nil(t, err)
+	assert.NotEqual(t, "\x13BitTorrent protocol", string(buf))
+}
+
+func TestReceiveUnknownInfoHash(t *testing.T) {
+	a, b := createConns(t)
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := Receive(b, [][20]byte{{4, 5, 6}}, CryptoRC4)
+		b.Close()
+		done <- err
+	}()
+
+	_, _, err := Initiate(a, [20]byte{1, 2, 3}, CryptoRC4)
+	assert.NotNil(t, err)
+	assert.True(t, errors.Is(<-done, ErrUnknownInfoHash))
+}
+
+func TestIsPlaintext(t *testing.T) {
+	a, b := createConns(t)
+	defer a.Close()
+	defer b.Close()
+
+	msg := []byte("\x13BitTorrent protocol and the rest")
+	go a.Write(msg)
+	conn, plaintext, err := IsPlaintext(b)
+	require.Nil(t, err)
+	assert.True(t, plaintext)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	assert.Equal(t, msg, buf)
+
+	go a.Write(make([]byte, 20))
+	_, plaintext, err = IsPlaintext(b)
+	require.Nil(t, err)
+	assert.False(t, plaintext)
+}
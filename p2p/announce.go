@@ -0,0 +1,234 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
+)
+
+// DefaultAnnounceInterval is the time between two announces when the tracker
+// does not ask for an interval
+const DefaultAnnounceInterval = 30 * time.Minute
+
+// StoppedTimeout bounds the time spent telling the tracker about the torrent
+// stopping when shutting down, and finishing an announce in flight
+const StoppedTimeout = 5 * time.Second
+
+// ErrNoTracker is returned when announcing a torrent without AnnounceURL
+var ErrNoTracker = errors.New("torrent has no tracker")
+
+// Announce announces the torrent to its tracker with the given event, which
+// is empty for regular announces, and adds the returned peers. The transfer
+// counters sent are the payload bytes of the current session. The regular
+// announces of partial seeds have the paused event (BEP 21).
+func (t *Torrent) Announce(ctx context.Context, event string) (tracker.AnnounceResponse, error) {
+	if t.AnnounceURL == "" {
+		return tracker.AnnounceResponse{}, ErrNoTracker
+	}
+	if event == "" && t.partialSeed() {
+		event = tracker.EventPaused
+	}
+
+	t.mu.Lock()
+	port := t.Port
+	if t.listenPort != 0 {
+		port = t.listenPort
+	} else if t.Incoming != nil {
+		port = t.Incoming.Port()
+	}
+	trackerID := t.announces.TrackerID
+	t.mu.Unlock()
+
+	counters := t.counters.Snapshot()
+	left := t.Length - int(atomic.LoadInt64(&t.completed))
+	if left < 0 {
+		left = 0
+	}
+	start := time.Now()
+	resp, err := tracker.Announce(ctx, t.AnnounceURL, tracker.AnnounceRequest{
+		InfoHash:   t.InfoHash,
+		PeerID:     t.PeerId,
+		Port:       port,
+		Uploaded:   int(counters.PayloadUploaded),
+		Downloaded: int(counters.PayloadDownloaded),
+		Left:       left,
+		Event:      event,
+		TrackerID:  trackerID,
+		Dialer:     t.Dialer,
+	})
+	t.metrics().Observe(MetricAnnounceLatency, time.Since(start).Seconds())
+	if err != nil {
+		t.metrics().AddCounter(MetricTrackerErrors, 1)
+		return resp, err
+	}
+
+	if resp.WarningMessage != "" {
+		t.logger().Log(logging.Warn, "warning from tracker", logging.F("tracker", t.AnnounceURL), logging.F("warning", resp.WarningMessage))
+	}
+	t.Announced(resp)
+	if event != tracker.EventStopped {
+		t.AddPeers(resp.Peers)
+	}
+	return resp, nil
+}
+
+// Announced records an announce made for the torrent, such as the one that
+// found its first peers, so that the next announces wait for the interval
+// the tracker asked for and send back its tracker id
+func (t *Torrent) Announced(resp tracker.AnnounceResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.announces.Update(resp, time.Now())
+	t.restored = false
+}
+
+// TrackerState returns the last announce to the tracker, to be restored by
+// the next run with RestoreTrackerState
+func (t *Torrent) TrackerState() tracker.State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.announces
+	state.Peers = append([]peer.Peer(nil), state.Peers...)
+	return state
+}
+
+// RestoreTrackerState adds the last known peers of a previous run, and keeps
+// its last announce until the tracker answers this run. The tracker is still
+// told about the torrent starting, but not before the interval it asked the
+// previous run for.
+func (t *Torrent) RestoreTrackerState(state tracker.State) {
+	t.mu.Lock()
+	if t.announces.LastAnnounce.IsZero() {
+		t.announces = state
+		t.announces.Peers = append([]peer.Peer(nil), state.Peers...)
+		t.restored = !state.LastAnnounce.IsZero()
+	}
+	t.mu.Unlock()
+	t.AddPeers(state.Peers)
+}
+
+// nextAnnounce returns when to announce again, at the interval asked for by
+// the tracker or DefaultAnnounceInterval
+func (t *Torrent) nextAnnounce() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.announces.LastAnnounce.IsZero() {
+		return time.Now().Add(DefaultAnnounceInterval)
+	}
+	if t.announces.Interval <= 0 && t.announces.MinInterval <= 0 {
+		return t.announces.LastAnnounce.Add(DefaultAnnounceInterval)
+	}
+	return t.announces.NextAnnounce()
+}
+
+// reannounce announces to the tracker until the context is done: with the
+// started event if this run never announced the torrent, at once or when the
+// interval asked for by a previous run elapses, the completed event when the
+// download completes, and at the interval the tracker asks for otherwise. The
+// tracker is told about the torrent stopping before returning. Failed
+// announces are retried with a backoff.
+func (t *Torrent) reannounce(ctx context.Context) {
+	t.mu.Lock()
+	finished := t.finishedLocked()
+	started := !t.announces.LastAnnounce.IsZero() && !t.restored
+	restored := t.restored
+	t.mu.Unlock()
+
+	event, next := "", t.nextAnnounce()
+	if !started {
+		event = tracker.EventStarted
+		if !restored {
+			next = time.Now()
+		}
+	}
+	backoff := DefaultMinBackoff
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			select {
+			case <-finished:
+				if event == "" {
+					event = tracker.EventCompleted
+				}
+			default:
+			}
+			t.announceStopped(event)
+			return
+		case <-finished:
+			timer.Stop()
+			finished = nil
+			event = tracker.EventCompleted
+		case <-timer.C:
+		}
+
+		// Events are announced to the end even if the context is done
+		// meanwhile, so that they are not sent again when stopping
+		announceCtx, cancel := ctx, context.CancelFunc(func() {})
+		if event != "" {
+			announceCtx, cancel = afterDone(ctx, StoppedTimeout)
+		}
+		_, err := t.Announce(announceCtx, event)
+		cancel()
+		if err == nil {
+			event, next = "", t.nextAnnounce()
+			backoff = DefaultMinBackoff
+			continue
+		}
+		if ctx.Err() == nil {
+			t.logger().Log(logging.Warn, "could not announce, retrying", logging.F("tracker", t.AnnounceURL), logging.F("err", err), logging.F("backoff", backoff))
+		}
+		next = time.Now().Add(backoff)
+		backoff *= 2
+		if backoff > DefaultMaxBackoff {
+			backoff = DefaultMaxBackoff
+		}
+	}
+}
+
+// afterDone returns a context cancelled once delay elapsed after ctx is done
+func afterDone(ctx context.Context, delay time.Duration) (context.Context, context.CancelFunc) {
+	detached, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-detached.Done():
+			return
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-detached.Done():
+		}
+	}()
+	return detached, cancel
+}
+
+// announceStopped tells the tracker the torrent stopped, after the completed
+// event if it is pending. Nothing is sent if the tracker never heard of the
+// torrent.
+func (t *Torrent) announceStopped(pending string) {
+	if pending == tracker.EventStarted {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), StoppedTimeout)
+	defer cancel()
+	if pending == tracker.EventCompleted {
+		_, err := t.Announce(ctx, tracker.EventCompleted)
+		if err != nil {
+			t.logger().Log(logging.Warn, "could not announce", logging.F("tracker", t.AnnounceURL), logging.F("err", err))
+		}
+	}
+	_, err := t.Announce(ctx, tracker.EventStopped)
+	if err != nil {
+		t.logger().Log(logging.Warn, "could not announce", logging.F("tracker", t.AnnounceURL), logging.F("err", err))
+	}
+}
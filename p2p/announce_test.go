@@ -0,0 +1,255 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeTracker returns the URL of a tracker answering with peers, and the
+// queries it received
+func newFakeTracker(t *testing.T, peers []peer.Peer) (string, chan string) {
+	queries := make(chan string, 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		compact := string(peer.Marshal(peers))
+		w.Write([]byte("d8:intervali900e10:tracker id3:abc5:peers" + strconv.Itoa(len(compact)) + ":" + compact + "e"))
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL, queries
+}
+
+func TestAnnounce(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	url, queries := newFakeTracker(t, []peer.Peer{fp.Peer})
+	to.AnnounceURL = url
+	to.Port = 6881
+
+	resp, err := to.Announce(context.Background(), tracker.EventStarted)
+	require.Nil(t, err)
+	assert.Equal(t, 900, resp.Interval)
+	assert.Equal(t, []peer.Peer{fp.Peer}, to.Peers)
+	query := <-queries
+	assert.Contains(t, query, "event=started")
+	assert.Contains(t, query, "left=65536")
+
+	// The tracker id is sent back, and the counters reflect the download
+	_, err = downloadBytes(&to)
+	require.Nil(t, err)
+	query = <-queries
+	assert.Contains(t, query, "event=completed")
+	assert.Contains(t, query, "trackerid=abc")
+	assert.Contains(t, query, "downloaded=65536")
+	assert.Contains(t, query, "left=0")
+}
+
+func TestRestoreTrackerState(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	url, queries := newFakeTracker(t, nil)
+	to.AnnounceURL = url
+
+	// The last known peers are added, and the tracker id is sent back
+	to.RestoreTrackerState(tracker.State{
+		LastAnnounce: time.Unix(1000, 0),
+		TrackerID:    "old",
+		Peers:        []peer.Peer{fp.Peer},
+		Complete:     5,
+		Incomplete:   2,
+	})
+	assert.Equal(t, []peer.Peer{fp.Peer}, to.Peers)
+	stats := to.Stats()
+	assert.Equal(t, 5, stats.Seeders)
+	assert.Equal(t, 2, stats.Leechers)
+	_, err := to.Announce(context.Background(), tracker.EventStarted)
+	require.Nil(t, err)
+	assert.Contains(t, <-queries, "trackerid=old")
+
+	state := to.TrackerState()
+	assert.Equal(t, "abc", state.TrackerID)
+	assert.Equal(t, 0, state.Complete)
+	assert.False(t, state.LastAnnounce.IsZero())
+
+	// The state of this run wins over the one of a previous run
+	to.RestoreTrackerState(tracker.State{TrackerID: "old", Complete: 5})
+	assert.Equal(t, state, to.TrackerState())
+}
+
+func TestReannounceRestored(t *testing.T) {
+	pieceLength := MaxBlockSize
+	_, to := newTestTorrent(4*pieceLength, pieceLength)
+	url, queries := newFakeTracker(t, nil)
+	to.AnnounceURL = url
+
+	// The started event waits for the interval asked for by the previous run
+	to.RestoreTrackerState(tracker.State{LastAnnounce: time.Now(), Interval: 1, TrackerID: "old"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go to.reannounce(ctx)
+
+	select {
+	case <-queries:
+		t.Fatal("announced before the interval")
+	case <-time.After(500 * time.Millisecond):
+	}
+	select {
+	case query := <-queries:
+		assert.Contains(t, query, "event=started")
+		assert.Contains(t, query, "trackerid=old")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no announce")
+	}
+}
+
+func TestAnnounceNoTracker(t *testing.T) {
+	to := Torrent{}
+	_, err := to.Announce(context.Background(), tracker.EventStarted)
+	assert.Equal(t, ErrNoTracker, err)
+}
+
+func TestAnnounceWarning(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compact := string(peer.Marshal([]peer.Peer{fp.Peer}))
+		w.Write([]byte("d8:intervali900e5:peers" + strconv.Itoa(len(compact)) + ":" + compact +
+			"15:warning message12:out of date!e"))
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	to.Logger = logging.Std{Logger: log.New(&out, "", 0), Min: logging.Debug}
+	to.AnnounceURL = ts.URL
+
+	resp, err := to.Announce(context.Background(), tracker.EventStarted)
+	require.Nil(t, err)
+	assert.Equal(t, "out of date!", resp.WarningMessage)
+	assert.Contains(t, out.String(), "out of date!")
+	assert.Equal(t, []peer.Peer{fp.Peer}, to.Peers)
+}
+
+func TestReannounce(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	queries := make(chan string, 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		compact := string(peer.Marshal([]peer.Peer{fp.Peer}))
+		w.Write([]byte("d8:intervali1e12:min intervali1e5:peers" + strconv.Itoa(len(compact)) + ":" + compact + "e"))
+	}))
+	defer ts.Close()
+	to.AnnounceURL = ts.URL
+
+	// The first announce was made before the download started
+	to.Announced(tracker.AnnounceResponse{Interval: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go to.reannounce(ctx)
+
+	select {
+	case query := <-queries:
+		assert.NotContains(t, query, "event=")
+		assert.Contains(t, query, "left=65536")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no re-announce")
+	}
+	assert.Eventually(t, func() bool {
+		to.mu.Lock()
+		defer to.mu.Unlock()
+		return len(to.Peers) > 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNextAnnounce(t *testing.T) {
+	to := Torrent{}
+	assert.WithinDuration(t, time.Now().Add(DefaultAnnounceInterval), to.nextAnnounce(), time.Second)
+
+	to.Announced(tracker.AnnounceResponse{Interval: 60, MinInterval: 300})
+	assert.WithinDuration(t, time.Now().Add(300*time.Second), to.nextAnnounce(), time.Second)
+
+	to.Announced(tracker.AnnounceResponse{})
+	assert.WithinDuration(t, time.Now().Add(DefaultAnnounceInterval), to.nextAnnounce(), time.Second)
+}
+
+func TestAnnounceEvents(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	url, queries := newFakeTracker(t, nil)
+	to.AnnounceURL = url
+	to.Peers = []peer.Peer{fp.Peer}
+
+	// The download waits for the tracker to know about it
+	started := make(chan struct{})
+	var once sync.Once
+	fp.wait = func(int) {
+		once.Do(func() {
+			query := <-queries
+			assert.Contains(t, query, "event=started")
+			close(started)
+		})
+		<-started
+	}
+
+	_, err := downloadBytes(&to)
+	require.Nil(t, err)
+	query := <-queries
+	assert.Contains(t, query, "event=completed")
+	assert.Contains(t, query, "left=0")
+	query = <-queries
+	assert.Contains(t, query, "event=stopped")
+	assert.Contains(t, query, "trackerid=abc")
+}
+
+func TestAnnouncePartialSeed(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(8*pieceLength, pieceLength)
+	to.WebFiles = []WebFile{
+		{Path: []string{"a"}, Length: int64(4 * pieceLength)},
+		{Path: []string{"b"}, Length: int64(4 * pieceLength)},
+	}
+	to.FilePriorities = []Priority{PriorityNormal, PrioritySkip}
+	url, queries := newFakeTracker(t, nil)
+	to.AnnounceURL = url
+
+	// Regular announces are paused only once the files wanted are downloaded
+	_, err := to.Announce(context.Background(), "")
+	require.Nil(t, err)
+	assert.NotContains(t, <-queries, "event=")
+
+	fp := newFakePeer(t, data, pieceLength, allPieces(8))
+	to.AnnounceURL = ""
+	to.Peers = []peer.Peer{fp.Peer}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, to.Download(ctx, &memStore{buf: make([]byte, to.Length)}))
+	assert.True(t, to.partialSeed())
+
+	to.AnnounceURL = url
+	_, err = to.Announce(context.Background(), "")
+	require.Nil(t, err)
+	query := <-queries
+	assert.Contains(t, query, "event=paused")
+	assert.Contains(t, query, "left=65536")
+
+	_, err = to.Announce(context.Background(), tracker.EventStopped)
+	require.Nil(t, err)
+	assert.Contains(t, <-queries, "event=stopped")
+}
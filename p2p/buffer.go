@@ -0,0 +1,109 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Buffer holds a torrent downloading in memory. It can be read while the
+// download is running: reads block until the pieces they cover are verified.
+type Buffer struct {
+	t      *Torrent
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the download returns
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	have []bool
+	err  error
+}
+
+// DownloadBuffer starts downloading the torrent in memory and returns right
+// away. Cancelling the context or closing the buffer interrupts the download.
+func (t *Torrent) DownloadBuffer(ctx context.Context) *Buffer {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &Buffer{
+		t:      t,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		buf:    make([]byte, t.Length),
+		have:   make([]bool, len(t.PieceHashes)),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	t.setStore(b)
+
+	go func() {
+		defer close(b.done)
+		err := t.download(ctx, b.store)
+		b.mu.Lock()
+		b.err = err
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}()
+	return b
+}
+
+func (b *Buffer) store(index int, piece []byte) error {
+	begin, end := b.t.calcultateBoundsForPiece(index)
+	b.mu.Lock()
+	copy(b.buf[begin:end], piece)
+	b.have[index] = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return nil
+}
+
+// ReadAt reads len(p) bytes at offset off, waiting for the pieces they
+// cover to be downloaded. It fails if the download fails first.
+func (b *Buffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(b.buf)) {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > int64(len(b.buf)) {
+		end = int64(len(b.buf))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	first := int(off) / b.t.PieceLength
+	last := int(end-1) / b.t.PieceLength
+	for index := first; index <= last; index++ {
+		for !b.have[index] {
+			if b.err != nil {
+				return 0, b.err
+			}
+			b.cond.Wait()
+		}
+	}
+
+	n := copy(p, b.buf[off:end])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Wait waits for the download to finish and returns the whole file
+func (b *Buffer) Wait() ([]byte, error) {
+	<-b.done
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.buf, nil
+}
+
+// Close interrupts the download if it is still running
+func (b *Buffer) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadBuffer(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength-10, pieceLength)
+	release := make(chan struct{})
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.wait = func(index int) {
+		if index > 0 {
+			<-release
+		}
+	}
+	to.Peers = []peer.Peer{fp.Peer}
+
+	b := to.DownloadBuffer(context.Background())
+	defer b.Close()
+
+	// The first piece is readable while the others are held back
+	p := make([]byte, 100)
+	n, err := b.ReadAt(p, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, data[10:110], p)
+	select {
+	case <-b.done:
+		t.Fatal("download finished before the other pieces were released")
+	default:
+	}
+
+	close(release)
+	p = make([]byte, 20)
+	n, err = b.ReadAt(p, int64(len(data)-10))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, data[len(data)-10:], p[:n])
+
+	buf, err := b.Wait()
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadBufferClose(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	release := make(chan struct{})
+	defer close(release)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.wait = func(index int) {
+		if index > 0 {
+			<-release
+		}
+	}
+	to.Peers = []peer.Peer{fp.Peer}
+
+	b := to.DownloadBuffer(context.Background())
+	_, err := b.ReadAt(make([]byte, 10), 0)
+	require.Nil(t, err)
+
+	b.Close()
+	_, err = b.ReadAt(make([]byte, 10), int64(pieceLength))
+	assert.True(t, errors.Is(err, context.Canceled))
+	_, err = b.Wait()
+	assert.True(t, errors.Is(err, context.Canceled))
+}
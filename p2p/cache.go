@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultReadCacheSize is the memory in bytes of the cache of the pieces
+// read to serve peers
+const DefaultReadCacheSize = 16 * 1024 * 1024
+
+// readCache holds the pieces read last to serve peers, up to size bytes, so
+// that a piece requested by several peers is read once. The least recently
+// used pieces are evicted first. Cached pieces must not be modified.
+type readCache struct {
+	size int64
+
+	mu     sync.Mutex
+	used   int64                 // bytes of the cached pieces
+	lru    *list.List            // cached pieces, most recently used first
+	pieces map[int]*list.Element // elements of lru by piece index
+}
+
+type cachedPiece struct {
+	index int
+	buf   []byte
+}
+
+func newReadCache(size int64) *readCache {
+	return &readCache{
+		size:   size,
+		lru:    list.New(),
+		pieces: make(map[int]*list.Element),
+	}
+}
+
+// get returns the piece at index if cached
+func (c *readCache) get(index int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.pieces[index]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedPiece).buf, true
+}
+
+// put caches the piece at index, evicting the least recently used pieces
+// to make room. Pieces larger than the cache are not cached.
+func (c *readCache) put(index int, buf []byte) {
+	if int64(len(buf)) > c.size {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pieces[index]; ok {
+		return
+	}
+	for c.used+int64(len(buf)) > c.size {
+		oldest := c.lru.Back()
+		piece := c.lru.Remove(oldest).(*cachedPiece)
+		delete(c.pieces, piece.index)
+		c.used -= int64(len(piece.buf))
+	}
+	c.pieces[index] = c.lru.PushFront(&cachedPiece{index, buf})
+	c.used += int64(len(buf))
+}
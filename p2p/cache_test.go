@@ -0,0 +1,39 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCache(t *testing.T) {
+	c := newReadCache(10)
+	c.put(0, []byte{0, 0, 0, 0})
+	c.put(1, []byte{1, 1, 1, 1})
+	buf, ok := c.get(0)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0, 0, 0, 0}, buf)
+
+	// Piece 1 is the least recently used
+	c.put(2, []byte{2, 2, 2, 2})
+	_, ok = c.get(1)
+	assert.False(t, ok)
+	_, ok = c.get(0)
+	assert.True(t, ok)
+	_, ok = c.get(2)
+	assert.True(t, ok)
+	assert.Equal(t, int64(8), c.used)
+
+	// Larger than the cache
+	c.put(3, make([]byte, 11))
+	_, ok = c.get(3)
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.lru.Len())
+
+	// Taking the whole cache
+	c.put(4, make([]byte, 10))
+	_, ok = c.get(4)
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.lru.Len())
+	assert.Equal(t, int64(10), c.used)
+}
@@ -0,0 +1,184 @@
+package p2p
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUploadSlots is the number of peers unchoked at the same time
+	DefaultUploadSlots = 4
+	// RechokeInterval is the time between two choking decisions
+	RechokeInterval = 10 * time.Second
+	// OptimisticUnchokeInterval is the time between two rotations of the
+	// optimistic unchoke slot
+	OptimisticUnchokeInterval = 30 * time.Second
+)
+
+// chokedPeer is a connection the choker unchokes or chokes
+type chokedPeer interface {
+	SendChoke() error
+	SendUnchoke() error
+	DownloadRate() float64
+	UploadRate() float64
+}
+
+// choker unchokes a limited number of interested peers. Peers are unchoked
+// right away while a slot is free. Then, every RechokeInterval, the slots go
+// to the peers we download the fastest from, or upload the fastest to once
+// seeding, except for one optimistic slot given to a random peer and rotated
+// every OptimisticUnchokeInterval, so new peers get a chance to reciprocate.
+type choker struct {
+	mu      sync.Mutex
+	slots   int
+	seeding func() bool
+	// received, if set, returns the rate we download from the peer of a
+	// connection, which may send us its pieces over another connection.
+	// DownloadRate of the connection is used otherwise.
+	received   func(c chokedPeer) float64
+	interests  []chokedPeer // interested peers, in order of arrival
+	unchoked   map[chokedPeer]bool
+	optimistic chokedPeer
+}
+
+func newChoker(slots int, seeding func() bool) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{
+		slots:    slots,
+		seeding:  seeding,
+		unchoked: make(map[chokedPeer]bool),
+	}
+}
+
+// interested unchokes the peer if a slot is free, or leaves it waiting for
+// the next rechoke
+func (ch *choker) interested(c chokedPeer) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.index(c) >= 0 {
+		return
+	}
+	ch.interests = append(ch.interests, c)
+	if len(ch.unchoked) < ch.slots {
+		ch.unchoked[c] = true
+		c.SendUnchoke()
+	}
+}
+
+// remove frees the slot of a peer that lost interest or disconnected,
+// and unchokes the longest waiting peer
+func (ch *choker) remove(c chokedPeer) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	i := ch.index(c)
+	if i < 0 {
+		return
+	}
+	ch.interests = append(ch.interests[:i], ch.interests[i+1:]...)
+	if ch.optimistic == c {
+		ch.optimistic = nil
+	}
+	if !ch.unchoked[c] {
+		return
+	}
+	delete(ch.unchoked, c)
+	c.SendChoke()
+	for _, next := range ch.interests {
+		if !ch.unchoked[next] {
+			ch.unchoked[next] = true
+			next.SendUnchoke()
+			return
+		}
+	}
+}
+
+func (ch *choker) isUnchoked(c chokedPeer) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.unchoked[c]
+}
+
+// index returns the position of an interested peer, or -1
+func (ch *choker) index(c chokedPeer) int {
+	for i, p := range ch.interests {
+		if p == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// rechoke unchokes the fastest interested peers and the optimistic peer, and
+// chokes the others. The optimistic peer is drawn again when rotate is set.
+func (ch *choker) rechoke(rotate bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	rate := chokedPeer.DownloadRate
+	if ch.received != nil {
+		rate = ch.received
+	}
+	if ch.seeding != nil && ch.seeding() {
+		rate = chokedPeer.UploadRate
+	}
+	ranked := make([]chokedPeer, len(ch.interests))
+	copy(ranked, ch.interests)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return rate(ranked[i]) > rate(ranked[j])
+	})
+
+	regular := ch.slots - 1
+	if regular > len(ranked) {
+		regular = len(ranked)
+	}
+	unchoke := make(map[chokedPeer]bool)
+	for _, c := range ranked[:regular] {
+		unchoke[c] = true
+	}
+
+	// The optimistic peer keeps its slot until the next rotation, unless it
+	// earned a regular one
+	others := ranked[regular:]
+	if rotate || ch.optimistic == nil || unchoke[ch.optimistic] {
+		ch.optimistic = nil
+		if len(others) > 0 {
+			ch.optimistic = others[rand.Intn(len(others))]
+		}
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+
+	for c := range ch.unchoked {
+		if !unchoke[c] {
+			delete(ch.unchoked, c)
+			c.SendChoke()
+		}
+	}
+	for _, c := range ranked {
+		if unchoke[c] && !ch.unchoked[c] {
+			ch.unchoked[c] = true
+			c.SendUnchoke()
+		}
+	}
+}
+
+// run rechokes every RechokeInterval until the context is cancelled
+func (ch *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+	rotation := int(OptimisticUnchokeInterval / RechokeInterval)
+	for round := 1; ; round++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ch.rechoke(round%rotation == 0)
+		}
+	}
+}
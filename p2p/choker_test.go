@@ -0,0 +1,123 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeChokedPeer struct {
+	download, upload float64
+	unchoked         bool
+}
+
+func (p *fakeChokedPeer) SendChoke() error {
+	p.unchoked = false
+	return nil
+}
+
+func (p *fakeChokedPeer) SendUnchoke() error {
+	p.unchoked = true
+	return nil
+}
+
+func (p *fakeChokedPeer) DownloadRate() float64 { return p.download }
+func (p *fakeChokedPeer) UploadRate() float64   { return p.upload }
+
+func TestChokerSlots(t *testing.T) {
+	ch := newChoker(2, nil)
+	a, b, c := &fakeChokedPeer{}, &fakeChokedPeer{}, &fakeChokedPeer{}
+	ch.interested(a)
+	ch.interested(b)
+	ch.interested(c)
+	assert.True(t, a.unchoked)
+	assert.True(t, b.unchoked)
+	assert.False(t, c.unchoked)
+
+	// The slot freed goes to the waiting peer
+	ch.remove(a)
+	assert.False(t, a.unchoked)
+	assert.True(t, c.unchoked)
+	assert.True(t, ch.isUnchoked(c))
+}
+
+func TestChokerRechoke(t *testing.T) {
+	tests := map[string]struct {
+		seeding bool
+		fastest int
+	}{
+		"leeching": {false, 2},
+		"seeding":  {true, 1},
+	}
+
+	for name, test := range tests {
+		seeding := test.seeding
+		ch := newChoker(2, func() bool { return seeding })
+		peers := []*fakeChokedPeer{
+			{download: 0, upload: 0},
+			{download: 10, upload: 300},
+			{download: 50, upload: 20},
+		}
+		for _, p := range peers {
+			ch.interested(p)
+		}
+
+		ch.rechoke(false)
+		assert.True(t, peers[test.fastest].unchoked, name)
+		optimistic := ch.optimistic
+		assert.NotNil(t, optimistic, name)
+		assert.NotSame(t, peers[test.fastest], optimistic, name)
+		for _, p := range peers {
+			assert.Equal(t, p == peers[test.fastest] || p == optimistic, p.unchoked, name)
+		}
+
+		// The optimistic peer keeps its slot until the rotation
+		ch.rechoke(false)
+		assert.Same(t, optimistic, ch.optimistic, name)
+		assert.True(t, optimistic.(*fakeChokedPeer).unchoked, name)
+	}
+}
+
+func TestChokerRechokeReceived(t *testing.T) {
+	// The connections report no download, as the peers send us their
+	// pieces over other connections
+	peers := []*fakeChokedPeer{{}, {}, {}}
+	received := map[chokedPeer]float64{peers[0]: 10, peers[1]: 0, peers[2]: 50}
+	ch := newChoker(2, nil)
+	ch.received = func(c chokedPeer) float64 { return received[c] }
+	for _, p := range peers {
+		ch.interested(p)
+	}
+
+	for i := 0; i < 10; i++ {
+		ch.rechoke(true)
+		assert.True(t, peers[2].unchoked)
+		assert.NotSame(t, peers[2], ch.optimistic)
+	}
+}
+
+func TestChokerRotation(t *testing.T) {
+	ch := newChoker(2, nil)
+	fast := &fakeChokedPeer{download: 100}
+	ch.interested(fast)
+	waiting := []*fakeChokedPeer{{}, {}, {}}
+	for _, p := range waiting {
+		ch.interested(p)
+	}
+
+	// Every waiting peer eventually gets the optimistic slot
+	seen := make(map[chokedPeer]bool)
+	for i := 0; i < 100 && len(seen) < len(waiting); i++ {
+		ch.rechoke(true)
+		assert.True(t, fast.unchoked)
+		unchoked := 0
+		for _, p := range waiting {
+			if p.unchoked {
+				unchoked++
+			}
+		}
+		assert.Equal(t, 1, unchoked)
+		seen[ch.optimistic] = true
+	}
+	assert.Len(t, seen, len(waiting))
+}
@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned when downloading or seeding a closed torrent
+var ErrClosed = errors.New("torrent closed")
+
+// syncer is implemented by the stores buffering their writes, such as files
+type syncer interface {
+	Sync() error
+}
+
+// Close stops the downloads and the seeding of the torrent, and waits for
+// them to return. As when their context is done, the requests in flight are
+// cancelled, the peers are told we are not interested anymore, the tracker is
+// told the torrent stopped and the stores are flushed. A closed torrent
+// cannot be downloaded or seeded again.
+func (t *Torrent) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		if t.closing == nil {
+			t.closing = make(chan struct{})
+		}
+		close(t.closing)
+	}
+	t.mu.Unlock()
+	t.runs.Wait()
+	return nil
+}
+
+// track ties an operation to the torrent: Close cancels its context, and
+// waits for it to call release. It fails with ErrClosed once the torrent is
+// closed.
+func (t *Torrent) track(ctx context.Context) (_ context.Context, release func(), _ error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, nil, ErrClosed
+	}
+	if t.closing == nil {
+		t.closing = make(chan struct{})
+	}
+	t.runs.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	closing := t.closing
+	go func() {
+		select {
+		case <-closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		t.runs.Done()
+	}, nil
+}
+
+// flush commits the data written to store, if it buffers its writes
+func flush(store Store) error {
+	if s, ok := store.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
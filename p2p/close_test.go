@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncStore is a store counting its flushes
+type syncStore struct {
+	memStore
+	syncs int
+}
+
+func (s *syncStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	release := make(chan struct{})
+	defer close(release)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.wait = func(int) { <-release }
+	url, queries := newFakeTracker(t, nil)
+	to.AnnounceURL = url
+	to.Peers = []peer.Peer{fp.Peer}
+
+	store := &syncStore{memStore: memStore{buf: make([]byte, to.Length)}}
+	done := make(chan error, 1)
+	go func() {
+		done <- to.Download(context.Background(), store)
+	}()
+	require.Eventually(t, func() bool { return fp.requestCount() > 0 }, time.Second, time.Millisecond)
+
+	assert.Nil(t, to.Close())
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	default:
+		t.Fatal("Close returned before the download")
+	}
+	assert.Equal(t, 1, store.syncs)
+	assert.Contains(t, <-queries, "event=started")
+	assert.Contains(t, <-queries, "event=stopped")
+	assert.Eventually(t, func() bool {
+		fp.mu.Lock()
+		defer fp.mu.Unlock()
+		return fp.cancels > 0 && fp.notInterested == 1
+	}, time.Second, time.Millisecond)
+
+	// A closed torrent stays closed
+	assert.Nil(t, to.Close())
+	assert.Equal(t, ErrClosed, to.Download(context.Background(), store))
+	assert.Equal(t, ErrClosed, to.SeedFile(context.Background(), store))
+}
+
+func TestCloseIdle(t *testing.T) {
+	_, to := newTestTorrent(MaxBlockSize, MaxBlockSize)
+	assert.Nil(t, to.Close())
+	_, err := downloadBytes(&to)
+	assert.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+)
+
+// ConnLimit caps the number of connections with peers. It can be shared by
+// several torrents so that they stay under a common limit.
+type ConnLimit struct {
+	mu     sync.Mutex
+	limit  int
+	active int
+	freed  chan struct{} // closed when a connection is released or the limit raised
+}
+
+// NewConnLimit returns a limit of n connections, 0 for no limit
+func NewConnLimit(n int) *ConnLimit {
+	return &ConnLimit{limit: n, freed: make(chan struct{})}
+}
+
+// SetLimit changes the limit to n connections, 0 for no limit. The
+// connections above a lowered limit are kept until they close.
+func (l *ConnLimit) SetLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	l.signal()
+}
+
+// Limit returns the maximum number of connections, 0 if unlimited
+func (l *ConnLimit) Limit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Active returns the number of connections counted against the limit
+func (l *ConnLimit) Active() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active
+}
+
+// acquire waits for a connection to be allowed, and returns false if the
+// context is done first. A nil limit allows every connection.
+func (l *ConnLimit) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	for {
+		l.mu.Lock()
+		if l.limit <= 0 || l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return true
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// tryAcquire allows a connection if the limit is not reached, without waiting
+func (l *ConnLimit) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > 0 && l.active >= l.limit {
+		return false
+	}
+	l.active++
+	return true
+}
+
+// release counts a connection allowed by acquire or tryAcquire as closed
+func (l *ConnLimit) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.signal()
+}
+
+// signal wakes up the connections waiting for the limit, with mu held
+func (l *ConnLimit) signal() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimit(t *testing.T) {
+	l := NewConnLimit(1)
+	ctx := context.Background()
+	assert.True(t, l.acquire(ctx))
+	assert.False(t, l.tryAcquire())
+	assert.Equal(t, 1, l.Active())
+
+	// A cancelled wait does not take a slot
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, l.acquire(canceled))
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- l.acquire(ctx)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired above the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release()
+	assert.True(t, <-acquired)
+
+	// Raising the limit lets the waiting connections through
+	go func() {
+		acquired <- l.acquire(ctx)
+	}()
+	l.SetLimit(2)
+	assert.True(t, <-acquired)
+	assert.Equal(t, 2, l.Active())
+
+	l.SetLimit(0)
+	assert.True(t, l.tryAcquire())
+	assert.Equal(t, 3, l.Active())
+
+	var unlimited *ConnLimit
+	assert.True(t, unlimited.acquire(ctx))
+	assert.True(t, unlimited.tryAcquire())
+	unlimited.release()
+	assert.Equal(t, 0, unlimited.Limit())
+}
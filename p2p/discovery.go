@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+const (
+	// DefaultMinBackoff is the delay before calling a failing peer source again
+	DefaultMinBackoff = 15 * time.Second
+	// DefaultMaxBackoff is the longest delay between calls to a failing peer source
+	DefaultMaxBackoff = 30 * time.Minute
+)
+
+// PeerSource discovers the peers of a torrent, e.g. a tracker or the DHT
+type PeerSource interface {
+	// Name identifies the source in the peer counts
+	Name() string
+	// Tracker tells if the source is a tracker, the only kind of source
+	// allowed for private torrents
+	Tracker() bool
+	// Discover returns the peers found and how long to wait before calling it again
+	Discover(ctx context.Context) ([]peer.Peer, time.Duration, error)
+}
+
+// Blocklist tells if an IP address must never be connected to
+type Blocklist interface {
+	Blocked(ip net.IP) bool
+}
+
+// Discovery runs the peer sources of a torrent concurrently, and feeds the
+// de-duplicated peers that are not blocked into a download
+type Discovery struct {
+	Sources []PeerSource
+	// Private restricts the discovery to trackers
+	Private bool
+	// Blocklist filters out peers, if set
+	Blocklist Blocklist
+	// MinBackoff and MaxBackoff bound the delay before calling a failing source
+	// again. They default to DefaultMinBackoff and DefaultMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Metrics, if set, receives the latency and failures of the sources
+	// that are trackers
+	Metrics Metrics
+
+	mu     sync.Mutex
+	seen   map[string]bool
+	counts map[string]int
+}
+
+// Run calls the sources until the context is cancelled, passing the new peers to add
+func (d *Discovery) Run(ctx context.Context, add func([]peer.Peer)) {
+	d.run(ctx, add, d.Private)
+}
+
+// run calls the sources, only the trackers if private
+func (d *Discovery) run(ctx context.Context, add func([]peer.Peer), private bool) {
+	var wg sync.WaitGroup
+	for _, s := range d.Sources {
+		if private && !s.Tracker() {
+			continue
+		}
+		wg.Add(1)
+		go func(s PeerSource) {
+			defer wg.Done()
+			d.runSource(ctx, s, add)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// hasTracker tells if one of the sources is a tracker
+func (d *Discovery) hasTracker() bool {
+	if d == nil {
+		return false
+	}
+	for _, s := range d.Sources {
+		if s.Tracker() {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerCounts returns the number of new peers found by each source
+func (d *Discovery) PeerCounts() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make(map[string]int, len(d.counts))
+	for name, count := range d.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+func (d *Discovery) runSource(ctx context.Context, s PeerSource, add func([]peer.Peer)) {
+	minBackoff, maxBackoff := d.MinBackoff, d.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		peers, wait, err := s.Discover(ctx)
+		if s.Tracker() && d.Metrics != nil {
+			d.Metrics.Observe(MetricAnnounceLatency, time.Since(start).Seconds())
+			if err != nil {
+				d.Metrics.AddCounter(MetricTrackerErrors, 1)
+			}
+		}
+		if err != nil {
+			wait = backoff
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		} else {
+			backoff = minBackoff
+			if fresh := d.filter(s.Name(), peers); len(fresh) > 0 {
+				add(fresh)
+			}
+		}
+		if wait <= 0 {
+			wait = minBackoff
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// filter drops the peers already seen or blocked
+func (d *Discovery) filter(name string, peers []peer.Peer) []peer.Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[string]bool)
+		d.counts = make(map[string]int)
+	}
+
+	var fresh []peer.Peer
+	for _, p := range peers {
+		if d.Blocklist != nil && d.Blocklist.Blocked(p.IP) {
+			continue
+		}
+		if d.seen[p.String()] {
+			continue
+		}
+		d.seen[p.String()] = true
+		d.counts[name]++
+		fresh = append(fresh, p)
+	}
+	return fresh
+}
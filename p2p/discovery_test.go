@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource struct {
+	name    string
+	tracker bool
+	peers   []peer.Peer
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *fakeSource) Name() string {
+	return s.name
+}
+
+func (s *fakeSource) Tracker() bool {
+	return s.tracker
+}
+
+func (s *fakeSource) Discover(ctx context.Context) ([]peer.Peer, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return s.peers, time.Hour, nil
+}
+
+func (s *fakeSource) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+type fakeBlocklist []net.IP
+
+func (b fakeBlocklist) Blocked(ip net.IP) bool {
+	for _, blocked := range b {
+		if blocked.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiscoveryRun(t *testing.T) {
+	tests := map[string]struct {
+		private   bool
+		dhtCalled bool
+		output    []peer.Peer
+		counts    map[string]int
+	}{
+		"public torrent consults every source": {
+			private:   false,
+			dhtCalled: true,
+			output: []peer.Peer{
+				{IP: net.IP{1, 1, 1, 1}, Port: 6881},
+				{IP: net.IP{3, 3, 3, 3}, Port: 6881},
+			},
+			counts: map[string]int{"tracker": 1, "dht": 1},
+		},
+		"private torrent only consults the tracker": {
+			private:   true,
+			dhtCalled: false,
+			output: []peer.Peer{
+				{IP: net.IP{1, 1, 1, 1}, Port: 6881},
+			},
+			counts: map[string]int{"tracker": 1},
+		},
+	}
+
+	for _, test := range tests {
+		tracker := &fakeSource{name: "tracker", tracker: true, peers: []peer.Peer{
+			{IP: net.IP{1, 1, 1, 1}, Port: 6881},
+			{IP: net.IP{1, 1, 1, 1}, Port: 6881}, // duplicate
+			{IP: net.IP{2, 2, 2, 2}, Port: 6881}, // blocked
+		}}
+		dht := &fakeSource{name: "dht", peers: []peer.Peer{
+			{IP: net.IP{3, 3, 3, 3}, Port: 6881},
+		}}
+		metrics := newRecordingMetrics()
+		d := Discovery{
+			Sources:   []PeerSource{tracker, dht},
+			Private:   test.private,
+			Blocklist: fakeBlocklist{net.IP{2, 2, 2, 2}},
+			Metrics:   metrics,
+		}
+
+		var mu sync.Mutex
+		var added []peer.Peer
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			d.Run(ctx, func(peers []peer.Peer) {
+				mu.Lock()
+				added = append(added, peers...)
+				mu.Unlock()
+			})
+			close(stopped)
+		}()
+
+		require.Eventually(t, func() bool {
+			return tracker.callCount() == 1 && (!test.dhtCalled || dht.callCount() == 1)
+		}, time.Second, time.Millisecond)
+		cancel()
+		<-stopped
+
+		assert.Equal(t, 1, tracker.callCount())
+		if !test.dhtCalled {
+			assert.Equal(t, 0, dht.callCount())
+		}
+		assert.ElementsMatch(t, test.output, added)
+		assert.Equal(t, test.counts, d.PeerCounts())
+		// Only the tracker is timed
+		assert.Equal(t, map[string]int{MetricAnnounceLatency: 1}, metrics.samples)
+	}
+}
+
+func TestDownloadDiscovery(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(3))
+	blocked := peer.Peer{IP: net.IP{127, 0, 0, 2}, Port: fp.Port}
+
+	var out bytes.Buffer
+	to.Logger = logging.Std{Logger: log.New(&out, "", 0), Min: logging.Debug}
+	to.Discovery = &Discovery{
+		Sources:   []PeerSource{&fakeSource{name: "tracker", tracker: true, peers: []peer.Peer{fp.Peer, blocked}}},
+		Blocklist: fakeBlocklist{blocked.IP},
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.NotContains(t, out.String(), blocked.IP.String())
+	assert.Equal(t, map[string]int{"tracker": 1}, to.Discovery.PeerCounts())
+	assert.Equal(t, map[string]int{"tracker": 1}, to.Stats().PeerSources)
+}
+
+func TestDownloadDiscoveryPrivate(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.Private = true
+	fp := newFakePeer(t, data, pieceLength, allPieces(3))
+	tracker := &fakeSource{name: "tracker", tracker: true, peers: []peer.Peer{fp.Peer}}
+	dht := &fakeSource{name: "dht", peers: []peer.Peer{fp.Peer}}
+	to.Discovery = &Discovery{Sources: []PeerSource{tracker, dht}}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, 1, tracker.callCount())
+	assert.Equal(t, 0, dht.callCount())
+}
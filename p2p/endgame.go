@@ -0,0 +1,55 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/leonhfr/torrent-client/message"
+)
+
+// pieceBlocks holds the blocks of a piece received so far. In endgame mode,
+// it is shared by the peers downloading the piece at the same time: each block
+// is kept from the first peer delivering it, and cancelled with the others.
+type pieceBlocks struct {
+	mu       sync.Mutex
+	buf      []byte
+	received map[int]bool // offsets of the blocks received
+	size     int          // bytes received
+}
+
+func newPieceBlocks(length int) *pieceBlocks {
+	return &pieceBlocks{buf: make([]byte, length), received: make(map[int]bool)}
+}
+
+// receive copies the block of a PIECE message into the piece, unless another
+// peer delivered it first. It reports whether that block completed the piece,
+// which is then never written to again.
+func (b *pieceBlocks) receive(index int, msg *message.Message) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	if b.received[begin] {
+		return false, nil
+	}
+	n, err := msg.ParsePiece(index, b.buf)
+	if err != nil {
+		return false, err
+	}
+	b.received[begin] = true
+	b.size += n
+	return b.size >= len(b.buf), nil
+}
+
+// has tells if the block at offset begin was received
+func (b *pieceBlocks) has(begin int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.received[begin]
+}
+
+// complete tells if every block of the piece was received
+func (b *pieceBlocks) complete() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size >= len(b.buf)
+}
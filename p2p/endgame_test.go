@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceBlocks(t *testing.T) {
+	b := newPieceBlocks(2 * MaxBlockSize)
+	first := message.NewPiece(0, 0, make([]byte, MaxBlockSize))
+	second := message.NewPiece(0, MaxBlockSize, make([]byte, MaxBlockSize))
+
+	complete, err := b.receive(0, first)
+	require.Nil(t, err)
+	assert.False(t, complete)
+	assert.True(t, b.has(0))
+	assert.False(t, b.has(MaxBlockSize))
+
+	// The same block delivered by another peer is dropped
+	complete, err = b.receive(0, first)
+	require.Nil(t, err)
+	assert.False(t, complete)
+
+	complete, err = b.receive(0, second)
+	require.Nil(t, err)
+	assert.True(t, complete)
+	assert.True(t, b.complete())
+
+	complete, err = b.receive(0, second)
+	require.Nil(t, err)
+	assert.False(t, complete)
+}
+
+func TestPickerEndgame(t *testing.T) {
+	work := []*pieceWork{{index: 0, length: 1}, {index: 1, length: 1}}
+	p := newPicker(work, 2, 0)
+	bf := bitfieldOf(0, 1)
+
+	first, firstBlocks, ok := p.pick(bf, noPieces, true)
+	require.True(t, ok)
+	second, _, ok := p.pick(bf, noPieces, true)
+	require.True(t, ok)
+
+	// Nothing is pending anymore: the pieces in flight are shared
+	pw, blocks, ok := p.pick(bf, noPieces, true)
+	require.True(t, ok)
+	assert.Same(t, first, pw)
+	assert.Same(t, firstBlocks, blocks)
+	holding := func(index int) bool { return index == 0 }
+	pw, _, ok = p.pick(bf, holding, false)
+	require.True(t, ok)
+	assert.Same(t, second, pw)
+
+	// A piece is pending again once all its holders put it back
+	p.put(first)
+	assert.Empty(t, p.pending)
+	p.put(first)
+	require.Len(t, p.pending, 1)
+	assert.Equal(t, 0, p.pending[0].index)
+	p.put(first) // put by a holder of the previous attempt
+	assert.Len(t, p.pending, 1)
+
+	// Complete pieces are not shared anymore
+	p.done(1)
+	retry, blocks, ok := p.pick(bf, noPieces, true)
+	require.True(t, ok)
+	_, err := blocks.receive(0, message.NewPiece(0, 0, []byte{1}))
+	require.Nil(t, err)
+	_, _, ok = p.pick(bf, noPieces, false)
+	assert.False(t, ok)
+	p.done(retry.index)
+	assert.Empty(t, p.inFlight)
+}
+
+func TestPickerEndgameThreshold(t *testing.T) {
+	work := []*pieceWork{{index: 0, length: 1}, {index: 1, length: 1}, {index: 2, length: 1}}
+	p := newPicker(work, 2, 0)
+	bf := bitfieldOf(0, 1, 2)
+	for range work {
+		_, _, ok := p.pick(bf, noPieces, false)
+		require.True(t, ok)
+	}
+
+	_, _, ok := p.pick(bf, noPieces, false)
+	assert.False(t, ok)
+	p.done(0)
+	_, _, ok = p.pick(bf, noPieces, false)
+	assert.True(t, ok)
+}
+
+func TestPeerDownloadCancelReceived(t *testing.T) {
+	pieceLength := 4 * MaxBlockSize
+	data, to := newTestTorrent(pieceLength, pieceLength)
+	release := make(chan struct{})
+	defer close(release)
+	fp := newFakePeer(t, data, pieceLength, allPieces(1))
+	fp.wait = func(int) { <-release }
+
+	c, err := client.New(context.Background(), fp.Peer, to.PeerId, to.InfoHash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	c.Choked = false
+	pw := &pieceWork{0, to.PieceHashes[0], pieceLength}
+	blocks := newPieceBlocks(pieceLength)
+	dl := newPeerDownload(c, 0)
+	dl.add(pw, blocks, time.Minute)
+	require.Nil(t, dl.sendRequests())
+
+	// Another peer delivers the first block
+	_, err = blocks.receive(0, message.NewPiece(0, 0, data[:MaxBlockSize]))
+	require.Nil(t, err)
+	require.Nil(t, dl.cancelReceived())
+	assert.Len(t, dl.pieces[0].outstanding, 3)
+	assert.Empty(t, dl.release())
+
+	// Then the rest of the piece
+	for begin := MaxBlockSize; begin < pieceLength; begin += MaxBlockSize {
+		_, err = blocks.receive(0, message.NewPiece(0, begin, data[begin:begin+MaxBlockSize]))
+		require.Nil(t, err)
+	}
+	require.Nil(t, dl.cancelReceived())
+	assert.Empty(t, dl.pieces)
+	assert.Equal(t, []*pieceWork{pw}, dl.release())
+	assert.Len(t, dl.canceled, 4)
+	assert.Eventually(t, func() bool {
+		fp.mu.Lock()
+		defer fp.mu.Unlock()
+		return fp.cancels == 4
+	}, time.Second, time.Millisecond)
+}
+
+func TestDownloadEndgame(t *testing.T) {
+	pieceLength := 4 * MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	// The slow peer would take more than a second to deliver the piece it has
+	slow := newFakePeer(t, data, pieceLength, []int{1})
+	slow.wait = func(int) { time.Sleep(300 * time.Millisecond) }
+	fast := newFakePeer(t, data, pieceLength, allPieces(2))
+	fast.wait = func(int) { time.Sleep(20 * time.Millisecond) }
+	to.Peers = []peer.Peer{slow.Peer, fast.Peer}
+
+	start := time.Now()
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Eventually(t, func() bool {
+		slow.mu.Lock()
+		defer slow.mu.Unlock()
+		return slow.cancels > 0
+	}, time.Second, time.Millisecond)
+}
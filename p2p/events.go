@@ -0,0 +1,56 @@
+package p2p
+
+import "github.com/leonhfr/torrent-client/peer"
+
+// Event is something that happened to a torrent, passed to OnEvent. It is
+// one of PieceCompleted, PeerConnected, PeerDropped, DownloadCompleted and
+// HashFailed.
+type Event interface {
+	isEvent()
+}
+
+// PieceCompleted is a piece verified and stored
+type PieceCompleted struct {
+	Index     int
+	Completed int // pieces stored so far
+	Total     int // pieces of the torrent
+}
+
+// PeerConnected is a peer whose handshake completed
+type PeerConnected struct {
+	Peer peer.Peer
+}
+
+// PeerDropped is a peer disconnected, or that could not be connected to
+type PeerDropped struct {
+	Peer   peer.Peer
+	Reason DisconnectReason
+	Err    error // cause of the disconnection, if any
+}
+
+// DownloadCompleted is the last piece of the torrent stored
+type DownloadCompleted struct {
+	Length int // bytes of the torrent
+}
+
+// HashFailed is a piece that failed the integrity check, and is downloaded
+// again
+type HashFailed struct {
+	Index int
+	// Source is the address of the peer or the URL of the web seed that
+	// delivered the piece, empty if several peers did
+	Source string
+}
+
+func (PieceCompleted) isEvent()    {}
+func (PeerConnected) isEvent()     {}
+func (PeerDropped) isEvent()       {}
+func (DownloadCompleted) isEvent() {}
+func (HashFailed) isEvent()        {}
+
+// emit passes the event to OnEvent, if set
+func (t *Torrent) emit(ev Event) {
+	if t.OnEvent != nil {
+		t.OnEvent(ev)
+	}
+}
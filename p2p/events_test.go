@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.MaxCorruptPieces = -1
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.corrupt = 1
+	to.Peers = []peer.Peer{fp.Peer}
+
+	var mu sync.Mutex
+	var events []Event
+	to.OnEvent = func(ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}
+	_, err := downloadBytes(&to)
+	require.Nil(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.True(t, len(events) > 0)
+	assert.Equal(t, PeerConnected{fp.Peer}, events[0])
+	var completed []PieceCompleted
+	var failed []HashFailed
+	for i, ev := range events {
+		switch ev := ev.(type) {
+		case PieceCompleted:
+			completed = append(completed, ev)
+		case HashFailed:
+			failed = append(failed, ev)
+		case DownloadCompleted:
+			assert.Equal(t, 4*pieceLength, ev.Length)
+			// The download completes with its last piece
+			last, ok := events[i-1].(PieceCompleted)
+			require.True(t, ok)
+			assert.Equal(t, 4, last.Completed)
+		}
+	}
+	require.Len(t, completed, 4)
+	for i, ev := range completed {
+		assert.Equal(t, i+1, ev.Completed)
+		assert.Equal(t, 4, ev.Total)
+	}
+	require.Len(t, failed, 1)
+	assert.Equal(t, fp.String(), failed[0].Source)
+	last, ok := events[len(events)-1].(PeerDropped)
+	require.True(t, ok)
+	assert.Equal(t, fp.Peer, last.Peer)
+	assert.Equal(t, ReasonCompleted, last.Reason)
+}
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// IPPreference selects the IP version dialed first
+type IPPreference int
+
+const (
+	PreferNone IPPreference = iota // PreferNone dials all the peers at once
+	PreferIPv4                     // PreferIPv4 dials IPv4 peers first
+	PreferIPv6                     // PreferIPv6 dials IPv6 peers first
+)
+
+// FallbackDelay is how long peers of the other IP version wait before being
+// dialed, so that a peer known by both addresses is reached on the preferred one
+const FallbackDelay = 300 * time.Millisecond
+
+var (
+	globalIPv6Once sync.Once
+	globalIPv6     bool
+)
+
+// hasGlobalIPv6 reports whether the host has an IPv6 address beyond loopback
+// and link-local ones
+func hasGlobalIPv6() bool {
+	globalIPv6Once.Do(func() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() {
+				globalIPv6 = true
+				return
+			}
+		}
+	})
+	return globalIPv6
+}
+
+// reachable reports whether we can connect to the peer with our connectivity.
+// Dialing IPv6 peers without IPv6 connectivity would only wait for timeouts.
+func reachable(p peer.Peer) bool {
+	if p.IP.To4() != nil || p.IP.IsLoopback() {
+		return true
+	}
+	return hasGlobalIPv6()
+}
+
+// preferred reports whether the peer is of the preferred IP version
+func (pref IPPreference) preferred(p peer.Peer) bool {
+	switch pref {
+	case PreferIPv4:
+		return p.IP.To4() != nil
+	case PreferIPv6:
+		return p.IP.To4() == nil
+	}
+	return true
+}
+
+// dialDelay returns how long to wait before dialing each peer: peers of the
+// other IP version wait FallbackDelay if any preferred peer is dialed
+func (pref IPPreference) dialDelay(peers []peer.Peer) []time.Duration {
+	delays := make([]time.Duration, len(peers))
+	anyPreferred := false
+	for _, p := range peers {
+		if pref.preferred(p) {
+			anyPreferred = true
+			break
+		}
+	}
+	if !anyPreferred {
+		return delays
+	}
+	for i, p := range peers {
+		if !pref.preferred(p) {
+			delays[i] = FallbackDelay
+		}
+	}
+	return delays
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialDelay(t *testing.T) {
+	v4 := peer.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}
+	v6 := peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+
+	tests := map[string]struct {
+		pref   IPPreference
+		peers  []peer.Peer
+		output []time.Duration
+	}{
+		"no preference": {
+			pref:   PreferNone,
+			peers:  []peer.Peer{v4, v6},
+			output: []time.Duration{0, 0},
+		},
+		"prefer IPv6": {
+			pref:   PreferIPv6,
+			peers:  []peer.Peer{v4, v6},
+			output: []time.Duration{FallbackDelay, 0},
+		},
+		"prefer IPv4": {
+			pref:   PreferIPv4,
+			peers:  []peer.Peer{v4, v6},
+			output: []time.Duration{0, FallbackDelay},
+		},
+		"only the other version": {
+			pref:   PreferIPv6,
+			peers:  []peer.Peer{v4},
+			output: []time.Duration{0},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, test.pref.dialDelay(test.peers))
+	}
+}
+
+func TestReachable(t *testing.T) {
+	assert.True(t, reachable(peer.Peer{IP: net.IP{192, 0, 2, 1}}))
+	assert.True(t, reachable(peer.Peer{IP: net.IPv6loopback}))
+	assert.Equal(t, hasGlobalIPv6(), reachable(peer.Peer{IP: net.ParseIP("2001:db8::1")}))
+}
+
+func TestDownloadIPPreference(t *testing.T) {
+	pieceLength := MaxBlockSize
+	for _, pref := range []IPPreference{PreferIPv4, PreferIPv6} {
+		data, to := newTestTorrent(4*pieceLength, pieceLength)
+		fp := newFakePeer(t, data, pieceLength, allPieces(4))
+		ln, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			t.Skip("no IPv6 loopback:", err)
+		}
+		ln.Close()
+		v6 := fp.listen(t, "[::1]:0")
+
+		var out bytes.Buffer
+		to.Logger = logging.Std{Logger: log.New(&out, "", 0), Min: logging.Debug}
+		to.IPPreference = pref
+		to.Peers = []peer.Peer{fp.Peer, v6}
+		buf, err := downloadBytes(&to)
+		require.Nil(t, err)
+		assert.Equal(t, data, buf)
+
+		preferred, other := fp.Peer, v6
+		if pref == PreferIPv6 {
+			preferred, other = other, preferred
+		}
+		assert.Contains(t, out.String(), "completed handshake peer="+preferred.String())
+		assert.NotContains(t, out.String(), "completed handshake peer="+other.String())
+	}
+}
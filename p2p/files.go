@@ -0,0 +1,94 @@
+package p2p
+
+import "io"
+
+// FileStore is one of the files a torrent is stored in, holding Length bytes
+// of the torrent data
+type FileStore struct {
+	Store
+	Length int64
+}
+
+// PaddingStore holds a padding file of a multi-file torrent (BEP 47), which
+// aligns the next file on a piece boundary. It reads as zeros and discards
+// what is written to it, so that padding files are never stored.
+type PaddingStore struct{}
+
+// ReadAt fills p with zeros
+func (PaddingStore) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// WriteAt discards p
+func (PaddingStore) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+// MultiStore stores the data of a multi-file torrent in its files, which
+// follow each other in the torrent data. Pieces spanning file boundaries are
+// split between the files.
+type MultiStore []FileStore
+
+// span calls fn for each part of [off, off+n) held by a file, with the offset
+// in that file and the range of the part relative to off
+func (m MultiStore) span(off int64, n int, fn func(f FileStore, fileOff int64, begin, end int) (int, error)) (int, error) {
+	done := 0
+	start := int64(0)
+	for _, f := range m {
+		if done == n {
+			break
+		}
+		fileEnd := start + f.Length
+		pos := off + int64(done)
+		if f.Length > 0 && pos >= start && pos < fileEnd {
+			end := n
+			if rest := fileEnd - pos; int64(end-done) > rest {
+				end = done + int(rest)
+			}
+			written, err := fn(f, pos-start, done, end)
+			done += written
+			if err != nil {
+				return done, err
+			}
+		}
+		start = fileEnd
+	}
+	if done < n {
+		return done, io.EOF
+	}
+	return done, nil
+}
+
+// WriteAt writes p at the offset off of the torrent data
+func (m MultiStore) WriteAt(p []byte, off int64) (int, error) {
+	return m.span(off, len(p), func(f FileStore, fileOff int64, begin, end int) (int, error) {
+		return f.WriteAt(p[begin:end], fileOff)
+	})
+}
+
+// Sync flushes the files buffering their writes
+func (m MultiStore) Sync() error {
+	var err error
+	for _, f := range m {
+		if s, ok := f.Store.(syncer); ok {
+			if syncErr := s.Sync(); err == nil {
+				err = syncErr
+			}
+		}
+	}
+	return err
+}
+
+// ReadAt reads len(p) bytes at the offset off of the torrent data
+func (m MultiStore) ReadAt(p []byte, off int64) (int, error) {
+	return m.span(off, len(p), func(f FileStore, fileOff int64, begin, end int) (int, error) {
+		n, err := f.ReadAt(p[begin:end], fileOff)
+		if err == io.EOF && n == end-begin {
+			err = nil
+		}
+		return n, err
+	})
+}
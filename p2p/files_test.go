@@ -0,0 +1,123 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMultiStore(lengths ...int) (MultiStore, []*memStore) {
+	var m MultiStore
+	var stores []*memStore
+	for _, length := range lengths {
+		s := &memStore{buf: make([]byte, length)}
+		stores = append(stores, s)
+		m = append(m, FileStore{Store: s, Length: int64(length)})
+	}
+	return m, stores
+}
+
+func TestMultiStoreWriteAt(t *testing.T) {
+	tests := map[string]struct {
+		input    []byte
+		offset   int64
+		expected [][]byte
+		n        int
+		err      error
+	}{
+		"within a file": {
+			input:    []byte{1, 2},
+			offset:   4,
+			expected: [][]byte{{0, 0, 0}, {}, {0, 1, 2, 0, 0}, {0, 0}},
+			n:        2,
+		},
+		"across files": {
+			input:    []byte{1, 2, 3, 4, 5, 6, 7},
+			offset:   2,
+			expected: [][]byte{{0, 0, 1}, {}, {2, 3, 4, 5, 6}, {7, 0}},
+			n:        7,
+		},
+		"past the end": {
+			input:    []byte{1, 2, 3},
+			offset:   9,
+			expected: [][]byte{{0, 0, 0}, {}, {0, 0, 0, 0, 0}, {0, 1}},
+			n:        1,
+			err:      io.EOF,
+		},
+	}
+
+	for name, test := range tests {
+		m, stores := newMultiStore(3, 0, 5, 2)
+		n, err := m.WriteAt(test.input, test.offset)
+		assert.Equal(t, test.err, err, name)
+		assert.Equal(t, test.n, n, name)
+		for i, s := range stores {
+			assert.Equal(t, test.expected[i], s.buf, name)
+		}
+	}
+}
+
+func TestMultiStoreReadAt(t *testing.T) {
+	m, stores := newMultiStore(3, 0, 5, 2)
+	copy(stores[0].buf, []byte{1, 2, 3})
+	copy(stores[2].buf, []byte{4, 5, 6, 7, 8})
+	copy(stores[3].buf, []byte{9, 10})
+
+	buf := make([]byte, 6)
+	n, err := m.ReadAt(buf, 1)
+	require.Nil(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, []byte{2, 3, 4, 5, 6, 7}, buf)
+
+	n, err = m.ReadAt(buf, 7)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []byte{8, 9, 10}, buf[:n])
+}
+
+func TestPaddingStore(t *testing.T) {
+	m, stores := newMultiStore(2, 3, 2)
+	m[1].Store = PaddingStore{}
+
+	n, err := m.WriteAt([]byte{1, 2, 3, 4, 5, 6, 7}, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte{0, 0, 0}, stores[1].buf)
+
+	buf := []byte{9, 9, 9, 9, 9, 9, 9}
+	n, err = m.ReadAt(buf, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte{1, 2, 0, 0, 0, 6, 7}, buf)
+}
+
+func TestMultiStoreSync(t *testing.T) {
+	synced := &syncStore{}
+	m := MultiStore{{Store: &memStore{}}, {Store: synced}}
+	assert.Nil(t, m.Sync())
+	assert.Equal(t, 1, synced.syncs)
+}
+
+func TestDownloadMultiStore(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength-10, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(3))
+	to.Peers = []peer.Peer{fp.Peer}
+	to.VerifyOnWrite = true
+
+	// The first piece spans three files
+	lengths := []int{100, 0, pieceLength, len(data) - pieceLength - 100}
+	m, stores := newMultiStore(lengths...)
+	err := to.Download(context.Background(), m)
+	require.Nil(t, err)
+
+	begin := 0
+	for i, s := range stores {
+		assert.Equal(t, data[begin:begin+lengths[i]], s.buf)
+		begin += lengths[i]
+	}
+}
@@ -0,0 +1,61 @@
+package p2p
+
+import (
+	"errors"
+	"runtime"
+)
+
+// errHashPoolClosed is passed to the callback of pieces not verified because
+// the pool was closed
+var errHashPoolClosed = errors.New("hash pool closed")
+
+type hashJob struct {
+	pw   *pieceWork
+	buf  []byte
+	done func(error)
+}
+
+// hashPool verifies pieces off the download path, on a bounded number of goroutines
+type hashPool struct {
+	jobs chan hashJob
+	stop chan struct{}
+}
+
+func newHashPool(workers int) *hashPool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	p := &hashPool{
+		jobs: make(chan hashJob),
+		stop: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+func (p *hashPool) run() {
+	for {
+		select {
+		case job := <-p.jobs:
+			job.done(checkIntegrity(job.pw, job.buf))
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// verify checks the integrity of a piece and calls done with the result.
+// It blocks while all the workers are busy.
+func (p *hashPool) verify(pw *pieceWork, buf []byte, done func(error)) {
+	select {
+	case p.jobs <- hashJob{pw, buf, done}:
+	case <-p.stop:
+		done(errHashPoolClosed)
+	}
+}
+
+func (p *hashPool) close() {
+	close(p.stop)
+}
@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPoolVerify(t *testing.T) {
+	buf := []byte("piece data")
+	tests := map[string]struct {
+		hash  [20]byte
+		fails bool
+	}{
+		"valid piece":     {hash: sha1.Sum(buf), fails: false},
+		"corrupted piece": {hash: sha1.Sum([]byte("other data")), fails: true},
+	}
+
+	pool := newHashPool(2)
+	defer pool.close()
+	for _, test := range tests {
+		errs := make(chan error, 1)
+		pool.verify(&pieceWork{0, test.hash, len(buf)}, buf, func(err error) { errs <- err })
+		err := <-errs
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestHashPoolWorkers(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		pool := newHashPool(workers)
+		var running, maxRunning int32
+		release := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 2*workers+1; i++ {
+			wg.Add(1)
+			go pool.verify(&pieceWork{}, nil, func(error) {
+				defer wg.Done()
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+			})
+		}
+
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt32(&running) == int32(workers)
+		}, time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		pool.close()
+		assert.Equal(t, int32(workers), maxRunning)
+	}
+}
+
+func BenchmarkHashPool(b *testing.B) {
+	const pieceLength = 1024 * 1024
+	buf := make([]byte, pieceLength)
+	pw := &pieceWork{0, sha1.Sum(buf), pieceLength}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pool := newHashPool(workers)
+			defer pool.close()
+			b.SetBytes(pieceLength)
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			wg.Add(b.N)
+			for i := 0; i < b.N; i++ {
+				go pool.verify(pw, buf, func(error) { wg.Done() })
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package p2p
+
+import (
+	"net"
+	"sort"
+)
+
+// PieceFailure records the failed integrity checks of a piece
+type PieceFailure struct {
+	Index int
+	Peers map[string]int // number of failures by peer IP
+}
+
+// Systematic tells if several peers delivered the piece corrupted, which
+// hints at a bad hash in the torrent rather than at a bad peer
+func (pf PieceFailure) Systematic() bool {
+	return len(pf.Peers) > 1
+}
+
+// PieceFailures returns the pieces that failed an integrity check, by index
+func (t *Torrent) PieceFailures() []PieceFailure {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failures := make([]PieceFailure, 0, len(t.failures))
+	for index, peers := range t.failures {
+		pf := PieceFailure{Index: index, Peers: make(map[string]int, len(peers))}
+		for ip, count := range peers {
+			pf.Peers[ip] = count
+		}
+		failures = append(failures, pf)
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Index < failures[j].Index })
+	return failures
+}
+
+// corrupted records that a peer delivered a piece failing the integrity
+// check. It returns true once the peer has to be banned, that is when it
+// failed MaxCorruptPieces checks on pieces no other peer failed.
+func (t *Torrent) corrupted(index int, ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failures == nil {
+		t.failures = make(map[int]map[string]int)
+	}
+	if t.failures[index] == nil {
+		t.failures[index] = make(map[string]int)
+	}
+	t.failures[index][ip.String()]++
+
+	count := 0
+	for _, peers := range t.failures {
+		if len(peers) == 1 {
+			count += peers[ip.String()]
+		}
+	}
+	max := t.MaxCorruptPieces
+	if max == 0 {
+		max = DefaultMaxCorruptPieces
+	}
+	return max > 0 && count >= max
+}
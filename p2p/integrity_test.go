@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrupted(t *testing.T) {
+	a, b := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	type failure struct {
+		index int
+		ip    net.IP
+	}
+	tests := map[string]struct {
+		failures   []failure
+		banned     []bool
+		systematic []bool
+	}{
+		"different peers each fail one piece": {
+			failures:   []failure{{0, a}, {1, b}},
+			banned:     []bool{false, false},
+			systematic: []bool{false, false},
+		},
+		"one peer fails repeatedly": {
+			failures:   []failure{{0, a}, {1, b}, {0, a}},
+			banned:     []bool{false, false, true},
+			systematic: []bool{false, false},
+		},
+		"different peers fail the same piece": {
+			failures:   []failure{{0, a}, {0, b}, {0, a}},
+			banned:     []bool{false, false, false},
+			systematic: []bool{true},
+		},
+	}
+
+	for name, test := range tests {
+		to := Torrent{}
+		for i, f := range test.failures {
+			assert.Equal(t, test.banned[i], to.corrupted(f.index, f.ip), name)
+		}
+		failures := to.PieceFailures()
+		require.Len(t, failures, len(test.systematic), name)
+		for i, pf := range failures {
+			assert.Equal(t, test.systematic[i], pf.Systematic(), name)
+		}
+	}
+}
+
+func TestDownloadBansCorruptingPeer(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+
+	var out bytes.Buffer
+	to.Logger = logging.Std{Logger: log.New(&out, "", 0), Min: logging.Debug}
+
+	// The corrupting peer is alone until it is banned
+	release := make(chan struct{})
+	var once sync.Once
+	to.OnPeerDisconnect = func(p peer.Peer, reason DisconnectReason, err error) {
+		if reason == ReasonBanned {
+			once.Do(func() { close(release) })
+		}
+	}
+	corrupting := newFakePeer(t, data, pieceLength, allPieces(4))
+	corrupting.corrupt = DefaultMaxCorruptPieces
+	corrupting.Peer = corrupting.listen(t, "127.0.0.2:0")
+	good := newFakePeer(t, data, pieceLength, allPieces(4))
+	good.wait = func(int) { <-release }
+	to.Peers = []peer.Peer{corrupting.Peer, good.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.True(t, to.isBanned(corrupting.IP))
+	assert.False(t, to.isBanned(good.IP))
+	assert.Contains(t, out.String(), "banning peer: delivered too many corrupt pieces peer="+corrupting.String())
+	failures := 0
+	for _, pf := range to.PieceFailures() {
+		assert.False(t, pf.Systematic())
+		failures += pf.Peers[corrupting.IP.String()]
+	}
+	assert.Equal(t, DefaultMaxCorruptPieces, failures)
+}
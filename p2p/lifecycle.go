@@ -0,0 +1,31 @@
+package p2p
+
+import "github.com/leonhfr/torrent-client/peer"
+
+// DisconnectReason tells why a peer was disconnected
+type DisconnectReason string
+
+const (
+	ReasonHandshakeFailed DisconnectReason = "handshake failed" // ReasonHandshakeFailed is a failed connection setup
+	ReasonDuplicate       DisconnectReason = "duplicate"        // ReasonDuplicate is a peer already connected on another address
+	ReasonBanned          DisconnectReason = "banned"           // ReasonBanned is a peer banned for misbehaving
+	ReasonIdle            DisconnectReason = "idle"             // ReasonIdle is a peer silent for longer than IdleTimeout
+	ReasonCompleted       DisconnectReason = "completed"        // ReasonCompleted is a peer the download no longer needs
+	ReasonError           DisconnectReason = "error"            // ReasonError is any other failure
+)
+
+func (t *Torrent) peerConnected(p peer.Peer) {
+	t.metrics().AddCounter(MetricPeerConnects, 1)
+	if t.OnPeerConnect != nil {
+		t.OnPeerConnect(p)
+	}
+	t.emit(PeerConnected{p})
+}
+
+func (t *Torrent) peerDisconnected(p peer.Peer, reason DisconnectReason, err error) {
+	t.metrics().AddCounter(MetricPeerDisconnects, 1)
+	if t.OnPeerDisconnect != nil {
+		t.OnPeerDisconnect(p, reason, err)
+	}
+	t.emit(PeerDropped{p, reason, err})
+}
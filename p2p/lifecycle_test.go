@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerLifecycleCallbacks(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.IdleTimeout = 50 * time.Millisecond
+	to.EndgameThreshold = -1 // the active peer would complete the pieces of the idle one
+
+	release := make(chan struct{})
+	defer close(release)
+	idle := newFakePeer(t, data, pieceLength, allPieces(4))
+	idle.wait = func(int) { <-release } // never answers requests
+	active := newFakePeer(t, data, pieceLength, allPieces(4))
+	active.wait = func(int) { time.Sleep(10 * time.Millisecond) }
+	to.Peers = []peer.Peer{idle.Peer, active.Peer}
+
+	var mu sync.Mutex
+	connected := make(map[string]bool)
+	reasons := make(map[string]DisconnectReason)
+	errs := make(map[string]error)
+	to.OnPeerConnect = func(p peer.Peer) {
+		mu.Lock()
+		defer mu.Unlock()
+		connected[p.String()] = true
+	}
+	// The idle peer is dialed again, its first disconnection is checked
+	to.OnPeerDisconnect = func(p peer.Peer, reason DisconnectReason, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := reasons[p.String()]; ok {
+			return
+		}
+		reasons[p.String()] = reason
+		errs[p.String()] = err
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, connected[idle.String()])
+	assert.Equal(t, ReasonIdle, reasons[idle.String()])
+	assert.True(t, errors.Is(errs[idle.String()], ErrIdle))
+	assert.True(t, connected[active.String()])
+	assert.Equal(t, ReasonCompleted, reasons[active.String()])
+}
+
+func TestPeerLifecycleHandshakeFailed(t *testing.T) {
+	_, to := newTestTorrent(MaxBlockSize, MaxBlockSize)
+	to.Logger = logging.Discard
+	unreachable := unreachablePeer(t)
+	to.Peers = []peer.Peer{unreachable}
+
+	var reason DisconnectReason
+	to.OnPeerConnect = func(p peer.Peer) { t.Error("unexpected connection to", p) }
+	to.OnPeerDisconnect = func(p peer.Peer, r DisconnectReason, err error) {
+		reason = r
+		assert.NotNil(t, err)
+	}
+	_, err := downloadBytes(&to)
+	assert.True(t, errors.Is(err, ErrUnsatisfiable))
+	assert.Equal(t, ReasonHandshakeFailed, reason)
+}
+
+func TestDownloadSnubbedPeer(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.SnubTimeout = 50 * time.Millisecond
+	to.EndgameThreshold = -1 // the pieces of the snubbing peer are handed over rather than duplicated
+
+	release := make(chan struct{})
+	defer close(release)
+	snubbing := newFakePeer(t, data, pieceLength, allPieces(4))
+	snubbing.wait = func(int) { <-release } // never answers requests
+	good := newFakePeer(t, data, pieceLength, allPieces(4))
+	good.wait = func(int) { time.Sleep(10 * time.Millisecond) }
+	to.Peers = []peer.Peer{snubbing.Peer, good.Peer}
+
+	var mu sync.Mutex
+	reasons := make(map[string]DisconnectReason)
+	to.OnPeerDisconnect = func(p peer.Peer, reason DisconnectReason, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[p.String()] = reason
+	}
+
+	start := time.Now()
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	// Way before the pieces of the snubbing peer would time out
+	assert.Less(t, int64(time.Since(start)), int64(MinPieceTimeout/2))
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The snubbing peer stays connected until the download completes
+	assert.Equal(t, ReasonCompleted, reasons[snubbing.String()])
+}
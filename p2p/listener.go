@@ -0,0 +1,200 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/portmap"
+)
+
+// ErrAlreadyAttached is returned when a torrent is served by a PeerListener
+// already serving a torrent with the same info hash
+var ErrAlreadyAttached = errors.New("torrent already attached to the listener")
+
+// PeerListener accepts the connections initiated by remote peers on a port
+// shared by several torrents, and hands each peer to the torrent whose info
+// hash it asks for. Torrents are served through it when it is their Incoming
+// listener.
+type PeerListener struct {
+	// Encryption is the encryption policy of the incoming connections
+	Encryption client.EncryptionPolicy
+	// Logger logs the connections refused. Defaults to logging.Default.
+	Logger logging.Logger
+	// Blocklist, if set, holds the addresses of the peers refused before
+	// their handshake
+	Blocklist Blocklist
+
+	ln       net.Listener
+	mu       sync.Mutex
+	torrents map[[20]byte]func(*client.Incoming) // handlers of the peers by info hash
+	mapped   uint16                              // port mapped on the gateway, if any
+}
+
+// Listen listens for IPv4 and IPv6 peers on the TCP port, or on a port
+// chosen by the system if it is 0
+func Listen(port uint16) (*PeerListener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return NewPeerListener(ln), nil
+}
+
+// NewPeerListener accepts peers on ln
+func NewPeerListener(ln net.Listener) *PeerListener {
+	return &PeerListener{
+		ln:       ln,
+		torrents: make(map[[20]byte]func(*client.Incoming)),
+	}
+}
+
+// Addr returns the address listened on
+func (l *PeerListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Port returns the port announced to the trackers: the port mapped on the
+// gateway by MapPort, or else the port listened on
+func (l *PeerListener) Port() uint16 {
+	l.mu.Lock()
+	mapped := l.mapped
+	l.mu.Unlock()
+	if mapped != 0 {
+		return mapped
+	}
+	return l.listenPort()
+}
+
+// listenPort returns the port listened on
+func (l *PeerListener) listenPort() uint16 {
+	if addr, ok := l.ln.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+// MapPort maps the port listened on with the gateway of the local network,
+// found with portmap.Discover, so that peers behind a NAT can connect. The
+// mapping is renewed until ctx is done, and then deleted before returning.
+// The port mapped is announced meanwhile.
+func (l *PeerListener) MapPort(ctx context.Context) error {
+	m, err := portmap.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	pm := portmap.PortMapping{
+		Mapper: m,
+		Port:   l.listenPort(),
+		Mapped: l.setMapped,
+		Logger: l.logger(),
+	}
+	defer l.setMapped(0)
+	return pm.Run(ctx)
+}
+
+// setMapped sets the port mapped on the gateway, 0 once unmapped
+func (l *PeerListener) setMapped(port uint16) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mapped = port
+}
+
+// Close stops accepting peers
+func (l *PeerListener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *PeerListener) logger() logging.Logger {
+	if l.Logger == nil {
+		return logging.Default
+	}
+	return l.Logger
+}
+
+// Serve accepts peers and hands them to the torrents attached until the
+// context is done or the listener is closed
+func (l *PeerListener) Serve(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.ln.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go l.dispatch(ctx, conn)
+	}
+}
+
+// dispatch reads the handshake of a peer and hands it to the torrent it asks
+// for. The connection is closed if no torrent attached has its info hash.
+func (l *PeerListener) dispatch(ctx context.Context, conn net.Conn) {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && l.Blocklist != nil && l.Blocklist.Blocked(addr.IP) {
+		l.logger().Log(logging.Debug, "refused blocked peer", logging.F("peer", addr))
+		conn.Close()
+		return
+	}
+	l.mu.Lock()
+	infoHashes := make([][20]byte, 0, len(l.torrents))
+	for infoHash := range l.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	l.mu.Unlock()
+
+	in, err := client.ReadHandshake(ctx, conn, infoHashes, client.WithEncryption(l.Encryption))
+	if err != nil {
+		l.logger().Log(logging.Debug, "could not accept connection", logging.F("err", err))
+		return
+	}
+
+	// The torrent may have been detached during the handshake
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	handle, ok := l.torrents[in.InfoHash()]
+	if !ok {
+		in.Close()
+		return
+	}
+	handle(in)
+}
+
+// Attached tells whether a torrent is served the peers asking for infoHash
+func (l *PeerListener) Attached(infoHash [20]byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.torrents[infoHash]
+	return ok
+}
+
+// attach hands the peers asking for the info hash to handle until the
+// context is done. handle must not block.
+func (l *PeerListener) attach(ctx context.Context, infoHash [20]byte, handle func(*client.Incoming)) error {
+	l.mu.Lock()
+	if _, ok := l.torrents[infoHash]; ok {
+		l.mu.Unlock()
+		return ErrAlreadyAttached
+	}
+	l.torrents[infoHash] = handle
+	l.mu.Unlock()
+
+	<-ctx.Done()
+	l.mu.Lock()
+	delete(l.torrents, infoHash)
+	l.mu.Unlock()
+	return nil
+}
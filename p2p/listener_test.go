@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/blocklist"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startPeerListener(t *testing.T) (*PeerListener, peer.Peer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l := NewPeerListener(ln)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go l.Serve(ctx)
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return l, peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// waitAttached waits for the torrents to be attached to the listener
+func waitAttached(t *testing.T, l *PeerListener, n int) {
+	assert.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.torrents) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestPeerListener(t *testing.T) {
+	l, p := startPeerListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Both torrents are seeded on the same port
+	lengths := []int{3 * MaxBlockSize, 5*MaxBlockSize - 9}
+	seeded := make([][]byte, len(lengths))
+	for i, length := range lengths {
+		data, seeder := newTestTorrent(length, MaxBlockSize)
+		seeder.InfoHash = [20]byte{byte(i + 1)}
+		seeder.Incoming = l
+		go seeder.SeedFile(ctx, bytes.NewReader(data))
+		seeded[i] = data
+	}
+	waitAttached(t, l, len(lengths))
+
+	for i, length := range lengths {
+		_, leecher := newTestTorrent(length, MaxBlockSize)
+		leecher.InfoHash = [20]byte{byte(i + 1)}
+		leecher.Peers = []peer.Peer{p}
+		buf, err := downloadBytes(&leecher)
+		require.Nil(t, err)
+		assert.Equal(t, seeded[i], buf)
+	}
+
+	// The torrents are detached once they stop seeding
+	cancel()
+	waitAttached(t, l, 0)
+}
+
+func TestPeerListenerUnknownTorrent(t *testing.T) {
+	_, p := startPeerListener(t)
+	_, leecher := newTestTorrent(2*MaxBlockSize, MaxBlockSize)
+	leecher.Peers = []peer.Peer{p}
+	_, err := downloadBytes(&leecher)
+	assert.NotNil(t, err)
+}
+
+func TestPeerListenerBlocklist(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	l := NewPeerListener(ln)
+	l.Blocklist, err = blocklist.New(blocklist.Range{First: p.IP, Last: p.IP})
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Serve(ctx)
+
+	data, seeder := newTestTorrent(2*MaxBlockSize, MaxBlockSize)
+	seeder.Incoming = l
+	go seeder.SeedFile(ctx, bytes.NewReader(data))
+	waitAttached(t, l, 1)
+
+	_, leecher := newTestTorrent(2*MaxBlockSize, MaxBlockSize)
+	leecher.Peers = []peer.Peer{p}
+	_, err = downloadBytes(&leecher)
+	assert.NotNil(t, err)
+}
+
+func TestPeerListenerAlreadyAttached(t *testing.T) {
+	l, _ := startPeerListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data, seeder := newTestTorrent(2*MaxBlockSize, MaxBlockSize)
+	seeder.Incoming = l
+	go seeder.SeedFile(ctx, bytes.NewReader(data))
+	waitAttached(t, l, 1)
+
+	_, other := newTestTorrent(2*MaxBlockSize, MaxBlockSize)
+	other.Incoming = l
+	err := other.SeedFile(ctx, bytes.NewReader(data))
+	assert.Equal(t, ErrAlreadyAttached, err)
+}
+
+func TestPeerListenerAnnouncePort(t *testing.T) {
+	l, _ := startPeerListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data, seeder := newTestTorrent(2*MaxBlockSize, MaxBlockSize)
+	url, queries := newFakeTracker(t, nil)
+	seeder.AnnounceURL = url
+	seeder.Port = 6881
+	seeder.Incoming = l
+	go seeder.SeedFile(ctx, bytes.NewReader(data))
+
+	query := <-queries
+	assert.Contains(t, query, "port="+strconv.Itoa(int(l.Port())))
+}
+
+func TestPeerListenerMappedPort(t *testing.T) {
+	l, _ := startPeerListener(t)
+	listened := uint16(l.Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, listened, l.Port())
+
+	// The port mapped on the gateway is announced instead
+	l.setMapped(listened + 1)
+	assert.Equal(t, listened+1, l.Port())
+	l.setMapped(0)
+	assert.Equal(t, listened, l.Port())
+}
+
+func TestDownloadIncoming(t *testing.T) {
+	l, _ := startPeerListener(t)
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	release := make(chan struct{})
+	fp := newFakePeer(t, data, pieceLength, allPieces(3))
+	fp.wait = func(int) { <-release }
+	to.Peers = []peer.Peer{fp.Peer}
+	to.Incoming = l
+
+	// The peers connecting are served while downloading only
+	downloaded := make(chan []byte)
+	go func() {
+		buf, err := downloadBytes(&to)
+		assert.Nil(t, err)
+		downloaded <- buf
+	}()
+	waitAttached(t, l, 1)
+	close(release)
+	assert.Equal(t, data, <-downloaded)
+	waitAttached(t, l, 0)
+}
+
+func TestListenIPv6(t *testing.T) {
+	l, err := Listen(0)
+	require.Nil(t, err)
+	defer l.Close()
+
+	// The port is shared by IPv4 and IPv6 peers
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(l.Port()))))
+		if err != nil && host == "::1" {
+			t.Skip("no IPv6 loopback:", err)
+		}
+		require.Nil(t, err)
+		accepted, err := l.ln.Accept()
+		require.Nil(t, err)
+		assert.Equal(t, net.ParseIP(host).To16(), accepted.RemoteAddr().(*net.TCPAddr).IP.To16())
+		accepted.Close()
+		conn.Close()
+	}
+}
+
+func TestPeerListenerAttached(t *testing.T) {
+	l, _ := startPeerListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.attach(ctx, [20]byte{1}, func(*client.Incoming) {})
+		close(done)
+	}()
+	waitAttached(t, l, 1)
+	assert.True(t, l.Attached([20]byte{1}))
+	assert.False(t, l.Attached([20]byte{2}))
+	cancel()
+	<-done
+	assert.False(t, l.Attached([20]byte{1}))
+}
@@ -0,0 +1,70 @@
+package p2p
+
+// Names of the metrics updated by the package
+const (
+	// MetricActiveTorrents is a gauge of the torrents being downloaded
+	MetricActiveTorrents = "active_torrents"
+	// MetricConnectedPeers is a gauge of the peers downloaded from
+	MetricConnectedPeers = "connected_peers"
+	// MetricDownloadedBytes is a counter of the bytes of the verified pieces
+	MetricDownloadedBytes = "downloaded_bytes"
+	// MetricUploadedBytes is a counter of the bytes of the blocks uploaded
+	MetricUploadedBytes = "uploaded_bytes"
+	// MetricPiecesCompleted is a counter of the pieces stored
+	MetricPiecesCompleted = "pieces_completed"
+	// MetricIntegrityFailures is a counter of the pieces failing the integrity check
+	MetricIntegrityFailures = "integrity_failures"
+	// MetricBannedPeers is a counter of the peers banned
+	MetricBannedPeers = "banned_peers"
+	// MetricCacheHits is a counter of the blocks uploaded from the read cache
+	MetricCacheHits = "cache_hits"
+	// MetricCacheMisses is a counter of the blocks uploaded after reading
+	// their piece into the read cache
+	MetricCacheMisses = "cache_misses"
+	// MetricPeerConnects is a counter of the handshakes completed with the
+	// peers downloaded from
+	MetricPeerConnects = "peer_connects"
+	// MetricPeerDisconnects is a counter of the peers downloaded from that
+	// were disconnected, or could not be connected to
+	MetricPeerDisconnects = "peer_disconnects"
+	// MetricTrackerErrors is a counter of the failed announces to trackers
+	MetricTrackerErrors = "tracker_errors"
+	// MetricRequestLatency is a histogram of the seconds between the request
+	// of a block and its reception
+	MetricRequestLatency = "request_latency_seconds"
+	// MetricAnnounceLatency is a histogram of the seconds taken by the
+	// announces to trackers, failed or not
+	MetricAnnounceLatency = "announce_latency_seconds"
+)
+
+// Metrics receives continuous instrumentation, to be bridged to Prometheus or
+// any other backend. Rates are derived from the counters by the backend.
+// Implementations must be safe for concurrent use, as they can be shared by
+// several torrents.
+type Metrics interface {
+	// AddCounter increments a counter by delta
+	AddCounter(name string, delta int64)
+	// AddGauge moves a gauge up or down by delta
+	AddGauge(name string, delta int64)
+	// Observe adds a sample to a histogram
+	Observe(name string, value float64)
+}
+
+// NopMetrics discards all the metrics
+type NopMetrics struct{}
+
+// AddCounter does nothing
+func (NopMetrics) AddCounter(name string, delta int64) {}
+
+// AddGauge does nothing
+func (NopMetrics) AddGauge(name string, delta int64) {}
+
+// Observe does nothing
+func (NopMetrics) Observe(name string, value float64) {}
+
+func (t *Torrent) metrics() Metrics {
+	if t.Metrics == nil {
+		return NopMetrics{}
+	}
+	return t.Metrics
+}
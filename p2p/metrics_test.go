@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMetrics keeps the current value and the peak of every metric, and
+// the number of samples of every histogram
+type recordingMetrics struct {
+	mu      sync.Mutex
+	values  map[string]int64
+	peaks   map[string]int64
+	samples map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{values: make(map[string]int64), peaks: make(map[string]int64), samples: make(map[string]int)}
+}
+
+func (m *recordingMetrics) add(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[name] += delta
+	if m.values[name] > m.peaks[name] {
+		m.peaks[name] = m.values[name]
+	}
+}
+
+func (m *recordingMetrics) AddCounter(name string, delta int64) {
+	m.add(name, delta)
+}
+
+func (m *recordingMetrics) AddGauge(name string, delta int64) {
+	m.add(name, delta)
+}
+
+func (m *recordingMetrics) Observe(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples[name]++
+}
+
+func TestDownloadMetrics(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength-10, pieceLength)
+	to.Logger = logging.Discard
+	metrics := newRecordingMetrics()
+	to.Metrics = metrics
+
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.corrupt = 1
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	expected := map[string]int64{
+		MetricActiveTorrents:    0,
+		MetricConnectedPeers:    0,
+		MetricDownloadedBytes:   int64(len(data)),
+		MetricPiecesCompleted:   4,
+		MetricIntegrityFailures: 1,
+		MetricPeerConnects:      1,
+		MetricPeerDisconnects:   1,
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal(t, expected, metrics.values)
+	assert.Equal(t, int64(1), metrics.peaks[MetricActiveTorrents])
+	assert.Equal(t, int64(1), metrics.peaks[MetricConnectedPeers])
+	// Each piece is a block, the corrupt one being requested twice
+	assert.Equal(t, map[string]int{MetricRequestLatency: 5}, metrics.samples)
+}
+
+func TestAnnounceMetrics(t *testing.T) {
+	_, to := newTestTorrent(MaxBlockSize, MaxBlockSize)
+	metrics := newRecordingMetrics()
+	to.Metrics = metrics
+	url, _ := newFakeTracker(t, nil)
+
+	to.AnnounceURL = url
+	_, err := to.Announce(context.Background(), tracker.EventStarted)
+	require.Nil(t, err)
+	to.AnnounceURL = "http://127.0.0.1:0/announce"
+	_, err = to.Announce(context.Background(), "")
+	require.NotNil(t, err)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	assert.Equal(t, map[string]int64{MetricTrackerErrors: 1}, metrics.values)
+	assert.Equal(t, map[string]int{MetricAnnounceLatency: 2}, metrics.samples)
+}
@@ -0,0 +1,213 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/logging"
+)
+
+// Option tunes a torrent for the links it runs on, such as a LAN, a
+// satellite or a mobile link. Options set the fields of the torrent.
+type Option func(*Torrent)
+
+// New returns a torrent of length bytes, in pieces of pieceLength bytes with
+// the given hashes, configured with the options. The other fields can be
+// set on the returned torrent before downloading or seeding.
+func New(infoHash [20]byte, pieceHashes [][20]byte, pieceLength, length int, opts ...Option) *Torrent {
+	t := &Torrent{
+		InfoHash:    infoHash,
+		PieceHashes: pieceHashes,
+		PieceLength: pieceLength,
+		Length:      length,
+	}
+	t.Apply(opts...)
+	return t
+}
+
+// Apply configures the torrent with the options. It must be called before
+// downloading or seeding.
+func (t *Torrent) Apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(t)
+	}
+}
+
+// WithPieceTimeout sets the smallest time budget given to a peer to deliver
+// a piece, see PieceTimeout
+func WithPieceTimeout(d time.Duration) Option {
+	return func(t *Torrent) {
+		t.PieceTimeout = d
+	}
+}
+
+// WithMinThroughput sets the slowest expected transfer rate in bytes per
+// second, which scales the time budget of the pieces
+func WithMinThroughput(bytesPerSecond int) Option {
+	return func(t *Torrent) {
+		t.MinThroughput = bytesPerSecond
+	}
+}
+
+// WithDialTimeout sets the time allowed to connect to a peer
+func WithDialTimeout(d time.Duration) Option {
+	return func(t *Torrent) {
+		t.ClientOptions = append(t.ClientOptions, client.WithDialTimeout(d))
+	}
+}
+
+// WithHandshakeTimeout sets the time allowed to complete the handshake with
+// a peer
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(t *Torrent) {
+		t.ClientOptions = append(t.ClientOptions, client.WithHandshakeTimeout(d))
+	}
+}
+
+// WithBitfieldTimeout sets the time allowed to receive the bitfield of a peer
+func WithBitfieldTimeout(d time.Duration) Option {
+	return func(t *Torrent) {
+		t.ClientOptions = append(t.ClientOptions, client.WithBitfieldTimeout(d))
+	}
+}
+
+// WithBacklog sets the smallest number of requests kept in flight for each
+// piece downloaded from a peer, see Backlog
+func WithBacklog(n int) Option {
+	return func(t *Torrent) {
+		t.Backlog = n
+	}
+}
+
+// WithBacklogCeiling sets the largest number of requests kept in flight for
+// each piece downloaded from a peer, see BacklogCeiling
+func WithBacklogCeiling(n int) Option {
+	return func(t *Torrent) {
+		t.BacklogCeiling = n
+	}
+}
+
+// WithBlockSize sets the size of the blocks requested, see BlockSize
+func WithBlockSize(n int) Option {
+	return func(t *Torrent) {
+		t.BlockSize = n
+	}
+}
+
+// WithMaxPeers caps the number of peers connected at the same time for the
+// torrent, see MaxPeers
+func WithMaxPeers(n int) Option {
+	return func(t *Torrent) {
+		t.MaxPeers = n
+	}
+}
+
+// WithMaxDials caps the number of peers dialed at the same time for the
+// torrent, see Dials
+func WithMaxDials(n int) Option {
+	return func(t *Torrent) {
+		t.Dials = NewConnLimit(n)
+	}
+}
+
+// WithSnubTimeout sets the time a peer that unchoked us can go without
+// delivering a block before it is snubbed, see SnubTimeout
+func WithSnubTimeout(d time.Duration) Option {
+	return func(t *Torrent) {
+		t.SnubTimeout = d
+	}
+}
+
+// WithPeerRetries sets the number of times a peer that failed is dialed
+// again, see PeerRetries
+func WithPeerRetries(n int) Option {
+	return func(t *Torrent) {
+		t.PeerRetries = n
+	}
+}
+
+// WithRetryBackoff sets the time waited before dialing a peer again after
+// its first failure, see RetryBackoff
+func WithRetryBackoff(d time.Duration) Option {
+	return func(t *Torrent) {
+		t.RetryBackoff = d
+	}
+}
+
+// WithLogger sets the logger of the torrent, see Logger
+func WithLogger(l logging.Logger) Option {
+	return func(t *Torrent) {
+		t.Logger = l
+	}
+}
+
+// pieceTimeoutMin returns the smallest time budget of a piece
+func (t *Torrent) pieceTimeoutMin() time.Duration {
+	if t.PieceTimeout <= 0 {
+		return MinPieceTimeout
+	}
+	return t.PieceTimeout
+}
+
+// backlog returns the number of requests kept in flight for a piece
+func (t *Torrent) backlog() int {
+	if t.Backlog <= 0 {
+		return MaxBacklog
+	}
+	return t.Backlog
+}
+
+// backlogCeiling returns the most requests kept in flight for a piece
+func (t *Torrent) backlogCeiling() int {
+	if t.BacklogCeiling <= 0 {
+		return DefaultBacklogCeiling
+	}
+	return t.BacklogCeiling
+}
+
+// snubTimeout returns the time without blocks before a peer is snubbed, 0
+// to never snub
+func (t *Torrent) snubTimeout() time.Duration {
+	if t.SnubTimeout < 0 {
+		return 0
+	}
+	if t.SnubTimeout == 0 {
+		return DefaultSnubTimeout
+	}
+	return t.SnubTimeout
+}
+
+// blockSize returns the size of the blocks requested, which peers refuse
+// above MaxBlockSize
+func (t *Torrent) blockSize() int {
+	if t.BlockSize <= 0 || t.BlockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return t.BlockSize
+}
+
+// peerLimit returns the limit of MaxPeers connections of the torrent
+func (t *Torrent) peerLimit() *ConnLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.MaxPeers <= 0 {
+		return nil
+	}
+	if t.peers == nil {
+		t.peers = NewConnLimit(t.MaxPeers)
+	}
+	return t.peers
+}
+
+// dialLimit returns the limit of the peers dialed at the same time
+func (t *Torrent) dialLimit() *ConnLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Dials != nil {
+		return t.Dials
+	}
+	if t.dials == nil {
+		t.dials = NewConnLimit(DefaultMaxDials)
+	}
+	return t.dials
+}
@@ -0,0 +1,180 @@
+package p2p
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	to := New([20]byte{1}, [][20]byte{{2}}, 10, 8)
+	assert.Equal(t, [20]byte{1}, to.InfoHash)
+	assert.Equal(t, 10, to.PieceLength)
+	assert.Equal(t, 8, to.Length)
+	assert.Equal(t, MinPieceTimeout, to.pieceTimeout(10))
+	assert.Equal(t, MaxBacklog, to.backlog())
+	assert.Equal(t, DefaultBacklogCeiling, to.backlogCeiling())
+	assert.Equal(t, MaxBlockSize, to.blockSize())
+	assert.Nil(t, to.peerLimit())
+	assert.Equal(t, DefaultMaxDials, to.dialLimit().Limit())
+	assert.Equal(t, DefaultSnubTimeout, to.snubTimeout())
+	assert.Equal(t, DefaultPeerRetries, to.peerRetries())
+
+	to = New([20]byte{1}, [][20]byte{{2}}, 10, 8,
+		WithPieceTimeout(time.Minute),
+		WithMinThroughput(1),
+		WithDialTimeout(time.Second),
+		WithHandshakeTimeout(time.Second),
+		WithBitfieldTimeout(time.Second),
+		WithBacklog(20),
+		WithBacklogCeiling(100),
+		WithBlockSize(4*MaxBlockSize),
+		WithMaxPeers(3),
+		WithMaxDials(2),
+		WithSnubTimeout(time.Second),
+		WithPeerRetries(5),
+		WithRetryBackoff(time.Minute),
+	)
+	assert.Equal(t, time.Minute, to.pieceTimeout(10))
+	assert.Equal(t, 100*time.Second, to.pieceTimeout(100))
+	assert.Len(t, to.ClientOptions, 3)
+	assert.Equal(t, 20, to.backlog())
+	assert.Equal(t, 100, to.backlogCeiling())
+	// Peers refuse blocks larger than MaxBlockSize
+	assert.Equal(t, MaxBlockSize, to.blockSize())
+	assert.Equal(t, 3, to.peerLimit().Limit())
+	assert.Equal(t, 2, to.dialLimit().Limit())
+	assert.Equal(t, time.Second, to.snubTimeout())
+	to.Apply(WithSnubTimeout(-1))
+	assert.Equal(t, time.Duration(0), to.snubTimeout())
+	assert.Equal(t, 5, to.peerRetries())
+	assert.Equal(t, time.Minute, to.RetryBackoff)
+}
+
+func TestDownloadBlockSize(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	to.EndgameThreshold = -1
+	to.Apply(WithBlockSize(MaxBlockSize/4), WithBacklog(2))
+	fp := newFakePeer(t, data, pieceLength, allPieces(2))
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	assert.Equal(t, 8, fp.requests)
+}
+
+func TestDownloadMaxPeers(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Apply(WithMaxPeers(1))
+	for i := 0; i < 3; i++ {
+		fp := newFakePeer(t, data, pieceLength, allPieces(4))
+		fp.wait = func(int) { time.Sleep(time.Millisecond) }
+		to.Peers = append(to.Peers, fp.Peer)
+	}
+
+	var mu sync.Mutex
+	connected, most := 0, 0
+	to.OnEvent = func(ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch ev.(type) {
+		case PeerConnected:
+			connected++
+			if connected > most {
+				most = connected
+			}
+		case PeerDropped:
+			connected--
+		}
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, most)
+}
+
+func TestDownloadQueuesPeers(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Apply(WithMaxPeers(1))
+	var fps []*fakePeer
+	for i := 0; i < 3; i++ {
+		fp := newFakePeer(t, data, pieceLength, allPieces(4))
+		fps = append(fps, fp)
+		to.Peers = append(to.Peers, fp.Peer)
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	// The first peer delivers everything before the others leave the queue
+	for i, fp := range fps {
+		fp.mu.Lock()
+		assert.Equal(t, i == 0, fp.conns > 0, "peer %d", i)
+		fp.mu.Unlock()
+	}
+}
+
+func TestDownloadMaxDials(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.Apply(WithMaxDials(1))
+
+	// The peers answer the handshake late, so that dials overlap unless
+	// they are limited
+	var mu sync.Mutex
+	dialing, most := 0, 0
+	for i := 0; i < 3; i++ {
+		fp := newFakePeer(t, data, pieceLength, allPieces(4))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { conn.Close() })
+				mu.Lock()
+				dialing++
+				if dialing > most {
+					most = dialing
+				}
+				mu.Unlock()
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					mu.Lock()
+					dialing--
+					mu.Unlock()
+					fp.serve(conn)
+				}()
+			}
+		}()
+		addr := ln.Addr().(*net.TCPAddr)
+		to.Peers = append(to.Peers, peer.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, most)
+	assert.Equal(t, 0, to.Dials.Active())
+}
@@ -2,26 +2,81 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
-	"runtime"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/leonhfr/torrent-client/bitfield"
 	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/logging"
 	"github.com/leonhfr/torrent-client/message"
 	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
 )
 
 const (
 	// MaxBlockSize is the largest number of bytes a request can ask for
 	MaxBlockSize = 16 * 1024
-	// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
+	// MaxBacklog is the number of unfulfilled requests a client starts with in
+	// its pipeline, for each piece
 	MaxBacklog = 5
+	// DefaultBacklogCeiling is the most unfulfilled requests a client can
+	// have in its pipeline for each piece, as it grows with the throughput
+	DefaultBacklogCeiling = 64
+	// ProgressFormat is the entry logged each time a piece is downloaded, with the
+	// completion percentage, the index of the piece and the number of connected peers
+	ProgressFormat = "(%0.2f%%) downloaded piece #%d from %d peers"
+	// MinPieceTimeout is the smallest time budget given to a peer to deliver a piece
+	MinPieceTimeout = 30 * time.Second
+	// DefaultMinThroughput is the slowest rate, in bytes per second, a healthy peer is expected to sustain
+	DefaultMinThroughput = 10 * 1024
+	// DefaultMaxPiecesPerPeer is the number of pieces downloaded at the same time from a peer
+	DefaultMaxPiecesPerPeer = 1
+	// MaxUnsolicited is the number of blocks we did not request a peer can
+	// send before being banned
+	MaxUnsolicited = 2 * MaxBacklog
+	// DefaultMaxCorruptPieces is the number of pieces failing the integrity
+	// check a peer can deliver before being banned
+	DefaultMaxCorruptPieces = 2
+	// DefaultEndgameThreshold is the number of pieces left below which the
+	// pieces in flight are requested from several peers at once
+	DefaultEndgameThreshold = 4
+	// DefaultSequentialWindow is the number of pieces downloaded ahead of the
+	// first missing one in sequential mode
+	DefaultSequentialWindow = 8
+	// DefaultMaxDials is the number of peers dialed at the same time
+	DefaultMaxDials = 20
+	// DefaultSnubTimeout is the time a peer that unchoked us can go without
+	// delivering a block before it is snubbed
+	DefaultSnubTimeout = time.Minute
+)
+
+var (
+	// ErrUnsatisfiable is returned when the peers cannot deliver the whole torrent
+	ErrUnsatisfiable = errors.New("peers cannot deliver the torrent")
+	// ErrFlooding is returned when a peer sends too many blocks we did not request
+	ErrFlooding = errors.New("peer sent too many unsolicited blocks")
+	// ErrIdle is returned when a peer sends nothing for longer than IdleTimeout
+	ErrIdle = errors.New("peer is idle")
+	// errSnubbed is returned when a peer delivers no block for SnubTimeout
+	errSnubbed = errors.New("peer snubbed us")
+	// ErrPieceHashMismatch is returned when the data of a piece does not
+	// match its hash in the metainfo
+	ErrPieceHashMismatch = errors.New("piece failed integrity check")
 )
 
 // Torrent holds data required to download a torrent form a list of peers
 type Torrent struct {
+	// Peers is the set of peers to download from. Unless Discovery is set,
+	// no other peer is discovered.
 	Peers       []peer.Peer
 	PeerId      [20]byte
 	InfoHash    [20]byte
@@ -29,6 +84,238 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+	// MinThroughput is the slowest expected transfer rate in bytes per second,
+	// used to scale the time budget of each piece. Defaults to DefaultMinThroughput.
+	MinThroughput int
+	// PieceTimeout is the smallest time budget given to a peer to deliver a
+	// piece. Defaults to MinPieceTimeout.
+	PieceTimeout time.Duration
+	// Backlog is the smallest number of requests kept in flight for each
+	// piece downloaded from a peer. Defaults to MaxBacklog.
+	Backlog int
+	// BacklogCeiling is the largest number of requests kept in flight for
+	// each piece downloaded from a peer. In between, the backlog grows with
+	// the measured throughput and round-trip time of the peer. Defaults to
+	// DefaultBacklogCeiling, a ceiling not above Backlog keeps it fixed.
+	BacklogCeiling int
+	// BlockSize is the size of the blocks requested, up to MaxBlockSize
+	// which is the default. Backlog, BacklogCeiling and BlockSize do not
+	// apply to SplitPieces.
+	BlockSize int
+	// MaxPeers, if positive, caps the number of peers connected at the same
+	// time for the torrent, besides the limit of Conns
+	MaxPeers int
+	// PeerRetries is the number of times a peer that timed out or dropped
+	// the connection is dialed again. Defaults to DefaultPeerRetries, a
+	// negative value never dials peers again.
+	PeerRetries int
+	// RetryBackoff is the time waited before dialing a peer again after its
+	// first failure, doubled after each of the next ones up to
+	// MaxRetryBackoff. Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+	// ClientOptions are applied to the connections with peers, e.g. to set
+	// their timeouts
+	ClientOptions []client.Option
+	// SplitPieces downloads pieces one at a time, partitioning the blocks of
+	// each piece across all the peers that have it. This lowers the latency
+	// of every piece at the cost of overall throughput.
+	SplitPieces bool
+	// Logger receives the download logs, including the progress entries.
+	// Defaults to logging.Default, use logging.Discard to silence it.
+	Logger logging.Logger
+	// Discovery, if set, finds more peers while downloading
+	Discovery *Discovery
+	// AnnounceURL is the URL of the tracker
+	AnnounceURL string
+	// Port is the port we accept incoming connections on
+	Port uint16
+	// Listener accepts incoming peer connections when seeding. If nil, a
+	// listener is opened on Port for IPv4 and IPv6 peers. It is closed when
+	// seeding stops.
+	Listener net.Listener
+	// Incoming, if set, is a listener shared with other torrents that hands
+	// us the peers connecting for our info hash, instead of Listener. The
+	// peers are then served while downloading too, and its port is the one
+	// announced.
+	Incoming *PeerListener
+	// Encryption is the encryption policy of the connections with peers
+	Encryption client.EncryptionPolicy
+	// Dialer, if set, establishes the connections with peers, web seeds and
+	// the tracker, e.g. through a proxy. UDP trackers are not announced to
+	// then.
+	Dialer client.Dialer
+	// Blocklist, if set, holds the addresses of the peers neither dialed nor
+	// accepted, such as a blocklist.Blocklist. It can be shared by several
+	// torrents and changed while transferring, which does not disconnect the
+	// peers already connected.
+	Blocklist Blocklist
+	// Conns, if set, caps the number of connections with peers. Outgoing
+	// connections wait for a free slot while incoming ones are refused.
+	Conns *ConnLimit
+	// Dials caps the number of peers being dialed and handshaked at the same
+	// time, so that a large swarm is not dialed all at once. It can be shared
+	// by several torrents. Defaults to a limit of DefaultMaxDials for the
+	// torrent.
+	Dials *ConnLimit
+	// DownloadLimiters and UploadLimiters limit the bandwidth of the
+	// connections with peers and web seeds, e.g. with a limiter for the
+	// torrent and one shared by all the torrents. Their limits can be
+	// changed while transferring.
+	DownloadLimiters []*client.Limiter
+	UploadLimiters   []*client.Limiter
+	// UploadSlots is the number of peers unchoked at the same time.
+	// Defaults to DefaultUploadSlots.
+	UploadSlots int
+	// ReadCacheSize is the memory in bytes of the cache of the pieces read
+	// to serve peers, so that the pieces requested by several peers are read
+	// once. Defaults to DefaultReadCacheSize, a negative value disables it.
+	ReadCacheSize int64
+	// SeedLimit stops seeding after uploading that many bytes, if positive
+	SeedLimit int64
+	// SeedRatio stops seeding once the torrent is complete and its share
+	// ratio, as reported by Stats, reaches it, if positive
+	SeedRatio float64
+	// SeedIdleTimeout stops seeding once the torrent is complete and nothing
+	// was uploaded for that long, if positive
+	SeedIdleTimeout time.Duration
+	// PastUploaded and PastDownloaded are the payload bytes exchanged by the
+	// previous runs of the torrent, e.g. restored from a resume file. They
+	// count in the totals and share ratio of Stats.
+	PastUploaded   int64
+	PastDownloaded int64
+	// SuperSeed seeds a complete torrent in initial-seeding mode (BEP 16), to
+	// bootstrap it from a single seed uploading little more than its data
+	// once. Peers are told about one piece at a time, the least distributed,
+	// and about another once a different peer reports having it, proving
+	// the piece was uploaded onward. It is meant for swarms of several
+	// peers, as a lone peer is not told about more pieces.
+	SuperSeed bool
+	// SkipVerify skips hashing the data before seeding it
+	SkipVerify bool
+	// HashWorkers bounds the number of pieces verified in parallel.
+	// Defaults to GOMAXPROCS.
+	HashWorkers int
+	// MaxPiecesPerPeer is the number of pieces downloaded at the same time
+	// from a peer, each with its own backlog of requests. Defaults to
+	// DefaultMaxPiecesPerPeer.
+	MaxPiecesPerPeer int
+	// Clients are connections already handshaked for this torrent, such as
+	// the ones opened to fetch its metadata. They are downloaded from before
+	// dialing Peers, and closed when the download returns. Their traffic is
+	// counted by their own counters.
+	Clients []*client.Client
+	// Metrics, if set, is updated continuously during downloads and seeding.
+	// Defaults to NopMetrics.
+	Metrics Metrics
+	// MaxCorruptPieces is the number of pieces failing the integrity check a
+	// peer can deliver before being banned. Defaults to DefaultMaxCorruptPieces,
+	// a negative value never bans. With SplitPieces, the peers that delivered
+	// blocks of a failed piece differing from a copy that passed the check are
+	// banned at once.
+	MaxCorruptPieces int
+	// VerifyOnWrite reads back and hashes every piece written to a Store,
+	// downloading again the pieces that did not survive the write
+	VerifyOnWrite bool
+	// IdleTimeout disconnects a peer that sends nothing for that long while
+	// we wait for blocks, if positive. Pieces also time out as a whole.
+	IdleTimeout time.Duration
+	// SnubTimeout snubs a peer that unchoked us and delivers no block for
+	// that long: its requests are cancelled and its pieces handed to the
+	// other peers. It then only gets the pieces no other peer has, one
+	// request at a time, until it delivers a block again. Defaults to
+	// DefaultSnubTimeout, a negative value never snubs.
+	SnubTimeout time.Duration
+	// KeepAliveInterval is the idle time after which a keep-alive is sent to
+	// a peer. Defaults to client.DefaultKeepAliveInterval.
+	KeepAliveInterval time.Duration
+	// OnPeerConnect, if set, is called when the handshake with a peer completes
+	OnPeerConnect func(p peer.Peer)
+	// OnPeerDisconnect, if set, is called when a peer is disconnected or could
+	// not be connected to, with the reason and the error causing it if any.
+	// Both callbacks may be called concurrently from several connections.
+	OnPeerDisconnect func(p peer.Peer, reason DisconnectReason, err error)
+	// IPPreference selects the IP version dialed first. A peer known by both
+	// an IPv4 and an IPv6 address is only connected to once.
+	IPPreference IPPreference
+	// OnPieceStored, if set, is called once a piece is verified and stored,
+	// e.g. to persist the pieces downloaded so far with Resume in mind
+	OnPieceStored func(index int)
+	// OnEvent, if set, is called with the progress of the download as typed
+	// events, for applications to build their own UI. It may be called
+	// concurrently from several connections, and must not block.
+	OnEvent func(Event)
+	// EndgameThreshold is the number of pieces left below which endgame mode
+	// starts: the pieces in flight are also requested from idle peers, and
+	// each block is cancelled with the other peers once one delivers it.
+	// Defaults to DefaultEndgameThreshold, a negative value disables it.
+	EndgameThreshold int
+	// Sequential downloads the pieces in order, so that media can be played
+	// while downloading. Peers only download the next SequentialWindow
+	// missing pieces, unless no connected peer has those not in flight.
+	Sequential bool
+	// SequentialWindow is the number of pieces downloaded at the same time in
+	// sequential mode. Defaults to DefaultSequentialWindow.
+	SequentialWindow int
+	// WebSeeds are the URLs of HTTP servers hosting the data of the torrent
+	// (BEP 19), which are downloaded from alongside the peers. They are not
+	// used when SplitPieces is set.
+	WebSeeds []string
+	// WebFiles are the files of a multi-file torrent, to find them on the
+	// web seeds
+	WebFiles []WebFile
+	// FilePriorities are the priorities of the files of WebFiles by index,
+	// or of the only file of a single-file torrent, normal if missing. The
+	// download returns once the pieces left are skipped. Use SetFilePriority
+	// while downloading. They are ignored with SplitPieces.
+	FilePriorities []Priority
+	// HTTPClient fetches the pieces from the web seeds. Defaults to
+	// http.DefaultClient, or to a client dialing with Dialer if set.
+	HTTPClient *http.Client
+	// PEX exchanges the addresses of connected peers with the peers that
+	// support ut_pex (BEP 11). It is ignored for private torrents.
+	PEX bool
+	// Private marks a private torrent (BEP 27), whose peers must only come
+	// from its trackers: PEX is off and only the trackers of Discovery are
+	// called.
+	Private bool
+
+	counters    client.Counters // traffic with all the peers
+	completed   int64           // bytes of the pieces we have, accessed atomically
+	connected   int32           // number of peers downloaded from, accessed atomically
+	served      int32           // number of peers served, accessed atomically
+	cacheHits   int64           // blocks served from the read cache, accessed atomically
+	cacheMisses int64           // blocks served after reading their piece, accessed atomically
+
+	mu         sync.Mutex
+	added      chan []peer.Peer             // peers added to the running download
+	handed     chan *servedPeer             // served peers handed to the running download
+	done       chan struct{}                // closed when the running download returns
+	banned     map[string]bool              // IPs of the peers we refuse to connect to
+	remotes    map[[20]byte]bool            // peer IDs of the connected peers
+	announces  tracker.State                // last announce to the tracker
+	restored   bool                         // whether announces is from a previous run
+	finished   chan struct{}                // closed when the download completes
+	downloaded bool                         // whether finished is closed
+	listenPort uint16                       // port actually listened on, if not Port
+	have       bitfield.Bitfield            // pieces stored so far
+	stored     int                          // number of pieces in have
+	failures   map[int]map[string]int       // failed integrity checks by piece and peer IP
+	seeding    *seeder                      // serves the pieces stored while downloading
+	conns      map[*client.Client]*peerConn // connections reported by ConnectedPeers
+	swarmPeers map[string]peer.Peer         // addresses of the peers downloaded from
+	resumed    chan struct{}                // closed by Resume, nil unless paused
+	peers      *ConnLimit                   // MaxPeers connections, created on first use
+	dials      *ConnLimit                   // DefaultMaxDials dials unless Dials is set, created on first use
+	stopRun    context.CancelFunc           // interrupts the running download on Pause
+	closed     bool                         // whether Close was called
+	closing    chan struct{}                // closed by Close, created on first use
+	runs       sync.WaitGroup               // downloads and seeding waited for by Close
+	picker     *picker                      // pieces of the running download
+	priorities chan struct{}                // signaled when the file priorities change while downloading
+	urgent     map[int]int                  // number of readers waiting for each piece
+	stores     chan struct{}                // closed when a piece is stored or the store set
+	store      io.ReaderAt                  // store of the running download, read by Readers
+	webClient  *http.Client                 // client dialing with Dialer, created on first use
 }
 
 type pieceWork struct {
@@ -38,136 +325,742 @@ type pieceWork struct {
 }
 
 type pieceResult struct {
-	index int
-	buf   []byte
+	pw  *pieceWork
+	buf []byte
 }
 
 type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+	pw          *pieceWork
+	blocks      *pieceBlocks
+	requested   int
+	backlog     int
+	outstanding map[int]int // length of the requested blocks by offset
+	deadline    time.Time
+}
+
+// solicited reports whether a PIECE message carries a block we requested
+func (state *pieceProgress) solicited(msg *message.Message) bool {
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length, ok := state.outstanding[begin]
+	return ok && length == len(msg.Payload)-8
+}
+
+// blockKey identifies a block by the index of its piece and its offset
+type blockKey struct {
+	index, begin int
+}
+
+// peerDownload holds the pieces being downloaded at the same time from a peer
+type peerDownload struct {
+	client      *client.Client
+	idle        time.Duration
+	pipeline    *pipeline // sizes the requests in flight per piece
+	blockSize   int
+	pieces      map[int]*pieceProgress
+	unsolicited int
+	canceled    map[blockKey]bool // blocks cancelled as other peers delivered them
+	released    []*pieceWork      // pieces completed by other peers, to put back
+	snubTimeout time.Duration     // time without blocks before the peer is snubbed, 0 to never snub
+	snubbed     bool
+	lastBlock   time.Time // when a block was last received, or the peer unchoked us
+	conn        *peerConn // state reported by ConnectedPeers, if set
+	// onHave, if set, is called with the pieces the peer announces
+	onHave func(index int)
+	// onInterested, if set, is called when the peer tells whether it is
+	// interested in our pieces
+	onInterested func(interested bool)
+	// onRequest, if set, serves the blocks the peer requests. The peer is
+	// disconnected if it returns an error.
+	onRequest func(msg *message.Message) error
+	// onUnsnub, if set, is called when a snubbed peer delivers a block
+	onUnsnub func()
+	// onLatency, if set, is called with the time taken by the peer to
+	// deliver each block since it was requested
+	onLatency func(latency time.Duration)
+}
+
+func newPeerDownload(c *client.Client, idle time.Duration) *peerDownload {
+	return &peerDownload{
+		client:    c,
+		idle:      idle,
+		pipeline:  newPipeline(MaxBacklog, MaxBacklog, MaxBlockSize),
+		blockSize: MaxBlockSize,
+		pieces:    make(map[int]*pieceProgress),
+		canceled:  make(map[blockKey]bool),
+		lastBlock: time.Now(),
+	}
+}
+
+// add starts downloading a piece into blocks, which may be shared with other
+// peers. It has to be downloaded within timeout.
+func (dl *peerDownload) add(pw *pieceWork, blocks *pieceBlocks, timeout time.Duration) {
+	dl.pieces[pw.index] = &pieceProgress{
+		pw:          pw,
+		blocks:      blocks,
+		outstanding: make(map[int]int),
+		deadline:    time.Now().Add(timeout),
+	}
+}
+
+// holding tells if the piece is being downloaded from the peer
+func (dl *peerDownload) holding(index int) bool {
+	_, ok := dl.pieces[index]
+	return ok
+}
+
+// abort returns the pieces still being downloaded and forgets them
+func (dl *peerDownload) abort() []*pieceWork {
+	var pws []*pieceWork
+	for index, state := range dl.pieces {
+		pws = append(pws, state.pw)
+		for begin := range state.outstanding {
+			dl.pipeline.forget(blockKey{index, begin})
+		}
+		delete(dl.pieces, index)
+	}
+	return pws
+}
+
+// release returns the pieces completed by other peers and forgets them
+func (dl *peerDownload) release() []*pieceWork {
+	pws := dl.released
+	dl.released = nil
+	return pws
+}
+
+// cancelReceived cancels the requested blocks other peers delivered first,
+// and releases the pieces they completed
+func (dl *peerDownload) cancelReceived() error {
+	for index, state := range dl.pieces {
+		for begin, length := range state.outstanding {
+			if !state.blocks.has(begin) {
+				continue
+			}
+			err := dl.client.SendCancel(index, begin, length)
+			if err != nil {
+				return err
+			}
+			delete(state.outstanding, begin)
+			state.backlog--
+			dl.canceled[blockKey{index, begin}] = true
+			dl.pipeline.forget(blockKey{index, begin})
+		}
+		if state.blocks.complete() {
+			delete(dl.pieces, index)
+			dl.released = append(dl.released, state.pw)
+		}
+	}
+	return nil
+}
+
+// sendRequests sends requests until every piece has enough unfulfilled
+// requests, skipping the blocks other peers delivered. The number of requests
+// follows the throughput of the peer, see pipeline.
+func (dl *peerDownload) sendRequests() error {
+	if dl.client.Choked {
+		return nil
+	}
+	backlog := dl.pipeline.backlog(len(dl.pieces))
+	if dl.snubbed {
+		backlog = 1
+	}
+	for _, state := range dl.pieces {
+		for state.backlog < backlog && state.requested < state.pw.length {
+			blockSize := dl.blockSize
+			// Last block might be shorter than the typical block
+			if state.pw.length-state.requested < blockSize {
+				blockSize = state.pw.length - state.requested
+			}
+			if state.blocks.has(state.requested) {
+				state.requested += blockSize
+				continue
+			}
+
+			err := dl.client.SendRequest(state.pw.index, state.requested, blockSize)
+			if err != nil {
+				return err
+			}
+			state.outstanding[state.requested] = blockSize
+			dl.pipeline.requested(blockKey{state.pw.index, state.requested}, time.Now())
+			state.backlog++
+			state.requested += blockSize
+		}
+	}
+	return nil
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
+// readMessage reads a message and returns the piece it completes, if any
+func (dl *peerDownload) readMessage() (*pieceProgress, error) {
+	msg, err := dl.client.Read() // this call blocks
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// keep-alive
 	if msg == nil {
-		return nil
+		return nil, nil
 	}
 
 	switch msg.ID {
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		if dl.client.Choked {
+			dl.lastBlock = time.Now()
+		}
+		dl.client.Choked = false
+		dl.conn.setChoking(false)
 	case message.MsgChoke:
-		state.client.Choked = true
+		dl.client.Choked = true
+		dl.conn.setChoking(true)
+	case message.MsgInterested, message.MsgNotInterested:
+		dl.conn.setInterested(msg.ID == message.MsgInterested)
+		if dl.onInterested != nil {
+			dl.onInterested(msg.ID == message.MsgInterested)
+		}
+	case message.MsgRequest:
+		if dl.onRequest != nil {
+			err := dl.onRequest(msg)
+			if err != nil {
+				return nil, err
+			}
+		}
 	case message.MsgHave:
 		index, err := msg.ParseHave()
 		if err != nil {
-			return err
+			return nil, err
+		}
+		dl.conn.have(index)
+		if !dl.client.Bitfield.HasPiece(index) {
+			dl.client.Bitfield.SetPiece(index)
+			if dl.onHave != nil && dl.client.Bitfield.HasPiece(index) {
+				dl.onHave(index)
+			}
 		}
-		state.client.Bitfield.SetPiece(index)
 	case message.MsgPiece:
-		n, err := msg.ParsePiece(state.index, state.buf)
-		if err != nil {
-			return err
+		// Drop blocks we did not ask for without processing them
+		var state *pieceProgress
+		var key blockKey
+		if len(msg.Payload) >= 8 {
+			key = blockKey{int(binary.BigEndian.Uint32(msg.Payload[0:4])), int(binary.BigEndian.Uint32(msg.Payload[4:8]))}
+			state = dl.pieces[key.index]
+		}
+		if state == nil || !state.solicited(msg) {
+			// Cancelled blocks may have been sent before the peer got the cancel
+			if dl.canceled[key] {
+				delete(dl.canceled, key)
+				message.Release(msg)
+				return nil, nil
+			}
+			dl.unsolicited++
+			if dl.unsolicited > MaxUnsolicited {
+				return nil, ErrFlooding
+			}
+			return nil, nil
 		}
-		state.downloaded += n
+		delete(state.outstanding, key.begin)
 		state.backlog--
+		dl.lastBlock = time.Now()
+		if dl.snubbed {
+			dl.snubbed = false
+			if dl.onUnsnub != nil {
+				dl.onUnsnub()
+			}
+		}
+		if latency := dl.pipeline.received(key, len(msg.Payload)-8, dl.lastBlock); latency > 0 && dl.onLatency != nil {
+			dl.onLatency(latency)
+		}
+		complete, err := state.blocks.receive(key.index, msg)
+		// The block was copied into the piece
+		message.Release(msg)
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			delete(dl.pieces, key.index)
+			return state, nil
+		}
 	}
 
+	return nil, nil
+}
+
+// awaitHave reads the messages of the peer until it announces a piece, the
+// deadline passes or ctx is done
+func (dl *peerDownload) awaitHave(ctx context.Context, deadline time.Time) error {
+	c := dl.client
+	defer c.Conn.SetDeadline(time.Time{}) // Disable deadline
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	c.Conn.SetReadDeadline(deadline)
+	// Checked after setting the deadline, which could override the interruption
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	announced := false
+	onHave := dl.onHave
+	dl.onHave = func(index int) {
+		announced = true
+		if onHave != nil {
+			onHave(index)
+		}
+	}
+	defer func() { dl.onHave = onHave }()
+	for !announced {
+		_, err := dl.readMessage()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, client.ErrPeerTimeout) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+// snub cancels the requests of a peer that stopped delivering blocks, and
+// returns its pieces to be handed to the other peers. The blocks of the
+// requests it already sent are dropped.
+func (dl *peerDownload) snub() []*pieceWork {
+	for _, state := range dl.pieces {
+		for begin, length := range state.outstanding {
+			dl.client.SendCancel(state.pw.index, begin, length)
+			dl.canceled[blockKey{state.pw.index, begin}] = true
+		}
 	}
+	dl.snubbed = true
+	return dl.abort()
+}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough rime to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+// cancel sends a cancel for every block requested and not received yet
+func (dl *peerDownload) cancel() {
+	for _, state := range dl.pieces {
+		for begin, length := range state.outstanding {
+			dl.client.SendCancel(state.pw.index, begin, length)
+		}
+	}
+}
+
+// next downloads until one of the pieces is complete and returns it. It
+// returns no piece if the other peers completed all of them, see release.
+// If idle is positive, it fails with ErrIdle when the peer sends nothing for
+// that long. When ctx is done, it cancels the outstanding blocks and returns
+// ctx.Err().
+func (dl *peerDownload) next(ctx context.Context) (*pieceWork, []byte, error) {
+	c := dl.client
 	defer c.Conn.SetDeadline(time.Time{}) // Disable deadline
 
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
+	// Expiring the read deadline interrupts the message being read, while
+	// keeping the connection open to send the cancels
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
 
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+	for {
+		err := dl.cancelReceived()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(dl.pieces) == 0 {
+			return nil, nil, nil
+		}
+		err = dl.sendRequests()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Setting a deadline helps get unresponsive peers unstuck. Each piece
+		// has its own, which scales with its length so that large pieces get
+		// a longer budget.
+		var deadline time.Time
+		for _, state := range dl.pieces {
+			if deadline.IsZero() || state.deadline.Before(deadline) {
+				deadline = state.deadline
 			}
 		}
+		idleDeadline := time.Now().Add(dl.idle)
+		idle := dl.idle > 0 && idleDeadline.Before(deadline)
+		if idle {
+			deadline = idleDeadline
+		}
+		// A peer that unchoked us and delivers no block is snubbing us
+		snubbing := false
+		if dl.snubTimeout > 0 && !dl.snubbed && !c.Choked {
+			if snubDeadline := dl.lastBlock.Add(dl.snubTimeout); snubDeadline.Before(deadline) {
+				deadline, idle, snubbing = snubDeadline, false, true
+			}
+		}
+		c.Conn.SetDeadline(deadline)
+		// Checked after setting the deadline, which could override the interruption
+		if ctx.Err() != nil {
+			c.Conn.SetDeadline(time.Time{})
+			dl.cancel()
+			return nil, nil, ctx.Err()
+		}
 
-		err := state.readMessage()
+		state, err := dl.readMessage()
 		if err != nil {
-			return nil, err
+			if ctx.Err() != nil {
+				c.Conn.SetDeadline(time.Time{})
+				dl.cancel()
+				return nil, nil, ctx.Err()
+			}
+			var netErr net.Error
+			if idle && errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil, fmt.Errorf("%w: %v", ErrIdle, err)
+			}
+			if snubbing && errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil, errSnubbed
+			}
+			return nil, nil, err
 		}
+		if state != nil {
+			return state.pw, state.blocks.buf, nil
+		}
+	}
+}
+
+func (t *Torrent) keepAliveInterval() time.Duration {
+	if t.KeepAliveInterval <= 0 {
+		return client.DefaultKeepAliveInterval
 	}
+	return t.KeepAliveInterval
+}
+
+func (t *Torrent) logger() logging.Logger {
+	if t.Logger == nil {
+		return logging.Default
+	}
+	return t.Logger
+}
 
-	return state.buf, nil
+func (t *Torrent) logProgress(donePieces, index int) {
+	percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
+	t.logger().Log(logging.Info, fmt.Sprintf(ProgressFormat, percent, index, atomic.LoadInt32(&t.connected)))
+}
+
+// pieceTimeout returns the time budget to download a piece of the given length
+// at the minimum expected throughput, but never less than PieceTimeout
+func (t *Torrent) pieceTimeout(length int) time.Duration {
+	throughput := t.MinThroughput
+	if throughput <= 0 {
+		throughput = DefaultMinThroughput
+	}
+	timeout := time.Duration(length) * time.Second / time.Duration(throughput)
+	if min := t.pieceTimeoutMin(); timeout < min {
+		return min
+	}
+	return timeout
 }
 
 func checkIntegrity(pw *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", pw.index)
+		return fmt.Errorf("%w: piece #%d", ErrPieceHashMismatch, pw.index)
 	}
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peer.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.PeerId, t.InfoHash)
+// clientOptions returns the options of the connections with peers
+func (t *Torrent) clientOptions() []client.Option {
+	opts := []client.Option{client.WithCounters(&t.counters), client.WithEncryption(t.Encryption), client.WithPieces(len(t.PieceHashes))}
+	if t.Dialer != nil {
+		opts = append(opts, client.WithDialer(t.Dialer))
+	}
+	for _, l := range t.DownloadLimiters {
+		opts = append(opts, client.WithDownloadLimiter(l))
+	}
+	for _, l := range t.UploadLimiters {
+		opts = append(opts, client.WithUploadLimiter(l))
+	}
+	if t.partialSeed() {
+		opts = append(opts, client.WithUploadOnly())
+	}
+	// The bitfields of torrents with millions of pieces are longer than
+	// what peers may send otherwise
+	if length := 1 + bitfield.Length(len(t.PieceHashes)); length > message.DefaultMaxLength {
+		opts = append(opts, client.WithMaxMessageLength(length))
+	}
+	return append(opts, t.ClientOptions...)
+}
+
+// startDownloadWorker connects to a peer and downloads from it, returning why
+// it was disconnected
+func (t *Torrent) startDownloadWorker(ctx context.Context, peer peer.Peer, pieces *picker, results chan *pieceResult, hashes *hashPool) (DisconnectReason, error) {
+	peers := t.peerLimit()
+	if !peers.acquire(ctx) {
+		return ReasonCompleted, nil
+	}
+	defer peers.release()
+	if !t.Conns.acquire(ctx) {
+		return ReasonCompleted, nil
+	}
+	defer t.Conns.release()
+
+	opts := t.clientOptions()
+	var pex *pexHandler
+	if t.PEX && !t.Private {
+		pex = &pexHandler{t: t}
+		opts = append(opts, client.WithExtension("ut_pex", pex))
+	}
+	dials := t.dialLimit()
+	if !dials.acquire(ctx) {
+		return ReasonCompleted, nil
+	}
+	c, err := client.New(ctx, peer, t.PeerId, t.InfoHash, opts...)
+	dials.release()
 	if err != nil {
-		log.Printf("could not handshake with %s, disconnecting\n", peer.IP)
-		return
+		t.logger().Log(logging.Debug, "could not connect, disconnecting", logging.F("peer", peer), logging.F("err", err))
+		t.peerDisconnected(peer, ReasonHandshakeFailed, err)
+		return ReasonHandshakeFailed, err
 	}
+	if pex != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go pex.gossip(ctx, c)
+	}
+	return t.runDownloadWorker(ctx, c, pieces, results, hashes)
+}
+
+// runDownloadWorker downloads pieces from a connected peer until none is left
+// or the peer fails, and returns why it was disconnected. The connection is
+// closed on return.
+func (t *Torrent) runDownloadWorker(ctx context.Context, c *client.Client, pieces *picker, results chan *pieceResult, hashes *hashPool) (DisconnectReason, error) {
+	peer := c.Peer()
 	defer c.Conn.Close()
-	log.Printf("completed handshake with %s/n", peer.IP)
+	if !t.register(c.RemoteID()) {
+		t.logger().Log(logging.Debug, "already connected on another address, disconnecting", logging.F("peer", peer))
+		t.peerDisconnected(peer, ReasonDuplicate, nil)
+		return ReasonDuplicate, nil
+	}
+	defer t.unregister(c.RemoteID())
+	t.joinSwarm(peer)
+	defer t.leaveSwarm(peer)
+	return t.downloadFrom(ctx, c, nil, pieces, results, hashes)
+}
+
+// runServedWorker downloads pieces from a peer that connected to us and is
+// served over conn, until none is left or the peer fails. The connection is
+// left open to keep serving the peer, and the peer is not gossiped to the
+// swarm as it listens on another port.
+func (t *Torrent) runServedWorker(ctx context.Context, c *client.Client, conn *peerConn, pieces *picker, results chan *pieceResult, hashes *hashPool) {
+	if !t.register(c.RemoteID()) {
+		return
+	}
+	defer t.unregister(c.RemoteID())
+	t.downloadFrom(ctx, c, conn, pieces, results, hashes)
+}
+
+// downloadFrom downloads pieces from a peer registered by the caller, and
+// returns why it stopped. A peer served over the connection served is
+// already reported by ConnectedPeers and registered with the seeder.
+func (t *Torrent) downloadFrom(ctx context.Context, c *client.Client, served *peerConn, pieces *picker, results chan *pieceResult, hashes *hashPool) (reason DisconnectReason, err error) {
+	// Wait for the pieces being verified, so that their results are
+	// delivered before the worker is known to have exited
+	var verifying sync.WaitGroup
+	defer verifying.Wait()
+
+	peer := c.Peer()
+	logger := logging.With(t.logger(), logging.F("peer", peer))
+	atomic.AddInt32(&t.connected, 1)
+	defer atomic.AddInt32(&t.connected, -1)
+	t.metrics().AddGauge(MetricConnectedPeers, 1)
+	defer t.metrics().AddGauge(MetricConnectedPeers, -1)
+	logger.Log(logging.Debug, "completed handshake")
+	t.peerConnected(peer)
+
+	reason = ReasonCompleted
+	defer func() {
+		if ctx.Err() != nil && reason == ReasonError {
+			reason, err = ReasonCompleted, nil // interrupted as the download does not need the peer anymore
+		}
+		t.peerDisconnected(peer, reason, err)
+	}()
 
-	c.SendUnchoke()
 	c.SendInterested()
+	// Peers left because the download stops or pauses are told before
+	// disconnecting, and served peers as they stay connected
+	defer func() {
+		if ctx.Err() != nil || served != nil {
+			c.SendNotInterested()
+		}
+	}()
+	if served == nil {
+		keepAlive, stop := context.WithCancel(ctx)
+		defer stop()
+		go c.KeepAlive(keepAlive, t.keepAliveInterval())
+	}
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw // Put piece back on the queue
+	maxPieces := t.MaxPiecesPerPeer
+	if maxPieces <= 0 {
+		maxPieces = DefaultMaxPiecesPerPeer
+	}
+	// Peers that did not send their bitfield announce their pieces with
+	// haves, which they are given as long as the bitfield to send
+	var announceDeadline time.Time
+	if !c.SentBitfield() {
+		announceDeadline = time.Now().Add(client.DefaultBitfieldTimeout)
+		if len(c.Bitfield) != bitfield.Length(len(t.PieceHashes)) {
+			c.Bitfield = bitfield.New(len(t.PieceHashes))
+		}
+	}
+	// The pieces of the peer are counted while connected, for sequential mode
+	pieces.join(c.Bitfield)
+	defer pieces.leave(c.Bitfield)
+	dl := newPeerDownload(c, t.IdleTimeout)
+	// The peer is served by the seeder like the peers connecting to us: it
+	// is told about the pieces stored and unchoked by the choker once
+	// interested. It stays choked if nothing is served.
+	t.mu.Lock()
+	s := t.seeding
+	t.mu.Unlock()
+	var ch *choker
+	if s != nil {
+		ch = s.choker
+		dl.onInterested = func(interested bool) {
+			if interested {
+				ch.interested(c)
+			} else {
+				ch.remove(c)
+			}
+		}
+		dl.onRequest = func(msg *message.Message) error {
+			return s.request(c, msg, false)
+		}
+	}
+	if served != nil {
+		dl.conn = served
+		dl.conn.setAmInterested(true)
+		defer dl.conn.setAmInterested(false)
+	} else {
+		if s != nil {
+			s.addClient(c, nil)
+			defer s.removeClient(c)
+			defer ch.remove(c)
+		}
+		dl.conn = t.addConn(c, false, ch)
+		defer t.removeConn(c)
+		dl.conn.setInterest(true, c.Choked, false)
+		dl.conn.haveBitfield(c.Bitfield)
+	}
+	dl.blockSize = t.blockSize()
+	dl.pipeline = newPipeline(t.backlog(), t.backlogCeiling(), dl.blockSize)
+	dl.snubTimeout = t.snubTimeout()
+	dl.onHave = func(index int) { pieces.have(index, dl.snubbed) }
+	dl.onLatency = func(latency time.Duration) {
+		t.metrics().Observe(MetricRequestLatency, latency.Seconds())
+	}
+	dl.onUnsnub = func() {
+		logger.Log(logging.Debug, "snubbed peer delivered a block")
+		pieces.snub(c.Bitfield, false)
+	}
+	defer func() {
+		if dl.snubbed {
+			pieces.snub(c.Bitfield, false)
+		}
+	}()
+	for {
+		// Only wait for a piece when there is nothing else to download.
+		// Snubbed peers download a single piece.
+		for len(dl.pieces) < maxPieces && !(dl.snubbed && len(dl.pieces) > 0) {
+			pw, blocks, ok := pieces.pickFor(c.Bitfield, dl.holding, len(dl.pieces) == 0, dl.snubbed)
+			if !ok {
+				break
+			}
+			dl.add(pw, blocks, t.pieceTimeout(pw.length))
+		}
+		if len(dl.pieces) == 0 && time.Now().Before(announceDeadline) {
+			haveErr := dl.awaitHave(ctx, announceDeadline)
+			if haveErr != nil {
+				reason, err = ReasonError, haveErr
+				logger.Log(logging.Debug, "disconnecting", logging.F("err", haveErr))
+				return
+			}
 			continue
 		}
-
-		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
-		if err != nil {
-			log.Println("exiting", err)
-			workQueue <- pw
+		if len(dl.pieces) == 0 {
+			logger.Log(logging.Debug, "peer has none of the remaining pieces, disconnecting")
 			return
 		}
 
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
+		// Download the pieces until one is complete
+		pw, buf, pieceErr := dl.next(ctx)
+		for _, pw := range dl.release() {
+			pieces.put(pw)
+		}
+		if errors.Is(pieceErr, errSnubbed) {
+			logger.Log(logging.Debug, "peer snubbed us, handing its pieces to the other peers")
+			for _, pw := range dl.snub() {
+				pieces.put(pw)
+			}
+			pieces.snub(c.Bitfield, true)
+			continue
+		}
+		if pieceErr != nil {
+			reason, err = ReasonError, pieceErr
+			switch {
+			case errors.Is(pieceErr, ErrFlooding):
+				logger.Log(logging.Warn, "banning peer", logging.F("err", pieceErr))
+				t.ban(peer.IP)
+				reason = ReasonBanned
+			case t.isBanned(peer.IP):
+				reason = ReasonBanned
+			case errors.Is(pieceErr, ErrIdle):
+				reason = ReasonIdle
+			}
+			logger.Log(logging.Debug, "disconnecting", logging.F("err", pieceErr))
+			for _, pw := range dl.abort() {
+				pieces.put(pw)
+			}
+			return
+		}
+		if pw == nil {
 			continue
 		}
 
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		// Verify the piece while downloading the next one
+		verifying.Add(1)
+		hashes.verify(pw, buf, func(err error) {
+			defer verifying.Done()
+			if errors.Is(err, errHashPoolClosed) {
+				return
+			}
+			if err != nil {
+				logger.Log(logging.Warn, "piece failed integrity check", logging.F("piece", pw.index))
+				t.metrics().AddCounter(MetricIntegrityFailures, 1)
+				t.emit(HashFailed{Index: pw.index, Source: peer.String()})
+				pieces.put(pw)
+				if t.corrupted(pw.index, peer.IP) {
+					logger.Log(logging.Warn, "banning peer: delivered too many corrupt pieces")
+					t.ban(peer.IP)
+					c.Conn.Close()
+				}
+				return
+			}
+			// The seeder tells its peers about the piece once stored
+			if s == nil {
+				c.SendHave(pw.index)
+			}
+			select {
+			case results <- &pieceResult{pw, buf}:
+			case <-ctx.Done():
+			}
+		})
 	}
 }
 
@@ -185,34 +1078,317 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-// Download downloads the torrent. This stores the entire file in memory.
-func (t *Torrent) Download() ([]byte, error) {
-	log.Println("starting download for", t.Name)
+func (t *Torrent) ban(ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.banned == nil {
+		t.banned = make(map[string]bool)
+	}
+	if !t.banned[ip.String()] {
+		t.banned[ip.String()] = true
+		t.metrics().AddCounter(MetricBannedPeers, 1)
+	}
+}
 
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
+func (t *Torrent) isBanned(ip net.IP) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.banned[ip.String()] || (t.Blocklist != nil && t.Blocklist.Blocked(ip))
+}
+
+// register records a connection to a peer ID. It returns false if the peer
+// is already connected, possibly on another address.
+func (t *Torrent) register(id [20]byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.remotes[id] {
+		return false
+	}
+	if t.remotes == nil {
+		t.remotes = make(map[[20]byte]bool)
+	}
+	t.remotes[id] = true
+	return true
+}
+
+func (t *Torrent) unregister(id [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.remotes, id)
+}
+
+// AddPeers adds peers to the torrent. Peers added during a download are
+// connected to right away.
+func (t *Torrent) AddPeers(peers []peer.Peer) {
+	t.mu.Lock()
+	added, done := t.added, t.done
+	if added == nil {
+		t.Peers = append(t.Peers, peers...)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+
+	select {
+	case added <- peers:
+	case <-done:
+	}
+}
+
+// download downloads every piece and passes it to store once verified,
+// until all the pieces are stored or the context is cancelled. Pieces that
+// store fails to keep with ErrCorruptWrite are downloaded again.
+func (t *Torrent) download(ctx context.Context, store func(index int, piece []byte) error) error {
+	ctx, release, err := t.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	t.logger().Log(logging.Info, "starting download", logging.F("torrent", t.Name))
+	t.metrics().AddGauge(MetricActiveTorrents, 1)
+	defer t.metrics().AddGauge(MetricActiveTorrents, -1)
+
+	if t.SplitPieces {
+		return t.unlessPaused(ctx, func(ctx context.Context) error {
+			return t.downloadSplit(ctx, store)
+		})
+	}
+	if len(t.MissingPieces()) == 0 {
+		return nil
+	}
 
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+	// While seeding, the seeder announces for both, and tracker sources
+	// announce on their own
+	t.mu.Lock()
+	seeding := t.seeding != nil
+	t.mu.Unlock()
+	if t.AnnounceURL != "" && !seeding && !t.Discovery.hasTracker() {
+		ctx, cancel := context.WithCancel(ctx)
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			t.reannounce(ctx)
+		}()
+		// The tracker is told about the download stopping before returning,
+		// once the peers it returns are not added to the download anymore
+		defer func() {
+			cancel()
+			<-stopped
+		}()
+	}
+	if t.Discovery != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go t.Discovery.run(ctx, t.AddPeers, t.Discovery.Private || t.Private)
 	}
 
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	return t.unlessPaused(ctx, func(ctx context.Context) error {
+		return t.downloadPieces(ctx, store)
+	})
+}
+
+// downloadPieces downloads the missing pieces from the peers and web seeds,
+// until all the pieces are stored or the context is cancelled
+func (t *Torrent) downloadPieces(ctx context.Context, store func(index int, piece []byte) error) error {
+	// Pieces stored by a previous run are not downloaded again
+	var work []*pieceWork
+	for _, index := range t.MissingPieces() {
+		work = append(work, &pieceWork{index, t.PieceHashes[index], t.calculatePieceSize(index)})
+	}
+	if len(work) == 0 {
+		return nil
+	}
+	// Workers are stopped before returning, so that none outlives the download
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	endgame := t.EndgameThreshold
+	if endgame == 0 {
+		endgame = DefaultEndgameThreshold
+	}
+	window := 0
+	if t.Sequential {
+		window = t.SequentialWindow
+		if window <= 0 {
+			window = DefaultSequentialWindow
+		}
 	}
+	pieces := newPicker(work, endgame, window)
+	defer pieces.close()
+	results := make(chan *pieceResult)
+
+	hashes := newHashPool(t.HashWorkers)
+	defer hashes.close()
 
-	buf := make([]byte, t.Length)
-	for donePieces := 0; donePieces < len(t.PieceHashes); donePieces++ {
-		res := <-results
-		begin, end := t.calcultateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+	exited := make(chan struct{})
+	added := make(chan []peer.Peer)
+	handed := make(chan *servedPeer)
+	done := make(chan struct{})
+	defer close(done)
+	// Cancelling the workers interrupts the pieces being downloaded
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The clients are only downloaded from once, their peers are dialed
+	// again when the download resumes after a pause
+	t.mu.Lock()
+	peers := t.Peers
+	clients := t.Clients
+	t.Clients = nil
+	for _, c := range clients {
+		t.Peers = append(t.Peers, c.Peer())
+	}
+	t.added, t.handed, t.done = added, handed, done
+	for index, n := range t.urgent {
+		pieces.urgent[index] = n
+	}
+	pieces.priority = t.piecePrioritiesLocked()
+	t.picker = pieces
+	reprioritized := make(chan struct{}, 1)
+	t.priorities = reprioritized
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.added, t.handed, t.done = nil, nil, nil
+		t.picker, t.priorities = nil, nil
+		t.mu.Unlock()
+	}()
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+	// The peers are queued as candidates, and only dialed while the torrent
+	// is under MaxPeers workers so that large swarms are not dialed at once.
+	// Queued peers count as active as they may still deliver pieces.
+	type candidate struct {
+		peer  peer.Peer
+		delay time.Duration
+	}
+	var queue []candidate
+	active, dialing := 0, 0
+	peerExited := make(chan struct{})
+	dial := func() {
+		for len(queue) > 0 && (t.MaxPeers <= 0 || dialing < t.MaxPeers) {
+			c := queue[0]
+			queue = queue[1:]
+			if t.isBanned(c.peer.IP) {
+				active--
+				continue
+			}
+			dialing++
+			workers.Add(1)
+			go func(p peer.Peer, delay time.Duration) {
+				defer workers.Done()
+				if delay > 0 {
+					select {
+					case <-time.After(delay):
+					case <-done:
+						return
+					}
+				}
+				t.dialDownloadWorker(workCtx, p, pieces, results, hashes)
+				select {
+				case peerExited <- struct{}{}:
+				case <-done:
+				}
+			}(c.peer, c.delay)
+		}
+	}
+	known := make(map[string]bool)
+	start := func(peers []peer.Peer) {
+		var dialed []peer.Peer
+		for _, p := range peers {
+			if known[p.String()] || t.isBanned(p.IP) || !reachable(p) {
+				continue
+			}
+			known[p.String()] = true
+			dialed = append(dialed, p)
+		}
+		delays := t.IPPreference.dialDelay(dialed)
+		for i, p := range dialed {
+			active++
+			queue = append(queue, candidate{p, delays[i]})
+		}
+		dial()
+	}
+	for _, c := range clients {
+		known[c.Peer().String()] = true
+		active++
+		workers.Add(1)
+		go func(c *client.Client) {
+			defer workers.Done()
+			t.runDownloadWorker(workCtx, c, pieces, results, hashes)
+			select {
+			case exited <- struct{}{}:
+			case <-done:
+			}
+		}(c)
+	}
+	start(peers)
+	for _, url := range t.WebSeeds {
+		active++
+		workers.Add(1)
+		go func(url string) {
+			defer workers.Done()
+			t.runWebSeed(workCtx, url, pieces, results, hashes)
+			select {
+			case exited <- struct{}{}:
+			case <-done:
+			}
+		}(url)
 	}
 
-	close(workQueue)
+	for donePieces := len(t.PieceHashes) - len(work); pieces.wanted() > 0; {
+		var res *pieceResult
+		for res == nil {
+			if active == 0 && t.Discovery == nil {
+				return fmt.Errorf("%w: %d of %d pieces missing", ErrUnsatisfiable, pieces.wanted(), len(t.PieceHashes))
+			}
+			select {
+			case <-reprioritized:
+				if pieces.wanted() == 0 {
+					return nil
+				}
+			case res = <-results:
+			case <-exited:
+				active--
+			case <-peerExited:
+				active--
+				dialing--
+				dial()
+			case peers := <-added:
+				t.mu.Lock()
+				t.Peers = append(t.Peers, peers...)
+				t.mu.Unlock()
+				start(peers)
+			case sp := <-handed:
+				active++
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					t.runServedWorker(workCtx, sp.c, sp.conn, pieces, results, hashes)
+					close(sp.done)
+					select {
+					case exited <- struct{}{}:
+					case <-done:
+					}
+				}()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err := store(res.pw.index, res.buf)
+		if errors.Is(err, ErrCorruptWrite) {
+			t.logger().Log(logging.Warn, "piece did not survive the write, downloading it again", logging.F("piece", res.pw.index))
+			pieces.put(res.pw)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		t.complete(res.pw.index)
+		donePieces++
 
-	return buf, nil
+		t.logProgress(donePieces, res.pw.index)
+		pieces.done(res.pw.index)
+	}
+
+	return nil
 }
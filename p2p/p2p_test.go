@@ -0,0 +1,632 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/blocklist"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/handshake"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePeer is a seeding peer serving the given pieces of data over TCP
+type fakePeer struct {
+	peer.Peer
+	id          [20]byte
+	data        []byte
+	pieceLength int
+	bitfield    bitfield.Bitfield
+
+	mu             sync.Mutex
+	conns          int // connections handshaked
+	requests       int
+	cancels        int
+	notInterested  int
+	unsolicited    int         // garbage blocks sent right after unchoking
+	corrupt        int         // number of blocks served with corrupted data
+	haves          bool        // announce the pieces with haves instead of a bitfield
+	interested     bool        // tell the client it is interested in its pieces
+	unchokes       int         // unchokes received from the client
+	fetch          bool        // request the first block of the pieces the client announces
+	fetched        int         // blocks received from the client
+	infoHash       *[20]byte   // if set, answered instead of the requested info hash
+	pending        map[int]int // requested blocks not served yet, by piece
+	maxPending     int         // most pieces requested at the same time
+	outstanding    int         // requested blocks not served yet
+	maxOutstanding int         // most blocks requested at the same time
+	// wait, if set, is called before serving each request
+	wait func(index int)
+	// pex, if set, is sent with ut_pex once the extension handshake is received
+	pex []peer.Peer
+}
+
+func newFakePeer(t *testing.T, data []byte, pieceLength int, pieces []int) *fakePeer {
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	fp := &fakePeer{
+		data:        data,
+		pieceLength: pieceLength,
+		bitfield:    make(bitfield.Bitfield, (numPieces+7)/8),
+		pending:     make(map[int]int),
+	}
+	for _, index := range pieces {
+		fp.bitfield.SetPiece(index)
+	}
+	fp.Peer = fp.listen(t, "127.0.0.1:0")
+	// Each fake peer has its own peer ID, derived from its first port
+	fp.id = [20]byte{'f', 'a', 'k', 'e', byte(fp.Port >> 8), byte(fp.Port)}
+	return fp
+}
+
+// listen serves the fake peer on another address too
+func (fp *fakePeer) listen(t *testing.T, address string) peer.Peer {
+	ln, err := net.Listen("tcp", address)
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go fp.serve(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (fp *fakePeer) serve(conn net.Conn) {
+	h, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	infoHash := h.InfoHash
+	if fp.infoHash != nil {
+		infoHash = *fp.infoHash
+	}
+	fp.mu.Lock()
+	pex := fp.pex
+	fp.mu.Unlock()
+	res := handshake.New(infoHash, fp.id)
+	if pex != nil {
+		res.EnableExtensions()
+	}
+	conn.Write(res.Serialize())
+	fp.mu.Lock()
+	fp.conns++
+	unsolicited, haves, interested := fp.unsolicited, fp.haves, fp.interested
+	fp.mu.Unlock()
+	if haves {
+		for index := 0; index < len(fp.bitfield)*8; index++ {
+			if fp.bitfield.HasPiece(index) {
+				conn.Write(message.NewHave(index).Serialize())
+			}
+		}
+	} else {
+		conn.Write((&message.Message{ID: message.MsgBitfield, Payload: fp.bitfield}).Serialize())
+	}
+	conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+	if interested {
+		conn.Write((&message.Message{ID: message.MsgInterested}).Serialize())
+	}
+
+	for i := 0; i < unsolicited; i++ {
+		payload := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff} // index 0, begin 1, 1 byte
+		conn.Write((&message.Message{ID: message.MsgPiece, Payload: payload}).Serialize())
+	}
+
+	// Requests are served in order while reading the next ones
+	requests := make(chan []byte, 64)
+	defer close(requests)
+	go func() {
+		for req := range requests {
+			fp.respond(conn, req)
+		}
+	}()
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgRequest:
+			index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+			fp.mu.Lock()
+			fp.requests++
+			fp.pending[index]++
+			if len(fp.pending) > fp.maxPending {
+				fp.maxPending = len(fp.pending)
+			}
+			fp.outstanding++
+			if fp.outstanding > fp.maxOutstanding {
+				fp.maxOutstanding = fp.outstanding
+			}
+			fp.mu.Unlock()
+			requests <- msg.Payload
+		case message.MsgCancel:
+			fp.mu.Lock()
+			fp.cancels++
+			fp.mu.Unlock()
+		case message.MsgNotInterested:
+			fp.mu.Lock()
+			fp.notInterested++
+			fp.mu.Unlock()
+		case message.MsgUnchoke:
+			fp.mu.Lock()
+			fp.unchokes++
+			fp.mu.Unlock()
+		case message.MsgHave:
+			fp.mu.Lock()
+			fetch := fp.fetch
+			fp.mu.Unlock()
+			if index, err := msg.ParseHave(); err == nil && fetch {
+				conn.Write(message.NewRequest(index, 0, MaxBlockSize).Serialize())
+			}
+		case message.MsgPiece:
+			fp.mu.Lock()
+			fp.fetched++
+			fp.mu.Unlock()
+		case message.MsgExtended:
+			fp.sendPEX(conn, msg, pex)
+		}
+	}
+}
+
+// sendPEX answers the extension handshake of the client with the ut_pex peers
+func (fp *fakePeer) sendPEX(conn net.Conn, msg *message.Message, pex []peer.Peer) {
+	id, payload, err := msg.ParseExtended()
+	if err != nil || id != 0 || pex == nil {
+		return
+	}
+	var hs client.ExtensionHandshake
+	bencode.Unmarshal(payload, &hs)
+	buf, _ := bencode.Marshal(client.ExtensionHandshake{M: map[string]int{"ut_pex": 1}})
+	conn.Write(message.NewExtended(0, buf).Serialize())
+	if hs.M["ut_pex"] == 0 {
+		return
+	}
+	buf, _ = bencode.Marshal(pexMessage{Added: string(peer.Marshal(pex))})
+	conn.Write(message.NewExtended(uint8(hs.M["ut_pex"]), buf).Serialize())
+}
+
+// respond sends the block asked for by a request
+func (fp *fakePeer) respond(conn net.Conn, req []byte) {
+	index := int(binary.BigEndian.Uint32(req[0:4]))
+	begin := int(binary.BigEndian.Uint32(req[4:8]))
+	length := int(binary.BigEndian.Uint32(req[8:12]))
+	fp.mu.Lock()
+	wait := fp.wait
+	fp.mu.Unlock()
+	if wait != nil {
+		wait(index)
+	}
+	offset := index*fp.pieceLength + begin
+	payload := make([]byte, 8+length)
+	copy(payload[0:8], req[0:8])
+	copy(payload[8:], fp.data[offset:offset+length])
+	fp.mu.Lock()
+	if fp.corrupt > 0 {
+		fp.corrupt--
+		payload[8] ^= 0xff
+	}
+	fp.pending[index]--
+	fp.outstanding--
+	if fp.pending[index] == 0 {
+		delete(fp.pending, index)
+	}
+	fp.mu.Unlock()
+	conn.Write((&message.Message{ID: message.MsgPiece, Payload: payload}).Serialize())
+}
+
+func (fp *fakePeer) requestCount() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.requests
+}
+
+// newTestTorrent returns random data and a Torrent describing it
+func newTestTorrent(length, pieceLength int) ([]byte, Torrent) {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	var hashes [][20]byte
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	return data, Torrent{
+		PeerId:      [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		InfoHash:    [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      length,
+		Name:        "test",
+		// Peers failing in tests are dialed again without delay
+		RetryBackoff: time.Millisecond,
+	}
+}
+
+// unreachablePeer returns the address of a port nothing listens on
+func unreachablePeer(t *testing.T) peer.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close() // nothing listens on the port anymore
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func allPieces(n int) []int {
+	pieces := make([]int, n)
+	for i := range pieces {
+		pieces[i] = i
+	}
+	return pieces
+}
+
+func TestPieceTimeout(t *testing.T) {
+	tests := map[string]struct {
+		minThroughput int
+		length        int
+		output        time.Duration
+	}{
+		"small piece gets the minimum timeout": {
+			minThroughput: 10 * 1024,
+			length:        256 * 1024,
+			output:        MinPieceTimeout,
+		},
+		"large piece scales with throughput": {
+			minThroughput: 10 * 1024,
+			length:        4 * 1024 * 1024,
+			output:        409600 * time.Millisecond,
+		},
+		"default throughput": {
+			minThroughput: 0,
+			length:        1024 * 1024,
+			output:        time.Duration(1024*1024) * time.Second / DefaultMinThroughput,
+		},
+	}
+
+	for _, test := range tests {
+		to := Torrent{MinThroughput: test.minThroughput}
+		assert.Equal(t, test.output, to.pieceTimeout(test.length))
+	}
+}
+
+func TestPieceTimeoutLargerPiece(t *testing.T) {
+	to := Torrent{MinThroughput: 10 * 1024}
+	small := to.pieceTimeout(256 * 1024)
+	large := to.pieceTimeout(8 * 1024 * 1024)
+	assert.Greater(t, large, small)
+}
+
+func TestDownload(t *testing.T) {
+	pieceLength := 2*MaxBlockSize + 10
+	data, to := newTestTorrent(6*pieceLength-100, pieceLength)
+	to.EndgameThreshold = -1 // blocks downloaded twice would be counted
+	for _, pieces := range [][]int{{0, 1, 2}, {3, 4}, {2, 5}} {
+		fp := newFakePeer(t, data, pieceLength, pieces)
+		to.Peers = append(to.Peers, fp.Peer)
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	stats := to.Stats()
+	assert.Equal(t, int64(len(data)), stats.Downloaded)
+	assert.Greater(t, stats.OverheadDownloaded, int64(0))
+	assert.Greater(t, stats.OverheadUploaded, int64(0))
+}
+
+func TestDownloadSequential(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(12*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.Sequential = true
+	to.SequentialWindow = 2
+	to.EndgameThreshold = -1
+	for i := 0; i < 3; i++ {
+		fp := newFakePeer(t, data, pieceLength, allPieces(12))
+		fp.wait = func(int) { time.Sleep(time.Millisecond) }
+		to.Peers = append(to.Peers, fp.Peer)
+	}
+	var stored []int
+	to.OnPieceStored = func(index int) { stored = append(stored, index) }
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	// Every piece is stored at most a window ahead of the first missing one
+	have := make(map[int]bool)
+	for _, index := range stored {
+		first := 0
+		for have[first] {
+			first++
+		}
+		assert.Less(t, index, first+to.SequentialWindow)
+		have[index] = true
+	}
+}
+
+func TestDownloadUnsatisfiable(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+
+	tests := map[string][]peer.Peer{
+		"no peers":         nil,
+		"unreachable peer": {unreachablePeer(t)},
+		"piece held by none": {
+			newFakePeer(t, data, pieceLength, []int{0, 1}).Peer,
+			newFakePeer(t, data, pieceLength, []int{1, 3}).Peer,
+		},
+	}
+
+	for _, peers := range tests {
+		to.Peers = peers
+		_, err := downloadBytes(&to)
+		assert.True(t, errors.Is(err, ErrUnsatisfiable))
+	}
+}
+
+func TestDownloadWithoutBitfield(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.haves = true
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadDropsInvalidBitfield(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	spare := newFakePeer(t, data, pieceLength, allPieces(3))
+	spare.bitfield[0] |= 1
+	long := newFakePeer(t, data, pieceLength, allPieces(3))
+	long.bitfield = append(long.bitfield, 0)
+
+	to.Peers = []peer.Peer{spare.Peer, long.Peer}
+	_, err := downloadBytes(&to)
+	assert.True(t, errors.Is(err, ErrUnsatisfiable))
+	assert.Zero(t, spare.requestCount())
+	assert.Zero(t, long.requestCount())
+}
+
+func TestDownloadProgressLog(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+
+	var out bytes.Buffer
+	to.Logger = logging.Std{Logger: log.New(&out, "", 0), Min: logging.Debug}
+	to.Peers = []peer.Peer{
+		newFakePeer(t, data, pieceLength, allPieces(4)).Peer,
+		unreachablePeer(t),
+	}
+	_, err := downloadBytes(&to)
+	require.Nil(t, err)
+
+	progress := regexp.MustCompile(`^\((\d+\.\d{2})%\) downloaded piece #(\d+) from (\d+) peers$`)
+	var percents []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		match := progress.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		percents = append(percents, match[1])
+		assert.Equal(t, "1", match[3])
+	}
+	assert.Equal(t, []string{"25.00", "50.00", "75.00", "100.00"}, percents)
+}
+
+func TestDownloadUnsolicitedBlocks(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+
+	var out bytes.Buffer
+	to.Logger = logging.Std{Logger: log.New(&out, "", 0), Min: logging.Debug}
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.unsolicited = MaxUnsolicited
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.False(t, to.isBanned(fp.IP))
+}
+
+func TestDownloadBansFloodingPeer(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+
+	var out bytes.Buffer
+	to.Logger = logging.Std{Logger: log.New(&out, "", 0), Min: logging.Debug}
+	flooder := newFakePeer(t, data, pieceLength, allPieces(4))
+	flooder.unsolicited = MaxUnsolicited + 1
+	to.Peers = []peer.Peer{
+		flooder.Peer,
+		newFakePeer(t, data, pieceLength, allPieces(4)).Peer,
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.True(t, to.isBanned(flooder.IP))
+	assert.Contains(t, out.String(), "banning peer peer="+flooder.String())
+}
+
+func TestDownloadBlocklist(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	fp := newFakePeer(t, data, pieceLength, allPieces(2))
+	b, err := blocklist.New(blocklist.Range{First: fp.IP, Last: fp.IP})
+	require.Nil(t, err)
+	to.Blocklist = b
+	to.Peers = []peer.Peer{fp.Peer}
+
+	_, err = downloadBytes(&to)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, fp.requestCount())
+	assert.True(t, to.isBanned(fp.IP))
+
+	// Ranges can be unblocked at runtime
+	require.Nil(t, b.Remove(blocklist.Range{First: fp.IP, Last: fp.IP}))
+	assert.False(t, to.isBanned(fp.IP))
+}
+
+func TestDownloadManyRequeues(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(8*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.MaxCorruptPieces = -1
+	for i := 0; i < 3; i++ {
+		fp := newFakePeer(t, data, pieceLength, allPieces(8))
+		fp.corrupt = 10 // every corrupted piece is put back
+		to.Peers = append(to.Peers, fp.Peer)
+	}
+
+	finished := make(chan error)
+	go func() {
+		buf, err := downloadBytes(&to)
+		if err == nil && !bytes.Equal(data, buf) {
+			err = errors.New("downloaded data differs")
+		}
+		finished <- err
+	}()
+
+	select {
+	case err := <-finished:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("download blocked while putting pieces back")
+	}
+}
+
+func TestDownloadMaxPiecesPerPeer(t *testing.T) {
+	pieceLength := MaxBlockSize
+	for _, max := range []int{0, 1, 3} {
+		data, to := newTestTorrent(8*pieceLength, pieceLength)
+		to.Logger = logging.Discard
+		fp := newFakePeer(t, data, pieceLength, allPieces(8))
+		fp.wait = func(int) { time.Sleep(5 * time.Millisecond) }
+		to.Peers = []peer.Peer{fp.Peer}
+		to.MaxPiecesPerPeer = max
+
+		buf, err := downloadBytes(&to)
+		require.Nil(t, err)
+		assert.Equal(t, data, buf)
+
+		expected := max
+		if expected == 0 {
+			expected = DefaultMaxPiecesPerPeer
+		}
+		fp.mu.Lock()
+		assert.Equal(t, expected, fp.maxPending)
+		fp.mu.Unlock()
+	}
+}
+
+func TestPeerDownloadCancel(t *testing.T) {
+	pieceLength := 4 * MaxBlockSize
+	data, to := newTestTorrent(pieceLength, pieceLength)
+	release := make(chan struct{})
+	defer close(release)
+	fp := newFakePeer(t, data, pieceLength, allPieces(1))
+	fp.wait = func(int) { <-release }
+
+	c, err := client.New(context.Background(), fp.Peer, to.PeerId, to.InfoHash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	dl := newPeerDownload(c, 0)
+	dl.add(&pieceWork{0, to.PieceHashes[0], pieceLength}, newPieceBlocks(pieceLength), time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error)
+	go func() {
+		_, _, err := dl.next(ctx)
+		returned <- err
+	}()
+
+	// Cancel once every block of the piece is requested
+	require.Eventually(t, func() bool { return fp.requestCount() == 4 }, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case err := <-returned:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("next did not return after cancellation")
+	}
+	assert.Eventually(t, func() bool {
+		fp.mu.Lock()
+		defer fp.mu.Unlock()
+		return fp.cancels == 4
+	}, time.Second, time.Millisecond)
+}
+
+func TestDownloadReusesClients(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+
+	// Connected beforehand, as when fetching the metadata
+	c, err := client.New(context.Background(), fp.Peer, to.PeerId, to.InfoHash)
+	require.Nil(t, err)
+	to.Clients = []*client.Client{c}
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	assert.Equal(t, 1, fp.conns)
+	assert.Equal(t, 4, fp.requests)
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	to.Peers = []peer.Peer{fp.Peer}
+
+	// The torrent and the global limits both apply
+	to.DownloadLimiters = []*client.Limiter{client.NewLimiter(0), client.NewLimiter(40000)}
+	start := time.Now()
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+}
@@ -0,0 +1,80 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/leonhfr/torrent-client/logging"
+)
+
+// Pause stops downloading: the requests in flight are cancelled and the
+// peers downloaded from are disconnected, while the pieces stored so far are
+// kept. The running download waits for Resume instead of returning, and a
+// download started while paused waits too.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resumed != nil {
+		return
+	}
+	t.resumed = make(chan struct{})
+	if t.stopRun != nil {
+		t.stopRun()
+	}
+}
+
+// Resume continues a paused download with the pieces still missing,
+// connecting to the peers known so far again
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resumed == nil {
+		return
+	}
+	close(t.resumed)
+	t.resumed = nil
+}
+
+// Paused tells whether the torrent is paused
+func (t *Torrent) Paused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.resumed != nil
+}
+
+// unlessPaused calls run until it returns while the torrent is not paused.
+// Pausing the torrent cancels the context of run, which is called again
+// once the torrent is resumed.
+func (t *Torrent) unlessPaused(ctx context.Context, run func(ctx context.Context) error) error {
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		t.mu.Lock()
+		resumed := t.resumed
+		if resumed == nil {
+			t.stopRun = cancel
+		}
+		t.mu.Unlock()
+
+		if resumed != nil {
+			cancel()
+			t.logger().Log(logging.Info, "download paused", logging.F("torrent", t.Name))
+			select {
+			case <-resumed:
+				t.logger().Log(logging.Info, "download resumed", logging.F("torrent", t.Name))
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err := run(runCtx)
+		t.mu.Lock()
+		t.stopRun = nil
+		paused := t.resumed != nil
+		t.mu.Unlock()
+		cancel()
+		// The error of a run interrupted by Pause is the interruption
+		if err == nil || !paused || ctx.Err() != nil {
+			return err
+		}
+	}
+}
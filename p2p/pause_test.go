@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseResume(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.EndgameThreshold = -1
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	to.Peers = []peer.Peer{fp.Peer}
+
+	// The peer holds the third piece until the download is paused, once
+	// the first two are stored
+	var mu sync.Mutex
+	var dropped int
+	stored := make(chan struct{}, 4)
+	to.OnEvent = func(ev Event) {
+		switch ev.(type) {
+		case PieceCompleted:
+			stored <- struct{}{}
+		case PeerDropped:
+			mu.Lock()
+			dropped++
+			mu.Unlock()
+		}
+	}
+	var once sync.Once
+	paused := make(chan struct{})
+	fp.wait = func(index int) {
+		if index == 2 {
+			once.Do(func() {
+				<-stored
+				<-stored
+				to.Pause()
+				close(paused)
+			})
+		}
+	}
+
+	store := &memStore{buf: make([]byte, to.Length)}
+	done := make(chan error, 1)
+	go func() {
+		done <- to.Download(context.Background(), store)
+	}()
+
+	<-paused
+	assert.True(t, to.Paused())
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return dropped == 1
+	}, time.Second, time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("download returned while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The pieces verified before pausing are kept
+	assert.Equal(t, 2, len(to.MissingPieces()))
+
+	to.Resume()
+	assert.False(t, to.Paused())
+	require.Nil(t, <-done)
+	assert.Equal(t, data, store.buf)
+	fp.mu.Lock()
+	assert.Equal(t, 2, fp.conns)
+	fp.mu.Unlock()
+}
+
+func TestPauseBeforeDownload(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(2))
+	to.Peers = []peer.Peer{fp.Peer}
+	to.Pause()
+	to.Pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &memStore{buf: make([]byte, to.Length)}
+	done := make(chan error, 1)
+	go func() {
+		done <- to.Download(ctx, store)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("download returned while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fp.mu.Lock()
+	assert.Equal(t, 0, fp.conns)
+	fp.mu.Unlock()
+
+	to.Resume()
+	to.Resume()
+	require.Nil(t, <-done)
+	assert.Equal(t, data, store.buf)
+}
+
+func TestPauseCanceled(t *testing.T) {
+	_, to := newTestTorrent(MaxBlockSize, MaxBlockSize)
+	to.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := to.Download(ctx, &memStore{buf: make([]byte, to.Length)})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
@@ -0,0 +1,216 @@
+package p2p
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// PeerInfo is a snapshot of a connection with a peer
+type PeerInfo struct {
+	Peer peer.Peer
+	ID   [20]byte
+	// Client and Version identify the software of the peer from its ID, see
+	// peer.Identify. Both are empty if unknown.
+	Client  string
+	Version string
+	// Incoming is set for the peers that connected to us
+	Incoming bool
+	// DownloadRate and UploadRate are the block data exchanged with the peer
+	// per second, over the last client.RateWindow
+	DownloadRate float64
+	UploadRate   float64
+	// AmChoking and AmInterested are our choke and interest states toward
+	// the peer, PeerChoking and PeerInterested its states toward us
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+	// Pieces is the number of pieces the peer is known to have
+	Pieces int
+}
+
+// peerConn holds the state of a connection with a peer reported by
+// ConnectedPeers, updated by the goroutine handling the connection. Its
+// methods do nothing on a nil peerConn.
+type peerConn struct {
+	c        *client.Client
+	incoming bool
+	choker   *choker // decides whether we choke the peer, nil if nothing is served
+	total    int     // number of pieces of the torrent
+
+	mu             sync.Mutex
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	has            bitfield.Bitfield
+	pieces         int
+}
+
+// addConn records a connection for ConnectedPeers, until removeConn is called
+func (t *Torrent) addConn(c *client.Client, incoming bool, ch *choker) *peerConn {
+	pc := &peerConn{
+		c:           c,
+		incoming:    incoming,
+		choker:      ch,
+		total:       len(t.PieceHashes),
+		peerChoking: true,
+		has:         bitfield.New(len(t.PieceHashes)),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[*client.Client]*peerConn)
+	}
+	t.conns[c] = pc
+	return pc
+}
+
+func (t *Torrent) removeConn(c *client.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// receivedRate returns the rate we download from the peer of a connection,
+// over all our connections with it, as a peer connecting to us is usually
+// downloaded from over the connection we opened
+func (t *Torrent) receivedRate(c chokedPeer) float64 {
+	cl, ok := c.(*client.Client)
+	if !ok {
+		return c.DownloadRate()
+	}
+	id := cl.RemoteID()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rate := 0.0
+	for other := range t.conns {
+		if other.RemoteID() == id {
+			rate += other.DownloadRate()
+		}
+	}
+	return rate
+}
+
+// setInterest records our interest and the choke and interest states of the
+// peer
+func (pc *peerConn) setInterest(amInterested, peerChoking, peerInterested bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.amInterested = amInterested
+	pc.peerChoking = peerChoking
+	pc.peerInterested = peerInterested
+}
+
+// setAmInterested records our interest in the pieces of the peer
+func (pc *peerConn) setAmInterested(interested bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.amInterested = interested
+}
+
+// setChoking records whether the peer chokes us
+func (pc *peerConn) setChoking(choking bool) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.peerChoking = choking
+}
+
+// setInterested records whether the peer is interested in our pieces
+func (pc *peerConn) setInterested(interested bool) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.peerInterested = interested
+}
+
+// haveBitfield records the pieces of a bitfield of the peer
+func (pc *peerConn) haveBitfield(bf bitfield.Bitfield) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for index := 0; index < pc.total; index++ {
+		if bf.HasPiece(index) {
+			pc.setPiece(index)
+		}
+	}
+}
+
+// have records a piece the peer announced
+func (pc *peerConn) have(index int) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.setPiece(index)
+}
+
+// state returns a copy of the pieces of the peer, and whether it chokes us
+func (pc *peerConn) state() (bitfield.Bitfield, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	has := make(bitfield.Bitfield, len(pc.has))
+	copy(has, pc.has)
+	return has, pc.peerChoking
+}
+
+// setPiece counts a piece of the peer once. The lock must be held.
+func (pc *peerConn) setPiece(index int) {
+	if index < 0 || index >= pc.total || pc.has.HasPiece(index) {
+		return
+	}
+	pc.has.SetPiece(index)
+	pc.pieces++
+}
+
+// info returns a snapshot of the connection
+func (pc *peerConn) info() PeerInfo {
+	id := pc.c.RemoteID()
+	name, version := peer.Identify(id)
+	info := PeerInfo{
+		Peer:         pc.c.Peer(),
+		ID:           id,
+		Client:       name,
+		Version:      version,
+		Incoming:     pc.incoming,
+		DownloadRate: pc.c.DownloadRate(),
+		UploadRate:   pc.c.UploadRate(),
+		AmChoking:    pc.choker == nil || !pc.choker.isUnchoked(pc.c),
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	info.AmInterested = pc.amInterested
+	info.PeerChoking = pc.peerChoking
+	info.PeerInterested = pc.peerInterested
+	info.Pieces = pc.pieces
+	return info
+}
+
+// ConnectedPeers returns a snapshot of the connections with peers,
+// downloading or being served, ordered by address. The connections of
+// SplitPieces are not reported.
+func (t *Torrent) ConnectedPeers() []PeerInfo {
+	t.mu.Lock()
+	conns := make([]*peerConn, 0, len(t.conns))
+	for _, pc := range t.conns {
+		conns = append(conns, pc)
+	}
+	t.mu.Unlock()
+
+	infos := make([]PeerInfo, len(conns))
+	for i, pc := range conns {
+		infos[i] = pc.info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Peer.String() < infos[j].Peer.String()
+	})
+	return infos
+}
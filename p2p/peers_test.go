@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectedPeersDownloading(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	copy(fp.id[:], "-qB4250-")
+	release := make(chan struct{})
+	fp.wait = func(int) { <-release }
+	to.Peers = []peer.Peer{fp.Peer}
+
+	downloaded := make(chan error, 1)
+	go func() {
+		_, err := downloadBytes(&to)
+		downloaded <- err
+	}()
+
+	require.Eventually(t, func() bool { return len(to.ConnectedPeers()) == 1 }, 5*time.Second, time.Millisecond)
+	info := to.ConnectedPeers()[0]
+	assert.Equal(t, fp.Peer.String(), info.Peer.String())
+	assert.Equal(t, fp.id, info.ID)
+	assert.Equal(t, "qBittorrent", info.Client)
+	assert.Equal(t, "4.2.5.0", info.Version)
+	assert.False(t, info.Incoming)
+	assert.True(t, info.AmInterested)
+	// Nothing is served while only downloading
+	assert.True(t, info.AmChoking)
+	assert.Equal(t, 4, info.Pieces)
+
+	close(release)
+	require.Nil(t, <-downloaded)
+	assert.Empty(t, to.ConnectedPeers())
+}
+
+func TestConnectedPeersSeeding(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(4*pieceLength, pieceLength)
+	p, _ := startSeeder(t, &seeder, data)
+
+	peerID := [20]byte{}
+	copy(peerID[:], "-UT3550-")
+	c, err := client.New(context.Background(), p, peerID, seeder.InfoHash, client.WithPieces(4))
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	require.Nil(t, c.SendInterested())
+	require.Nil(t, c.SendHave(1))
+
+	require.Eventually(t, func() bool {
+		peers := seeder.ConnectedPeers()
+		return len(peers) == 1 && peers[0].Pieces == 1 && peers[0].PeerInterested
+	}, 5*time.Second, time.Millisecond)
+	info := seeder.ConnectedPeers()[0]
+	assert.Equal(t, "µTorrent", info.Client)
+	assert.Equal(t, "3.5.5.0", info.Version)
+	assert.True(t, info.Incoming)
+	assert.False(t, info.AmInterested)
+	assert.False(t, info.AmChoking)
+	assert.True(t, info.PeerChoking)
+
+	c.Conn.Close()
+	require.Eventually(t, func() bool { return len(seeder.ConnectedPeers()) == 0 }, 5*time.Second, time.Millisecond)
+}
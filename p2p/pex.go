@@ -0,0 +1,151 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// maxPEXPeers is the most peers added by a single ut_pex message (BEP 11)
+const maxPEXPeers = 50
+
+// pexInterval is the delay between two ut_pex messages sent to a peer
+var pexInterval = time.Minute
+
+// pexMessage lists the peers connected to and disconnected from since the
+// previous message, in the compact format
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	Added6   string `bencode:"added6,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// pexHandler exchanges the addresses of the peers we are connected to with
+// one peer (BEP 11). The peers it sends are added to the download, which
+// skips those already known.
+type pexHandler struct {
+	t    *Torrent
+	sent map[string]peer.Peer // peers advertised so far, only used by gossip
+}
+
+func (h *pexHandler) Handshake(c *client.Client, hs client.ExtensionHandshake) error {
+	return nil
+}
+
+func (h *pexHandler) Message(c *client.Client, payload []byte) error {
+	var msg pexMessage
+	err := bencode.Unmarshal(payload, &msg)
+	if err != nil {
+		return err
+	}
+	added, err := peer.Unmarshal([]byte(msg.Added))
+	if err != nil {
+		return err
+	}
+	added6, err := peer.Unmarshal6([]byte(msg.Added6))
+	if err != nil {
+		return err
+	}
+	peers := append(added, added6...)
+	if len(peers) > maxPEXPeers {
+		peers = peers[:maxPEXPeers]
+	}
+	if len(peers) > 0 {
+		h.t.AddPeers(peers)
+	}
+	return nil
+}
+
+// diff returns the message advertising the swarm to the peer, given what was
+// advertised before. It reports false if there is nothing new to send.
+func (h *pexHandler) diff(swarm []peer.Peer, self peer.Peer) (pexMessage, bool) {
+	if h.sent == nil {
+		h.sent = make(map[string]peer.Peer)
+	}
+	current := make(map[string]bool, len(swarm))
+	var added, dropped []peer.Peer
+	for _, p := range swarm {
+		key := p.String()
+		if key == self.String() {
+			continue
+		}
+		current[key] = true
+		if _, ok := h.sent[key]; !ok && len(added) < maxPEXPeers {
+			added = append(added, p)
+			h.sent[key] = p
+		}
+	}
+	for key, p := range h.sent {
+		if !current[key] {
+			dropped = append(dropped, p)
+			delete(h.sent, key)
+		}
+	}
+
+	msg := pexMessage{
+		Added:    string(peer.Marshal(added)),
+		Added6:   string(peer.Marshal6(added)),
+		Dropped:  string(peer.Marshal(dropped)),
+		Dropped6: string(peer.Marshal6(dropped)),
+	}
+	return msg, len(added) > 0 || len(dropped) > 0
+}
+
+// gossip sends the peers we are connected to every pexInterval, until the
+// context is done or the peer cannot be written to
+func (h *pexHandler) gossip(ctx context.Context, c *client.Client) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, ok := c.ExtensionID("ut_pex"); !ok {
+			continue
+		}
+		msg, ok := h.diff(h.t.swarm(), c.Peer())
+		if !ok {
+			continue
+		}
+		buf, err := bencode.Marshal(msg)
+		if err != nil {
+			return
+		}
+		err = c.SendExtension("ut_pex", buf)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// swarm returns the addresses of the peers the download is connected to
+func (t *Torrent) swarm() []peer.Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]peer.Peer, 0, len(t.swarmPeers))
+	for _, p := range t.swarmPeers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (t *Torrent) joinSwarm(p peer.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.swarmPeers == nil {
+		t.swarmPeers = make(map[string]peer.Peer)
+	}
+	t.swarmPeers[p.String()] = p
+}
+
+func (t *Torrent) leaveSwarm(p peer.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.swarmPeers, p.String())
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPEXDiff(t *testing.T) {
+	self := peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	a := peer.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+	b := peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+	h := &pexHandler{}
+
+	msg, ok := h.diff([]peer.Peer{self, a, b}, self)
+	assert.True(t, ok)
+	assert.Equal(t, pexMessage{
+		Added:  string(peer.Marshal([]peer.Peer{a})),
+		Added6: string(peer.Marshal6([]peer.Peer{b})),
+	}, msg)
+
+	_, ok = h.diff([]peer.Peer{self, a, b}, self)
+	assert.False(t, ok, "nothing changed")
+
+	msg, ok = h.diff([]peer.Peer{b}, self)
+	assert.True(t, ok)
+	assert.Equal(t, pexMessage{Dropped: string(peer.Marshal([]peer.Peer{a}))}, msg)
+}
+
+func TestPEXDiffLimit(t *testing.T) {
+	var swarm []peer.Peer
+	for i := 0; i < maxPEXPeers+10; i++ {
+		swarm = append(swarm, peer.Peer{IP: net.IP{10, 0, byte(i >> 8), byte(i)}, Port: 6881})
+	}
+	h := &pexHandler{}
+
+	msg, ok := h.diff(swarm, peer.Peer{})
+	assert.True(t, ok)
+	assert.Len(t, msg.Added, maxPEXPeers*6)
+	msg, ok = h.diff(swarm, peer.Peer{})
+	assert.True(t, ok)
+	assert.Len(t, msg.Added, 10*6)
+}
+
+func TestDownloadPEX(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.PEX = true
+	// Only the peer learned from the other one has every piece
+	seed := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp := newFakePeer(t, data, pieceLength, []int{0})
+	fp.mu.Lock()
+	fp.pex = []peer.Peer{fp.Peer, seed.Peer, seed.Peer}
+	fp.mu.Unlock()
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	for _, p := range []*fakePeer{fp, seed} {
+		p.mu.Lock()
+		assert.Equal(t, 1, p.conns, "known peers are not dialed again")
+		p.mu.Unlock()
+	}
+}
+
+func TestDownloadPEXPrivate(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.PEX = true
+	to.Private = true
+	other := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.mu.Lock()
+	fp.pex = []peer.Peer{other.Peer}
+	fp.mu.Unlock()
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	assert.Equal(t, 0, other.conns, "peers are not exchanged for private torrents")
+}
+
+// recordingPEX records the ut_pex messages received
+type recordingPEX chan pexMessage
+
+func (r recordingPEX) Handshake(c *client.Client, hs client.ExtensionHandshake) error {
+	return nil
+}
+
+func (r recordingPEX) Message(c *client.Client, payload []byte) error {
+	var msg pexMessage
+	err := bencode.Unmarshal(payload, &msg)
+	r <- msg
+	return err
+}
+
+func TestPEXGossip(t *testing.T) {
+	defer func(interval time.Duration) { pexInterval = interval }(pexInterval)
+	pexInterval = 10 * time.Millisecond
+
+	_, to := newTestTorrent(MaxBlockSize, MaxBlockSize)
+	connected := peer.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+	to.joinSwarm(connected)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	received := make(recordingPEX, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		a, err := client.Accept(context.Background(), conn, [20]byte{1}, to.InfoHash, bitfield.Bitfield{0x80}, client.WithExtension("ut_pex", received))
+		if err != nil {
+			return
+		}
+		for {
+			if _, err := a.Read(); err != nil {
+				return
+			}
+		}
+	}()
+
+	h := &pexHandler{t: &to}
+	addr := ln.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := client.New(context.Background(), p, to.PeerId, to.InfoHash, client.WithExtension("ut_pex", h))
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	_, err = c.Read() // extension handshake
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.gossip(ctx, c)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, pexMessage{Added: string(peer.Marshal([]peer.Peer{connected}))}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("no ut_pex message received")
+	}
+}
@@ -0,0 +1,350 @@
+package p2p
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+)
+
+// picker hands out the pieces left to download, only giving each peer a
+// piece it has, so that workers never have to put back a piece they cannot use.
+// Once few pieces are left, in endgame mode, the pieces in flight are also
+// handed out to other peers, which share the blocks received. In sequential
+// mode, peers are kept to a window of the next pieces while a connected peer
+// has the pending ones. Snubbed peers only get the pending pieces no other
+// peer has. Urgent pieces, waited for by readers, are handed out first, then
+// the pieces of high priority. Skipped pieces are not handed out.
+type picker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	pending   []*pieceWork      // pieces nobody is downloading, by index
+	inFlight  map[int]*inFlight // pieces being downloaded or verified
+	endgame   int               // pieces left below which endgame starts, 0 to disable it
+	window    int               // pieces not done yet picked in order, 0 to disable it
+	available map[int]int       // number of connected peers having each piece
+	snubbed   map[int]int       // number of connected snubbed peers having each piece
+	urgent    map[int]int       // number of readers waiting for each piece
+	priority  map[int]Priority  // priorities of the pieces not of normal priority
+	closed    bool
+}
+
+// inFlight is a piece handed out to holders peers, which download its blocks
+// together
+type inFlight struct {
+	pw      *pieceWork
+	blocks  *pieceBlocks
+	holders int
+}
+
+func newPicker(pieces []*pieceWork, endgame, window int) *picker {
+	p := &picker{
+		pending:   pieces,
+		inFlight:  make(map[int]*inFlight),
+		endgame:   endgame,
+		window:    window,
+		available: make(map[int]int),
+		snubbed:   make(map[int]int),
+		urgent:    make(map[int]int),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// pick returns the first pending piece in the bitfield, and the blocks to
+// download it into. In sequential mode, pieces past the window are only
+// returned if no piece of the window is in flight, nor pending and had by a
+// connected peer. In
+// endgame mode, a piece in flight the peer is not holding yet is returned if
+// none is pending. Otherwise, if the peer only has pieces other peers are
+// downloading or may download first, and wait is set, it waits for one of
+// them to be put back. It returns false when the peer has no piece left we
+// need now, or the picker is closed.
+func (p *picker) pick(bf bitfield.Bitfield, holding func(index int) bool, wait bool) (*pieceWork, *pieceBlocks, bool) {
+	return p.pickFor(bf, holding, wait, false)
+}
+
+// pickFor picks a piece as pick does, for a peer that may be snubbed. The
+// pending pieces other peers have are left to them, and a snubbed peer waits
+// for them as for the pieces in flight.
+func (p *picker) pickFor(bf bitfield.Bitfield, holding func(index int) bool, wait, snubbed bool) (*pieceWork, *pieceBlocks, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed {
+		end := p.windowEnd()
+		// Pieces past the window wait for those in flight in the window
+		restricted := false
+		for index := range p.inFlight {
+			if end != math.MaxInt && index <= end {
+				restricted = true
+				break
+			}
+		}
+		deferred := false
+		if len(p.urgent) > 0 || len(p.priority) > 0 {
+			// Urgent pieces go first, then the pieces of high priority
+			best := -1
+			for i, pw := range p.pending {
+				if !bf.HasPiece(pw.index) || (snubbed && p.available[pw.index] > p.snubbed[pw.index]) {
+					continue
+				}
+				if p.urgent[pw.index] > 0 {
+					best = i
+					break
+				}
+				if best < 0 && p.priority[pw.index] == PriorityHigh {
+					best = i
+				}
+			}
+			if best >= 0 {
+				return p.take(best)
+			}
+		}
+		for i, pw := range p.pending {
+			if p.skipped(pw.index) {
+				continue
+			}
+			if pw.index > end && restricted {
+				break
+			}
+			if bf.HasPiece(pw.index) {
+				if snubbed && p.available[pw.index] > p.snubbed[pw.index] {
+					deferred = true
+					continue
+				}
+				return p.take(i)
+			}
+			if end != math.MaxInt && pw.index <= end && p.available[pw.index] > 0 {
+				restricted = true
+			}
+		}
+
+		if f := p.duplicate(bf, holding); f != nil {
+			f.holders++
+			return f.pw, f.blocks, true
+		}
+
+		waiting := restricted || deferred
+		for index := range p.inFlight {
+			if bf.HasPiece(index) {
+				waiting = true
+				break
+			}
+		}
+		if !wait || !waiting {
+			return nil, nil, false
+		}
+		p.cond.Wait()
+	}
+	return nil, nil, false
+}
+
+// take hands out the pending piece at position i
+func (p *picker) take(i int) (*pieceWork, *pieceBlocks, bool) {
+	pw := p.pending[i]
+	p.pending = append(p.pending[:i], p.pending[i+1:]...)
+	f := &inFlight{pw: pw, blocks: newPieceBlocks(pw.length), holders: 1}
+	p.inFlight[pw.index] = f
+	return pw, f.blocks, true
+}
+
+// windowEnd returns the last index of the window of sequential mode, made of
+// the next wanted pieces
+func (p *picker) windowEnd() int {
+	if p.window <= 0 || p.wantedLocked() <= p.window {
+		return math.MaxInt
+	}
+	inFlight := make([]int, 0, len(p.inFlight))
+	for index := range p.inFlight {
+		inFlight = append(inFlight, index)
+	}
+	sort.Ints(inFlight)
+	// Merge the pending pieces and the ones in flight, both in order
+	end, i, j := 0, 0, 0
+	for n := 0; n < p.window; n++ {
+		for i < len(p.pending) && p.skipped(p.pending[i].index) {
+			i++
+		}
+		if j == len(inFlight) || (i < len(p.pending) && p.pending[i].index < inFlight[j]) {
+			end = p.pending[i].index
+			i++
+		} else {
+			end = inFlight[j]
+			j++
+		}
+	}
+	return end
+}
+
+// join counts the pieces of a peer connected to
+func (p *picker) join(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := 0; index < len(bf)*8; index++ {
+		if bf.HasPiece(index) {
+			p.available[index]++
+		}
+	}
+}
+
+// have counts a piece a connected peer announced, snubbed if the peer is
+func (p *picker) have(index int, snubbed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.available[index]++
+	if snubbed {
+		p.snubbed[index]++
+	}
+	p.cond.Broadcast()
+}
+
+// snub counts the pieces of a connected peer as had by a snubbed peer, or
+// stops counting them once the peer is not snubbed anymore
+func (p *picker) snub(bf bitfield.Bitfield, snubbed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delta := 1
+	if !snubbed {
+		delta = -1
+	}
+	for index := 0; index < len(bf)*8; index++ {
+		if bf.HasPiece(index) {
+			p.snubbed[index] += delta
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// leave stops counting the pieces of a peer disconnected from, which may
+// leave pieces of the window to other peers
+func (p *picker) leave(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := 0; index < len(bf)*8; index++ {
+		if bf.HasPiece(index) {
+			p.available[index]--
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// duplicate returns the piece in flight with the fewest holders the peer can
+// download as well, if the download is in endgame mode
+func (p *picker) duplicate(bf bitfield.Bitfield, holding func(index int) bool) *inFlight {
+	if p.endgame <= 0 || p.wantedLocked() > p.endgame {
+		return nil
+	}
+	var best *inFlight
+	for index, f := range p.inFlight {
+		if !bf.HasPiece(index) || holding(index) || f.blocks.complete() {
+			continue
+		}
+		if best == nil || f.holders < best.holders || (f.holders == best.holders && index < best.pw.index) {
+			best = f
+		}
+	}
+	return best
+}
+
+// put gives back a piece that could not be downloaded or verified. It is
+// pending again once no other peer downloads it. Unlike sending on a
+// channel, it never blocks the worker holding the connection.
+func (p *picker) put(pw *pieceWork) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.inFlight[pw.index]
+	if !ok || f.pw != pw {
+		return // done, or already put back by its other holders
+	}
+	f.holders--
+	if f.holders > 0 {
+		return
+	}
+	delete(p.inFlight, pw.index)
+	// A new piece of work tells it apart from the one holders may still put
+	retry := *pw
+	i := 0
+	for i < len(p.pending) && p.pending[i].index < pw.index {
+		i++
+	}
+	p.pending = append(p.pending, nil)
+	copy(p.pending[i+1:], p.pending[i:])
+	p.pending[i] = &retry
+	p.cond.Broadcast()
+}
+
+// done marks a piece as downloaded and verified
+func (p *picker) done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inFlight, index)
+	p.cond.Broadcast()
+}
+
+// prioritize adds delta readers waiting for each of the pieces, which are
+// handed out first while any reader waits for them
+func (p *picker) prioritize(indexes []int, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, index := range indexes {
+		p.urgent[index] += delta
+		if p.urgent[index] <= 0 {
+			delete(p.urgent, index)
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// setPriorities sets the priorities of the pieces not of normal priority
+func (p *picker) setPriorities(priorities map[int]Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.priority = priorities
+	p.cond.Broadcast()
+}
+
+// skipped tells whether a piece is skipped and no reader waits for it. The
+// lock must be held.
+func (p *picker) skipped(index int) bool {
+	return p.priority[index] == PrioritySkip && p.urgent[index] == 0
+}
+
+// wants tells whether a peer has a pending piece that is not skipped
+func (p *picker) wants(bf bitfield.Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pw := range p.pending {
+		if bf.HasPiece(pw.index) && !p.skipped(pw.index) {
+			return true
+		}
+	}
+	return false
+}
+
+// wanted returns the number of pieces left to download that are not
+// skipped, including the pieces in flight
+func (p *picker) wanted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wantedLocked()
+}
+
+// wantedLocked returns the number of wanted pieces. The lock must be held.
+func (p *picker) wantedLocked() int {
+	n := len(p.inFlight)
+	for _, pw := range p.pending {
+		if !p.skipped(pw.index) {
+			n++
+		}
+	}
+	return n
+}
+
+// close wakes up and turns away all the workers
+func (p *picker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
@@ -0,0 +1,310 @@
+package p2p
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPicker(n int) *picker {
+	work := make([]*pieceWork, n)
+	for i := range work {
+		work[i] = &pieceWork{index: i}
+	}
+	return newPicker(work, 0, 0)
+}
+
+// noPieces is the holding function of a peer downloading nothing yet
+func noPieces(int) bool { return false }
+
+func bitfieldOf(pieces ...int) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, 1)
+	for _, index := range pieces {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+func TestPickerDisjointPeers(t *testing.T) {
+	p := newTestPicker(6)
+	peers := []bitfield.Bitfield{bitfieldOf(0, 1, 2), bitfieldOf(3, 4), bitfieldOf(5)}
+
+	// Every pick is a piece the peer has, so nothing is ever put back
+	for round := 0; round < 3; round++ {
+		for _, bf := range peers {
+			pw, _, ok := p.pick(bf, noPieces, true)
+			if !ok {
+				continue
+			}
+			assert.True(t, bf.HasPiece(pw.index))
+			p.done(pw.index)
+		}
+	}
+	assert.Empty(t, p.pending)
+	assert.Empty(t, p.inFlight)
+}
+
+func TestPickerNothingToServe(t *testing.T) {
+	p := newTestPicker(4)
+	_, _, ok := p.pick(bitfieldOf(5, 6), noPieces, true)
+	assert.False(t, ok)
+}
+
+func TestPickerWaitsForInFlightPiece(t *testing.T) {
+	p := newTestPicker(1)
+	pw, _, ok := p.pick(bitfieldOf(0), noPieces, true)
+	require.True(t, ok)
+
+	picked := make(chan *pieceWork)
+	go func() {
+		pw, _, _ := p.pick(bitfieldOf(0), noPieces, true)
+		picked <- pw
+	}()
+
+	select {
+	case <-picked:
+		t.Fatal("piece picked while in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.put(pw)
+	assert.Equal(t, pw, <-picked)
+}
+
+func TestPickerGivesUpOnceDone(t *testing.T) {
+	p := newTestPicker(1)
+	pw, _, ok := p.pick(bitfieldOf(0), noPieces, true)
+	require.True(t, ok)
+
+	result := make(chan bool)
+	go func() {
+		_, _, ok := p.pick(bitfieldOf(0), noPieces, true)
+		result <- ok
+	}()
+	p.done(pw.index)
+	assert.False(t, <-result)
+}
+
+func TestPickerClose(t *testing.T) {
+	p := newTestPicker(1)
+	_, _, ok := p.pick(bitfieldOf(0), noPieces, true)
+	require.True(t, ok)
+
+	result := make(chan bool)
+	go func() {
+		_, _, ok := p.pick(bitfieldOf(0), noPieces, true)
+		result <- ok
+	}()
+	p.close()
+	assert.False(t, <-result)
+}
+
+func TestPickerPutKeepsOrder(t *testing.T) {
+	p := newTestPicker(3)
+	bf := bitfieldOf(0, 1, 2)
+	first, _, _ := p.pick(bf, noPieces, true)
+	second, _, _ := p.pick(bf, noPieces, true)
+	p.put(second)
+	p.put(first)
+	pw, _, _ := p.pick(bf, noPieces, true)
+	assert.Equal(t, 0, pw.index)
+}
+
+func TestPickerManyRequeues(t *testing.T) {
+	const pieces, workers, failures = 50, 8, 20
+	p := newTestPicker(pieces)
+	bf := make(bitfield.Bitfield, (pieces+7)/8)
+	for i := 0; i < pieces; i++ {
+		bf.SetPiece(i)
+	}
+
+	// Each piece is put back a number of times before being done
+	var mu sync.Mutex
+	attempts := make(map[int]int)
+	finished := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				pw, _, ok := p.pick(bf, noPieces, true)
+				if !ok {
+					return
+				}
+				mu.Lock()
+				attempts[pw.index]++
+				failed := attempts[pw.index] <= failures
+				mu.Unlock()
+				if failed {
+					p.put(pw)
+				} else {
+					p.done(pw.index)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers blocked putting pieces back")
+	}
+	for i := 0; i < pieces; i++ {
+		assert.Equal(t, failures+1, attempts[i])
+	}
+}
+
+func TestPickerSequential(t *testing.T) {
+	work := make([]*pieceWork, 20)
+	for i := range work {
+		work[i] = &pieceWork{index: i, length: 1}
+	}
+	p := newPicker(work, 0, 4)
+	all := make(bitfield.Bitfield, 3)
+	for i := 0; i < 20; i++ {
+		all.SetPiece(i)
+	}
+	late := make(bitfield.Bitfield, 3)
+	late.SetPiece(10)
+
+	// Nobody has the window yet: the late pieces are downloaded meanwhile
+	pw, _, ok := p.pick(late, noPieces, false)
+	require.True(t, ok)
+	assert.Equal(t, 10, pw.index)
+	p.put(pw)
+
+	// Once a peer has the window, it is downloaded first
+	p.join(all)
+	_, _, ok = p.pick(late, noPieces, false)
+	assert.False(t, ok)
+	for i := 0; i < 4; i++ {
+		pw, _, ok := p.pick(all, noPieces, false)
+		require.True(t, ok)
+		assert.Equal(t, i, pw.index)
+	}
+	// The window is in flight, it moves once its first piece is done
+	_, _, ok = p.pick(all, noPieces, false)
+	assert.False(t, ok)
+	p.done(0)
+	pw, _, ok = p.pick(all, noPieces, false)
+	require.True(t, ok)
+	assert.Equal(t, 4, pw.index)
+}
+
+func TestPickerSequentialLeave(t *testing.T) {
+	work := make([]*pieceWork, 20)
+	for i := range work {
+		work[i] = &pieceWork{index: i, length: 1}
+	}
+	p := newPicker(work, 0, 4)
+	window := bitfieldOf(0, 1, 2, 3)
+	p.join(window)
+	late := make(bitfield.Bitfield, 3)
+	late.SetPiece(10)
+
+	picked := make(chan *pieceWork)
+	go func() {
+		pw, _, _ := p.pick(late, noPieces, true)
+		picked <- pw
+	}()
+	select {
+	case <-picked:
+		t.Fatal("piece picked past the window")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The peer having the window disconnects
+	p.leave(window)
+	assert.Equal(t, 10, (<-picked).index)
+}
+
+func TestPickerSnubbed(t *testing.T) {
+	p := newTestPicker(3)
+	snubbed, other := bitfieldOf(0, 1), bitfieldOf(0)
+	p.join(snubbed)
+	p.join(other)
+	p.snub(snubbed, true)
+
+	// The piece the other peer has is left to it
+	pw, _, ok := p.pickFor(snubbed, noPieces, false, true)
+	require.True(t, ok)
+	assert.Equal(t, 1, pw.index)
+	_, _, ok = p.pickFor(snubbed, noPieces, false, true)
+	assert.False(t, ok)
+
+	// Once the other peer leaves, or the peer is not snubbed anymore, it is
+	// the peer's to download
+	p.leave(other)
+	pw, _, ok = p.pickFor(snubbed, noPieces, false, true)
+	require.True(t, ok)
+	assert.Equal(t, 0, pw.index)
+	p.put(pw)
+	p.join(other)
+	p.snub(snubbed, false)
+	pw, _, ok = p.pickFor(snubbed, noPieces, false, false)
+	require.True(t, ok)
+	assert.Equal(t, 0, pw.index)
+}
+
+func TestPickerUrgent(t *testing.T) {
+	work := make([]*pieceWork, 20)
+	for i := range work {
+		work[i] = &pieceWork{index: i, length: 1}
+	}
+	p := newPicker(work, 0, 4)
+	all := make(bitfield.Bitfield, 3)
+	for i := 0; i < 20; i++ {
+		all.SetPiece(i)
+	}
+	p.join(all)
+
+	// The pieces waited for go first, even past the sequential window
+	p.prioritize([]int{15, 12}, 1)
+	for _, index := range []int{12, 15} {
+		pw, _, ok := p.pick(all, noPieces, false)
+		require.True(t, ok)
+		assert.Equal(t, index, pw.index)
+		p.done(pw.index)
+	}
+	p.prioritize([]int{15, 12}, -1)
+	assert.Empty(t, p.urgent)
+
+	p.prioritize([]int{18}, 1)
+	p.prioritize([]int{18}, -1)
+	pw, _, ok := p.pick(all, noPieces, false)
+	require.True(t, ok)
+	assert.Equal(t, 0, pw.index)
+}
+
+func TestPickerPriorities(t *testing.T) {
+	p := newTestPicker(6)
+	p.setPriorities(map[int]Priority{0: PrioritySkip, 1: PrioritySkip, 4: PriorityHigh})
+	all := bitfieldOf(0, 1, 2, 3, 4, 5)
+	assert.Equal(t, 4, p.wanted())
+
+	// The pieces of high priority go first, the skipped ones are left out
+	for _, index := range []int{4, 2, 3, 5} {
+		pw, _, ok := p.pick(all, noPieces, false)
+		require.True(t, ok)
+		assert.Equal(t, index, pw.index)
+		p.done(pw.index)
+	}
+	_, _, ok := p.pick(all, noPieces, false)
+	assert.False(t, ok)
+	assert.Equal(t, 0, p.wanted())
+
+	// A reader waiting for a skipped piece still gets it
+	p.prioritize([]int{1}, 1)
+	assert.Equal(t, 1, p.wanted())
+	pw, _, ok := p.pick(all, noPieces, false)
+	require.True(t, ok)
+	assert.Equal(t, 1, pw.index)
+}
@@ -0,0 +1,183 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+)
+
+// ErrNoStore is returned by Verify before the torrent has a store
+var ErrNoStore = errors.New("torrent has no store")
+
+// PieceRange returns the byte range [begin, end) of a piece in the torrent
+func (t *Torrent) PieceRange(index int) (begin, end int) {
+	return t.calcultateBoundsForPiece(index)
+}
+
+// MissingPieces returns the indexes of the pieces not stored yet, in order
+func (t *Torrent) MissingPieces() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var missing []int
+	for index := range t.PieceHashes {
+		if !t.have.HasPiece(index) {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+// Bitfield returns a copy of the pieces stored
+func (t *Torrent) Bitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bf := bitfield.New(len(t.PieceHashes))
+	copy(bf, t.have)
+	return bf
+}
+
+// hasPiece tells if a piece has been stored
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.have.HasPiece(index)
+}
+
+// complete records that a piece has been stored, and tells the peers we
+// seed to about it
+func (t *Torrent) complete(index int) {
+	length := t.calculatePieceSize(index)
+	atomic.AddInt64(&t.completed, int64(length))
+	t.metrics().AddCounter(MetricPiecesCompleted, 1)
+	t.metrics().AddCounter(MetricDownloadedBytes, int64(length))
+	t.mu.Lock()
+	if t.have == nil {
+		t.have = bitfield.New(len(t.PieceHashes))
+	}
+	if !t.have.HasPiece(index) {
+		t.have.SetPiece(index)
+		t.stored++
+	}
+	t.notifyStoredLocked()
+	stored := t.stored
+	finished := false
+	if atomic.LoadInt64(&t.completed) >= int64(t.Length) && !t.downloaded {
+		t.downloaded = true
+		close(t.finishedLocked())
+		finished = true
+	}
+	seeding := t.seeding
+	t.mu.Unlock()
+
+	if seeding != nil {
+		seeding.have(index)
+	}
+	if t.OnPieceStored != nil {
+		t.OnPieceStored(index)
+	}
+	t.emit(PieceCompleted{Index: index, Completed: stored, Total: len(t.PieceHashes)})
+	if finished {
+		t.emit(DownloadCompleted{Length: t.Length})
+	}
+}
+
+// finishedLocked returns the channel closed when the download completes. The
+// lock must be held.
+func (t *Torrent) finishedLocked() chan struct{} {
+	if t.finished == nil {
+		t.finished = make(chan struct{})
+	}
+	return t.finished
+}
+
+// ResumeFrom marks the pieces of the bitfield as stored by a previous run,
+// so that downloads skip them. It must be called before downloading.
+func (t *Torrent) ResumeFrom(bf bitfield.Bitfield) {
+	for index := range t.PieceHashes {
+		if bf.HasPiece(index) {
+			t.restore(index)
+		}
+	}
+}
+
+// VerifyStore hashes the data already in the store and marks the intact
+// pieces as stored, so that downloads skip them. It returns their number.
+// It must be called before downloading.
+func (t *Torrent) VerifyStore(ra io.ReaderAt) int {
+	t.SetStore(ra)
+	found, _ := t.Verify(context.Background())
+	return found
+}
+
+// SetStore sets the data of the torrent, read by Verify and the readers of
+// NewReader, e.g. to verify data without downloading. Download sets it too.
+func (t *Torrent) SetStore(store io.ReaderAt) {
+	t.setStore(store)
+}
+
+// Verify hashes all the data of the store again, the one of SetStore or of
+// the last download, and rebuilds the pieces stored from it: the intact ones
+// are marked stored and the others missing, for the next download to fetch
+// them again. It returns the number of intact pieces, or ctx.Err() if ctx is
+// done first, leaving the pieces not hashed yet as they were. It must not be
+// called while downloading.
+func (t *Torrent) Verify(ctx context.Context) (int, error) {
+	t.mu.Lock()
+	store := t.store
+	t.mu.Unlock()
+	if store == nil {
+		return 0, ErrNoStore
+	}
+
+	found := 0
+	for index, hash := range t.PieceHashes {
+		if err := ctx.Err(); err != nil {
+			return found, err
+		}
+		begin, end := t.calcultateBoundsForPiece(index)
+		buf := make([]byte, end-begin)
+		_, err := store.ReadAt(buf, int64(begin))
+		if err == nil && checkIntegrity(&pieceWork{index, hash, len(buf)}, buf) == nil {
+			t.restore(index)
+			found++
+		} else {
+			t.drop(index)
+		}
+	}
+	return found, nil
+}
+
+// drop records that a piece stored before is missing, found damaged by
+// Verify
+func (t *Torrent) drop(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.have.HasPiece(index) {
+		return
+	}
+	t.have.ClearPiece(index)
+	t.stored--
+	atomic.AddInt64(&t.completed, -int64(t.calculatePieceSize(index)))
+	if t.downloaded {
+		// The download completes again once the piece is stored again
+		t.downloaded = false
+		t.finished = nil
+	}
+}
+
+// restore records a piece stored by a previous run
+func (t *Torrent) restore(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.have == nil {
+		t.have = bitfield.New(len(t.PieceHashes))
+	}
+	if !t.have.HasPiece(index) {
+		t.have.SetPiece(index)
+		t.stored++
+		atomic.AddInt64(&t.completed, int64(t.calculatePieceSize(index)))
+	}
+}
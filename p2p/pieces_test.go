@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceRange(t *testing.T) {
+	to := Torrent{PieceHashes: make([][20]byte, 3), PieceLength: 100, Length: 250}
+	tests := map[string]struct {
+		index int
+		begin int
+		end   int
+	}{
+		"first piece":      {0, 0, 100},
+		"middle piece":     {1, 100, 200},
+		"short last piece": {2, 200, 250},
+	}
+
+	for name, test := range tests {
+		begin, end := to.PieceRange(test.index)
+		assert.Equal(t, test.begin, begin, name)
+		assert.Equal(t, test.end, end, name)
+	}
+}
+
+func TestMissingPieces(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength-10, pieceLength)
+	assert.Equal(t, []int{0, 1, 2, 3}, to.MissingPieces())
+
+	fp := newFakePeer(t, data, pieceLength, []int{0, 2})
+	to.Peers = []peer.Peer{fp.Peer}
+	ctx, cancel := context.WithCancel(context.Background())
+	stored := 0
+	err := to.download(ctx, func(index int, piece []byte) error {
+		stored++
+		if stored == 2 {
+			cancel()
+		}
+		return nil
+	})
+	require.NotNil(t, err)
+	assert.Equal(t, []int{1, 3}, to.MissingPieces())
+}
+
+func TestResume(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength-10, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	to.Peers = []peer.Peer{fp.Peer}
+	var stored []int
+	to.OnPieceStored = func(index int) { stored = append(stored, index) }
+
+	// Pieces 0 and 2 were stored by a previous run
+	store := &memStore{buf: make([]byte, len(data))}
+	copy(store.buf[0:pieceLength], data[0:pieceLength])
+	copy(store.buf[2*pieceLength:3*pieceLength], data[2*pieceLength:3*pieceLength])
+	to.ResumeFrom(bitfield.Bitfield{0xa0})
+	assert.Equal(t, []int{1, 3}, to.MissingPieces())
+	assert.Equal(t, int64(2*pieceLength), atomic.LoadInt64(&to.completed))
+
+	err := to.Download(context.Background(), store)
+	require.Nil(t, err)
+	assert.Equal(t, data, store.buf)
+	assert.ElementsMatch(t, []int{1, 3}, stored)
+	assert.Equal(t, 2, fp.requestCount())
+
+	// Nothing is left to download
+	err = to.Download(context.Background(), store)
+	require.Nil(t, err)
+	assert.Equal(t, 2, fp.requestCount())
+}
+
+func TestVerifyStore(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength-10, pieceLength)
+
+	store := &memStore{buf: append([]byte(nil), data...)}
+	store.buf[2*pieceLength+5] ^= 0xff
+	assert.Equal(t, 3, to.VerifyStore(store))
+	assert.Equal(t, []int{2}, to.MissingPieces())
+}
+
+func TestVerify(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength-10, pieceLength)
+	_, err := to.Verify(context.Background())
+	assert.Equal(t, ErrNoStore, err)
+
+	// The pieces are stored by a download, then one is damaged on disk
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	to.Peers = []peer.Peer{fp.Peer}
+	store := &memStore{buf: make([]byte, to.Length)}
+	require.Nil(t, to.Download(context.Background(), store))
+	store.buf[3*pieceLength] ^= 0xff
+	found, err := to.Verify(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, 3, found)
+	assert.Equal(t, []int{3}, to.MissingPieces())
+	stats := to.Stats()
+	assert.Equal(t, 3, stats.CompletedPieces)
+	assert.Equal(t, int64(3*pieceLength), stats.Completed)
+
+	// The next download fetches the damaged piece again
+	require.Nil(t, to.Download(context.Background(), store))
+	assert.Equal(t, data, store.buf)
+	assert.Empty(t, to.MissingPieces())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = to.Verify(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, to.MissingPieces())
+}
@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// requestQueueTime is the time worth of blocks, at the measured rate of
+	// a peer, kept requested on top of its round-trip time. It lets the
+	// backlog grow as long as the peer keeps up with it.
+	requestQueueTime = time.Second
+	// rateSamplePeriod is the shortest period the throughput of a peer is
+	// sampled over
+	rateSamplePeriod = 250 * time.Millisecond
+)
+
+// pipeline sizes the backlog of requests of a peer from its throughput and
+// round-trip time, so that the requests in flight cover the bandwidth-delay
+// product of the connection. The backlog stays between min and max, and is
+// min until the throughput is measured.
+type pipeline struct {
+	min, max  int
+	blockSize int
+	rtt       time.Duration          // lowest round-trip time of a request
+	rate      float64                // bytes per second, moving average
+	sent      map[blockKey]time.Time // requests in flight by block
+	start     time.Time              // start of the current rate sample
+	bytes     int                    // bytes received during the current rate sample
+}
+
+func newPipeline(min, max, blockSize int) *pipeline {
+	if max < min {
+		max = min
+	}
+	return &pipeline{
+		min:       min,
+		max:       max,
+		blockSize: blockSize,
+		sent:      make(map[blockKey]time.Time),
+	}
+}
+
+// requested records a request sent at now
+func (p *pipeline) requested(key blockKey, now time.Time) {
+	p.sent[key] = now
+	if p.start.IsZero() {
+		p.start = now
+	}
+}
+
+// forget drops a request that will not be answered, such as a cancelled one
+func (p *pipeline) forget(key blockKey) {
+	delete(p.sent, key)
+}
+
+// received records a block of n bytes received at now, and returns the time
+// since it was requested, 0 if unknown
+func (p *pipeline) received(key blockKey, n int, now time.Time) (latency time.Duration) {
+	if sent, ok := p.sent[key]; ok {
+		delete(p.sent, key)
+		latency = now.Sub(sent)
+		if p.rtt == 0 || latency < p.rtt {
+			p.rtt = latency
+		}
+	}
+
+	p.bytes += n
+	elapsed := now.Sub(p.start)
+	if elapsed < rateSamplePeriod {
+		return latency
+	}
+	sample := float64(p.bytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = (p.rate + sample) / 2
+	}
+	p.start, p.bytes = now, 0
+	return latency
+}
+
+// backlog returns the number of requests to keep in flight for each of the
+// given number of pieces downloaded from the peer
+func (p *pipeline) backlog(pieces int) int {
+	if p.rate == 0 || pieces == 0 {
+		return p.min
+	}
+	window := p.rate * (p.rtt + requestQueueTime).Seconds() / float64(p.blockSize)
+	backlog := int(math.Ceil(window / float64(pieces)))
+	if backlog < p.min {
+		return p.min
+	}
+	if backlog > p.max {
+		return p.max
+	}
+	return backlog
+}
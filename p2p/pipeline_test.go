@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineBacklog(t *testing.T) {
+	p := newPipeline(5, 64, 1000)
+	assert.Equal(t, 5, p.backlog(1))
+
+	// 10 blocks of 1000 bytes in 100ms, answered after 10ms each
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		p.requested(blockKey{0, i}, now)
+		p.received(blockKey{0, i}, 1000, now.Add(10*time.Millisecond))
+		now = now.Add(10 * time.Millisecond)
+	}
+	assert.Equal(t, 10*time.Millisecond, p.rtt)
+	assert.InDelta(t, 100000, p.rate, 1)
+	// 100 kB/s over 1.01s is 101 blocks of 1000 bytes, capped by max
+	assert.Equal(t, 64, p.backlog(1))
+	assert.Equal(t, 51, p.backlog(2))
+
+	// Slow peers keep the smallest backlog
+	p = newPipeline(5, 64, 16384)
+	now = time.Now()
+	p.requested(blockKey{0, 0}, now)
+	p.received(blockKey{0, 0}, 100, now.Add(time.Second))
+	assert.Equal(t, 5, p.backlog(1))
+
+	// A ceiling below the smallest backlog keeps it fixed
+	p = newPipeline(5, 2, 1000)
+	p.rate, p.rtt = 1e9, time.Second
+	assert.Equal(t, 5, p.backlog(1))
+}
+
+func TestPipelineForget(t *testing.T) {
+	p := newPipeline(5, 64, 1000)
+	now := time.Now()
+	p.requested(blockKey{0, 0}, now)
+	p.forget(blockKey{0, 0})
+	p.received(blockKey{0, 0}, 1000, now.Add(time.Millisecond))
+	assert.Zero(t, p.rtt)
+	assert.Empty(t, p.sent)
+}
+
+func TestDownloadGrowsBacklog(t *testing.T) {
+	pieceLength := 16 * MaxBlockSize
+	data, to := newTestTorrent(16*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.EndgameThreshold = -1
+	to.BacklogCeiling = 12
+	fp := newFakePeer(t, data, pieceLength, allPieces(16))
+	fp.wait = func(int) { time.Sleep(2 * time.Millisecond) }
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	assert.Greater(t, fp.maxOutstanding, MaxBacklog)
+	assert.LessOrEqual(t, fp.maxOutstanding, 12)
+}
@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"fmt"
+)
+
+// Priority is the priority of a file of the torrent
+type Priority int
+
+const (
+	// PrioritySkip does not download a file, except for the pieces it shares
+	// with wanted files
+	PrioritySkip Priority = -1
+	// PriorityNormal downloads a file
+	PriorityNormal Priority = 0
+	// PriorityHigh downloads a file before the files of normal priority
+	PriorityHigh Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+// SetFilePriority sets the priority of the file at index in WebFiles, or of
+// the only file of a single-file torrent at index 0. It can be called while
+// downloading: the download returns once the pieces left are skipped.
+func (t *Torrent) SetFilePriority(index int, p Priority) error {
+	if _, _, err := t.fileBounds(index); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	files := len(t.WebFiles)
+	if files == 0 {
+		files = 1
+	}
+	priorities := make([]Priority, files)
+	copy(priorities, t.FilePriorities)
+	priorities[index] = p
+	t.FilePriorities = priorities
+	if t.picker != nil {
+		t.picker.setPriorities(t.piecePrioritiesLocked())
+		select {
+		case t.priorities <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// piecePrioritiesLocked returns the priorities of the pieces that are not of
+// normal priority. A piece shared by several files takes the highest of their
+// priorities, so that it is only skipped if all of them are. Padding files
+// are left out. The lock must be held.
+func (t *Torrent) piecePrioritiesLocked() map[int]Priority {
+	if len(t.FilePriorities) == 0 {
+		return nil
+	}
+	files := t.WebFiles
+	if len(files) == 0 {
+		files = []WebFile{{Length: int64(t.Length)}}
+	}
+	pieces := make(map[int]Priority)
+	off := int64(0)
+	for i, f := range files {
+		begin := off
+		off += f.Length
+		if f.Length == 0 || f.Padding {
+			continue
+		}
+		p := PriorityNormal
+		if i < len(t.FilePriorities) {
+			p = t.FilePriorities[i]
+		}
+		first := int(begin / int64(t.PieceLength))
+		last := int((off - 1) / int64(t.PieceLength))
+		for index := first; index <= last; index++ {
+			if current, ok := pieces[index]; !ok || p > current {
+				pieces[index] = p
+			}
+		}
+	}
+	for index, p := range pieces {
+		if p == PriorityNormal {
+			delete(pieces, index)
+		}
+	}
+	return pieces
+}
+
+// partialSeed tells if the torrent has every piece of the files not skipped
+// but not the others, so that it only uploads (BEP 21)
+func (t *Torrent) partialSeed() bool {
+	return !t.isComplete() && t.wantedLeft() == 0
+}
+
+// wantedLeft returns the length of the pieces left to download that are
+// not skipped
+func (t *Torrent) wantedLeft() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	priorities := t.piecePrioritiesLocked()
+	left := int64(0)
+	for index := range t.PieceHashes {
+		if !t.have.HasPiece(index) && priorities[index] != PrioritySkip {
+			left += int64(t.calculatePieceSize(index))
+		}
+	}
+	return left
+}
@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPiecePriorities(t *testing.T) {
+	// piece 4 with c, padded to the end of the torrent
+	// piece 4 with c, which ends the torrent
+	files := []WebFile{{Length: 25}, {Length: 20}, {Length: 0}, {Length: 10}, {Length: 5, Padding: true}}
+	tests := map[string]struct {
+		priorities []Priority
+		pieces     map[int]Priority
+	}{
+		"none":               {nil, nil},
+		"all normal":         {[]Priority{PriorityNormal}, map[int]Priority{}},
+		"first skipped":      {[]Priority{PrioritySkip}, map[int]Priority{0: PrioritySkip, 1: PrioritySkip}},
+		"middle skipped":     {[]Priority{PriorityNormal, PrioritySkip}, map[int]Priority{3: PrioritySkip}},
+		"shared with high":   {[]Priority{PrioritySkip, PriorityHigh}, map[int]Priority{0: PrioritySkip, 1: PrioritySkip, 2: PriorityHigh, 3: PriorityHigh, 4: PriorityHigh}},
+		"all skipped":        {[]Priority{PrioritySkip, PrioritySkip, PriorityNormal, PrioritySkip}, map[int]Priority{0: PrioritySkip, 1: PrioritySkip, 2: PrioritySkip, 3: PrioritySkip, 4: PrioritySkip, 5: PrioritySkip}},
+		"empty file ignored": {[]Priority{PrioritySkip, PrioritySkip, PriorityHigh, PrioritySkip}, map[int]Priority{0: PrioritySkip, 1: PrioritySkip, 2: PrioritySkip, 3: PrioritySkip, 4: PrioritySkip, 5: PrioritySkip}},
+		"padding ignored":    {[]Priority{PriorityNormal, PriorityNormal, PriorityNormal, PrioritySkip, PriorityHigh}, map[int]Priority{5: PrioritySkip}},
+	}
+
+	for name, test := range tests {
+		_, to := newTestTorrent(60, 10)
+		to.WebFiles = files
+		to.FilePriorities = test.priorities
+		assert.Equal(t, test.pieces, to.piecePrioritiesLocked(), name)
+	}
+}
+
+func TestSetFilePriority(t *testing.T) {
+	_, to := newTestTorrent(60, 10)
+	to.WebFiles = []WebFile{{Length: 25}, {Length: 35}}
+	require.Nil(t, to.SetFilePriority(1, PrioritySkip))
+	assert.Equal(t, []Priority{PriorityNormal, PrioritySkip}, to.FilePriorities)
+	assert.NotNil(t, to.SetFilePriority(2, PrioritySkip))
+
+	// Only the pieces not skipped are left
+	assert.Equal(t, int64(30), to.wantedLeft())
+	assert.Equal(t, "skip", PrioritySkip.String())
+}
+
+func TestDownloadSkipsFiles(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(8*pieceLength, pieceLength)
+	to.WebFiles = []WebFile{
+		{Path: []string{"a"}, Length: int64(3*pieceLength + 100)},
+		{Path: []string{"b"}, Length: int64(5*pieceLength - 100)},
+	}
+	to.FilePriorities = []Priority{PriorityNormal, PrioritySkip}
+	fp := newFakePeer(t, data, pieceLength, allPieces(8))
+	to.Peers = []peer.Peer{fp.Peer}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, to.Download(ctx, &memStore{buf: make([]byte, to.Length)}))
+
+	// The piece a shares with b is downloaded
+	assert.Equal(t, []int{4, 5, 6, 7}, to.MissingPieces())
+	assert.Equal(t, 4, fp.requestCount())
+}
+
+func TestSetFilePriorityWhileDownloading(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(16*pieceLength, pieceLength)
+	to.WebFiles = []WebFile{
+		{Path: []string{"a"}, Length: int64(4 * pieceLength)},
+		{Path: []string{"b"}, Length: int64(12 * pieceLength)},
+	}
+	to.FilePriorities = []Priority{PriorityHigh}
+	fp := newFakePeer(t, data, pieceLength, allPieces(16))
+	release := make(chan struct{})
+	fp.wait = func(index int) {
+		if index >= 4 {
+			<-release
+		}
+	}
+	to.Peers = []peer.Peer{fp.Peer}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	downloaded := make(chan error, 1)
+	go func() { downloaded <- to.Download(ctx, &memStore{buf: make([]byte, to.Length)}) }()
+
+	// Skipping b once a is downloaded ends the download with the pieces in
+	// flight
+	require.Eventually(t, func() bool { return to.Stats().CompletedPieces == 4 }, 5*time.Second, time.Millisecond)
+	require.Nil(t, to.SetFilePriority(1, PrioritySkip))
+	close(release)
+	select {
+	case err := <-downloaded:
+		require.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("download did not return once b was skipped")
+	}
+	assert.Less(t, to.Stats().CompletedPieces, 16)
+	assert.Equal(t, time.Duration(0), to.Stats().ETA)
+}
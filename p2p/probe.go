@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// ProbeResult describes a peer as seen during the connection setup
+type ProbeResult struct {
+	// InfoHashMatched is false if the peer answered for another torrent
+	InfoHashMatched bool
+	// PeerID is the ID the peer sent in its handshake
+	PeerID [20]byte
+	// WantedPieces is the number of pieces of the torrent the peer has
+	WantedPieces int
+	// Oddities lists protocol violations noticed, which may prevent downloading
+	Oddities []string
+}
+
+// Probe connects to a single peer, completes the handshake and reads its
+// bitfield, without downloading anything. It helps diagnosing why a peer
+// cannot be downloaded from. A peer handshaking for another torrent is
+// reported in the result rather than as an error.
+func (t *Torrent) Probe(ctx context.Context, p peer.Peer) (ProbeResult, error) {
+	opts := []client.Option{client.WithEncryption(t.Encryption)}
+	if t.Dialer != nil {
+		opts = append(opts, client.WithDialer(t.Dialer))
+	}
+	c, err := client.New(ctx, p, t.PeerId, t.InfoHash, opts...)
+	if errors.Is(err, client.ErrInfoHashMismatch) {
+		return ProbeResult{InfoHashMatched: false}, nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ProbeResult{}, ctx.Err()
+		}
+		return ProbeResult{}, err
+	}
+	defer c.Conn.Close()
+
+	result := ProbeResult{
+		InfoHashMatched: true,
+		PeerID:          c.RemoteID(),
+	}
+	for index := range t.PieceHashes {
+		if c.Bitfield.HasPiece(index) {
+			result.WantedPieces++
+		}
+	}
+
+	numPieces := len(t.PieceHashes)
+	if expected := bitfield.Length(numPieces); len(c.Bitfield) != expected {
+		result.Oddities = append(result.Oddities, fmt.Sprintf("bitfield is %d bytes long, expected %d", len(c.Bitfield), expected))
+	}
+	for index := numPieces; index < len(c.Bitfield)*8; index++ {
+		if c.Bitfield.HasPiece(index) {
+			result.Oddities = append(result.Oddities, fmt.Sprintf("bitfield has spare bit #%d set", index))
+			break
+		}
+	}
+	if c.RemoteID() == t.PeerId {
+		result.Oddities = append(result.Oddities, "peer has our own peer ID, it may be ourselves")
+	}
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbe(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(5*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, []int{0, 2, 3})
+
+	result, err := to.Probe(context.Background(), fp.Peer)
+	require.Nil(t, err)
+	assert.True(t, result.InfoHashMatched)
+	assert.Equal(t, fp.id, result.PeerID)
+	assert.Equal(t, 3, result.WantedPieces)
+	assert.Empty(t, result.Oddities)
+	assert.Equal(t, 0, fp.requestCount())
+}
+
+// redirectDialer connects to a single address whatever the address dialed,
+// as a proxy would, recording the addresses dialed
+type redirectDialer struct {
+	to     string
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *redirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mu.Unlock()
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, d.to)
+}
+
+func TestProbeDialer(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(5*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(5))
+	d := &redirectDialer{to: fp.Peer.String()}
+	to.Dialer = d
+
+	// The peer is only reachable through the dialer
+	p := peer.Peer{IP: net.IP{203, 0, 113, 5}, Port: 6881}
+	result, err := to.Probe(context.Background(), p)
+	require.Nil(t, err)
+	assert.True(t, result.InfoHashMatched)
+	assert.Equal(t, []string{"203.0.113.5:6881"}, d.dialed)
+}
+
+func TestProbeInfoHashMismatch(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(5*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(5))
+	fp.infoHash = &[20]byte{0xde, 0xad}
+
+	result, err := to.Probe(context.Background(), fp.Peer)
+	require.Nil(t, err)
+	assert.False(t, result.InfoHashMatched)
+}
+
+func TestProbeOddities(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(5*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, nil)
+	fp.bitfield = bitfield.Bitfield{0xff, 0x00}
+
+	result, err := to.Probe(context.Background(), fp.Peer)
+	require.Nil(t, err)
+	assert.Equal(t, 5, result.WantedPieces)
+	assert.Len(t, result.Oddities, 2)
+}
+
+func TestProbeUnreachable(t *testing.T) {
+	_, to := newTestTorrent(MaxBlockSize, MaxBlockSize)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := to.Probe(ctx, unreachablePeer(t))
+	assert.NotNil(t, err)
+}
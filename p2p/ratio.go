@@ -0,0 +1,74 @@
+package p2p
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+)
+
+// shareRatio returns the data uploaded per byte downloaded, or per byte held
+// when nothing was downloaded, as when seeding data we already had
+func shareRatio(uploaded, downloaded, held int64) float64 {
+	base := downloaded
+	if base == 0 {
+		base = held
+	}
+	if base <= 0 {
+		return 0
+	}
+	return float64(uploaded) / float64(base)
+}
+
+// ratio returns the share ratio of the torrent, counting the traffic of the
+// previous runs
+func (t *Torrent) ratio() float64 {
+	counters := t.counters.Snapshot()
+	return shareRatio(
+		t.PastUploaded+counters.PayloadUploaded,
+		t.PastDownloaded+counters.PayloadDownloaded,
+		atomic.LoadInt64(&t.completed),
+	)
+}
+
+// seedRatioReached tells if the torrent is complete with a share ratio of at
+// least SeedRatio, so that seeding stops
+func (t *Torrent) seedRatioReached() bool {
+	if t.SeedRatio <= 0 || !t.isComplete() {
+		return false
+	}
+	if t.ratio() < t.SeedRatio {
+		return false
+	}
+	t.logger().Log(logging.Info, "share ratio reached, stopping seeding", logging.F("torrent", t.Name), logging.F("ratio", t.SeedRatio))
+	return true
+}
+
+// stopWhenIdle stops seeding once the torrent is complete and nothing was
+// uploaded for SeedIdleTimeout, until the context is done. The time spent
+// downloading does not count as idle.
+func (s *seeder) stopWhenIdle(ctx context.Context) {
+	t := s.t
+	ticker := time.NewTicker(t.SeedIdleTimeout / 10)
+	defer ticker.Stop()
+	uploaded := atomic.LoadInt64(&s.uploaded)
+	active := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if current := atomic.LoadInt64(&s.uploaded); current != uploaded || !t.isComplete() {
+				uploaded = current
+				active = now
+				continue
+			}
+			if now.Sub(active) >= t.SeedIdleTimeout {
+				t.logger().Log(logging.Info, "idle, stopping seeding", logging.F("torrent", t.Name), logging.F("idle", t.SeedIdleTimeout))
+				s.stop()
+				return
+			}
+		}
+	}
+}
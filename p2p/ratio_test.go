@@ -0,0 +1,97 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareRatio(t *testing.T) {
+	tests := map[string]struct {
+		uploaded   int64
+		downloaded int64
+		held       int64
+		ratio      float64
+	}{
+		"nothing":             {0, 0, 0, 0},
+		"downloaded":          {50, 100, 100, 0.5},
+		"seeding what we had": {200, 0, 100, 2},
+		"partially held":      {50, 0, 25, 2},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.ratio, shareRatio(test.uploaded, test.downloaded, test.held), name)
+	}
+}
+
+func TestStatsPastTraffic(t *testing.T) {
+	_, to := newTestTorrent(4*MaxBlockSize, MaxBlockSize)
+	to.PastUploaded = 300
+	to.PastDownloaded = 200
+
+	stats := to.Stats()
+	assert.Equal(t, int64(0), stats.Uploaded)
+	assert.Equal(t, int64(300), stats.TotalUploaded)
+	assert.Equal(t, int64(200), stats.TotalDownloaded)
+	assert.Equal(t, 1.5, stats.Ratio)
+}
+
+func TestSeedFileRatio(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(4*pieceLength, pieceLength)
+	seeder.SeedRatio = 1
+	p, errs := startSeeder(t, &seeder, data)
+
+	// The seeder stops once it uploaded its data once
+	_, leecher := newTestTorrent(4*pieceLength, pieceLength)
+	leecher.Peers = []peer.Peer{p}
+	buf, err := downloadBytes(&leecher)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("seeder did not stop at its ratio")
+	}
+	assert.Equal(t, 1.0, seeder.Stats().Ratio)
+}
+
+func TestSeedFileRatioReached(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(2*pieceLength, pieceLength)
+	seeder.SeedRatio = 2
+	seeder.PastUploaded = int64(2 * len(data))
+
+	// The previous runs reached the ratio, nothing is served
+	errs := make(chan error, 1)
+	go func() {
+		errs <- seeder.SeedFile(context.Background(), bytes.NewReader(data))
+	}()
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("seeder did not stop at its ratio")
+	}
+}
+
+func TestSeedFileIdle(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(2*pieceLength, pieceLength)
+	seeder.SeedIdleTimeout = 100 * time.Millisecond
+	_, errs := startSeeder(t, &seeder, data)
+
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("seeder did not stop once idle")
+	}
+}
@@ -0,0 +1,186 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultReadahead is the data past the position of a Reader whose pieces
+// are downloaded before the others
+const DefaultReadahead = 4 * 1024 * 1024
+
+// ErrReaderClosed is returned when reading from a closed Reader
+var ErrReaderClosed = errors.New("reader closed")
+
+// Reader reads a file of the torrent while it downloads or seeds. Reads block
+// until the pieces they cover are verified, and the pieces past the position
+// of the reader are downloaded first, so that moving it with Seek shifts the
+// priorities of the download.
+type Reader struct {
+	t      *Torrent
+	off    int64 // offset of the file in the torrent data
+	length int64
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+	ahead     []int // pieces prioritized for the readahead
+	closed    bool
+}
+
+// NewReader returns a reader of the file at fileIndex in WebFiles, or of the
+// whole torrent for a single-file torrent whose only file is at index 0. It
+// reads the store of the running download, and waits for one to start.
+// Close it to stop prioritizing its pieces.
+func (t *Torrent) NewReader(fileIndex int) (*Reader, error) {
+	off, length, err := t.fileBounds(fileIndex)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Reader{t: t, off: off, length: length, ctx: ctx, cancel: cancel, readahead: DefaultReadahead}
+	r.mu.Lock()
+	r.prioritizeLocked()
+	r.mu.Unlock()
+	return r, nil
+}
+
+// fileBounds returns the offset and the length in the torrent data of the
+// file at index
+func (t *Torrent) fileBounds(index int) (int64, int64, error) {
+	if len(t.WebFiles) == 0 {
+		if index != 0 {
+			return 0, 0, fmt.Errorf("no file #%d in a single-file torrent", index)
+		}
+		return 0, int64(t.Length), nil
+	}
+	if index < 0 || index >= len(t.WebFiles) {
+		return 0, 0, fmt.Errorf("no file #%d in a torrent of %d files", index, len(t.WebFiles))
+	}
+	off := int64(0)
+	for _, f := range t.WebFiles[:index] {
+		off += f.Length
+	}
+	return off, t.WebFiles[index].Length, nil
+}
+
+// SetReadahead sets the data past the position whose pieces are downloaded
+// first, DefaultReadahead by default
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readahead = n
+	r.prioritizeLocked()
+}
+
+// Read reads from the position once the pieces read are stored. It reads at
+// most up to the end of the piece at the position, so as not to wait for
+// the next ones.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos, closed := r.pos, r.closed
+	r.mu.Unlock()
+	if closed {
+		return 0, ErrReaderClosed
+	}
+	if pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	off := r.off + pos
+	end := (off/int64(r.t.PieceLength) + 1) * int64(r.t.PieceLength)
+	if end > r.off+r.length {
+		end = r.off + r.length
+	}
+	if int64(len(p)) > end-off {
+		p = p[:end-off]
+	}
+	err := r.t.WaitRange(r.ctx, off, int64(len(p)))
+	if err == nil {
+		var store io.ReaderAt
+		store, err = r.t.waitStore(r.ctx)
+		if err == nil {
+			var n int
+			n, err = store.ReadAt(p, off)
+			if err == io.EOF && n == len(p) {
+				err = nil
+			}
+			r.mu.Lock()
+			r.pos += int64(n)
+			r.prioritizeLocked()
+			r.mu.Unlock()
+			return n, err
+		}
+	}
+	if r.ctx.Err() != nil {
+		return 0, ErrReaderClosed
+	}
+	return 0, err
+}
+
+// Seek sets the position of the next Read, and downloads the pieces past
+// it first
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.pos = offset
+	r.prioritizeLocked()
+	return offset, nil
+}
+
+// Close stops prioritizing the pieces of the reader, and interrupts the
+// reads waiting for pieces
+func (r *Reader) Close() error {
+	r.cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.t.prioritize(r.ahead, -1)
+	r.ahead = nil
+	return nil
+}
+
+// prioritizeLocked prioritizes the pieces of the readahead instead of the
+// previous ones. The lock must be held.
+func (r *Reader) prioritizeLocked() {
+	if r.closed {
+		return
+	}
+	var ahead []int
+	if r.pos < r.length && r.readahead > 0 {
+		end := r.pos + r.readahead
+		if end > r.length {
+			end = r.length
+		}
+		first := int((r.off + r.pos) / int64(r.t.PieceLength))
+		last := int((r.off + end - 1) / int64(r.t.PieceLength))
+		for index := first; index <= last; index++ {
+			if !r.t.hasPiece(index) {
+				ahead = append(ahead, index)
+			}
+		}
+	}
+	r.t.prioritize(ahead, 1)
+	r.t.prioritize(r.ahead, -1)
+	r.ahead = ahead
+}
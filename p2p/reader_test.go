@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(8*pieceLength, pieceLength)
+	to.WebFiles = []WebFile{
+		{Path: []string{"a"}, Length: int64(3*pieceLength + 100)},
+		{Path: []string{"b"}, Length: int64(5*pieceLength - 100)},
+	}
+	fp := newFakePeer(t, data, pieceLength, allPieces(8))
+	to.Peers = []peer.Peer{fp.Peer}
+
+	r, err := to.NewReader(1)
+	require.Nil(t, err)
+	defer r.Close()
+	_, err = to.NewReader(2)
+	assert.NotNil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	downloaded := make(chan error, 1)
+	go func() { downloaded <- to.Download(ctx, &memStore{buf: make([]byte, to.Length)}) }()
+
+	// Reads wait for the pieces of the file to be downloaded
+	buf, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, data[3*pieceLength+100:], buf)
+
+	pos, err := r.Seek(-10, io.SeekEnd)
+	require.Nil(t, err)
+	assert.Equal(t, int64(5*pieceLength-110), pos)
+	buf, err = ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, data[len(data)-10:], buf)
+	assert.Nil(t, <-downloaded)
+}
+
+func TestReaderSeekPrioritizes(t *testing.T) {
+	_, to := newTestTorrent(100, 10)
+	r, err := to.NewReader(0)
+	require.Nil(t, err)
+	r.SetReadahead(25)
+	urgent := func() map[int]int {
+		to.mu.Lock()
+		defer to.mu.Unlock()
+		copied := make(map[int]int)
+		for index, n := range to.urgent {
+			copied[index] = n
+		}
+		return copied
+	}
+	assert.Equal(t, map[int]int{0: 1, 1: 1, 2: 1}, urgent())
+
+	// Seeking moves the readahead, leaving out the pieces stored
+	to.complete(6)
+	_, err = r.Seek(55, io.SeekStart)
+	require.Nil(t, err)
+	assert.Equal(t, map[int]int{5: 1, 7: 1}, urgent())
+
+	_, err = r.Seek(5, io.SeekCurrent)
+	require.Nil(t, err)
+	assert.Equal(t, map[int]int{7: 1, 8: 1}, urgent())
+
+	require.Nil(t, r.Close())
+	assert.Empty(t, urgent())
+}
+
+func TestReaderClose(t *testing.T) {
+	_, to := newTestTorrent(100, 10)
+	r, err := to.NewReader(0)
+	require.Nil(t, err)
+
+	// Closing the reader interrupts a read waiting for a piece
+	read := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.Nil(t, r.Close())
+	select {
+	case err := <-read:
+		assert.Equal(t, ErrReaderClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("read did not return after closing the reader")
+	}
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, ErrReaderClosed, err)
+}
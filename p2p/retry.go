@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/handshake"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+const (
+	// DefaultPeerRetries is the number of times a peer that failed is dialed
+	// again during a download
+	DefaultPeerRetries = 3
+	// DefaultRetryBackoff is the time waited before dialing a peer again
+	// after its first failure, doubled after each of the next ones
+	DefaultRetryBackoff = 5 * time.Second
+	// MaxRetryBackoff is the longest time waited before dialing a peer again
+	MaxRetryBackoff = 2 * time.Minute
+)
+
+// protocolErrors are the failures of peers that break the protocol, or that
+// are not part of the swarm, which are not dialed again
+var protocolErrors = []error{
+	client.ErrInfoHashMismatch,
+	client.ErrPlaintextRefused,
+	handshake.ErrMalformed,
+	message.ErrMalformed,
+	message.ErrUnexpectedID,
+	message.ErrTooLong,
+	bitfield.ErrLength,
+	bitfield.ErrSpareBits,
+	ErrPieceHashMismatch,
+}
+
+// retryable tells whether a peer disconnected for reason may be dialed
+// again. Peers that timed out, went idle or dropped the connection may be
+// reachable later, unlike the ones banned, connected on another address,
+// breaking the protocol or not needed anymore.
+func retryable(reason DisconnectReason, err error) bool {
+	switch reason {
+	case ReasonIdle:
+		return true
+	case ReasonHandshakeFailed, ReasonError:
+		for _, target := range protocolErrors {
+			if errors.Is(err, target) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// peerRetries returns the number of times a peer is dialed again
+func (t *Torrent) peerRetries() int {
+	if t.PeerRetries == 0 {
+		return DefaultPeerRetries
+	}
+	if t.PeerRetries < 0 {
+		return 0
+	}
+	return t.PeerRetries
+}
+
+// retryBackoff returns the time waited before the retry-th new dial of a
+// peer, counted from 0. It doubles from RetryBackoff up to MaxRetryBackoff,
+// and is randomized by up to a half so that the peers failing together are
+// not dialed again together.
+func (t *Torrent) retryBackoff(retry int) time.Duration {
+	backoff := t.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for i := 0; i < retry && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRetryBackoff {
+		backoff = MaxRetryBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// dialDownloadWorker downloads from a peer, dialing it again with
+// exponential backoff after the transient failures, up to PeerRetries times
+func (t *Torrent) dialDownloadWorker(ctx context.Context, p peer.Peer, pieces *picker, results chan *pieceResult, hashes *hashPool) {
+	for retry := 0; ; retry++ {
+		reason, err := t.startDownloadWorker(ctx, p, pieces, results, hashes)
+		if ctx.Err() != nil || !retryable(reason, err) || retry >= t.peerRetries() {
+			return
+		}
+		backoff := t.retryBackoff(retry)
+		t.logger().Log(logging.Debug, "dialing peer again", logging.F("peer", p), logging.F("backoff", backoff), logging.F("err", err))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		if t.isBanned(p.IP) {
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := map[string]struct {
+		reason DisconnectReason
+		err    error
+		want   bool
+	}{
+		"timeout":            {ReasonHandshakeFailed, client.ErrPeerTimeout, true},
+		"connection reset":   {ReasonError, errors.New("connection reset by peer"), true},
+		"idle":               {ReasonIdle, ErrIdle, true},
+		"info hash mismatch": {ReasonHandshakeFailed, fmt.Errorf("handshake: %w", client.ErrInfoHashMismatch), false},
+		"corrupt piece":      {ReasonError, fmt.Errorf("%w: piece #1", ErrPieceHashMismatch), false},
+		"banned":             {ReasonBanned, ErrFlooding, false},
+		"duplicate":          {ReasonDuplicate, nil, false},
+		"completed":          {ReasonCompleted, nil, false},
+	}
+
+	for name, tt := range tests {
+		assert.Equal(t, tt.want, retryable(tt.reason, tt.err), name)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	to := Torrent{RetryBackoff: time.Second}
+	for retry, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		backoff := to.retryBackoff(retry)
+		assert.True(t, backoff >= want/2 && backoff <= want, "retry %d: %v", retry, backoff)
+	}
+	assert.True(t, to.retryBackoff(100) <= MaxRetryBackoff)
+}
+
+func TestDownloadRetriesPeer(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+
+	// The peer drops the first connection, as a peer restarting would
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for first := true; ; first = false {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if first {
+				conn.Close()
+				continue
+			}
+			t.Cleanup(func() { conn.Close() })
+			go fp.serve(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	flaky := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	to.Peers = []peer.Peer{flaky}
+
+	var mu sync.Mutex
+	var reasons []DisconnectReason
+	to.OnPeerDisconnect = func(p peer.Peer, r DisconnectReason, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons = append(reasons, r)
+	}
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []DisconnectReason{ReasonHandshakeFailed, ReasonCompleted}, reasons)
+}
+
+func TestDownloadPeerRetriesCapped(t *testing.T) {
+	tests := map[string]struct {
+		retries int
+		dials   int
+	}{
+		"default":  {0, 1 + DefaultPeerRetries},
+		"custom":   {1, 2},
+		"disabled": {-1, 1},
+	}
+
+	for name, tt := range tests {
+		_, to := newTestTorrent(MaxBlockSize, MaxBlockSize)
+		to.Logger = logging.Discard
+		to.Peers = []peer.Peer{unreachablePeer(t)}
+		to.PeerRetries = tt.retries
+		var mu sync.Mutex
+		dials := 0
+		to.OnPeerDisconnect = func(p peer.Peer, r DisconnectReason, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dials++
+		}
+		_, err := downloadBytes(&to)
+		assert.True(t, errors.Is(err, ErrUnsatisfiable), name)
+		mu.Lock()
+		assert.Equal(t, tt.dials, dials, name)
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,562 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/message"
+)
+
+// MaxRequestLength is the largest block a peer can request from us
+const MaxRequestLength = 128 * 1024
+
+type seeder struct {
+	t        *Torrent
+	ra       io.ReaderAt
+	choker   *choker
+	uploaded int64 // accessed atomically
+	stop     context.CancelFunc
+	cache    *readCache   // nil if disabled
+	super    *superSeeder // nil unless SuperSeed is set
+
+	mu      sync.Mutex
+	clients map[*client.Client]bool // peers being served
+}
+
+func newSeeder(t *Torrent, ra io.ReaderAt, stop context.CancelFunc) *seeder {
+	s := &seeder{
+		t:       t,
+		ra:      ra,
+		choker:  newChoker(t.UploadSlots, t.isComplete),
+		stop:    stop,
+		clients: make(map[*client.Client]bool),
+	}
+	size := t.ReadCacheSize
+	if size == 0 {
+		size = DefaultReadCacheSize
+	}
+	if size > 0 {
+		s.cache = newReadCache(size)
+	}
+	if t.SuperSeed {
+		s.super = newSuperSeeder(len(t.PieceHashes))
+	}
+	s.choker.received = t.receivedRate
+	return s
+}
+
+// SeedFile serves the complete data of the torrent read from ra to incoming
+// peers, until the context is cancelled or a limit among SeedLimit,
+// SeedRatio and SeedIdleTimeout is reached. The data is verified first
+// unless SkipVerify is set.
+func (t *Torrent) SeedFile(ctx context.Context, ra io.ReaderAt) error {
+	ctx, release, err := t.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if !t.SkipVerify {
+		err := t.verifyData(ra)
+		if err != nil {
+			return err
+		}
+	}
+
+	bf := bitfield.New(len(t.PieceHashes))
+	for index := range t.PieceHashes {
+		bf.SetPiece(index)
+	}
+	atomic.StoreInt64(&t.completed, int64(t.Length))
+	t.mu.Lock()
+	t.have = bf
+	t.stored = len(t.PieceHashes)
+	t.mu.Unlock()
+	t.setStore(ra)
+	if t.seedRatioReached() {
+		return nil
+	}
+
+	ln, err := t.listen()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return newSeeder(t, ra, cancel).run(ctx, ln)
+}
+
+// DownloadAndSeed downloads the torrent to the store while serving the pieces
+// already stored to incoming peers, and keeps seeding once the download is
+// complete, until the context is cancelled or a limit among SeedLimit,
+// SeedRatio and SeedIdleTimeout is reached. It returns the error of the
+// download, if any.
+func (t *Torrent) DownloadAndSeed(ctx context.Context, store Store) error {
+	return t.downloadAndServe(ctx, store, true)
+}
+
+// downloadAndServe downloads the torrent to the store while serving the
+// pieces already stored to incoming peers, and keeps seeding once the
+// download is complete if seed is set
+func (t *Torrent) downloadAndServe(ctx context.Context, store Store, seed bool) error {
+	ctx, release, err := t.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ln, err := t.listen()
+	if err != nil {
+		return err
+	}
+
+	seedCtx, stopSeeding := context.WithCancel(ctx)
+	defer stopSeeding()
+	s := newSeeder(t, store, stopSeeding)
+	t.mu.Lock()
+	t.seeding = s
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.seeding = nil
+		t.mu.Unlock()
+	}()
+
+	seeded := make(chan error, 1)
+	go func() {
+		seeded <- s.run(seedCtx, ln)
+	}()
+
+	err = t.Download(ctx, store)
+	if err != nil || !seed {
+		stopSeeding()
+		seedErr := <-seeded
+		if err == nil {
+			err = seedErr
+		}
+		return err
+	}
+	t.logger().Log(logging.Info, "download complete, seeding", logging.F("torrent", t.Name))
+	if t.seedRatioReached() {
+		stopSeeding()
+	}
+	return <-seeded
+}
+
+// listen returns the listener of the torrent, or listens on Port. It
+// returns no listener if the peers are handed by Incoming.
+func (t *Torrent) listen() (net.Listener, error) {
+	if t.Incoming != nil {
+		return nil, nil
+	}
+	if t.Listener != nil {
+		return t.Listener, nil
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%d", t.Port))
+}
+
+// run accepts peers on ln, or from Incoming if ln is nil, and serves them
+// until the context is cancelled
+func (s *seeder) run(ctx context.Context, ln net.Listener) error {
+	t := s.t
+	ctx, cancel := context.WithCancel(ctx)
+	var addr net.Addr
+	if ln != nil {
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+		}()
+		addr = ln.Addr()
+	} else {
+		addr = t.Incoming.Addr()
+	}
+
+	announcing := make(chan struct{})
+	go func() {
+		defer close(announcing)
+		if t.AnnounceURL != "" {
+			t.announceListening(ctx, addr)
+		}
+	}()
+	// The tracker is told about the seeding stopping before returning
+	defer func() {
+		cancel()
+		<-announcing
+	}()
+	go s.choker.run(ctx)
+	if t.SeedIdleTimeout > 0 {
+		go s.stopWhenIdle(ctx)
+	}
+
+	var wg sync.WaitGroup
+	var err error
+	if ln == nil {
+		err = t.Incoming.attach(ctx, t.InfoHash, func(in *client.Incoming) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveIncoming(ctx, in)
+			}()
+		})
+	} else {
+		err = s.accept(ctx, ln, &wg)
+	}
+	s.stop()
+	wg.Wait()
+	return err
+}
+
+// accept serves the peers connecting on ln until it is closed
+func (s *seeder) accept(ctx context.Context, ln net.Listener, wg *sync.WaitGroup) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, conn)
+		}()
+	}
+}
+
+// addClient tells a peer about the pieces stored but missing from the
+// bitfield bf it was sent, if any, and about the next ones until
+// removeClient is called
+func (s *seeder) addClient(c *client.Client, bf bitfield.Bitfield) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c] = true
+	stored := s.t.Bitfield()
+	for index := range s.t.PieceHashes {
+		if stored.HasPiece(index) && !bf.HasPiece(index) {
+			c.SendHave(index)
+		}
+	}
+}
+
+func (s *seeder) removeClient(c *client.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// servedPeer is a peer connecting to us handed to the running download, as
+// it has pieces we miss. The download reads from the connection until done
+// is closed.
+type servedPeer struct {
+	c    *client.Client
+	conn *peerConn
+	done chan struct{}
+}
+
+// download hands a served peer to the running download if it has pieces we
+// miss, and waits for the download to be done with it. It returns false if
+// the peer was not handed.
+func (s *seeder) download(c *client.Client, conn *peerConn) bool {
+	t := s.t
+	t.mu.Lock()
+	handed, done, pieces := t.handed, t.done, t.picker
+	t.mu.Unlock()
+	if handed == nil {
+		return false
+	}
+	has, choking := conn.state()
+	if !pieces.wants(has) {
+		return false
+	}
+	c.Bitfield, c.Choked = has, choking
+	sp := &servedPeer{c: c, conn: conn, done: make(chan struct{})}
+	select {
+	case handed <- sp:
+	case <-done:
+		return false
+	}
+	<-sp.done
+	return true
+}
+
+// have tells the peers being served about a piece we just stored
+func (s *seeder) have(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.SendHave(index)
+	}
+}
+
+// isComplete tells if every piece is stored
+func (t *Torrent) isComplete() bool {
+	return atomic.LoadInt64(&t.completed) >= int64(t.Length)
+}
+
+// verifyData checks the hash of every piece read from ra
+func (t *Torrent) verifyData(ra io.ReaderAt) error {
+	for index, hash := range t.PieceHashes {
+		begin, end := t.calcultateBoundsForPiece(index)
+		buf := make([]byte, end-begin)
+		_, err := ra.ReadAt(buf, int64(begin))
+		if err != nil {
+			return err
+		}
+		sum := sha1.Sum(buf)
+		if !bytes.Equal(sum[:], hash[:]) {
+			return fmt.Errorf("%w: piece #%d", ErrPieceHashMismatch, index)
+		}
+	}
+	return nil
+}
+
+// announceListening tells the tracker the port we accept peers on, then
+// announces at the interval it asks for until the context is done
+func (t *Torrent) announceListening(ctx context.Context, addr net.Addr) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		t.mu.Lock()
+		t.listenPort = uint16(tcpAddr.Port)
+		t.mu.Unlock()
+	}
+	t.reannounce(ctx)
+}
+
+// serve completes the handshake of a peer connecting on conn and serves it
+func (s *seeder) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && s.t.isBanned(addr.IP) {
+		return
+	}
+	if !s.acquire() {
+		return
+	}
+	defer s.release()
+	bf, super := s.bitfield()
+	c, err := client.Accept(ctx, conn, s.t.PeerId, s.t.InfoHash, bf, s.t.clientOptions()...)
+	if err != nil {
+		s.t.logger().Log(logging.Debug, "could not accept connection", logging.F("err", err))
+		return
+	}
+	s.serveClient(ctx, c, bf, super)
+}
+
+// serveIncoming answers the handshake of a peer handed by Incoming and
+// serves it
+func (s *seeder) serveIncoming(ctx context.Context, in *client.Incoming) {
+	defer in.Close()
+	if s.t.isBanned(in.Peer().IP) {
+		return
+	}
+	if !s.acquire() {
+		return
+	}
+	defer s.release()
+	bf, super := s.bitfield()
+	c, err := in.Accept(ctx, s.t.PeerId, bf, s.t.clientOptions()...)
+	if err != nil {
+		s.t.logger().Log(logging.Debug, "could not accept connection", logging.F("peer", in.Peer()), logging.F("err", err))
+		return
+	}
+	s.serveClient(ctx, c, bf, super)
+}
+
+// acquire counts a peer connecting against the limits of the torrent, and
+// returns false if one of them is reached
+func (s *seeder) acquire() bool {
+	peers := s.t.peerLimit()
+	if !peers.tryAcquire() {
+		return false
+	}
+	if !s.t.Conns.tryAcquire() {
+		peers.release()
+		return false
+	}
+	return true
+}
+
+// release counts a peer allowed by acquire as disconnected
+func (s *seeder) release() {
+	s.t.Conns.release()
+	s.t.peerLimit().release()
+}
+
+// bitfield returns the pieces to announce to a peer connecting, and whether
+// it is super-seeded, which it is if SuperSeed is set and the torrent is
+// complete. Super-seeded peers are told about no piece at first.
+func (s *seeder) bitfield() (bitfield.Bitfield, bool) {
+	if s.super != nil && s.t.isComplete() {
+		return bitfield.New(len(s.t.PieceHashes)), true
+	}
+	return s.t.Bitfield(), false
+}
+
+// serveClient serves a peer that was sent the bitfield bf until it
+// disconnects or the context is cancelled. A super-seeded peer is told about
+// the pieces by the super seeder.
+func (s *seeder) serveClient(ctx context.Context, c *client.Client, bf bitfield.Bitfield, super bool) {
+	if super {
+		s.super.add(c)
+		defer s.super.remove(c)
+	}
+
+	// Tell about the pieces stored during the handshake, the next ones are
+	// told about by have
+	if !super {
+		s.addClient(c, bf)
+		defer s.removeClient(c)
+	}
+	atomic.AddInt32(&s.t.served, 1)
+	defer atomic.AddInt32(&s.t.served, -1)
+	defer s.choker.remove(c)
+	conn := s.t.addConn(c, true, s.choker)
+	defer s.t.removeConn(c)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.Close()
+		case <-done:
+		}
+	}()
+	keepAlive, stop := context.WithCancel(ctx)
+	defer stop()
+	go c.KeepAlive(keepAlive, s.t.keepAliveInterval())
+
+	for {
+		msg, err := c.Read()
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case message.MsgInterested:
+			conn.setInterested(true)
+			s.choker.interested(c)
+		case message.MsgNotInterested:
+			conn.setInterested(false)
+			s.choker.remove(c)
+		case message.MsgChoke, message.MsgUnchoke:
+			conn.setChoking(msg.ID == message.MsgChoke)
+		case message.MsgHave:
+			index, err := msg.ParseHave()
+			if err != nil {
+				return
+			}
+			conn.have(index)
+			if super {
+				s.super.have(c, index)
+			} else if s.download(c, conn) && s.t.isBanned(c.Peer().IP) {
+				return
+			}
+		case message.MsgBitfield:
+			conn.haveBitfield(bitfield.Bitfield(msg.Payload))
+			if !super {
+				if s.download(c, conn) && s.t.isBanned(c.Peer().IP) {
+					return
+				}
+				continue
+			}
+			var indexes []int
+			for index := range s.t.PieceHashes {
+				if bitfield.Bitfield(msg.Payload).HasPiece(index) {
+					indexes = append(indexes, index)
+				}
+			}
+			s.super.have(c, indexes...)
+		case message.MsgRequest:
+			err := s.request(c, msg, super)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// request sends the block requested by a peer if the choker unchoked it,
+// and returns an error if the peer has to be disconnected
+func (s *seeder) request(c *client.Client, msg *message.Message, super bool) error {
+	if !s.choker.isUnchoked(c) {
+		return nil
+	}
+	index, begin, length, err := msg.ParseRequest()
+	if err != nil {
+		return err
+	}
+	// Super-seeded peers only get the pieces they were told about
+	if super && !s.super.allowed(c, index) {
+		return nil
+	}
+	block, err := s.readBlock(index, begin, length)
+	if err != nil {
+		s.t.logger().Log(logging.Warn, "invalid request, disconnecting", logging.F("peer", c.Peer()), logging.F("err", err))
+		return err
+	}
+	err = c.SendPiece(index, begin, block)
+	if err != nil {
+		return err
+	}
+	uploaded := atomic.AddInt64(&s.uploaded, int64(len(block)))
+	s.t.metrics().AddCounter(MetricUploadedBytes, int64(len(block)))
+	if s.t.SeedLimit > 0 && uploaded >= s.t.SeedLimit || s.t.seedRatioReached() {
+		s.stop()
+	}
+	return nil
+}
+
+func (s *seeder) readBlock(index, begin, length int) ([]byte, error) {
+	if index < 0 || index >= len(s.t.PieceHashes) {
+		return nil, fmt.Errorf("piece index %d out of range", index)
+	}
+	if !s.t.hasPiece(index) {
+		return nil, fmt.Errorf("piece #%d not stored yet", index)
+	}
+	if length <= 0 || length > MaxRequestLength {
+		return nil, fmt.Errorf("block length %d out of range", length)
+	}
+	if begin < 0 || begin+length > s.t.calculatePieceSize(index) {
+		return nil, fmt.Errorf("block [%d:%d] out of piece #%d", begin, begin+length, index)
+	}
+	pieceBegin, _ := s.t.calcultateBoundsForPiece(index)
+	pieceSize := s.t.calculatePieceSize(index)
+	if s.cache == nil || int64(pieceSize) > s.cache.size {
+		block := make([]byte, length)
+		_, err := s.ra.ReadAt(block, int64(pieceBegin+begin))
+		if err != nil {
+			return nil, err
+		}
+		return block, nil
+	}
+
+	// The whole piece is read, as its other blocks are requested next
+	piece, ok := s.cache.get(index)
+	if ok {
+		atomic.AddInt64(&s.t.cacheHits, 1)
+		s.t.metrics().AddCounter(MetricCacheHits, 1)
+	} else {
+		atomic.AddInt64(&s.t.cacheMisses, 1)
+		s.t.metrics().AddCounter(MetricCacheMisses, 1)
+		piece = make([]byte, pieceSize)
+		_, err := s.ra.ReadAt(piece, int64(pieceBegin))
+		if err != nil {
+			return nil, err
+		}
+		s.cache.put(index, piece)
+	}
+	return piece[begin : begin+length], nil
+}
@@ -0,0 +1,381 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startSeeder(t *testing.T, seeder *Torrent, data []byte) (peer.Peer, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	seeder.Listener = ln
+
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		errs <- seeder.SeedFile(ctx, bytes.NewReader(data))
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}, errs
+}
+
+func TestSeedFile(t *testing.T) {
+	pieceLength := 2*MaxBlockSize + 7
+	data, seeder := newTestTorrent(3*pieceLength-20, pieceLength)
+	seeder.PeerId = [20]byte{'s', 'e', 'e', 'd'}
+	p, _ := startSeeder(t, &seeder, data)
+
+	_, leecher := newTestTorrent(3*pieceLength-20, pieceLength)
+	leecher.Peers = []peer.Peer{p}
+	buf, err := downloadBytes(&leecher)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestSeedFileReadCache(t *testing.T) {
+	tests := map[string]struct {
+		size   int64
+		hits   int64
+		misses int64
+	}{
+		// The pieces of 3, 3 and 2 blocks are read once each
+		"default":  {0, 5, 3},
+		"disabled": {-1, 0, 0},
+		// The pieces are larger than the cache, so only blocks are read
+		"too small": {MaxBlockSize, 0, 0},
+	}
+
+	for name, test := range tests {
+		pieceLength := 2*MaxBlockSize + 7
+		data, seeder := newTestTorrent(3*pieceLength-20, pieceLength)
+		seeder.ReadCacheSize = test.size
+		p, _ := startSeeder(t, &seeder, data)
+
+		_, leecher := newTestTorrent(3*pieceLength-20, pieceLength)
+		leecher.Peers = []peer.Peer{p}
+		buf, err := downloadBytes(&leecher)
+		require.Nil(t, err, name)
+		assert.Equal(t, data, buf, name)
+
+		stats := seeder.Stats()
+		assert.Equal(t, test.hits, stats.CacheHits, name)
+		assert.Equal(t, test.misses, stats.CacheMisses, name)
+	}
+}
+
+func TestSeedFileLimit(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(4*pieceLength, pieceLength)
+	seeder.SeedLimit = int64(pieceLength)
+	p, errs := startSeeder(t, &seeder, data)
+
+	_, leecher := newTestTorrent(4*pieceLength, pieceLength)
+	leecher.Peers = []peer.Peer{p}
+	downloadBytes(&leecher) // the seeder stops before the download completes
+
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("seeder did not stop at its limit")
+	}
+}
+
+func TestSeedFileCorrupted(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(2*pieceLength, pieceLength)
+	data[pieceLength+1]++
+
+	err := seeder.SeedFile(context.Background(), bytes.NewReader(data))
+	assert.NotNil(t, err)
+}
+
+func TestDownloadAndSeed(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength-10, pieceLength)
+	to.PeerId = [20]byte{'s', 'e', 'e', 'd'}
+	release := make(chan struct{})
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.wait = func(index int) {
+		if index > 0 {
+			<-release
+		}
+	}
+	to.Peers = []peer.Peer{fp.Peer}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	to.Listener = ln
+
+	store := &corruptStore{buf: make([]byte, len(data)), corrupt: -1, writes: map[int64]int{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- to.DownloadAndSeed(ctx, store)
+	}()
+
+	// A peer connecting mid-download gets the pieces already stored, then
+	// is told about the next ones
+	require.Eventually(t, func() bool { return to.hasPiece(0) }, time.Second, time.Millisecond)
+	addr := ln.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := client.New(context.Background(), p, [20]byte{'l', 'e', 'e', 'c', 'h'}, to.InfoHash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.True(t, c.Bitfield.HasPiece(0))
+	assert.False(t, c.Bitfield.HasPiece(1))
+	close(release)
+	told := map[int]bool{}
+	for len(told) < 3 {
+		msg, err := c.Read()
+		require.Nil(t, err)
+		if msg != nil && msg.ID == message.MsgHave {
+			index, err := msg.ParseHave()
+			require.Nil(t, err)
+			told[index] = true
+		}
+	}
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: true}, told)
+
+	// Seeding goes on once the download is complete
+	_, leecher := newTestTorrent(4*pieceLength-10, pieceLength)
+	leecher.Peers = []peer.Peer{p}
+	buf, err := downloadBytes(&leecher)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+
+	cancel()
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("seeding did not stop with the context")
+	}
+}
+
+func TestDownloadUnchokeInterested(t *testing.T) {
+	tests := map[string]struct {
+		seed     bool
+		unchokes int
+	}{
+		// Nothing is served, so the peer stays choked
+		"downloading": {false, 0},
+		// The peer gets a slot of the choker
+		"seeding": {true, 1},
+	}
+
+	for name, test := range tests {
+		pieceLength := MaxBlockSize
+		data, to := newTestTorrent(2*pieceLength, pieceLength)
+		release := make(chan struct{})
+		fp := newFakePeer(t, data, pieceLength, allPieces(2))
+		fp.interested = true
+		fp.wait = func(index int) {
+			if index > 0 {
+				<-release
+			}
+		}
+		to.Peers = []peer.Peer{fp.Peer}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		to.Listener = ln
+
+		store := &memStore{buf: make([]byte, len(data))}
+		errs := make(chan error, 1)
+		go func() {
+			if test.seed {
+				errs <- to.downloadAndServe(context.Background(), store, false)
+			} else {
+				errs <- to.Download(context.Background(), store)
+			}
+		}()
+
+		require.Eventually(t, func() bool {
+			peers := to.ConnectedPeers()
+			return len(peers) == 1 && peers[0].PeerInterested
+		}, 5*time.Second, time.Millisecond, name)
+		time.Sleep(20 * time.Millisecond)
+		fp.mu.Lock()
+		assert.Equal(t, test.unchokes, fp.unchokes, name)
+		fp.mu.Unlock()
+		assert.Equal(t, !test.seed, to.ConnectedPeers()[0].AmChoking, name)
+
+		close(release)
+		require.Nil(t, <-errs, name)
+		ln.Close()
+	}
+}
+
+func TestDownloadAndServeOutgoing(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	release := make(chan struct{})
+	fp := newFakePeer(t, data, pieceLength, allPieces(2))
+	fp.interested = true
+	fp.fetch = true
+	fp.wait = func(index int) {
+		if index > 0 {
+			<-release
+		}
+	}
+	to.Peers = []peer.Peer{fp.Peer}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	to.Listener = ln
+
+	store := &memStore{buf: make([]byte, len(data))}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- to.downloadAndServe(context.Background(), store, false)
+	}()
+
+	// The peer we connected to is told about the piece stored, and served
+	// the block it requests
+	assert.Eventually(t, func() bool {
+		fp.mu.Lock()
+		defer fp.mu.Unlock()
+		return fp.fetched == 1
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	require.Nil(t, <-errs)
+	assert.Equal(t, int64(pieceLength), to.Stats().Uploaded)
+}
+
+func TestDownloadFromIncoming(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	release := make(chan struct{})
+	fp := newFakePeer(t, data, pieceLength, []int{0})
+	fp.wait = func(int) { <-release }
+	to.Peers = []peer.Peer{fp.Peer}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	to.Listener = ln
+
+	store := &memStore{buf: make([]byte, len(data))}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- to.DownloadAndSeed(ctx, store)
+	}()
+
+	// A peer connecting to us with the piece the fake peer withholds is
+	// downloaded from
+	addr := ln.Addr().(*net.TCPAddr)
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	c, err := client.New(context.Background(), p, [20]byte{'i', 'n'}, to.InfoHash, client.WithPieces(2))
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	_, err = c.Conn.Write((&message.Message{ID: message.MsgBitfield, Payload: []byte{0x40}}).Serialize())
+	require.Nil(t, err)
+	require.Nil(t, c.SendUnchoke())
+	go func() {
+		for {
+			msg, err := c.Read()
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != message.MsgRequest {
+				continue
+			}
+			index, begin, length, err := msg.ParseRequest()
+			if err != nil {
+				return
+			}
+			c.SendPiece(index, begin, data[index*pieceLength+begin:][:length])
+		}
+	}()
+	require.Eventually(t, func() bool { return to.hasPiece(1) }, 5*time.Second, time.Millisecond)
+	assert.False(t, to.hasPiece(0))
+
+	// The peer is still served once the download is done with it
+	close(release)
+	require.Eventually(t, func() bool {
+		peers := to.ConnectedPeers()
+		return to.isComplete() && len(peers) == 1 && peers[0].Incoming
+	}, 5*time.Second, time.Millisecond)
+
+	cancel()
+	require.Nil(t, <-errs)
+}
+
+func TestSeedFileAnnounce(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(2*pieceLength, pieceLength)
+	url, queries := newFakeTracker(t, nil)
+	seeder.AnnounceURL = url
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	seeder.Listener = ln
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- seeder.SeedFile(ctx, bytes.NewReader(data))
+	}()
+	query := <-queries
+	assert.Contains(t, query, "event=started")
+	assert.Contains(t, query, "left=0")
+	assert.Eventually(t, func() bool {
+		seeder.mu.Lock()
+		defer seeder.mu.Unlock()
+		return !seeder.announces.LastAnnounce.IsZero()
+	}, time.Second, time.Millisecond)
+
+	// The tracker is told about the seeder stopping before SeedFile returns,
+	// and nothing was completed
+	cancel()
+	require.Nil(t, <-errs)
+	select {
+	case query = <-queries:
+		assert.Contains(t, query, "event=stopped")
+	default:
+		t.Fatal("no stopped announce")
+	}
+}
+
+func TestSeedFileIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(3*pieceLength, pieceLength)
+	seeder.Listener = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go seeder.SeedFile(ctx, bytes.NewReader(data))
+
+	_, leecher := newTestTorrent(3*pieceLength, pieceLength)
+	leecher.Peers = []peer.Peer{{IP: net.IPv6loopback, Port: uint16(ln.Addr().(*net.TCPAddr).Port)}}
+	buf, err := downloadBytes(&leecher)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestSeedFileRateLimit(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(4*pieceLength, pieceLength)
+	seeder.UploadLimiters = []*client.Limiter{client.NewLimiter(40000)}
+	p, _ := startSeeder(t, &seeder, data)
+
+	_, leecher := newTestTorrent(4*pieceLength, pieceLength)
+	leecher.Peers = []peer.Peer{p}
+	start := time.Now()
+	buf, err := downloadBytes(&leecher)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+}
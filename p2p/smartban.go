@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"net"
+)
+
+// blockRecord is a block of a piece that failed the integrity check, with
+// the peer that delivered it
+type blockRecord struct {
+	block int
+	ip    string
+	hash  [20]byte
+}
+
+// smartBan attributes the failed integrity checks of the pieces assembled
+// from the blocks of several peers. The blocks of a failed copy of a piece
+// are remembered with the peer that delivered them, and once a copy passes
+// the check the peers that delivered different blocks are the ones to ban.
+type smartBan struct {
+	records map[int][]blockRecord // by piece index
+}
+
+// failed remembers the blocks of a copy of a piece that failed the check.
+// from holds the IP of the peer that delivered each block.
+func (sb *smartBan) failed(index int, buf []byte, from []net.IP) {
+	if sb.records == nil {
+		sb.records = make(map[int][]blockRecord)
+	}
+	for block, ip := range from {
+		begin, size := blockBounds(len(buf), block)
+		sb.records[index] = append(sb.records[index], blockRecord{
+			block: block,
+			ip:    ip.String(),
+			hash:  sha1.Sum(buf[begin : begin+size]),
+		})
+	}
+}
+
+// passed forgets the failed copies of a piece now that buf passed the check,
+// and returns the IPs of the peers that delivered blocks different from it
+func (sb *smartBan) passed(index int, buf []byte) []string {
+	records := sb.records[index]
+	delete(sb.records, index)
+	var guilty []string
+	seen := make(map[string]bool)
+	for _, r := range records {
+		begin, size := blockBounds(len(buf), r.block)
+		if seen[r.ip] || sha1.Sum(buf[begin:begin+size]) == r.hash {
+			continue
+		}
+		seen[r.ip] = true
+		guilty = append(guilty, r.ip)
+	}
+	return guilty
+}
@@ -0,0 +1,48 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSmartBan(t *testing.T) {
+	good := make([]byte, 3*MaxBlockSize)
+	for i := range good {
+		good[i] = byte(i)
+	}
+	bad := append([]byte(nil), good...)
+	bad[MaxBlockSize] ^= 0xff // second block
+
+	honest, corrupting := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	var sb smartBan
+	sb.failed(7, bad, []net.IP{honest, corrupting, honest})
+	sb.failed(7, bad, []net.IP{corrupting, corrupting, honest})
+
+	assert.Empty(t, sb.passed(3, good))
+	assert.Equal(t, []string{corrupting.String()}, sb.passed(7, good))
+	assert.Empty(t, sb.passed(7, good), "records are forgotten once the piece passes")
+}
+
+func TestDownloadSplitBansCorruptingPeer(t *testing.T) {
+	pieceLength := 4 * MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	to.SplitPieces = true
+
+	corrupting := newFakePeer(t, data, pieceLength, allPieces(3))
+	corrupting.corrupt = 1000 // every block it serves
+	corrupting.Peer = corrupting.listen(t, "127.0.0.2:0")
+	good := newFakePeer(t, data, pieceLength, allPieces(3))
+	to.Peers = []peer.Peer{corrupting.Peer, good.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.True(t, to.isBanned(corrupting.IP))
+	assert.False(t, to.isBanned(good.IP))
+}
@@ -0,0 +1,494 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// splitPeer tracks the blocks of the current piece assigned to one peer
+type splitPeer struct {
+	client      *client.Client
+	pending     []int        // blocks assigned but not requested yet
+	outstanding map[int]bool // blocks requested but not received yet
+	failed      bool
+}
+
+type splitEvent struct {
+	peer *splitPeer
+	msg  *message.Message
+	err  error
+}
+
+// readLoop forwards every message read from the peer until the connection fails
+func (sp *splitPeer) readLoop(events chan<- splitEvent, done <-chan struct{}) {
+	for {
+		msg, err := sp.client.Read()
+		select {
+		case events <- splitEvent{sp, msg, err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// splitPiece holds the state of a piece whose blocks are partitioned across peers
+type splitPiece struct {
+	pw       *pieceWork
+	holders  []*splitPeer
+	buf      []byte
+	received []bool
+	from     []*splitPeer // peer that delivered each received block
+	done     int
+}
+
+func blockBounds(length, block int) (begin, size int) {
+	begin = block * MaxBlockSize
+	size = MaxBlockSize
+	if length-begin < size {
+		size = length - begin
+	}
+	return
+}
+
+// assign distributes blocks round-robin across the holders
+func (sp *splitPiece) assign(blocks []int) {
+	for i, block := range blocks {
+		h := sp.holders[i%len(sp.holders)]
+		h.pending = append(h.pending, block)
+	}
+}
+
+// drop removes a failed peer and hands its unfinished blocks to the others
+func (sp *splitPiece) drop(p *splitPeer) error {
+	p.failed = true
+	var blocks []int
+	for _, block := range p.pending {
+		if !sp.received[block] {
+			blocks = append(blocks, block)
+		}
+	}
+	for block := range p.outstanding {
+		if !sp.received[block] {
+			blocks = append(blocks, block)
+		}
+	}
+	p.pending, p.outstanding = nil, map[int]bool{}
+
+	holders := sp.holders[:0]
+	for _, h := range sp.holders {
+		if h != p {
+			holders = append(holders, h)
+		}
+	}
+	sp.holders = holders
+	if len(sp.holders) == 0 {
+		return fmt.Errorf("%w: no peer left to download piece #%d", ErrUnsatisfiable, sp.pw.index)
+	}
+	sp.assign(blocks)
+	return nil
+}
+
+// steal takes a pending block from the most loaded holder other than p
+func (sp *splitPiece) steal(p *splitPeer) (int, bool) {
+	var victim *splitPeer
+	for _, h := range sp.holders {
+		if h != p && (victim == nil || len(h.pending) > len(victim.pending)) {
+			victim = h
+		}
+	}
+	if victim == nil || len(victim.pending) == 0 {
+		return 0, false
+	}
+	block := victim.pending[len(victim.pending)-1]
+	victim.pending = victim.pending[:len(victim.pending)-1]
+	return block, true
+}
+
+// duplicate returns a block outstanding at another holder that p could also request
+func (sp *splitPiece) duplicate(p *splitPeer) (int, bool) {
+	for _, h := range sp.holders {
+		if h == p {
+			continue
+		}
+		for block := range h.outstanding {
+			if !sp.received[block] && !p.outstanding[block] {
+				return block, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (sp *splitPiece) request(p *splitPeer, block int) error {
+	begin, size := blockBounds(sp.pw.length, block)
+	err := p.client.SendRequest(sp.pw.index, begin, size)
+	if err != nil {
+		return err
+	}
+	p.outstanding[block] = true
+	return nil
+}
+
+// fill sends requests until every unchoked holder has a full backlog. Idle
+// holders steal pending blocks from others, then duplicate outstanding ones.
+func (sp *splitPiece) fill() error {
+	for _, p := range sp.holders {
+		if p.client.Choked {
+			continue
+		}
+		var err error
+		for err == nil && len(p.outstanding) < MaxBacklog {
+			var block int
+			if len(p.pending) > 0 {
+				block = p.pending[0]
+				p.pending = p.pending[1:]
+			} else if stolen, ok := sp.steal(p); ok {
+				block = stolen
+			} else {
+				break
+			}
+			if !sp.received[block] {
+				err = sp.request(p, block)
+			}
+		}
+		if err == nil && len(p.outstanding) == 0 {
+			if block, ok := sp.duplicate(p); ok {
+				err = sp.request(p, block)
+			}
+		}
+		if err != nil {
+			if err := sp.drop(p); err != nil {
+				return err
+			}
+			return sp.fill()
+		}
+	}
+	return nil
+}
+
+// receive stores a block and cancels the copies still requested from other
+// peers. Blocks not requested from the peer, such as late ones of a previous
+// copy of the piece, are ignored.
+func (sp *splitPiece) receive(p *splitPeer, msg *message.Message) error {
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	block := begin / MaxBlockSize
+	if !p.outstanding[block] {
+		return nil
+	}
+	_, err := msg.ParsePiece(sp.pw.index, sp.buf)
+	if err != nil {
+		return err
+	}
+	delete(p.outstanding, block)
+	if sp.received[block] {
+		return nil
+	}
+	sp.received[block] = true
+	sp.from[block] = p
+	sp.done++
+
+	_, size := blockBounds(sp.pw.length, block)
+	for _, h := range sp.holders {
+		if h != p && h.outstanding[block] {
+			delete(h.outstanding, block)
+			h.client.SendCancel(sp.pw.index, begin, size)
+		}
+	}
+	return nil
+}
+
+func (sp *splitPiece) handle(ev splitEvent) error {
+	if ev.err != nil {
+		if ev.peer.failed {
+			return nil
+		}
+		for _, h := range sp.holders {
+			if h == ev.peer {
+				return sp.drop(ev.peer)
+			}
+		}
+		ev.peer.failed = true
+		return nil
+	}
+
+	msg := ev.msg
+	if msg == nil || ev.peer.failed {
+		return nil
+	}
+	c := ev.peer.client
+	switch msg.ID {
+	case message.MsgUnchoke:
+		c.Choked = false
+	case message.MsgChoke:
+		c.Choked = true
+		// A choking peer discards our requests, so they have to be sent again
+		for block := range ev.peer.outstanding {
+			ev.peer.pending = append(ev.peer.pending, block)
+		}
+		ev.peer.outstanding = map[int]bool{}
+	case message.MsgHave:
+		index, err := msg.ParseHave()
+		if err != nil {
+			return nil
+		}
+		c.Bitfield.SetPiece(index)
+	case message.MsgPiece:
+		if len(msg.Payload) < 8 || int(binary.BigEndian.Uint32(msg.Payload[0:4])) != sp.pw.index {
+			return nil // late block from a previous piece
+		}
+		err := sp.receive(ev.peer, msg)
+		if err != nil {
+			return sp.drop(ev.peer)
+		}
+	}
+	return nil
+}
+
+// downloadPieceFromPeers downloads a single piece by partitioning its blocks
+// across all the peers that have it, or only from one of them if set, and
+// reassembling them centrally. It returns the piece and the peer that
+// delivered each of its blocks.
+func downloadPieceFromPeers(peers []*splitPeer, events <-chan splitEvent, pw *pieceWork, timeout time.Duration, only *splitPeer) ([]byte, []*splitPeer, error) {
+	numBlocks := (pw.length + MaxBlockSize - 1) / MaxBlockSize
+	sp := splitPiece{
+		pw:       pw,
+		buf:      make([]byte, pw.length),
+		received: make([]bool, numBlocks),
+		from:     make([]*splitPeer, numBlocks),
+	}
+	for _, p := range peers {
+		p.pending, p.outstanding = nil, map[int]bool{}
+		if !p.failed && p.client.Bitfield.HasPiece(pw.index) && (only == nil || p == only) {
+			sp.holders = append(sp.holders, p)
+		}
+	}
+	if len(sp.holders) == 0 {
+		return nil, nil, fmt.Errorf("%w: no connected peer has piece #%d", ErrUnsatisfiable, pw.index)
+	}
+
+	blocks := make([]int, numBlocks)
+	for i := range blocks {
+		blocks[i] = i
+	}
+	sp.assign(blocks)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for sp.done < numBlocks {
+		err := sp.fill()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		select {
+		case ev := <-events:
+			err = sp.handle(ev)
+			if err != nil {
+				return nil, nil, err
+			}
+		case <-timer.C:
+			return nil, nil, fmt.Errorf("%w: piece #%d not delivered in time", client.ErrPeerTimeout, pw.index)
+		}
+	}
+
+	return sp.buf, sp.from, nil
+}
+
+func (t *Torrent) connectPeers(ctx context.Context) []*client.Client {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var clients []*client.Client
+	for _, p := range t.Peers {
+		if !reachable(p) {
+			continue
+		}
+		wg.Add(1)
+		go func(p peer.Peer) {
+			defer wg.Done()
+			c, err := client.New(ctx, p, t.PeerId, t.InfoHash, t.clientOptions()...)
+			if err != nil {
+				t.logger().Log(logging.Debug, "could not connect, disconnecting", logging.F("peer", p), logging.F("err", err))
+				return
+			}
+			mu.Lock()
+			clients = append(clients, c)
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return clients
+}
+
+// downloadSplit downloads the pieces in order, each one from all the peers
+// that have it at once
+func (t *Torrent) downloadSplit(ctx context.Context, store func(index int, piece []byte) error) error {
+	missing := t.MissingPieces()
+	if len(missing) == 0 {
+		return nil
+	}
+	clients := t.connectPeers(ctx)
+	if len(clients) == 0 {
+		return fmt.Errorf("%w: could not connect to any peer", ErrUnsatisfiable)
+	}
+
+	events := make(chan splitEvent, len(clients)*MaxBacklog)
+	done := make(chan struct{})
+	// Readers are stopped before returning, so that none outlives the download
+	var readers sync.WaitGroup
+	keepAlive, stop := context.WithCancel(ctx)
+	defer stop()
+	peers := make([]*splitPeer, len(clients))
+	for i, c := range clients {
+		peers[i] = &splitPeer{client: c}
+		c.SendUnchoke()
+		c.SendInterested()
+		go c.KeepAlive(keepAlive, t.keepAliveInterval())
+		readers.Add(1)
+		go func(sp *splitPeer) {
+			defer readers.Done()
+			sp.readLoop(events, done)
+		}(peers[i])
+	}
+	gauge := int64(len(clients)) // connected peers reported to the metrics
+	t.metrics().AddGauge(MetricConnectedPeers, gauge)
+	defer func() {
+		close(done)
+		for _, c := range clients {
+			c.Conn.Close()
+		}
+		readers.Wait()
+		t.metrics().AddGauge(MetricConnectedPeers, -gauge)
+	}()
+	// Closing the connections interrupts the piece being downloaded
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, c := range clients {
+				c.Conn.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	var sb smartBan
+	for _, index := range missing {
+		pw := &pieceWork{index, t.PieceHashes[index], t.calculatePieceSize(index)}
+		// The peers that delivered the blocks of a failed copy are then
+		// downloaded from alone in turn, so that a corrupting peer cannot
+		// keep the piece from passing the check
+		var suspects []*splitPeer
+		for {
+			var only *splitPeer
+			for only == nil && len(suspects) > 0 {
+				if !suspects[0].failed {
+					only = suspects[0]
+				}
+				suspects = suspects[1:]
+			}
+			pieceBuf, from, err := downloadPieceFromPeers(peers, events, pw, t.pieceTimeout(pw.length), only)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil && only != nil {
+				continue // the next suspect, or all the peers, download the piece
+			}
+			if err != nil {
+				return err
+			}
+			err = checkIntegrity(pw, pieceBuf)
+			if err != nil {
+				t.logger().Log(logging.Warn, "piece failed integrity check", logging.F("piece", pw.index))
+				t.metrics().AddCounter(MetricIntegrityFailures, 1)
+				contributors := splitContributors(from)
+				if len(contributors) == 1 {
+					p := contributors[0]
+					t.emit(HashFailed{Index: pw.index, Source: p.client.Peer().String()})
+					if t.corrupted(pw.index, p.client.Peer().IP) {
+						t.banSplitPeer(p, "banning peer: delivered too many corrupt pieces")
+					}
+					continue
+				}
+				t.emit(HashFailed{Index: pw.index})
+				ips := make([]net.IP, len(from))
+				for block, p := range from {
+					ips[block] = p.client.Peer().IP
+				}
+				sb.failed(pw.index, pieceBuf, ips)
+				if len(suspects) == 0 {
+					suspects = contributors
+				}
+				continue
+			}
+			for _, ip := range sb.passed(pw.index, pieceBuf) {
+				if t.MaxCorruptPieces < 0 {
+					break
+				}
+				for _, p := range peers {
+					if p.client.Peer().IP.String() == ip {
+						t.banSplitPeer(p, "banning peer: delivered corrupt blocks")
+					}
+				}
+			}
+			err = store(index, pieceBuf)
+			if errors.Is(err, ErrCorruptWrite) {
+				t.logger().Log(logging.Warn, "piece did not survive the write, downloading it again", logging.F("piece", pw.index))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			t.complete(index)
+			break
+		}
+
+		connected := 0
+		for _, p := range peers {
+			if !p.failed {
+				p.client.SendHave(index)
+				connected++
+			}
+		}
+		atomic.StoreInt32(&t.connected, int32(connected))
+		t.metrics().AddGauge(MetricConnectedPeers, int64(connected)-gauge)
+		gauge = int64(connected)
+		t.logProgress(len(t.PieceHashes)-len(t.MissingPieces()), index)
+	}
+
+	return nil
+}
+
+// splitContributors returns the peers that delivered the blocks of a piece
+func splitContributors(from []*splitPeer) []*splitPeer {
+	var contributors []*splitPeer
+	seen := make(map[*splitPeer]bool)
+	for _, p := range from {
+		if !seen[p] {
+			seen[p] = true
+			contributors = append(contributors, p)
+		}
+	}
+	return contributors
+}
+
+// banSplitPeer bans a peer of a split download and disconnects it
+func (t *Torrent) banSplitPeer(p *splitPeer, msg string) {
+	t.logger().Log(logging.Warn, msg, logging.F("peer", p.client.Peer()))
+	t.ban(p.client.Peer().IP)
+	p.failed = true
+	p.client.Conn.Close()
+}
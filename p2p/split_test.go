@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadPieceFromPeers(t *testing.T) {
+	pieceLength := 4*MaxBlockSize + 100 // 5 blocks, the last one short
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	fakes := []*fakePeer{
+		newFakePeer(t, data, pieceLength, allPieces(2)),
+		newFakePeer(t, data, pieceLength, allPieces(2)),
+	}
+
+	events := make(chan splitEvent, 16)
+	done := make(chan struct{})
+	defer close(done)
+	var peers []*splitPeer
+	for _, fp := range fakes {
+		c, err := client.New(context.Background(), fp.Peer, to.PeerId, to.InfoHash)
+		require.Nil(t, err)
+		defer c.Conn.Close()
+		// Wait for the unchoke so that no peer gets all the blocks alone
+		msg, err := c.Read()
+		require.Nil(t, err)
+		require.Equal(t, message.MsgUnchoke, msg.ID)
+		c.Choked = false
+		sp := &splitPeer{client: c}
+		peers = append(peers, sp)
+		go sp.readLoop(events, done)
+	}
+
+	pw := &pieceWork{1, to.PieceHashes[1], pieceLength}
+	buf, from, err := downloadPieceFromPeers(peers, events, pw, time.Second, nil)
+	require.Nil(t, err)
+	assert.Equal(t, data[pieceLength:], buf)
+	assert.Nil(t, checkIntegrity(pw, buf))
+	assert.True(t, errors.Is(checkIntegrity(pw, data[:pieceLength]), ErrPieceHashMismatch))
+	for _, fp := range fakes {
+		assert.Greater(t, fp.requestCount(), 0)
+	}
+	require.Len(t, from, 5)
+	for block, p := range from {
+		assert.True(t, p == peers[0] || p == peers[1], "block %d", block)
+	}
+}
+
+func TestDownloadPieceFromPeersMissingPiece(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, []int{0})
+
+	c, err := client.New(context.Background(), fp.Peer, to.PeerId, to.InfoHash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+
+	pw := &pieceWork{1, to.PieceHashes[1], pieceLength}
+	_, _, err = downloadPieceFromPeers([]*splitPeer{{client: c}}, nil, pw, time.Second, nil)
+	assert.NotNil(t, err)
+}
+
+func TestDownloadSplit(t *testing.T) {
+	pieceLength := 3 * MaxBlockSize
+	data, to := newTestTorrent(5*pieceLength-42, pieceLength)
+	to.SplitPieces = true
+	for i := 0; i < 3; i++ {
+		fp := newFakePeer(t, data, pieceLength, allPieces(5))
+		to.Peers = append(to.Peers, fp.Peer)
+	}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
@@ -0,0 +1,102 @@
+package p2p
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the progress and traffic of a torrent. Uploaded and
+// Downloaded only count block data, as reported to the tracker; the protocol
+// overhead is counted separately.
+type Stats struct {
+	Uploaded           int64
+	Downloaded         int64
+	OverheadUploaded   int64
+	OverheadDownloaded int64
+	// DownloadRate and UploadRate are the block data exchanged per second,
+	// over the last client.RateWindow
+	DownloadRate float64
+	UploadRate   float64
+	// Peers is the number of connections with peers, downloading or being
+	// served, and KnownPeers the number of addresses known for the swarm
+	Peers      int
+	KnownPeers int
+	// PeerSources is the number of new peers found by each source of
+	// Discovery, nil without Discovery
+	PeerSources map[string]int
+	// Seeders and Leechers are the sizes of the swarm last reported by the
+	// tracker, possibly to a previous run, see RestoreTrackerState
+	Seeders  int
+	Leechers int
+	// CompletedPieces out of TotalPieces are stored, for Completed bytes
+	CompletedPieces int
+	TotalPieces     int
+	Completed       int64
+	// ETA is the time left to download the pieces not skipped at
+	// DownloadRate, 0 once done and negative while nothing is downloaded
+	ETA time.Duration
+	// TotalUploaded and TotalDownloaded add the payload bytes of the
+	// previous runs, PastUploaded and PastDownloaded, to those of this run
+	TotalUploaded   int64
+	TotalDownloaded int64
+	// Ratio is the data uploaded per byte downloaded over all the runs, or
+	// per byte held when nothing was downloaded, as when seeding
+	Ratio  float64
+	Paused bool
+	// CacheHits and CacheMisses count the blocks uploaded from the read
+	// cache, and the ones whose piece had to be read from the store
+	CacheHits   int64
+	CacheMisses int64
+}
+
+// Stats returns a snapshot of the progress and traffic of the torrent. It is
+// cheap enough to be polled by user interfaces.
+func (t *Torrent) Stats() Stats {
+	counters := t.counters.Snapshot()
+	stats := Stats{
+		Uploaded:           counters.PayloadUploaded,
+		Downloaded:         counters.PayloadDownloaded,
+		OverheadUploaded:   counters.OverheadUploaded,
+		OverheadDownloaded: counters.OverheadDownloaded,
+		DownloadRate:       t.counters.DownloadRate(),
+		UploadRate:         t.counters.UploadRate(),
+		Peers:              int(atomic.LoadInt32(&t.connected) + atomic.LoadInt32(&t.served)),
+		TotalPieces:        len(t.PieceHashes),
+		Completed:          atomic.LoadInt64(&t.completed),
+		TotalUploaded:      t.PastUploaded + counters.PayloadUploaded,
+		TotalDownloaded:    t.PastDownloaded + counters.PayloadDownloaded,
+		CacheHits:          atomic.LoadInt64(&t.cacheHits),
+		CacheMisses:        atomic.LoadInt64(&t.cacheMisses),
+	}
+
+	t.mu.Lock()
+	stats.CompletedPieces = t.stored
+	stats.Paused = t.resumed != nil
+	stats.Seeders, stats.Leechers = t.announces.Complete, t.announces.Incomplete
+	known := make(map[string]bool, len(t.Peers))
+	for _, p := range t.Peers {
+		known[p.String()] = true
+	}
+	for addr := range t.swarmPeers {
+		known[addr] = true
+	}
+	t.mu.Unlock()
+	stats.KnownPeers = len(known)
+	if t.Discovery != nil {
+		stats.PeerSources = t.Discovery.PeerCounts()
+	}
+
+	left := t.wantedLeft()
+	switch {
+	case left <= 0:
+		stats.ETA = 0
+	case stats.DownloadRate > 0:
+		stats.ETA = time.Duration(math.Ceil(float64(left)/stats.DownloadRate)) * time.Second
+	default:
+		stats.ETA = -1
+	}
+
+	stats.Ratio = shareRatio(stats.TotalUploaded, stats.TotalDownloaded, stats.Completed)
+	return stats
+}
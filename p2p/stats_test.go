@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(4*pieceLength, pieceLength)
+	to.EndgameThreshold = -1
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	to.Peers = []peer.Peer{fp.Peer, fp.Peer}
+
+	stats := to.Stats()
+	assert.Equal(t, 4, stats.TotalPieces)
+	assert.Equal(t, 0, stats.CompletedPieces)
+	assert.Equal(t, 1, stats.KnownPeers)
+	assert.Equal(t, time.Duration(-1), stats.ETA)
+	assert.Equal(t, 0.0, stats.Ratio)
+
+	// The peer holds the last piece while the stats are taken
+	release := make(chan struct{})
+	taken := make(chan Stats)
+	fp.wait = func(index int) {
+		if index == 3 {
+			taken <- to.Stats()
+			<-release
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := downloadBytes(&to)
+		done <- err
+	}()
+	stats = <-taken
+	close(release)
+	assert.Equal(t, 1, stats.Peers)
+	assert.Greater(t, stats.DownloadRate, 0.0)
+	assert.Greater(t, stats.ETA, time.Duration(0))
+	require.Nil(t, <-done)
+
+	stats = to.Stats()
+	assert.Equal(t, 4, stats.CompletedPieces)
+	assert.Equal(t, int64(len(data)), stats.Completed)
+	assert.Equal(t, float64(len(data))/client.RateWindow.Seconds(), stats.DownloadRate)
+	assert.Equal(t, time.Duration(0), stats.ETA)
+	assert.Equal(t, 0, stats.Peers)
+	assert.False(t, stats.Paused)
+}
+
+func TestStatsSeeding(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(2*pieceLength, pieceLength)
+	p, _ := startSeeder(t, &seeder, data)
+
+	_, leecher := newTestTorrent(2*pieceLength, pieceLength)
+	leecher.Peers = []peer.Peer{p}
+	_, err := downloadBytes(&leecher)
+	require.Nil(t, err)
+
+	// Nothing was downloaded, the ratio is relative to the data seeded
+	stats := seeder.Stats()
+	assert.Equal(t, int64(len(data)), stats.Uploaded)
+	assert.Equal(t, 1.0, stats.Ratio)
+	assert.Greater(t, stats.UploadRate, 0.0)
+	assert.Equal(t, 2, stats.CompletedPieces)
+}
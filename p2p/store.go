@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCorruptWrite is returned when a piece read back from a Store does not
+// match its hash
+var ErrCorruptWrite = errors.New("piece corrupted by the write")
+
+// Store holds the data of a torrent at its offsets, like a file
+type Store interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Download downloads the torrent to the store, such as a file, and returns
+// once every piece is written to it, or when ctx is done. Each piece is
+// written as soon as it is verified, the torrent is never held in memory.
+// Pieces already stored, by a previous download or marked with Resume or
+// VerifyStore, are skipped. The store is flushed before returning if it has
+// a Sync method, as files do.
+func (t *Torrent) Download(ctx context.Context, store Store) (err error) {
+	defer func() {
+		if flushErr := flush(store); err == nil {
+			err = flushErr
+		}
+	}()
+
+	t.setStore(store)
+
+	// Peers connecting through Incoming are served the pieces stored
+	t.mu.Lock()
+	seeding := t.seeding != nil
+	t.mu.Unlock()
+	if t.Incoming != nil && !seeding {
+		return t.downloadAndServe(ctx, store, false)
+	}
+
+	return t.download(ctx, func(index int, piece []byte) error {
+		begin, _ := t.calcultateBoundsForPiece(index)
+		_, err := store.WriteAt(piece, int64(begin))
+		if err != nil {
+			return err
+		}
+		if !t.VerifyOnWrite {
+			return nil
+		}
+
+		written := make([]byte, len(piece))
+		_, err = store.ReadAt(written, int64(begin))
+		if err != nil {
+			return err
+		}
+		pw := &pieceWork{index, t.PieceHashes[index], len(piece)}
+		if checkIntegrity(pw, written) != nil {
+			return fmt.Errorf("%w: piece #%d", ErrCorruptWrite, index)
+		}
+		return nil
+	})
+}
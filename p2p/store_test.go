@@ -0,0 +1,142 @@
+package p2p
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptStore is an in-memory store that flips a byte the first time a
+// write lands at the offset corrupt
+type corruptStore struct {
+	mu      sync.Mutex
+	buf     []byte
+	corrupt int64
+	writes  map[int64]int
+}
+
+func (s *corruptStore) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := copy(s.buf[off:], p)
+	s.writes[off]++
+	if off == s.corrupt && s.writes[off] == 1 {
+		s.buf[off] ^= 0xff
+	}
+	return n, nil
+}
+
+func (s *corruptStore) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copy(p, s.buf[off:]), nil
+}
+
+// memStore is an in-memory store
+type memStore struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (s *memStore) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copy(s.buf[off:], p), nil
+}
+
+func (s *memStore) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copy(p, s.buf[off:]), nil
+}
+
+// downloadBytes downloads the torrent to memory
+func downloadBytes(to *Torrent) ([]byte, error) {
+	store := &memStore{buf: make([]byte, to.Length)}
+	err := to.Download(context.Background(), store)
+	if err != nil {
+		return nil, err
+	}
+	return store.buf, nil
+}
+
+func TestDownloadToFile(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength-10, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(3))
+	to.Peers = []peer.Peer{fp.Peer}
+
+	path := filepath.Join(t.TempDir(), "test")
+	file, err := os.Create(path)
+	require.Nil(t, err)
+	defer file.Close()
+
+	err = to.Download(context.Background(), file)
+	require.Nil(t, err)
+	written, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, data, written)
+}
+
+func TestDownloadToStore(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength-10, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(3))
+	to.Peers = []peer.Peer{fp.Peer}
+
+	store := &corruptStore{buf: make([]byte, len(data)), corrupt: -1, writes: map[int64]int{}}
+	err := to.Download(context.Background(), store)
+	require.Nil(t, err)
+	assert.Equal(t, data, store.buf)
+}
+
+func TestDownloadToStoreVerifyOnWrite(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength-10, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(3))
+	to.Peers = []peer.Peer{fp.Peer}
+	to.VerifyOnWrite = true
+
+	offset := int64(pieceLength)
+	store := &corruptStore{buf: make([]byte, len(data)), corrupt: offset, writes: map[int64]int{}}
+	err := to.Download(context.Background(), store)
+	require.Nil(t, err)
+	assert.Equal(t, data, store.buf)
+	assert.Equal(t, 2, store.writes[offset])
+	assert.Equal(t, 1, store.writes[0])
+}
+
+func TestDownloadCanceled(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	release := make(chan struct{})
+	defer close(release)
+	fp := newFakePeer(t, data, pieceLength, allPieces(2))
+	fp.wait = func(int) { <-release }
+	to.Peers = []peer.Peer{fp.Peer}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error)
+	go func() {
+		returned <- to.Download(ctx, &memStore{buf: make([]byte, len(data))})
+	}()
+
+	require.Eventually(t, func() bool { return fp.requestCount() > 0 }, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case err := <-returned:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("Download did not return after cancellation")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&to.connected))
+}
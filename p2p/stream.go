@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// WaitRange waits for the pieces holding the n bytes at offset off to be
+// stored, until ctx is done. The missing pieces are downloaded before the
+// others meanwhile, so that a player reading a file being downloaded is not
+// kept waiting, e.g. after seeking.
+func (t *Torrent) WaitRange(ctx context.Context, off, n int64) error {
+	if off < 0 || n < 0 || off+n > int64(t.Length) {
+		return fmt.Errorf("range of %d bytes at offset %d out of the %d bytes of the torrent", n, off, t.Length)
+	}
+	if n == 0 {
+		return nil
+	}
+	first := int(off / int64(t.PieceLength))
+	last := int((off + n - 1) / int64(t.PieceLength))
+
+	var missing []int
+	for index := first; index <= last; index++ {
+		if !t.hasPiece(index) {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	t.prioritize(missing, 1)
+	defer t.prioritize(missing, -1)
+
+	for {
+		t.mu.Lock()
+		for len(missing) > 0 && t.have.HasPiece(missing[0]) {
+			missing = missing[1:]
+		}
+		if len(missing) == 0 {
+			t.mu.Unlock()
+			return nil
+		}
+		stores := t.storesLocked()
+		t.mu.Unlock()
+
+		select {
+		case <-stores:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitStore returns the store of the running download, waiting for one to
+// start until ctx is done
+func (t *Torrent) waitStore(ctx context.Context) (io.ReaderAt, error) {
+	for {
+		t.mu.Lock()
+		store := t.store
+		stores := t.storesLocked()
+		t.mu.Unlock()
+		if store != nil {
+			return store, nil
+		}
+
+		select {
+		case <-stores:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// setStore records the store the pieces are read from, and wakes up the
+// readers waiting for it
+func (t *Torrent) setStore(store io.ReaderAt) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.store = store
+	t.notifyStoredLocked()
+}
+
+// prioritize adds delta readers waiting for each of the pieces, for the
+// running download and the ones to come
+func (t *Torrent) prioritize(indexes []int, delta int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.urgent == nil {
+		t.urgent = make(map[int]int)
+	}
+	for _, index := range indexes {
+		t.urgent[index] += delta
+		if t.urgent[index] <= 0 {
+			delete(t.urgent, index)
+		}
+	}
+	if t.picker != nil {
+		t.picker.prioritize(indexes, delta)
+	}
+}
+
+// storesLocked returns the channel closed when a piece is stored. The lock
+// must be held.
+func (t *Torrent) storesLocked() chan struct{} {
+	if t.stores == nil {
+		t.stores = make(chan struct{})
+	}
+	return t.stores
+}
+
+// notifyStoredLocked wakes up the readers waiting for pieces to be stored.
+// The lock must be held.
+func (t *Torrent) notifyStoredLocked() {
+	if t.stores != nil {
+		close(t.stores)
+		t.stores = nil
+	}
+}
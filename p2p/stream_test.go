@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitRange(t *testing.T) {
+	_, to := newTestTorrent(100, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	to.complete(3)
+
+	returned := make(chan error, 1)
+	go func() { returned <- to.WaitRange(ctx, 25, 20) }()
+
+	// The missing pieces are prioritized while waited for
+	require.Eventually(t, func() bool {
+		to.mu.Lock()
+		defer to.mu.Unlock()
+		return len(to.urgent) == 2
+	}, time.Second, time.Millisecond)
+	to.complete(2)
+	select {
+	case err := <-returned:
+		t.Fatalf("returned before the range is stored: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	to.complete(4)
+	assert.Nil(t, <-returned)
+	assert.Empty(t, to.urgent)
+
+	assert.Nil(t, to.WaitRange(ctx, 20, 30))
+	assert.NotNil(t, to.WaitRange(ctx, 90, 20))
+	assert.NotNil(t, to.WaitRange(ctx, -1, 5))
+
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	assert.Equal(t, context.DeadlineExceeded, to.WaitRange(short, 0, 1))
+	assert.Empty(t, to.urgent)
+}
+
+func TestWaitRangePrioritizesDownload(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(8*pieceLength, pieceLength)
+	fp := newFakePeer(t, data, pieceLength, allPieces(8))
+	var served []int
+	fp.wait = func(index int) {
+		fp.mu.Lock()
+		served = append(served, index)
+		fp.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	to.Peers = []peer.Peer{fp.Peer}
+	to.Sequential = true
+	to.SequentialWindow = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	waited := make(chan error, 1)
+	go func() { waited <- to.WaitRange(ctx, int64(6*pieceLength), 1) }()
+	require.Eventually(t, func() bool {
+		to.mu.Lock()
+		defer to.mu.Unlock()
+		return len(to.urgent) == 1
+	}, time.Second, time.Millisecond)
+
+	store := &memStore{buf: make([]byte, to.Length)}
+	require.Nil(t, to.Download(ctx, store))
+	assert.Nil(t, <-waited)
+	assert.Equal(t, data, store.buf)
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	require.NotEmpty(t, served)
+	assert.Equal(t, 6, served[0])
+}
@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+)
+
+// superSeeder reveals the pieces of a complete torrent to the peers one at a
+// time, as described by BEP 16. Each peer is told about the least
+// distributed piece it lacks, and about another one once a different peer
+// reports having it, proving the first peer uploaded it onward.
+type superSeeder struct {
+	pieces int
+
+	mu        sync.Mutex
+	available []int                               // peers having or told about each piece
+	peers     map[*client.Client]*superSeededPeer // peers served
+}
+
+// superSeededPeer holds the pieces a peer has and was told about
+type superSeededPeer struct {
+	has      bitfield.Bitfield // pieces the peer reported having
+	counted  bitfield.Bitfield // pieces counted in available for the peer
+	revealed bitfield.Bitfield // pieces the peer was told about
+	pending  map[int]bool      // revealed pieces no other peer reported yet
+}
+
+// superSeedHave is a piece a peer is to be told about
+type superSeedHave struct {
+	c     *client.Client
+	index int
+}
+
+func newSuperSeeder(pieces int) *superSeeder {
+	return &superSeeder{
+		pieces:    pieces,
+		available: make([]int, pieces),
+		peers:     make(map[*client.Client]*superSeededPeer),
+	}
+}
+
+// add starts super-seeding to a peer that was sent an empty bitfield, and
+// tells it about its first piece
+func (s *superSeeder) add(c *client.Client) {
+	s.mu.Lock()
+	s.peers[c] = &superSeededPeer{
+		has:      bitfield.New(s.pieces),
+		counted:  bitfield.New(s.pieces),
+		revealed: bitfield.New(s.pieces),
+		pending:  make(map[int]bool),
+	}
+	haves := s.reveal(c, nil)
+	s.mu.Unlock()
+	sendHaves(haves)
+}
+
+// remove stops super-seeding to a peer once disconnected
+func (s *superSeeder) remove(c *client.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[c]
+	if !ok {
+		return
+	}
+	for index := 0; index < s.pieces; index++ {
+		if p.counted.HasPiece(index) {
+			s.available[index]--
+		}
+	}
+	delete(s.peers, c)
+}
+
+// allowed tells if the peer was told about the piece at index, so that it
+// may request it
+func (s *superSeeder) allowed(c *client.Client, index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[c]
+	return ok && p.revealed.HasPiece(index)
+}
+
+// have records the pieces a peer reports having, with a bitfield or Have
+// messages. The peers that were told about those pieces before are told
+// about new ones.
+func (s *superSeeder) have(c *client.Client, indexes ...int) {
+	s.mu.Lock()
+	p, ok := s.peers[c]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	var haves []superSeedHave
+	for _, index := range indexes {
+		if index < 0 || index >= s.pieces || p.has.HasPiece(index) {
+			continue
+		}
+		p.has.SetPiece(index)
+		s.count(p, index)
+		for other, op := range s.peers {
+			if other != c && op.pending[index] {
+				delete(op.pending, index)
+				haves = s.reveal(other, haves)
+			}
+		}
+	}
+	s.mu.Unlock()
+	sendHaves(haves)
+}
+
+// count counts a piece in available for a peer, once. The lock must be held.
+func (s *superSeeder) count(p *superSeededPeer, index int) {
+	if !p.counted.HasPiece(index) {
+		p.counted.SetPiece(index)
+		s.available[index]++
+	}
+}
+
+// reveal picks the least distributed piece the peer neither has nor was
+// told about, and appends it to haves. The lock must be held.
+func (s *superSeeder) reveal(c *client.Client, haves []superSeedHave) []superSeedHave {
+	p := s.peers[c]
+	best := -1
+	for index := 0; index < s.pieces; index++ {
+		if p.has.HasPiece(index) || p.revealed.HasPiece(index) {
+			continue
+		}
+		if best < 0 || s.available[index] < s.available[best] {
+			best = index
+		}
+	}
+	if best < 0 {
+		return haves
+	}
+	p.revealed.SetPiece(best)
+	p.pending[best] = true
+	s.count(p, best)
+	return append(haves, superSeedHave{c, best})
+}
+
+// sendHaves tells the peers about their pieces, outside of the lock as
+// sending may block
+func sendHaves(haves []superSeedHave) {
+	for _, h := range haves {
+		h.c.SendHave(h.index)
+	}
+}
@@ -0,0 +1,74 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readUntil reads the messages of c until one is wanted, and returns it
+func readUntil(t *testing.T, c *client.Client, wanted func(*message.Message) bool) *message.Message {
+	t.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	for {
+		msg, err := c.Read()
+		require.Nil(t, err)
+		if msg != nil && wanted(msg) {
+			return msg
+		}
+	}
+}
+
+func TestSuperSeed(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, seeder := newTestTorrent(4*pieceLength, pieceLength)
+	seeder.SuperSeed = true
+	p, _ := startSeeder(t, &seeder, data)
+
+	// Each peer is told about a single piece, the least distributed
+	x, err := client.New(context.Background(), p, [20]byte{'x'}, seeder.InfoHash)
+	require.Nil(t, err)
+	defer x.Conn.Close()
+	assert.Equal(t, bitfield.New(4), x.Bitfield)
+	index, err := readUntil(t, x, isHave).ParseHave()
+	require.Nil(t, err)
+	assert.Equal(t, 0, index)
+
+	y, err := client.New(context.Background(), p, [20]byte{'y'}, seeder.InfoHash)
+	require.Nil(t, err)
+	defer y.Conn.Close()
+	assert.Equal(t, bitfield.New(4), y.Bitfield)
+	index, err = readUntil(t, y, isHave).ParseHave()
+	require.Nil(t, err)
+	assert.Equal(t, 1, index)
+
+	// Once y has the piece of x, x uploaded it onward and is told about
+	// another one
+	require.Nil(t, y.SendHave(0))
+	index, err = readUntil(t, x, isHave).ParseHave()
+	require.Nil(t, err)
+	assert.Equal(t, 2, index)
+
+	// x only gets the pieces it was told about
+	require.Nil(t, x.SendInterested())
+	readUntil(t, x, isUnchoke)
+	require.Nil(t, x.SendRequest(1, 0, MaxBlockSize))
+	require.Nil(t, x.SendRequest(2, 0, MaxBlockSize))
+	msg := readUntil(t, x, isPiece)
+	buf := make([]byte, pieceLength)
+	n, err := msg.ParsePiece(2, buf)
+	require.Nil(t, err)
+	assert.Equal(t, MaxBlockSize, n)
+	assert.Equal(t, data[2*pieceLength:3*pieceLength], buf)
+}
+
+func isHave(msg *message.Message) bool    { return msg.ID == message.MsgHave }
+func isUnchoke(msg *message.Message) bool { return msg.ID == message.MsgUnchoke }
+func isPiece(msg *message.Message) bool   { return msg.ID == message.MsgPiece }
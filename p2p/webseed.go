@@ -0,0 +1,218 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/message"
+)
+
+// WebFile is a file of a multi-file torrent, in the order of the data. Web
+// seeds serve it at its Path under the directory of the torrent, except for
+// padding files (BEP 47), which are zeros never fetched.
+type WebFile struct {
+	Path    []string
+	Length  int64
+	Padding bool
+}
+
+// webFile is a file of the torrent on a web seed
+type webFile struct {
+	url     string
+	length  int64
+	padding bool
+}
+
+// webFiles returns the files of the torrent on the web seed at base, as
+// described by BEP 19: the name of the torrent is appended to URLs ending
+// with a slash, and multi-file torrents are directories
+func (t *Torrent) webFiles(base string) []webFile {
+	if len(t.WebFiles) == 0 {
+		if strings.HasSuffix(base, "/") {
+			base += url.PathEscape(t.Name)
+		}
+		return []webFile{{url: base, length: int64(t.Length)}}
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	dir := base + url.PathEscape(t.Name) + "/"
+	files := make([]webFile, len(t.WebFiles))
+	for i, f := range t.WebFiles {
+		path := make([]string, len(f.Path))
+		for j, elem := range f.Path {
+			path[j] = url.PathEscape(elem)
+		}
+		files[i] = webFile{url: dir + strings.Join(path, "/"), length: f.Length, padding: f.Padding}
+	}
+	return files
+}
+
+func (t *Torrent) httpClient() *http.Client {
+	if t.HTTPClient != nil {
+		return t.HTTPClient
+	}
+	if t.Dialer == nil {
+		return http.DefaultClient
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.webClient == nil {
+		t.webClient = &http.Client{Transport: &http.Transport{DialContext: t.Dialer.DialContext}}
+	}
+	return t.webClient
+}
+
+// fetchRange reads length bytes at the offset off of the torrent data from
+// the files of a web seed, with a range request per file spanned
+func (t *Torrent) fetchRange(ctx context.Context, files []webFile, off int64, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	done := 0
+	start := int64(0)
+	for _, f := range files {
+		if done == length {
+			break
+		}
+		fileEnd := start + f.length
+		pos := off + int64(done)
+		if f.length > 0 && pos >= start && pos < fileEnd {
+			end := length
+			if rest := fileEnd - pos; int64(end-done) > rest {
+				end = done + int(rest)
+			}
+			// buf is zeroed already for padding files
+			if !f.padding {
+				err := t.fetchFile(ctx, f.url, pos-start, buf[done:end])
+				if err != nil {
+					return nil, err
+				}
+			}
+			done = end
+		}
+		start = fileEnd
+	}
+	if done < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+// fetchFile reads len(buf) bytes at the offset off of a file
+func (t *Torrent) fetchFile(ctx context.Context, fileURL string, off int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+	res, err := t.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file
+		_, err = io.CopyN(io.Discard, res.Body, off)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: %s", fileURL, res.Status)
+	}
+	_, err = io.ReadFull(res.Body, buf)
+	return err
+}
+
+// runWebSeed downloads pieces from a web seed until none is left, the
+// context is done, or the web seed fails. A web seed delivering a corrupt
+// piece is not downloaded from anymore.
+func (t *Torrent) runWebSeed(ctx context.Context, base string, pieces *picker, results chan *pieceResult, hashes *hashPool) {
+	var verifying sync.WaitGroup
+	defer verifying.Wait()
+
+	files := t.webFiles(base)
+	all := bitfield.New(len(t.PieceHashes))
+	for index := range t.PieceHashes {
+		all.SetPiece(index)
+	}
+	pieces.join(all)
+	defer pieces.leave(all)
+
+	var corrupt int32 // accessed atomically
+	for atomic.LoadInt32(&corrupt) == 0 {
+		pw, blocks, ok := pieces.pick(all, func(int) bool { return false }, true)
+		if !ok {
+			return
+		}
+		begin, _ := t.calcultateBoundsForPiece(pw.index)
+		fetchCtx, cancel := context.WithTimeout(ctx, t.pieceTimeout(pw.length))
+		buf, err := t.fetchRange(fetchCtx, files, int64(begin), pw.length)
+		cancel()
+		if err != nil {
+			pieces.put(pw)
+			if ctx.Err() == nil {
+				t.logger().Log(logging.Warn, "could not fetch piece, disconnecting", logging.F("webseed", base), logging.F("piece", pw.index), logging.F("err", err))
+			}
+			return
+		}
+		for _, l := range t.DownloadLimiters {
+			if l.Wait(ctx, len(buf)) != nil {
+				pieces.put(pw)
+				return
+			}
+		}
+		t.counters.AddPayloadDownloaded(int64(len(buf)))
+
+		// The blocks go through the piece shared with the peers, which may
+		// have delivered some of them in endgame mode
+		complete := false
+		blockSize := t.blockSize()
+		for offset := 0; offset < len(buf); offset += blockSize {
+			end := offset + blockSize
+			if end > len(buf) {
+				end = len(buf)
+			}
+			done, err := blocks.receive(pw.index, message.NewPiece(pw.index, offset, buf[offset:end]))
+			if err != nil {
+				break
+			}
+			complete = complete || done
+		}
+		if !complete {
+			pieces.put(pw)
+			continue
+		}
+
+		verifying.Add(1)
+		hashes.verify(pw, blocks.buf, func(err error) {
+			defer verifying.Done()
+			if errors.Is(err, errHashPoolClosed) {
+				return
+			}
+			if err != nil {
+				t.logger().Log(logging.Warn, "piece failed integrity check, disconnecting", logging.F("webseed", base), logging.F("piece", pw.index))
+				t.metrics().AddCounter(MetricIntegrityFailures, 1)
+				t.emit(HashFailed{Index: pw.index, Source: base})
+				pieces.put(pw)
+				atomic.StoreInt32(&corrupt, 1)
+				return
+			}
+			select {
+			case results <- &pieceResult{pw, blocks.buf}:
+			case <-ctx.Done():
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebFiles(t *testing.T) {
+	to := Torrent{Name: "a file.iso", Length: 10}
+	assert.Equal(t, []webFile{{url: "http://example.com/a%20file.iso", length: 10}}, to.webFiles("http://example.com/"))
+	assert.Equal(t, []webFile{{url: "http://example.com/other.iso", length: 10}}, to.webFiles("http://example.com/other.iso"))
+
+	to = Torrent{Name: "dir", Length: 3, WebFiles: []WebFile{{Path: []string{"a"}, Length: 1}, {Path: []string{"sub", "b#1"}, Length: 2}}}
+	expected := []webFile{{url: "http://example.com/dir/a", length: 1}, {url: "http://example.com/dir/sub/b%231", length: 2}}
+	assert.Equal(t, expected, to.webFiles("http://example.com"))
+	assert.Equal(t, expected, to.webFiles("http://example.com/"))
+}
+
+func TestDownloadWebSeed(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data, to := newTestTorrent(5*pieceLength-10, pieceLength)
+	to.Logger = logging.Discard
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	to.WebSeeds = []string{server.URL + "/test"}
+	to.Peers = []peer.Peer{}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Equal(t, int64(len(data)), to.counters.Snapshot().PayloadDownloaded)
+}
+
+func TestDownloadWebSeedDialer(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	d := &redirectDialer{to: server.Listener.Addr().String()}
+	to.Dialer = d
+	to.WebSeeds = []string{"http://seed.example.com/test"}
+	to.Peers = []peer.Peer{}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+	assert.Contains(t, d.dialed, "seed.example.com:80")
+}
+
+func TestDownloadWebSeedMultiFile(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	// The pieces span the files
+	dir := t.TempDir()
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "test", "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "test", "a"), data[:100], 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "test", "sub", "b"), data[100:], 0644))
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	to.WebSeeds = []string{server.URL + "/"}
+	to.WebFiles = []WebFile{{Path: []string{"a"}, Length: 100}, {Path: []string{"sub", "b"}, Length: int64(len(data) - 100)}}
+	to.Peers = []peer.Peer{}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadWebSeedPadding(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(2*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	// The padding file aligns b on the second piece, the web seed lacks it
+	for i := 100; i < pieceLength; i++ {
+		data[i] = 0
+	}
+	to.PieceHashes[0] = sha1.Sum(data[:pieceLength])
+	dir := t.TempDir()
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "test"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "test", "a"), data[:100], 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "test", "b"), data[pieceLength:], 0644))
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	to.WebSeeds = []string{server.URL + "/"}
+	to.WebFiles = []WebFile{
+		{Path: []string{"a"}, Length: 100},
+		{Path: []string{".pad", "0"}, Length: int64(pieceLength - 100), Padding: true},
+		{Path: []string{"b"}, Length: int64(pieceLength)},
+	}
+	to.Peers = []peer.Peer{}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDownloadWebSeedCorrupt(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(3*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	corrupt := make([]byte, len(data))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(corrupt))
+	}))
+	defer server.Close()
+	to.WebSeeds = []string{server.URL + "/test"}
+	to.Peers = []peer.Peer{}
+
+	_, err := downloadBytes(&to)
+	assert.True(t, errors.Is(err, ErrUnsatisfiable))
+}
+
+func TestDownloadWebSeedWithPeers(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data, to := newTestTorrent(8*pieceLength, pieceLength)
+	to.Logger = logging.Discard
+	fp := newFakePeer(t, data, pieceLength, allPieces(4))
+	fp.wait = func(int) { time.Sleep(10 * time.Millisecond) }
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	to.WebSeeds = []string{server.URL + "/test"}
+	to.Peers = []peer.Peer{fp.Peer}
+
+	buf, err := downloadBytes(&to)
+	require.Nil(t, err)
+	assert.Equal(t, data, buf)
+}
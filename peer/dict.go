@@ -0,0 +1,50 @@
+package peer
+
+import (
+	"context"
+	"net"
+)
+
+// Dict is a peer in the dictionary model of the tracker responses, which
+// predates the compact format
+type Dict struct {
+	ID   string `bencode:"peer id"`
+	IP   string `bencode:"ip"` // IPv4 or IPv6 address, or DNS name
+	Port int    `bencode:"port"`
+}
+
+// Resolver looks up the IP addresses of a host, like net.Resolver
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// FromDicts returns the peers of the dictionary model, resolving the DNS
+// names with r, or net.DefaultResolver if nil. Peers with an invalid port or
+// a name that does not resolve are skipped.
+func FromDicts(ctx context.Context, dicts []Dict, r Resolver) ([]Peer, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	peers := make([]Peer, 0, len(dicts))
+	for _, d := range dicts {
+		if d.Port <= 0 || d.Port > 0xffff {
+			continue
+		}
+		ip := net.ParseIP(d.IP)
+		if ip == nil {
+			addrs, err := r.LookupIPAddr(ctx, d.IP)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil || len(addrs) == 0 {
+				continue
+			}
+			ip = addrs[0].IP
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		peers = append(peers, Peer{IP: ip, Port: uint16(d.Port)})
+	}
+	return peers, nil
+}
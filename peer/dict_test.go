@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver map[string][]net.IPAddr
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestFromDicts(t *testing.T) {
+	r := fakeResolver{"peer.example.com": {{IP: net.IP{198, 51, 100, 7}}}}
+	dicts := []Dict{
+		{ID: "a", IP: "192.0.2.123", Port: 6881},
+		{ID: "b", IP: "2001:db8::1", Port: 6882},
+		{ID: "c", IP: "peer.example.com", Port: 6883},
+		{ID: "d", IP: "unknown.example.com", Port: 6884},
+		{ID: "e", IP: "192.0.2.124", Port: 70000},
+		{ID: "f", IP: "192.0.2.125", Port: 0},
+	}
+	peers, err := FromDicts(context.Background(), dicts, r)
+	require.Nil(t, err)
+	assert.Equal(t, []Peer{
+		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+		{IP: net.IP{198, 51, 100, 7}, Port: 6883},
+	}, peers)
+}
+
+func TestFromDictsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := FromDicts(ctx, []Dict{{IP: "peer.example.com", Port: 6881}}, fakeResolver{})
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,133 @@
+package peer
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// ClientName and ClientVersion identify this client, e.g. in the
+	// User-Agent of tracker requests
+	ClientName    = "torrent-client"
+	ClientVersion = "0.1.0"
+	// IDPrefix starts the peer IDs of this client, in the Azureus style
+	// with its code and version
+	IDPrefix = "-LH0100-"
+)
+
+// azureusClients are the names of the clients by the two letter code of
+// their Azureus-style peer IDs, such as -UT3550-
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LH": ClientName,
+	"LT": "libtorrent",
+	"lt": "libtorrent (Rasterbar)",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WD": "WebTorrent Desktop",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients are the names of the clients by the letter starting their
+// Shad0w-style peer IDs, such as S58B-----
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT BitTorrent",
+}
+
+// Identify returns the name and version of the client using a peer ID, as
+// encoded by the Azureus and Shad0w conventions. Unknown Azureus codes are
+// returned as the name. Both are empty when the ID follows neither.
+func Identify(id [20]byte) (name, version string) {
+	if name, version, ok := identifyAzureus(id); ok {
+		return name, version
+	}
+	if name, version, ok := identifyShadow(id); ok {
+		return name, version
+	}
+	return "", ""
+}
+
+// identifyAzureus decodes a -XX1234- prefix, each version character being a
+// digit or a letter counting from 10
+func identifyAzureus(id [20]byte) (name, version string, ok bool) {
+	if id[0] != '-' || id[7] != '-' || !isLetter(id[1]) || !isLetter(id[2]) {
+		return "", "", false
+	}
+	parts := make([]string, 4)
+	for i := range parts {
+		n, ok := versionDigit(id[3+i])
+		if !ok || n > 35 {
+			return "", "", false
+		}
+		parts[i] = strconv.Itoa(n)
+	}
+	code := string(id[1:3])
+	name, ok = azureusClients[code]
+	if !ok {
+		name = code
+	}
+	return name, strings.Join(parts, "."), true
+}
+
+// identifyShadow decodes a client letter followed by three version
+// characters and dashes, each version character being a digit, a letter
+// counting from 10 for uppercase and 36 for lowercase, '.' for 62 or '-'
+// ending the version
+func identifyShadow(id [20]byte) (name, version string, ok bool) {
+	name, ok = shadowClients[id[0]]
+	if !ok || id[4] != '-' || id[5] != '-' {
+		return "", "", false
+	}
+	var parts []string
+	for _, b := range id[1:4] {
+		if b == '-' {
+			break
+		}
+		n, ok := versionDigit(b)
+		if !ok {
+			return "", "", false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if len(parts) == 0 {
+		return "", "", false
+	}
+	return name, strings.Join(parts, "."), true
+}
+
+// versionDigit returns the value of a version character
+func versionDigit(b byte) (int, bool) {
+	switch {
+	case b >= '0' && b <= '9':
+		return int(b - '0'), true
+	case b >= 'A' && b <= 'Z':
+		return int(b-'A') + 10, true
+	case b >= 'a' && b <= 'z':
+		return int(b-'a') + 36, true
+	case b == '.':
+		return 62, true
+	}
+	return 0, false
+}
+
+func isLetter(b byte) bool {
+	return b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z'
+}
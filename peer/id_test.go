@@ -0,0 +1,32 @@
+package peer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentify(t *testing.T) {
+	tests := map[string]struct {
+		id      string
+		name    string
+		version string
+	}{
+		"azureus":              {id: "-UT3550-abcdefghijkl", name: "µTorrent", version: "3.5.5.0"},
+		"azureus letters":      {id: "-qB4A50-abcdefghijkl", name: "qBittorrent", version: "4.10.5.0"},
+		"azureus unknown code": {id: "-ZZ0100-abcdefghijkl", name: "ZZ", version: "0.1.0.0"},
+		"shadow":               {id: "S58B-----abcdefghijk", name: "Shadow's client", version: "5.8.11"},
+		"shadow short version": {id: "T03---abcdefghijklmn", name: "BitTornado", version: "0.3"},
+		"random":               {id: "\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13\x14"},
+		"malformed azureus":    {id: "-UT35!0-abcdefghijkl"},
+		"malformed shadow":     {id: "S5!B-----abcdefghijk"},
+	}
+
+	for name, test := range tests {
+		var id [20]byte
+		copy(id[:], test.id)
+		client, version := Identify(id)
+		assert.Equal(t, test.name, client, name)
+		assert.Equal(t, test.version, version, name)
+	}
+}
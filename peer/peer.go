@@ -7,7 +7,10 @@ import (
 	"strconv"
 )
 
-const peerSize = 6 // 4 for IP, 2 for port
+const (
+	peerSize  = 6  // 4 for IP, 2 for port
+	peer6Size = 18 // 16 for IP, 2 for port
+)
 
 // Peer encodes connection information for a peer
 type Peer struct {
@@ -24,12 +27,55 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
+		peers[i].IP = net.IP(append([]byte(nil), peersBin[offset:offset+4]...))
 		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
 	}
 	return peers, nil
 }
 
+// Marshal encodes IPv4 peers in the compact format parsed by Unmarshal.
+// Peers that are not IPv4 are skipped.
+func Marshal(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*peerSize)
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, ip...)
+		buf = append(buf, byte(p.Port>>8), byte(p.Port))
+	}
+	return buf
+}
+
+// Unmarshal6 parses IPv6 peer addresses and ports from a buffer
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	if len(peersBin)%peer6Size != 0 {
+		return nil, fmt.Errorf("received malformed peers of length %d", len(peersBin))
+	}
+	peers := make([]Peer, len(peersBin)/peer6Size)
+	for i := range peers {
+		offset := i * peer6Size
+		peers[i].IP = net.IP(append([]byte(nil), peersBin[offset:offset+16]...))
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16 : offset+18])
+	}
+	return peers, nil
+}
+
+// Marshal6 encodes IPv6 peers in the compact format parsed by Unmarshal6.
+// IPv4 peers are skipped.
+func Marshal6(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*peer6Size)
+	for _, p := range peers {
+		if p.IP.To4() != nil || len(p.IP) != net.IPv6len {
+			continue
+		}
+		buf = append(buf, p.IP...)
+		buf = append(buf, byte(p.Port>>8), byte(p.Port))
+	}
+	return buf
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
@@ -38,6 +38,54 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestMarshal(t *testing.T) {
+	tests := map[string]struct {
+		input  []Peer
+		output []byte
+	}{
+		"encodes peers": {
+			input: []Peer{
+				{IP: net.IP{127, 0, 0, 1}, Port: 80},
+				{IP: net.IP{1, 1, 1, 1}, Port: 443},
+			},
+			output: []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb},
+		},
+		"skips IPv6 peers": {
+			input: []Peer{
+				{IP: net.ParseIP("::1"), Port: 80},
+				{IP: net.ParseIP("1.1.1.1"), Port: 443},
+			},
+			output: []byte{1, 1, 1, 1, 0x01, 0xbb},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, Marshal(test.input))
+	}
+}
+
+func TestUnmarshal6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	input := append(append([]byte(nil), ip...), 0x1a, 0xe1)
+
+	peers, err := Unmarshal6(input)
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{{IP: ip, Port: 6881}}, peers)
+
+	_, err = Unmarshal6(input[:17])
+	assert.NotNil(t, err)
+}
+
+func TestMarshal6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	peers := []Peer{
+		{IP: net.IP{1, 1, 1, 1}, Port: 443},
+		{IP: ip, Port: 6881},
+	}
+	expected := append(append([]byte(nil), ip...), 0x1a, 0xe1)
+	assert.Equal(t, expected, Marshal6(peers))
+}
+
 func TestString(t *testing.T) {
 	tests := []struct {
 		input  Peer
@@ -47,6 +95,10 @@ func TestString(t *testing.T) {
 			input:  Peer{IP: net.IP{127, 0, 0, 1}, Port: 8080},
 			output: "127.0.0.1:8080",
 		},
+		{
+			input:  Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			output: "[2001:db8::1]:6881",
+		},
 	}
 	for _, test := range tests {
 		s := test.input.String()
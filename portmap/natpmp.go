@@ -0,0 +1,145 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// natpmpPort is the port NAT-PMP gateways listen on
+	natpmpPort = 5351
+	// natpmpTries is the number of times a request is sent, waiting twice as
+	// long for the response each time from natpmpTimeout on
+	natpmpTries   = 4
+	natpmpTimeout = 250 * time.Millisecond
+
+	natpmpOpExternalAddress = 0
+	natpmpOpMapTCP          = 2
+)
+
+// natpmpResults are the failures reported by NAT-PMP gateways, by result code
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// NATPMP maps ports with the NAT-PMP protocol (RFC 6886)
+type NATPMP struct {
+	// Gateway is the UDP address of the gateway
+	Gateway string
+}
+
+// NewNATPMP returns the mapper of a NAT-PMP gateway
+func NewNATPMP(gateway net.IP) *NATPMP {
+	return &NATPMP{Gateway: net.JoinHostPort(gateway.String(), strconv.Itoa(natpmpPort))}
+}
+
+func (m *NATPMP) String() string {
+	return "NAT-PMP gateway " + m.Gateway
+}
+
+// ExternalAddress returns the public IPv4 address of the gateway
+func (m *NATPMP) ExternalAddress(ctx context.Context) (net.IP, error) {
+	resp, err := m.request(ctx, []byte{0, natpmpOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(resp[8:12]), nil
+}
+
+// AddMapping maps a TCP port
+func (m *NATPMP) AddMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	resp, err := m.request(ctx, mapRequest(internal, external, lifetime), 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	mapped := binary.BigEndian.Uint16(resp[10:12])
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return mapped, granted, nil
+}
+
+// DeleteMapping deletes the mapping of a TCP port
+func (m *NATPMP) DeleteMapping(ctx context.Context, internal, external uint16) error {
+	_, err := m.request(ctx, mapRequest(internal, 0, 0), 16)
+	return err
+}
+
+// mapRequest builds the request mapping a TCP port, which deletes the
+// mapping with a lifetime of 0
+func mapRequest(internal, external uint16, lifetime time.Duration) []byte {
+	req := make([]byte, 12)
+	req[1] = natpmpOpMapTCP
+	binary.BigEndian.PutUint16(req[4:6], internal)
+	binary.BigEndian.PutUint16(req[6:8], external)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	return req
+}
+
+// request sends a request to the gateway until it responds and returns the
+// response, of at least size bytes
+func (m *NATPMP) request(ctx context.Context, req []byte, size int) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", m.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Expiring the deadline interrupts the read in progress
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	timeout := natpmpTimeout
+	buf := make([]byte, 16)
+	for try := 0; try < natpmpTries; try++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		// The deadline may have overridden the one of ctx
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		for {
+			n, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			// Responses to other requests are ignored
+			if n < size || buf[0] != 0 || buf[1] != 128+req[1] {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+				if msg, ok := natpmpResults[code]; ok {
+					return nil, fmt.Errorf("NAT-PMP: %s", msg)
+				}
+				return nil, fmt.Errorf("NAT-PMP: result code %d", code)
+			}
+			return buf[:n], nil
+		}
+	}
+	return nil, errors.New("NAT-PMP: gateway did not respond")
+}
@@ -0,0 +1,121 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATPMP is a NAT-PMP gateway mapping the ports asked for, plus offset
+type fakeNATPMP struct {
+	conn     net.PacketConn
+	offset   uint16
+	result   uint16
+	requests chan []byte
+	drop     int // number of requests not answered
+}
+
+func newFakeNATPMP(t *testing.T) *fakeNATPMP {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &fakeNATPMP{conn: conn, requests: make(chan []byte, 16)}
+}
+
+func (g *fakeNATPMP) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, addr, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		g.requests <- req
+		if g.drop > 0 {
+			g.drop--
+			continue
+		}
+		resp := make([]byte, 16)
+		resp[1] = 128 + req[1]
+		binary.BigEndian.PutUint16(resp[2:4], g.result)
+		binary.BigEndian.PutUint32(resp[4:8], 1000)
+		switch req[1] {
+		case natpmpOpExternalAddress:
+			copy(resp[8:12], net.IP{203, 0, 113, 7})
+			resp = resp[:12]
+		case natpmpOpMapTCP:
+			copy(resp[8:10], req[4:6])
+			external := binary.BigEndian.Uint16(req[6:8])
+			if external != 0 {
+				external += g.offset
+			}
+			binary.BigEndian.PutUint16(resp[10:12], external)
+			copy(resp[12:16], req[8:12])
+		}
+		g.conn.WriteTo(resp, addr)
+	}
+}
+
+func TestNATPMPExternalAddress(t *testing.T) {
+	g := newFakeNATPMP(t)
+	go g.serve()
+	m := &NATPMP{Gateway: g.conn.LocalAddr().String()}
+
+	ip, err := m.ExternalAddress(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, net.IP{203, 0, 113, 7}, ip)
+}
+
+func TestNATPMPAddMapping(t *testing.T) {
+	g := newFakeNATPMP(t)
+	g.offset = 10
+	g.drop = 1 // the request is sent again
+	go g.serve()
+	m := &NATPMP{Gateway: g.conn.LocalAddr().String()}
+
+	external, lifetime, err := m.AddMapping(context.Background(), 6881, 6881, time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, uint16(6891), external)
+	assert.Equal(t, time.Hour, lifetime)
+
+	req := <-g.requests
+	assert.Equal(t, []byte{0, 2, 0, 0, 0x1a, 0xe1, 0x1a, 0xe1, 0, 0, 0x0e, 0x10}, req)
+}
+
+func TestNATPMPDeleteMapping(t *testing.T) {
+	g := newFakeNATPMP(t)
+	go g.serve()
+	m := &NATPMP{Gateway: g.conn.LocalAddr().String()}
+
+	err := m.DeleteMapping(context.Background(), 6881, 6891)
+	require.Nil(t, err)
+	req := <-g.requests
+	assert.Equal(t, []byte{0, 2, 0, 0, 0x1a, 0xe1, 0, 0, 0, 0, 0, 0}, req)
+}
+
+func TestNATPMPError(t *testing.T) {
+	g := newFakeNATPMP(t)
+	g.result = 2
+	go g.serve()
+	m := &NATPMP{Gateway: g.conn.LocalAddr().String()}
+
+	_, _, err := m.AddMapping(context.Background(), 6881, 6881, time.Hour)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not authorized")
+}
+
+func TestNATPMPCanceled(t *testing.T) {
+	g := newFakeNATPMP(t) // never answers
+	m := &NATPMP{Gateway: g.conn.LocalAddr().String()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := m.ExternalAddress(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
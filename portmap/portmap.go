@@ -0,0 +1,210 @@
+// Package portmap maps a TCP port of the gateway to this host with NAT-PMP
+// (RFC 6886) or UPnP IGD, so that peers behind a home NAT can be connected
+// to. Most PCP gateways (RFC 6887) answer NAT-PMP requests too.
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+)
+
+const (
+	// DefaultLifetime is the lifetime requested for the mappings, which are
+	// renewed halfway through
+	DefaultLifetime = time.Hour
+	// retryInterval is the time waited before renewing again a mapping whose
+	// renewal failed
+	retryInterval = time.Minute
+	// deleteTimeout is the time allowed to delete the mapping on shutdown
+	deleteTimeout = 3 * time.Second
+)
+
+// ErrNoGateway is returned by Discover when no gateway answers NAT-PMP nor
+// UPnP requests
+var ErrNoGateway = errors.New("no gateway supporting NAT-PMP or UPnP found")
+
+// Mapper maps TCP ports of a gateway to this host
+type Mapper interface {
+	// AddMapping maps the external port of the gateway to the internal port
+	// of this host for lifetime, or renews the mapping. The gateway may map
+	// another external port and grant another lifetime, which are returned.
+	// A lifetime of 0 is a permanent mapping.
+	AddMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error)
+	// DeleteMapping removes the mapping of the internal port
+	DeleteMapping(ctx context.Context, internal, external uint16) error
+	// String describes the gateway
+	String() string
+}
+
+// Discover finds the gateway of the local network, trying NAT-PMP before
+// UPnP
+func Discover(ctx context.Context) (Mapper, error) {
+	if gateway, err := DefaultGateway(); err == nil {
+		m := NewNATPMP(gateway)
+		if _, err := m.ExternalAddress(ctx); err == nil {
+			return m, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m, err := DiscoverUPnP(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %v", ErrNoGateway, err)
+	}
+	return m, nil
+}
+
+// PortMapping keeps a TCP port of this host mapped on a gateway
+type PortMapping struct {
+	// Mapper maps the port
+	Mapper Mapper
+	// Port is the port of this host, the same external port is asked for
+	Port uint16
+	// Lifetime is the lifetime requested for the mapping. Defaults to
+	// DefaultLifetime.
+	Lifetime time.Duration
+	// Mapped, if set, is called with the external port once mapped, and
+	// again if the gateway maps another port when renewing
+	Mapped func(external uint16)
+	// Logger logs the renewals. Defaults to logging.Default.
+	Logger logging.Logger
+}
+
+func (pm *PortMapping) logger() logging.Logger {
+	if pm.Logger == nil {
+		return logging.Default
+	}
+	return pm.Logger
+}
+
+// Run maps the port, renews the mapping before it expires until ctx is done,
+// and then deletes it. It returns an error if the port could not be mapped
+// at first; failed renewals are logged and retried.
+func (pm *PortMapping) Run(ctx context.Context) error {
+	lifetime := pm.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+	external, granted, err := pm.Mapper.AddMapping(ctx, pm.Port, pm.Port, lifetime)
+	if err != nil {
+		return fmt.Errorf("mapping port %d on %s: %w", pm.Port, pm.Mapper, err)
+	}
+	logger := logging.With(pm.logger(), logging.F("gateway", pm.Mapper.String()), logging.F("port", pm.Port))
+	logger.Log(logging.Info, "port mapped", logging.F("external", external), logging.F("lifetime", granted))
+	if pm.Mapped != nil {
+		pm.Mapped(external)
+	}
+
+	for {
+		renew := granted / 2
+		if granted <= 0 {
+			renew = lifetime / 2
+		}
+		timer := time.NewTimer(renew)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			deleteCtx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+			defer cancel()
+			if err := pm.Mapper.DeleteMapping(deleteCtx, pm.Port, external); err != nil {
+				logger.Log(logging.Warn, "could not delete port mapping", logging.F("err", err))
+			}
+			return nil
+		case <-timer.C:
+		}
+
+		renewed, g, err := pm.Mapper.AddMapping(ctx, pm.Port, external, lifetime)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Log(logging.Warn, "could not renew port mapping", logging.F("err", err))
+			}
+			granted = 2 * retryInterval
+			continue
+		}
+		granted = g
+		if renewed != external {
+			external = renewed
+			logger.Log(logging.Info, "port mapped", logging.F("external", external), logging.F("lifetime", granted))
+			if pm.Mapped != nil {
+				pm.Mapped(external)
+			}
+		}
+	}
+}
+
+// DefaultGateway returns the IPv4 address of the default gateway, read from
+// the routing table on Linux. Elsewhere, it is guessed as the first address
+// of the network of this host, such as 192.168.1.1.
+func DefaultGateway() (net.IP, error) {
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		defer f.Close()
+		if ip, err := parseRoutes(f); err == nil {
+			return ip, nil
+		}
+	}
+	local, err := localIP("192.0.2.1:9")
+	if err != nil {
+		return nil, err
+	}
+	ip := local.To4()
+	if ip == nil {
+		return nil, errors.New("no IPv4 address")
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], 1), nil
+}
+
+// parseRoutes returns the gateway of the default route of a Linux routing
+// table, as listed by /proc/net/route
+func parseRoutes(r io.Reader) (net.IP, error) {
+	s := bufio.NewScanner(r)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&0x2 == 0 { // RTF_GATEWAY
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// The address is in host byte order, little-endian on most hosts
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+		return ip, nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default route")
+}
+
+// localIP returns the address of this host on the network of address. No
+// packet is sent.
+func localIP(address string) (net.IP, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
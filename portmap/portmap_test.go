@@ -0,0 +1,111 @@
+package portmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output net.IP
+	}{
+		"default route": {
+			"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+				"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+				"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			net.IP{192, 168, 1, 1},
+		},
+		"no gateway flag": {
+			"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+				"eth0\t00000000\t0101A8C0\t0001\t0\t0\t0\t00000000\t0\t0\t0\n",
+			nil,
+		},
+		"no default route": {
+			"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+				"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+			nil,
+		},
+	}
+
+	for name, test := range tests {
+		output, err := parseRoutes(strings.NewReader(test.input))
+		assert.Equal(t, test.output == nil, err != nil, name)
+		assert.Equal(t, test.output, output, name)
+	}
+}
+
+// fakeMapper records the mappings asked for
+type fakeMapper struct {
+	mu       sync.Mutex
+	added    []uint16 // external ports asked for
+	deleted  []uint16
+	external uint16 // port mapped, the one asked for if 0
+	lifetime time.Duration
+	err      error
+}
+
+func (m *fakeMapper) AddMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.added = append(m.added, external)
+	if m.err != nil {
+		return 0, 0, m.err
+	}
+	if m.external != 0 {
+		external = m.external
+	}
+	return external, m.lifetime, nil
+}
+
+func (m *fakeMapper) DeleteMapping(ctx context.Context, internal, external uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, external)
+	return nil
+}
+
+func (m *fakeMapper) String() string {
+	return "fake gateway"
+}
+
+func TestPortMappingRun(t *testing.T) {
+	m := &fakeMapper{external: 7000, lifetime: 20 * time.Millisecond}
+	var mapped []uint16
+	pm := PortMapping{
+		Mapper: m,
+		Port:   6881,
+		Mapped: func(external uint16) { mapped = append(mapped, external) },
+		Logger: logging.Discard,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := pm.Run(ctx)
+	require.Nil(t, err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The mapping is renewed every 10ms, asking for the port mapped
+	assert.Greater(t, len(m.added), 3)
+	assert.Equal(t, uint16(6881), m.added[0])
+	assert.Equal(t, uint16(7000), m.added[1])
+	assert.Equal(t, []uint16{7000}, mapped)
+	assert.Equal(t, []uint16{7000}, m.deleted)
+}
+
+func TestPortMappingRunFails(t *testing.T) {
+	m := &fakeMapper{err: errors.New("refused")}
+	pm := PortMapping{Mapper: m, Port: 6881, Logger: logging.Discard}
+	err := pm.Run(context.Background())
+	assert.NotNil(t, err)
+	assert.Empty(t, m.deleted)
+}
@@ -0,0 +1,284 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ssdpAddr is the multicast address UPnP devices are searched on
+	ssdpAddr = "239.255.255.250:1900"
+	// ssdpWait is the time waited for the gateways to answer a search
+	ssdpWait = 2 * time.Second
+	// upnpDescription is the description of the mappings
+	upnpDescription = "torrent-client"
+)
+
+// upnpServices are the types of the services mapping ports, by preference
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// errOnlyPermanentLeases is the error code of the gateways that refuse
+// mappings with a lifetime
+const errOnlyPermanentLeases = 725
+
+// UPnP maps ports with the WANIPConnection or WANPPPConnection service of a
+// UPnP Internet Gateway Device
+type UPnP struct {
+	// ControlURL is the URL the actions of the service are posted to
+	ControlURL string
+	// ServiceType is the type of the service
+	ServiceType string
+	// Client is the local address ports are mapped to
+	Client net.IP
+}
+
+func (m *UPnP) String() string {
+	return "UPnP gateway " + m.ControlURL
+}
+
+// DiscoverUPnP searches the local network for an Internet Gateway Device
+// with SSDP and returns the first one able to map ports
+func DiscoverUPnP(ctx context.Context) (*UPnP, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), addr); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ssdpWait))
+	seen := make(map[string]bool)
+	lastErr := errors.New("no UPnP gateway answered")
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, lastErr
+		}
+		location, ok := ssdpLocation(buf[:n])
+		if !ok || seen[location] {
+			continue
+		}
+		seen[location] = true
+		m, err := NewUPnP(ctx, location)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return m, nil
+	}
+}
+
+// ssdpLocation returns the URL of the description of the device answering a
+// search
+func ssdpLocation(resp []byte) (string, bool) {
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+	if err != nil || r.StatusCode != http.StatusOK {
+		return "", false
+	}
+	location := r.Header.Get("Location")
+	return location, location != ""
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// find returns the service of type serviceType of the device or of its
+// embedded devices
+func (d upnpDevice) find(serviceType string) (upnpService, bool) {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return s, true
+		}
+	}
+	for _, child := range d.Devices {
+		if s, ok := child.find(serviceType); ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// NewUPnP returns the mapper of the gateway whose device description is at
+// location
+func NewUPnP(ctx context.Context, location string) (*UPnP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upnpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("UPnP: fetching %s: %s", location, resp.Status)
+	}
+	var root upnpRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, fmt.Errorf("UPnP: decoding %s: %w", location, err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	for _, serviceType := range upnpServices {
+		s, ok := root.Device.find(serviceType)
+		if !ok {
+			continue
+		}
+		control, err := base.Parse(strings.TrimSpace(s.ControlURL))
+		if err != nil {
+			return nil, err
+		}
+		client, err := localIP(net.JoinHostPort(control.Hostname(), "80"))
+		if err != nil {
+			return nil, err
+		}
+		return &UPnP{ControlURL: control.String(), ServiceType: serviceType, Client: client}, nil
+	}
+	return nil, fmt.Errorf("UPnP: %s maps no ports", location)
+}
+
+// upnpClient sends the requests to the gateways
+var upnpClient = &http.Client{Timeout: 5 * time.Second}
+
+// upnpError is the error returned by a failed action
+type upnpError struct {
+	Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+	Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP: error %d: %s", e.Code, e.Description)
+}
+
+// AddMapping maps a TCP port. The gateways supporting permanent mappings
+// only are asked for one, which is deleted on shutdown nonetheless.
+func (m *UPnP) AddMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	err := m.addMapping(ctx, internal, external, lifetime)
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.Code == errOnlyPermanentLeases {
+		lifetime = 0
+		err = m.addMapping(ctx, internal, external, lifetime)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return external, lifetime, nil
+}
+
+func (m *UPnP) addMapping(ctx context.Context, internal, external uint16, lifetime time.Duration) error {
+	return m.action(ctx, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprint(external)},
+		{"NewProtocol", "TCP"},
+		{"NewInternalPort", fmt.Sprint(internal)},
+		{"NewInternalClient", m.Client.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", upnpDescription},
+		{"NewLeaseDuration", fmt.Sprint(int(lifetime / time.Second))},
+	})
+}
+
+// DeleteMapping deletes the mapping of a TCP port
+func (m *UPnP) DeleteMapping(ctx context.Context, internal, external uint16) error {
+	return m.action(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprint(external)},
+		{"NewProtocol", "TCP"},
+	})
+}
+
+// action calls an action of the service with its arguments, in order
+func (m *UPnP) action(ctx context.Context, name string, args [][2]string) error {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + name + ` xmlns:u="` + m.ServiceType + `">`)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>%s</%s>", arg[0], html.EscapeString(arg[1]), arg[0])
+	}
+	body.WriteString(`</u:` + name + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.ControlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+m.ServiceType+"#"+name+`"`)
+	resp, err := upnpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	upnpErr := &upnpError{}
+	if xml.Unmarshal(data, upnpErr) != nil || upnpErr.Code == 0 {
+		return fmt.Errorf("UPnP: %s: %s", name, resp.Status)
+	}
+	return upnpErr
+}
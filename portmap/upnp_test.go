@@ -0,0 +1,167 @@
+package portmap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const igdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// fakeIGD is a UPnP gateway recording the actions called
+type fakeIGD struct {
+	server    *httptest.Server
+	mu        sync.Mutex
+	actions   []string // SOAPAction headers
+	bodies    []string
+	permanent bool // whether only permanent leases are supported
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	g := &fakeIGD{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, igdDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.actions = append(g.actions, r.Header.Get("SOAPAction"))
+		g.bodies = append(g.bodies, string(body))
+		if g.permanent && !strings.Contains(string(body), "<NewLeaseDuration>0</NewLeaseDuration>") &&
+			strings.Contains(string(body), "AddPortMapping") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+				`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+				`<errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body></s:Body></s:Envelope>`)
+	})
+	g.server = httptest.NewServer(mux)
+	t.Cleanup(g.server.Close)
+	return g
+}
+
+func TestSSDPLocation(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		location string
+		ok       bool
+	}{
+		"location":    {"HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\nLOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n\r\n", "http://192.168.1.1:5000/rootDesc.xml", true},
+		"no location": {"HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n", "", false},
+		"notify":      {"NOTIFY * HTTP/1.1\r\nLOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n\r\n", "", false},
+	}
+
+	for name, test := range tests {
+		location, ok := ssdpLocation([]byte(test.input))
+		assert.Equal(t, test.ok, ok, name)
+		assert.Equal(t, test.location, location, name)
+	}
+}
+
+func TestNewUPnP(t *testing.T) {
+	g := newFakeIGD(t)
+	m, err := NewUPnP(context.Background(), g.server.URL+"/rootDesc.xml")
+	require.Nil(t, err)
+	assert.Equal(t, g.server.URL+"/ctl/IPConn", m.ControlURL)
+	assert.Equal(t, "urn:schemas-upnp-org:service:WANIPConnection:1", m.ServiceType)
+	assert.Equal(t, "127.0.0.1", m.Client.String())
+}
+
+func TestNewUPnPNoService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<root><device><deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType></device></root>`)
+	}))
+	defer server.Close()
+	_, err := NewUPnP(context.Background(), server.URL)
+	assert.NotNil(t, err)
+}
+
+func TestUPnPAddMapping(t *testing.T) {
+	tests := map[string]struct {
+		permanent bool
+		lifetime  time.Duration
+		calls     int
+	}{
+		"lease":           {false, time.Hour, 1},
+		"permanent lease": {true, 0, 2},
+	}
+
+	for name, test := range tests {
+		g := newFakeIGD(t)
+		g.permanent = test.permanent
+		m, err := NewUPnP(context.Background(), g.server.URL+"/rootDesc.xml")
+		require.Nil(t, err, name)
+
+		external, lifetime, err := m.AddMapping(context.Background(), 6881, 6881, time.Hour)
+		require.Nil(t, err, name)
+		assert.Equal(t, uint16(6881), external, name)
+		assert.Equal(t, test.lifetime, lifetime, name)
+		require.Len(t, g.actions, test.calls, name)
+		assert.Equal(t, `"urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping"`, g.actions[0], name)
+		body := g.bodies[len(g.bodies)-1]
+		assert.Contains(t, body, "<NewExternalPort>6881</NewExternalPort>", name)
+		assert.Contains(t, body, "<NewInternalClient>127.0.0.1</NewInternalClient>", name)
+		assert.Contains(t, body, fmt.Sprintf("<NewLeaseDuration>%d</NewLeaseDuration>", int(test.lifetime.Seconds())), name)
+	}
+}
+
+func TestUPnPDeleteMapping(t *testing.T) {
+	g := newFakeIGD(t)
+	m, err := NewUPnP(context.Background(), g.server.URL+"/rootDesc.xml")
+	require.Nil(t, err)
+
+	err = m.DeleteMapping(context.Background(), 6881, 6881)
+	require.Nil(t, err)
+	assert.Equal(t, []string{`"urn:schemas-upnp-org:service:WANIPConnection:1#DeletePortMapping"`}, g.actions)
+	assert.Contains(t, g.bodies[0], "<NewExternalPort>6881</NewExternalPort>")
+}
+
+func TestUPnPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail>`+
+			`<UPnPError><errorCode>718</errorCode><errorDescription>ConflictInMappingEntry</errorDescription></UPnPError>`+
+			`</detail></s:Fault></s:Body></s:Envelope>`)
+	}))
+	defer server.Close()
+	m := &UPnP{ControlURL: server.URL, ServiceType: "urn:schemas-upnp-org:service:WANIPConnection:1"}
+
+	_, _, err := m.AddMapping(context.Background(), 6881, 6881, time.Hour)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "718")
+	assert.Contains(t, err.Error(), "ConflictInMappingEntry")
+}
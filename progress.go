@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/p2p"
+)
+
+const (
+	// progressInterval is the time between two redraws of the progress bar
+	progressInterval = 500 * time.Millisecond
+	// barWidth is the number of characters of the bar itself
+	barWidth = 30
+)
+
+// progressBar draws the progress of a torrent on the last line of a
+// terminal. It is also the logger of the torrent: the bar replaces the
+// progress entries, and the warnings are written above it.
+type progressBar struct {
+	mu   sync.Mutex
+	out  io.Writer
+	log  logging.Logger
+	line string
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{
+		out: out,
+		log: logging.Std{Logger: log.New(out, "", log.LstdFlags), Min: logging.Warn},
+	}
+}
+
+// update redraws the bar from the statistics of the torrent
+func (b *progressBar) update(s p2p.Stats) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.line = renderProgress(s)
+	fmt.Fprint(b.out, "\r\033[K"+b.line)
+}
+
+// Log writes the warnings and errors above the bar
+func (b *progressBar) Log(level logging.Level, msg string, fields ...logging.Field) {
+	if level < logging.Warn {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprint(b.out, "\r\033[K")
+	b.log.Log(level, msg, fields...)
+	fmt.Fprint(b.out, b.line)
+}
+
+// finish leaves the bar as last drawn and moves to the next line
+func (b *progressBar) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.line != "" {
+		fmt.Fprintln(b.out)
+		b.line = ""
+	}
+}
+
+// renderProgress returns the line of the progress bar of a torrent
+func renderProgress(s p2p.Stats) string {
+	percent := 100.0
+	filled := barWidth
+	if s.TotalPieces > 0 {
+		percent = float64(s.CompletedPieces) / float64(s.TotalPieces) * 100
+		filled = barWidth * s.CompletedPieces / s.TotalPieces
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+
+	var status string
+	switch {
+	case s.Paused:
+		status = "paused"
+	case s.ETA == 0:
+		status = fmt.Sprintf("complete  up %s/s  ratio %.2f", formatBytes(s.UploadRate), s.Ratio)
+	case s.ETA < 0:
+		status = fmt.Sprintf("%s/s  ETA --", formatBytes(s.DownloadRate))
+	default:
+		status = fmt.Sprintf("%s/s  ETA %s", formatBytes(s.DownloadRate), s.ETA.Round(time.Second))
+	}
+	return fmt.Sprintf("[%s] %5.1f%%  %s  %d peers", bar, percent, status, s.Peers)
+}
+
+// formatBytes returns a number of bytes in binary units
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// isTerminal tells whether f is a terminal, on which the progress bar can
+// be redrawn
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/leonhfr/torrent-client/daemon"
+)
+
+// runRemote controls a daemon over its JSON-RPC API:
+//
+//	torrent-client remote [flags] add <path|magnet link>...
+//	torrent-client remote [flags] remove|pause|resume <info hash>...
+//	torrent-client remote [flags] verify <info hash>...
+//	torrent-client remote [flags] move <info hash> <position>
+//	torrent-client remote [flags] list
+//	torrent-client remote [flags] limits [<download> <upload>]
+//	torrent-client remote [flags] queue [<downloads> <seeds>]
+//	torrent-client remote [flags] schedule [<rules>]
+func runRemote(args []string) error {
+	fs := flag.NewFlagSet("remote", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: torrent-client remote [flags] add <path|magnet link>...")
+		fmt.Fprintln(fs.Output(), "       torrent-client remote [flags] remove|pause|resume <info hash>...")
+		fmt.Fprintln(fs.Output(), "       torrent-client remote [flags] verify <info hash>...")
+		fmt.Fprintln(fs.Output(), "       torrent-client remote [flags] move <info hash> <position>")
+		fmt.Fprintln(fs.Output(), "       torrent-client remote [flags] list")
+		fmt.Fprintln(fs.Output(), "       torrent-client remote [flags] limits [<download> <upload>]")
+		fmt.Fprintln(fs.Output(), "       torrent-client remote [flags] queue [<downloads> <seeds>]")
+		fmt.Fprintln(fs.Output(), "       torrent-client remote [flags] schedule [<rules>]")
+		fmt.Fprintln(fs.Output(), "limits are in bytes per second, queue positions start at 0 and queue sizes are numbers of torrents, 0 for no limit")
+		fmt.Fprintln(fs.Output(), "verify hashes the data of the torrents again, within the timeout of the call")
+		fmt.Fprintln(fs.Output(), `rules are in the format of the -schedule flag of the daemon, e.g. "mon-fri 09:00-18:00 1000000 0", "" for none`)
+		fs.PrintDefaults()
+	}
+	url := fs.String("rpc", "http://"+defaultRPCAddress+"/rpc", "URL of the API of the daemon")
+	timeout := fs.Duration("timeout", 30*time.Second, "time allowed to each call")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("expected an action")
+	}
+	c := daemon.NewClient(*url)
+	action, args := fs.Arg(0), fs.Args()[1:]
+
+	call := func(fn func(ctx context.Context) error) error {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		return fn(ctx)
+	}
+	switch action {
+	case "add":
+		if len(args) == 0 {
+			return errors.New("expected torrent files or magnet links")
+		}
+		for _, arg := range args {
+			err := call(func(ctx context.Context) error {
+				info, err := addRemote(ctx, c, arg)
+				if err == nil {
+					fmt.Printf("%s %s\n", info.InfoHash, info.Name)
+				}
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", arg, err)
+			}
+		}
+	case "remove", "pause", "resume":
+		if len(args) == 0 {
+			return errors.New("expected info hashes")
+		}
+		for _, infoHash := range args {
+			err := call(func(ctx context.Context) error {
+				switch action {
+				case "remove":
+					return c.Remove(ctx, infoHash)
+				case "pause":
+					_, err := c.Pause(ctx, infoHash)
+					return err
+				default:
+					_, err := c.Resume(ctx, infoHash)
+					return err
+				}
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", infoHash, err)
+			}
+		}
+	case "verify":
+		if len(args) == 0 {
+			return errors.New("expected info hashes")
+		}
+		for _, infoHash := range args {
+			err := call(func(ctx context.Context) error {
+				info, err := c.Verify(ctx, infoHash)
+				if err == nil {
+					fmt.Printf("%s %d/%d pieces\n", info.InfoHash, info.CompletedPieces, info.TotalPieces)
+				}
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", infoHash, err)
+			}
+		}
+	case "move":
+		if len(args) != 2 {
+			return errors.New("expected an info hash and a position")
+		}
+		position, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid position %q", args[1])
+		}
+		return call(func(ctx context.Context) error {
+			_, err := c.Move(ctx, args[0], position)
+			return err
+		})
+	case "list":
+		return call(func(ctx context.Context) error {
+			infos, err := c.Torrents(ctx)
+			if err != nil {
+				return err
+			}
+			printTorrents(infos)
+			return nil
+		})
+	case "limits":
+		if len(args) != 0 && len(args) != 2 {
+			return errors.New("expected no limit or both the download and upload limits")
+		}
+		return call(func(ctx context.Context) error {
+			var info daemon.SessionInfo
+			var err error
+			if len(args) == 0 {
+				info, err = c.Session(ctx)
+			} else {
+				var download, upload int
+				if download, err = strconv.Atoi(args[0]); err != nil {
+					return fmt.Errorf("invalid download limit %q", args[0])
+				}
+				if upload, err = strconv.Atoi(args[1]); err != nil {
+					return fmt.Errorf("invalid upload limit %q", args[1])
+				}
+				info, err = c.SetLimits(ctx, &download, &upload)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("download: %s\nupload:   %s\n", formatLimit(info.DownloadLimit), formatLimit(info.UploadLimit))
+			return nil
+		})
+	case "queue":
+		if len(args) != 0 && len(args) != 2 {
+			return errors.New("expected no size or both the download and seed queue sizes")
+		}
+		return call(func(ctx context.Context) error {
+			var info daemon.SessionInfo
+			var err error
+			if len(args) == 0 {
+				info, err = c.Session(ctx)
+			} else {
+				var downloads, seeds int
+				if downloads, err = strconv.Atoi(args[0]); err != nil {
+					return fmt.Errorf("invalid download queue size %q", args[0])
+				}
+				if seeds, err = strconv.Atoi(args[1]); err != nil {
+					return fmt.Errorf("invalid seed queue size %q", args[1])
+				}
+				info, err = c.SetQueueLimits(ctx, &downloads, &seeds)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("downloads: %s\nseeds:     %s\n", formatQueueLimit(info.MaxActiveDownloads), formatQueueLimit(info.MaxActiveSeeds))
+			return nil
+		})
+	case "schedule":
+		return call(func(ctx context.Context) error {
+			var info daemon.SessionInfo
+			var err error
+			if len(args) == 0 {
+				info, err = c.Session(ctx)
+			} else {
+				info, err = c.SetSchedule(ctx, strings.Join(args, " "))
+			}
+			if err != nil {
+				return err
+			}
+			schedule, active := info.Schedule, info.ActiveRule
+			if schedule == "" {
+				schedule = "none"
+			}
+			if active == "" {
+				active = "none"
+			}
+			fmt.Printf("schedule: %s\nactive:   %s\n", schedule, active)
+			return nil
+		})
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+	return nil
+}
+
+// addRemote adds a torrent to the daemon from a magnet link or from the
+// content of a .torrent file
+func addRemote(ctx context.Context, c *daemon.Client, arg string) (daemon.TorrentInfo, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return c.AddMagnet(ctx, arg)
+	}
+	buf, err := ioutil.ReadFile(arg)
+	if err != nil {
+		return daemon.TorrentInfo{}, err
+	}
+	return c.AddTorrent(ctx, buf)
+}
+
+// printTorrents prints a table of the torrents of the daemon, followed by
+// the errors they stopped with
+func printTorrents(infos []daemon.TorrentInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INFO HASH\tQUEUE\tDONE\tSTATE\tDOWN\tUP\tPEERS\tRATIO\tNAME")
+	for _, info := range infos {
+		done := "--"
+		if info.TotalPieces > 0 {
+			done = fmt.Sprintf("%.1f%%", float64(info.CompletedPieces)/float64(info.TotalPieces)*100)
+		}
+		state := "paused"
+		switch {
+		case info.Error != "":
+			state = "error"
+		case info.Running:
+			state = "running"
+		case info.Queued:
+			state = "queued"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s/s\t%s/s\t%d\t%.2f\t%s\n", info.InfoHash, info.QueuePosition, done, state,
+			formatBytes(info.DownloadRate), formatBytes(info.UploadRate), info.Peers, info.Ratio, info.Name)
+	}
+	w.Flush()
+	for _, info := range infos {
+		if info.Error != "" {
+			fmt.Printf("%s: %s\n", info.Name, info.Error)
+		}
+	}
+}
+
+// formatLimit returns a rate limit in bytes per second
+func formatLimit(limit int) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return formatBytes(float64(limit)) + "/s"
+}
+
+// formatQueueLimit returns a number of active torrents
+func formatQueueLimit(limit int) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(limit)
+}
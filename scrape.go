@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/leonhfr/torrent-client/proxy"
+	"github.com/leonhfr/torrent-client/torrentfile"
+	"github.com/leonhfr/torrent-client/tracker"
+)
+
+// runScrape prints the numbers of seeders, leechers and completed downloads
+// of a torrent given by its .torrent file or its hex info hash:
+//
+//	torrent-client scrape [flags] <path|info hash>
+func runScrape(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: torrent-client scrape [flags] <path|info hash>")
+		fs.PrintDefaults()
+	}
+	var trackers listFlag
+	fs.Var(&trackers, "tracker", "URL of a tracker to scrape instead of the ones of the torrent; can be repeated")
+	timeout := fs.Duration("timeout", 30*time.Second, "time allowed to scrape each tracker")
+	proxyURL := fs.String("proxy", "", "SOCKS5 proxy to connect to the trackers through, e.g. socks5://host:1080; UDP trackers cannot be scraped then")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a torrent file or an info hash")
+	}
+	var dialer tracker.Dialer
+	if *proxyURL != "" {
+		d, err := proxy.FromURL(*proxyURL)
+		if err != nil {
+			return err
+		}
+		dialer = d
+	}
+
+	var infoHash [20]byte
+	if b, err := hex.DecodeString(fs.Arg(0)); err == nil && len(b) == len(infoHash) {
+		copy(infoHash[:], b)
+	} else {
+		tf, err := torrentfile.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		infoHash = tf.InfoHash
+		if len(trackers) == 0 {
+			for _, tier := range tf.Trackers() {
+				trackers = append(trackers, tier...)
+			}
+		}
+	}
+	if len(trackers) == 0 {
+		return errors.New("no tracker to scrape")
+	}
+
+	failed := 0
+	for _, url := range trackers {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		stats, err := tracker.ScrapeWithDialer(ctx, dialer, url, infoHash)
+		cancel()
+		stat, ok := stats[infoHash]
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %s\n", url, err)
+		case !ok:
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: unknown torrent\n", url)
+		default:
+			fmt.Printf("%s: %d seeders, %d leechers, %d downloaded\n", url, stat.Complete, stat.Incomplete, stat.Downloaded)
+		}
+	}
+	if failed == len(trackers) {
+		return errors.New("no tracker could be scraped")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package session
+
+// SetQueueLimits limits the torrents downloading and the ones seeding at the
+// same time, 0 for no limit. The others are queued, and started by queue
+// position as slots free up: when a torrent completes, stops or is removed.
+// A torrent completing moves from a download slot to a seed slot, if one is
+// free. The torrents beyond lowered limits are queued again.
+func (s *Session) SetQueueLimits(downloads, seeds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxDownloads, s.maxSeeds = downloads, seeds
+	s.schedule()
+}
+
+// QueueLimits returns the limits of SetQueueLimits
+func (s *Session) QueueLimits() (downloads, seeds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxDownloads, s.maxSeeds
+}
+
+// MoveTorrent moves a torrent to a position of the queue, from 0 for the
+// first, clamped to the last position. The queued torrents before it start
+// first, and a running torrent can be queued again for one moved ahead of
+// it. It returns false if the session has no such torrent.
+func (s *Session) MoveTorrent(infoHash [20]byte, position int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.torrents[infoHash]; !ok {
+		return false
+	}
+	s.removeFromQueue(infoHash)
+	if position < 0 {
+		position = 0
+	}
+	if position > len(s.queue) {
+		position = len(s.queue)
+	}
+	s.queue = append(s.queue, [20]byte{})
+	copy(s.queue[position+1:], s.queue[position:])
+	s.queue[position] = infoHash
+	s.schedule()
+	return true
+}
+
+// queuePosition returns the position of a torrent in the queue. The lock must
+// be held.
+func (s *Session) queuePosition(infoHash [20]byte) int {
+	for i, h := range s.queue {
+		if h == infoHash {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeFromQueue removes a torrent from the queue. The lock must be held.
+func (s *Session) removeFromQueue(infoHash [20]byte) {
+	if i := s.queuePosition(infoHash); i >= 0 {
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	}
+}
+
+// reschedule updates the torrents running after one completed
+func (s *Session) reschedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule()
+}
+
+// schedule gives the download and seed slots to the wanted torrents by queue
+// position, starting the ones getting a slot and stopping the running ones
+// left without. A torrent never run is deemed downloading until it reports
+// being complete. The torrents being verified take no slot and are not
+// started until the end. The lock must be held.
+func (s *Session) schedule() {
+	downloads, seeds := 0, 0
+	for _, infoHash := range s.queue {
+		ctx, wanted := s.wanted[infoHash]
+		if !wanted {
+			continue
+		}
+		if ctx.Err() != nil {
+			delete(s.wanted, infoHash)
+			continue
+		}
+		r, running := s.running[infoHash]
+		if s.verifying[infoHash] {
+			if running {
+				delete(s.running, infoHash)
+				s.stopped[infoHash] = r
+				r.cancel()
+			}
+			continue
+		}
+		complete := false
+		if running {
+			complete = r.isComplete()
+		} else if last, ok := s.stopped[infoHash]; ok {
+			complete = last.isComplete()
+		}
+
+		var slot bool
+		if complete {
+			slot = s.maxSeeds <= 0 || seeds < s.maxSeeds
+			if slot {
+				seeds++
+			}
+		} else {
+			slot = s.maxDownloads <= 0 || downloads < s.maxDownloads
+			if slot {
+				downloads++
+			}
+		}
+
+		switch {
+		case slot && !running:
+			s.start(ctx, s.torrents[infoHash])
+		case !slot && running:
+			delete(s.running, infoHash)
+			s.stopped[infoHash] = r
+			r.cancel()
+		}
+	}
+}
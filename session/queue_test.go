@@ -0,0 +1,101 @@
+package session
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSession(t, ctx)
+	s.SetQueueLimits(1, 1)
+	downloads, seeds := s.QueueLimits()
+	assert.Equal(t, 1, downloads)
+	assert.Equal(t, 1, seeds)
+
+	// a and b have no data and wait for a peer that never answers the
+	// handshake, so they download forever, while the data of c is complete
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	silent := torrentfile.WithPeers([]peer.Peer{{IP: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Addr().(*net.TCPAddr).Port)}})
+	content := []byte("seeded once checked")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.Dir, "c"), content, 0644))
+	torrent := func(name string) torrentfile.TorrentFile {
+		return torrentfile.TorrentFile{
+			InfoHash:    sha1.Sum([]byte(name)),
+			PieceHashes: [][20]byte{sha1.Sum(content)},
+			PieceLength: len(content),
+			Length:      len(content),
+			Name:        name,
+		}
+	}
+	a, b, c := torrent("a"), torrent("b"), torrent("c")
+	require.True(t, s.AddTorrent(ctx, a, silent))
+	require.True(t, s.AddTorrent(ctx, b, silent))
+	require.True(t, s.AddTorrent(ctx, c, torrentfile.WithPeers([]peer.Peer{}), torrentfile.WithRecheck()))
+
+	// states returns R for the running torrents, Q for the queued ones and
+	// S for the stopped ones, by name
+	states := func() string {
+		var states []byte
+		for _, status := range s.Statuses() {
+			switch {
+			case status.Running:
+				states = append(states, 'R')
+			case status.Queued:
+				states = append(states, 'Q')
+			default:
+				states = append(states, 'S')
+			}
+		}
+		return string(states)
+	}
+	assert.Equal(t, "RQQ", states())
+	status, _ := s.Status(b.InfoHash)
+	assert.Equal(t, 1, status.QueuePosition)
+
+	// b moves ahead of a and takes its slot
+	assert.True(t, s.MoveTorrent(b.InfoHash, 0))
+	assert.Equal(t, "QRQ", states())
+	status, _ = s.Status(a.InfoHash)
+	assert.Equal(t, 1, status.QueuePosition)
+	assert.False(t, s.MoveTorrent([20]byte{}, 0))
+
+	// a is promoted when b stops
+	assert.True(t, s.StopTorrent(b.InfoHash))
+	assert.Equal(t, "RSQ", states())
+	assert.False(t, s.StartTorrent(ctx, c.InfoHash))
+	assert.True(t, s.StopTorrent(c.InfoHash))
+	assert.False(t, s.StopTorrent(c.InfoHash))
+	assert.Equal(t, "RSS", states())
+
+	// c moved first takes the download slot of a, then completes and moves
+	// to the seed slot, leaving its download slot to b
+	assert.True(t, s.MoveTorrent(c.InfoHash, 0))
+	require.True(t, s.StartTorrent(ctx, c.InfoHash))
+	assert.Equal(t, "QSR", states())
+	require.True(t, s.StartTorrent(ctx, b.InfoHash))
+	assert.Equal(t, "QQR", states())
+	require.Eventually(t, func() bool { return states() == "QRR" }, 5*time.Second, 10*time.Millisecond)
+
+	s.SetQueueLimits(2, 1)
+	assert.Equal(t, "RRR", states())
+	s.SetQueueLimits(1, 1)
+	assert.Equal(t, "QRR", states())
+	assert.True(t, s.RemoveTorrent(b.InfoHash))
+	assert.Equal(t, "RR", states())
+	status, _ = s.Status(a.InfoHash)
+	assert.Equal(t, 1, status.QueuePosition)
+}
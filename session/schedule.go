@@ -0,0 +1,251 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleRule sets alternate bandwidth limits on some days of the week,
+// from a time of day to another in the local time zone
+type ScheduleRule struct {
+	// Days are the days the rule starts on, every day if empty
+	Days []time.Weekday
+	// Start and End are the times of day the rule applies from and until,
+	// since midnight. A rule ending before it starts runs past midnight, and
+	// one ending when it starts lasts the whole day.
+	Start, End time.Duration
+	// DownloadLimit and UploadLimit are the bandwidth limits of all the
+	// torrents together while the rule applies, in bytes per second, 0 for
+	// no limit
+	DownloadLimit, UploadLimit int
+}
+
+// dayNames are the names of the days of the week in schedules
+var dayNames = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// activeAt tells whether the rule applies at t
+func (r ScheduleRule) activeAt(t time.Time) bool {
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+	switch {
+	case r.Start < r.End:
+		return r.on(today) && since >= r.Start && since < r.End
+	case r.Start > r.End:
+		return r.on(today) && since >= r.Start || r.on(yesterday) && since < r.End
+	default:
+		return r.on(today)
+	}
+}
+
+// on tells whether the rule starts on day
+func (r ScheduleRule) on(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, d := range r.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the rule in the format of ParseSchedule
+func (r ScheduleRule) String() string {
+	days := "daily"
+	if len(r.Days) > 0 {
+		names := make([]string, len(r.Days))
+		for i, d := range r.Days {
+			names[i] = dayNames[d]
+		}
+		days = strings.Join(names, ",")
+	}
+	return fmt.Sprintf("%s %s-%s %d %d", days, formatTimeOfDay(r.Start), formatTimeOfDay(r.End), r.DownloadLimit, r.UploadLimit)
+}
+
+// formatTimeOfDay returns a time since midnight as HH:MM
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+// FormatSchedule returns rules in the format of ParseSchedule
+func FormatSchedule(rules []ScheduleRule) string {
+	s := make([]string, len(rules))
+	for i, r := range rules {
+		s[i] = r.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+// ParseSchedule parses rules separated by semicolons, each made of the days
+// it starts on, its times of day and its download and upload limits in
+// bytes per second, e.g. "mon-fri 09:00-18:00 1000000 0; daily 01:00-07:00 0 0".
+// The days are "daily", or names and ranges of names separated by commas,
+// e.g. "sat,sun" or "mon-wed,fri".
+func ParseSchedule(s string) ([]ScheduleRule, error) {
+	var rules []ScheduleRule
+	for _, text := range strings.Split(s, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("rule %q: expected days, times, download and upload limits", strings.TrimSpace(text))
+		}
+		var r ScheduleRule
+		var err error
+		if r.Days, err = parseDays(fields[0]); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", strings.TrimSpace(text), err)
+		}
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("rule %q: invalid times %q", strings.TrimSpace(text), fields[1])
+		}
+		if r.Start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", strings.TrimSpace(text), err)
+		}
+		if r.End, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", strings.TrimSpace(text), err)
+		}
+		if r.DownloadLimit, err = strconv.Atoi(fields[2]); err != nil || r.DownloadLimit < 0 {
+			return nil, fmt.Errorf("rule %q: invalid download limit %q", strings.TrimSpace(text), fields[2])
+		}
+		if r.UploadLimit, err = strconv.Atoi(fields[3]); err != nil || r.UploadLimit < 0 {
+			return nil, fmt.Errorf("rule %q: invalid upload limit %q", strings.TrimSpace(text), fields[3])
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseDays parses the days of a rule, nil for every day
+func parseDays(s string) ([]time.Weekday, error) {
+	if s == "daily" {
+		return nil, nil
+	}
+	var days []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return nil, fmt.Errorf("invalid days %q", part)
+		}
+		var ends [2]time.Weekday
+		for i, name := range bounds {
+			day, ok := parseDay(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown day %q", name)
+			}
+			ends[i] = day
+		}
+		if len(bounds) == 1 {
+			ends[1] = ends[0]
+		}
+		// ranges like fri-mon wrap around the end of the week
+		for day := ends[0]; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == ends[1] {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseDay parses the name of a day
+func parseDay(name string) (time.Weekday, bool) {
+	for i, n := range dayNames {
+		if strings.EqualFold(name, n) {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// parseTimeOfDay parses a time of day as HH:MM, from 00:00 to 24:00
+func parseTimeOfDay(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 && len(parts[0]) == 2 && len(parts[1]) == 2 {
+		hours, err1 := strconv.Atoi(parts[0])
+		minutes, err2 := strconv.Atoi(parts[1])
+		d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+		if err1 == nil && err2 == nil && hours >= 0 && minutes >= 0 && minutes < 60 && d <= 24*time.Hour {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q", s)
+}
+
+// SetSchedule sets alternate bandwidth limits by time of day, replacing the
+// ones of SetDownloadLimit and SetUploadLimit while a rule applies. The
+// first rule applying wins. The limits are applied to the torrents already
+// running, without restarting them, and checked every minute until Close.
+func (s *Session) SetSchedule(rules []ScheduleRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduleRules = append([]ScheduleRule(nil), rules...)
+	s.applyLimits()
+}
+
+// Schedule returns the rules of SetSchedule
+func (s *Session) Schedule() []ScheduleRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ScheduleRule(nil), s.scheduleRules...)
+}
+
+// ActiveRule returns the rule of the schedule applying now, if any
+func (s *Session) ActiveRule() (ScheduleRule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activeRule(s.now())
+}
+
+// activeRule returns the first rule applying at t. The lock must be held.
+func (s *Session) activeRule(t time.Time) (ScheduleRule, bool) {
+	for _, r := range s.scheduleRules {
+		if r.activeAt(t) {
+			return r, true
+		}
+	}
+	return ScheduleRule{}, false
+}
+
+// now returns the current time, in the local time zone
+func (s *Session) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+// applyLimits sets the bandwidth limits of the rule applying now, or else
+// the ones of SetDownloadLimit and SetUploadLimit, and checks again at the
+// next minute while there is a schedule. The lock must be held.
+func (s *Session) applyLimits() {
+	now := s.now()
+	download, upload := s.downloadLimit, s.uploadLimit
+	if r, ok := s.activeRule(now); ok {
+		download, upload = r.DownloadLimit, r.UploadLimit
+	}
+	s.download.SetLimit(download)
+	s.upload.SetLimit(upload)
+
+	if s.scheduleTimer != nil {
+		s.scheduleTimer.Stop()
+		s.scheduleTimer = nil
+	}
+	if len(s.scheduleRules) > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(now.Truncate(time.Minute).Add(time.Minute).Sub(now), func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// the timer may have been replaced or stopped while it fired
+			if s.scheduleTimer == t {
+				s.applyLimits()
+			}
+		})
+		s.scheduleTimer = t
+	}
+}
@@ -0,0 +1,138 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	rules, err := ParseSchedule("mon-fri 09:00-18:00 1000000 0; sat,sun 22:30-06:00 0 500 ;daily 00:00-00:00 1 2;")
+	require.Nil(t, err)
+	assert.Equal(t, []ScheduleRule{
+		{
+			Days:          []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			Start:         9 * time.Hour,
+			End:           18 * time.Hour,
+			DownloadLimit: 1000000,
+		},
+		{
+			Days:        []time.Weekday{time.Saturday, time.Sunday},
+			Start:       22*time.Hour + 30*time.Minute,
+			End:         6 * time.Hour,
+			UploadLimit: 500,
+		},
+		{DownloadLimit: 1, UploadLimit: 2},
+	}, rules)
+	assert.Equal(t, "mon,tue,wed,thu,fri 09:00-18:00 1000000 0; sat,sun 22:30-06:00 0 500; daily 00:00-00:00 1 2", FormatSchedule(rules))
+
+	rules, err = ParseSchedule("Fri-mon,wed 00:00-24:00 0 0")
+	require.Nil(t, err)
+	assert.Equal(t, []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday, time.Wednesday}, rules[0].Days)
+	assert.Equal(t, 24*time.Hour, rules[0].End)
+
+	rules, err = ParseSchedule(" ")
+	require.Nil(t, err)
+	assert.Empty(t, rules)
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		want  string
+	}{
+		"missing field":  {"mon 09:00-18:00 0", `rule "mon 09:00-18:00 0": expected days, times, download and upload limits`},
+		"unknown day":    {"monday 09:00-18:00 0 0", `rule "monday 09:00-18:00 0 0": unknown day "monday"`},
+		"invalid days":   {"mon-tue-wed 09:00-18:00 0 0", `rule "mon-tue-wed 09:00-18:00 0 0": invalid days "mon-tue-wed"`},
+		"invalid times":  {"mon 09:00 0 0", `rule "mon 09:00 0 0": invalid times "09:00"`},
+		"invalid time":   {"mon 9:00-18:00 0 0", `rule "mon 9:00-18:00 0 0": invalid time "9:00"`},
+		"past midnight":  {"mon 09:00-24:01 0 0", `rule "mon 09:00-24:01 0 0": invalid time "24:01"`},
+		"download limit": {"mon 09:00-18:00 -1 0", `rule "mon 09:00-18:00 -1 0": invalid download limit "-1"`},
+		"upload limit":   {"mon 09:00-18:00 0 1k", `rule "mon 09:00-18:00 0 1k": invalid upload limit "1k"`},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseSchedule(tt.input)
+			require.NotNil(t, err)
+			assert.Equal(t, tt.want, err.Error())
+		})
+	}
+}
+
+func TestScheduleRuleActiveAt(t *testing.T) {
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	work := ScheduleRule{Days: weekdays, Start: 9 * time.Hour, End: 18 * time.Hour}
+	night := ScheduleRule{Days: weekdays, Start: 22 * time.Hour, End: 6 * time.Hour}
+	weekend := ScheduleRule{Days: []time.Weekday{time.Saturday, time.Sunday}}
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := map[string]struct {
+		rule ScheduleRule
+		t    time.Time
+		want bool
+	}{
+		"work start":        {work, at(1, 9, 0), true},
+		"work end":          {work, at(1, 18, 0), false},
+		"work before":       {work, at(1, 8, 59), false},
+		"work saturday":     {work, at(6, 12, 0), false},
+		"night evening":     {night, at(5, 23, 0), true},
+		"night morning":     {night, at(6, 5, 59), true},
+		"night day after":   {night, at(6, 23, 0), false},
+		"night monday":      {night, at(1, 3, 0), false},
+		"night day":         {night, at(2, 12, 0), false},
+		"weekend":           {weekend, at(7, 23, 59), true},
+		"weekend monday":    {weekend, at(8, 0, 0), false},
+		"daily":             {ScheduleRule{Start: 1 * time.Hour, End: 2 * time.Hour}, at(3, 1, 30), true},
+		"daily whole night": {ScheduleRule{Start: 0, End: 24 * time.Hour}, at(3, 23, 59), true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.rule.activeAt(tt.t))
+		})
+	}
+}
+
+func TestSessionSchedule(t *testing.T) {
+	s := New()
+	defer s.Close()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	s.clock = func() time.Time { return now }
+	s.SetDownloadLimit(1000)
+	s.SetUploadLimit(2000)
+
+	rules, err := ParseSchedule("mon-fri 09:00-18:00 100 0; daily 00:00-00:00 0 0")
+	require.Nil(t, err)
+	s.SetSchedule(rules[:1])
+	assert.Equal(t, rules[:1], s.Schedule())
+	rule, ok := s.ActiveRule()
+	assert.True(t, ok)
+	assert.Equal(t, rules[0], rule)
+	assert.Equal(t, 100, s.download.Limit())
+	assert.Equal(t, 0, s.upload.Limit())
+	assert.Equal(t, 1000, s.DownloadLimit())
+
+	// The limits set while a rule applies take effect once it ends
+	s.SetDownloadLimit(3000)
+	assert.Equal(t, 100, s.download.Limit())
+	now = now.Add(6 * time.Hour)
+	s.mu.Lock()
+	s.applyLimits()
+	s.mu.Unlock()
+	_, ok = s.ActiveRule()
+	assert.False(t, ok)
+	assert.Equal(t, 3000, s.download.Limit())
+	assert.Equal(t, 2000, s.upload.Limit())
+
+	s.SetSchedule(rules)
+	assert.Equal(t, 0, s.download.Limit())
+	s.SetSchedule(nil)
+	assert.Equal(t, 3000, s.download.Limit())
+	assert.Nil(t, s.scheduleTimer)
+}
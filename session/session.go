@@ -0,0 +1,466 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/leonhfr/torrent-client/blocklist"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/dht"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+// Session holds the torrents managed together, by info hash. The torrents
+// it runs share its peer ID, listener, DHT, connection limit and bandwidth
+// limits, and are stored under Dir.
+type Session struct {
+	// Encryption is the encryption policy of the connections of the torrents
+	Encryption client.EncryptionPolicy
+	// Dialer, if set, establishes the connections of the torrents with
+	// trackers, peers and web seeds, e.g. through a proxy. The DHT and UDP
+	// trackers are not used then.
+	Dialer client.Dialer
+	// Port is the port the peers of all the torrents connect to, see Listen.
+	// A port is chosen by the system if it is 0.
+	Port uint16
+	// MapPort maps Port with the gateway of the local network while
+	// listening, with NAT-PMP or UPnP, so that peers behind a NAT can connect
+	MapPort bool
+	// Dir is the directory the torrents are downloaded to and seeded from,
+	// each under its name
+	Dir string
+	// StateDir, if set, keeps the last announce to the tracker of each
+	// torrent across restarts, see torrentfile.WithTrackerStateDir
+	StateDir string
+	// Blocklist, if set, holds the addresses of the peers the torrents
+	// neither connect to nor accept. It can be changed while running.
+	Blocklist *blocklist.Blocklist
+	// DHT, if set, finds peers for the public torrents besides their trackers
+	DHT *dht.Server
+	// Logger receives the logs of the session and its torrents. Defaults to
+	// logging.Default.
+	Logger logging.Logger
+	// Metrics, if set, is updated by all the torrents, e.g. a
+	// metrics.Registry served to Prometheus
+	Metrics p2p.Metrics
+
+	peerID   [20]byte
+	mu       sync.Mutex
+	torrents map[[20]byte]torrentfile.TorrentFile
+	options  map[[20]byte][]torrentfile.DownloadOption // options of the torrents added with AddTorrent
+	running  map[[20]byte]*running
+	stopped  map[[20]byte]*running // last run of the torrents stopped with StopTorrent
+	listener *p2p.PeerListener
+	conns    *p2p.ConnLimit  // shared by all the torrents
+	dials    *p2p.ConnLimit  // shared by all the torrents
+	download *client.Limiter // shared by all the torrents
+	upload   *client.Limiter // shared by all the torrents
+
+	queue [][20]byte // info hashes of the torrents, by queue position
+	// wanted are the torrents to run, or to start once a slot is free, with
+	// the context to run them with
+	wanted       map[[20]byte]context.Context
+	verifying    map[[20]byte]bool // torrents hashed by VerifyTorrent, not started meanwhile
+	maxDownloads int               // torrents downloading at the same time, 0 for no limit
+	maxSeeds     int               // torrents seeding at the same time, 0 for no limit
+
+	downloadLimit int // limits outside of the schedule, see SetSchedule
+	uploadLimit   int
+	scheduleRules []ScheduleRule
+	scheduleTimer *time.Timer      // applies the schedule at the next minute
+	clock         func() time.Time // defaults to time.Now
+}
+
+// running is a torrent being downloaded or seeded by the session
+type running struct {
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the torrent stopped
+
+	onComplete func() // called once the torrent is complete
+
+	mu       sync.Mutex
+	stats    p2p.Stats // last statistics reported
+	complete bool      // set once the pieces not skipped are stored
+	err      error     // error the torrent stopped with, if any
+}
+
+// update records the statistics of the torrent
+func (r *running) update(stats p2p.Stats) {
+	r.mu.Lock()
+	r.stats = stats
+	completed := !r.complete && stats.TotalPieces > 0 && stats.ETA == 0
+	if completed {
+		r.complete = true
+	}
+	r.mu.Unlock()
+	if completed && r.onComplete != nil {
+		r.onComplete()
+	}
+}
+
+// isComplete tells whether the pieces not skipped are stored
+func (r *running) isComplete() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.complete
+}
+
+// New creates an empty session with a random peer ID, without connection
+// or bandwidth limits. Its torrents dial up to p2p.DefaultMaxDials peers at
+// the same time together.
+func New() *Session {
+	// crypto/rand only fails if the system has no source of randomness
+	peerID, err := torrentfile.GeneratePeerID(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &Session{
+		peerID:    peerID,
+		torrents:  make(map[[20]byte]torrentfile.TorrentFile),
+		options:   make(map[[20]byte][]torrentfile.DownloadOption),
+		running:   make(map[[20]byte]*running),
+		stopped:   make(map[[20]byte]*running),
+		wanted:    make(map[[20]byte]context.Context),
+		verifying: make(map[[20]byte]bool),
+		conns:     p2p.NewConnLimit(0),
+		dials:     p2p.NewConnLimit(p2p.DefaultMaxDials),
+		download:  client.NewLimiter(0),
+		upload:    client.NewLimiter(0),
+	}
+}
+
+// PeerID returns the peer ID of the session, used by all its torrents
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// SetMaxConns limits the connections with peers of all the torrents together
+// to n, 0 for no limit. It applies to the torrents already running too.
+func (s *Session) SetMaxConns(n int) {
+	s.conns.SetLimit(n)
+}
+
+// SetMaxDials limits the peers dialed at the same time by all the torrents
+// together to n, 0 for no limit. It applies to the torrents already running
+// too.
+func (s *Session) SetMaxDials(n int) {
+	s.dials.SetLimit(n)
+}
+
+// SetDownloadLimit limits the download bandwidth of all the torrents
+// together to bytesPerSecond, 0 for no limit, unless a rule of the schedule
+// applies. It applies to the torrents already downloading too.
+func (s *Session) SetDownloadLimit(bytesPerSecond int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloadLimit = bytesPerSecond
+	s.applyLimits()
+}
+
+// DownloadLimit returns the download bandwidth limit of SetDownloadLimit, in
+// bytes per second, 0 for no limit
+func (s *Session) DownloadLimit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloadLimit
+}
+
+// UploadLimit returns the upload bandwidth limit of SetUploadLimit, in bytes
+// per second, 0 for no limit
+func (s *Session) UploadLimit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploadLimit
+}
+
+// SetUploadLimit limits the upload bandwidth of all the torrents together to
+// bytesPerSecond, 0 for no limit, unless a rule of the schedule applies. It
+// applies to the torrents already downloading too.
+func (s *Session) SetUploadLimit(bytesPerSecond int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploadLimit = bytesPerSecond
+	s.applyLimits()
+}
+
+// Add adds a torrent to the session without starting it. It returns false
+// if the session already has a torrent with the same info hash.
+func (s *Session) Add(tf torrentfile.TorrentFile) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.torrents[tf.InfoHash]; ok {
+		return false
+	}
+	s.torrents[tf.InfoHash] = tf
+	s.queue = append(s.queue, tf.InfoHash)
+	return true
+}
+
+// AddTorrent adds a torrent to the session and starts downloading it under
+// Dir, then seeds it until it is removed or ctx is done. It is queued while
+// the limits of SetQueueLimits are reached. The options are applied after
+// the ones of the session. It returns false if the session already has a
+// torrent with the same info hash.
+func (s *Session) AddTorrent(ctx context.Context, tf torrentfile.TorrentFile, opts ...torrentfile.DownloadOption) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.torrents[tf.InfoHash]; ok {
+		return false
+	}
+	s.torrents[tf.InfoHash] = tf
+	s.options[tf.InfoHash] = opts
+	s.queue = append(s.queue, tf.InfoHash)
+	s.wanted[tf.InfoHash] = ctx
+	s.schedule()
+	return true
+}
+
+// start runs a torrent of the session. A previous run must have been
+// canceled: the torrent starts once it returned. The lock must be held.
+func (s *Session) start(ctx context.Context, tf torrentfile.TorrentFile) {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &running{cancel: cancel, done: make(chan struct{}), onComplete: s.reschedule}
+	prev, ok := s.running[tf.InfoHash]
+	if !ok {
+		prev = s.stopped[tf.InfoHash]
+	}
+	if prev != nil {
+		prev.mu.Lock()
+		r.stats, r.complete = prev.stats, prev.complete
+		prev.mu.Unlock()
+	}
+	s.running[tf.InfoHash] = r
+	delete(s.stopped, tf.InfoHash)
+
+	opts := append(s.downloadOptionsLocked(), torrentfile.WithSeeding(), torrentfile.WithProgress(progressInterval, r.update))
+	opts = append(opts, s.options[tf.InfoHash]...)
+	go func() {
+		defer close(r.done)
+		if prev != nil {
+			<-prev.done
+		}
+		// The name comes from the torrent file or the magnet link: the data
+		// must stay under Dir
+		var err error
+		if torrentfile.SafeName(tf.Name) {
+			err = tf.DownloadToFile(ctx, filepath.Join(s.Dir, tf.Name), opts...)
+		} else {
+			err = fmt.Errorf("unsafe name %q", tf.Name)
+		}
+		if err != nil && ctx.Err() == nil {
+			s.logger().Log(logging.Error, "could not download", logging.F("torrent", tf.Name), logging.F("err", err))
+			r.mu.Lock()
+			r.err = err
+			r.mu.Unlock()
+		}
+		if ctx.Err() == nil {
+			s.finished(tf.InfoHash, r)
+		}
+	}()
+}
+
+// finished records that a run returned by itself, with an error or once
+// seeded enough, so that its slot goes to the next queued torrent. The run
+// is left in running, reported as stopped, for StopTorrent and StartTorrent.
+func (s *Session) finished(infoHash [20]byte, r *running) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[infoHash] != r {
+		return
+	}
+	delete(s.wanted, infoHash)
+	s.schedule()
+}
+
+// RemoveTorrent stops a torrent and removes it from the session, leaving
+// its data on disk. It returns false if the session has no such torrent.
+func (s *Session) RemoveTorrent(infoHash [20]byte) bool {
+	s.mu.Lock()
+	_, ok := s.torrents[infoHash]
+	r := s.running[infoHash]
+	delete(s.torrents, infoHash)
+	delete(s.options, infoHash)
+	delete(s.running, infoHash)
+	delete(s.stopped, infoHash)
+	delete(s.wanted, infoHash)
+	s.removeFromQueue(infoHash)
+	if r != nil {
+		s.schedule()
+	}
+	s.mu.Unlock()
+
+	if r != nil {
+		r.cancel()
+		<-r.done
+	}
+	return ok
+}
+
+// DeleteTorrent removes a torrent from the session like RemoveTorrent, then
+// deletes its data and resume file under Dir. It returns false if the session
+// has no such torrent. The data is kept if the name of the torrent is not a
+// single path element, as it may point outside Dir.
+func (s *Session) DeleteTorrent(infoHash [20]byte) (bool, error) {
+	s.mu.Lock()
+	tf, ok := s.torrents[infoHash]
+	s.mu.Unlock()
+	if !ok || !s.RemoveTorrent(infoHash) {
+		return false, nil
+	}
+	if !torrentfile.SafeName(tf.Name) {
+		return true, fmt.Errorf("unsafe name %q, data not deleted", tf.Name)
+	}
+	path := filepath.Join(s.Dir, tf.Name)
+	if err := os.RemoveAll(path); err != nil {
+		return true, err
+	}
+	if err := os.Remove(path + torrentfile.ResumeSuffix); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// Close stops the torrents of the session and waits for them to return, each
+// telling its tracker it stopped and flushing its files, then stops listening
+// for peers. The torrents stay in the session, stopped, and the schedule is
+// no longer checked.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.scheduleTimer != nil {
+		s.scheduleTimer.Stop()
+		s.scheduleTimer = nil
+	}
+	stopped := s.running
+	s.running = make(map[[20]byte]*running)
+	s.wanted = make(map[[20]byte]context.Context)
+	for infoHash, r := range stopped {
+		s.stopped[infoHash] = r
+	}
+	l := s.listener
+	s.listener = nil
+	s.mu.Unlock()
+
+	for _, r := range stopped {
+		r.cancel()
+	}
+	for _, r := range stopped {
+		<-r.done
+	}
+	if l != nil {
+		return l.Close()
+	}
+	return nil
+}
+
+// Torrents returns the torrents of the session, sorted by name
+func (s *Session) Torrents() []torrentfile.TorrentFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	torrents := make([]torrentfile.TorrentFile, 0, len(s.torrents))
+	for _, tf := range s.torrents {
+		torrents = append(torrents, tf)
+	}
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].Name < torrents[j].Name })
+	return torrents
+}
+
+// Listen listens on Port for the peers of the torrents of the session, and
+// hands them to their torrent until ctx is done. The torrents downloaded
+// with DownloadOptions afterwards are served on it.
+func (s *Session) Listen(ctx context.Context) error {
+	l, err := p2p.Listen(s.Port)
+	if err != nil {
+		return err
+	}
+	l.Encryption = s.Encryption
+	l.Logger = s.Logger
+	if s.Blocklist != nil {
+		l.Blocklist = s.Blocklist
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	go func() {
+		err := l.Serve(ctx)
+		if err != nil {
+			s.logger().Log(logging.Error, "could not accept peers", logging.F("err", err))
+		}
+	}()
+	if s.MapPort {
+		go func() {
+			err := l.MapPort(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.logger().Log(logging.Warn, "could not map port", logging.F("err", err))
+			}
+		}()
+	}
+	return nil
+}
+
+// ListenPort returns the port the peers connect to, or 0 if the session does
+// not listen
+func (s *Session) ListenPort() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return 0
+	}
+	return s.listener.Port()
+}
+
+// DownloadOptions returns the options the torrents of the session are
+// downloaded with
+func (s *Session) DownloadOptions() []torrentfile.DownloadOption {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloadOptionsLocked()
+}
+
+// downloadOptionsLocked returns the options of DownloadOptions. The lock
+// must be held.
+func (s *Session) downloadOptionsLocked() []torrentfile.DownloadOption {
+	opts := []torrentfile.DownloadOption{
+		torrentfile.WithPeerID(s.peerID),
+		torrentfile.WithLogger(s.logger()),
+		torrentfile.WithEncryption(s.Encryption),
+		torrentfile.WithConnLimit(s.conns),
+		torrentfile.WithDialLimit(s.dials),
+		torrentfile.WithDownloadLimiter(s.download),
+		torrentfile.WithUploadLimiter(s.upload),
+	}
+	if s.listener != nil {
+		opts = append(opts, torrentfile.WithListener(s.listener))
+	}
+	if s.DHT != nil {
+		opts = append(opts, torrentfile.WithDHT(s.DHT))
+	}
+	if s.Dialer != nil {
+		opts = append(opts, torrentfile.WithDialer(s.Dialer))
+	}
+	if s.Blocklist != nil {
+		opts = append(opts, torrentfile.WithBlocklist(s.Blocklist))
+	}
+	if s.Metrics != nil {
+		opts = append(opts, torrentfile.WithMetrics(s.Metrics))
+	}
+	if s.StateDir != "" {
+		opts = append(opts, torrentfile.WithTrackerStateDir(s.StateDir))
+	}
+	return opts
+}
+
+func (s *Session) logger() logging.Logger {
+	if s.Logger == nil {
+		return logging.Default
+	}
+	return s.Logger
+}
@@ -0,0 +1,202 @@
+package session
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionAdd(t *testing.T) {
+	s := New()
+	assert.True(t, s.Add(torrentfile.TorrentFile{InfoHash: [20]byte{2}, Name: "b"}))
+	assert.True(t, s.Add(torrentfile.TorrentFile{InfoHash: [20]byte{1}, Name: "a"}))
+	assert.False(t, s.Add(torrentfile.TorrentFile{InfoHash: [20]byte{2}, Name: "c"}))
+
+	torrents := s.Torrents()
+	assert.Len(t, torrents, 2)
+	assert.Equal(t, "a", torrents[0].Name)
+	assert.Equal(t, "b", torrents[1].Name)
+}
+
+func TestSessionListen(t *testing.T) {
+	s := New()
+	assert.Equal(t, uint16(0), s.ListenPort())
+	assert.Len(t, s.DownloadOptions(), 7)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.Nil(t, s.Listen(ctx))
+	assert.NotEqual(t, uint16(0), s.ListenPort())
+	assert.Len(t, s.DownloadOptions(), 8)
+	s.Metrics = p2p.NopMetrics{}
+	assert.Len(t, s.DownloadOptions(), 9)
+	s.StateDir = t.TempDir()
+	assert.Len(t, s.DownloadOptions(), 10)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.ListenPort()))
+	require.Nil(t, err)
+	conn.Close()
+}
+
+func TestSessionLimits(t *testing.T) {
+	s := New()
+	assert.Equal(t, 0, s.download.Limit())
+	s.SetDownloadLimit(1000)
+	s.SetUploadLimit(2000)
+	assert.Equal(t, 1000, s.download.Limit())
+	assert.Equal(t, 2000, s.upload.Limit())
+	s.SetDownloadLimit(0)
+	assert.Equal(t, 0, s.download.Limit())
+}
+
+func TestSessionLimitsConns(t *testing.T) {
+	s := New()
+	assert.Equal(t, 0, s.conns.Limit())
+	s.SetMaxConns(10)
+	assert.Equal(t, 10, s.conns.Limit())
+	assert.Equal(t, p2p.DefaultMaxDials, s.dials.Limit())
+	s.SetMaxDials(4)
+	assert.Equal(t, 4, s.dials.Limit())
+}
+
+// newTestSession returns a session listening on a free port, storing the
+// torrents in a temporary directory
+func newTestSession(t *testing.T, ctx context.Context) *Session {
+	s := New()
+	s.Dir = t.TempDir()
+	s.Logger = logging.Discard
+	require.Nil(t, s.Listen(ctx))
+	return s
+}
+
+func TestSessionAddTorrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	content := []byte("shared by two sessions")
+	half := len(content) / 2
+	tf := torrentfile.TorrentFile{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: [][20]byte{sha1.Sum(content[:half]), sha1.Sum(content[half:])},
+		PieceLength: half,
+		Length:      len(content),
+		Name:        "file",
+	}
+
+	// The seeder checks the data already in its directory
+	seeder := newTestSession(t, ctx)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(seeder.Dir, "file"), content, 0644))
+	assert.True(t, seeder.AddTorrent(ctx, tf, torrentfile.WithPeers([]peer.Peer{}), torrentfile.WithRecheck()))
+	assert.False(t, seeder.AddTorrent(ctx, tf))
+	assert.Eventually(t, func() bool { return seeder.listener.Attached(tf.InfoHash) }, time.Second, time.Millisecond)
+
+	leecher := newTestSession(t, ctx)
+	assert.NotEqual(t, seeder.PeerID(), leecher.PeerID())
+	p := peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: seeder.ListenPort()}
+	assert.True(t, leecher.AddTorrent(ctx, tf, torrentfile.WithPeers([]peer.Peer{p})))
+	assert.Eventually(t, func() bool {
+		buf, _ := ioutil.ReadFile(filepath.Join(leecher.Dir, "file"))
+		return string(buf) == string(content)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.True(t, leecher.RemoveTorrent(tf.InfoHash))
+	assert.False(t, leecher.RemoveTorrent(tf.InfoHash))
+	assert.Empty(t, leecher.Torrents())
+	assert.True(t, seeder.RemoveTorrent(tf.InfoHash))
+}
+
+func TestSessionAddTorrentUnsafeName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSession(t, ctx)
+	content := []byte("kept in the directory")
+	tf := torrentfile.TorrentFile{
+		InfoHash:    [20]byte{9},
+		PieceHashes: [][20]byte{sha1.Sum(content)},
+		PieceLength: len(content),
+		Length:      len(content),
+		Name:        "../escaped",
+	}
+
+	assert.True(t, s.AddTorrent(ctx, tf, torrentfile.WithPeers([]peer.Peer{})))
+	require.Eventually(t, func() bool {
+		status, _ := s.Status(tf.InfoHash)
+		return status.Err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	status, _ := s.Status(tf.InfoHash)
+	assert.EqualError(t, status.Err, `unsafe name "../escaped"`)
+	assert.NoFileExists(t, filepath.Join(s.Dir, "..", "escaped"))
+	assert.NoFileExists(t, filepath.Join(s.Dir, "..", "escaped"+torrentfile.ResumeSuffix))
+}
+
+func TestSessionClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tf := torrentfile.TorrentFile{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: [][20]byte{{}},
+		PieceLength: 1,
+		Length:      1,
+		Name:        "file",
+	}
+
+	s := newTestSession(t, ctx)
+	port := s.ListenPort()
+	// The torrent waits for a peer that never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	p := peer.Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Addr().(*net.TCPAddr).Port)}
+	assert.True(t, s.AddTorrent(ctx, tf, torrentfile.WithPeers([]peer.Peer{p})))
+	assert.Eventually(t, func() bool { return s.listener.Attached(tf.InfoHash) }, time.Second, time.Millisecond)
+
+	assert.Nil(t, s.Close())
+	assert.Len(t, s.Torrents(), 1)
+	assert.Equal(t, uint16(0), s.ListenPort())
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NotNil(t, err)
+}
+
+func TestSessionDeleteTorrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSession(t, ctx)
+	require.Nil(t, os.Mkdir(filepath.Join(s.Dir, "dir"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.Dir, "dir", "file"), []byte("data"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.Dir, "dir"+torrentfile.ResumeSuffix), []byte("resume"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.Dir, "kept"), []byte("data"), 0644))
+
+	tf := torrentfile.TorrentFile{InfoHash: [20]byte{7}, Name: "dir"}
+	require.True(t, s.Add(tf))
+	ok, err := s.DeleteTorrent(tf.InfoHash)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Empty(t, s.Torrents())
+	entries, err := ioutil.ReadDir(s.Dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "kept", entries[0].Name())
+
+	ok, err = s.DeleteTorrent(tf.InfoHash)
+	assert.False(t, ok)
+	assert.Nil(t, err)
+
+	unsafe := torrentfile.TorrentFile{InfoHash: [20]byte{8}, Name: ".."}
+	require.True(t, s.Add(unsafe))
+	ok, err = s.DeleteTorrent(unsafe.InfoHash)
+	assert.True(t, ok)
+	assert.NotNil(t, err)
+	assert.FileExists(t, filepath.Join(s.Dir, "kept"))
+}
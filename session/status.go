@@ -0,0 +1,234 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+// progressInterval is the interval the statistics of the running torrents
+// are refreshed at
+const progressInterval = time.Second
+
+// TorrentStatus is a snapshot of a torrent of the session
+type TorrentStatus struct {
+	InfoHash [20]byte
+	Name     string
+	// Length is the size of the torrent, 0 for a magnet link whose metadata
+	// is only fetched when running
+	Length int
+	// Running is set while the torrent is downloaded or seeded, and unset
+	// once it stopped, with StopTorrent, Close or an error
+	Running bool
+	// Queued is set while the torrent waits for a slot to run, see
+	// SetQueueLimits
+	Queued bool
+	// QueuePosition is the position of the torrent in the queue, from 0
+	QueuePosition int
+	// Verifying is set while VerifyTorrent hashes the data of the torrent
+	Verifying bool
+	// Stats are the last statistics reported by the torrent, refreshed every
+	// second while running
+	Stats p2p.Stats
+	// Err is the error the torrent stopped with, if any
+	Err error
+}
+
+// Status returns a snapshot of a torrent of the session, false if the
+// session has no such torrent
+func (s *Session) Status(infoHash [20]byte) (TorrentStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tf, ok := s.torrents[infoHash]
+	if !ok {
+		return TorrentStatus{}, false
+	}
+	return s.statusLocked(tf), true
+}
+
+// Statuses returns a snapshot of the torrents of the session, sorted by name
+func (s *Session) Statuses() []TorrentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]TorrentStatus, 0, len(s.torrents))
+	for _, tf := range s.torrents {
+		statuses = append(statuses, s.statusLocked(tf))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// statusLocked returns the status of a torrent. The lock must be held.
+func (s *Session) statusLocked(tf torrentfile.TorrentFile) TorrentStatus {
+	status := TorrentStatus{
+		InfoHash:      tf.InfoHash,
+		Name:          tf.Name,
+		Length:        tf.Length,
+		QueuePosition: s.queuePosition(tf.InfoHash),
+		Verifying:     s.verifying[tf.InfoHash],
+	}
+	r, ok := s.running[tf.InfoHash]
+	if ok {
+		select {
+		case <-r.done:
+		default:
+			status.Running = true
+		}
+	} else {
+		r = s.stopped[tf.InfoHash]
+		_, status.Queued = s.wanted[tf.InfoHash]
+	}
+	if r != nil {
+		r.mu.Lock()
+		status.Stats, status.Err = r.stats, r.err
+		r.mu.Unlock()
+	}
+	return status
+}
+
+// StopTorrent stops a running or queued torrent, keeping it in the session,
+// and starts the next queued torrent in its slot. The pieces downloaded so
+// far are kept in its resume file, for StartTorrent. It returns false if the
+// session has no such torrent or if it is neither running nor queued.
+func (s *Session) StopTorrent(infoHash [20]byte) bool {
+	s.mu.Lock()
+	_, wanted := s.wanted[infoHash]
+	delete(s.wanted, infoHash)
+	r, running := s.running[infoHash]
+	if running {
+		delete(s.running, infoHash)
+		s.stopped[infoHash] = r
+		s.schedule()
+	}
+	s.mu.Unlock()
+
+	if running {
+		r.cancel()
+		<-r.done
+	}
+	return wanted || running
+}
+
+// StartTorrent runs a torrent added with Add, or again a torrent stopped with
+// StopTorrent or Close or that failed, with the options it was added with,
+// until it is removed or ctx is done. It is queued while the limits of
+// SetQueueLimits are reached. It returns false if the session has no such
+// torrent or if it is running or queued.
+func (s *Session) StartTorrent(ctx context.Context, infoHash [20]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.torrents[infoHash]; !ok {
+		return false
+	}
+	if _, wanted := s.wanted[infoHash]; wanted {
+		return false
+	}
+	if r, running := s.running[infoHash]; running {
+		select {
+		case <-r.done:
+			delete(s.running, infoHash)
+			s.stopped[infoHash] = r
+		default:
+			return false
+		}
+	}
+	s.wanted[infoHash] = ctx
+	s.schedule()
+	return true
+}
+
+// Errors of VerifyTorrent
+var (
+	// ErrMetadataPending is returned for a torrent added by a magnet link
+	// whose metadata is not known yet
+	ErrMetadataPending = errors.New("metadata of the torrent not known yet")
+	// ErrVerifying is returned for a torrent already being verified
+	ErrVerifying = errors.New("torrent already being verified")
+)
+
+// VerifyTorrent hashes the data of a torrent again and records the intact
+// pieces in its resume file, e.g. after the data was changed outside of the
+// session: the missing pieces are downloaded again by the next run. A
+// running torrent is stopped meanwhile, and the torrent is only started once
+// verified, when it was running or queued or if StartTorrent is called
+// meanwhile. It returns false if the session has no such torrent, and an
+// error if ctx is done before the end, ErrMetadataPending or ErrVerifying.
+func (s *Session) VerifyTorrent(ctx context.Context, infoHash [20]byte) (bool, error) {
+	s.mu.Lock()
+	tf, ok := s.torrents[infoHash]
+	var err error
+	switch {
+	case !ok:
+	case !tf.HasMetadata():
+		err = ErrMetadataPending
+	case s.verifying[infoHash]:
+		err = ErrVerifying
+	}
+	if !ok || err != nil {
+		s.mu.Unlock()
+		return ok, err
+	}
+	s.verifying[infoHash] = true
+	r := s.running[infoHash]
+	s.schedule()
+	s.mu.Unlock()
+
+	// The data must not be written to while it is hashed
+	if r != nil {
+		<-r.done
+	}
+	bf, err := tf.Recheck(ctx, filepath.Join(s.Dir, tf.Name))
+	if err != nil && ctx.Err() == nil {
+		s.logger().Log(logging.Error, "could not verify", logging.F("torrent", tf.Name), logging.F("err", err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.verified(infoHash, tf, bf)
+	}
+	delete(s.verifying, infoHash)
+	s.schedule()
+	return true, err
+}
+
+// verified records the pieces found intact by VerifyTorrent in the status of
+// the last run of a torrent. The lock must be held.
+func (s *Session) verified(infoHash [20]byte, tf torrentfile.TorrentFile, bf bitfield.Bitfield) {
+	r, ok := s.stopped[infoHash]
+	if !ok {
+		r, ok = s.running[infoHash]
+	}
+	if !ok {
+		return
+	}
+
+	pieces, completed := 0, int64(0)
+	for index := range tf.PieceHashes {
+		if !bf.HasPiece(index) {
+			continue
+		}
+		begin, end := index*tf.PieceLength, (index+1)*tf.PieceLength
+		if end > tf.Length {
+			end = tf.Length
+		}
+		pieces++
+		completed += int64(end - begin)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.TotalPieces = len(tf.PieceHashes)
+	r.stats.CompletedPieces, r.stats.Completed = pieces, completed
+	if pieces < len(tf.PieceHashes) {
+		// The torrent downloads again, in a download slot
+		r.complete = false
+		r.stats.ETA = -1
+	}
+}
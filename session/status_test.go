@@ -0,0 +1,177 @@
+package session
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStopStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	content := []byte("stopped and started")
+	tf := torrentfile.TorrentFile{
+		InfoHash:    [20]byte{4, 5, 6},
+		PieceHashes: [][20]byte{sha1.Sum(content)},
+		PieceLength: len(content),
+		Length:      len(content),
+		Name:        "file",
+	}
+	s := newTestSession(t, ctx)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.Dir, "file"), content, 0644))
+
+	_, ok := s.Status(tf.InfoHash)
+	assert.False(t, ok)
+	assert.False(t, s.StopTorrent(tf.InfoHash))
+	assert.False(t, s.StartTorrent(ctx, tf.InfoHash))
+
+	complete := func() bool {
+		status, ok := s.Status(tf.InfoHash)
+		return ok && status.Running && status.Stats.CompletedPieces == 1
+	}
+	require.True(t, s.AddTorrent(ctx, tf, torrentfile.WithPeers([]peer.Peer{}), torrentfile.WithRecheck()))
+	require.Eventually(t, complete, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, s.StartTorrent(ctx, tf.InfoHash))
+
+	// The statistics of a stopped torrent are kept
+	assert.True(t, s.StopTorrent(tf.InfoHash))
+	assert.False(t, s.StopTorrent(tf.InfoHash))
+	statuses := s.Statuses()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "file", statuses[0].Name)
+	assert.Equal(t, len(content), statuses[0].Length)
+	assert.False(t, statuses[0].Running)
+	assert.Equal(t, 1, statuses[0].Stats.CompletedPieces)
+	assert.Nil(t, statuses[0].Err)
+
+	assert.True(t, s.StartTorrent(ctx, tf.InfoHash))
+	require.Eventually(t, complete, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, s.RemoveTorrent(tf.InfoHash))
+	assert.Empty(t, s.Statuses())
+}
+
+func TestSessionVerifyTorrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	content := []byte("verified again")
+	half := len(content) / 2
+	tf := torrentfile.TorrentFile{
+		InfoHash:    [20]byte{7, 8, 9},
+		PieceHashes: [][20]byte{sha1.Sum(content[:half]), sha1.Sum(content[half:])},
+		PieceLength: half,
+		Length:      len(content),
+		Name:        "file",
+	}
+	s := newTestSession(t, ctx)
+	path := filepath.Join(s.Dir, "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+
+	ok, err := s.VerifyTorrent(ctx, tf.InfoHash)
+	assert.False(t, ok)
+	assert.Nil(t, err)
+	magnet := torrentfile.TorrentFile{InfoHash: [20]byte{1}, Name: "magnet"}
+	require.True(t, s.Add(magnet))
+	ok, err = s.VerifyTorrent(ctx, magnet.InfoHash)
+	assert.True(t, ok)
+	assert.NotNil(t, err)
+
+	// The peer never answers, so the missing piece is downloaded forever
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	silent := torrentfile.WithPeers([]peer.Peer{{IP: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Addr().(*net.TCPAddr).Port)}})
+	pieces := func(n int) func() bool {
+		return func() bool {
+			status, ok := s.Status(tf.InfoHash)
+			return ok && status.Running && status.Stats.CompletedPieces == n
+		}
+	}
+	require.True(t, s.AddTorrent(ctx, tf, silent, torrentfile.WithRecheck()))
+	require.Eventually(t, pieces(2), 5*time.Second, 10*time.Millisecond)
+
+	// The damaged piece is found missing, and the torrent runs again
+	damaged := append([]byte(nil), content...)
+	damaged[half] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(path, damaged, 0644))
+	ok, err = s.VerifyTorrent(ctx, tf.InfoHash)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.True(t, pieces(1)())
+
+	// A stopped torrent stays stopped
+	require.True(t, s.StopTorrent(tf.InfoHash))
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	ok, err = s.VerifyTorrent(ctx, tf.InfoHash)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	status, _ := s.Status(tf.InfoHash)
+	assert.False(t, status.Running || status.Queued)
+	assert.Equal(t, 2, status.Stats.CompletedPieces)
+	assert.Equal(t, int64(len(content)), status.Stats.Completed)
+
+	canceled, cancelVerify := context.WithCancel(ctx)
+	cancelVerify()
+	_, err = s.VerifyTorrent(canceled, tf.InfoHash)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSessionVerifyTorrentStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Hashing a large sparse file leaves time to start the torrent meanwhile
+	const pieceLength, numPieces = 1 << 20, 256
+	hash := sha1.Sum(make([]byte, pieceLength))
+	tf := torrentfile.TorrentFile{
+		InfoHash:    [20]byte{4, 5, 6},
+		PieceLength: pieceLength,
+		Length:      pieceLength * numPieces,
+		Name:        "sparse",
+	}
+	for i := 0; i < numPieces; i++ {
+		tf.PieceHashes = append(tf.PieceHashes, hash)
+	}
+	s := newTestSession(t, ctx)
+	defer s.Close()
+	f, err := os.Create(filepath.Join(s.Dir, "sparse"))
+	require.Nil(t, err)
+	require.Nil(t, f.Truncate(int64(tf.Length)))
+	require.Nil(t, f.Close())
+	require.True(t, s.AddTorrent(ctx, tf, torrentfile.WithPeers([]peer.Peer{})))
+	s.StopTorrent(tf.InfoHash)
+
+	verified := make(chan error, 1)
+	go func() {
+		_, err := s.VerifyTorrent(ctx, tf.InfoHash)
+		verified <- err
+	}()
+	require.Eventually(t, func() bool {
+		status, _ := s.Status(tf.InfoHash)
+		return status.Verifying
+	}, 5*time.Second, time.Millisecond)
+	ok, err := s.VerifyTorrent(ctx, tf.InfoHash)
+	assert.True(t, ok)
+	assert.Equal(t, ErrVerifying, err)
+
+	// The torrent waits for the end of the verification to start
+	assert.True(t, s.StartTorrent(ctx, tf.InfoHash))
+	status, _ := s.Status(tf.InfoHash)
+	assert.True(t, status.Verifying)
+	assert.False(t, status.Running)
+	assert.True(t, status.Queued)
+
+	require.Nil(t, <-verified)
+	status, _ = s.Status(tf.InfoHash)
+	assert.False(t, status.Verifying)
+	assert.True(t, status.Running)
+	assert.Equal(t, numPieces, status.Stats.CompletedPieces)
+}
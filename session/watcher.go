@@ -0,0 +1,121 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+const (
+	// DefaultPollInterval is the time between two scans of a watched directory
+	DefaultPollInterval = time.Second
+	// ProcessedDir is the subdirectory processed torrent files are moved to
+	ProcessedDir = "processed"
+	// InvalidSuffix is appended to the torrent files that cannot be parsed
+	InvalidSuffix = ".invalid"
+)
+
+// Watcher adds the .torrent files dropped into a directory to a session and
+// starts them. A file is only picked up once its size and modification time
+// have not changed between two scans, so that partially written files are
+// skipped.
+type Watcher struct {
+	Dir     string
+	Session *Session
+	// PollInterval is the time between two scans. Defaults to DefaultPollInterval.
+	PollInterval time.Duration
+	// Logger defaults to logging.Default
+	Logger logging.Logger
+
+	seen map[string]os.FileInfo // torrent files found by the previous scan
+}
+
+// Run scans the directory until the context is cancelled, running the
+// torrents added with it. The errors are logged, and the directory scanned
+// again at the next interval.
+func (w *Watcher) Run(ctx context.Context) error {
+	interval := w.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := w.scan(ctx)
+		if err != nil {
+			w.logger().Log(logging.Warn, "could not scan watched directory", logging.F("dir", w.Dir), logging.F("err", err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan processes the torrent files that did not change since the previous
+// scan. A file that cannot be processed is logged, and processed again by a
+// later scan.
+func (w *Watcher) scan(ctx context.Context) error {
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]os.FileInfo)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".torrent") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed since listed
+		}
+		prev, ok := w.seen[entry.Name()]
+		if !ok || prev.Size() != info.Size() || !prev.ModTime().Equal(info.ModTime()) {
+			seen[entry.Name()] = info
+			continue
+		}
+		err = w.process(ctx, entry.Name())
+		if err != nil {
+			w.logger().Log(logging.Warn, "could not process torrent file", logging.F("path", filepath.Join(w.Dir, entry.Name())), logging.F("err", err))
+		}
+	}
+	w.seen = seen
+	return nil
+}
+
+// process adds a torrent file to the session, running it with ctx, and moves
+// it aside
+func (w *Watcher) process(ctx context.Context, name string) error {
+	path := filepath.Join(w.Dir, name)
+	tf, err := torrentfile.Open(path)
+	if err != nil {
+		w.logger().Log(logging.Warn, "could not parse torrent file", logging.F("path", path), logging.F("err", err))
+		return os.Rename(path, path+InvalidSuffix)
+	}
+
+	if w.Session.AddTorrent(ctx, tf) {
+		w.logger().Log(logging.Info, "added torrent", logging.F("torrent", tf.Name), logging.F("path", path))
+	}
+
+	dir := filepath.Join(w.Dir, ProcessedDir)
+	err = os.MkdirAll(dir, torrentfile.DefaultDirMode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, name))
+}
+
+func (w *Watcher) logger() logging.Logger {
+	if w.Logger == nil {
+		return logging.Default
+	}
+	return w.Logger
+}
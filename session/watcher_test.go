@@ -0,0 +1,105 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/logging"
+	"github.com/leonhfr/torrent-client/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTorrentFile returns a torrent without tracker of a file named name,
+// and its .torrent file
+func newTestTorrentFile(t *testing.T, name string) (torrentfile.TorrentFile, []byte) {
+	path := filepath.Join(t.TempDir(), name)
+	require.Nil(t, ioutil.WriteFile(path, []byte("dropped into a watched directory"), 0644))
+	tf, err := torrentfile.Create(path)
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	require.Nil(t, tf.Write(&buf))
+	return tf, buf.Bytes()
+}
+
+func TestWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newTestSession(t, ctx)
+	stopped := make(chan struct{})
+	defer func() {
+		cancel()
+		<-stopped
+		s.Close()
+	}()
+	tf, torrent := newTestTorrentFile(t, "dropped")
+
+	dir := t.TempDir()
+	w := &Watcher{Dir: dir, Session: s, PollInterval: 10 * time.Millisecond, Logger: logging.Discard}
+	go func() {
+		w.Run(ctx)
+		close(stopped)
+	}()
+
+	// A partially written file is not picked up
+	path := filepath.Join(dir, "dropped.torrent")
+	require.Nil(t, ioutil.WriteFile(path, torrent[:len(torrent)/2], 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a torrent"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, s.Torrents())
+	require.Nil(t, ioutil.WriteFile(path, torrent, 0644))
+
+	assert.Eventually(t, func() bool { return len(s.Torrents()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "dropped", s.Torrents()[0].Name)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, ProcessedDir, "dropped.torrent"))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	_, err := os.Stat(filepath.Join(dir, "notes.txt"))
+	assert.Nil(t, err)
+
+	// The torrent is started, and stops as it has no tracker to find peers
+	assert.Eventually(t, func() bool {
+		status, _ := s.Status(tf.InfoHash)
+		return status.Err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWatcherInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "broken.torrent")
+	require.Nil(t, ioutil.WriteFile(path, []byte("garbage"), 0644))
+
+	s := New()
+	w := &Watcher{Dir: dir, Session: s, Logger: logging.Discard}
+	require.Nil(t, w.scan(context.Background()))
+	require.Nil(t, w.scan(context.Background()))
+	assert.Empty(t, s.Torrents())
+	_, err := os.Stat(path + InvalidSuffix)
+	assert.Nil(t, err)
+}
+
+func TestWatcherProcessError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newTestSession(t, ctx)
+	defer s.Close()
+	dir := t.TempDir()
+	_, first := newTestTorrentFile(t, "first")
+	_, second := newTestTorrentFile(t, "second")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "first.torrent"), first, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "second.torrent"), second, 0644))
+
+	// The files cannot be moved aside, which does not stop the others
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, ProcessedDir), nil, 0644))
+	w := &Watcher{Dir: dir, Session: s, Logger: logging.Discard}
+	require.Nil(t, w.scan(ctx))
+	require.Nil(t, w.scan(ctx))
+	assert.Len(t, s.Torrents(), 2)
+	_, err := os.Stat(filepath.Join(dir, "first.torrent"))
+	assert.Nil(t, err)
+}
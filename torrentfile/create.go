@@ -0,0 +1,273 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+)
+
+const (
+	// MinPieceLength and MaxPieceLength bound the piece length chosen for
+	// the torrents created without one
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
+	// targetPieces is the number of pieces the chosen piece length aims for
+	targetPieces = 1500
+)
+
+// ErrNoFiles is returned when creating a torrent of a directory without
+// any file
+var ErrNoFiles = errors.New("no files to create the torrent of")
+
+type createOptions struct {
+	pieceLength  int
+	announce     string
+	announceList [][]string
+	urlList      []string
+	comment      string
+	createdBy    string
+	creationDate time.Time
+	private      bool
+}
+
+// CreateOption sets the metadata of a torrent created by Create
+type CreateOption func(*createOptions)
+
+// WithPieceLength sets the piece length of the torrent, a power of two
+// between MinPieceLength and MaxPieceLength by convention. By default, the
+// piece length grows with the content so that it has about 1500 pieces.
+func WithPieceLength(n int) CreateOption {
+	return func(o *createOptions) {
+		o.pieceLength = n
+	}
+}
+
+// WithAnnounce sets the tracker of the torrent
+func WithAnnounce(url string) CreateOption {
+	return func(o *createOptions) {
+		o.announce = url
+	}
+}
+
+// WithAnnounceList sets the tiers of trackers of the torrent. Its announce
+// defaults to the first tracker of the first tier.
+func WithAnnounceList(tiers [][]string) CreateOption {
+	return func(o *createOptions) {
+		o.announceList = tiers
+	}
+}
+
+// WithWebSeeds sets the URLs of the web seeds of the torrent (BEP 19)
+func WithWebSeeds(urls ...string) CreateOption {
+	return func(o *createOptions) {
+		o.urlList = urls
+	}
+}
+
+// WithComment sets the comment of the torrent
+func WithComment(comment string) CreateOption {
+	return func(o *createOptions) {
+		o.comment = comment
+	}
+}
+
+// WithCreatedBy sets the name of the program creating the torrent
+func WithCreatedBy(name string) CreateOption {
+	return func(o *createOptions) {
+		o.createdBy = name
+	}
+}
+
+// WithCreationDate sets the creation date of the torrent instead of the
+// current time, the zero time leaves it out
+func WithCreationDate(date time.Time) CreateOption {
+	return func(o *createOptions) {
+		o.creationDate = date
+	}
+}
+
+// WithPrivate marks the torrent as private, so that clients only get its
+// peers from its trackers (BEP 27)
+func WithPrivate() CreateOption {
+	return func(o *createOptions) {
+		o.private = true
+	}
+}
+
+// Create builds a torrent of the file or directory at path, named after it,
+// hashing its pieces. The files of a directory are taken in lexical order,
+// including the ones of its subdirectories. Use Write to save the torrent
+// as a .torrent file.
+func Create(path string, opts ...CreateOption) (TorrentFile, error) {
+	o := createOptions{creationDate: time.Now()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	var paths []string
+	var files []File
+	length := 0
+	if stat.IsDir() {
+		err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			files = append(files, File{
+				Length:     int(fi.Size()),
+				Path:       strings.Split(rel, string(filepath.Separator)),
+				Executable: fi.Mode()&0111 != 0,
+			})
+			length += int(fi.Size())
+			return nil
+		})
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		if len(files) == 0 {
+			return TorrentFile{}, ErrNoFiles
+		}
+	} else {
+		paths = []string{path}
+		length = int(stat.Size())
+	}
+
+	pieceLength := o.pieceLength
+	if pieceLength <= 0 {
+		pieceLength = pieceLengthFor(length)
+	}
+	hashes, err := hashPieces(paths, pieceLength)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	announce := o.announce
+	if announce == "" && len(o.announceList) > 0 && len(o.announceList[0]) > 0 {
+		announce = o.announceList[0][0]
+	}
+	t := TorrentFile{
+		Announce:     announce,
+		AnnounceList: o.announceList,
+		PieceHashes:  hashes,
+		PieceLength:  pieceLength,
+		Length:       length,
+		Name:         filepath.Base(filepath.Clean(path)),
+		Private:      o.private,
+		Files:        files,
+		URLList:      o.urlList,
+		Comment:      o.comment,
+		CreatedBy:    o.createdBy,
+		CreationDate: o.creationDate,
+	}
+	info := t.info()
+	t.InfoHash, err = info.hash()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return t, nil
+}
+
+// pieceLengthFor returns the power of two piece length giving about
+// targetPieces pieces to length bytes, within MinPieceLength and
+// MaxPieceLength
+func pieceLengthFor(length int) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashPieces returns the hashes of the pieces of the files at paths, read
+// one after the other
+func hashPieces(paths []string, pieceLength int) ([][20]byte, error) {
+	readers := make([]io.Reader, 0, len(paths))
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	r := io.MultiReader(readers...)
+
+	var hashes [][20]byte
+	buf := make([]byte, pieceLength)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hashes = append(hashes, sha1.Sum(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// info returns the info dictionary of the torrent
+func (t *TorrentFile) info() bencodeInfo {
+	var pieces bytes.Buffer
+	for _, h := range t.PieceHashes {
+		pieces.Write(h[:])
+	}
+	info := bencodeInfo{
+		Pieces:      pieces.String(),
+		PieceLength: t.PieceLength,
+		Name:        t.Name,
+	}
+	if t.Private {
+		info.Private = 1
+	}
+	if len(t.Files) == 0 {
+		info.Length = t.Length
+	}
+	for _, f := range t.Files {
+		file := bencodeFile{Length: f.Length, Path: f.Path}
+		if f.Padding {
+			file.Attr += "p"
+		}
+		if f.Executable {
+			file.Attr += "x"
+		}
+		info.Files = append(info.Files, file)
+	}
+	return info
+}
+
+// Write writes the torrent as a .torrent file. Its info dictionary is
+// rebuilt from its fields, so the info hash of a torrent opened from a file
+// with other fields in its info dictionary would change: only torrents
+// created by Create are meant to be written.
+func (t *TorrentFile) Write(w io.Writer) error {
+	bto := bencodeTorrent{
+		Announce:     t.Announce,
+		AnnounceList: t.AnnounceList,
+		URLList:      t.URLList,
+		Comment:      t.Comment,
+		CreatedBy:    t.CreatedBy,
+		Info:         t.info(),
+	}
+	if !t.CreationDate.IsZero() {
+		bto.CreationDate = t.CreationDate.Unix()
+	}
+	return bencode.NewEncoder(w).Encode(bto)
+}
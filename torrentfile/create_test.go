@@ -0,0 +1,125 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateSingleFile(t *testing.T) {
+	content := make([]byte, 100*1024)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "content.bin")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+
+	date := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	tf, err := Create(path,
+		WithPieceLength(32*1024),
+		WithAnnounce("http://tracker.example.com/announce"),
+		WithWebSeeds("http://seed.example.com/"),
+		WithComment("test content"),
+		WithCreatedBy("torrent-client"),
+		WithCreationDate(date),
+		WithPrivate(),
+	)
+	require.Nil(t, err)
+	assert.Equal(t, "content.bin", tf.Name)
+	assert.Equal(t, len(content), tf.Length)
+	assert.Nil(t, tf.Files)
+	require.Len(t, tf.PieceHashes, 4)
+	for i, h := range tf.PieceHashes {
+		end := (i + 1) * 32 * 1024
+		if end > len(content) {
+			end = len(content)
+		}
+		assert.Equal(t, sha1.Sum(content[i*32*1024:end]), h, "piece %d", i)
+	}
+
+	// The written torrent opens as created
+	var buf bytes.Buffer
+	require.Nil(t, tf.Write(&buf))
+	torrentPath := filepath.Join(t.TempDir(), "content.torrent")
+	require.Nil(t, ioutil.WriteFile(torrentPath, buf.Bytes(), 0644))
+	opened, err := Open(torrentPath)
+	require.Nil(t, err)
+	assert.Equal(t, tf, opened)
+}
+
+func TestCreateDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "album")
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "disc 2"), 0755))
+	files := map[string]string{
+		"b.txt":          "second file",
+		"a.txt":          "first file",
+		"disc 2/c.txt":   "third file, in a subdirectory",
+		"disc 2/d.empty": "",
+	}
+	for name, content := range files {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	require.Nil(t, os.Chmod(filepath.Join(dir, "b.txt"), 0755))
+
+	tiers := [][]string{{"http://a.example.com/announce", "udp://b.example.com:6969"}, {"http://c.example.com/announce"}}
+	tf, err := Create(dir, WithAnnounceList(tiers), WithPieceLength(16))
+	require.Nil(t, err)
+	assert.Equal(t, "album", tf.Name)
+	assert.Equal(t, "http://a.example.com/announce", tf.Announce)
+	assert.Equal(t, tiers, tf.AnnounceList)
+	assert.False(t, tf.Private)
+	assert.Equal(t, []File{
+		{Length: 10, Path: []string{"a.txt"}},
+		{Length: 11, Path: []string{"b.txt"}, Executable: true},
+		{Length: 29, Path: []string{"disc 2", "c.txt"}},
+		{Length: 0, Path: []string{"disc 2", "d.empty"}},
+	}, tf.Files)
+	assert.Equal(t, 50, tf.Length)
+	// Pieces span the files
+	data := files["a.txt"] + files["b.txt"] + files["disc 2/c.txt"]
+	require.Len(t, tf.PieceHashes, 4)
+	assert.Equal(t, sha1.Sum([]byte(data[16:32])), tf.PieceHashes[1])
+	assert.Equal(t, sha1.Sum([]byte(data[48:])), tf.PieceHashes[3])
+
+	var buf bytes.Buffer
+	require.Nil(t, tf.Write(&buf))
+	torrentPath := filepath.Join(t.TempDir(), "album.torrent")
+	require.Nil(t, ioutil.WriteFile(torrentPath, buf.Bytes(), 0644))
+	opened, err := Open(torrentPath)
+	require.Nil(t, err)
+	assert.Equal(t, tf.InfoHash, opened.InfoHash)
+	assert.Equal(t, tf.Files, opened.Files)
+	assert.Equal(t, tf.CreationDate.Unix(), opened.CreationDate.Unix())
+}
+
+func TestCreateErrors(t *testing.T) {
+	_, err := Create(t.TempDir())
+	assert.True(t, errors.Is(err, ErrNoFiles))
+
+	_, err = Create(filepath.Join(t.TempDir(), "missing"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPieceLengthFor(t *testing.T) {
+	tests := map[string]struct {
+		length int
+		output int
+	}{
+		"empty":  {0, MinPieceLength},
+		"small":  {1000, MinPieceLength},
+		"medium": {700 * 1024 * 1024, 512 * 1024},
+		"huge":   {1 << 40, MaxPieceLength},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, pieceLengthFor(test.length), name)
+	}
+}
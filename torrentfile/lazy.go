@@ -0,0 +1,76 @@
+package torrentfile
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/leonhfr/torrent-client/p2p"
+)
+
+// skipped tells whether the file at index is skipped
+func skipped(priorities []p2p.Priority, index int) bool {
+	return index < len(priorities) && priorities[index] == p2p.PrioritySkip
+}
+
+// lazyFile is a skipped file of the torrent, only created when a piece it
+// shares with a wanted file is written, and never allocated to its final size
+type lazyFile struct {
+	path       string
+	keep       bool // whether the data of an existing file is kept
+	executable bool
+	o          downloadOptions
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// ReadAt reads the file if it exists
+func (l *lazyFile) ReadAt(p []byte, off int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil && l.keep {
+		f, err := os.OpenFile(l.path, os.O_RDWR, 0)
+		if err == nil {
+			l.f = f
+		}
+	}
+	if l.f == nil {
+		return 0, io.EOF
+	}
+	return l.f.ReadAt(p, off)
+}
+
+// WriteAt creates the file on the first write
+func (l *lazyFile) WriteAt(p []byte, off int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		f, err := createFile(l.path, l.keep, l.o.modeFor(l.executable), l.o)
+		if err != nil {
+			return 0, err
+		}
+		l.f = f
+	}
+	return l.f.WriteAt(p, off)
+}
+
+// Sync flushes the file if it was created
+func (l *lazyFile) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Sync()
+}
+
+// Close closes the file if it was created
+func (l *lazyFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
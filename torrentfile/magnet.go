@@ -0,0 +1,94 @@
+package torrentfile
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// FromMagnet parses a magnet link. The torrent knows only its info hash, name
+// and trackers: its metadata is fetched from peers before downloading it. The
+// name, if any, must be a single path element.
+func FromMagnet(uri string) (TorrentFile, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if u.Scheme != "magnet" {
+		return TorrentFile{}, fmt.Errorf("expected magnet link, got scheme %q", u.Scheme)
+	}
+
+	query := u.Query()
+	var infoHash [20]byte
+	found := false
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		infoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return TorrentFile{}, fmt.Errorf("magnet link has no BitTorrent info hash")
+	}
+
+	t := TorrentFile{InfoHash: infoHash, Name: query.Get("dn")}
+	if t.Name != "" && !SafeName(t.Name) {
+		return TorrentFile{}, fmt.Errorf("unsafe name %q", t.Name)
+	}
+	trackers := query["tr"]
+	if len(trackers) > 0 {
+		t.Announce = trackers[0]
+	}
+	if len(trackers) > 1 {
+		for _, tr := range trackers {
+			t.AnnounceList = append(t.AnnounceList, []string{tr})
+		}
+	}
+	return t, nil
+}
+
+// Magnet returns the magnet link of the torrent, with its info hash, name and
+// trackers
+func (t *TorrentFile) Magnet() string {
+	params := url.Values{}
+	if t.Name != "" {
+		params.Set("dn", t.Name)
+	}
+	for _, tier := range t.Trackers() {
+		for _, tr := range tier {
+			params.Add("tr", tr)
+		}
+	}
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(t.InfoHash[:])
+	if len(params) > 0 {
+		uri += "&" + params.Encode()
+	}
+	return uri
+}
+
+// parseInfoHash decodes an info hash encoded in hex or in base32
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = fmt.Errorf("info hash has length %d", len(s))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("malformed info hash: %w", err)
+	}
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
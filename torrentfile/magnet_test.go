@@ -0,0 +1,100 @@
+package torrentfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromMagnet(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f, 0xa6, 0xf2, 0x86, 0xa9, 0xd7, 0x4c, 0x36, 0x20, 0x14, 0x61, 0x6a, 0x0f, 0xf5, 0xe4, 0x84, 0x3d}
+
+	tests := map[string]struct {
+		input  string
+		output TorrentFile
+		fails  bool
+	}{
+		"hex info hash": {
+			input:  "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&dn=debian.iso",
+			output: TorrentFile{InfoHash: infoHash, Name: "debian.iso"},
+		},
+		"base32 info hash": {
+			input:  "magnet:?xt=urn:btih:33ugu75g6kdktv2mgyqbiylkb726jbb5",
+			output: TorrentFile{InfoHash: infoHash},
+		},
+		"one tracker": {
+			input:  "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&tr=http%3A%2F%2Ftracker.example%2Fannounce",
+			output: TorrentFile{InfoHash: infoHash, Announce: "http://tracker.example/announce"},
+		},
+		"several trackers": {
+			input: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&tr=http%3A%2F%2Fa.example%2Fannounce&tr=udp%3A%2F%2Fb.example%3A6969",
+			output: TorrentFile{
+				InfoHash:     infoHash,
+				Announce:     "http://a.example/announce",
+				AnnounceList: [][]string{{"http://a.example/announce"}, {"udp://b.example:6969"}},
+			},
+		},
+		"not a magnet link": {
+			input: "http://example.com/?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d",
+			fails: true,
+		},
+		"missing info hash": {
+			input: "magnet:?dn=debian.iso",
+			fails: true,
+		},
+		"unsafe name": {
+			input: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&dn=..%2F..%2F.bashrc",
+			fails: true,
+		},
+		"parent directory name": {
+			input: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&dn=..",
+			fails: true,
+		},
+		"malformed info hash": {
+			input: "magnet:?xt=urn:btih:dee86a7f",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		torrent, err := FromMagnet(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, torrent, name)
+		assert.False(t, torrent.HasMetadata(), name)
+	}
+}
+
+func TestMagnet(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xe8, 0x6a, 0x7f, 0xa6, 0xf2, 0x86, 0xa9, 0xd7, 0x4c, 0x36, 0x20, 0x14, 0x61, 0x6a, 0x0f, 0xf5, 0xe4, 0x84, 0x3d}
+
+	tests := map[string]struct {
+		input  TorrentFile
+		output string
+	}{
+		"info hash only": {
+			input:  TorrentFile{InfoHash: infoHash},
+			output: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d",
+		},
+		"name and trackers": {
+			input: TorrentFile{
+				InfoHash:     infoHash,
+				Name:         "debian.iso",
+				Announce:     "http://a.example/announce",
+				AnnounceList: [][]string{{"http://a.example/announce"}, {"udp://b.example:6969"}},
+			},
+			output: "magnet:?xt=urn:btih:dee86a7fa6f286a9d74c362014616a0ff5e4843d&dn=debian.iso&tr=http%3A%2F%2Fa.example%2Fannounce&tr=udp%3A%2F%2Fb.example%3A6969",
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, test.input.Magnet(), name)
+		// The link gives back the torrent without its metadata
+		parsed, err := FromMagnet(test.output)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.input, parsed, name)
+	}
+}
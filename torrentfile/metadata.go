@@ -0,0 +1,243 @@
+package torrentfile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/message"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+const (
+	// DefaultMetadataTimeout is the time allowed to fetch the metadata from a peer
+	DefaultMetadataTimeout = 30 * time.Second
+	// MetadataPieceSize is the size of the pieces the metadata is exchanged in
+	MetadataPieceSize = 16 * 1024
+	// MaxMetadataSize is the largest metadata accepted from a peer
+	MaxMetadataSize = 8 * 1024 * 1024
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+var (
+	// ErrNoMetadata is returned when no peer could deliver the metadata
+	ErrNoMetadata = errors.New("could not fetch metadata from any peer")
+	// ErrMetadataMismatch is returned when a peer delivers metadata that
+	// does not hash to the info hash
+	ErrMetadataMismatch = errors.New("metadata does not match info hash")
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// HasMetadata reports whether the info dictionary of the torrent is known.
+// It is not the case of torrents opened from magnet links until FetchMetadata.
+func (t *TorrentFile) HasMetadata() bool {
+	return len(t.PieceHashes) > 0
+}
+
+// FetchMetadata fetches the info dictionary from the peers with the
+// ut_metadata extension (BEP 9), trying them in turn until one delivers
+// metadata matching the info hash. The options configure the connections.
+func (t *TorrentFile) FetchMetadata(ctx context.Context, peerID [20]byte, peers []peer.Peer, opts ...client.Option) error {
+	c, err := t.fetchMetadata(ctx, peerID, peers, opts...)
+	if err != nil {
+		return err
+	}
+	c.Conn.Close()
+	return nil
+}
+
+// fetchMetadata fetches the metadata and returns the connection to the peer
+// that delivered it, which can be downloaded from
+func (t *TorrentFile) fetchMetadata(ctx context.Context, peerID [20]byte, peers []peer.Peer, opts ...client.Option) (*client.Client, error) {
+	lastErr := errors.New("no peers")
+	for _, p := range peers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		f := &metadataFetch{infoHash: t.InfoHash}
+		c, err := client.New(ctx, p, peerID, t.InfoHash, append(opts, client.WithExtension("ut_metadata", f))...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		info, err := requestMetadata(ctx, c, f)
+		if err == nil {
+			err = t.setInfo(info)
+		}
+		if err != nil {
+			c.Conn.Close()
+			lastErr = fmt.Errorf("%s: %w", p, err)
+			continue
+		}
+		return c, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoMetadata, lastErr)
+}
+
+// setInfo fills the torrent from its bencoded info dictionary
+func (t *TorrentFile) setInfo(buf []byte) error {
+	info := bencodeInfo{}
+	err := bencode.Unmarshal(buf, &info)
+	if err != nil {
+		return err
+	}
+	pieceHashes, files, length, err := info.parse()
+	if err != nil {
+		return err
+	}
+	t.PieceHashes = pieceHashes
+	t.PieceLength = info.PieceLength
+	t.Length = length
+	t.Files = files
+	t.Name = info.Name
+	t.Private = info.Private == 1
+	return nil
+}
+
+// metadataFetch is the ut_metadata handler requesting every piece of the
+// metadata once the peer sent its extension handshake
+type metadataFetch struct {
+	infoHash  [20]byte
+	metadata  []byte
+	received  []bool
+	remaining int
+	done      bool
+}
+
+func (f *metadataFetch) Handshake(c *client.Client, hs client.ExtensionHandshake) error {
+	if f.metadata != nil {
+		return nil
+	}
+	if _, ok := c.ExtensionID("ut_metadata"); !ok {
+		return errors.New("peer does not support ut_metadata")
+	}
+	if hs.MetadataSize <= 0 || hs.MetadataSize > MaxMetadataSize {
+		return fmt.Errorf("invalid metadata size %d", hs.MetadataSize)
+	}
+	f.metadata = make([]byte, hs.MetadataSize)
+	f.received = make([]bool, (hs.MetadataSize+MetadataPieceSize-1)/MetadataPieceSize)
+	f.remaining = len(f.received)
+	for piece := range f.received {
+		buf, err := bencode.Marshal(metadataMessage{MsgType: metadataRequest, Piece: piece})
+		if err != nil {
+			return err
+		}
+		err = c.SendExtension("ut_metadata", buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *metadataFetch) Message(c *client.Client, payload []byte) error {
+	if f.metadata == nil {
+		return nil
+	}
+	piece, data, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	if piece >= len(f.received) || f.received[piece] {
+		return nil
+	}
+	begin := piece * MetadataPieceSize
+	if expected := min(MetadataPieceSize, len(f.metadata)-begin); len(data) != expected {
+		return fmt.Errorf("metadata piece #%d has length %d, expected %d", piece, len(data), expected)
+	}
+	copy(f.metadata[begin:], data)
+	f.received[piece] = true
+	f.remaining--
+	if f.remaining == 0 {
+		if sha1.Sum(f.metadata) != f.infoHash {
+			return ErrMetadataMismatch
+		}
+		f.done = true
+	}
+	return nil
+}
+
+// requestMetadata reads messages from the peer until the metadata fetch is
+// done. Choke, unchoke and have messages received meanwhile update the client.
+func requestMetadata(ctx context.Context, c *client.Client, f *metadataFetch) ([]byte, error) {
+	if !c.SupportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultMetadataTimeout)
+	defer cancel()
+
+	for !f.done {
+		msg, err := c.ReadContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case message.MsgUnchoke:
+			c.Choked = false
+		case message.MsgChoke:
+			c.Choked = true
+		case message.MsgHave:
+			index, err := msg.ParseHave()
+			if err == nil {
+				c.Bitfield.SetPiece(index)
+			}
+		}
+	}
+	return f.metadata, nil
+}
+
+// parseMetadataMessage parses a ut_metadata data message, a bencoded
+// dictionary followed by the piece of metadata
+func parseMetadataMessage(payload []byte) (int, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(payload))
+	var msg metadataMessage
+	err := bencode.NewDecoder(r).Decode(&msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch msg.MsgType {
+	case metadataData:
+	case metadataReject:
+		return 0, nil, fmt.Errorf("peer rejected metadata piece #%d", msg.Piece)
+	default:
+		return 0, nil, fmt.Errorf("unexpected ut_metadata message type %d", msg.MsgType)
+	}
+	if msg.Piece < 0 {
+		return 0, nil, fmt.Errorf("invalid metadata piece #%d", msg.Piece)
+	}
+	data, err := ioutil.ReadAll(r)
+	return msg.Piece, data, err
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,204 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// metadataPeer is a peer serving the metadata of a torrent with ut_metadata
+type metadataPeer struct {
+	info         []byte
+	noExtensions bool
+	corrupt      bool
+	rejectPieces bool
+}
+
+func (mp metadataPeer) listen(t *testing.T, infoHash [20]byte) peer.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mp.serve(conn, infoHash)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (mp metadataPeer) serve(conn net.Conn, infoHash [20]byte) {
+	info := mp.info
+	if mp.corrupt {
+		info = append([]byte(nil), info...)
+		info[len(info)-2] ^= 0xff
+	}
+	var opts []client.Option
+	if !mp.noExtensions {
+		opts = append(opts,
+			client.WithExtension("ut_metadata", metadataServer{info, mp.rejectPieces}),
+			client.WithMetadataSize(len(info)),
+		)
+	}
+	c, err := client.Accept(context.Background(), conn, [20]byte{1}, infoHash, bitfield.Bitfield{0xff}, opts...)
+	if err != nil {
+		return
+	}
+	c.SendUnchoke()
+	for {
+		_, err := c.Read()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// metadataServer answers ut_metadata requests
+type metadataServer struct {
+	info   []byte
+	reject bool
+}
+
+func (ms metadataServer) Handshake(c *client.Client, hs client.ExtensionHandshake) error {
+	return nil
+}
+
+func (ms metadataServer) Message(c *client.Client, payload []byte) error {
+	var req metadataMessage
+	err := bencode.Unmarshal(payload, &req)
+	if err != nil {
+		return err
+	}
+	if ms.reject {
+		buf, _ := bencode.Marshal(metadataMessage{MsgType: metadataReject, Piece: req.Piece})
+		return c.SendExtension("ut_metadata", buf)
+	}
+	begin := req.Piece * MetadataPieceSize
+	end := min(begin+MetadataPieceSize, len(ms.info))
+	buf, _ := bencode.Marshal(metadataMessage{MsgType: metadataData, Piece: req.Piece, TotalSize: len(ms.info)})
+	return c.SendExtension("ut_metadata", append(buf, ms.info[begin:end]...))
+}
+
+// testInfo returns a bencoded info dictionary spanning several metadata pieces
+func testInfo(t *testing.T) (bencodeInfo, []byte) {
+	info := bencodeInfo{
+		Pieces:      strings.Repeat("0123456789abcdefghij", 1000),
+		PieceLength: 262144,
+		Length:      262144 * 1000,
+		Name:        "debian.iso",
+	}
+	buf, err := bencode.Marshal(info)
+	require.Nil(t, err)
+	require.Greater(t, len(buf), MetadataPieceSize)
+	return info, buf
+}
+
+func TestFetchMetadata(t *testing.T) {
+	info, raw := testInfo(t)
+	infoHash := sha1.Sum(raw)
+	pieceHashes, err := info.splitPieceHashes()
+	require.Nil(t, err)
+
+	tests := map[string]struct {
+		peers []metadataPeer
+		fails bool
+	}{
+		"single peer": {
+			peers: []metadataPeer{{info: raw}},
+		},
+		"falls back to the next peer": {
+			peers: []metadataPeer{{info: raw, corrupt: true}, {info: raw, noExtensions: true}, {info: raw}},
+		},
+		"metadata does not match info hash": {
+			peers: []metadataPeer{{info: raw, corrupt: true}},
+			fails: true,
+		},
+		"peer rejects requests": {
+			peers: []metadataPeer{{info: raw, rejectPieces: true}},
+			fails: true,
+		},
+		"peer without extensions": {
+			peers: []metadataPeer{{info: raw, noExtensions: true}},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		var peers []peer.Peer
+		for _, mp := range test.peers {
+			peers = append(peers, mp.listen(t, infoHash))
+		}
+
+		torrent, err := FromMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x", infoHash))
+		require.Nil(t, err, name)
+		err = torrent.FetchMetadata(context.Background(), [20]byte{2}, peers)
+		if test.fails {
+			assert.ErrorIs(t, err, ErrNoMetadata, name)
+			assert.False(t, torrent.HasMetadata(), name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, TorrentFile{
+			InfoHash:    infoHash,
+			PieceHashes: pieceHashes,
+			PieceLength: info.PieceLength,
+			Length:      info.Length,
+			Name:        info.Name,
+		}, torrent, name)
+	}
+}
+
+func TestFetchMetadataInvalid(t *testing.T) {
+	tests := map[string]struct {
+		change func(*bencodeInfo)
+		err    string
+	}{
+		"unsafe name":          {func(info *bencodeInfo) { info.Name = `..\..\evil` }, "unsafe name"},
+		"zero piece length":    {func(info *bencodeInfo) { info.PieceLength = 0 }, "invalid piece length"},
+		"missing piece hashes": {func(info *bencodeInfo) { info.Length++ }, "1000 piece hashes for 1001 pieces"},
+		"extra piece hashes":   {func(info *bencodeInfo) { info.Length = 1000 }, "1000 piece hashes for 1 pieces"},
+	}
+
+	for name, test := range tests {
+		info, _ := testInfo(t)
+		test.change(&info)
+		raw, err := bencode.Marshal(info)
+		require.Nil(t, err)
+		infoHash := sha1.Sum(raw)
+		p := metadataPeer{info: raw}.listen(t, infoHash)
+
+		torrent := TorrentFile{InfoHash: infoHash}
+		err = torrent.FetchMetadata(context.Background(), [20]byte{2}, []peer.Peer{p})
+		assert.ErrorIs(t, err, ErrNoMetadata, name)
+		assert.Contains(t, err.Error(), test.err, name)
+		assert.False(t, torrent.HasMetadata(), name)
+		assert.Empty(t, torrent.Name, name)
+	}
+}
+
+func TestFetchMetadataCanceled(t *testing.T) {
+	_, raw := testInfo(t)
+	infoHash := sha1.Sum(raw)
+	p := metadataPeer{info: raw}.listen(t, infoHash)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	torrent := TorrentFile{InfoHash: infoHash}
+	err := torrent.FetchMetadata(ctx, [20]byte{2}, []peer.Peer{p})
+	assert.ErrorIs(t, err, context.Canceled)
+}
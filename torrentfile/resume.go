@@ -0,0 +1,241 @@
+package torrentfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/tracker"
+)
+
+// ResumeSuffix is appended to the output path of a download to name the file
+// recording its progress
+const ResumeSuffix = ".resume"
+
+// resumeVersion is the version of the format of the resume file. The files
+// without version only hold the info hash, bitfield and traffic.
+const resumeVersion = 2
+
+// resumeSaveInterval is the least time between two writes of the resume file
+// while pieces are stored
+var resumeSaveInterval = 5 * time.Second
+
+// resumeData is the bencoded content of the resume file
+type resumeData struct {
+	Version    int    `bencode:"version,omitempty"`
+	InfoHash   string `bencode:"info hash"`
+	Bitfield   string `bencode:"bitfield"`
+	Uploaded   int64  `bencode:"uploaded,omitempty"`
+	Downloaded int64  `bencode:"downloaded,omitempty"`
+	// Files are the files at the output path once the last run stopped, by
+	// index in the torrent, missing while it runs
+	Files []resumeFileStat `bencode:"files,omitempty"`
+	// Tracker is the tracker.State of the last announce
+	Tracker bencode.RawMessage `bencode:"tracker,omitempty"`
+}
+
+// resumeFileStat is the size and modification time of a file of the torrent,
+// to tell whether it changed since the bitfield was saved
+type resumeFileStat struct {
+	Size  int64 `bencode:"size"`  // -1 if missing
+	MTime int64 `bencode:"mtime"` // in nanoseconds since the epoch
+}
+
+// resumeFile records the pieces stored at the output path of a download, so
+// that an interrupted download can be resumed, the traffic of the torrent
+// over its runs, for its share ratio, and the last announce to its tracker.
+// Once a run stopped, it also records the files, so that the next run can
+// trust the pieces without hashing them again if they did not change.
+type resumeFile struct {
+	path       string
+	infoHash   [20]byte
+	mu         sync.Mutex
+	bf         bitfield.Bitfield
+	uploaded   int64
+	downloaded int64
+	files      []resumeFileStat
+	tracker    tracker.State
+	saved      time.Time // when the resume file was last written
+}
+
+func newResumeFile(path string, infoHash [20]byte, pieces int) *resumeFile {
+	return &resumeFile{
+		path:     path + ResumeSuffix,
+		infoHash: infoHash,
+		bf:       bitfield.New(pieces),
+	}
+}
+
+// load reads the pieces and traffic recorded by the previous runs. It
+// reports false if there is no resume file, or if it does not match the
+// torrent.
+func (r *resumeFile) load() bool {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	var data resumeData
+	err = bencode.NewDecoder(file).Decode(&data)
+	if err != nil || data.Version > resumeVersion || data.InfoHash != string(r.infoHash[:]) || len(data.Bitfield) != len(r.bf) {
+		return false
+	}
+	copy(r.bf, data.Bitfield)
+	r.uploaded, r.downloaded = data.Uploaded, data.Downloaded
+	r.files = data.Files
+	if len(data.Tracker) > 0 {
+		// The tracker state only saves time, so a broken one is ignored
+		if state, err := tracker.LoadState(bytes.NewReader(data.Tracker)); err == nil {
+			r.tracker = state
+		}
+	}
+	return true
+}
+
+// unchanged reports whether the files at path are the ones recorded when the
+// last run stopped, so that the pieces of the bitfield can be trusted
+func (r *resumeFile) unchanged(t *TorrentFile, path string) bool {
+	stats := t.fileStats(path)
+	if len(r.files) != len(stats) {
+		return false
+	}
+	for i := range stats {
+		if r.files[i] != stats[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// set records a stored piece, and writes the resume file unless it was
+// written less than resumeSaveInterval ago. The pieces stored meanwhile are
+// written with the next ones or when the run stops, and downloaded again if
+// the process dies before. The files are changing until the run stops.
+func (r *resumeFile) set(index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bf.SetPiece(index)
+	if r.files == nil && time.Since(r.saved) < resumeSaveInterval {
+		return nil
+	}
+	r.files = nil
+	return r.save()
+}
+
+// save writes the resume file atomically, so that it is never left half
+// written if the process dies
+func (r *resumeFile) save() error {
+	data := resumeData{
+		Version:    resumeVersion,
+		InfoHash:   string(r.infoHash[:]),
+		Bitfield:   string(r.bf),
+		Uploaded:   r.uploaded,
+		Downloaded: r.downloaded,
+		Files:      r.files,
+	}
+	if !r.tracker.LastAnnounce.IsZero() {
+		var state bytes.Buffer
+		if err := r.tracker.Save(&state); err != nil {
+			return err
+		}
+		data.Tracker = state.Bytes()
+	}
+	buf, err := bencode.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), r.path)
+	if err == nil {
+		r.saved = time.Now()
+	}
+	return err
+}
+
+// finish records the traffic of the torrent over its runs, the last
+// announce to its tracker and the files at path, then writes the resume file,
+// or deletes it if the download is complete and nothing was exchanged, as
+// there is nothing left to resume
+func (r *resumeFile) finish(t *TorrentFile, path string, stats p2p.Stats, state tracker.State) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploaded, r.downloaded = stats.TotalUploaded, stats.TotalDownloaded
+	if !state.LastAnnounce.IsZero() {
+		r.tracker = state
+	}
+	r.files = t.fileStats(path)
+	if stats.CompletedPieces == stats.TotalPieces && r.uploaded == 0 && r.downloaded == 0 {
+		return r.remove()
+	}
+	return r.save()
+}
+
+// remove deletes the resume file
+func (r *resumeFile) remove() error {
+	err := os.Remove(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// filesExist reports whether the files of the torrent exist at path with
+// their final size, as left by a previous run. Skipped files are left out, as
+// they are only written the pieces they share with the others.
+func (t *TorrentFile) filesExist(path string, priorities []p2p.Priority) bool {
+	if len(t.Files) == 0 {
+		return skipped(priorities, 0) || fileHasSize(path, int64(t.Length))
+	}
+	for i, f := range t.Files {
+		if !f.Padding && !skipped(priorities, i) && !fileHasSize(filepath.Join(append([]string{path}, f.Path...)...), int64(f.Length)) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileStats returns the sizes and modification times of the files of the
+// torrent at path, by index in Files. The padding files are left zero.
+func (t *TorrentFile) fileStats(path string) []resumeFileStat {
+	if len(t.Files) == 0 {
+		return []resumeFileStat{statFile(path)}
+	}
+	stats := make([]resumeFileStat, len(t.Files))
+	for i, f := range t.Files {
+		if !f.Padding {
+			stats[i] = statFile(filepath.Join(append([]string{path}, f.Path...)...))
+		}
+	}
+	return stats
+}
+
+func statFile(path string) resumeFileStat {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return resumeFileStat{Size: -1}
+	}
+	return resumeFileStat{Size: info.Size(), MTime: info.ModTime().UnixNano()}
+}
+
+func fileHasSize(path string, size int64) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Size() == size
+}
@@ -0,0 +1,486 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.iso")
+	infoHash := [20]byte{1, 2, 3}
+
+	defer func(interval time.Duration) { resumeSaveInterval = interval }(resumeSaveInterval)
+	resumeSaveInterval = 50 * time.Millisecond
+	r := newResumeFile(path, infoHash, 10)
+	assert.False(t, r.load())
+	require.Nil(t, r.set(0))
+
+	// The pieces stored right after a write are written with the next ones
+	require.Nil(t, r.set(9))
+	loaded := newResumeFile(path, infoHash, 10)
+	require.True(t, loaded.load())
+	assert.Equal(t, bitfield.Bitfield{0x80, 0x00}, loaded.bf)
+	time.Sleep(resumeSaveInterval)
+	require.Nil(t, r.set(9))
+
+	tests := map[string]struct {
+		infoHash [20]byte
+		pieces   int
+		ok       bool
+	}{
+		"matching torrent": {infoHash, 10, true},
+		"other info hash":  {[20]byte{4, 5, 6}, 10, false},
+		"other pieces":     {infoHash, 20, false},
+	}
+
+	for name, test := range tests {
+		loaded := newResumeFile(path, test.infoHash, test.pieces)
+		assert.Equal(t, test.ok, loaded.load(), name)
+		if test.ok {
+			assert.Equal(t, bitfield.Bitfield{0x80, 0x40}, loaded.bf, name)
+		}
+	}
+
+	require.Nil(t, r.remove())
+	_, err := os.Stat(path + ResumeSuffix)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, r.remove())
+}
+
+func TestResumeFileFinish(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.iso")
+	infoHash := [20]byte{1, 2, 3}
+
+	torrent := &TorrentFile{Length: 2}
+
+	// Complete without traffic, there is nothing to resume
+	r := newResumeFile(path, infoHash, 2)
+	require.Nil(t, r.set(0))
+	require.Nil(t, r.finish(torrent, path, p2p.Stats{CompletedPieces: 2, TotalPieces: 2}, tracker.State{}))
+	assert.False(t, newResumeFile(path, infoHash, 2).load())
+
+	// The traffic is kept for the share ratio of the next runs, with the
+	// last announce
+	state := tracker.State{
+		LastAnnounce: time.Unix(1000, 0),
+		Interval:     900,
+		TrackerID:    "abc",
+		Peers:        []peer.Peer{{IP: net.IP{192, 0, 2, 1}, Port: 6881}},
+		Complete:     3,
+	}
+	require.Nil(t, r.finish(torrent, path, p2p.Stats{CompletedPieces: 2, TotalPieces: 2, TotalUploaded: 30, TotalDownloaded: 20}, state))
+	loaded := newResumeFile(path, infoHash, 2)
+	assert.True(t, loaded.load())
+	assert.Equal(t, int64(30), loaded.uploaded)
+	assert.Equal(t, int64(20), loaded.downloaded)
+	assert.Equal(t, state, loaded.tracker)
+
+	// A run that did not announce keeps the last announce
+	require.Nil(t, r.finish(torrent, path, p2p.Stats{TotalPieces: 2, TotalUploaded: 30}, tracker.State{}))
+	loaded = newResumeFile(path, infoHash, 2)
+	assert.True(t, loaded.load())
+	assert.Equal(t, state, loaded.tracker)
+}
+
+func TestResumeFileUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	torrent := &TorrentFile{
+		Length: 3,
+		Files: []File{
+			{Length: 1, Path: []string{"a"}},
+			{Length: 1, Padding: true},
+			{Length: 1, Path: []string{"b"}},
+		},
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte{1}, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte{2}, 0644))
+	infoHash := [20]byte{1, 2, 3}
+
+	// Saved while running, the files are not recorded
+	r := newResumeFile(dir, infoHash, 1)
+	require.Nil(t, r.set(0))
+	loaded := newResumeFile(dir, infoHash, 1)
+	require.True(t, loaded.load())
+	assert.False(t, loaded.unchanged(torrent, dir))
+
+	require.Nil(t, r.finish(torrent, dir, p2p.Stats{CompletedPieces: 1, TotalPieces: 1, TotalUploaded: 1}, tracker.State{}))
+	loaded = newResumeFile(dir, infoHash, 1)
+	require.True(t, loaded.load())
+	assert.True(t, loaded.unchanged(torrent, dir))
+
+	tests := map[string]func(path string) error{
+		"modified": func(path string) error {
+			return os.Chtimes(path, time.Now(), time.Unix(1000, 0))
+		},
+		"resized": func(path string) error {
+			return ioutil.WriteFile(path, []byte{2, 3}, 0644)
+		},
+		"missing": os.Remove,
+	}
+
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Nil(t, r.finish(torrent, dir, p2p.Stats{CompletedPieces: 1, TotalPieces: 1, TotalUploaded: 1}, tracker.State{}))
+			require.Nil(t, change(filepath.Join(dir, "b")))
+			loaded := newResumeFile(dir, infoHash, 1)
+			require.True(t, loaded.load())
+			assert.False(t, loaded.unchanged(torrent, dir))
+			require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte{2}, 0644))
+		})
+	}
+}
+
+func TestResumeFileVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	infoHash := [20]byte{1, 2, 3}
+	buf, err := bencode.Marshal(resumeData{Version: resumeVersion + 1, InfoHash: string(infoHash[:]), Bitfield: "\x80"})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path+ResumeSuffix, buf, 0644))
+	assert.False(t, newResumeFile(path, infoHash, 1).load())
+
+	// The files without version are still read
+	buf, err = bencode.Marshal(resumeData{InfoHash: string(infoHash[:]), Bitfield: "\x80", Uploaded: 5})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path+ResumeSuffix, buf, 0644))
+	r := newResumeFile(path, infoHash, 1)
+	require.True(t, r.load())
+	assert.Equal(t, int64(5), r.uploaded)
+}
+
+func TestDownloadToFileSeedRatio(t *testing.T) {
+	content := []byte("seeded download!")
+	torrent := completeTorrent(content)
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	r := newResumeFile(path, torrent.InfoHash, len(torrent.PieceHashes))
+	r.uploaded = int64(2 * len(content))
+	r.bf.SetPiece(0)
+	r.bf.SetPiece(1)
+	require.Nil(t, r.save())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := p2p.Listen(0)
+	require.Nil(t, err)
+	go l.Serve(ctx)
+
+	// The previous runs reached the ratio, so seeding stops at once
+	var last p2p.Stats
+	err = torrent.DownloadToFile(ctx, path,
+		WithPeers([]peer.Peer{}),
+		WithRandom(bytes.NewReader(make([]byte, 20))),
+		WithListener(l),
+		WithSeeding(),
+		WithSeedRatio(2),
+		WithProgress(time.Hour, func(s p2p.Stats) { last = s }),
+	)
+	require.Nil(t, err)
+	assert.Equal(t, 2.0, last.Ratio)
+
+	loaded := newResumeFile(path, torrent.InfoHash, len(torrent.PieceHashes))
+	assert.True(t, loaded.load())
+	assert.Equal(t, int64(2*len(content)), loaded.uploaded)
+}
+
+func TestFilesExist(t *testing.T) {
+	dir := t.TempDir()
+	torrent := TorrentFile{Length: 3}
+	assert.False(t, torrent.filesExist(filepath.Join(dir, "file"), nil))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte{1, 2}, 0644))
+	assert.False(t, torrent.filesExist(filepath.Join(dir, "file"), nil))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte{1, 2, 3}, 0644))
+	assert.True(t, torrent.filesExist(filepath.Join(dir, "file"), nil))
+
+	torrent = TorrentFile{
+		Length: 3,
+		Files: []File{
+			{Length: 1, Path: []string{"a"}},
+			{Length: 2, Path: []string{"sub", "b"}},
+		},
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte{1}, 0644))
+	assert.False(t, torrent.filesExist(dir, nil))
+	// Skipped files may be missing
+	assert.True(t, torrent.filesExist(dir, []p2p.Priority{p2p.PriorityNormal, p2p.PrioritySkip}))
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b"), []byte{2, 3}, 0644))
+	assert.True(t, torrent.filesExist(dir, nil))
+}
+
+// completeTorrent returns a torrent of two pieces of content
+func completeTorrent(content []byte) TorrentFile {
+	half := len(content) / 2
+	return TorrentFile{
+		InfoHash:    [20]byte{1},
+		PieceHashes: [][20]byte{sha1.Sum(content[:half]), sha1.Sum(content[half:])},
+		PieceLength: half,
+		Length:      len(content),
+		Name:        "file",
+	}
+}
+
+func TestDownloadToFileResume(t *testing.T) {
+	content := []byte("resumed download")
+	tests := map[string]struct {
+		resume bool
+		opts   []DownloadOption
+	}{
+		"resume file":   {true, nil},
+		"recheck files": {false, []DownloadOption{WithRecheck()}},
+	}
+
+	for name, test := range tests {
+		torrent := completeTorrent(content)
+		path := filepath.Join(t.TempDir(), "file")
+		require.Nil(t, ioutil.WriteFile(path, content, 0644))
+		if test.resume {
+			r := newResumeFile(path, torrent.InfoHash, len(torrent.PieceHashes))
+			r.bf.SetPiece(0)
+			r.bf.SetPiece(1)
+			require.Nil(t, r.save())
+		}
+
+		// No peer is needed, as every piece is already stored
+		opts := append([]DownloadOption{WithPeers([]peer.Peer{}), WithRandom(bytes.NewReader(make([]byte, 20)))}, test.opts...)
+		err := torrent.DownloadToFile(context.Background(), path, opts...)
+		assert.Nil(t, err, name)
+
+		buf, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		assert.Equal(t, content, buf, name)
+		_, err = os.Stat(path + ResumeSuffix)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	content := []byte("reported download!")
+	torrent := completeTorrent(content)
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+
+	var last p2p.Stats
+	calls := 0
+	err := torrent.DownloadToFile(context.Background(), path,
+		WithPeers([]peer.Peer{}),
+		WithRandom(bytes.NewReader(make([]byte, 20))),
+		WithRecheck(),
+		WithProgress(time.Hour, func(s p2p.Stats) {
+			last = s
+			calls++
+		}),
+	)
+	require.Nil(t, err)
+
+	// The statistics are reported once the download stops
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 2, last.CompletedPieces)
+	assert.Equal(t, 2, last.TotalPieces)
+	assert.Equal(t, int64(len(content)), last.Completed)
+}
+
+func TestDownloadToFileFastResume(t *testing.T) {
+	content := []byte("resumed download")
+	torrent := completeTorrent(content)
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	r := newResumeFile(path, torrent.InfoHash, len(torrent.PieceHashes))
+	require.Nil(t, r.set(0))
+	require.Nil(t, r.set(1))
+	require.Nil(t, r.finish(&torrent, path, p2p.Stats{CompletedPieces: 2, TotalPieces: 2, TotalUploaded: 1}, tracker.State{}))
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+
+	// The data is replaced without changing the size nor the modification
+	// time: the pieces are trusted without hashing them
+	corrupt := bytes.Repeat([]byte{'x'}, len(content))
+	require.Nil(t, ioutil.WriteFile(path, corrupt, 0644))
+	require.Nil(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	opts := []DownloadOption{WithPeers([]peer.Peer{}), WithRandom(bytes.NewReader(make([]byte, 20)))}
+	assert.Nil(t, torrent.DownloadToFile(context.Background(), path, opts...))
+
+	// Once the file changed, its pieces are hashed again and found missing,
+	// with no peer to download them from
+	require.Nil(t, ioutil.WriteFile(path, corrupt, 0644))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Unix(1000, 0)))
+	opts = []DownloadOption{WithPeers([]peer.Peer{}), WithRandom(bytes.NewReader(make([]byte, 20)))}
+	assert.NotNil(t, torrent.DownloadToFile(context.Background(), path, opts...))
+}
+
+func TestDownloadToFileTrackerStateDir(t *testing.T) {
+	announces := make(chan url.Values, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces <- r.URL.Query()
+		w.Write([]byte("d8:intervali2e10:tracker id3:abc5:peers0:e"))
+	}))
+	defer server.Close()
+	content := []byte("seeded twice")
+	torrent := completeTorrent(content)
+	torrent.Announce = server.URL
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	dir := t.TempDir()
+
+	// seed runs the torrent until the tracker heard of it, and returns the
+	// started announce and how long it took
+	seed := func() (url.Values, time.Duration) {
+		start := time.Now()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- torrent.DownloadToFile(ctx, path, WithPeers([]peer.Peer{}), WithRecheck(), WithSeeding(), WithTrackerStateDir(dir), WithRandom(bytes.NewReader(make([]byte, 20))))
+		}()
+		started := <-announces
+		elapsed := time.Since(start)
+		cancel()
+		require.Nil(t, <-done)
+		assert.Equal(t, "stopped", (<-announces).Get("event"))
+		return started, elapsed
+	}
+
+	started, _ := seed()
+	assert.Empty(t, started.Get("trackerid"))
+	state, err := tracker.LoadStateFile(filepath.Join(dir, "0100000000000000000000000000000000000000.tracker"))
+	require.Nil(t, err)
+	assert.Equal(t, "abc", state.TrackerID)
+	assert.Equal(t, 2, state.Interval)
+	_, err = os.Stat(path + ResumeSuffix)
+	require.True(t, os.IsNotExist(err))
+
+	// Without the resume file, the next run waits for the interval and sends
+	// the tracker id back
+	started, elapsed := seed()
+	assert.Equal(t, "abc", started.Get("trackerid"))
+	assert.Equal(t, "started", started.Get("event"))
+	assert.Greater(t, elapsed, 500*time.Millisecond)
+}
+
+func TestDownloadToFileTrackerStateFresh(t *testing.T) {
+	announces := make(chan url.Values, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces <- r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x00\x01e"))
+	}))
+	defer server.Close()
+	content := []byte("seeded twice")
+	torrent := completeTorrent(content)
+	torrent.Announce = server.URL
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	dir := t.TempDir()
+	seed := func(ctx context.Context, opts ...DownloadOption) error {
+		opts = append(opts, WithRecheck(), WithSeeding(), WithTrackerStateDir(dir), WithRandom(bytes.NewReader(make([]byte, 20))))
+		return torrent.DownloadToFile(ctx, path, opts...)
+	}
+
+	// The run is stopped once the tracker answered
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		var once sync.Once
+		done <- seed(ctx, WithProgress(10*time.Millisecond, func(p2p.Stats) { once.Do(cancel) }))
+	}()
+	assert.Equal(t, "started", (<-announces).Get("event"))
+	require.Nil(t, <-done)
+	assert.Equal(t, "stopped", (<-announces).Get("event"))
+
+	// The peers of the last announce are tried until the interval elapses
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	require.Nil(t, seed(ctx))
+	assert.Empty(t, announces)
+}
+
+func TestDownloadToFileResumeMismatch(t *testing.T) {
+	content := []byte("resumed download")
+	torrent := completeTorrent(content)
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	r := newResumeFile(path, [20]byte{2}, len(torrent.PieceHashes))
+	require.Nil(t, r.set(0))
+	require.Nil(t, r.set(1))
+
+	// The resume file belongs to another torrent: the data is not trusted,
+	// and there is no peer to download it again from
+	err := torrent.DownloadToFile(context.Background(), path, WithPeers([]peer.Peer{}), WithRandom(bytes.NewReader(make([]byte, 20))))
+	assert.NotNil(t, err)
+}
+
+func TestDownloadToFileSkipsFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "files")
+	content := []byte("first, second")
+	torrent := TorrentFile{
+		InfoHash:    [20]byte{1},
+		PieceHashes: [][20]byte{sha1.Sum(content[:7]), sha1.Sum(content[7:])},
+		PieceLength: 7,
+		Length:      len(content),
+		Name:        "files",
+		Files: []File{
+			{Length: 7, Path: []string{"a.txt"}},
+			{Length: 6, Path: []string{"b.txt"}},
+		},
+	}
+	require.Nil(t, os.Mkdir(dir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), content[:7], 0644))
+
+	// The wanted file is complete, the skipped one is not created
+	err := torrent.DownloadToFile(context.Background(), dir,
+		WithPeers([]peer.Peer{}),
+		WithRandom(bytes.NewReader(make([]byte, 20))),
+		WithRecheck(),
+		WithFilePriorities(p2p.PriorityNormal, p2p.PrioritySkip),
+	)
+	require.Nil(t, err)
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, content[:7], buf)
+	_, err = os.Stat(filepath.Join(dir, "b.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The resume file is kept for the skipped pieces
+	r := newResumeFile(dir, torrent.InfoHash, len(torrent.PieceHashes))
+	require.True(t, r.load())
+	assert.Equal(t, bitfield.Bitfield{0x80}, r.bf)
+}
+
+func TestLazyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "file")
+	l := &lazyFile{path: path, o: newDownloadOptions(nil)}
+	_, err := l.ReadAt(make([]byte, 2), 0)
+	assert.Equal(t, io.EOF, err)
+	require.Nil(t, l.Sync())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Writing creates the file, without allocating it
+	_, err = l.WriteAt([]byte{1, 2}, 4)
+	require.Nil(t, err)
+	buf := make([]byte, 2)
+	_, err = l.ReadAt(buf, 4)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{1, 2}, buf)
+	require.Nil(t, l.Close())
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, int64(6), info.Size())
+}
@@ -0,0 +1,113 @@
+package torrentfile
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/leonhfr/torrent-client/p2p"
+)
+
+// WithStreamServer serves the files of the torrent over HTTP on l while it
+// downloads, at /<name> for a single-file torrent and at their path in the
+// torrent for a multi-file one, with an index at /. Range requests are
+// supported, and the pieces they need are downloaded first, so that media
+// players can play a file being downloaded and seek in it. The files are
+// served until the context of the download is done, even once complete.
+func WithStreamServer(l net.Listener) DownloadOption {
+	return func(o *downloadOptions) {
+		o.stream = l
+	}
+}
+
+// serveStream serves the files of the torrent on l until the returned
+// function is called
+func (t *TorrentFile) serveStream(l net.Listener, torrent *p2p.Torrent) func() {
+	srv := &http.Server{
+		Handler:           t.streamHandler(torrent),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go srv.Serve(l)
+	return func() { srv.Close() }
+}
+
+// streamHandler serves the files of the torrent from the store of its
+// download, waiting for the pieces of each range read
+func (t *TorrentFile) streamHandler(torrent *p2p.Torrent) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" {
+			t.serveIndex(w)
+			return
+		}
+		index, ok := t.fileIndex(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reader, err := torrent.NewReader(index)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer reader.Close()
+		// The reads waiting for pieces stop once the client is gone
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-r.Context().Done():
+				reader.Close()
+			case <-done:
+			}
+		}()
+		http.ServeContent(w, r, path.Base(name), time.Time{}, reader)
+	})
+}
+
+// serveIndex lists the links to the files of the torrent
+func (t *TorrentFile) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<pre>")
+	for _, name := range t.streamNames() {
+		if name == "" {
+			continue
+		}
+		segments := strings.Split(name, "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		fmt.Fprintf(w, "<a href=\"/%s\">%s</a>\n", html.EscapeString(strings.Join(segments, "/")), html.EscapeString(name))
+	}
+	fmt.Fprintln(w, "</pre>")
+}
+
+// streamNames returns the paths the files of the torrent are served at,
+// empty for padding files which are not served
+func (t *TorrentFile) streamNames() []string {
+	if len(t.Files) == 0 {
+		return []string{t.Name}
+	}
+	names := make([]string, len(t.Files))
+	for i, f := range t.Files {
+		if !f.Padding {
+			names[i] = strings.Join(f.Path, "/")
+		}
+	}
+	return names
+}
+
+// fileIndex returns the index of the file served at name
+func (t *TorrentFile) fileIndex(name string) (int, bool) {
+	for i, n := range t.streamNames() {
+		if n != "" && n == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamHandler(t *testing.T) {
+	content := []byte("first file, second file")
+	tf := TorrentFile{
+		PieceHashes: [][20]byte{sha1.Sum(content[:12]), sha1.Sum(content[12:])},
+		PieceLength: 12,
+		Length:      len(content),
+		Name:        "files",
+		Files: []File{
+			{Length: 12, Path: []string{"a.txt"}},
+			{Length: 11, Path: []string{"sub dir", "b.txt"}},
+		},
+	}
+	torrent := p2p.Torrent{PieceHashes: tf.PieceHashes, PieceLength: tf.PieceLength, Length: tf.Length, WebFiles: tf.webFiles()}
+	store := p2p.MultiStore{
+		{Store: &fileData{content[:12]}, Length: 12},
+		{Store: &fileData{content[12:]}, Length: 11},
+	}
+	torrent.VerifyStore(store)
+	srv := httptest.NewServer(tf.streamHandler(&torrent))
+	defer srv.Close()
+
+	tests := map[string]struct {
+		path   string
+		header string
+		status int
+		body   string
+	}{
+		"whole file":   {"/a.txt", "", http.StatusOK, "first file, "},
+		"range":        {"/sub%20dir/b.txt", "bytes=0-5", http.StatusPartialContent, "second"},
+		"open range":   {"/sub%20dir/b.txt", "bytes=7-", http.StatusPartialContent, "file"},
+		"unknown file": {"/c.txt", "", http.StatusNotFound, "404 page not found\n"},
+		"torrent name": {"/files", "", http.StatusNotFound, "404 page not found\n"},
+		"index":        {"/", "", http.StatusOK, "<pre>\n<a href=\"/a.txt\">a.txt</a>\n<a href=\"/sub%20dir/b.txt\">sub dir/b.txt</a>\n</pre>\n"},
+	}
+
+	for name, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+test.path, nil)
+		require.Nil(t, err)
+		if test.header != "" {
+			req.Header.Set("Range", test.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err, name)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err, name)
+		assert.Equal(t, test.status, resp.StatusCode, name)
+		assert.Equal(t, test.body, string(body), name)
+	}
+}
+
+// fileData is the data of a file held in memory
+type fileData struct {
+	buf []byte
+}
+
+func (f *fileData) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.buf).ReadAt(p, off)
+}
+
+func (f *fileData) WriteAt(p []byte, off int64) (int, error) {
+	return copy(f.buf[off:], p), nil
+}
+
+func TestDownloadToFileStream(t *testing.T) {
+	content := []byte("streamed content")
+	torrent := completeTorrent(content)
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error)
+	go func() {
+		returned <- torrent.DownloadToFile(ctx, path,
+			WithPeers([]peer.Peer{}),
+			WithRandom(bytes.NewReader(make([]byte, 20))),
+			WithRecheck(),
+			WithStreamServer(l),
+		)
+	}()
+
+	// The file is served until the context is done, even once downloaded
+	req, err := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+"/file", nil)
+	require.Nil(t, err)
+	req.Header.Set("Range", "bytes=9-")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "content", string(body))
+
+	cancel()
+	assert.Nil(t, <-returned)
+}
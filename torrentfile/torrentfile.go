@@ -1,106 +1,828 @@
 package torrentfile
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/client"
+	"github.com/leonhfr/torrent-client/dht"
+	"github.com/leonhfr/torrent-client/logging"
 	"github.com/leonhfr/torrent-client/p2p"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
 )
 
 // Port to listen on
 const Port uint16 = 6881
 
+const (
+	// DefaultFileMode is the permission used when creating downloaded files
+	DefaultFileMode os.FileMode = 0644
+	// DefaultDirMode is the permission used when creating output directories
+	DefaultDirMode os.FileMode = 0755
+)
+
+type downloadOptions struct {
+	fileMode         os.FileMode
+	dirMode          os.FileMode
+	peers            []peer.Peer
+	random           io.Reader
+	verify           bool
+	recheck          bool
+	sequential       bool
+	encryption       client.EncryptionPolicy
+	dialer           client.Dialer
+	blocklist        p2p.Blocklist
+	listener         *p2p.PeerListener
+	downloadLimiters []*client.Limiter
+	uploadLimiters   []*client.Limiter
+	peerID           *[20]byte
+	conns            *p2p.ConnLimit
+	dials            *p2p.ConnLimit
+	dht              *dht.Server
+	seed             bool
+	seedRatio        float64
+	seedIdleTimeout  time.Duration
+	superSeed        bool
+	torrentOptions   []p2p.Option
+	logger           logging.Logger
+	progress         func(p2p.Stats)
+	progressInterval time.Duration
+	stream           net.Listener
+	filePriorities   []p2p.Priority
+	metrics          p2p.Metrics
+	trackerStateDir  string
+}
+
+// DownloadOption configures how a torrent is downloaded and written to disk
+type DownloadOption func(*downloadOptions)
+
+func newDownloadOptions(opts []DownloadOption) downloadOptions {
+	o := downloadOptions{fileMode: DefaultFileMode, dirMode: DefaultDirMode, random: rand.Reader, logger: logging.Default}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithFileMode sets the permission of the files created by the download.
+// The files the torrent marks executable also get the execute permission of
+// each class allowed to read them.
+func WithFileMode(mode os.FileMode) DownloadOption {
+	return func(o *downloadOptions) {
+		o.fileMode = mode
+	}
+}
+
+// WithDirMode sets the permission of the directories created by the download
+func WithDirMode(mode os.FileMode) DownloadOption {
+	return func(o *downloadOptions) {
+		o.dirMode = mode
+	}
+}
+
+// WithPeers downloads from the given peers only, without announcing to the
+// tracker. The download fails if those peers cannot deliver the whole torrent.
+func WithPeers(peers []peer.Peer) DownloadOption {
+	return func(o *downloadOptions) {
+		o.peers = peers
+	}
+}
+
+// WithRandom sets the source of randomness used to generate our peer ID.
+// Tests can use it to get a fixed peer ID.
+func WithRandom(r io.Reader) DownloadOption {
+	return func(o *downloadOptions) {
+		o.random = r
+	}
+}
+
+// WithVerifyOnWrite reads back and hashes every piece once written to the
+// file, downloading again those corrupted by the write
+func WithVerifyOnWrite() DownloadOption {
+	return func(o *downloadOptions) {
+		o.verify = true
+	}
+}
+
+// WithRecheck hashes the data already at the output path and keeps the intact
+// pieces, instead of trusting the resume file left by an interrupted download
+func WithRecheck() DownloadOption {
+	return func(o *downloadOptions) {
+		o.recheck = true
+	}
+}
+
+// WithSequential downloads the pieces in order, so that the file can be
+// played while downloading
+func WithSequential() DownloadOption {
+	return func(o *downloadOptions) {
+		o.sequential = true
+	}
+}
+
+// WithEncryption sets the encryption policy of the connections with peers
+func WithEncryption(policy client.EncryptionPolicy) DownloadOption {
+	return func(o *downloadOptions) {
+		o.encryption = policy
+	}
+}
+
+// WithDialer establishes the connections with the trackers, peers and web
+// seeds with d, e.g. a proxy.SOCKS5, instead of directly. UDP trackers and
+// the DHT are not used then, so that no traffic bypasses the dialer.
+func WithDialer(d client.Dialer) DownloadOption {
+	return func(o *downloadOptions) {
+		o.dialer = d
+	}
+}
+
+// WithBlocklist neither connects to nor accepts the peers blocked by b, such
+// as a blocklist.Blocklist, which can be changed while downloading
+func WithBlocklist(b p2p.Blocklist) DownloadOption {
+	return func(o *downloadOptions) {
+		o.blocklist = b
+	}
+}
+
+// WithMetrics updates m while downloading and seeding, such as a
+// metrics.Registry shared by several torrents
+func WithMetrics(m p2p.Metrics) DownloadOption {
+	return func(o *downloadOptions) {
+		o.metrics = m
+	}
+}
+
+// WithListener serves the peers connecting through a listener shared with
+// other torrents while downloading, and announces its port instead of Port
+func WithListener(l *p2p.PeerListener) DownloadOption {
+	return func(o *downloadOptions) {
+		o.listener = l
+	}
+}
+
+// WithDownloadLimiter limits the download bandwidth of the torrent. The
+// option can be given several times, e.g. with a limiter of the torrent and
+// one shared by all the torrents.
+func WithDownloadLimiter(l *client.Limiter) DownloadOption {
+	return func(o *downloadOptions) {
+		o.downloadLimiters = append(o.downloadLimiters, l)
+	}
+}
+
+// WithUploadLimiter limits the upload bandwidth of the torrent. The option
+// can be given several times, e.g. with a limiter of the torrent and one
+// shared by all the torrents.
+func WithUploadLimiter(l *client.Limiter) DownloadOption {
+	return func(o *downloadOptions) {
+		o.uploadLimiters = append(o.uploadLimiters, l)
+	}
+}
+
+// WithPeerID sets our peer ID instead of generating a random one, e.g. to
+// share it between the torrents of a session
+func WithPeerID(peerID [20]byte) DownloadOption {
+	return func(o *downloadOptions) {
+		o.peerID = &peerID
+	}
+}
+
+// WithConnLimit caps the number of connections with peers, with a limit
+// that can be shared with other torrents
+func WithConnLimit(l *p2p.ConnLimit) DownloadOption {
+	return func(o *downloadOptions) {
+		o.conns = l
+	}
+}
+
+// WithDialLimit caps the number of peers dialed at the same time, with a
+// limit that can be shared with other torrents
+func WithDialLimit(l *p2p.ConnLimit) DownloadOption {
+	return func(o *downloadOptions) {
+		o.dials = l
+	}
+}
+
+// WithDHT finds peers on the DHT besides the tracker while downloading.
+// Private torrents do not use it.
+func WithDHT(s *dht.Server) DownloadOption {
+	return func(o *downloadOptions) {
+		o.dht = s
+	}
+}
+
+// WithSeeding keeps seeding the torrent once downloaded, until the context
+// is done
+func WithSeeding() DownloadOption {
+	return func(o *downloadOptions) {
+		o.seed = true
+	}
+}
+
+// WithSeedRatio stops seeding once the share ratio of the torrent reaches
+// ratio, counting the traffic of the previous runs kept in the resume file
+func WithSeedRatio(ratio float64) DownloadOption {
+	return func(o *downloadOptions) {
+		o.seedRatio = ratio
+	}
+}
+
+// WithSeedIdleTimeout stops seeding once nothing was uploaded for d
+func WithSeedIdleTimeout(d time.Duration) DownloadOption {
+	return func(o *downloadOptions) {
+		o.seedIdleTimeout = d
+	}
+}
+
+// WithSuperSeeding seeds the torrent in initial-seeding mode once complete
+// (BEP 16), revealing its pieces to the peers one at a time, see
+// p2p.Torrent.SuperSeed
+func WithSuperSeeding() DownloadOption {
+	return func(o *downloadOptions) {
+		o.superSeed = true
+	}
+}
+
+// WithProgress calls fn with the statistics of the torrent every interval
+// while it is downloaded or seeded, and once more when it stops, e.g. to draw
+// a progress bar
+func WithProgress(interval time.Duration, fn func(p2p.Stats)) DownloadOption {
+	return func(o *downloadOptions) {
+		o.progress = fn
+		o.progressInterval = interval
+	}
+}
+
+// WithFilePriorities sets the priorities of the files of the torrent by
+// index, normal if missing. Skipped files are not created, unless they share
+// pieces with wanted files, which are then written to them. The download
+// returns once the wanted files are complete, and can be resumed with other
+// priorities.
+func WithFilePriorities(priorities ...p2p.Priority) DownloadOption {
+	return func(o *downloadOptions) {
+		o.filePriorities = priorities
+	}
+}
+
+// WithTorrentOptions tunes the download with options of the p2p package,
+// such as its timeouts or the number of peers connected
+func WithTorrentOptions(opts ...p2p.Option) DownloadOption {
+	return func(o *downloadOptions) {
+		o.torrentOptions = append(o.torrentOptions, opts...)
+	}
+}
+
+// WithTrackerStateDir keeps the last announce to the tracker in a file of dir
+// named after the info hash of the torrent, restored by the next downloads
+// even once the resume file is removed. The directory must exist.
+func WithTrackerStateDir(dir string) DownloadOption {
+	return func(o *downloadOptions) {
+		o.trackerStateDir = dir
+	}
+}
+
+// trackerStatePath returns the file of WithTrackerStateDir of a torrent, ""
+// without the option
+func (o downloadOptions) trackerStatePath(infoHash [20]byte) string {
+	if o.trackerStateDir == "" {
+		return ""
+	}
+	return filepath.Join(o.trackerStateDir, hex.EncodeToString(infoHash[:])+".tracker")
+}
+
+// WithLogger sets the logger of the download. Defaults to logging.Default.
+func WithLogger(l logging.Logger) DownloadOption {
+	return func(o *downloadOptions) {
+		o.logger = l
+	}
+}
+
+// GeneratePeerID returns a peer ID starting with peer.IDPrefix, which tells
+// peers and trackers the client and its version, followed by random bytes
+// read from r
+func GeneratePeerID(r io.Reader) ([20]byte, error) {
+	var peerID [20]byte
+	n := copy(peerID[:], peer.IDPrefix)
+	_, err := io.ReadFull(r, peerID[n:])
+	return peerID, err
+}
+
 // TorrentFile encodes the metadata from a .torrent file
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce string
+	// AnnounceList holds the tiers of trackers of the announce-list, if any,
+	// which are announced to instead of Announce
+	AnnounceList [][]string `json:",omitempty"`
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	// Private torrents only get peers from their trackers (BEP 27)
+	Private bool `json:",omitempty"`
+	// Files lists the files of a multi-file torrent in the order of the data,
+	// under the directory Name. Length is their total length.
+	Files []File `json:",omitempty"`
+	// URLList holds the URLs of the web seeds of the url-list (BEP 19)
+	URLList []string `json:",omitempty"`
+	// Comment, CreatedBy and CreationDate describe the torrent, and are
+	// empty when it does not tell
+	Comment      string `json:",omitempty"`
+	CreatedBy    string `json:",omitempty"`
+	CreationDate time.Time
+
+	tiers [][]string // shuffled tiers, reordered as trackers respond
+}
+
+// FromInfoHash returns a torrent known only by its info hash and tracker.
+// It can be announced, but not downloaded as the pieces are unknown.
+func FromInfoHash(announce string, infoHash [20]byte) TorrentFile {
+	return TorrentFile{Announce: announce, InfoHash: infoHash}
+}
+
+// File is a file of a multi-file torrent
+type File struct {
+	Length int
+	// Path is the path of the file under the directory of the torrent, one
+	// element per directory level
+	Path []string
+	// Padding marks a padding file (BEP 47), made of zeros aligning the next
+	// file on a piece boundary. Padding files are not written to disk.
+	Padding bool
+	// Executable marks a file created executable (BEP 47)
+	Executable bool
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	Attr   string   `bencode:"attr,omitempty"`
 }
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+	Private     int           `bencode:"private,omitempty"`
+
+	raw []byte // encoding the dictionary was decoded from
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce,omitempty"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	URLList      urlList     `bencode:"url-list,omitempty"`
+	Comment      string      `bencode:"comment,omitempty"`
+	CreatedBy    string      `bencode:"created by,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"`
+	Info         bencodeInfo `bencode:"info"`
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
-func (t *TorrentFile) DownloadToFile(path string) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
-	if err != nil {
-		return err
+// urlList is the url-list of a torrent, which is a string instead of a list
+// in the torrents of a single web seed
+type urlList []string
+
+// UnmarshalBencode decodes a list of URLs, or a single one
+func (l *urlList) UnmarshalBencode(data []byte) error {
+	var url string
+	if bencode.Unmarshal(data, &url) == nil {
+		*l = nil
+		if url != "" {
+			*l = urlList{url}
+		}
+		return nil
 	}
+	err := bencode.Unmarshal(data, (*[]string)(l))
+	if len(*l) == 0 {
+		*l = nil
+	}
+	return err
+}
 
-	peers, err := t.requestPeers(peerID, Port)
+// generatePeerID returns the peer ID set by WithPeerID, or a random one
+func (o downloadOptions) generatePeerID() ([20]byte, error) {
+	if o.peerID != nil {
+		return *o.peerID, nil
+	}
+	return GeneratePeerID(o.random)
+}
+
+// DownloadToFile downloads a torrent and writes each piece to a file as
+// soon as it is verified. The files of a multi-file torrent are created
+// under the directory path. The metadata of torrents opened from magnet links
+// is fetched from the peers first.
+//
+// The pieces written so far are recorded in a resume file next to path, so
+// that downloading the same torrent to the same path again after an
+// interruption only downloads the missing pieces. The files are recorded
+// too once the download stops: their pieces are hashed again at the next
+// run if they changed since, or if the process died before recording them.
+// The resume file is removed once the download completes, and kept if files
+// are skipped or if data was exchanged, which counts in the share ratio of
+// the next runs, along with the last announce to the tracker, also kept with
+// WithTrackerStateDir. The next run then starts from the peers the tracker
+// returned, and does not announce before the interval it asked for.
+//
+// The download stops when ctx is done, leaving the resume file behind. With
+// WithSeeding, the torrent is seeded once downloaded until ctx is done, as
+// its files are served with WithStreamServer. WithSeedRatio and
+// WithSeedIdleTimeout stop seeding earlier.
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string, opts ...DownloadOption) error {
+	o := newDownloadOptions(opts)
+	peerID, err := o.generatePeerID()
 	if err != nil {
 		return err
 	}
 
+	port := Port
+	if o.listener != nil {
+		port = o.listener.Port()
+	}
+
+	// The last announce of a previous run spares announcing again before the
+	// interval the tracker asked for, if it left peers to try meanwhile
+	var resume *resumeFile
+	var resumed bool
+	var trackerState tracker.State
+	if t.HasMetadata() {
+		resume, resumed, trackerState = t.loadResume(path, o)
+	}
+	fresh := len(trackerState.Peers) > 0 && trackerState.NextAnnounce().After(time.Now())
+
+	peers := o.peers
+	var announced *tracker.AnnounceResponse
+	if peers == nil && !fresh {
+		req := t.announceRequest(peerID)
+		req.Port = port
+		req.Event = tracker.EventStarted
+		req.Dialer = o.dialer
+		resp, err := t.announce(ctx, req)
+		if err != nil {
+			return err
+		}
+		peers, announced = resp.Peers, &resp
+	}
+
+	var clients []*client.Client
+	if !t.HasMetadata() {
+		metadataOpts := []client.Option{client.WithEncryption(o.encryption)}
+		if o.dialer != nil {
+			metadataOpts = append(metadataOpts, client.WithDialer(o.dialer))
+		}
+		c, err := t.fetchMetadata(ctx, peerID, peers, metadataOpts...)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, c)
+	}
+
 	torrent := p2p.Torrent{
-		Peers:       peers,
-		PeerId:      peerID,
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		Name:        t.Name,
-	}
-	buf, err := torrent.Download()
+		Peers:            peers,
+		PeerId:           peerID,
+		InfoHash:         t.InfoHash,
+		PieceHashes:      t.PieceHashes,
+		PieceLength:      t.PieceLength,
+		Length:           t.Length,
+		Name:             t.Name,
+		AnnounceURL:      t.Announce,
+		Port:             port,
+		Logger:           o.logger,
+		Incoming:         o.listener,
+		DownloadLimiters: o.downloadLimiters,
+		UploadLimiters:   o.uploadLimiters,
+		Clients:          clients,
+		PEX:              true,
+		Private:          t.Private,
+		VerifyOnWrite:    o.verify,
+		Sequential:       o.sequential,
+		Encryption:       o.encryption,
+		Dialer:           o.dialer,
+		Blocklist:        o.blocklist,
+		Conns:            o.conns,
+		Dials:            o.dials,
+		WebSeeds:         t.URLList,
+		WebFiles:         t.webFiles(),
+		FilePriorities:   o.filePriorities,
+		Metrics:          o.metrics,
+	}
+
+	if o.seed {
+		torrent.SeedRatio = o.seedRatio
+		torrent.SeedIdleTimeout = o.seedIdleTimeout
+		torrent.SuperSeed = o.superSeed
+	}
+	torrent.Apply(o.torrentOptions...)
+
+	if o.dht != nil && !t.Private && o.dialer == nil {
+		torrent.Discovery = &p2p.Discovery{
+			Sources:   []p2p.PeerSource{o.dht.PeerSource(t.InfoHash, port)},
+			Blocklist: o.blocklist,
+			Metrics:   o.metrics,
+		}
+	}
+
+	// The tracker is announced to again at the interval it asked for, and
+	// told about the download completing and stopping
+	if announced != nil {
+		torrent.Announced(*announced)
+	}
+
+	if resume == nil {
+		resume, resumed, trackerState = t.loadResume(path, o)
+	}
+	keep := t.filesExist(path, o.filePriorities) && (o.recheck || resumed)
+	// The files are hashed again unless they are the ones the pieces were
+	// recorded with
+	recheck := o.recheck || resumed && !resume.unchanged(t, path)
+	store, files, err := t.createStore(path, keep, o)
+	defer closeFiles(files)
 	if err != nil {
+		closeClients(clients)
 		return err
 	}
 
-	outFile, err := os.Create(path)
+	switch {
+	case keep && recheck:
+		torrent.VerifyStore(store)
+	case keep:
+		torrent.ResumeFrom(resume.bf)
+	}
+	resume.bf = torrent.Bitfield()
+	torrent.PastUploaded, torrent.PastDownloaded = resume.uploaded, resume.downloaded
+	if !trackerState.LastAnnounce.IsZero() {
+		torrent.RestoreTrackerState(trackerState)
+	}
+	torrent.OnPieceStored = func(index int) {
+		err := resume.set(index)
+		if err != nil {
+			o.logger.Log(logging.Warn, "could not save resume file", logging.F("err", err))
+		}
+	}
+
+	if o.progress != nil {
+		stop := reportProgress(&torrent, o.progressInterval, o.progress)
+		defer stop()
+	}
+	if o.stream != nil {
+		stop := t.serveStream(o.stream, &torrent)
+		defer stop()
+	}
+
+	if o.seed {
+		err = torrent.DownloadAndSeed(ctx, store)
+	} else {
+		err = torrent.Download(ctx, store)
+	}
+	// The skipped pieces are left for a download with other priorities, and
+	// the traffic is kept for the share ratio of the next runs
+	finishErr := resume.finish(t, path, torrent.Stats(), torrent.TrackerState())
+	if state, statePath := torrent.TrackerState(), o.trackerStatePath(t.InfoHash); statePath != "" && !state.LastAnnounce.IsZero() {
+		if err := state.SaveFile(statePath); err != nil {
+			o.logger.Log(logging.Warn, "could not save tracker state", logging.F("err", err))
+		}
+	}
 	if err != nil {
+		if finishErr != nil {
+			o.logger.Log(logging.Warn, "could not save resume file", logging.F("err", finishErr))
+		}
 		return err
 	}
-	defer outFile.Close()
+	err = finishErr
+	if err == nil && o.stream != nil {
+		// The files are still being watched
+		<-ctx.Done()
+	}
+	return err
+}
+
+// loadResume reads the resume file of the download to path, and returns it
+// along with whether it matches the torrent and the last announce to the
+// tracker, from the resume file or WithTrackerStateDir whichever is newer
+func (t *TorrentFile) loadResume(path string, o downloadOptions) (*resumeFile, bool, tracker.State) {
+	resume := newResumeFile(path, t.InfoHash, len(t.PieceHashes))
+	resumed := resume.load()
+	state := resume.tracker
+	if statePath := o.trackerStatePath(t.InfoHash); statePath != "" {
+		// A missing or broken state only costs an early announce
+		if saved, err := tracker.LoadStateFile(statePath); err == nil && saved.LastAnnounce.After(state.LastAnnounce) {
+			state = saved
+		}
+	}
+	return resume, resumed, state
+}
+
+// reportProgress calls fn with the statistics of the torrent every interval
+// until the returned function is called, which reports them a last time
+func reportProgress(torrent *p2p.Torrent, interval time.Duration, fn func(p2p.Stats)) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(torrent.Stats())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		fn(torrent.Stats())
+	}
+}
+
+// webFiles returns the files of a multi-file torrent for its web seeds
+func (t *TorrentFile) webFiles() []p2p.WebFile {
+	var files []p2p.WebFile
+	for _, f := range t.Files {
+		files = append(files, p2p.WebFile{Path: f.Path, Length: int64(f.Length), Padding: f.Padding})
+	}
+	return files
+}
+
+// createStore creates the file of the torrent at path, or the files of a
+// multi-file torrent under the directory path, at their final size. The data
+// of existing files is kept if keep is set. Skipped files are only created
+// once written to, and padding files never are.
+func (t *TorrentFile) createStore(path string, keep bool, o downloadOptions) (p2p.Store, []io.Closer, error) {
+	if len(t.Files) == 0 {
+		if skipped(o.filePriorities, 0) {
+			lazy := &lazyFile{path: path, keep: keep, o: o}
+			return lazy, []io.Closer{lazy}, nil
+		}
+		outFile, err := createFile(path, keep, o.fileMode, o)
+		if err != nil {
+			return nil, nil, err
+		}
+		return outFile, []io.Closer{outFile}, outFile.Truncate(int64(t.Length))
+	}
+
+	var store p2p.MultiStore
+	var files []io.Closer
+	for i, f := range t.Files {
+		if f.Padding {
+			store = append(store, p2p.FileStore{Store: p2p.PaddingStore{}, Length: int64(f.Length)})
+			continue
+		}
+		filePath := filepath.Join(append([]string{path}, f.Path...)...)
+		if skipped(o.filePriorities, i) {
+			lazy := &lazyFile{path: filePath, keep: keep, executable: f.Executable, o: o}
+			files = append(files, lazy)
+			store = append(store, p2p.FileStore{Store: lazy, Length: int64(f.Length)})
+			continue
+		}
+		outFile, err := createFile(filePath, keep, o.modeFor(f.Executable), o)
+		if err != nil {
+			return nil, files, err
+		}
+		files = append(files, outFile)
+		err = outFile.Truncate(int64(f.Length))
+		if err != nil {
+			return nil, files, err
+		}
+		store = append(store, p2p.FileStore{Store: outFile, Length: int64(f.Length)})
+	}
+	return store, files, nil
+}
+
+func closeFiles(files []io.Closer) {
+	for _, f := range files {
+		f.Close()
+	}
+}
 
-	_, err = outFile.Write(buf)
+func closeClients(clients []*client.Client) {
+	for _, c := range clients {
+		c.Conn.Close()
+	}
+}
+
+// modeFor returns the permission of a file created by the download, which
+// gets the execute permission of each class allowed to read it if executable
+func (o downloadOptions) modeFor(executable bool) os.FileMode {
+	if executable {
+		return o.fileMode | (o.fileMode&0444)>>2
+	}
+	return o.fileMode
+}
+
+// createFile creates an empty file at path with the permission mode,
+// creating missing parent directories. An existing file is truncated, unless
+// keep is set. Modes are applied explicitly so they are not altered by the
+// process umask.
+func createFile(path string, keep bool, mode os.FileMode, o downloadOptions) (*os.File, error) {
+	err := createDirs(filepath.Dir(path), o.dirMode)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if keep {
+		flag &^= os.O_TRUNC
+	}
+	outFile, err := os.OpenFile(path, flag, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = outFile.Chmod(mode)
+	if err != nil {
+		outFile.Close()
+		return nil, err
 	}
 
+	return outFile, nil
+}
+
+// createDirs creates the directory dir and its missing parents with the
+// permission mode. Each directory created is chmodded, as MkdirAll applies
+// the umask.
+func createDirs(dir string, mode os.FileMode) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(dir, mode)
+	if err != nil {
+		return err
+	}
+	for _, d := range missing {
+		err = os.Chmod(d, mode)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Open parses a torrent file
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer file.Close()
+	return Parse(buf)
+}
 
+// Parse parses the content of a torrent file
+func Parse(buf []byte) (TorrentFile, error) {
 	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err := bencode.Unmarshal(buf, &bto)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	return bto.toTorrentFile()
 }
 
+// UnmarshalBencode decodes an info dictionary, keeping its encoding to hash it
+func (i *bencodeInfo) UnmarshalBencode(data []byte) error {
+	type info bencodeInfo // without this method
+	err := bencode.Unmarshal(data, (*info)(i))
+	if err != nil {
+		return err
+	}
+	i.raw = append([]byte(nil), data...)
+	return nil
+}
+
+// hash returns the info hash. The info dictionary of a decoded torrent is
+// hashed as it was encoded, since it may hold fields bencodeInfo leaves out.
 func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
+	if i.raw != nil {
+		return sha1.Sum(i.raw), nil
+	}
+	buf, err := bencode.Marshal(*i)
 	if err != nil {
 		return [20]byte{}, err
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	return sha1.Sum(buf), nil
 }
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -119,21 +841,97 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
+// parse checks the info dictionary, and returns the piece hashes, the files
+// of a multi-file torrent and the total length of the torrent. There must be
+// one piece hash for each piece of the torrent.
+func (i *bencodeInfo) parse() ([][20]byte, []File, int, error) {
+	pieceHashes, err := i.splitPieceHashes()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	files, length, err := i.files()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if !SafeName(i.Name) {
+		return nil, nil, 0, fmt.Errorf("unsafe name %q", i.Name)
+	}
+	if i.PieceLength <= 0 {
+		return nil, nil, 0, fmt.Errorf("invalid piece length %d", i.PieceLength)
+	}
+	if length < 0 {
+		return nil, nil, 0, fmt.Errorf("invalid length %d", length)
+	}
+	pieces := length / i.PieceLength
+	if length%i.PieceLength != 0 {
+		pieces++
+	}
+	if len(pieceHashes) != pieces {
+		return nil, nil, 0, fmt.Errorf("%d piece hashes for %d pieces", len(pieceHashes), pieces)
+	}
+	return pieceHashes, files, length, nil
+}
+
+// SafeName tells whether name is a single path element, so that the data of
+// a torrent stored under it stays in the directory it is downloaded to
+func SafeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// files returns the files of a multi-file torrent and the total length of
+// the torrent. File paths must stay under the directory of the torrent.
+func (i *bencodeInfo) files() ([]File, int, error) {
+	if len(i.Files) == 0 {
+		return nil, i.Length, nil
+	}
+	files := make([]File, len(i.Files))
+	length := 0
+	for index, f := range i.Files {
+		if len(f.Path) == 0 || f.Length < 0 {
+			return nil, 0, fmt.Errorf("malformed file #%d", index)
+		}
+		for _, elem := range f.Path {
+			if !SafeName(elem) {
+				return nil, 0, fmt.Errorf("unsafe path %q for file #%d", f.Path, index)
+			}
+		}
+		files[index] = File{
+			Length:     f.Length,
+			Path:       f.Path,
+			Padding:    strings.ContainsRune(f.Attr, 'p'),
+			Executable: strings.ContainsRune(f.Attr, 'x'),
+		}
+		length += f.Length
+	}
+	return files, length, nil
+}
+
 func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 	infoHash, err := bto.Info.hash()
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	pieceHashes, err := bto.Info.splitPieceHashes()
+	pieceHashes, files, length, err := bto.Info.parse()
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	var created time.Time
+	if bto.CreationDate > 0 {
+		created = time.Unix(bto.CreationDate, 0).UTC()
+	}
 	return TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: bto.AnnounceList,
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       length,
+		Name:         bto.Info.Name,
+		Private:      bto.Info.Private == 1,
+		Files:        files,
+		URLList:      []string(bto.URLList),
+		Comment:      bto.Comment,
+		CreatedBy:    bto.CreatedBy,
+		CreationDate: created,
 	}, nil
 }
@@ -1,11 +1,17 @@
 package torrentfile
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -44,36 +50,199 @@ func TestToTorrentFile(t *testing.T) {
 				Info: bencodeInfo{
 					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
 					PieceLength: 262144,
-					Length:      351272960,
+					Length:      500000,
 					Name:        "debian-10.2.0-amd64-netinst.iso",
 				},
 			},
 			output: TorrentFile{
 				Announce: "http://bttracker.debian.org:6969/announce",
-				InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+				InfoHash: [20]byte{118, 74, 22, 33, 122, 197, 89, 183, 211, 120, 105, 40, 47, 226, 227, 200, 125, 172, 29, 216},
 				PieceHashes: [][20]byte{
 					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
 					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
 				},
 				PieceLength: 262144,
-				Length:      351272960,
+				Length:      500000,
 				Name:        "debian-10.2.0-amd64-netinst.iso",
 			},
 			fails: false,
 		},
+		"private torrent": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 262144,
+					Length:      500000,
+					Name:        "debian-10.2.0-amd64-netinst.iso",
+					Private:     1,
+				},
+			},
+			output: TorrentFile{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				InfoHash: [20]byte{4, 151, 143, 83, 1, 241, 25, 149, 240, 108, 54, 23, 109, 4, 57, 21, 226, 254, 170, 20},
+				PieceHashes: [][20]byte{
+					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
+					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
+				},
+				PieceLength: 262144,
+				Length:      500000,
+				Name:        "debian-10.2.0-amd64-netinst.iso",
+				Private:     true,
+			},
+			fails: false,
+		},
+		"multi-file torrent": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 200,
+					Files: []bencodeFile{
+						{Length: 100, Path: []string{"a.txt"}},
+						{Length: 200, Path: []string{"sub", "b.txt"}},
+					},
+					Name: "dir",
+				},
+			},
+			output: TorrentFile{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				InfoHash: [20]byte{146, 81, 0, 119, 211, 58, 17, 77, 186, 175, 240, 41, 123, 153, 8, 176, 57, 210, 13, 183},
+				PieceHashes: [][20]byte{
+					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
+					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
+				},
+				PieceLength: 200,
+				Length:      300,
+				Name:        "dir",
+				Files: []File{
+					{Length: 100, Path: []string{"a.txt"}},
+					{Length: 200, Path: []string{"sub", "b.txt"}},
+				},
+			},
+			fails: false,
+		},
+		"padding file": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 262144,
+					Files: []bencodeFile{
+						{Length: 100, Path: []string{"a.txt"}},
+						{Length: 262044, Path: []string{".pad", "262044"}, Attr: "p"},
+						{Length: 200, Path: []string{"b.txt"}},
+					},
+					Name: "dir",
+				},
+			},
+			output: TorrentFile{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				InfoHash: [20]byte{132, 207, 229, 92, 233, 3, 30, 51, 117, 244, 90, 3, 19, 236, 61, 67, 138, 132, 117, 161},
+				PieceHashes: [][20]byte{
+					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
+					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
+				},
+				PieceLength: 262144,
+				Length:      262344,
+				Name:        "dir",
+				Files: []File{
+					{Length: 100, Path: []string{"a.txt"}},
+					{Length: 262044, Path: []string{".pad", "262044"}, Padding: true},
+					{Length: 200, Path: []string{"b.txt"}},
+				},
+			},
+			fails: false,
+		},
+		"unsafe file path": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 262144,
+					Files:       []bencodeFile{{Length: 100, Path: []string{"..", "etc", "passwd"}}},
+					Name:        "dir",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"unsafe name": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 262144,
+					Length:      500000,
+					Name:        "../../.bashrc",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"empty name": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 262144,
+					Length:      500000,
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
 		"not enough bytes in pieces": {
 			input: &bencodeTorrent{
 				Announce: "http://bttracker.debian.org:6969/announce",
 				Info: bencodeInfo{
 					Pieces:      "1234567890abcdefghijabcdef", // Only 26 bytes
 					PieceLength: 262144,
-					Length:      351272960,
+					Length:      500000,
 					Name:        "debian-10.2.0-amd64-netinst.iso",
 				},
 			},
 			output: TorrentFile{},
 			fails:  true,
 		},
+		"zero piece length": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces: "1234567890abcdefghij",
+					Length: 1000,
+					Name:   "file",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"missing piece hashes": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghij",
+					PieceLength: 262144,
+					Length:      262145,
+					Name:        "file",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
+		"extra piece hashes": {
+			input: &bencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
+					PieceLength: 262144,
+					Length:      1000,
+					Name:        "file",
+				},
+			},
+			output: TorrentFile{},
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
@@ -86,3 +255,229 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestOpenAnnounceList(t *testing.T) {
+	bto := bencodeTorrent{
+		Announce: "http://tracker.example.com/announce",
+		AnnounceList: [][]string{
+			{"http://tracker.example.com/announce", "udp://backup.example.com:6969"},
+			{"http://other.example.com/announce"},
+		},
+		Info: bencodeInfo{Pieces: "1234567890abcdefghij", PieceLength: 262144, Length: 1000, Name: "file"},
+	}
+	buf, err := bencode.Marshal(bto)
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "file.torrent")
+	require.Nil(t, ioutil.WriteFile(path, buf, 0644))
+
+	tf, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, bto.AnnounceList, tf.AnnounceList)
+	assert.Equal(t, bto.AnnounceList, tf.Trackers())
+
+	tf.AnnounceList = nil
+	assert.Equal(t, [][]string{{"http://tracker.example.com/announce"}}, tf.Trackers())
+}
+
+func TestOpenInfoHash(t *testing.T) {
+	// the info dictionary holds a field unknown to bencodeInfo
+	info := []byte("d6:lengthi1000e4:name4:file12:piece lengthi262144e6:pieces20:1234567890abcdefghij6:source4:teame")
+	buf, err := bencode.Marshal(struct {
+		Announce string             `bencode:"announce"`
+		Info     bencode.RawMessage `bencode:"info"`
+	}{"http://tracker.example.com/announce", info})
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "file.torrent")
+	require.Nil(t, ioutil.WriteFile(path, buf, 0644))
+
+	tf, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, sha1.Sum(info), tf.InfoHash)
+	assert.Equal(t, "file", tf.Name)
+	assert.Equal(t, 1000, tf.Length)
+}
+
+func TestCreateFile(t *testing.T) {
+	tests := map[string]struct {
+		opts       []DownloadOption
+		executable bool
+		fileMode   os.FileMode
+		dirMode    os.FileMode
+	}{
+		"default modes": {
+			opts:     nil,
+			fileMode: DefaultFileMode,
+			dirMode:  DefaultDirMode,
+		},
+		"configured modes": {
+			opts:     []DownloadOption{WithFileMode(0600), WithDirMode(0700)},
+			fileMode: 0600,
+			dirMode:  0700,
+		},
+		"group writable modes": {
+			opts:     []DownloadOption{WithFileMode(0664), WithDirMode(0775)},
+			fileMode: 0664,
+			dirMode:  0775,
+		},
+		"executable": {
+			opts:       []DownloadOption{WithFileMode(0640)},
+			executable: true,
+			fileMode:   0750,
+			dirMode:    DefaultDirMode,
+		},
+	}
+
+	for name, test := range tests {
+		out := filepath.Join(t.TempDir(), "out")
+		dir := filepath.Join(out, "sub")
+		path := filepath.Join(dir, "file.iso")
+
+		o := newDownloadOptions(test.opts)
+		f, err := createFile(path, false, o.modeFor(test.executable), o)
+		require.Nil(t, err, name)
+		_, err = f.WriteAt([]byte{1, 2, 3}, 0)
+		require.Nil(t, err, name)
+		require.Nil(t, f.Close(), name)
+
+		info, err := os.Stat(path)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.fileMode, info.Mode().Perm(), name)
+
+		// Every directory created gets the mode, not only the parent
+		for _, d := range []string{out, dir} {
+			info, err = os.Stat(d)
+			require.Nil(t, err, name)
+			assert.Equal(t, test.dirMode, info.Mode().Perm(), name)
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, buf)
+	}
+}
+
+func TestCreateStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	torrent := TorrentFile{
+		Length: 5,
+		Files: []File{
+			{Length: 2, Path: []string{"a.txt"}},
+			{Length: 3, Path: []string{"sub", "b.txt"}},
+		},
+	}
+
+	store, files, err := torrent.createStore(dir, false, newDownloadOptions(nil))
+	require.Nil(t, err)
+	_, err = store.WriteAt([]byte{1, 2, 3, 4, 5}, 0)
+	require.Nil(t, err)
+	closeFiles(files)
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{1, 2}, buf)
+	buf, err = ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{3, 4, 5}, buf)
+}
+
+func TestCreateStorePadding(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	torrent := TorrentFile{
+		Length: 6,
+		Files: []File{
+			{Length: 2, Path: []string{"a.txt"}},
+			{Length: 2, Path: []string{".pad", "2"}, Padding: true},
+			{Length: 2, Path: []string{"b.txt"}},
+		},
+	}
+
+	store, files, err := torrent.createStore(dir, false, newDownloadOptions(nil))
+	require.Nil(t, err)
+	_, err = store.WriteAt([]byte{1, 2, 0, 0, 5, 6}, 0)
+	require.Nil(t, err)
+	buf := make([]byte, 6)
+	_, err = store.ReadAt(buf, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 0, 0, 5, 6}, buf)
+	closeFiles(files)
+
+	_, err = os.Stat(filepath.Join(dir, ".pad"))
+	assert.True(t, os.IsNotExist(err))
+	buf, err = ioutil.ReadFile(filepath.Join(dir, "b.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{5, 6}, buf)
+	assert.True(t, torrent.filesExist(dir, nil))
+}
+
+func TestGeneratePeerID(t *testing.T) {
+	seed := bytes.Repeat([]byte{42}, 32)
+	first, err := GeneratePeerID(bytes.NewReader(seed))
+	require.Nil(t, err)
+	second, err := GeneratePeerID(bytes.NewReader(seed))
+	require.Nil(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, [20]byte{'-', 'L', 'H', '0', '1', '0', '0', '-', 42, 42, 42, 42, 42, 42, 42, 42, 42, 42, 42, 42}, first)
+	name, version := peer.Identify(first)
+	assert.Equal(t, peer.ClientName, name)
+	assert.Equal(t, "0.1.0.0", version)
+
+	_, err = GeneratePeerID(bytes.NewReader(seed[:10]))
+	assert.NotNil(t, err)
+}
+
+func TestWithPeerID(t *testing.T) {
+	o := newDownloadOptions([]DownloadOption{WithRandom(bytes.NewReader(nil)), WithPeerID([20]byte{1, 2})})
+	peerID, err := o.generatePeerID()
+	require.Nil(t, err)
+	assert.Equal(t, [20]byte{1, 2}, peerID)
+
+	_, err = newDownloadOptions([]DownloadOption{WithRandom(bytes.NewReader(nil))}).generatePeerID()
+	assert.NotNil(t, err)
+}
+
+func TestFromInfoHash(t *testing.T) {
+	infoHash := [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+	tf := FromInfoHash("http://bttracker.debian.org:6969/announce", infoHash)
+	assert.Equal(t, infoHash, tf.InfoHash)
+	assert.Equal(t, "http://bttracker.debian.org:6969/announce", tf.Announce)
+}
+
+func TestOpenURLList(t *testing.T) {
+	info := bencodeInfo{Pieces: "1234567890abcdefghij", PieceLength: 262144, Length: 1000, Name: "file"}
+	tests := map[string]struct {
+		input  interface{}
+		output []string
+	}{
+		"list of web seeds": {
+			input: bencodeTorrent{
+				Announce: "http://tracker.example.com/announce",
+				URLList:  []string{"http://a.example.com/", "http://b.example.com/file"},
+				Info:     info,
+			},
+			output: []string{"http://a.example.com/", "http://b.example.com/file"},
+		},
+		"single web seed": {
+			input: struct {
+				Announce string      `bencode:"announce"`
+				URLList  string      `bencode:"url-list"`
+				Info     bencodeInfo `bencode:"info"`
+			}{"http://tracker.example.com/announce", "http://a.example.com/", info},
+			output: []string{"http://a.example.com/"},
+		},
+		"no web seed": {
+			input:  bencodeTorrent{Announce: "http://tracker.example.com/announce", Info: info},
+			output: nil,
+		},
+	}
+
+	for name, test := range tests {
+		buf, err := bencode.Marshal(test.input)
+		require.Nil(t, err, name)
+		path := filepath.Join(t.TempDir(), "file.torrent")
+		require.Nil(t, ioutil.WriteFile(path, buf, 0644))
+
+		tf, err := Open(path)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, tf.URLList, name)
+	}
+}
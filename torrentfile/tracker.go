@@ -1,56 +1,144 @@
 package torrentfile
 
 import (
-	"net/http"
-	"net/url"
-	"strconv"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"time"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/leonhfr/torrent-client/p2p"
 	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
 )
 
-type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+func (t *TorrentFile) announceRequest(peerID [20]byte) tracker.AnnounceRequest {
+	return tracker.AnnounceRequest{
+		InfoHash: t.InfoHash,
+		PeerID:   peerID,
+		Port:     Port,
+		Left:     t.Length,
+	}
 }
 
 func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(t.Announce)
-	if err != nil {
-		return "", err
+	return tracker.BuildURL(t.Announce, t.announceRequest(peerID))
+}
+
+// Trackers returns the tiers of trackers of the torrent, from the
+// announce-list if any or else the announce URL
+func (t *TorrentFile) Trackers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
 	}
-	params := url.Values{
-		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(Port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+	if t.Announce == "" {
+		return nil
 	}
-	base.RawQuery = params.Encode()
-	return base.String(), nil
+	return [][]string{{t.Announce}}
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peer.Peer, error) {
-	url, err := t.buildTrackerURL(peerID, port)
-	if err != nil {
-		return nil, err
+// announce announces to the tiers of trackers in order and merges the swarm
+// information they return. As specified by BEP 12, the trackers of each tier
+// are shuffled once and tried in order until one responds, which is then
+// moved first in its tier.
+func (t *TorrentFile) announce(ctx context.Context, req tracker.AnnounceRequest) (tracker.AnnounceResponse, error) {
+	if t.tiers == nil {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for _, tier := range t.Trackers() {
+			tier = append([]string(nil), tier...)
+			random.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+			t.tiers = append(t.tiers, tier)
+		}
 	}
 
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
-	if err != nil {
-		return nil, err
+	var merged tracker.AnnounceResponse
+	var lastErr error
+	responded := 0
+	known := make(map[string]bool)
+	for _, tier := range t.tiers {
+		for i, url := range tier {
+			resp, err := tracker.Announce(ctx, url, req)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = url
+
+			if responded == 0 {
+				merged = resp
+				merged.Peers = nil
+			}
+			if resp.Interval > 0 && (merged.Interval <= 0 || resp.Interval < merged.Interval) {
+				merged.Interval = resp.Interval
+			}
+			if resp.MinInterval > merged.MinInterval {
+				merged.MinInterval = resp.MinInterval
+			}
+			if resp.Complete > merged.Complete {
+				merged.Complete = resp.Complete
+			}
+			if resp.Incomplete > merged.Incomplete {
+				merged.Incomplete = resp.Incomplete
+			}
+			for _, p := range resp.Peers {
+				if !known[p.String()] {
+					known[p.String()] = true
+					merged.Peers = append(merged.Peers, p)
+				}
+			}
+			responded++
+			break
+		}
+	}
+
+	if responded == 0 {
+		if lastErr == nil {
+			return tracker.AnnounceResponse{}, errors.New("torrent has no tracker")
+		}
+		return tracker.AnnounceResponse{}, fmt.Errorf("no tracker responded: %w", lastErr)
 	}
-	defer resp.Body.Close()
+	return merged, nil
+}
 
-	trackerResp := bencodeTrackerResp{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+// AnnounceTracker announces the torrent to its trackers and returns the swarm
+// information. The announce is abandoned when ctx is done.
+func (t *TorrentFile) AnnounceTracker(ctx context.Context, peerID [20]byte, port uint16) (tracker.AnnounceResponse, error) {
+	return t.announce(ctx, t.announceRequest(peerID))
+}
+
+func (t *TorrentFile) requestPeers(ctx context.Context, peerID [20]byte, port uint16) ([]peer.Peer, error) {
+	resp, err := t.AnnounceTracker(ctx, peerID, port)
 	if err != nil {
 		return nil, err
 	}
+	return resp.Peers, nil
+}
+
+type trackerSource struct {
+	t      *TorrentFile
+	peerID [20]byte
+	port   uint16
+}
+
+// PeerSource returns the trackers of the torrent as a source of peers,
+// to be announced to at the interval they request
+func (t *TorrentFile) PeerSource(peerID [20]byte, port uint16) p2p.PeerSource {
+	return trackerSource{t, peerID, port}
+}
 
-	return peer.Unmarshal([]byte(trackerResp.Peers))
+func (s trackerSource) Name() string {
+	return "tracker"
+}
+
+func (s trackerSource) Tracker() bool {
+	return true
+}
+
+func (s trackerSource) Discover(ctx context.Context) ([]peer.Peer, time.Duration, error) {
+	resp, err := s.t.announce(ctx, s.t.announceRequest(s.peerID))
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Peers, time.Duration(resp.Interval) * time.Second, nil
 }
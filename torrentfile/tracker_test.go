@@ -1,13 +1,22 @@
 package torrentfile
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/leonhfr/torrent-client/peer"
+	"github.com/leonhfr/torrent-client/tracker"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBuildTrackerURL(t *testing.T) {
@@ -60,7 +69,131 @@ func TestRequestPeers(t *testing.T) {
 		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
 	}
-	p, err := tf.requestPeers(peerID, port)
+	p, err := tf.requestPeers(context.Background(), peerID, port)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, p)
 }
+
+func TestAnnounceTracker(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := []byte(
+			"d" +
+				"8:complete" + "i12e" +
+				"10:incomplete" + "i34e" +
+				"8:interval" + "i900e" +
+				"5:peers" + "6:" +
+				string([]byte{
+					192, 0, 2, 123, 0x1A, 0xE1, // 0x1AE1 = 6881
+				}) + "e")
+		w.Write(response)
+	}))
+	defer ts.Close()
+	tf := TorrentFile{
+		Announce:    ts.URL,
+		InfoHash:    [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		PieceLength: 262144,
+		Length:      351272960,
+		Name:        "debian-10.2.0-amd64-netinst.iso",
+	}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	expected := tracker.AnnounceResponse{
+		Interval:   900,
+		Peers:      []peer.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}},
+		Complete:   12,
+		Incomplete: 34,
+	}
+	resp, err := tf.AnnounceTracker(context.Background(), peerID, Port)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, resp)
+}
+
+// newTestTracker serves an announce response with the given interval and peers
+func newTestTracker(t *testing.T, interval int, peers []peer.Peer) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compact := peer.Marshal(peers)
+		fmt.Fprintf(w, "d8:intervali%de5:peers%d:%se", interval, len(compact), compact)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	shared := peer.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}
+	first := newTestTracker(t, 900, []peer.Peer{shared, {IP: net.IP{192, 0, 2, 2}, Port: 6881}})
+	second := newTestTracker(t, 600, []peer.Peer{shared, {IP: net.IP{192, 0, 2, 3}, Port: 6881}})
+	dead := newTestTracker(t, 0, nil)
+	dead.Close()
+
+	tf := TorrentFile{
+		Announce:     dead.URL,
+		AnnounceList: [][]string{{dead.URL, first.URL}, {second.URL}},
+	}
+	resp, err := tf.AnnounceTracker(context.Background(), [20]byte{}, Port)
+	require.Nil(t, err)
+	assert.Equal(t, 600, resp.Interval)
+	assert.Equal(t, []peer.Peer{
+		shared,
+		{IP: net.IP{192, 0, 2, 2}, Port: 6881},
+		{IP: net.IP{192, 0, 2, 3}, Port: 6881},
+	}, resp.Peers)
+	// The tracker that responded is tried first next time
+	assert.Equal(t, [][]string{{first.URL, dead.URL}, {second.URL}}, tf.tiers)
+	assert.Equal(t, [][]string{{dead.URL, first.URL}, {second.URL}}, tf.AnnounceList)
+}
+
+func TestAnnounceTiersFail(t *testing.T) {
+	dead := newTestTracker(t, 0, nil)
+	dead.Close()
+
+	tf := TorrentFile{AnnounceList: [][]string{{dead.URL}, {dead.URL + "/other"}}}
+	_, err := tf.AnnounceTracker(context.Background(), [20]byte{}, Port)
+	assert.NotNil(t, err)
+
+	tf = TorrentFile{}
+	_, err = tf.AnnounceTracker(context.Background(), [20]byte{}, Port)
+	assert.NotNil(t, err)
+}
+
+// trackerDialer connects to the test tracker whatever the address dialed,
+// as a proxy would, recording the addresses dialed
+type trackerDialer struct {
+	to     string
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *trackerDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mu.Unlock()
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, d.to)
+}
+
+func TestDownloadToFileDialer(t *testing.T) {
+	ts := newTestTracker(t, 900, nil)
+	content := []byte("proxied download")
+	torrent := completeTorrent(content)
+	torrent.Announce = "http://tracker.example.com/announce"
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+
+	// The tracker is only reachable through the dialer
+	d := &trackerDialer{to: ts.Listener.Addr().String()}
+	err := torrent.DownloadToFile(context.Background(), path, WithDialer(d), WithRecheck(), WithRandom(bytes.NewReader(make([]byte, 20))))
+	require.Nil(t, err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	assert.Contains(t, d.dialed, "tracker.example.com:80")
+}
+
+func TestDownloadToFileDialerUDP(t *testing.T) {
+	torrent := completeTorrent([]byte("proxied download"))
+	torrent.Announce = "udp://127.0.0.1:6969"
+	path := filepath.Join(t.TempDir(), "file")
+
+	d := &trackerDialer{to: "127.0.0.1:1"}
+	err := torrent.DownloadToFile(context.Background(), path, WithDialer(d), WithRandom(bytes.NewReader(make([]byte, 20))))
+	assert.True(t, errors.Is(err, tracker.ErrUDPDialer))
+	assert.Empty(t, d.dialed)
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package torrentfile
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateFileUmask(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(077))
+	out := filepath.Join(t.TempDir(), "out")
+	dir := filepath.Join(out, "sub")
+	path := filepath.Join(dir, "file.iso")
+
+	o := newDownloadOptions([]DownloadOption{WithFileMode(0664), WithDirMode(0775)})
+	f, err := createFile(path, false, o.modeFor(false), o)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	for _, d := range []string{out, dir} {
+		info, err := os.Stat(d)
+		require.Nil(t, err)
+		assert.Equal(t, os.FileMode(0775), info.Mode().Perm(), d)
+	}
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0664), info.Mode().Perm())
+}
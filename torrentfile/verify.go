@@ -0,0 +1,100 @@
+package torrentfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/p2p"
+)
+
+// Verify hashes the data of the torrent at path, the file of the torrent or
+// the directory of a multi-file torrent, and returns the pieces that are
+// intact. Missing or truncated files only make their pieces missing, and
+// padding files are zeros whether they exist or not. The data is never
+// written to. It returns ctx.Err() if ctx is done before the end.
+func (t *TorrentFile) Verify(ctx context.Context, path string) (bitfield.Bitfield, error) {
+	var store p2p.Store
+	if len(t.Files) == 0 {
+		f, err := openVerified(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		store = f
+	} else {
+		var multi p2p.MultiStore
+		for _, file := range t.Files {
+			if file.Padding {
+				multi = append(multi, p2p.FileStore{Store: p2p.PaddingStore{}, Length: int64(file.Length)})
+				continue
+			}
+			f, err := openVerified(filepath.Join(append([]string{path}, file.Path...)...))
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			multi = append(multi, p2p.FileStore{Store: f, Length: int64(file.Length)})
+		}
+		store = multi
+	}
+
+	torrent := p2p.Torrent{
+		PieceHashes: t.PieceHashes,
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+	}
+	torrent.SetStore(store)
+	if _, err := torrent.Verify(ctx); err != nil {
+		return nil, err
+	}
+	return torrent.Bitfield(), nil
+}
+
+// Recheck hashes the data of the torrent at path like Verify, and records
+// the intact pieces in the resume file along with the files, so that the
+// next download to path trusts them without hashing them again. The traffic
+// and last announce recorded by the previous runs are kept. The torrent must
+// not be downloading to path meanwhile.
+func (t *TorrentFile) Recheck(ctx context.Context, path string) (bitfield.Bitfield, error) {
+	bf, err := t.Verify(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	resume := newResumeFile(path, t.InfoHash, len(t.PieceHashes))
+	resume.load()
+	resume.bf = bf
+	resume.files = t.fileStats(path)
+	if err := resume.save(); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+// missingFile stands for a file of the torrent that does not exist, from
+// which nothing can be read
+type missingFile struct{}
+
+func (missingFile) ReadAt([]byte, int64) (int, error)  { return 0, os.ErrNotExist }
+func (missingFile) WriteAt([]byte, int64) (int, error) { return 0, os.ErrNotExist }
+func (missingFile) Close() error                       { return nil }
+
+// verifiedFile is a file opened for reading by Verify
+type verifiedFile interface {
+	p2p.Store
+	Close() error
+}
+
+// openVerified opens the file at path read-only, or returns a missingFile if
+// there is none
+func openVerified(path string) (verifiedFile, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return missingFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
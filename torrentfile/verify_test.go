@@ -0,0 +1,129 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/bitfield"
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+	require.Nil(t, os.Mkdir(dir, 0755))
+	a := make([]byte, 40*1024)
+	for i := range a {
+		a[i] = byte(i * 3)
+	}
+	b := make([]byte, 30*1024)
+	for i := range b {
+		b[i] = byte(i * 5)
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.bin"), a, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.bin"), b, 0644))
+
+	// Pieces 0 and 1 are in a.bin, 2 spans both files, 3 and 4 are in b.bin
+	tf, err := Create(dir, WithPieceLength(16*1024))
+	require.Nil(t, err)
+	require.Len(t, tf.PieceHashes, 5)
+
+	bf, err := tf.Verify(context.Background(), dir)
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0xf8}, bf)
+
+	a[0]++
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.bin"), a, 0644))
+	bf, err = tf.Verify(context.Background(), dir)
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0x78}, bf)
+
+	require.Nil(t, os.Remove(filepath.Join(dir, "b.bin")))
+	bf, err = tf.Verify(context.Background(), dir)
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0x40}, bf)
+
+	bf, err = tf.Verify(context.Background(), filepath.Join(t.TempDir(), "missing"))
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0x00}, bf)
+}
+
+func TestVerifyPadding(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+	require.Nil(t, os.Mkdir(dir, 0755))
+	a := []byte{1, 2, 3}
+	b := []byte{4, 5, 6, 7}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.bin"), a, 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.bin"), b, 0644))
+
+	// The padding file aligns b.bin on the second piece and is not on disk
+	tf := TorrentFile{
+		PieceHashes: [][20]byte{sha1.Sum([]byte{1, 2, 3, 0}), sha1.Sum(b)},
+		PieceLength: 4,
+		Length:      8,
+		Files: []File{
+			{Length: 3, Path: []string{"a.bin"}},
+			{Length: 1, Path: []string{".pad", "1"}, Padding: true},
+			{Length: 4, Path: []string{"b.bin"}},
+		},
+	}
+	bf, err := tf.Verify(context.Background(), dir)
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0xc0}, bf)
+}
+
+func TestVerifySingleFile(t *testing.T) {
+	content := make([]byte, 40*1024)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "content.bin")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	tf, err := Create(path, WithPieceLength(16*1024))
+	require.Nil(t, err)
+
+	bf, err := tf.Verify(context.Background(), path)
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0xe0}, bf)
+
+	// A truncated file misses its last pieces
+	require.Nil(t, os.Truncate(path, 20*1024))
+	bf, err = tf.Verify(context.Background(), path)
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0x80}, bf)
+}
+
+func TestRecheck(t *testing.T) {
+	content := []byte("rechecked download")
+	torrent := completeTorrent(content)
+	path := filepath.Join(t.TempDir(), "file")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+	r := newResumeFile(path, torrent.InfoHash, len(torrent.PieceHashes))
+	r.uploaded = 7
+	require.Nil(t, r.save())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := torrent.Recheck(ctx, path)
+	assert.Equal(t, context.Canceled, err)
+
+	// The intact pieces are recorded with the files, and the traffic kept
+	bf, err := torrent.Recheck(context.Background(), path)
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0xc0}, bf)
+	loaded := newResumeFile(path, torrent.InfoHash, len(torrent.PieceHashes))
+	require.True(t, loaded.load())
+	assert.Equal(t, bf, loaded.bf)
+	assert.Equal(t, int64(7), loaded.uploaded)
+	assert.True(t, loaded.unchanged(&torrent, path))
+
+	// The next download trusts them, with no peer to download from
+	err = torrent.DownloadToFile(context.Background(), path, WithPeers([]peer.Peer{}), WithRandom(bytes.NewReader(make([]byte, 20))))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,177 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/leonhfr/torrent-client/bencode"
+)
+
+// ErrScrapeUnsupported is returned when scraping an HTTP tracker whose
+// announce URL does not follow the scrape convention
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// udpMaxScrape is the most info hashes scraped by a UDP request, whose
+// response must fit in a packet (BEP 15)
+const udpMaxScrape = 74
+
+// ScrapeResponse holds the statistics of a torrent returned by a scrape
+type ScrapeResponse struct {
+	Complete   int // number of seeders
+	Incomplete int // number of leechers
+	Downloaded int // number of completed downloads
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+	Downloaded int `bencode:"downloaded"`
+}
+
+type bencodeScrapeResp struct {
+	Failure string                       `bencode:"failure reason"`
+	Files   map[string]bencodeScrapeFile `bencode:"files"`
+}
+
+// ScrapeURL builds the URL scraping the torrents of infoHashes from an HTTP
+// tracker. By convention, it is the announce URL with the "announce" starting
+// its last path segment replaced with "scrape".
+func ScrapeURL(announce string, infoHashes ...[20]byte) (string, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndexByte(base.Path, '/')
+	if !strings.HasPrefix(base.Path[i+1:], "announce") {
+		return "", fmt.Errorf("%w: %s", ErrScrapeUnsupported, announce)
+	}
+	base.Path = base.Path[:i+1] + "scrape" + strings.TrimPrefix(base.Path[i+1:], "announce")
+	params := base.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
+
+// Scrape asks a tracker for the statistics of the torrents of infoHashes,
+// without announcing. The torrents unknown to the tracker are missing from
+// the result. The protocol is chosen from the scheme of the announce URL.
+func Scrape(ctx context.Context, announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResponse, error) {
+	return ScrapeWithDialer(ctx, nil, announce, infoHashes...)
+}
+
+// ScrapeWithDialer scrapes a tracker as Scrape does, dialing it with d if not
+// nil. UDP trackers are not scraped with a dialer.
+func ScrapeWithDialer(ctx context.Context, d Dialer, announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResponse, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, d, announce, infoHashes)
+	case "udp":
+		if d != nil {
+			return nil, ErrUDPDialer
+		}
+		return scrapeUDP(ctx, u.Host, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// scrapeHTTP scrapes an HTTP tracker
+func scrapeHTTP(ctx context.Context, d Dialer, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResponse, error) {
+	url, err := ScrapeURL(announce, infoHashes...)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("User-Agent", UserAgent)
+
+	resp, err := httpClient(d).Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	scrapeResp := bencodeScrapeResp{}
+	err = bencode.Unmarshal(body, &scrapeResp)
+	if err != nil {
+		return nil, err
+	}
+	if scrapeResp.Failure != "" {
+		return nil, fmt.Errorf("%w: %s", ErrTrackerFailure, scrapeResp.Failure)
+	}
+
+	stats := make(map[[20]byte]ScrapeResponse, len(scrapeResp.Files))
+	for key, f := range scrapeResp.Files {
+		if len(key) != 20 {
+			continue
+		}
+		var h [20]byte
+		copy(h[:], key)
+		stats[h] = ScrapeResponse(f)
+	}
+	return stats, nil
+}
+
+// scrapeUDP scrapes a UDP tracker at host, udpMaxScrape info hashes at a time
+func scrapeUDP(ctx context.Context, host string, infoHashes [][20]byte) (map[[20]byte]ScrapeResponse, error) {
+	stats := make(map[[20]byte]ScrapeResponse, len(infoHashes))
+	err := udpConnect(ctx, host, func(conn net.Conn, connID uint64) error {
+		for len(infoHashes) > 0 {
+			batch := infoHashes
+			if len(batch) > udpMaxScrape {
+				batch = batch[:udpMaxScrape]
+			}
+			infoHashes = infoHashes[len(batch):]
+
+			res, err := udpTransact(ctx, conn, udpActionScrape, func(tid uint32) []byte {
+				packet := make([]byte, 16, 16+20*len(batch))
+				binary.BigEndian.PutUint64(packet[0:8], connID)
+				binary.BigEndian.PutUint32(packet[8:12], udpActionScrape)
+				binary.BigEndian.PutUint32(packet[12:16], tid)
+				for _, h := range batch {
+					packet = append(packet, h[:]...)
+				}
+				return packet
+			})
+			if err != nil {
+				return err
+			}
+			if len(res) < 12*len(batch) {
+				return fmt.Errorf("received malformed scrape response of length %d", len(res))
+			}
+			for i, h := range batch {
+				stat := res[12*i:]
+				stats[h] = ScrapeResponse{
+					Complete:   int(binary.BigEndian.Uint32(stat[0:4])),
+					Downloaded: int(binary.BigEndian.Uint32(stat[4:8])),
+					Incomplete: int(binary.BigEndian.Uint32(stat[8:12])),
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeURL(t *testing.T) {
+	hash := [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+	tests := map[string]struct {
+		input  string
+		output string
+		err    error
+	}{
+		"announce":        {"http://example.com/announce", "http://example.com/scrape?info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6", nil},
+		"announce suffix": {"http://example.com/x/announce.php", "http://example.com/x/scrape.php?info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6", nil},
+		"query":           {"http://example.com/announce?passkey=abc", "http://example.com/scrape?info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&passkey=abc", nil},
+		"other path":      {"http://example.com/a", "", ErrScrapeUnsupported},
+		"not last":        {"http://example.com/announce/x", "", ErrScrapeUnsupported},
+		"no path":         {"http://example.com", "", ErrScrapeUnsupported},
+	}
+
+	for name, test := range tests {
+		output, err := ScrapeURL(test.input, hash)
+		assert.True(t, errors.Is(err, test.err), name)
+		assert.Equal(t, test.output, output, name)
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	hash1 := [20]byte{1}
+	hash2 := [20]byte{2}
+	var query []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrape", r.URL.Path)
+		assert.Equal(t, UserAgent, r.UserAgent())
+		query = r.URL.Query()["info_hash"]
+		w.Write([]byte(
+			"d5:filesd" +
+				"20:" + string(hash1[:]) + "d8:completei5e10:downloadedi50e10:incompletei10ee" +
+				"ee"))
+	}))
+	defer ts.Close()
+
+	stats, err := Scrape(context.Background(), ts.URL+"/announce", hash1, hash2)
+	require.Nil(t, err)
+	assert.Equal(t, []string{string(hash1[:]), string(hash2[:])}, query)
+	assert.Equal(t, map[[20]byte]ScrapeResponse{
+		hash1: {Complete: 5, Incomplete: 10, Downloaded: 50},
+	}, stats)
+}
+
+func TestScrapeWithDialer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:filesdee"))
+	}))
+	defer ts.Close()
+
+	d := &recordingDialer{}
+	stats, err := ScrapeWithDialer(context.Background(), d, ts.URL+"/announce", [20]byte{1})
+	require.Nil(t, err)
+	assert.Empty(t, stats)
+	assert.Equal(t, []string{ts.Listener.Addr().String()}, d.addresses)
+
+	_, err = ScrapeWithDialer(context.Background(), d, "udp://127.0.0.1:6969", [20]byte{1})
+	assert.True(t, errors.Is(err, ErrUDPDialer))
+}
+
+func TestScrapeHTTPFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason9:forbiddene"))
+	}))
+	defer ts.Close()
+
+	_, err := Scrape(context.Background(), ts.URL+"/announce", [20]byte{})
+	assert.True(t, errors.Is(err, ErrTrackerFailure))
+}
+
+func TestScrapeUDP(t *testing.T) {
+	defer func(timeout time.Duration) { udpTimeout = timeout }(udpTimeout)
+	udpTimeout = 20 * time.Millisecond
+
+	ft := newFakeUDPTracker(t)
+	go ft.serve()
+
+	// more hashes than fit in a request
+	hashes := make([][20]byte, udpMaxScrape+6)
+	expected := make(map[[20]byte]ScrapeResponse)
+	for i := range hashes {
+		hashes[i] = [20]byte{byte(i), byte(2 * i), byte(3 * i)}
+		expected[hashes[i]] = ScrapeResponse{Complete: i, Downloaded: int(byte(2 * i)), Incomplete: int(byte(3 * i))}
+	}
+
+	stats, err := Scrape(context.Background(), ft.url(), hashes...)
+	require.Nil(t, err)
+	assert.Equal(t, expected, stats)
+}
+
+func TestScrapeUnsupportedScheme(t *testing.T) {
+	_, err := Scrape(context.Background(), "wss://tracker.example.com/announce", [20]byte{})
+	assert.NotNil(t, err)
+}
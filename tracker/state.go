@@ -0,0 +1,122 @@
+package tracker
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// State remembers the last announce to a tracker across restarts, so that we
+// do not announce again before the interval it asked for
+type State struct {
+	LastAnnounce time.Time
+	Interval     int
+	MinInterval  int
+	TrackerID    string
+	Peers        []peer.Peer // last known good peers
+	Complete     int         // number of seeders last reported
+	Incomplete   int         // number of leechers last reported
+}
+
+type bencodeState struct {
+	LastAnnounce int64  `bencode:"last announce"`
+	Interval     int    `bencode:"interval"`
+	MinInterval  int    `bencode:"min interval"`
+	TrackerID    string `bencode:"tracker id"`
+	Peers        string `bencode:"peers"`
+	Complete     int    `bencode:"complete,omitempty"`
+	Incomplete   int    `bencode:"incomplete,omitempty"`
+}
+
+// Update records a successful announce
+func (s *State) Update(resp AnnounceResponse, now time.Time) {
+	s.LastAnnounce = now
+	s.Interval = resp.Interval
+	s.MinInterval = resp.MinInterval
+	s.Complete, s.Incomplete = resp.Complete, resp.Incomplete
+	if resp.TrackerID != "" {
+		s.TrackerID = resp.TrackerID
+	}
+	if len(resp.Peers) > 0 {
+		s.Peers = resp.Peers
+	}
+}
+
+// NextAnnounce returns when the tracker can be announced to again, after the
+// interval it asked for but never before the min interval
+func (s *State) NextAnnounce() time.Time {
+	interval := s.Interval
+	if s.MinInterval > interval {
+		interval = s.MinInterval
+	}
+	return s.LastAnnounce.Add(time.Duration(interval) * time.Second)
+}
+
+// Save writes the state
+func (s *State) Save(w io.Writer) error {
+	return bencode.NewEncoder(w).Encode(bencodeState{
+		LastAnnounce: s.LastAnnounce.Unix(),
+		Interval:     s.Interval,
+		MinInterval:  s.MinInterval,
+		TrackerID:    s.TrackerID,
+		Peers:        string(peer.Marshal(s.Peers)),
+		Complete:     s.Complete,
+		Incomplete:   s.Incomplete,
+	})
+}
+
+// LoadState reads a state written by Save
+func LoadState(r io.Reader) (State, error) {
+	bs := bencodeState{}
+	err := bencode.NewDecoder(r).Decode(&bs)
+	if err != nil {
+		return State{}, err
+	}
+	peers, err := peer.Unmarshal([]byte(bs.Peers))
+	if err != nil {
+		return State{}, err
+	}
+	return State{
+		LastAnnounce: time.Unix(bs.LastAnnounce, 0),
+		Interval:     bs.Interval,
+		MinInterval:  bs.MinInterval,
+		TrackerID:    bs.TrackerID,
+		Peers:        peers,
+		Complete:     bs.Complete,
+		Incomplete:   bs.Incomplete,
+	}, nil
+}
+
+// SaveFile writes the state to a file, replacing it atomically
+func (s *State) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = s.Save(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadStateFile reads a state from a file written by SaveFile
+func LoadStateFile(path string) (State, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return State{}, err
+	}
+	defer file.Close()
+	return LoadState(file)
+}
@@ -0,0 +1,52 @@
+package tracker
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateUpdate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := State{TrackerID: "abc"}
+	s.Update(AnnounceResponse{Interval: 900, Complete: 3, Incomplete: 4}, now)
+
+	assert.Equal(t, "abc", s.TrackerID)
+	assert.Equal(t, 3, s.Complete)
+	assert.Equal(t, 4, s.Incomplete)
+	assert.Equal(t, now.Add(900*time.Second), s.NextAnnounce())
+
+	// The min interval wins over a shorter interval
+	s.Update(AnnounceResponse{Interval: 60, MinInterval: 300}, now)
+	assert.Equal(t, now.Add(300*time.Second), s.NextAnnounce())
+}
+
+func TestStateSaveLoad(t *testing.T) {
+	s := State{
+		LastAnnounce: time.Unix(1000, 0),
+		Interval:     900,
+		MinInterval:  300,
+		TrackerID:    "abc",
+		Peers:        []peer.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}},
+		Complete:     3,
+		Incomplete:   4,
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, s.Save(&buf))
+	loaded, err := LoadState(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, s, loaded)
+
+	path := filepath.Join(t.TempDir(), "tracker.dat")
+	require.Nil(t, s.SaveFile(path))
+	loaded, err = LoadStateFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, s, loaded)
+}
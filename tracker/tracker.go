@@ -0,0 +1,212 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/leonhfr/torrent-client/bencode"
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// ErrTrackerFailure is returned when a tracker rejects an announce, with the
+// reason it gave. Announcing again the same request is likely to fail too.
+var ErrTrackerFailure = errors.New("tracker failure")
+
+// ErrUDPDialer is returned when announcing to or scraping a UDP tracker with
+// a Dialer, which only routes TCP connections. The tracker is not contacted
+// so that no traffic bypasses the dialer.
+var ErrUDPDialer = errors.New("UDP trackers cannot be reached through a dialer")
+
+// Dialer establishes the TCP connections with HTTP trackers, e.g. through a
+// proxy such as proxy.SOCKS5
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// UserAgent is sent with the requests to HTTP trackers
+const UserAgent = peer.ClientName + "/" + peer.ClientVersion
+
+// Events sent to the tracker, regular announces have no event
+const (
+	EventStarted   = "started"   // EventStarted is sent by the first announce
+	EventCompleted = "completed" // EventCompleted is sent when the download completes
+	EventStopped   = "stopped"   // EventStopped is sent when shutting down
+	// EventPaused is sent instead of regular announces by partial seeds,
+	// which have every piece of the files they want but not the others
+	// (BEP 21). UDP trackers get regular announces, having no such event.
+	EventPaused = "paused"
+)
+
+// AnnounceRequest holds the parameters of an announce
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      string
+	TrackerID  string // echoes the tracker id of a previous response
+	Dialer     Dialer // dials the tracker, directly if nil
+}
+
+// AnnounceResponse holds the swarm information returned by a tracker
+type AnnounceResponse struct {
+	Interval       int         // seconds to wait between announces
+	MinInterval    int         // seconds to wait at least between announces, if set
+	Peers          []peer.Peer // peers to connect to, IPv4 then IPv6 ones
+	Complete       int         // number of seeders
+	Incomplete     int         // number of leechers
+	TrackerID      string      // to send back in the next announces
+	WarningMessage string      // non-fatal message, the announce still succeeded
+}
+
+type bencodeTrackerResp struct {
+	Failure     string `bencode:"failure reason"`
+	Interval    int    `bencode:"interval"`
+	MinInterval int    `bencode:"min interval"`
+	// Peers is the compact string, or a list in the dictionary model
+	Peers      bencode.RawMessage `bencode:"peers"`
+	Peers6     string             `bencode:"peers6"`
+	Complete   int                `bencode:"complete"`
+	Incomplete int                `bencode:"incomplete"`
+	TrackerID  string             `bencode:"tracker id"`
+	Warning    string             `bencode:"warning message"`
+}
+
+// decodePeers decodes the peers of a response, a compact string or a list of
+// dictionaries
+func decodePeers(ctx context.Context, raw bencode.RawMessage) ([]peer.Peer, error) {
+	if len(raw) > 0 && raw[0] == 'l' {
+		var dicts []peer.Dict
+		err := bencode.Unmarshal(raw, &dicts)
+		if err != nil {
+			return nil, err
+		}
+		return peer.FromDicts(ctx, dicts, nil)
+	}
+	var compact string
+	if len(raw) > 0 {
+		err := bencode.Unmarshal(raw, &compact)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return peer.Unmarshal([]byte(compact))
+}
+
+// BuildURL builds the URL announcing a request to a tracker
+func BuildURL(announce string, req AnnounceRequest) (string, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"info_hash":  []string{string(req.InfoHash[:])},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.Itoa(req.Uploaded)},
+		"downloaded": []string{strconv.Itoa(req.Downloaded)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.Itoa(req.Left)},
+	}
+	if req.Event != "" {
+		params.Set("event", req.Event)
+	}
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
+
+// Announce announces a request to a tracker and returns the swarm information.
+// The protocol is chosen from the scheme of the announce URL.
+func Announce(ctx context.Context, announce string, req AnnounceRequest) (AnnounceResponse, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, announce, req)
+	case "udp":
+		if req.Dialer != nil {
+			return AnnounceResponse{}, ErrUDPDialer
+		}
+		return announceUDP(ctx, u.Host, req)
+	default:
+		return AnnounceResponse{}, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// httpClient returns the client of the requests to HTTP trackers, dialing
+// with d if not nil
+func httpClient(d Dialer) *http.Client {
+	c := &http.Client{Timeout: 15 * time.Second}
+	if d != nil {
+		c.Transport = &http.Transport{DialContext: d.DialContext}
+	}
+	return c
+}
+
+// announceHTTP announces a request to an HTTP tracker
+func announceHTTP(ctx context.Context, announce string, req AnnounceRequest) (AnnounceResponse, error) {
+	url, err := BuildURL(announce, req)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	httpReq.Header.Set("User-Agent", UserAgent)
+
+	resp, err := httpClient(req.Dialer).Do(httpReq)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	trackerResp := bencodeTrackerResp{}
+	err = bencode.Unmarshal(body, &trackerResp)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	if trackerResp.Failure != "" {
+		return AnnounceResponse{}, fmt.Errorf("%w: %s", ErrTrackerFailure, trackerResp.Failure)
+	}
+
+	peers, err := decodePeers(ctx, trackerResp.Peers)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	// IPv6 peers are listed apart (BEP 7)
+	peers6, err := peer.Unmarshal6([]byte(trackerResp.Peers6))
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	peers = append(peers, peers6...)
+
+	return AnnounceResponse{
+		Interval:       trackerResp.Interval,
+		MinInterval:    trackerResp.MinInterval,
+		Peers:          peers,
+		Complete:       trackerResp.Complete,
+		Incomplete:     trackerResp.Incomplete,
+		TrackerID:      trackerResp.TrackerID,
+		WarningMessage: trackerResp.Warning,
+	}, nil
+}
@@ -0,0 +1,163 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildURL(t *testing.T) {
+	req := AnnounceRequest{
+		InfoHash:   [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		PeerID:     [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		Port:       6882,
+		Uploaded:   1024,
+		Downloaded: 2048,
+		Left:       0,
+		Event:      EventStarted,
+	}
+	url, err := BuildURL("http://bttracker.debian.org:6969/announce", req)
+	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=2048&event=started&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=0&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6882&uploaded=1024"
+	assert.Nil(t, err)
+	assert.Equal(t, expected, url)
+}
+
+func TestAnnounce(t *testing.T) {
+	var query, userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		userAgent = r.UserAgent()
+		response := []byte(
+			"d" +
+				"8:complete" + "i12e" +
+				"10:incomplete" + "i34e" +
+				"8:interval" + "i900e" +
+				"12:min interval" + "i300e" +
+				"10:tracker id" + "3:abc" +
+				"15:warning message" + "12:out of date!" +
+				"5:peers" + "6:" +
+				string([]byte{
+					192, 0, 2, 123, 0x1A, 0xE1, // 0x1AE1 = 6881
+				}) + "e")
+		w.Write(response)
+	}))
+	defer ts.Close()
+
+	req := AnnounceRequest{Port: 6881, Left: 42, TrackerID: "xyz"}
+	expected := AnnounceResponse{
+		Interval:       900,
+		MinInterval:    300,
+		Peers:          []peer.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}},
+		Complete:       12,
+		Incomplete:     34,
+		TrackerID:      "abc",
+		WarningMessage: "out of date!",
+	}
+	resp, err := Announce(context.Background(), ts.URL, req)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, resp)
+	assert.Contains(t, query, "left=42")
+	assert.Contains(t, query, "trackerid=xyz")
+	assert.Equal(t, "torrent-client/0.1.0", userAgent)
+}
+
+func TestAnnounceFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason20:unregistered torrente"))
+	}))
+	defer ts.Close()
+
+	_, err := Announce(context.Background(), ts.URL, AnnounceRequest{})
+	assert.True(t, errors.Is(err, ErrTrackerFailure))
+	assert.Contains(t, err.Error(), "unregistered torrent")
+}
+
+// recordingDialer dials directly, recording the addresses dialed
+type recordingDialer struct {
+	addresses []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.addresses = append(d.addresses, address)
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+func TestAnnounceDialer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	d := &recordingDialer{}
+	resp, err := Announce(context.Background(), ts.URL, AnnounceRequest{Dialer: d})
+	require.Nil(t, err)
+	assert.Equal(t, 900, resp.Interval)
+	assert.Equal(t, []string{ts.Listener.Addr().String()}, d.addresses)
+}
+
+func TestAnnounceUDPDialer(t *testing.T) {
+	d := &recordingDialer{}
+	_, err := Announce(context.Background(), "udp://127.0.0.1:6969", AnnounceRequest{Dialer: d})
+	assert.True(t, errors.Is(err, ErrUDPDialer))
+	assert.Empty(t, d.addresses)
+}
+
+func TestAnnouncePeers6(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := []byte(
+			"d" +
+				"8:interval" + "i900e" +
+				"5:peers" + "6:" + string([]byte{192, 0, 2, 123, 0x1A, 0xE1}) +
+				"6:peers6" + "18:" + string([]byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE9, // 0x1AE9 = 6889
+			}) + "e")
+		w.Write(response)
+	}))
+	defer ts.Close()
+
+	resp, err := Announce(context.Background(), ts.URL, AnnounceRequest{Port: 6881})
+	require.Nil(t, err)
+	assert.Equal(t, []peer.Peer{
+		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6889},
+	}, resp.Peers)
+	assert.Equal(t, "[2001:db8::1]:6889", resp.Peers[1].String())
+}
+
+func TestAnnounceMalformedPeers6(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers0:6:peers65:abcdee"))
+	}))
+	defer ts.Close()
+
+	_, err := Announce(context.Background(), ts.URL, AnnounceRequest{Port: 6881})
+	assert.NotNil(t, err)
+}
+
+func TestAnnounceDictPeers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peersl" +
+			"d7:peer id20:-TR2940-abcdefghijkl2:ip11:192.0.2.1234:porti6881ee" +
+			"d7:peer id20:-TR2940-mnopqrstuvwx2:ip11:2001:db8::14:porti6889ee" +
+			"d7:peer id20:-TR2940-yz01234567892:ip9:localhost4:porti6890ee" +
+			"ee"))
+	}))
+	defer ts.Close()
+
+	resp, err := Announce(context.Background(), ts.URL, AnnounceRequest{Port: 6881})
+	require.Nil(t, err)
+	assert.Equal(t, 900, resp.Interval)
+	require.Len(t, resp.Peers, 3)
+	assert.Equal(t, peer.Peer{IP: net.IP{192, 0, 2, 123}, Port: 6881}, resp.Peers[0])
+	assert.Equal(t, peer.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6889}, resp.Peers[1])
+	assert.True(t, resp.Peers[2].IP.IsLoopback())
+	assert.Equal(t, uint16(6890), resp.Peers[2].Port)
+}
@@ -0,0 +1,198 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+)
+
+// UDP tracker protocol, as specified by BEP 15
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// The n-th retransmission of a UDP request waits udpTimeout * 2^n for the
+// response, until udpMaxRetries retransmissions are done
+var (
+	udpTimeout    = 15 * time.Second
+	udpMaxRetries = 8
+)
+
+// udpMaxPacketSize is the size of the largest UDP datagram, so that long
+// lists of peers are not truncated
+const udpMaxPacketSize = 64 << 10
+
+// ErrNoResponse is returned when a UDP tracker answers none of the retransmissions
+var ErrNoResponse = errors.New("tracker did not respond")
+
+var udpEvents = map[string]uint32{
+	"":             0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+func randomUint32() (uint32, error) {
+	var b [4]byte
+	_, err := rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:]), err
+}
+
+// udpTransact sends a request until the response with the same transaction
+// ID is received, and returns the payload following the header
+func udpTransact(ctx context.Context, conn net.Conn, action uint32, build func(tid uint32) []byte) ([]byte, error) {
+	tid, err := randomUint32()
+	if err != nil {
+		return nil, err
+	}
+	packet := build(tid)
+
+	buf := make([]byte, udpMaxPacketSize)
+	for n := 0; n <= udpMaxRetries; n++ {
+		_, err := conn.Write(packet)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(udpTimeout << n))
+		// Checked after setting the deadline, which could override the interruption
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		for {
+			size, err := conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				break // retransmit
+			}
+			if err != nil {
+				return nil, err
+			}
+			if size < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+				continue // stale or malformed response
+			}
+			switch binary.BigEndian.Uint32(buf[0:4]) {
+			case action:
+				return append([]byte(nil), buf[8:size]...), nil
+			case udpActionError:
+				return nil, fmt.Errorf("%w: %s", ErrTrackerFailure, buf[8:size])
+			default:
+				return nil, fmt.Errorf("unexpected action %d in response", binary.BigEndian.Uint32(buf[0:4]))
+			}
+		}
+	}
+	return nil, ErrNoResponse
+}
+
+// udpConnect dials the UDP tracker at host and obtains a connection ID, then
+// calls f with them. Canceling ctx interrupts the transactions of f.
+func udpConnect(ctx context.Context, host string, f func(conn net.Conn, connID uint64) error) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Expiring the deadline interrupts the transaction in progress
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	res, err := udpTransact(ctx, conn, udpActionConnect, func(tid uint32) []byte {
+		packet := make([]byte, 16)
+		binary.BigEndian.PutUint64(packet[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(packet[8:12], udpActionConnect)
+		binary.BigEndian.PutUint32(packet[12:16], tid)
+		return packet
+	})
+	if err != nil {
+		return err
+	}
+	if len(res) < 8 {
+		return fmt.Errorf("received malformed connect response of length %d", len(res))
+	}
+	return f(conn, binary.BigEndian.Uint64(res[0:8]))
+}
+
+// announceUDP announces a request to a UDP tracker at host
+func announceUDP(ctx context.Context, host string, req AnnounceRequest) (AnnounceResponse, error) {
+	var resp AnnounceResponse
+	err := udpConnect(ctx, host, func(conn net.Conn, connID uint64) error {
+		var err error
+		resp, err = announceUDPConn(ctx, conn, connID, req)
+		return err
+	})
+	return resp, err
+}
+
+// announceUDPConn announces a request on a connection to a UDP tracker
+func announceUDPConn(ctx context.Context, conn net.Conn, connID uint64, req AnnounceRequest) (AnnounceResponse, error) {
+	key, err := randomUint32()
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	res, err := udpTransact(ctx, conn, udpActionAnnounce, func(tid uint32) []byte {
+		packet := make([]byte, 98)
+		binary.BigEndian.PutUint64(packet[0:8], connID)
+		binary.BigEndian.PutUint32(packet[8:12], udpActionAnnounce)
+		binary.BigEndian.PutUint32(packet[12:16], tid)
+		copy(packet[16:36], req.InfoHash[:])
+		copy(packet[36:56], req.PeerID[:])
+		binary.BigEndian.PutUint64(packet[56:64], uint64(req.Downloaded))
+		binary.BigEndian.PutUint64(packet[64:72], uint64(req.Left))
+		binary.BigEndian.PutUint64(packet[72:80], uint64(req.Uploaded))
+		binary.BigEndian.PutUint32(packet[80:84], udpEvents[req.Event])
+		// IP address 0 lets the tracker use the sender's
+		binary.BigEndian.PutUint32(packet[88:92], key)
+		binary.BigEndian.PutUint32(packet[92:96], 0xffffffff) // default number of peers
+		binary.BigEndian.PutUint16(packet[96:98], req.Port)
+		return packet
+	})
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	if len(res) < 12 {
+		return AnnounceResponse{}, fmt.Errorf("received malformed announce response of length %d", len(res))
+	}
+
+	peers, err := unmarshalUDPPeers(res[12:], conn.RemoteAddr())
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	return AnnounceResponse{
+		Interval:   int(binary.BigEndian.Uint32(res[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(res[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(res[8:12])),
+		Peers:      peers,
+	}, nil
+}
+
+// unmarshalUDPPeers parses the peers of an announce response, which are IPv6
+// addresses when the tracker is reached over IPv6
+func unmarshalUDPPeers(peersBin []byte, tracker net.Addr) ([]peer.Peer, error) {
+	addr, ok := tracker.(*net.UDPAddr)
+	if !ok || addr.IP.To4() != nil {
+		return peer.Unmarshal(peersBin)
+	}
+	return peer.Unmarshal6(peersBin)
+}
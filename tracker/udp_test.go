@@ -0,0 +1,196 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonhfr/torrent-client/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUDPTracker answers connect, announce and scrape requests. It drops the first
+// drop packets and sends a response with a wrong transaction ID before each
+// response if stale is set.
+type fakeUDPTracker struct {
+	conn     net.PacketConn
+	drop     int
+	stale    bool
+	failure  string
+	peers    int         // peers answered besides the first one
+	announce chan []byte // announce requests received
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &fakeUDPTracker{conn: conn, announce: make(chan []byte, 16)}
+}
+
+func (ft *fakeUDPTracker) url() string {
+	return "udp://" + ft.conn.LocalAddr().String() + "/announce"
+}
+
+func (ft *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := ft.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if ft.drop > 0 {
+			ft.drop--
+			continue
+		}
+		tid := binary.BigEndian.Uint32(buf[12:16])
+
+		var res []byte
+		switch binary.BigEndian.Uint32(buf[8:12]) {
+		case udpActionConnect:
+			res = make([]byte, 16)
+			binary.BigEndian.PutUint32(res[0:4], udpActionConnect)
+			binary.BigEndian.PutUint64(res[8:16], 0xc0ffee)
+		case udpActionAnnounce:
+			ft.announce <- append([]byte(nil), buf[:n]...)
+			if ft.failure != "" {
+				res = make([]byte, 8+len(ft.failure))
+				binary.BigEndian.PutUint32(res[0:4], udpActionError)
+				copy(res[8:], ft.failure)
+				break
+			}
+			res = make([]byte, 20)
+			binary.BigEndian.PutUint32(res[0:4], udpActionAnnounce)
+			binary.BigEndian.PutUint32(res[8:12], 900)
+			binary.BigEndian.PutUint32(res[12:16], 34)
+			binary.BigEndian.PutUint32(res[16:20], 12)
+			res = append(res, 192, 0, 2, 123, 0x1A, 0xE1)
+			for i := 0; i < ft.peers; i++ {
+				res = append(res, 198, 51, byte(i>>8), byte(i), 0x1A, 0xE1)
+			}
+		case udpActionScrape:
+			// the statistics of a torrent are the first bytes of its hash
+			res = make([]byte, 8)
+			binary.BigEndian.PutUint32(res[0:4], udpActionScrape)
+			for i := 16; i+20 <= n; i += 20 {
+				res = append(res, 0, 0, 0, buf[i], 0, 0, 0, buf[i+1], 0, 0, 0, buf[i+2])
+			}
+		}
+		if ft.stale {
+			binary.BigEndian.PutUint32(res[4:8], tid+1)
+			ft.conn.WriteTo(res, addr)
+		}
+		binary.BigEndian.PutUint32(res[4:8], tid)
+		ft.conn.WriteTo(res, addr)
+	}
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	defer func(timeout time.Duration) { udpTimeout = timeout }(udpTimeout)
+	udpTimeout = 20 * time.Millisecond
+
+	tests := map[string]struct {
+		drop  int
+		stale bool
+	}{
+		"tracker responds":            {},
+		"tracker drops packets":       {drop: 2},
+		"tracker sends stale packets": {stale: true},
+	}
+
+	req := AnnounceRequest{
+		InfoHash:   [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		PeerID:     [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		Port:       6881,
+		Uploaded:   1024,
+		Downloaded: 2048,
+		Left:       42,
+		Event:      EventStarted,
+	}
+	expected := AnnounceResponse{
+		Interval:   900,
+		Peers:      []peer.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}},
+		Complete:   12,
+		Incomplete: 34,
+	}
+
+	for name, test := range tests {
+		ft := newFakeUDPTracker(t)
+		ft.drop, ft.stale = test.drop, test.stale
+		go ft.serve()
+
+		resp, err := Announce(context.Background(), ft.url(), req)
+		require.Nil(t, err, name)
+		assert.Equal(t, expected, resp, name)
+
+		packet := <-ft.announce
+		require.Len(t, packet, 98, name)
+		assert.Equal(t, uint64(0xc0ffee), binary.BigEndian.Uint64(packet[0:8]), name)
+		assert.Equal(t, req.InfoHash[:], packet[16:36], name)
+		assert.Equal(t, req.PeerID[:], packet[36:56], name)
+		assert.Equal(t, uint64(2048), binary.BigEndian.Uint64(packet[56:64]), name)
+		assert.Equal(t, uint64(42), binary.BigEndian.Uint64(packet[64:72]), name)
+		assert.Equal(t, uint64(1024), binary.BigEndian.Uint64(packet[72:80]), name)
+		assert.Equal(t, uint32(2), binary.BigEndian.Uint32(packet[80:84]), name)
+		assert.Equal(t, uint16(6881), binary.BigEndian.Uint16(packet[96:98]), name)
+	}
+}
+
+func TestAnnounceUDPManyPeers(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	ft.peers = 1000
+	go ft.serve()
+
+	// The response is larger than a typical MTU
+	resp, err := Announce(context.Background(), ft.url(), AnnounceRequest{})
+	require.Nil(t, err)
+	require.Len(t, resp.Peers, 1001)
+	assert.Equal(t, peer.Peer{IP: net.IP{198, 51, 3, 231}, Port: 6881}, resp.Peers[1000])
+}
+
+func TestAnnounceUDPError(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	ft.failure = "unregistered torrent"
+	go ft.serve()
+
+	_, err := Announce(context.Background(), ft.url(), AnnounceRequest{})
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrTrackerFailure))
+	assert.Contains(t, err.Error(), "unregistered torrent")
+}
+
+func TestAnnounceUDPNoResponse(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		udpTimeout, udpMaxRetries = timeout, retries
+	}(udpTimeout, udpMaxRetries)
+	udpTimeout, udpMaxRetries = 5*time.Millisecond, 2
+
+	ft := newFakeUDPTracker(t)
+	ft.drop = 3
+	go ft.serve()
+
+	_, err := Announce(context.Background(), ft.url(), AnnounceRequest{})
+	assert.ErrorIs(t, err, ErrNoResponse)
+}
+
+func TestAnnounceUDPCancel(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+	ft.drop = 1
+	go ft.serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Announce(ctx, ft.url(), AnnounceRequest{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestAnnounceUnsupportedScheme(t *testing.T) {
+	_, err := Announce(context.Background(), "wss://tracker.example.com/announce", AnnounceRequest{})
+	assert.NotNil(t, err)
+}
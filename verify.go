@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/leonhfr/torrent-client/torrentfile"
+)
+
+// runVerify hashes the data of a torrent and prints how many of its pieces
+// are intact, recording them in the resume file with -resume. It fails if
+// some are not.
+//
+//	torrent-client verify [flags] <path> <data>
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: torrent-client verify [flags] <path> <data>")
+		fs.PrintDefaults()
+	}
+	verbose := fs.Bool("v", false, "list the missing pieces")
+	resume := fs.Bool("resume", false, "record the intact pieces in the resume file next to the data, so that downloading the torrent there again trusts them")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected a torrent file and the path of its data")
+	}
+
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Interrupting the process stops hashing
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	verify := tf.Verify
+	if *resume {
+		verify = tf.Recheck
+	}
+	bf, err := verify(ctx, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	intact := 0
+	for i := range tf.PieceHashes {
+		if bf.HasPiece(i) {
+			intact++
+		} else if *verbose {
+			fmt.Printf("piece %d is missing\n", i)
+		}
+	}
+	fmt.Printf("%d of %d pieces intact\n", intact, len(tf.PieceHashes))
+	if intact < len(tf.PieceHashes) {
+		return fmt.Errorf("%d pieces missing", len(tf.PieceHashes)-intact)
+	}
+	return nil
+}